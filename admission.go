@@ -0,0 +1,158 @@
+package lsmtree
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// WritePriority decides which writes are held back first when the database cannot keep up with
+// them. See Options.MaxInFlightWrites.
+type WritePriority int
+
+const (
+	// WritePriorityNormal is the default priority for writes. Normal writes are held back once
+	// the database has Options.MaxInFlightWrites commits in progress.
+	WritePriorityNormal WritePriority = iota
+
+	// WritePriorityHigh writes are never held back. This is meant for small interactive writes
+	// that a user is waiting on.
+	WritePriorityHigh
+
+	// WritePriorityLow writes are held back once the database has half of
+	// Options.MaxInFlightWrites commits in progress, before any other writes are. This is meant
+	// for background work like imports and backfills that can take longer without anyone
+	// noticing. Load always writes with low priority.
+	WritePriorityLow
+)
+
+type (
+	// WriteAdmissionStats counts the writes that had to wait to be admitted. High priority writes
+	// never wait, so they are not counted.
+	WriteAdmissionStats struct {
+		ThrottledNormal uint64
+		ThrottledLow    uint64
+	}
+
+	// writeAdmission limits how many commits can be in the commit pipeline at once. When the
+	// pipeline is full, writes wait in order of their priority: low priority writes stop being
+	// admitted first, so that the latency of normal and high priority writes is protected.
+	writeAdmission struct {
+		lock sync.Mutex
+		cond *sync.Cond
+
+		// limit is the number of commits that can be in progress before normal priority writes
+		// wait. If this is 0 then writes are never held back.
+		limit int
+
+		// inFlight is the number of commits that have been admitted and have not finished yet.
+		inFlight int
+
+		// stopped is set once the database has been closed, anything waiting is woken up.
+		stopped bool
+
+		// throttled is the number of writes of each priority that had to wait, indexed by the
+		// priority. It is only modified atomically.
+		throttled [WritePriorityLow + 1]uint64
+	}
+)
+
+func newWriteAdmission(limit int) *writeAdmission {
+	admission := &writeAdmission{
+		limit: limit,
+	}
+	admission.cond = sync.NewCond(&admission.lock)
+
+	return admission
+}
+
+// Admit blocks until a write with the priority provided is allowed to start committing. Once the
+// commit has finished Release must be called. ErrClosed is returned if the database is closed
+// while waiting, Release must not be called in this case.
+func (a *writeAdmission) Admit(priority WritePriority) error {
+	if a.limit == 0 {
+		return nil
+	}
+
+	// Anything that is not a known priority is treated as normal.
+	if priority < WritePriorityNormal || priority > WritePriorityLow {
+		priority = WritePriorityNormal
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	limit := a.limitFor(priority)
+	if a.inFlight >= limit && !a.stopped {
+		atomic.AddUint64(&a.throttled[priority], 1)
+		for a.inFlight >= limit && !a.stopped {
+			a.cond.Wait()
+		}
+	}
+
+	if a.stopped {
+		return ErrClosed
+	}
+
+	a.inFlight++
+
+	return nil
+}
+
+// Release allows another write to be admitted.
+func (a *writeAdmission) Release() {
+	if a.limit == 0 {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.inFlight--
+
+	// Writes with different priorities wait on different limits, so every waiter needs to check.
+	a.cond.Broadcast()
+}
+
+// Stats returns the number of writes that have had to wait for each priority.
+func (a *writeAdmission) Stats() WriteAdmissionStats {
+	return WriteAdmissionStats{
+		ThrottledNormal: atomic.LoadUint64(&a.throttled[WritePriorityNormal]),
+		ThrottledLow:    atomic.LoadUint64(&a.throttled[WritePriorityLow]),
+	}
+}
+
+// Add returns the sum of the two sets of stats.
+func (s WriteAdmissionStats) Add(other WriteAdmissionStats) WriteAdmissionStats {
+	return WriteAdmissionStats{
+		ThrottledNormal: s.ThrottledNormal + other.ThrottledNormal,
+		ThrottledLow:    s.ThrottledLow + other.ThrottledLow,
+	}
+}
+
+// stop wakes up every write that is waiting to be admitted, and stops any new writes from being
+// admitted.
+func (a *writeAdmission) stop() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.stopped = true
+	a.cond.Broadcast()
+}
+
+// limitFor returns the number of commits that can be in progress when a write with the priority
+// provided is admitted.
+func (a *writeAdmission) limitFor(priority WritePriority) int {
+	switch priority {
+	case WritePriorityHigh:
+		// High priority writes are only limited by the pipeline itself.
+		return int(^uint(0) >> 1)
+	case WritePriorityLow:
+		if half := a.limit / 2; half > 0 {
+			return half
+		}
+
+		return 1
+	default:
+		return a.limit
+	}
+}
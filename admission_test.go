@@ -0,0 +1,103 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestWriteAdmission(t *testing.T) {
+	// admitted returns a channel that is closed once a write with the priority is admitted.
+	admit := func(a *writeAdmission, priority WritePriority) chan error {
+		result := make(chan error, 1)
+		go func() {
+			result <- a.Admit(priority)
+		}()
+		return result
+	}
+
+	waiting := func(t *testing.T, result chan error) {
+		select {
+		case <-result:
+			t.Fatal("write should be waiting")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	admitted := func(t *testing.T, result chan error) {
+		select {
+		case err := <-result:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for write to be admitted")
+		}
+	}
+
+	t.Run("unlimited", func(t *testing.T) {
+		a := newWriteAdmission(0)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, a.Admit(WritePriorityLow))
+		}
+		assert.Equal(t, WriteAdmissionStats{}, a.Stats())
+	})
+
+	t.Run("priorities", func(t *testing.T) {
+		a := newWriteAdmission(4)
+
+		// Low priority writes are held back once half of the limit is in progress.
+		assert.NoError(t, a.Admit(WritePriorityLow))
+		assert.NoError(t, a.Admit(WritePriorityNormal))
+		low := admit(a, WritePriorityLow)
+		waiting(t, low)
+
+		// Normal priority writes can still use the rest.
+		assert.NoError(t, a.Admit(WritePriorityNormal))
+		assert.NoError(t, a.Admit(WritePriorityNormal))
+		normal := admit(a, WritePriorityNormal)
+		waiting(t, normal)
+
+		// High priority writes are never held back.
+		assert.NoError(t, a.Admit(WritePriorityHigh))
+
+		a.Release()
+		a.Release()
+		admitted(t, normal)
+		waiting(t, low)
+
+		a.Release()
+		a.Release()
+		waiting(t, low)
+		a.Release()
+		admitted(t, low)
+
+		assert.Equal(t, WriteAdmissionStats{ThrottledNormal: 1, ThrottledLow: 1}, a.Stats())
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		a := newWriteAdmission(1)
+		assert.NoError(t, a.Admit(WritePriorityNormal))
+		normal := admit(a, WritePriorityNormal)
+		waiting(t, normal)
+
+		a.stop()
+		assert.Equal(t, ErrClosed, <-normal)
+		assert.Equal(t, ErrClosed, a.Admit(WritePriorityHigh))
+	})
+}
+
+func TestTxn_Priority(t *testing.T) {
+	options := DefaultOptions()
+	options.MaxInFlightWrites = 2
+	db, cleanup := newTestDB(t, options)
+	defer cleanup()
+
+	for _, priority := range []WritePriority{WritePriorityLow, WritePriorityNormal, WritePriorityHigh} {
+		txn, err := db.NewTransaction(TxnOptions{Priority: priority})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+		assert.NoError(t, txn.Commit())
+	}
+
+	options.MaxInFlightWrites = -1
+	assert.Error(t, options.validate())
+}
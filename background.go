@@ -0,0 +1,156 @@
+package lsmtree
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrBackgroundWorkNotPaused is returned by ResumeBackgroundWork when there is no matching
+	// call to PauseBackgroundWork.
+	ErrBackgroundWorkNotPaused = errors.New("background work is not paused")
+)
+
+// backgroundWork is used to gate work that the database does on its own, like flushing memtables
+// and compacting tables, so that it can be paused by the embedder. Each piece of background work
+// must call begin before it starts and end once it is done. Pausing will wait for any work that
+// has already started to finish, and will prevent any new work from starting until every pause
+// has been resumed.
+type backgroundWork struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// paused is the number of calls to pause that have not been resumed yet. Pauses can be nested
+	// so that independent callers do not resume each others work.
+	paused int
+
+	// running is the number of tasks that have called begin but have not called end.
+	running int
+
+	// stopped is set once the database has been closed. Nothing can begin after this point.
+	stopped bool
+}
+
+func newBackgroundWork() *backgroundWork {
+	work := &backgroundWork{}
+	work.cond = sync.NewCond(&work.lock)
+
+	return work
+}
+
+// begin will block until background work is allowed to run. If this returns false then the
+// database has been closed and the work should not be started. Otherwise end must be called once
+// the work has finished.
+func (b *backgroundWork) begin() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for b.paused > 0 && !b.stopped {
+		b.cond.Wait()
+	}
+
+	if b.stopped {
+		return false
+	}
+
+	b.running++
+
+	return true
+}
+
+// end marks a piece of work that was started with begin as finished.
+func (b *backgroundWork) end() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.running--
+	b.cond.Broadcast()
+}
+
+// pause prevents any new work from starting and waits for any work that is currently running to
+// finish.
+func (b *backgroundWork) pause() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.stopped {
+		return ErrClosed
+	}
+
+	b.paused++
+	for b.running > 0 {
+		b.cond.Wait()
+	}
+
+	return nil
+}
+
+// resume undoes a single call to pause. Work will only start again once every pause has been
+// resumed.
+func (b *backgroundWork) resume() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.paused == 0 {
+		return ErrBackgroundWorkNotPaused
+	}
+
+	b.paused--
+	b.cond.Broadcast()
+
+	return nil
+}
+
+// stop will wake anything that is waiting to begin and prevent any new work from starting. Work
+// that is already running is not waited for.
+func (b *backgroundWork) stop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.stopped = true
+	b.cond.Broadcast()
+}
+
+// idle returns a channel that is closed once no work is running. This should only be used after
+// stop has been called, otherwise new work could start after the channel has been closed.
+func (b *backgroundWork) idle() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		for b.running > 0 {
+			b.cond.Wait()
+		}
+	}()
+
+	return done
+}
+
+// PauseBackgroundWork will stop the database from starting any new flushes or compactions, and
+// will wait for any that are already running to finish. This can be used to keep background IO
+// out of a latency critical window, or to keep the files on the disk from changing while a
+// filesystem snapshot is taken. Writes are still accepted while background work is paused.
+//
+// Every call must be matched by a call to ResumeBackgroundWork.
+func (db *DB) PauseBackgroundWork() error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	return db.background.pause()
+}
+
+// ResumeBackgroundWork undoes a call to PauseBackgroundWork. If PauseBackgroundWork has been
+// called multiple times, background work will not start again until each of them has been
+// resumed.
+func (db *DB) ResumeBackgroundWork() error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	return db.background.resume()
+}
@@ -0,0 +1,82 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBackgroundWork(t *testing.T) {
+	t.Run("pause waits for running work", func(t *testing.T) {
+		work := newBackgroundWork()
+		assert.True(t, work.begin())
+
+		paused := make(chan error)
+		go func() {
+			paused <- work.pause()
+		}()
+
+		select {
+		case <-paused:
+			t.Fatal("pause returned while work was still running")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		work.end()
+		assert.NoError(t, <-paused)
+	})
+
+	t.Run("begin waits for every resume", func(t *testing.T) {
+		work := newBackgroundWork()
+		assert.NoError(t, work.pause())
+		assert.NoError(t, work.pause())
+
+		started := make(chan bool)
+		go func() {
+			started <- work.begin()
+		}()
+
+		assert.NoError(t, work.resume())
+		select {
+		case <-started:
+			t.Fatal("work started while still paused")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		assert.NoError(t, work.resume())
+		assert.True(t, <-started)
+		work.end()
+
+		assert.Equal(t, ErrBackgroundWorkNotPaused, work.resume())
+	})
+
+	t.Run("stop wakes waiting work", func(t *testing.T) {
+		work := newBackgroundWork()
+		assert.NoError(t, work.pause())
+
+		started := make(chan bool)
+		go func() {
+			started <- work.begin()
+		}()
+
+		work.stop()
+		assert.False(t, <-started)
+		assert.Equal(t, ErrClosed, work.pause())
+	})
+
+	t.Run("database", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		assert.NoError(t, db.PauseBackgroundWork())
+
+		// Writes should still be accepted while background work is paused.
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+		assert.NoError(t, txn.Commit())
+
+		assert.NoError(t, db.ResumeBackgroundWork())
+		assert.Equal(t, ErrBackgroundWorkNotPaused, db.ResumeBackgroundWork())
+	})
+}
@@ -0,0 +1,112 @@
+package lsmtree
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Make sure that both of our clocks implement the Clock interface.
+	_ Clock = systemClock{}
+	_ Clock = &ManualClock{}
+)
+
+type (
+	// Clock is used by the database anywhere that the current time is needed. This includes
+	// allocating timestamps for transactions. A different clock can be provided in the Options to
+	// make the behavior of the database deterministic in tests.
+	Clock interface {
+		Now() time.Time
+	}
+
+	// systemClock is the default Clock and simply returns the current time of the system.
+	systemClock struct{}
+
+	// ManualClock is a Clock that only moves when it is told to. It is safe to use concurrently.
+	ManualClock struct {
+		lock sync.RWMutex
+		now  time.Time
+	}
+
+	// timestampAllocator hands out strictly increasing timestamps based on a Clock. If the clock
+	// does not move forward (or moves backwards) between calls then the last timestamp will simply
+	// be incremented. This way timestamps are always unique and ascending.
+	timestampAllocator struct {
+		clock Clock
+		last  uint64
+	}
+)
+
+// Now returns the current system time.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewManualClock creates a new ManualClock that will start at the time provided.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{
+		now: start,
+	}
+}
+
+// Now returns the current time of the ManualClock.
+func (c *ManualClock) Now() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.now
+}
+
+// Set will change the current time of the ManualClock to the time provided. This can be used to
+// move the clock backwards.
+func (c *ManualClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+}
+
+// Advance will move the ManualClock forward by the duration provided.
+func (c *ManualClock) Advance(duration time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(duration)
+}
+
+// newTimestampAllocator creates a new allocator using the clock provided.
+func newTimestampAllocator(clock Clock) *timestampAllocator {
+	return &timestampAllocator{
+		clock: clock,
+		last:  0,
+	}
+}
+
+// Next returns a new timestamp that is greater than any timestamp returned before it.
+func (a *timestampAllocator) Next() uint64 {
+	for {
+		last := atomic.LoadUint64(&a.last)
+		next := uint64(a.clock.Now().UnixNano())
+		if next <= last {
+			next = last + 1
+		}
+
+		if atomic.CompareAndSwapUint64(&a.last, last, next) {
+			return next
+		}
+	}
+}
+
+// Observe makes sure that every timestamp returned by Next after this is greater than the one
+// provided. This is used to keep timestamps ordered after seeing a timestamp from somewhere else.
+func (a *timestampAllocator) Observe(timestamp uint64) {
+	for {
+		last := atomic.LoadUint64(&a.last)
+		if timestamp <= last || atomic.CompareAndSwapUint64(&a.last, last, timestamp) {
+			return
+		}
+	}
+}
+
+// Current returns the last timestamp that was returned by Next, or 0 if Next has not been called.
+func (a *timestampAllocator) Current() uint64 {
+	return atomic.LoadUint64(&a.last)
+}
@@ -0,0 +1,90 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManualClock(t *testing.T) {
+	t.Run("advance", func(t *testing.T) {
+		start := time.Unix(1000, 0)
+		clock := NewManualClock(start)
+		assert.Equal(t, start, clock.Now())
+
+		clock.Advance(time.Second)
+		assert.Equal(t, start.Add(time.Second), clock.Now())
+
+		clock.Set(start)
+		assert.Equal(t, start, clock.Now())
+	})
+}
+
+func TestTimestampAllocator_Next(t *testing.T) {
+	t.Run("follows clock", func(t *testing.T) {
+		clock := NewManualClock(time.Unix(0, 100))
+		allocator := newTimestampAllocator(clock)
+		assert.Equal(t, uint64(100), allocator.Next())
+
+		clock.Advance(50)
+		assert.Equal(t, uint64(150), allocator.Next())
+	})
+
+	t.Run("clock does not move", func(t *testing.T) {
+		clock := NewManualClock(time.Unix(0, 100))
+		allocator := newTimestampAllocator(clock)
+		assert.Equal(t, uint64(100), allocator.Next())
+		assert.Equal(t, uint64(101), allocator.Next())
+		assert.Equal(t, uint64(102), allocator.Next())
+	})
+
+	t.Run("clock moves backwards", func(t *testing.T) {
+		clock := NewManualClock(time.Unix(0, 100))
+		allocator := newTimestampAllocator(clock)
+		assert.Equal(t, uint64(100), allocator.Next())
+
+		clock.Set(time.Unix(0, 10))
+		assert.Equal(t, uint64(101), allocator.Next())
+	})
+
+	t.Run("observe", func(t *testing.T) {
+		clock := NewManualClock(time.Unix(0, 100))
+		allocator := newTimestampAllocator(clock)
+		allocator.Observe(500)
+		assert.Equal(t, uint64(501), allocator.Next())
+
+		// Observing an older timestamp should not move the allocator backwards.
+		allocator.Observe(200)
+		assert.Equal(t, uint64(502), allocator.Next())
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		clock := NewManualClock(time.Unix(0, 100))
+		allocator := newTimestampAllocator(clock)
+
+		numberOfRoutines, numberOfTimestamps := 8, 100
+		timestamps := make(chan uint64, numberOfRoutines*numberOfTimestamps)
+
+		wg := sync.WaitGroup{}
+		wg.Add(numberOfRoutines)
+		for i := 0; i < numberOfRoutines; i++ {
+			go func() {
+				defer wg.Done()
+				for x := 0; x < numberOfTimestamps; x++ {
+					timestamps <- allocator.Next()
+				}
+			}()
+		}
+		wg.Wait()
+		close(timestamps)
+
+		// Every timestamp handed out must be unique.
+		seen := map[uint64]struct{}{}
+		for timestamp := range timestamps {
+			_, ok := seen[timestamp]
+			assert.False(t, ok, "duplicate timestamp %d", timestamp)
+			seen[timestamp] = struct{}{}
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package lsmtree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+)
+
+var (
+	// ErrCloneDirectoryNotEmpty is returned by Clone when the directory it was given already has
+	// files in it.
+	ErrCloneDirectoryNotEmpty = errors.New("clone directory is not empty")
+)
+
+// A clone is a second database that starts out with the same contents as this one and then goes
+// its own way, like a branch for a test or a migration dry run. Copying every file would make
+// that as expensive as a backup, but most of the files never change once they are written: every
+// file in the manifest is checksummed when it is added and treated as corrupt if it changes after
+// that. Those files are hard linked into the clone so that both databases share the same blocks
+// on the disk until one of them removes its link. Everything else, the WAL segments and value
+// files that are not finished yet, can still be written to, so they are copied.
+//
+// The WAL is held while the files are linked and copied so that the segments are a prefix of the
+// transactions that have been written. The manifest is held as well so that no file is removed by
+// a compaction before it is linked.
+
+// Clone creates a copy of the database in the directory provided, which must be empty or not exist
+// yet. Every file that cannot change is hard linked into the directory instead of being copied, so
+// a clone of a large database is cheap to create and only takes up space as the two databases
+// diverge. If the directory is on a different device than a file then that file is copied.
+//
+// The clone is a database of its own, open it with the directory as both the WALDirectory and the
+// DataDirectory. It holds every transaction that was committed before Clone was called, except for
+// the ones that were committed with the WAL disabled since those only exist in the memtable.
+// Changes made to either database after the clone is created are not visible to the other.
+//
+// If Clone fails then the files it already created in the directory are left behind.
+func (db *DB) Clone(directory string) error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	if err := newDirectory(directory, getDirectoryMode(db.options.FileMode)); err != nil {
+		return err
+	}
+
+	if infos, err := ioutil.ReadDir(directory); err != nil {
+		return err
+	} else if len(infos) > 0 {
+		return fmt.Errorf("%w: %s", ErrCloneDirectoryNotEmpty, directory)
+	}
+
+	// Every transaction committed before this point needs to be in the WAL segments before they
+	// are copied.
+	if err := db.waitForCommits(context.Background()); err != nil {
+		return err
+	}
+
+	db.wal.appendLock.Lock()
+	defer db.wal.appendLock.Unlock()
+
+	segments, err := listFiles(db.wal.Directory, fileTypeWal)
+	if err != nil {
+		return err
+	}
+
+	for _, segmentId := range segments {
+		name := getWalSegmentFileName(segmentId)
+		source, target := path.Join(db.wal.Directory, name), path.Join(directory, name)
+		if err = cloneFile(source, target, db.options.FileMode, false); err != nil {
+			return err
+		}
+	}
+
+	db.manifest.lock.Lock()
+	defer db.manifest.lock.Unlock()
+
+	files := make([]manifestFile, 0, len(db.manifest.files))
+	for _, file := range db.manifest.files {
+		name := getFileName(file.Kind, file.Id)
+		source := path.Join(db.manifest.fileDirectory(file.Kind, file.Id), name)
+		if err = cloneFile(source, path.Join(directory, name), db.options.FileMode, true); err != nil {
+			return err
+		}
+
+		files = append(files, file)
+	}
+
+	// Value files that are not in the manifest may still be appended to.
+	for _, valueDirectory := range db.values.directories.directories {
+		ids, err := listFiles(valueDirectory, fileTypeValue)
+		if err != nil {
+			return err
+		}
+
+		for _, fileId := range ids {
+			if _, ok := db.manifest.files[manifestFileKey{Kind: fileTypeValue, Id: fileId}]; ok {
+				continue
+			}
+
+			name := getValueFileName(fileId)
+			source, target := path.Join(valueDirectory, name), path.Join(directory, name)
+			if err = cloneFile(source, target, db.options.FileMode, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	err = writeCloneManifest(directory, files, db.manifest.appliedIndex,
+		db.manifest.lastSegmentId, db.manifest.version, db.options.FileMode)
+	if err != nil {
+		return err
+	}
+
+	return syncDirectory(directory)
+}
+
+// cloneFile creates the target as a copy of the source file. If link is true then the target is a
+// hard link to the source instead, unless the link cannot be created, for example because the two
+// are on different devices. A copy is synced before it is returned, a link shares the blocks of a
+// file that is already durable.
+func cloneFile(source, target string, mode os.FileMode, link bool) error {
+	if link {
+		if err := os.Link(source, target); err == nil {
+			return nil
+		}
+	}
+
+	if err := copyFile(source, target, mode); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_WRONLY, mode&os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// writeCloneManifest writes the first manifest of a clone, recording the files provided in the
+// same version of the format as the manifest of the database being cloned.
+func writeCloneManifest(
+	directory string,
+	files []manifestFile,
+	appliedIndex, lastSegmentId uint64,
+	version int,
+	mode os.FileMode,
+) error {
+	filePath := path.Join(directory, getManifestFileName(1))
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode&os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	data := encodeManifest(files, appliedIndex, lastSegmentId, version)
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// copyFile copies the contents of the source file to a new file at the target. The target must not
+// already exist, if the copy fails then the target is removed.
+func copyFile(source, target string, mode os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode&os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(target)
+		return err
+	}
+
+	if err = out.Close(); err != nil {
+		_ = os.Remove(target)
+		return err
+	}
+
+	return nil
+}
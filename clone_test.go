@@ -0,0 +1,109 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDB_Clone(t *testing.T) {
+	set := func(t *testing.T, db *DB, key, value string) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key(key), []byte(value)))
+		assert.NoError(t, txn.Commit())
+	}
+
+	get := func(t *testing.T, db *DB, key string) (string, bool) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		item, err := txn.Get(Key(key))
+		if errors.Is(err, ErrKeyNotFound) {
+			return "", false
+		}
+		assert.NoError(t, err)
+
+		return string(item.Value), true
+	}
+
+	t.Run("clone", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		// Heap files cannot be written yet, so a finished file is added to the manifest by hand.
+		heapPath := path.Join(db.options.DataDirectory, getHeapFileName(1))
+		assert.NoError(t, ioutil.WriteFile(heapPath, []byte("heap file"), 0644))
+		assert.NoError(t, db.manifest.AddFile(fileTypeHeap, 1))
+
+		set(t, db, "first", "one")
+		set(t, db, "second", "two")
+
+		dir, cleanupClone := NewTempDirectory(t)
+		defer cleanupClone()
+
+		cloneDir := path.Join(dir, "clone")
+		assert.NoError(t, db.Clone(cloneDir))
+
+		// Changes made after the clone was created only belong to the source.
+		set(t, db, "first", "changed")
+		set(t, db, "third", "three")
+
+		options := DefaultOptions()
+		options.DataDirectory = cloneDir
+		options.WALDirectory = cloneDir
+		clone, err := Open(options)
+		assert.NoError(t, err)
+		defer clone.Close()
+
+		value, ok := get(t, clone, "first")
+		assert.True(t, ok)
+		assert.Equal(t, "one", value)
+		value, ok = get(t, clone, "second")
+		assert.True(t, ok)
+		assert.Equal(t, "two", value)
+		_, ok = get(t, clone, "third")
+		assert.False(t, ok)
+
+		// And changes made to the clone only belong to the clone.
+		set(t, clone, "fourth", "four")
+		_, ok = get(t, db, "fourth")
+		assert.False(t, ok)
+		value, ok = get(t, db, "first")
+		assert.True(t, ok)
+		assert.Equal(t, "changed", value)
+
+		// The heap file is shared with the source instead of being copied.
+		assert.Equal(t, db.manifest.Files(), clone.manifest.Files())
+		assert.NoError(t, clone.VerifyFileChecksums())
+		sourceInfo, err := os.Stat(heapPath)
+		assert.NoError(t, err)
+		cloneInfo, err := os.Stat(path.Join(cloneDir, getHeapFileName(1)))
+		assert.NoError(t, err)
+		assert.True(t, os.SameFile(sourceInfo, cloneInfo))
+	})
+
+	t.Run("directory not empty", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		dir, cleanupClone := NewTempDirectory(t)
+		defer cleanupClone()
+
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "file"), nil, 0644))
+		err := db.Clone(dir)
+		assert.True(t, errors.Is(err, ErrCloneDirectoryNotEmpty))
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		assert.NoError(t, db.Close())
+		assert.Equal(t, ErrClosed, db.Clone(path.Join(db.options.DataDirectory, "clone")))
+	})
+}
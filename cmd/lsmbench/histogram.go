@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	// histogramSubBuckets is the number of buckets each power of two is split into. With 16 sub
+	// buckets every recorded latency is within about 6% of the value it is reported as.
+	histogramSubBuckets = 16
+
+	// histogramBuckets is enough buckets to cover every possible duration in nanoseconds.
+	histogramBuckets = 64 * histogramSubBuckets
+)
+
+// histogram records latencies into log-linear buckets, so it uses a fixed amount of memory no
+// matter how many operations are recorded. It is not safe for concurrent use, each worker records
+// into its own histogram and they are merged once the workers are done.
+type histogram struct {
+	counts [histogramBuckets]uint64
+	count  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// Record adds a single latency to the histogram.
+func (h *histogram) Record(latency time.Duration) {
+	if latency < 0 {
+		latency = 0
+	}
+
+	h.counts[histogramBucket(latency)]++
+	if h.count == 0 || latency < h.min {
+		h.min = latency
+	}
+	if latency > h.max {
+		h.max = latency
+	}
+	h.count++
+	h.sum += latency
+}
+
+// Merge adds every latency recorded by other to this histogram.
+func (h *histogram) Merge(other *histogram) {
+	if other.count == 0 {
+		return
+	}
+
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+	if h.count == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+	h.count += other.count
+	h.sum += other.sum
+}
+
+// Count returns the number of latencies recorded.
+func (h *histogram) Count() uint64 {
+	return h.count
+}
+
+// Mean returns the average latency.
+func (h *histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	return h.sum / time.Duration(h.count)
+}
+
+// Percentile returns the latency that p percent of the recorded latencies are at or below. The
+// result is the upper bound of the bucket the latency fell in, capped at the largest latency that
+// was recorded.
+func (h *histogram) Percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(float64(h.count) * p / 100))
+	if target == 0 {
+		target = 1
+	}
+
+	var seen uint64
+	for i, count := range h.counts {
+		if seen += count; seen >= target {
+			if upper := histogramBucketUpper(i); upper < h.max {
+				return upper
+			}
+			break
+		}
+	}
+
+	return h.max
+}
+
+// String returns a single line summary of the histogram.
+func (h *histogram) String() string {
+	return fmt.Sprintf("avg %s  p50 %s  p95 %s  p99 %s  p99.9 %s  max %s",
+		h.Mean(), h.Percentile(50), h.Percentile(95), h.Percentile(99), h.Percentile(99.9), h.max)
+}
+
+// histogramBucket returns the bucket a latency is recorded in. Latencies below
+// histogramSubBuckets nanoseconds get a bucket each, after that each power of two is split into
+// histogramSubBuckets buckets of equal width.
+func histogramBucket(latency time.Duration) int {
+	n := uint64(latency)
+	if n < histogramSubBuckets {
+		return int(n)
+	}
+
+	// The shift keeps the top bits of the latency below the leading one, those pick the sub
+	// bucket within the power of two.
+	power := bits.Len64(n) - 1
+	shift := power - bits.Len64(histogramSubBuckets-1)
+	sub := (n >> uint(shift)) & (histogramSubBuckets - 1)
+
+	return (shift+1)*histogramSubBuckets + int(sub)
+}
+
+// histogramBucketUpper returns the largest latency that is recorded in the bucket.
+func histogramBucketUpper(bucket int) time.Duration {
+	if bucket < histogramSubBuckets {
+		return time.Duration(bucket)
+	}
+
+	shift := uint(bucket/histogramSubBuckets - 1)
+	sub := uint64(bucket % histogramSubBuckets)
+	lower := (histogramSubBuckets + sub) << shift
+
+	return time.Duration(lower + (1 << shift) - 1)
+}
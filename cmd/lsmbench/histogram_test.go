@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		h := &histogram{}
+		assert.Equal(t, uint64(0), h.Count())
+		assert.Equal(t, time.Duration(0), h.Mean())
+		assert.Equal(t, time.Duration(0), h.Percentile(99))
+	})
+
+	t.Run("percentiles", func(t *testing.T) {
+		h := &histogram{}
+		for i := 1; i <= 1000; i++ {
+			h.Record(time.Duration(i) * time.Microsecond)
+		}
+
+		assert.Equal(t, uint64(1000), h.Count())
+		assert.Equal(t, 500500*time.Nanosecond, h.Mean())
+		assert.Equal(t, time.Millisecond, h.Percentile(100))
+
+		// Percentiles are rounded up to the end of their bucket, which is never more than 1/16th
+		// past the actual value.
+		for _, p := range []float64{50, 90, 99} {
+			actual := time.Duration(p*10) * time.Microsecond
+			assert.True(t, h.Percentile(p) >= actual, "p%v", p)
+			assert.True(t, h.Percentile(p) <= actual+actual/16, "p%v", p)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		a, b := &histogram{}, &histogram{}
+		a.Record(time.Millisecond)
+		b.Record(time.Microsecond)
+		b.Record(time.Second)
+
+		a.Merge(b)
+		a.Merge(&histogram{})
+		assert.Equal(t, uint64(3), a.Count())
+		assert.Equal(t, time.Microsecond, a.min)
+		assert.Equal(t, time.Second, a.Percentile(100))
+	})
+}
+
+func TestHistogramBucket(t *testing.T) {
+	// Every latency must fall within the bounds of its bucket, and buckets must be in order.
+	latencies := []time.Duration{0, 1, 15, 16, 17, 31, 32, 1000, 123456789, math.MaxInt64}
+	for _, latency := range latencies {
+		bucket := histogramBucket(latency)
+		assert.True(t, bucket < histogramBuckets)
+		assert.True(t, latency <= histogramBucketUpper(bucket), "%d", latency)
+		if bucket > 0 {
+			assert.True(t, latency > histogramBucketUpper(bucket-1), "%d", latency)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// lsmbench runs a fixed set of benchmarks against an lsmtree database so that performance can be
+// compared between releases and between sets of options. It covers the classic fill and read
+// benchmarks (fillseq, fillrandom, readrandom and readwhilewriting) and the core YCSB workloads A
+// to F, and reports the throughput of each one along with latency percentiles for every type of
+// operation it performed.
+//
+// Benchmarks run in the order they are listed and share a single database, so a read benchmark
+// should follow a fill benchmark. The YCSB workloads load -num keys on their own before they
+// start if they have not been written yet.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/elliotcourant/lsmtree"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+func main() {
+	var list []string
+	for _, benchmark := range benchmarks() {
+		list = append(list, benchmark.Name)
+	}
+
+	names := flag.String("benchmarks", strings.Join(list, ","),
+		"comma separated list of benchmarks to run")
+	dataDirectory := flag.String("data", "",
+		"the data directory of the database (default: a temporary directory that is removed)")
+	num := flag.Int("num", 100000, "the number of keys to fill and load")
+	ops := flag.Int("ops", 100000, "the number of operations each benchmark performs")
+	threads := flag.Int("threads", 1, "the number of threads performing operations")
+	keySize := flag.Int("key-size", 16, "the size of each key in bytes")
+	valueSize := flag.Int("value-size", 100, "the size of each value in bytes")
+	maxScanLength := flag.Int("max-scan-length", 100, "the longest scan in YCSB workload E")
+	seed := flag.Int64("seed", 1, "the seed used to generate keys and values")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: lsmbench [flags]\n\nbenchmarks:\n")
+		for _, benchmark := range benchmarks() {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %-18s%s\n",
+				benchmark.Name, benchmark.Description)
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "\nflags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	err := run(os.Stdout, *dataDirectory, strings.Split(*names, ","), config{
+		Num:           *num,
+		Ops:           *ops,
+		Threads:       *threads,
+		KeySize:       *keySize,
+		ValueSize:     *valueSize,
+		MaxScanLength: *maxScanLength,
+		Seed:          *seed,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run opens the database and runs each of the benchmarks named, writing the results to w.
+func run(w io.Writer, dataDirectory string, names []string, config config) error {
+	switch {
+	case config.Num < 1 || config.Ops < 0 || config.Threads < 1:
+		return fmt.Errorf("-num and -threads must be at least 1 and -ops cannot be negative")
+	case config.KeySize < len(fmt.Sprint(config.Num+config.Ops)):
+		// Every key must be unique, including keys inserted while the YCSB workloads run.
+		return fmt.Errorf("-key-size is too small to fit %d keys", config.Num+config.Ops)
+	case config.ValueSize < 0 || config.MaxScanLength < 1:
+		return fmt.Errorf("-value-size cannot be negative and -max-scan-length must be at least 1")
+	}
+
+	available := map[string]benchmark{}
+	for _, benchmark := range benchmarks() {
+		available[benchmark.Name] = benchmark
+	}
+
+	var selected []benchmark
+	for _, name := range names {
+		benchmark, ok := available[strings.TrimSpace(name)]
+		if !ok {
+			return fmt.Errorf("unknown benchmark %q", name)
+		}
+		selected = append(selected, benchmark)
+	}
+
+	if dataDirectory == "" {
+		directory, err := ioutil.TempDir("", "lsmbench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(directory)
+		dataDirectory = directory
+	}
+
+	options := lsmtree.DefaultOptions()
+	options.DataDirectory = dataDirectory
+	options.WALDirectory = dataDirectory
+	options.Logger = nil
+	db, err := lsmtree.Open(options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	fmt.Fprintf(w, "keys: %d  ops: %d  threads: %d  key size: %d  value size: %d\n\n",
+		config.Num, config.Ops, config.Threads, config.KeySize, config.ValueSize)
+
+	b := newBench(db, config)
+	for _, benchmark := range selected {
+		result, err := b.Run(benchmark)
+		if err != nil {
+			return err
+		}
+
+		printResult(w, result)
+	}
+
+	return nil
+}
+
+// printResult writes the throughput of the benchmark followed by a line of latencies for each
+// type of operation it performed.
+func printResult(w io.Writer, result result) {
+	var ops uint64
+	for _, latencies := range result.Latencies {
+		ops += latencies.Count()
+	}
+
+	seconds := result.Elapsed.Seconds()
+	if seconds == 0 {
+		seconds = 1e-9
+	}
+
+	fmt.Fprintf(w, "%-18s %10d ops  %10.0f ops/s", result.Name, ops, float64(ops)/seconds)
+	if result.Bytes > 0 {
+		fmt.Fprintf(w, "  %8.2f MB/s", float64(result.Bytes)/seconds/1024/1024)
+	}
+	fmt.Fprintln(w)
+
+	names := make([]string, 0, len(result.Latencies))
+	for op := range result.Latencies {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+	for _, op := range names {
+		fmt.Fprintf(w, "  %-18s %s\n", op, result.Latencies[op])
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	config := config{
+		Num:           200,
+		Ops:           200,
+		Threads:       4,
+		KeySize:       16,
+		ValueSize:     10,
+		MaxScanLength: 10,
+		Seed:          1,
+	}
+
+	t.Run("every benchmark", func(t *testing.T) {
+		var names []string
+		for _, benchmark := range benchmarks() {
+			names = append(names, benchmark.Name)
+		}
+
+		var output bytes.Buffer
+		assert.NoError(t, run(&output, "", names, config))
+		for _, name := range names {
+			assert.Contains(t, output.String(), "\n"+name+" ")
+		}
+		assert.Contains(t, output.String(), opScan)
+		assert.Contains(t, output.String(), opRMW)
+	})
+
+	t.Run("unknown benchmark", func(t *testing.T) {
+		err := run(&bytes.Buffer{}, "", []string{"fillseq", "nope"}, config)
+		assert.Error(t, err)
+		assert.True(t, strings.Contains(err.Error(), "nope"))
+	})
+
+	t.Run("key size too small", func(t *testing.T) {
+		small := config
+		small.KeySize = 2
+		assert.Error(t, run(&bytes.Buffer{}, "", []string{"fillseq"}, small))
+	})
+}
+
+func TestBench_Load(t *testing.T) {
+	// The YCSB workloads must be able to read every key that was loaded, and inserts must not
+	// overwrite loaded keys.
+	b := &bench{config: config{Num: 100, KeySize: 8}}
+	b.markLoaded()
+	assert.Equal(t, int64(100), b.loaded)
+	assert.Equal(t, "00000042", string(b.key(42)))
+
+	b.loaded = 150
+	b.markLoaded()
+	assert.Equal(t, int64(150), b.loaded)
+}
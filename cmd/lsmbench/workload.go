@@ -0,0 +1,541 @@
+package main
+
+import (
+	"fmt"
+	"github.com/elliotcourant/lsmtree"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operations that a benchmark can perform. Each one has its own latency histogram in the results.
+const (
+	opRead   = "read"
+	opUpdate = "update"
+	opInsert = "insert"
+	opScan   = "scan"
+	opRMW    = "read-modify-write"
+)
+
+type (
+	// config is everything that controls how the benchmarks are run.
+	config struct {
+		// Num is the number of keys that are written by the fill benchmarks and loaded before the
+		// YCSB workloads run.
+		Num int
+
+		// Ops is the number of operations each benchmark performs, spread across every thread.
+		Ops int
+
+		// Threads is the number of goroutines performing operations at the same time.
+		Threads int
+
+		// KeySize and ValueSize are the size of each key and value in bytes.
+		KeySize   int
+		ValueSize int
+
+		// MaxScanLength is the longest a scan in YCSB workload E can be.
+		MaxScanLength int
+
+		// Seed is used to generate keys and values so that runs can be repeated exactly.
+		Seed int64
+	}
+
+	// result is the outcome of a single benchmark.
+	result struct {
+		Name    string
+		Elapsed time.Duration
+
+		// Bytes is the number of bytes of keys and values written.
+		Bytes int64
+
+		// Latencies has a histogram for each type of operation that was performed.
+		Latencies map[string]*histogram
+	}
+
+	// bench runs benchmarks against a single database. The database is shared between
+	// benchmarks, so later benchmarks see the keys written by earlier ones.
+	bench struct {
+		db     *lsmtree.DB
+		config config
+
+		// values is a block of random bytes that values are sliced out of, generating new random
+		// bytes for every write would be measured along with the database.
+		values []byte
+
+		// loaded is the number of sequential keys that are known to be in the database, keys
+		// 0 to loaded-1 exist. Inserts add keys past the end and increment it.
+		loaded int64
+
+		// sequence is the next key that fillseq will write.
+		sequence int64
+	}
+
+	// worker is the state of a single thread running a benchmark.
+	worker struct {
+		bench     *bench
+		random    *rand.Rand
+		latencies map[string]*histogram
+		bytes     int64
+	}
+
+	// benchmark is a single named benchmark. Each thread calls run with its share of the
+	// operations.
+	benchmark struct {
+		Name        string
+		Description string
+		run         func(w *worker, ops int) error
+	}
+
+	// ycsbWorkload is the mix of operations in one of the core YCSB workloads. The proportions
+	// must add up to 1.
+	ycsbWorkload struct {
+		Read, Update, Insert, Scan, RMW float64
+
+		// Distribution picks which existing key each operation uses.
+		Distribution string
+	}
+)
+
+const (
+	// distributionZipfian makes a small number of keys much more popular than the rest.
+	distributionZipfian = "zipfian"
+
+	// distributionLatest makes the most recently inserted keys the most popular.
+	distributionLatest = "latest"
+
+	// zipfianExponent is the skew of the zipfian distribution. YCSB uses 0.99, but the generator
+	// in math/rand requires an exponent greater than 1.
+	zipfianExponent = 1.01
+)
+
+// ycsbWorkloads are the core workloads defined by YCSB.
+var ycsbWorkloads = map[string]ycsbWorkload{
+	"a": {Read: 0.5, Update: 0.5, Distribution: distributionZipfian},
+	"b": {Read: 0.95, Update: 0.05, Distribution: distributionZipfian},
+	"c": {Read: 1, Distribution: distributionZipfian},
+	"d": {Read: 0.95, Insert: 0.05, Distribution: distributionLatest},
+	"e": {Scan: 0.95, Insert: 0.05, Distribution: distributionZipfian},
+	"f": {Read: 0.5, RMW: 0.5, Distribution: distributionZipfian},
+}
+
+// benchmarks returns every benchmark that can be run, in the order they are listed in the usage.
+func benchmarks() []benchmark {
+	list := []benchmark{
+		{
+			Name:        "fillseq",
+			Description: "write -num keys in sequential order",
+			run:         fillSequential,
+		},
+		{
+			Name:        "fillrandom",
+			Description: "write -ops keys in random order",
+			run:         fillRandom,
+		},
+		{
+			Name:        "readrandom",
+			Description: "read -ops keys in random order",
+			run:         readRandom,
+		},
+		{
+			Name:        "readwhilewriting",
+			Description: "readrandom while one extra thread keeps writing",
+			run:         readRandom,
+		},
+	}
+
+	names := make([]string, 0, len(ycsbWorkloads))
+	for name := range ycsbWorkloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		workload := ycsbWorkloads[name]
+		list = append(list, benchmark{
+			Name:        "ycsb" + name,
+			Description: "YCSB workload " + strings.ToUpper(name) + ", loads -num keys first",
+			run: func(w *worker, ops int) error {
+				return runYCSB(w, workload, ops)
+			},
+		})
+	}
+
+	return list
+}
+
+// newBench creates a bench for the database.
+func newBench(db *lsmtree.DB, config config) *bench {
+	random := rand.New(rand.NewSource(config.Seed))
+	values := make([]byte, config.ValueSize+1024*1024)
+	random.Read(values)
+
+	return &bench{
+		db:     db,
+		config: config,
+		values: values,
+	}
+}
+
+// Run runs a single benchmark and returns its result.
+func (b *bench) Run(benchmark benchmark) (result, error) {
+	if strings.HasPrefix(benchmark.Name, "ycsb") {
+		if err := b.load(); err != nil {
+			return result{}, err
+		}
+	}
+
+	// fillseq writes every key once, the rest of the benchmarks share -ops between the threads.
+	ops := b.config.Ops
+	if benchmark.Name == "fillseq" {
+		ops = b.config.Num
+		atomic.StoreInt64(&b.sequence, 0)
+	}
+
+	// readwhilewriting has a writer running in the background until the readers are done.
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	var backgroundErr error
+	if benchmark.Name == "readwhilewriting" {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+
+			writer := b.newWorker(-1)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				if backgroundErr = fillRandom(writer, 1); backgroundErr != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	workers := make([]*worker, b.config.Threads)
+	errs := make([]error, b.config.Threads)
+	var group sync.WaitGroup
+	start := time.Now()
+	for i := range workers {
+		workers[i] = b.newWorker(i)
+
+		// Any operations that do not divide evenly go to the first threads.
+		share := ops / b.config.Threads
+		if i < ops%b.config.Threads {
+			share++
+		}
+
+		group.Add(1)
+		go func(i, share int) {
+			defer group.Done()
+			errs[i] = benchmark.run(workers[i], share)
+		}(i, share)
+	}
+	group.Wait()
+	elapsed := time.Since(start)
+
+	close(stop)
+	background.Wait()
+
+	for _, err := range append(errs, backgroundErr) {
+		if err != nil {
+			return result{}, fmt.Errorf("%s: %w", benchmark.Name, err)
+		}
+	}
+
+	if benchmark.Name == "fillseq" {
+		b.markLoaded()
+	}
+
+	res := result{
+		Name:      benchmark.Name,
+		Elapsed:   elapsed,
+		Latencies: map[string]*histogram{},
+	}
+	for _, w := range workers {
+		res.Bytes += w.bytes
+		for op, latencies := range w.latencies {
+			if res.Latencies[op] == nil {
+				res.Latencies[op] = &histogram{}
+			}
+			res.Latencies[op].Merge(latencies)
+		}
+	}
+
+	return res, nil
+}
+
+// load writes the keys the YCSB workloads read from if they have not been written yet.
+func (b *bench) load() error {
+	if atomic.LoadInt64(&b.loaded) >= int64(b.config.Num) {
+		return nil
+	}
+
+	atomic.StoreInt64(&b.sequence, 0)
+	if err := fillSequential(b.newWorker(-1), b.config.Num); err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	b.markLoaded()
+
+	return nil
+}
+
+// markLoaded records that keys 0 to -num have been written. Keys inserted past the end are kept.
+func (b *bench) markLoaded() {
+	if atomic.LoadInt64(&b.loaded) < int64(b.config.Num) {
+		atomic.StoreInt64(&b.loaded, int64(b.config.Num))
+	}
+}
+
+// newWorker creates the state for a single thread. Every thread gets its own random source
+// derived from the seed so that runs can be repeated.
+func (b *bench) newWorker(id int) *worker {
+	return &worker{
+		bench:     b,
+		random:    rand.New(rand.NewSource(b.config.Seed + int64(id) + 1)),
+		latencies: map[string]*histogram{},
+	}
+}
+
+// key returns the key for the index provided. Keys are zero padded so that they sort in the same
+// order as their index.
+func (b *bench) key(index int64) lsmtree.Key {
+	key := fmt.Sprintf("%0*d", b.config.KeySize, index)
+	return lsmtree.Key(key[len(key)-b.config.KeySize:])
+}
+
+// value returns a value of the configured size.
+func (w *worker) value() []byte {
+	offset := w.random.Intn(len(w.bench.values) - w.bench.config.ValueSize + 1)
+	return w.bench.values[offset : offset+w.bench.config.ValueSize]
+}
+
+// time runs the operation and records how long it took under op.
+func (w *worker) time(op string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	latency := time.Since(start)
+
+	if w.latencies[op] == nil {
+		w.latencies[op] = &histogram{}
+	}
+	w.latencies[op].Record(latency)
+
+	return err
+}
+
+// set writes a single key in its own transaction. Conflicts with other threads are retried, the
+// retries are included in the latency.
+func (w *worker) set(op string, key lsmtree.Key) error {
+	value := w.value()
+	w.bytes += int64(len(key) + len(value))
+
+	return w.time(op, func() error {
+		for {
+			txn, err := w.bench.db.NewTransaction(lsmtree.TxnOptions{})
+			if err != nil {
+				return err
+			}
+
+			if err = txn.Set(key, value); err != nil {
+				txn.Discard()
+				return err
+			}
+
+			if err = txn.Commit(); err != lsmtree.ErrTxnConflict {
+				return err
+			}
+		}
+	})
+}
+
+// get reads a single key. Keys that do not exist are not an error, fillrandom may not have
+// written every key that readrandom reads.
+func (w *worker) get(key lsmtree.Key) error {
+	return w.time(opRead, func() error {
+		txn, err := w.bench.db.NewTransaction(lsmtree.TxnOptions{ReadOnly: true})
+		if err != nil {
+			return err
+		}
+		defer txn.Discard()
+
+		if _, err = txn.Get(key); err == lsmtree.ErrKeyNotFound {
+			return nil
+		}
+
+		return err
+	})
+}
+
+// scan reads up to length keys starting at the key provided.
+func (w *worker) scan(key lsmtree.Key, length int) error {
+	return w.time(opScan, func() error {
+		txn, err := w.bench.db.NewTransaction(lsmtree.TxnOptions{ReadOnly: true})
+		if err != nil {
+			return err
+		}
+		defer txn.Discard()
+
+		iterator, err := txn.NewIterator(lsmtree.IteratorOptions{})
+		if err != nil {
+			return err
+		}
+		defer iterator.Close()
+
+		for iterator.Seek(key); iterator.Valid() && length > 0; iterator.Next() {
+			length--
+		}
+
+		return nil
+	})
+}
+
+// readModifyWrite reads a key and writes a new value for it in the same transaction. Conflicts
+// are retried, the retries are included in the latency.
+func (w *worker) readModifyWrite(key lsmtree.Key) error {
+	value := w.value()
+	w.bytes += int64(len(key) + len(value))
+
+	return w.time(opRMW, func() error {
+		for {
+			txn, err := w.bench.db.NewTransaction(lsmtree.TxnOptions{})
+			if err != nil {
+				return err
+			}
+
+			if _, err = txn.Get(key); err != nil && err != lsmtree.ErrKeyNotFound {
+				txn.Discard()
+				return err
+			}
+
+			if err = txn.Set(key, value); err != nil {
+				txn.Discard()
+				return err
+			}
+
+			if err = txn.Commit(); err != lsmtree.ErrTxnConflict {
+				return err
+			}
+		}
+	})
+}
+
+// fillSequential writes keys in ascending order. Each thread takes the next ops keys, so together
+// the threads write every key once.
+func fillSequential(w *worker, ops int) error {
+	start := atomic.AddInt64(&w.bench.sequence, int64(ops)) - int64(ops)
+	for i := int64(0); i < int64(ops); i++ {
+		if err := w.set(opInsert, w.bench.key(start+i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fillRandom writes keys picked uniformly from the first -num keys.
+func fillRandom(w *worker, ops int) error {
+	for i := 0; i < ops; i++ {
+		key := w.bench.key(w.random.Int63n(int64(w.bench.config.Num)))
+		if err := w.set(opUpdate, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readRandom reads keys picked uniformly from the first -num keys.
+func readRandom(w *worker, ops int) error {
+	for i := 0; i < ops; i++ {
+		key := w.bench.key(w.random.Int63n(int64(w.bench.config.Num)))
+		if err := w.get(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runYCSB performs ops operations picked according to the proportions of the workload.
+func runYCSB(w *worker, workload ycsbWorkload, ops int) error {
+	chooser := newKeyChooser(w, workload.Distribution)
+	for i := 0; i < ops; i++ {
+		var err error
+		switch p := w.random.Float64(); {
+		case p < workload.Read:
+			err = w.get(chooser.Next())
+		case p < workload.Read+workload.Update:
+			err = w.set(opUpdate, chooser.Next())
+		case p < workload.Read+workload.Update+workload.Insert:
+			err = w.set(opInsert, w.bench.key(atomic.AddInt64(&w.bench.loaded, 1)-1))
+		case p < workload.Read+workload.Update+workload.Insert+workload.Scan:
+			err = w.scan(chooser.Next(), 1+w.random.Intn(w.bench.config.MaxScanLength))
+		default:
+			err = w.readModifyWrite(chooser.Next())
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keyChooser picks existing keys according to a YCSB request distribution.
+type keyChooser struct {
+	worker       *worker
+	distribution string
+	zipf         *rand.Zipf
+}
+
+// newKeyChooser creates a key chooser for the worker. The zipfian distribution is generated over
+// the keys that were loaded, keys inserted while the workload runs are only picked by latest.
+func newKeyChooser(w *worker, distribution string) *keyChooser {
+	loaded := atomic.LoadInt64(&w.bench.loaded)
+	if loaded < 1 {
+		loaded = 1
+	}
+
+	return &keyChooser{
+		worker:       w,
+		distribution: distribution,
+		zipf:         rand.NewZipf(w.random, zipfianExponent, 1, uint64(loaded-1)),
+	}
+}
+
+// Next returns the next key to operate on.
+func (c *keyChooser) Next() lsmtree.Key {
+	rank := int64(c.zipf.Uint64())
+	if c.distribution == distributionLatest {
+		// The most popular keys are the newest ones.
+		if loaded := atomic.LoadInt64(&c.worker.bench.loaded); rank < loaded {
+			return c.worker.bench.key(loaded - 1 - rank)
+		}
+	}
+
+	// YCSB scatters the popular keys across the key space so that they are not all next to
+	// each other, the same is done here by hashing the rank.
+	loaded := atomic.LoadInt64(&c.worker.bench.loaded)
+	return c.worker.bench.key(int64(fnv64(uint64(rank)) % uint64(loaded)))
+}
+
+// fnv64 is the 64-bit FNV-1a hash of the bytes of n.
+func fnv64(n uint64) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < 8; i++ {
+		hash ^= n & 0xff
+		hash *= 1099511628211
+		n >>= 8
+	}
+
+	return hash
+}
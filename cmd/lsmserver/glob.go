@@ -0,0 +1,86 @@
+package main
+
+// matchGlob reports whether the key matches the pattern using the same rules as the MATCH option
+// of the redis SCAN command. A star matches any number of bytes, a question mark matches a single
+// byte, brackets match one of the bytes inside them (ranges like [a-z] and negation like [^a] are
+// supported) and a backslash matches the byte after it literally.
+func matchGlob(pattern, key []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// Collapse repeated stars, then try to match the rest of the pattern at every position.
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchGlob(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					matched = matched || pattern[1] == key[0]
+					pattern = pattern[2:]
+				case len(pattern) >= 3 && pattern[1] == '-' && pattern[2] != ']':
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					matched = matched || (key[0] >= start && key[0] <= end)
+					pattern = pattern[3:]
+				default:
+					matched = matched || pattern[0] == key[0]
+					pattern = pattern[1:]
+				}
+			}
+
+			// Skip the closing bracket, an unclosed bracket is treated as if it were closed.
+			if len(pattern) > 0 {
+				pattern = pattern[1:]
+			}
+
+			if matched == negate {
+				return false
+			}
+			key = key[1:]
+
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		}
+	}
+
+	return len(key) == 0
+}
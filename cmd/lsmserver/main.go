@@ -0,0 +1,68 @@
+// lsmserver serves an lsmtree database over the network using a subset of the redis protocol, so it
+// can be used from any language that has a redis client. The supported commands are PING, QUIT,
+// GET, SET (with NX, XX, EX, PX, EXAT, PXAT and KEEPTTL), DEL, TTL, SCAN (with MATCH and COUNT),
+// MULTI, EXEC and DISCARD.
+package main
+
+import (
+	"flag"
+	"github.com/elliotcourant/lsmtree"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	address := flag.String("addr", "127.0.0.1:6380", "the address to listen on")
+	dataDirectory := flag.String("data", "", "the data directory of the database")
+	walDirectory := flag.String("wal", "", "the WAL directory of the database (default: -data)")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "lsmserver: ", log.LstdFlags)
+
+	if *dataDirectory == "" {
+		logger.Fatal("-data must be specified")
+	}
+
+	if *walDirectory == "" {
+		*walDirectory = *dataDirectory
+	}
+
+	options := lsmtree.DefaultOptions()
+	options.DataDirectory = *dataDirectory
+	options.WALDirectory = *walDirectory
+	options.Logger = logger
+
+	db, err := lsmtree.Open(options)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", *address)
+	if err != nil {
+		_ = db.Close()
+		logger.Fatal(err)
+	}
+	logger.Printf("listening on %s", listener.Addr())
+
+	srv := newServer(db, options, logger)
+
+	// Stop accepting connections and close the database cleanly when we are asked to stop.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logger.Print("shutting down")
+		_ = srv.Close()
+	}()
+
+	if err = srv.Serve(listener); err != nil {
+		logger.Print(err)
+	}
+
+	if err = db.Close(); err != nil {
+		logger.Fatal(err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+var (
+	// errProtocol is returned when a client sends something that is not valid RESP.
+	errProtocol = errors.New("ERR protocol error")
+)
+
+const (
+	// maxArrayLength is the largest number of arguments a single command can have.
+	maxArrayLength = 1024 * 1024
+)
+
+type (
+	// status is a simple string reply, like OK.
+	status string
+
+	// respReader reads commands sent by a client. Commands are normally sent as an array of bulk
+	// strings, but inline commands (a line of space separated arguments) are also accepted so that
+	// the server can be used with telnet.
+	respReader struct {
+		r *bufio.Reader
+
+		// maxBulkLength is the largest single argument that a client can send, anything larger
+		// could not be stored by the database anyway.
+		maxBulkLength int
+	}
+
+	// respWriter writes replies to a client. Replies are buffered until Flush is called.
+	respWriter struct {
+		w *bufio.Writer
+	}
+)
+
+func newRespReader(r io.Reader, maxBulkLength int) *respReader {
+	return &respReader{
+		r:             bufio.NewReader(r),
+		maxBulkLength: maxBulkLength,
+	}
+}
+
+func newRespWriter(w io.Writer) *respWriter {
+	return &respWriter{w: bufio.NewWriter(w)}
+}
+
+// ReadCommand reads the next command from the client. Empty inline commands are skipped.
+func (r *respReader) ReadCommand() ([][]byte, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if line[0] != '*' {
+			args := bytes.Fields(line)
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+
+		count, err := strconv.Atoi(string(line[1:]))
+		if err != nil || count > maxArrayLength {
+			return nil, errProtocol
+		}
+		if count <= 0 {
+			continue
+		}
+
+		// Like the length of a bulk string, the count is only what the client claims to be
+		// sending, so the arguments are appended as they arrive.
+		var args [][]byte
+		for i := 0; i < count; i++ {
+			arg, err := r.readBulk()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+
+		return args, nil
+	}
+}
+
+// readBulk reads a single bulk string.
+func (r *respReader) readBulk() ([]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '$' {
+		return nil, errProtocol
+	}
+
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil || length < 0 || length > r.maxBulkLength {
+		return nil, errProtocol
+	}
+
+	// The length is only what the client claims to be sending, so the buffer grows as the data
+	// actually arrives instead of being allocated up front.
+	var data bytes.Buffer
+	if _, err = io.CopyN(&data, r.r, int64(length)); err != nil {
+		return nil, err
+	}
+
+	// The bulk string is followed by a CRLF.
+	var end [2]byte
+	if _, err = io.ReadFull(r.r, end[:]); err != nil {
+		return nil, err
+	}
+	if end[0] != '\r' || end[1] != '\n' {
+		return nil, errProtocol
+	}
+
+	return data.Bytes(), nil
+}
+
+// readLine reads a single line without the line ending.
+func (r *respReader) readLine() ([]byte, error) {
+	line, err := r.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errProtocol
+	} else if err != nil {
+		return nil, err
+	}
+
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+
+	return append([]byte{}, line...), nil
+}
+
+// WriteReply writes a single reply. The type of the reply decides how it is encoded:
+// status is a simple string, error is an error, int64 is an integer, []byte is a bulk string where
+// nil is a null bulk string, and []interface{} is an array of replies.
+func (w *respWriter) WriteReply(reply interface{}) {
+	switch reply := reply.(type) {
+	case status:
+		fmt.Fprintf(w.w, "+%s\r\n", reply)
+	case error:
+		fmt.Fprintf(w.w, "-%s\r\n", reply)
+	case int64:
+		fmt.Fprintf(w.w, ":%d\r\n", reply)
+	case []byte:
+		if reply == nil {
+			w.w.WriteString("$-1\r\n")
+			return
+		}
+		fmt.Fprintf(w.w, "$%d\r\n", len(reply))
+		w.w.Write(reply)
+		w.w.WriteString("\r\n")
+	case []interface{}:
+		if reply == nil {
+			w.w.WriteString("*-1\r\n")
+			return
+		}
+		fmt.Fprintf(w.w, "*%d\r\n", len(reply))
+		for _, item := range reply {
+			w.WriteReply(item)
+		}
+	default:
+		panic(fmt.Sprintf("unknown reply type %T", reply))
+	}
+}
+
+// Flush sends every buffered reply to the client.
+func (w *respWriter) Flush() error {
+	return w.w.Flush()
+}
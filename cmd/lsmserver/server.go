@@ -0,0 +1,506 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/elliotcourant/lsmtree"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultScanCount is how many keys SCAN looks at if COUNT is not provided.
+	defaultScanCount = 10
+
+	// maxCursors is the largest number of SCAN cursors a single connection can have open. Once
+	// there are more than this the oldest cursor is forgotten.
+	maxCursors = 1024
+)
+
+var (
+	errSyntax          = errors.New("ERR syntax error")
+	errNotInteger      = errors.New("ERR value is not an integer or out of range")
+	errInvalidCursor   = errors.New("ERR invalid cursor")
+	errNestedMulti     = errors.New("ERR MULTI calls can not be nested")
+	errExecWithoutMuti = errors.New("ERR EXEC without MULTI")
+	errDiscardNoMulti  = errors.New("ERR DISCARD without MULTI")
+	errExecAbort       = errors.New("EXECABORT Transaction discarded because of previous errors.")
+	errExpireTime      = errors.New("ERR invalid expire time in 'set' command")
+)
+
+type (
+	// server accepts redis clients and runs their commands against the database.
+	server struct {
+		db     *lsmtree.DB
+		clock  lsmtree.Clock
+		logger *log.Logger
+
+		// maxBulkLength is the largest single argument that a client can send, see respReader.
+		maxBulkLength int
+
+		lock        sync.Mutex
+		listener    net.Listener
+		connections map[net.Conn]struct{}
+		closed      bool
+	}
+
+	// session is the state of a single client connection.
+	session struct {
+		db *lsmtree.DB
+
+		// clock is the Options.Clock of the database, expirations are relative to it.
+		clock lsmtree.Clock
+
+		// queue is the commands that have been queued since MULTI. It is nil when the client is
+		// not in a MULTI block. queueFailed is set if any command could not be queued, this will
+		// make EXEC fail.
+		queue       [][][]byte
+		queueFailed bool
+
+		// cursors are the keys that each SCAN cursor will continue from. cursorOrder is the order
+		// the cursors were created in so that the oldest can be forgotten.
+		cursors     map[uint64][]byte
+		cursorOrder []uint64
+		nextCursor  uint64
+	}
+
+	// command is a single redis command that the server supports.
+	command struct {
+		// arity is the number of arguments including the name of the command. If this is negative
+		// then the command takes at least -arity arguments.
+		arity int
+
+		// write is true if the command can make changes.
+		write bool
+
+		handler func(s *session, txn *lsmtree.Txn, args [][]byte) interface{}
+	}
+)
+
+// commands are the commands that can be run against the database. Connection commands like MULTI
+// and QUIT are handled by the session itself.
+var commands = map[string]command{
+	"GET":  {arity: 2, handler: (*session).get},
+	"SET":  {arity: -3, write: true, handler: (*session).set},
+	"DEL":  {arity: -2, write: true, handler: (*session).del},
+	"TTL":  {arity: 2, handler: (*session).ttl},
+	"SCAN": {arity: -2, handler: (*session).scan},
+}
+
+// newServer creates a server for the database that was opened with the options provided. The
+// options limit how large an argument a client can send.
+func newServer(db *lsmtree.DB, options lsmtree.Options, logger *log.Logger) *server {
+	maxBulkLength := options.MaxValueSize
+	if options.MaxKeySize > maxBulkLength {
+		maxBulkLength = options.MaxKeySize
+	}
+
+	return &server{
+		db:            db,
+		clock:         options.Clock,
+		logger:        logger,
+		maxBulkLength: int(maxBulkLength),
+		connections:   map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts connections until the listener is closed.
+func (s *server) Serve(listener net.Listener) error {
+	s.lock.Lock()
+	s.listener = listener
+	s.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.lock.Lock()
+		s.connections[conn] = struct{}{}
+		s.lock.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting connections and closes every open connection.
+func (s *server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	for conn := range s.connections {
+		_ = conn.Close()
+	}
+
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+
+	return nil
+}
+
+// handle reads and runs commands from a single connection until it is closed.
+func (s *server) handle(conn net.Conn) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.connections, conn)
+		s.lock.Unlock()
+		_ = conn.Close()
+	}()
+
+	reader, writer := newRespReader(conn, s.maxBulkLength), newRespWriter(conn)
+	session := &session{
+		db:      s.db,
+		clock:   s.clock,
+		cursors: map[uint64][]byte{},
+	}
+
+	for {
+		args, err := reader.ReadCommand()
+		if err == errProtocol {
+			writer.WriteReply(err)
+			_ = writer.Flush()
+			return
+		} else if err != nil {
+			if err != io.EOF {
+				s.logger.Printf("reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		reply, quit := session.run(args)
+		writer.WriteReply(reply)
+		if err = writer.Flush(); err != nil || quit {
+			return
+		}
+	}
+}
+
+// run runs a single command and returns its reply. If quit is true then the connection should be
+// closed once the reply has been sent.
+func (s *session) run(args [][]byte) (reply interface{}, quit bool) {
+	name := strings.ToUpper(string(args[0]))
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			return args[1], false
+		}
+		return status("PONG"), false
+	case "QUIT":
+		return status("OK"), true
+	case "MULTI":
+		if s.queue != nil {
+			return errNestedMulti, false
+		}
+		s.queue, s.queueFailed = [][][]byte{}, false
+		return status("OK"), false
+	case "DISCARD":
+		if s.queue == nil {
+			return errDiscardNoMulti, false
+		}
+		s.queue = nil
+		return status("OK"), false
+	case "EXEC":
+		if s.queue == nil {
+			return errExecWithoutMuti, false
+		}
+		queue, failed := s.queue, s.queueFailed
+		s.queue = nil
+		if failed {
+			return errExecAbort, false
+		}
+		return s.exec(queue), false
+	}
+
+	cmd, err := lookupCommand(name, args)
+	if err != nil {
+		if s.queue != nil {
+			s.queueFailed = true
+		}
+		return err, false
+	}
+
+	if s.queue != nil {
+		s.queue = append(s.queue, args)
+		return status("QUEUED"), false
+	}
+
+	txn, err := s.db.NewTransaction(lsmtree.TxnOptions{ReadOnly: !cmd.write})
+	if err != nil {
+		return toError(err), false
+	}
+	defer txn.Discard()
+
+	reply = cmd.handler(s, txn, args)
+	if _, failed := reply.(error); failed || !cmd.write {
+		return reply, false
+	}
+
+	if err = txn.Commit(); err != nil {
+		return toError(err), false
+	}
+
+	return reply, false
+}
+
+// exec runs every queued command in a single transaction. The replies are only returned if the
+// transaction is committed.
+func (s *session) exec(queue [][][]byte) interface{} {
+	txn, err := s.db.NewTransaction(lsmtree.TxnOptions{})
+	if err != nil {
+		return toError(err)
+	}
+	defer txn.Discard()
+
+	replies := make([]interface{}, len(queue))
+	for i, args := range queue {
+		cmd, _ := lookupCommand(strings.ToUpper(string(args[0])), args)
+		replies[i] = cmd.handler(s, txn, args)
+	}
+
+	if err = txn.Commit(); err != nil {
+		return toError(err)
+	}
+
+	return replies
+}
+
+// lookupCommand finds the command and makes sure it was given the right number of arguments.
+func lookupCommand(name string, args [][]byte) (command, error) {
+	cmd, ok := commands[name]
+	if !ok {
+		// The name is quoted since it comes straight from the client, a CR or LF in it would
+		// otherwise end the error line early and break the framing of the reply.
+		return command{}, fmt.Errorf("ERR unknown command %q", args[0])
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		return command{}, fmt.Errorf("ERR wrong number of arguments for '%s' command",
+			strings.ToLower(name))
+	}
+
+	return cmd, nil
+}
+
+// get implements GET key.
+func (s *session) get(txn *lsmtree.Txn, args [][]byte) interface{} {
+	item, err := txn.Get(args[1])
+	if err == lsmtree.ErrKeyNotFound {
+		return []byte(nil)
+	} else if err != nil {
+		return toError(err)
+	}
+
+	return item.Value
+}
+
+// set implements SET key value [NX|XX] [EX seconds|PX milliseconds|EXAT unix-time-seconds|
+// PXAT unix-time-milliseconds|KEEPTTL]. The database stores expirations in whole seconds, so a key
+// set with PX or PXAT expires at the start of the second that its expiration falls in.
+func (s *session) set(txn *lsmtree.Txn, args [][]byte) interface{} {
+	now := s.clock.Now()
+
+	var nx, xx, keepTTL bool
+	var expiresAt time.Time
+	for i := 3; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i])); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if !expiresAt.IsZero() || i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+
+			// Anything larger could overflow once it is converted to a time.Duration.
+			unit := time.Second
+			if option == "PX" || option == "PXAT" {
+				unit = time.Millisecond
+			}
+			if n <= 0 || n > math.MaxInt64/int64(unit) {
+				return errExpireTime
+			}
+
+			switch option {
+			case "EX", "PX":
+				expiresAt = now.Add(time.Duration(n) * unit)
+			default:
+				expiresAt = time.Unix(0, 0).Add(time.Duration(n) * unit)
+			}
+		default:
+			return errSyntax
+		}
+	}
+
+	if (nx && xx) || (keepTTL && !expiresAt.IsZero()) {
+		return errSyntax
+	}
+
+	if nx || xx || keepTTL {
+		item, err := txn.Get(args[1])
+		exists := err == nil
+		if err != nil && err != lsmtree.ErrKeyNotFound {
+			return toError(err)
+		}
+
+		if (nx && exists) || (xx && !exists) {
+			return []byte(nil)
+		}
+
+		if keepTTL && item.ExpiresAt != 0 {
+			expiresAt = time.Unix(int64(item.ExpiresAt), 0)
+		}
+	}
+
+	var err error
+	if expiresAt.IsZero() {
+		err = txn.Set(args[1], args[2])
+	} else {
+		err = txn.SetWithTTL(args[1], args[2], expiresAt.Sub(now))
+	}
+	if err != nil {
+		return toError(err)
+	}
+
+	return status("OK")
+}
+
+// del implements DEL key [key ...]. It returns the number of keys that existed.
+func (s *session) del(txn *lsmtree.Txn, args [][]byte) interface{} {
+	var deleted int64
+	for _, key := range args[1:] {
+		if _, err := txn.Get(key); err == lsmtree.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return toError(err)
+		}
+
+		if err := txn.Delete(key); err != nil {
+			return toError(err)
+		}
+		deleted++
+	}
+
+	return deleted
+}
+
+// ttl implements TTL key. It is the number of seconds until the key expires, -1 if the key exists
+// but does not expire, or -2 if it does not exist.
+func (s *session) ttl(txn *lsmtree.Txn, args [][]byte) interface{} {
+	item, err := txn.Get(args[1])
+	if err == lsmtree.ErrKeyNotFound {
+		return int64(-2)
+	} else if err != nil {
+		return toError(err)
+	}
+
+	if item.ExpiresAt == 0 {
+		return int64(-1)
+	}
+
+	return int64(item.ExpiresAt) - s.clock.Now().Unix()
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT count]. Cursors are numbers that refer to the
+// key the scan should continue from, they are only valid on the connection that created them.
+func (s *session) scan(txn *lsmtree.Txn, args [][]byte) interface{} {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return errInvalidCursor
+	}
+
+	var pattern []byte
+	count := defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil {
+				return errNotInteger
+			} else if count < 1 {
+				return errSyntax
+			}
+		default:
+			return errSyntax
+		}
+	}
+
+	var start []byte
+	if cursor != 0 {
+		var ok bool
+		if start, ok = s.cursors[cursor]; !ok {
+			return errInvalidCursor
+		}
+		delete(s.cursors, cursor)
+	}
+
+	iterator, err := txn.NewIterator(lsmtree.IteratorOptions{})
+	if err != nil {
+		return toError(err)
+	}
+	defer iterator.Close()
+
+	keys := make([]interface{}, 0)
+	iterator.Seek(start)
+	for examined := 0; iterator.Valid() && examined < count; iterator.Next() {
+		key := iterator.Item().Key
+		if pattern == nil || matchGlob(pattern, key) {
+			keys = append(keys, []byte(key))
+		}
+		examined++
+	}
+
+	next := uint64(0)
+	if iterator.Valid() {
+		next = s.newCursor(iterator.Item().Key)
+	}
+
+	return []interface{}{[]byte(strconv.FormatUint(next, 10)), keys}
+}
+
+// newCursor stores the key that the next SCAN should start from and returns the cursor for it.
+func (s *session) newCursor(key []byte) uint64 {
+	if len(s.cursorOrder) >= maxCursors {
+		delete(s.cursors, s.cursorOrder[0])
+		s.cursorOrder = s.cursorOrder[1:]
+	}
+
+	s.nextCursor++
+	s.cursors[s.nextCursor] = key
+	s.cursorOrder = append(s.cursorOrder, s.nextCursor)
+
+	return s.nextCursor
+}
+
+// toError converts an error from the database into a redis error reply.
+func toError(err error) error {
+	return fmt.Errorf("ERR %v", err)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/elliotcourant/lsmtree"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	directory, err := ioutil.TempDir("", "lsmserver")
+	assert.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	options := lsmtree.DefaultOptions()
+	options.DataDirectory = directory
+	options.WALDirectory = directory
+	clock := lsmtree.NewManualClock(time.Unix(1000, 0))
+	options.Clock = clock
+	db, err := lsmtree.Open(options)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	srv := newServer(db, options, log.New(ioutil.Discard, "", 0))
+	client, conn := net.Pipe()
+	defer client.Close()
+	go srv.handle(conn)
+
+	reader := bufio.NewReader(client)
+
+	// do sends a command and returns the raw reply with each line separated by a space.
+	do := func(args ...string) string {
+		command := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		go client.Write([]byte(command))
+
+		var lines []string
+		pending := 1
+		for pending > 0 {
+			line, err := reader.ReadString('\n')
+			assert.NoError(t, err)
+			line = strings.TrimSuffix(line, "\r\n")
+			lines = append(lines, line)
+			pending--
+
+			var n int
+			switch line[0] {
+			case '*':
+				fmt.Sscanf(line[1:], "%d", &n)
+				pending += n
+			case '$':
+				if fmt.Sscanf(line[1:], "%d", &n); n >= 0 {
+					pending++
+				}
+			}
+		}
+
+		return strings.Join(lines, " ")
+	}
+
+	t.Run("get set del", func(t *testing.T) {
+		assert.Equal(t, "+PONG", do("PING"))
+		assert.Equal(t, "$-1", do("GET", "a"))
+		assert.Equal(t, "+OK", do("SET", "a", "1"))
+		assert.Equal(t, "$1 1", do("GET", "a"))
+		assert.Equal(t, "$-1", do("SET", "a", "2", "NX"))
+		assert.Equal(t, "+OK", do("SET", "a", "2", "XX"))
+		assert.Equal(t, "$1 2", do("GET", "a"))
+		assert.Equal(t, ":-1", do("TTL", "a"))
+		assert.Equal(t, ":1", do("DEL", "a", "b"))
+		assert.Equal(t, ":-2", do("TTL", "a"))
+		assert.Equal(t, "-ERR wrong number of arguments for 'get' command", do("GET"))
+		assert.Equal(t, `-ERR unknown command "NO\r\nPE"`, do("NO\r\nPE"))
+		assert.Equal(t, `-ERR unknown command "NOPE"`, do("NOPE"))
+	})
+
+	t.Run("expiration", func(t *testing.T) {
+		assert.Equal(t, "+OK", do("SET", "e", "1", "EX", "10"))
+		assert.Equal(t, ":10", do("TTL", "e"))
+		assert.Equal(t, "+OK", do("SET", "e", "2", "KEEPTTL"))
+		assert.Equal(t, ":10", do("TTL", "e"))
+		assert.Equal(t, "+OK", do("SET", "e", "3", "PX", "5500"))
+		assert.Equal(t, ":5", do("TTL", "e"))
+		assert.Equal(t, "+OK", do("SET", "e", "4", "EXAT", "1020"))
+		assert.Equal(t, ":20", do("TTL", "e"))
+		assert.Equal(t, "+OK", do("SET", "e", "5", "PXAT", "1030000"))
+		assert.Equal(t, ":30", do("TTL", "e"))
+		assert.Equal(t, "+OK", do("SET", "e", "6"))
+		assert.Equal(t, ":-1", do("TTL", "e"))
+
+		assert.Equal(t, "+OK", do("SET", "e", "7", "EX", "10"))
+		clock.Advance(10 * time.Second)
+		assert.Equal(t, "$-1", do("GET", "e"))
+		assert.Equal(t, ":-2", do("TTL", "e"))
+
+		assert.Equal(t, "-ERR invalid expire time in 'set' command", do("SET", "e", "1", "EX", "0"))
+		assert.Equal(t, "-ERR value is not an integer or out of range", do("SET", "e", "1", "EX", "x"))
+		assert.Equal(t, "-ERR syntax error", do("SET", "e", "1", "EX", "1", "PX", "1"))
+		assert.Equal(t, "-ERR syntax error", do("SET", "e", "1", "EX", "1", "KEEPTTL"))
+		assert.Equal(t, "-ERR syntax error", do("SET", "e", "1", "EX"))
+	})
+
+	t.Run("multi", func(t *testing.T) {
+		assert.Equal(t, "+OK", do("MULTI"))
+		assert.Equal(t, "+QUEUED", do("SET", "x", "1"))
+		assert.Equal(t, "+QUEUED", do("GET", "x"))
+		assert.Equal(t, "*2 +OK $1 1", do("EXEC"))
+		assert.Equal(t, "-ERR EXEC without MULTI", do("EXEC"))
+
+		assert.Equal(t, "+OK", do("MULTI"))
+		assert.Equal(t, "+QUEUED", do("SET", "y", "1"))
+		assert.Equal(t, "+OK", do("DISCARD"))
+		assert.Equal(t, "$-1", do("GET", "y"))
+
+		assert.Equal(t, "+OK", do("MULTI"))
+		assert.Equal(t, `-ERR unknown command "NOPE"`, do("NOPE"))
+		assert.Equal(t, "+QUEUED", do("SET", "y", "1"))
+		assert.Contains(t, do("EXEC"), "EXECABORT")
+		assert.Equal(t, "$-1", do("GET", "y"))
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		for _, key := range []string{"k1", "k2", "k3", "other"} {
+			assert.Equal(t, "+OK", do("SET", key, "v"))
+		}
+
+		assert.Equal(t, "*2 $1 1 *2 $2 k1 $2 k2", do("SCAN", "0", "MATCH", "k*", "COUNT", "2"))
+		assert.Equal(t, "*2 $1 2 *1 $2 k3", do("SCAN", "1", "MATCH", "k*", "COUNT", "2"))
+		assert.Equal(t, "*2 $1 0 *0", do("SCAN", "2", "MATCH", "k*", "COUNT", "2"))
+		assert.Equal(t, "-ERR invalid cursor", do("SCAN", "1"))
+	})
+
+	assert.Equal(t, "+OK", do("QUIT"))
+}
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbc", false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.match, matchGlob([]byte(c.pattern), []byte(c.key)), "%s %s", c.pattern, c.key)
+	}
+}
+
+func TestRespReader(t *testing.T) {
+	t.Run("bulk", func(t *testing.T) {
+		reader := newRespReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$5\r\nhello\r\n"), 5)
+		args, err := reader.ReadCommand()
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("GET"), []byte("hello")}, args)
+	})
+
+	t.Run("bulk too large", func(t *testing.T) {
+		reader := newRespReader(strings.NewReader("*1\r\n$6\r\nhello!\r\n"), 5)
+		_, err := reader.ReadCommand()
+		assert.Equal(t, errProtocol, err)
+	})
+
+	t.Run("bulk shorter than claimed", func(t *testing.T) {
+		// A client that claims a huge argument but never sends it only costs what it sent.
+		reader := newRespReader(strings.NewReader("*1\r\n$1000000\r\nhello"), 1<<30)
+		_, err := reader.ReadCommand()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("array longer than sent", func(t *testing.T) {
+		// A client that claims a huge array but never sends it only costs what it sent.
+		reader := newRespReader(strings.NewReader("*1000000\r\n$5\r\nhello\r\n"), 5)
+		_, err := reader.ReadCommand()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("missing crlf", func(t *testing.T) {
+		reader := newRespReader(strings.NewReader("*1\r\n$5\r\nhello!!"), 5)
+		_, err := reader.ReadCommand()
+		assert.Equal(t, errProtocol, err)
+	})
+}
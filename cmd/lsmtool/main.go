@@ -0,0 +1,156 @@
+// lsmtool is a command line tool for inspecting and maintaining lsmtree databases while they are
+// not being used by anything else.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/elliotcourant/lsmtree"
+	"io/ioutil"
+	"os"
+)
+
+const usage = `usage: lsmtool <command> [flags]
+
+commands:
+  verify    check every finished file against the checksums in the manifest
+  replay    replay a workload trace recorded by a Tracer against a database
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch command, args := os.Args[1], os.Args[2:]; command {
+	case "verify":
+		err = verify(args)
+	case "replay":
+		err = replay(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// verify opens the database and checks every file recorded in the manifest. This can be pointed
+// at a backup or a copy of the database to make sure it was copied correctly.
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	dataDirectory := flags.String("data", "", "the data directory of the database")
+	walDirectory := flags.String("wal", "", "the WAL directory of the database (default: -data)")
+	_ = flags.Parse(args)
+
+	if *dataDirectory == "" {
+		return fmt.Errorf("-data must be specified")
+	}
+
+	if *walDirectory == "" {
+		*walDirectory = *dataDirectory
+	}
+
+	options := lsmtree.DefaultOptions()
+	options.DataDirectory = *dataDirectory
+	options.WALDirectory = *walDirectory
+
+	db, err := lsmtree.Open(options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err = db.VerifyFileChecksums(); err != nil {
+		return err
+	}
+
+	fmt.Println("ok")
+
+	return nil
+}
+
+// replay performs a recorded workload against a database opened with the options provided, so
+// that the effect of changing the options can be measured. By default the trace is replayed into
+// a new temporary database.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	tracePath := flags.String("trace", "", "the trace file to replay")
+	dataDirectory := flags.String("data", "",
+		"the data directory of the database (default: a temporary directory that is removed)")
+	walDirectory := flags.String("wal", "", "the WAL directory of the database (default: -data)")
+	speed := flags.Float64("speed", 0,
+		"replay at this multiple of the recorded rate, 0 replays as fast as possible")
+
+	// These are the options that can be tuned, each one defaults to the default of the database.
+	defaults := lsmtree.DefaultOptions()
+	maxWALSegmentSize := flags.Uint64("max-wal-segment-size", defaults.MaxWALSegmentSize,
+		"Options.MaxWALSegmentSize")
+	pendingWritesBuffer := flags.Int("pending-writes-buffer", defaults.PendingWritesBuffer,
+		"Options.PendingWritesBuffer")
+	unorderedWrites := flags.Bool("unordered-writes", defaults.UnorderedWrites,
+		"Options.UnorderedWrites")
+	skipSyncOnSeal := flags.Bool("skip-sync-on-seal", defaults.SkipSyncOnSeal,
+		"Options.SkipSyncOnSeal")
+	_ = flags.Parse(args)
+
+	if *tracePath == "" {
+		return fmt.Errorf("-trace must be specified")
+	}
+
+	if *dataDirectory == "" {
+		directory, err := ioutil.TempDir("", "lsmtool-replay")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(directory)
+		*dataDirectory = directory
+	}
+
+	if *walDirectory == "" {
+		*walDirectory = *dataDirectory
+	}
+
+	file, err := os.Open(*tracePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := lsmtree.NewTraceReader(file)
+	if err != nil {
+		return err
+	}
+
+	options := defaults
+	options.DataDirectory = *dataDirectory
+	options.WALDirectory = *walDirectory
+	options.MaxWALSegmentSize = *maxWALSegmentSize
+	options.PendingWritesBuffer = *pendingWritesBuffer
+	options.UnorderedWrites = *unorderedWrites
+	options.SkipSyncOnSeal = *skipSyncOnSeal
+
+	db, err := lsmtree.Open(options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := lsmtree.Replay(db, reader, lsmtree.ReplayOptions{Speed: *speed})
+	if err != nil {
+		return err
+	}
+
+	operations := stats.Gets + stats.Sets + stats.Deletes
+	fmt.Printf("gets: %d  sets: %d  deletes: %d  commits: %d  conflicts: %d\n",
+		stats.Gets, stats.Sets, stats.Deletes, stats.Commits, stats.Conflicts)
+	fmt.Printf("elapsed: %s  ops/s: %.0f\n",
+		stats.Elapsed, float64(operations)/stats.Elapsed.Seconds())
+
+	return nil
+}
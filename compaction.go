@@ -0,0 +1,210 @@
+package lsmtree
+
+import (
+	"bytes"
+	"math"
+	"sort"
+)
+
+const (
+	// numLevels is the number of levels in the tree. Level numLevels-1 is the bottommost level,
+	// compactions never write any deeper than that.
+	numLevels = 7
+
+	// level0CompactionTrigger is the number of heap files in level 0 at which level 0 has a
+	// compaction score of 1 and should be compacted into level 1.
+	level0CompactionTrigger = 4
+
+	// rangeDeletionCompactionRatio is the fraction of a level's size that range tombstones have
+	// to cover before the level is compacted regardless of its other score. Without this a wide
+	// DeleteRange would not free any space until the level filled up on its own.
+	rangeDeletionCompactionRatio = 0.5
+)
+
+type (
+	// CompactionScore describes how badly a single level needs to be compacted.
+	CompactionScore struct {
+		Level int
+
+		// Files is the number of heap files in the level.
+		Files int
+
+		// Size is the total size of the heap files in the level in bytes.
+		Size int64
+
+		// RangeDeletedSize is the approximate number of bytes of older data covered by the range
+		// tombstones in the level's files. This space is freed by compacting the level.
+		RangeDeletedSize int64
+
+		// Score is how far the level is past the point where it should be compacted. A level
+		// with a score of 1 or more is a candidate for compaction, the level with the highest
+		// score is compacted first.
+		Score float64
+	}
+
+	// CompactionPick is the compaction that would be run next, see DB.PickCompaction.
+	CompactionPick struct {
+		// Level is the level that files are taken from.
+		Level int
+
+		// OutputLevel is the level that the compacted files are written to.
+		OutputLevel int
+
+		// Files are the Ids of the heap files that would be compacted, in ascending order.
+		Files []uint64
+
+		// Score is the score of the level at the time it was picked.
+		Score float64
+
+		// TrivialMove is true if the files do not overlap each other or any file in the output
+		// level. Then the compaction is run by moving the files to the output level in the
+		// manifest instead of rewriting them, which costs no writes at all. This is what happens
+		// to most files when keys are written in ascending order, like a sequential ingest.
+		TrivialMove bool
+	}
+)
+
+// CompactionScores returns the compaction score of every level, ordered by level. This is meant
+// for tests and tooling that need to know the shape of the tree. It is a dry run, nothing is
+// compacted until DB.Compact is called.
+//
+// Heap files are always added to level 0 and only reach deeper levels when a compaction moves
+// them there, so level 0 is always returned and deeper levels are only returned once they have
+// files. Deeper levels do not have a target size yet, their score only comes from range
+// tombstones.
+//
+// A level whose range tombstones cover at least half of its size has a score of at least 1 plus
+// the fraction covered, so that space deleted by a wide range is reclaimed promptly. Level 0 also
+// has a score of at least the average read amplification over Options.MaxReadAmplification
+// while lookups are searching too many of its files.
+func (db *DB) CompactionScores() []CompactionScore {
+	scores := []CompactionScore{{Level: 0}}
+	for _, file := range db.manifest.Files() {
+		if file.Kind != fileTypeHeap {
+			continue
+		}
+
+		for len(scores) <= file.Level {
+			scores = append(scores, CompactionScore{Level: len(scores)})
+		}
+
+		score := &scores[file.Level]
+		score.Files++
+		score.Size += file.Size
+		score.RangeDeletedSize += db.heapProperties.Get(file.Id).RangeDeletedSize
+	}
+	scores[0].Score = float64(scores[0].Files) / level0CompactionTrigger
+
+	// Lookups that search too many overlapping files are a reason to compact level 0 on their
+	// own, but only if it has more than one file to compact.
+	if scores[0].Files > 1 {
+		scores[0].Score = math.Max(scores[0].Score, db.readAmp.Boost())
+	}
+
+	for i := range scores {
+		if scores[i].Size == 0 {
+			continue
+		}
+
+		covered := float64(scores[i].RangeDeletedSize) / float64(scores[i].Size)
+		if covered >= rangeDeletionCompactionRatio {
+			scores[i].Score = math.Max(scores[i].Score, 1+covered)
+		}
+	}
+
+	return scores
+}
+
+// PickCompaction returns the compaction that would be run next without running it. If no level
+// has a score of at least 1 then false is returned. Calling PickCompaction does not change
+// anything, so it can be called as often as needed to check what compaction would do.
+func (db *DB) PickCompaction() (CompactionPick, bool) {
+	scores := db.CompactionScores()
+
+	// The level with the highest score goes first, ties go to the shallower level since its files
+	// are the newest and have the most overlap.
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].Score > scores[j].Score
+	})
+
+	// The bottommost level has nowhere deeper to write to, so it cannot be compacted.
+	filtered := scores[:0]
+	for _, score := range scores {
+		if score.Level < numLevels-1 {
+			filtered = append(filtered, score)
+		}
+	}
+	scores = filtered
+
+	if len(scores) == 0 || scores[0].Score < 1 {
+		return CompactionPick{}, false
+	}
+
+	pick := CompactionPick{
+		Level:       scores[0].Level,
+		OutputLevel: scores[0].Level + 1,
+		Score:       scores[0].Score,
+	}
+
+	// Level 0 files overlap each other, so all of them have to be compacted together. Deeper
+	// levels do not have a way to choose some of their files yet, so they are compacted whole too.
+	var output []uint64
+	for _, file := range db.manifest.Files() {
+		switch {
+		case file.Kind != fileTypeHeap:
+		case file.Level == pick.Level:
+			pick.Files = append(pick.Files, file.Id)
+		case file.Level == pick.OutputLevel:
+			output = append(output, file.Id)
+		}
+	}
+	pick.TrivialMove = db.canMoveFiles(pick.Files, output)
+
+	return pick, true
+}
+
+// canMoveFiles returns true if the heap files can be moved into a level that holds the output
+// files without being rewritten. That is only safe if no two of the files could hold the same
+// key, otherwise a read could find an older version in one file and stop before it reached the
+// newer version in another. Files whose key range is not known are assumed to overlap everything.
+//
+// Files with range tombstones are always rewritten. The tombstones only free space once they are
+// compacted together with the data that they cover, and moving the file would drop the level's
+// score without freeing any of it.
+func (db *DB) canMoveFiles(files, output []uint64) bool {
+	if len(files) == 0 {
+		return false
+	}
+
+	ranges := make([]tableProperties, 0, len(files)+len(output))
+	for i, id := range append(append([]uint64{}, files...), output...) {
+		properties := db.heapProperties.Get(id)
+		if properties.Smallest == nil || properties.Largest == nil {
+			return false
+		}
+
+		if i < len(files) && properties.RangeDeletions > 0 {
+			return false
+		}
+
+		ranges = append(ranges, properties)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].Smallest, ranges[j].Smallest) < 0
+	})
+
+	for i := 1; i < len(ranges); i++ {
+		if bytes.Compare(ranges[i-1].Largest, ranges[i].Smallest) >= 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// moveFiles runs a compaction that PickCompaction marked as a TrivialMove. The files are moved to
+// the output level by a single edit of the manifest, none of their contents are read or written.
+func (db *DB) moveFiles(pick CompactionPick) error {
+	return db.manifest.MoveFiles(pick.Files, pick.OutputLevel)
+}
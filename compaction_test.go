@@ -0,0 +1,162 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestDB_PickCompaction(t *testing.T) {
+	db, cleanup := newTestDB(t, DefaultOptions())
+	defer cleanup()
+
+	addHeapFile := func(t *testing.T, id uint64, size int) {
+		name := path.Join(db.options.DataDirectory, getHeapFileName(id))
+		assert.NoError(t, ioutil.WriteFile(name, make([]byte, size), 0644))
+		assert.NoError(t, db.manifest.AddFile(fileTypeHeap, id))
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		assert.Equal(t, []CompactionScore{{Level: 0}}, db.CompactionScores())
+
+		_, ok := db.PickCompaction()
+		assert.False(t, ok)
+	})
+
+	t.Run("below trigger", func(t *testing.T) {
+		for id := uint64(1); id < level0CompactionTrigger; id++ {
+			addHeapFile(t, id, 10)
+		}
+
+		scores := db.CompactionScores()
+		assert.Len(t, scores, 1)
+		assert.Equal(t, level0CompactionTrigger-1, scores[0].Files)
+		assert.Equal(t, int64(10*(level0CompactionTrigger-1)), scores[0].Size)
+		assert.True(t, scores[0].Score < 1)
+
+		_, ok := db.PickCompaction()
+		assert.False(t, ok)
+	})
+
+	t.Run("at trigger", func(t *testing.T) {
+		addHeapFile(t, level0CompactionTrigger, 10)
+
+		pick, ok := db.PickCompaction()
+		assert.True(t, ok)
+		assert.Equal(t, CompactionPick{
+			Level:       0,
+			OutputLevel: 1,
+			Files:       []uint64{1, 2, 3, 4},
+			Score:       1,
+		}, pick)
+
+		// Picking is a dry run, so the same compaction is picked again.
+		again, ok := db.PickCompaction()
+		assert.True(t, ok)
+		assert.Equal(t, pick, again)
+	})
+}
+
+func TestDB_PickCompactionRangeDeletions(t *testing.T) {
+	db, cleanup := newTestDB(t, DefaultOptions())
+	defer cleanup()
+
+	for id := uint64(1); id <= 2; id++ {
+		name := path.Join(db.options.DataDirectory, getHeapFileName(id))
+		assert.NoError(t, ioutil.WriteFile(name, make([]byte, 100), 0644))
+		assert.NoError(t, db.manifest.AddFile(fileTypeHeap, id))
+	}
+
+	// Two files are well below the trigger, and a narrow range deletion does not change that.
+	db.heapProperties.Set(2, tableProperties{
+		RangeDeletions:   1,
+		RangeDeletedSize: 20,
+	})
+	_, ok := db.PickCompaction()
+	assert.False(t, ok)
+
+	// Once the range tombstones cover most of the level it is compacted to free the space.
+	db.heapProperties.Set(2, tableProperties{
+		RangeDeletions:   1,
+		RangeDeletedSize: 150,
+	})
+	scores := db.CompactionScores()
+	assert.Equal(t, int64(150), scores[0].RangeDeletedSize)
+	assert.Equal(t, 1.75, scores[0].Score)
+
+	pick, ok := db.PickCompaction()
+	assert.True(t, ok)
+	assert.Equal(t, []uint64{1, 2}, pick.Files)
+
+	// Forgetting the file's properties removes the boost.
+	db.heapProperties.Remove(2)
+	_, ok = db.PickCompaction()
+	assert.False(t, ok)
+}
+
+func TestDB_PickCompactionTrivialMove(t *testing.T) {
+	db, cleanup := newTestDB(t, DefaultOptions())
+	defer cleanup()
+
+	addHeapFile := func(t *testing.T, id uint64, smallest, largest string) {
+		name := path.Join(db.options.DataDirectory, getHeapFileName(id))
+		assert.NoError(t, ioutil.WriteFile(name, make([]byte, 10), 0644))
+		assert.NoError(t, db.manifest.AddFile(fileTypeHeap, id))
+		db.heapProperties.Set(id, tableProperties{
+			Smallest: Key(smallest),
+			Largest:  Key(largest),
+		})
+	}
+
+	// Keys written in ascending order produce files that do not overlap.
+	addHeapFile(t, 1, "a", "c")
+	addHeapFile(t, 2, "d", "f")
+	addHeapFile(t, 3, "g", "i")
+	addHeapFile(t, 4, "j", "l")
+
+	pick, ok := db.PickCompaction()
+	assert.True(t, ok)
+	assert.Equal(t, []uint64{1, 2, 3, 4}, pick.Files)
+	assert.True(t, pick.TrivialMove)
+
+	assert.NoError(t, db.moveFiles(pick))
+	scores := db.CompactionScores()
+	assert.Len(t, scores, 2)
+	assert.Zero(t, scores[0].Files)
+	assert.Equal(t, 4, scores[1].Files)
+	assert.Equal(t, int64(40), scores[1].Size)
+
+	// Files that overlap each other have to be merged.
+	addHeapFile(t, 5, "m", "o")
+	addHeapFile(t, 6, "n", "p")
+	addHeapFile(t, 7, "q", "r")
+	addHeapFile(t, 8, "s", "t")
+	pick, ok = db.PickCompaction()
+	assert.True(t, ok)
+	assert.Equal(t, []uint64{5, 6, 7, 8}, pick.Files)
+	assert.False(t, pick.TrivialMove)
+
+	// So do files that overlap a file in the output level.
+	db.heapProperties.Set(6, tableProperties{Smallest: Key("k"), Largest: Key("k")})
+	pick, _ = db.PickCompaction()
+	assert.False(t, pick.TrivialMove)
+
+	db.heapProperties.Set(6, tableProperties{Smallest: Key("p"), Largest: Key("p")})
+	pick, _ = db.PickCompaction()
+	assert.True(t, pick.TrivialMove)
+
+	// A file without a known key range could overlap anything.
+	db.heapProperties.Set(6, tableProperties{})
+	pick, _ = db.PickCompaction()
+	assert.False(t, pick.TrivialMove)
+
+	// Range tombstones only free space once they are merged with the data they cover.
+	db.heapProperties.Set(6, tableProperties{
+		Smallest:       Key("p"),
+		Largest:        Key("p"),
+		RangeDeletions: 1,
+	})
+	pick, _ = db.PickCompaction()
+	assert.False(t, pick.TrivialMove)
+}
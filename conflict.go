@@ -0,0 +1,94 @@
+package lsmtree
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// minConflictPruneSize is the fewest writes the conflict tracker holds before it tries to
+	// forget the ones that can no longer conflict.
+	minConflictPruneSize = 1024
+)
+
+// Transactions are optimistic: nothing is locked while a transaction runs. Instead every key that
+// a transaction reads with Get is remembered, and when it is committed the writer checks whether
+// any of those keys was written by a transaction with a newer timestamp than the snapshot it read
+// from. If one was then the transaction would have read a stale value, so it fails with
+// ErrTxnConflict and can be retried.
+//
+// The check happens in backgroundWriter, which is the only place timestamps are allocated. So a
+// commit is checked against every transaction that was given a timestamp before it, even ones
+// that are not visible yet.
+
+type (
+	// conflictTracker remembers the newest timestamp that each key was written at. It is only
+	// used by backgroundWriter so it needs no lock.
+	conflictTracker struct {
+		writes map[string]uint64
+
+		// pruneAt is the number of writes that will cause the next prune.
+		pruneAt int
+	}
+)
+
+func newConflictTracker() *conflictTracker {
+	return &conflictTracker{
+		writes:  map[string]uint64{},
+		pruneAt: minConflictPruneSize,
+	}
+}
+
+// Conflicts returns the newest timestamp that any of the keys was written at after the read
+// timestamp, or 0 if none of them were.
+func (c *conflictTracker) Conflicts(reads []Key, readTimestamp uint64) uint64 {
+	var conflict uint64
+	for _, key := range reads {
+		if written := c.writes[string(key)]; written > readTimestamp && written > conflict {
+			conflict = written
+		}
+	}
+
+	return conflict
+}
+
+// Record remembers that the changes were written at the timestamp.
+func (c *conflictTracker) Record(timestamp uint64, changes []walTransactionChange) {
+	for _, change := range changes {
+		c.writes[string(change.Key)] = timestamp
+	}
+}
+
+// Prune forgets every write at or before the timestamp returned by cutoff, no transaction can
+// conflict with them anymore once every open transaction reads at or after it. Writes are only
+// pruned once enough have built up since the last prune, so the cost of pruning is spread over
+// every write.
+func (c *conflictTracker) Prune(cutoff func() uint64) {
+	if len(c.writes) < c.pruneAt {
+		return
+	}
+
+	timestamp := cutoff()
+	for key, written := range c.writes {
+		if written <= timestamp {
+			delete(c.writes, key)
+		}
+	}
+
+	c.pruneAt = 2 * len(c.writes)
+	if c.pruneAt < minConflictPruneSize {
+		c.pruneAt = minConflictPruneSize
+	}
+}
+
+// conflictCutoff returns the oldest timestamp that an open transaction, or one that is started
+// later, could read at.
+func (db *DB) conflictCutoff() uint64 {
+	// The committed timestamp has to be read before the oldest snapshot. A transaction that starts
+	// after the oldest snapshot is found reads at a timestamp that is at least this.
+	cutoff := atomic.LoadUint64(&db.committed)
+	if oldest, ok := db.snapshots.Oldest(); ok && oldest < cutoff {
+		cutoff = oldest
+	}
+
+	return cutoff
+}
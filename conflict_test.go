@@ -0,0 +1,98 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConflictTracker(t *testing.T) {
+	t.Run("conflicts", func(t *testing.T) {
+		tracker := newConflictTracker()
+		tracker.Record(10, []walTransactionChange{{Key: Key("a")}, {Key: Key("b")}})
+		tracker.Record(20, []walTransactionChange{{Key: Key("b")}})
+
+		assert.Zero(t, tracker.Conflicts(nil, 0))
+		assert.Zero(t, tracker.Conflicts([]Key{Key("c")}, 0))
+		assert.Equal(t, uint64(20), tracker.Conflicts([]Key{Key("a"), Key("b")}, 9))
+		assert.Zero(t, tracker.Conflicts([]Key{Key("a")}, 10))
+		assert.Equal(t, uint64(20), tracker.Conflicts([]Key{Key("b")}, 15))
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		tracker := newConflictTracker()
+		calls := 0
+		cutoff := func() uint64 {
+			calls++
+			return 100
+		}
+
+		for i := 0; i < minConflictPruneSize-1; i++ {
+			tracker.Record(uint64(i), []walTransactionChange{{Key: Key{byte(i), byte(i >> 8)}}})
+		}
+		tracker.Prune(cutoff)
+		assert.Equal(t, 0, calls)
+
+		tracker.Record(1000, []walTransactionChange{{Key: Key("new")}})
+		tracker.Prune(cutoff)
+		assert.Equal(t, 1, calls)
+
+		// Every write at or before 100 is forgotten, the rest can still conflict.
+		assert.Len(t, tracker.writes, minConflictPruneSize-1-101+1)
+		assert.Equal(t, uint64(1000), tracker.Conflicts([]Key{Key("new")}, 999))
+	})
+}
+
+func TestTxn_Conflict(t *testing.T) {
+	t.Run("read then written", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		_, err = txn.Get(Key("a"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.NoError(t, txn.Set(Key("b"), []byte("from txn")))
+
+		other, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, other.Set(Key("a"), []byte("from other")))
+		assert.NoError(t, other.Commit())
+
+		assert.Equal(t, ErrTxnConflict, txn.Commit())
+		assert.Equal(t, other.CommitTimestamp(), txn.conflictTimestamp)
+	})
+
+	t.Run("blind writes do not conflict", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		first, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, first.Set(Key("a"), []byte("1")))
+
+		second, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, second.Set(Key("a"), []byte("2")))
+
+		assert.NoError(t, second.Commit())
+		assert.NoError(t, first.Commit())
+	})
+
+	t.Run("read before written", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		writer, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Set(Key("a"), []byte("1")))
+		assert.NoError(t, writer.Commit())
+
+		// The write is older than the snapshot the transaction reads from.
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		_, err = txn.Get(Key("a"))
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("a"), []byte("2")))
+		assert.NoError(t, txn.Commit())
+	})
+}
@@ -0,0 +1,464 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// The crash harness simulates a power failure underneath a database that is being written to, and
+// then checks that the database recovers to a state that it could have been in. Every WAL segment
+// the database creates is wrapped by a crashFS, which remembers each write made to a segment since
+// it was last synced along with the bytes it overwrote. At a random write the crashFS takes an
+// image of the directory as the disk would have it after losing power: every synced write is kept,
+// and of the writes that were not synced only the ones before a random point are kept, the rest
+// are undone. The image is opened as a new database, and the workload continues on it until the
+// next crash.
+//
+// The workload is run by several workers that each own their own keys, so the order of each
+// worker's transactions is known without the workers coordinating. Every transaction of a worker
+// changes some of its keys and records its own number under the worker's last key. After a crash
+// the last key says which transaction of the worker was the last one to be recovered, and it must
+// not be older than the last one that was acknowledged before the crash. Every other key of the
+// worker must be exactly what that transaction left it as, so a transaction that was only partly
+// recovered is caught by any of its keys that do not match.
+
+const (
+	crashWorkers       = 4
+	crashKeysPerWorker = 8
+)
+
+type (
+	// crashFS tracks the writes made to WAL segments that have not been synced yet.
+	crashFS struct {
+		// lock is held by every write and sync so that an image is never taken in the middle of
+		// one.
+		lock sync.Mutex
+
+		random *rand.Rand
+		files  map[string]*crashFile
+
+		// writes is the number of writes made, the image is taken at the write numbered crashAt.
+		writes  int
+		crashAt int
+
+		// crashed is set once the image has been taken, writes made after it are lost.
+		crashed int32
+
+		source string
+		image  string
+	}
+
+	// crashFile wraps a single WAL segment.
+	crashFile struct {
+		fs   *crashFS
+		file ReaderWriterAt
+		size int64
+
+		// pending are the writes made since the file was last synced, oldest first.
+		pending []crashWrite
+	}
+
+	// crashWrite is a write that has not been synced, along with what it would take to undo it.
+	crashWrite struct {
+		offset int64
+		// old is what was in the file where the write was made, up to the end of the file.
+		old []byte
+		// size is the size of the file before the write was made.
+		size int64
+	}
+
+	// crashWorker is the model of one worker's keys.
+	crashWorker struct {
+		id int
+
+		// states is the state of the worker's keys after each of its transactions, the state
+		// before the first transaction is empty.
+		states []map[string]string
+
+		// acknowledged is the last transaction that was committed without an error before the
+		// image was taken.
+		acknowledged int
+	}
+)
+
+func newCrashFS(random *rand.Rand, source, image string, crashAt int) *crashFS {
+	return &crashFS{
+		random:  random,
+		files:   map[string]*crashFile{},
+		crashAt: crashAt,
+		source:  source,
+		image:   image,
+	}
+}
+
+// Wrap is used as the walManager's wrapSegment.
+func (c *crashFS) Wrap(name string, file ReaderWriterAt) ReaderWriterAt {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	wrapped := &crashFile{
+		fs:   c,
+		file: file,
+	}
+	if stat, ok := file.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if info, err := stat.Stat(); err == nil {
+			wrapped.size = info.Size()
+		}
+	}
+	c.files[name] = wrapped
+
+	return wrapped
+}
+
+// Crashed returns true once the image has been taken.
+func (c *crashFS) Crashed() bool {
+	return atomic.LoadInt32(&c.crashed) == 1
+}
+
+// Crash takes the image now if it has not been taken yet.
+func (c *crashFS) Crash() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.crash()
+}
+
+// crash copies every file in the source directory to the image, and then undoes a random suffix of
+// the writes made to each segment since it was last synced. The lock must be held.
+func (c *crashFS) crash() error {
+	if c.Crashed() {
+		return nil
+	}
+	atomic.StoreInt32(&c.crashed, 1)
+
+	files, err := ioutil.ReadDir(c.source)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range files {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		if err = copyFile(
+			path.Join(c.source, info.Name()), path.Join(c.image, info.Name()), info.Mode(),
+		); err != nil {
+			return err
+		}
+
+		segment, ok := c.files[info.Name()]
+		if !ok || len(segment.pending) == 0 {
+			continue
+		}
+
+		if err = segment.undo(
+			path.Join(c.image, info.Name()), c.random.Intn(len(segment.pending)+1),
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *crashFile) ReadAt(p []byte, offset int64) (int, error) {
+	return f.file.ReadAt(p, offset)
+}
+
+func (f *crashFile) WriteAt(p []byte, offset int64) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	// The write that the crash lands on is lost along with everything after it.
+	f.fs.writes++
+	if f.fs.writes == f.fs.crashAt {
+		if err := f.fs.crash(); err != nil {
+			return 0, err
+		}
+	}
+
+	write := crashWrite{
+		offset: offset,
+		size:   f.size,
+	}
+	if offset < f.size {
+		end := offset + int64(len(p))
+		if end > f.size {
+			end = f.size
+		}
+
+		write.old = make([]byte, end-offset)
+		if _, err := f.file.ReadAt(write.old, offset); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.WriteAt(p, offset)
+	if end := offset + int64(n); end > f.size {
+		f.size = end
+	}
+	f.pending = append(f.pending, write)
+
+	return n, err
+}
+
+func (f *crashFile) Sync() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if canSync, ok := f.file.(CanSync); ok {
+		if err := canSync.Sync(); err != nil {
+			return err
+		}
+	}
+	f.pending = f.pending[:0]
+
+	return nil
+}
+
+// undo reverts the pending writes of the file after the first keep of them in the copy of the file
+// at filePath, newest first.
+func (f *crashFile) undo(filePath string, keep int) error {
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for i := len(f.pending) - 1; i >= keep; i-- {
+		write := f.pending[i]
+		if len(write.old) > 0 {
+			if _, err = file.WriteAt(write.old, write.offset); err != nil {
+				return err
+			}
+		}
+
+		if err = file.Truncate(write.size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newCrashWorker(id int) *crashWorker {
+	return &crashWorker{
+		id:     id,
+		states: []map[string]string{{}},
+	}
+}
+
+func (w *crashWorker) lastKey() Key {
+	return Key(fmt.Sprintf("worker%d/last", w.id))
+}
+
+// Next returns the next transaction that the worker will commit as the changes it makes to its
+// keys, a nil value is a delete.
+func (w *crashWorker) Next(random *rand.Rand) map[string][]byte {
+	state := map[string]string{}
+	for key, value := range w.states[len(w.states)-1] {
+		state[key] = value
+	}
+
+	number := len(w.states)
+	changes := map[string][]byte{}
+	for i := random.Intn(crashKeysPerWorker) + 1; i > 0; i-- {
+		key := fmt.Sprintf("worker%d/key%d", w.id, random.Intn(crashKeysPerWorker))
+		if random.Intn(4) == 0 {
+			changes[key] = nil
+			delete(state, key)
+			continue
+		}
+
+		value := fmt.Sprintf("%d/%s", number, key)
+		changes[key] = []byte(value)
+		state[key] = value
+	}
+	w.states = append(w.states, state)
+
+	return changes
+}
+
+// Run commits transactions until the crash has happened or count transactions have been made.
+func (w *crashWorker) Run(db *DB, fs *crashFS, random *rand.Rand, count int) error {
+	for i := 0; i < count && !fs.Crashed(); i++ {
+		changes := w.Next(random)
+		number := len(w.states) - 1
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		if err != nil {
+			return err
+		}
+
+		for key, value := range changes {
+			if value == nil {
+				err = txn.Delete(Key(key))
+			} else {
+				err = txn.Set(Key(key), value)
+			}
+			if err != nil {
+				txn.Discard()
+				return err
+			}
+		}
+
+		if err = txn.Set(w.lastKey(), []byte(strconv.Itoa(number))); err != nil {
+			txn.Discard()
+			return err
+		}
+
+		// A commit that returns after the image was taken might not have been synced before it.
+		if err = txn.Commit(); err != nil {
+			return err
+		}
+		if !fs.Crashed() {
+			w.acknowledged = number
+		}
+	}
+
+	return nil
+}
+
+// Recover checks the worker's keys in a database recovered from a crash, and then forgets every
+// transaction that was not recovered so that the workload can continue on the database.
+func (w *crashWorker) Recover(t *testing.T, db *DB) bool {
+	txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+	if !assert.NoError(t, err) {
+		return false
+	}
+	defer txn.Discard()
+
+	recovered := 0
+	item, err := txn.Get(w.lastKey())
+	if err == nil {
+		recovered, err = strconv.Atoi(string(item.Value))
+	}
+	if err != ErrKeyNotFound && !assert.NoError(t, err) {
+		return false
+	}
+
+	if !assert.GreaterOrEqual(t, recovered, w.acknowledged,
+		"worker %d lost an acknowledged transaction", w.id) ||
+		!assert.Less(t, recovered, len(w.states), "worker %d recovered too much", w.id) {
+		return false
+	}
+
+	expected := w.states[recovered]
+	for i := 0; i < crashKeysPerWorker; i++ {
+		key := fmt.Sprintf("worker%d/key%d", w.id, i)
+		item, err := txn.Get(Key(key))
+		if value, ok := expected[key]; ok {
+			if !assert.NoError(t, err, "worker %d transaction %d: %s", w.id, recovered, key) ||
+				!assert.Equal(t, value, string(item.Value),
+					"worker %d transaction %d: %s", w.id, recovered, key) {
+				return false
+			}
+		} else if !assert.Equal(t, ErrKeyNotFound, err,
+			"worker %d transaction %d: %s", w.id, recovered, key) {
+			return false
+		}
+	}
+
+	w.states = w.states[:recovered+1]
+	w.acknowledged = recovered
+
+	return true
+}
+
+// runCrashWorkload runs the workload against a database in source until a random write, and
+// returns the image of the directory at that write. The database in source is closed.
+func runCrashWorkload(
+	t *testing.T, random *rand.Rand, source, image string, workers []*crashWorker,
+) bool {
+	options := DefaultOptions()
+	options.DataDirectory, options.WALDirectory = source, source
+	db, err := Open(options)
+	if !assert.NoError(t, err) {
+		return false
+	}
+
+	// Each transaction is at least two writes to its segment, and then it is synced.
+	// The crash happens on a background goroutine, so it gets a random source of its own.
+	const transactions = 50
+	crashAt := random.Intn(transactions*len(workers)*3) + 1
+	fs := newCrashFS(rand.New(rand.NewSource(random.Int63())), source, image, crashAt)
+	db.wal.appendLock.Lock()
+	db.wal.wrapSegment = fs.Wrap
+	db.wal.appendLock.Unlock()
+
+	errs := make(chan error, len(workers))
+	for _, worker := range workers {
+		go func(worker *crashWorker, random *rand.Rand) {
+			errs <- worker.Run(db, fs, random, transactions)
+		}(worker, rand.New(rand.NewSource(random.Int63())))
+	}
+
+	ok := true
+	for range workers {
+		ok = assert.NoError(t, <-errs) && ok
+	}
+
+	// If the workload finished before the random write then it crashes once it is done.
+	ok = assert.NoError(t, fs.Crash()) && ok
+	_ = db.Close()
+
+	return ok
+}
+
+func TestCrashConsistency(t *testing.T) {
+	seeds, rounds := 20, 4
+	if testing.Short() {
+		seeds = 4
+	}
+
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			random := rand.New(rand.NewSource(seed))
+
+			workers := make([]*crashWorker, crashWorkers)
+			for i := range workers {
+				workers[i] = newCrashWorker(i)
+			}
+
+			source, cleanup := NewTempDirectory(t)
+			defer cleanup()
+
+			for round := 0; round < rounds; round++ {
+				image, cleanupImage := NewTempDirectory(t)
+				defer cleanupImage()
+
+				if !runCrashWorkload(t, random, source, image, workers) {
+					return
+				}
+
+				options := DefaultOptions()
+				options.DataDirectory, options.WALDirectory = image, image
+				db, err := Open(options)
+				if !assert.NoError(t, err, "round %d", round) {
+					return
+				}
+
+				for _, worker := range workers {
+					if !worker.Recover(t, db) {
+						_ = db.Close()
+						return
+					}
+				}
+				assert.NoError(t, db.Close())
+
+				// The next round continues from what was recovered.
+				source = image
+			}
+		})
+	}
+}
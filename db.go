@@ -2,6 +2,13 @@ package lsmtree
 
 import (
 	"fmt"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Options is used to configure how the database will behave.
@@ -27,85 +34,878 @@ type Options struct {
 	// Default is db/data.
 	DataDirectory string
 
+	// HeapDirectories are more folders that heap files are striped across along with the
+	// DataDirectory, usually one for each device so that their bandwidth adds up. New heap files
+	// are written to each directory in turn. The WALDirectory should be on a device of its own
+	// where possible, since every commit waits for it to sync. Directories can be added or
+	// removed between opens of the database as long as the heap files in a removed directory
+	// are moved to one of the others.
+	// Default is nil, every heap file is stored in the DataDirectory.
+	HeapDirectories []string
+
+	// ValueDirectories are more folders that value files are spread across along with the
+	// DataDirectory, so that workloads with large values can use the bandwidth and space of
+	// several disks. Each value file is placed by consistent hashing of its Id, so adding a
+	// directory later only changes where a fair share of new files go. Existing files are found
+	// in whichever of the directories they are in. DB.DirectoryUsage reports how much each
+	// directory holds.
+	// Default is nil, every value file is stored in the DataDirectory.
+	ValueDirectories []string
+
 	// Number of pending writes that can be queued up concurrently before transaction commits will
 	// be blocked.
 	PendingWritesBuffer int
+
+	// MaxInFlightWrites is the number of commits that can be in progress at once before the
+	// database starts holding writes back, which protects the latency of interactive writes while
+	// bulk writes are running. Low priority writes wait once half of this many commits are in
+	// progress, normal priority writes wait once this many are, and high priority writes never
+	// wait. See TxnOptions.Priority. If this is 0 then writes are never held back.
+	// Default is 0.
+	MaxInFlightWrites int
+
+	// MaxBatchCount is the largest number of keys that a single transaction or WriteBatch can
+	// change. Once it is reached Set and Delete return ErrTxnTooBig for any other key, the
+	// changes made so far are kept so the caller can commit them and carry on in a new
+	// transaction. This cannot be larger than 65535, if it is 0 then 65535 is used.
+	// Default is 65535.
+	MaxBatchCount int
+
+	// MaxBatchSize (in bytes) is the largest total size of the keys and values that a single
+	// transaction or WriteBatch can change. Like MaxBatchCount, a change that would go over this
+	// returns ErrTxnTooBig and is not made. If this is 0 then the size is not limited.
+	// Default is 64mb.
+	MaxBatchSize int64
+
+	// MaxKeySize (in bytes) is the largest a single key is allowed to be. A change to a larger key
+	// is rejected with ErrKeyTooLarge by the call that makes it, like Txn.Set or Txn.Delete, so it
+	// never reaches the commit. This cannot be larger than 64kb.
+	// Default is 16kb.
+	MaxKeySize uint32
+
+	// MaxValueSize (in bytes) is the largest a single value is allowed to be. A larger value is
+	// rejected with ErrValueTooLarge by the call that sets it, like Txn.Set, so it never reaches
+	// the commit. This cannot be larger than 1gb.
+	// Default is 1mb.
+	MaxValueSize uint32
+
+	// Clock is used anywhere the database needs the current time, like when allocating timestamps
+	// for transactions. This can be replaced with a ManualClock to make tests deterministic.
+	// Default is the system clock.
+	Clock Clock
+
+	// WALEncryptionKey is used to encrypt every transaction written to the WAL using AES-GCM. The
+	// key must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256. This only applies to
+	// the WAL and is independent of how any other files are stored, so the WAL can be encrypted on
+	// its own (for example when it is on a shared device). The same key must be provided every
+	// time the database is opened.
+	// Default is nil, the WAL is not encrypted.
+	WALEncryptionKey []byte
+
+	// WALCompressionThreshold (in bytes) is the encoded size above which a transaction is
+	// compressed before it is written to the WAL. Compressing small transactions costs more CPU
+	// than the space it saves, so this is meant for workloads with large batch commits. A WAL with
+	// compressed transactions cannot be read by versions of the database from before compression
+	// was added.
+	// Default is 0, transactions are never compressed.
+	WALCompressionThreshold int
+
+	// IOUring is an experimental option that will perform all reads, writes and syncs of WAL
+	// segments and value files through io_uring. This is only supported on linux 5.6 or newer, if
+	// it is not supported then Open will return ErrIOUringNotSupported.
+	// Default is false.
+	IOUring bool
+
+	// FileMode is the permissions that any files created by the database will have (before the
+	// umask is applied). Directories created by the database will have the same permissions but
+	// with the execute bit added wherever the read bit is set, so 0644 will create directories
+	// with 0755. The owner must be able to read and write the files.
+	// Default is 0644.
+	FileMode os.FileMode
+
+	// Registry can be shared between multiple databases in the same process. The database will be
+	// added to the registry when it is opened and removed when it is closed. If the registry
+	// already has RegistryOptions.MaxOpenDatabases open then Open will return
+	// ErrTooManyDatabases.
+	// Default is nil.
+	Registry *Registry
+
+	// MaxTotalMemory is the approximate number of bytes of memory that the database will try to
+	// stay under. When it is exceeded the row cache is shrunk to make room, it is the only memory
+	// that can be given back. Memtables cannot be flushed to the disk yet, so their memory is
+	// counted towards the total but can never be reclaimed and this does not bound how much memory
+	// the database uses. Once the memtables alone are over the limit every write empties the row
+	// cache again, which only slows writers down. If this is 0 then memory usage is only tracked
+	// (see DB.MemoryUsage).
+	// Default is 0.
+	MaxTotalMemory int64
+
+	// SnapshotLeakThreshold is how long a snapshot can be held before it is logged as a possible
+	// leak. Snapshots keep old versions of keys from being removed, so a snapshot that is never
+	// released will cause the database to grow forever. If this is 0 then snapshots are never
+	// checked.
+	// Default is 0.
+	SnapshotLeakThreshold time.Duration
+
+	// Logger is used to report problems that do not cause an operation to fail.
+	// Default is a logger that writes to stderr.
+	Logger Logger
+
+	// UnorderedWrites is meant for bulk loading. Transactions are still written to the WAL in
+	// order, but once they are durable each committer applies its own changes to the memtable
+	// concurrently instead of waiting for the transactions before it. This increases write
+	// throughput, but a transaction that starts while others are committing may see a newer
+	// transaction without seeing an older one. A transaction will always see its own commits.
+	// Default is false.
+	UnorderedWrites bool
+
+	// VerifyOnOpen will make Open read every transaction in the WAL and return an error if any of
+	// them are corrupt. Segments are read in parallel, but this still makes opening a large
+	// database slower. When this is false nothing is read until it is needed.
+	// Default is false.
+	VerifyOnOpen bool
+
+	// DeleteFilesPerSecond is the largest number of obsolete files that will be deleted each
+	// second. Obsolete files are moved into a trash directory right away and deleted in the
+	// background so that deleting many files at once does not stall the filesystem.
+	// Default is 0, the number of files deleted is not limited.
+	DeleteFilesPerSecond int
+
+	// DeleteBytesPerSecond is the largest number of bytes of obsolete files that will be deleted
+	// each second. This works with DeleteFilesPerSecond, whichever is slower is used.
+	// Default is 0, the number of bytes deleted is not limited.
+	DeleteBytesPerSecond int64
+
+	// MaxReadAmplification is the largest average number of heap files that a point lookup can
+	// search before level 0 should be compacted regardless of how many files it has. When
+	// lookups keep landing on overlapping level 0 files, level 0 is given a compaction score of
+	// the average over this limit. Lookups do not read heap files yet, the average is counted
+	// from the files in the manifest that could hold each key, and the score only changes what
+	// CompactionScores and PickCompaction report: DB.Compact cannot merge overlapping files yet, so
+	// nothing is compacted because of it. Metrics.ReadAmp reports the average and whether it is
+	// over the limit.
+	// Default is 8, if this is 0 then read amplification does not change the scores.
+	MaxReadAmplification float64
+
+	// LockTimeout is how long Open keeps trying to lock the database directories when another
+	// process has them locked, for example because it is still closing the database. The
+	// directories are tried again every few milliseconds until the timeout passes.
+	// Default is 0, Open returns ErrDatabaseLocked straight away.
+	LockTimeout time.Duration
+
+	// LockLease locks the database directories with a lease instead of an OS file lock. The lease
+	// is recorded in a LEASE file in each directory and renewed by the process that holds it a
+	// third of the way through each lease. If the process stops renewing it, because it crashed or
+	// lost access to the directory, the next process can take over once the lease expires, or
+	// straight away if the holder was on the same host and has exited. This is meant for shared
+	// filesystems like NFS that do not release OS locks reliably. The lease should be a lot
+	// longer than the longest pause the process could have, or two processes could both believe
+	// they hold the directory. Every process that opens the database must use the same setting.
+	// Default is 0, directories are locked with OS file locks.
+	LockLease time.Duration
+
+	// SkipSyncOnSeal skips syncing finished files to the disk. Normally when a WAL segment is
+	// sealed, or any other file is finished, the file and then its directory are synced before
+	// anything refers to it. With this enabled a crash can lose or corrupt finished files, and
+	// transactions in a sealed WAL segment may be lost even after their commit returned. This is
+	// only meant for ephemeral data sets that are rebuilt from scratch after a crash.
+	// Default is false.
+	SkipSyncOnSeal bool
+
+	// NegativeLookupCacheSize is the number of missing keys that are remembered so that repeated
+	// lookups of them can return ErrKeyNotFound without searching the rest of the read path. This
+	// helps workloads that keep checking for keys that do not exist, like a cache in front of
+	// another store. Each key is removed as soon as it is written. If this is 0 then missing keys
+	// are not remembered.
+	// Default is 0.
+	NegativeLookupCacheSize int
+
+	// RowCacheSize is the approximate number of bytes used to cache the newest version of recently
+	// read keys, so that lookups of very hot keys are answered without searching the read path.
+	// Each key is removed from the cache as soon as it is written, and the cache is the first
+	// thing shrunk when Options.MaxTotalMemory is exceeded. If this is 0 then there is no row
+	// cache.
+	// Default is 0.
+	RowCacheSize int64
+
+	// Tracer records every read and committed write to a trace that can be replayed against
+	// different options with Replay. See NewTracer.
+	// Default is nil, nothing is traced.
+	Tracer *Tracer
+
+	// WatchBufferSize is the number of committed transactions that can be queued for each Watch
+	// before commits start waiting for the watch to catch up. See DB.Watch.
+	// Default is 64.
+	WatchBufferSize int
+
+	// MaxWatchLagSegments is the largest number of WAL segments that a watch can fall behind
+	// before it is disconnected. Once the buffer of a watch that stops keeping up is full it holds
+	// back every commit, disconnecting it lets them continue. A disconnected watch stops receiving
+	// changes and Watch.Err returns ErrWatchTooSlow. WAL segments are never deleted, so this does
+	// not limit how much of the WAL is kept on disk.
+	// Default is 0, watches are never disconnected.
+	MaxWatchLagSegments int
+
+	// IdempotencyTokenRetention is how long a token applied with ApplyIfNotSeen is remembered.
+	// Once a token is older than this a batch with the same token will be applied again, so this
+	// should be longer than the longest time a producer could take to deliver a message again.
+	// Default is 0, tokens are remembered forever.
+	IdempotencyTokenRetention time.Duration
+
+	// NumVersionsToKeep is the largest number of the newest versions of each key that
+	// DB.GetVersions returns, including versions that deleted the key. Returning more than one
+	// version allows reading a key's history, for example to undo a change. Nothing writes
+	// compacted tables yet, so no version is ever removed and this does not limit what is kept.
+	// Default is 1.
+	NumVersionsToKeep int
+
+	// ExpirationInterval is how often keys that were set with a TTL and have expired are deleted
+	// in the background. Expired keys are never returned by reads whether or not this is set.
+	// Each delete is committed like any other, so it adds a tombstone to the WAL and the
+	// memtable. Nothing drops the expired versions or the tombstones until memtables can be
+	// flushed and compacted, so for now this makes the database use more disk and memory, not
+	// less. If this is 0 then expired keys are not deleted in the background.
+	// Default is 0.
+	ExpirationInterval time.Duration
+
+	// Quotas limit the logical size of the keys under each of their prefixes. A commit that
+	// would take a quota over its limit fails with ErrQuotaExceeded. Committing a prepared
+	// transaction is never rejected, since it was promised to succeed when it was prepared. The
+	// usage of each quota is counted again from the data every time the database is opened, so
+	// quotas can be changed between opens. See DB.QuotaUsage.
+	// Default is nil, nothing is limited.
+	Quotas []Quota
+
+	// AccessSampleRate enables sampling the keys that are read with Txn.Get and written by
+	// commits so that DB.HeatMap can show which key prefixes get the most traffic. On average one
+	// in every AccessSampleRate accesses is sampled, a higher rate costs less but makes the heat
+	// map less accurate for prefixes that get little traffic.
+	// Default is 0, nothing is sampled.
+	AccessSampleRate int
+
+	// HeatMapPrefixLength is the number of bytes at the start of each key that decide which
+	// bucket of the heat map it is counted in, for example the length of a tenant id. Keys that
+	// are shorter than this are counted in a bucket of their own.
+	// Default is 4.
+	HeatMapPrefixLength int
+
+	// The options below tune reads from value files. Keys do not point into value files yet, so
+	// nothing reads them and these are not exported until something does.
+
+	// coalesceReads will merge concurrent reads of values that are stored near each other within
+	// the same value file into a single larger read. This helps most on storage where each read
+	// has a high latency, like network attached block storage.
+	// Default is false.
+	coalesceReads bool
 }
 
 // DB is the root object for the database. You can open/create your DB by calling Open().
 type DB struct {
+	// The fields that are modified atomically with 64-bit operations come first so that they are
+	// 64-bit aligned on 32-bit platforms.
+
+	// committed is the timestamp of the last transaction that was committed. New transactions and
+	// snapshots read at this timestamp. It is only modified atomically.
+	committed uint64
+
+	// expiredKeys is the number of keys that have been deleted because they expired.
+	expiredKeys uint64
+
+	// lookups counts where each point lookup was answered.
+	lookups lookupCounters
+
+	options Options
+
 	wal    *walManager
 	values *valueManager
 
-	writeChannel     chan interface{}
+	// timestamps is used to allocate the timestamp for each transaction.
+	timestamps *timestampAllocator
+
+	// ring is used for all file IO if Options.IOUring is enabled, otherwise it is nil.
+	ring *ioURing
+
+	// snapshots are all of the snapshots that have not been released yet.
+	snapshots snapshotList
+
+	// transactions are all of the open transactions that have a timeout.
+	transactions transactionList
+
+	// memtable holds every change that has been committed.
+	memtable *memtable
+
+	// memory tracks the approximate memory used by the database and reclaims memory when
+	// Options.MaxTotalMemory is exceeded.
+	memory *memoryAccountant
+
+	// background gates flushes and compactions so that they can be paused.
+	background *backgroundWork
+
+	// admission holds back writes by priority when too many commits are in progress.
+	admission *writeAdmission
+
+	// readAmp counts how many heap files each point lookup searched.
+	readAmp *readAmpTracker
+
+	// negativeLookups remembers keys that were recently looked up and not found.
+	negativeLookups *negativeCache
+
+	// rows caches the newest version of recently read keys.
+	rows *rowCache
+
+	// heapProperties are the tableProperties of every heap file, used to plan compactions.
+	heapProperties *heapProperties
+
+	// prepared are the transactions that have been prepared and not committed or rolled back.
+	prepared *preparedTransactions
+
+	// tokens are the idempotency tokens that have been applied by ApplyIfNotSeen.
+	tokens *idempotencyTokens
+
+	// expirations are the versions of keys that expire and have not been deleted yet, see
+	// expiredKeys.
+	expirations *expirationIndex
+
+	// quotas enforces Options.Quotas, it is nil if there are none.
+	quotas *quotaTracker
+
+	// accesses samples the keys that are read and written for DB.HeatMap, it is nil if
+	// Options.AccessSampleRate is 0.
+	accesses *accessSampler
+
+	// conflicts are the recent writes that commits are checked against, it is only used by
+	// backgroundWriter.
+	conflicts *conflictTracker
+
+	// manifest records the finished files that the database depends on.
+	manifest *manifest
+
+	// timestampWaiters are waiting for a timestamp to be published, see WaitForTimestamp.
+	timestampWaiters timestampWaiters
+
+	// watches are every Watch that has not been closed.
+	watches watchList
+
+	// fsmLock serializes ApplyBatch, NewFSMSnapshot and InstallSnapshot so that the applied index
+	// always matches the changes that have been committed.
+	fsmLock sync.Mutex
+
+	// deleter removes obsolete files in the background.
+	deleter *fileDeleter
+
+	// locks are held on the database directories for as long as the database is open.
+	locks []*directoryLock
+
+	// writeChannel is the first stage of the commit pipeline (see pipeline.go), syncChannel and
+	// applyChannel are the stages after it.
+	writeChannel     chan *commitRequest
+	syncChannel      chan *commitRequest
+	applyChannel     chan *commitRequest
 	stopWriteChannel chan chan error
+
+	// pipelineDone is closed once every stage of the commit pipeline has exited.
+	pipelineDone chan struct{}
+
+	// stopped is closed when the database is closed to stop any background tasks.
+	stopped chan struct{}
+
+	// closed is set to 1 atomically once Close has been called. Any calls made against the DB
+	// after this point will return ErrClosed.
+	closed int32
 }
 
 // Open will open or create the database using the provided configuration.
-func Open(options Options) (*DB, error) {
-	// TODO (elliotcourant) Add options validation.
+func Open(options Options) (_ *DB, err error) {
+	// Make sure the options provided are usable before we create anything on the disk.
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	// If we fail to open the database after we have locked directories or started the ring then
+	// they need to be released so that the database can be opened again.
+	var locks []*directoryLock
+	var ring *ioURing
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		for _, lock := range locks {
+			_ = lock.Release()
+		}
+
+		if ring != nil {
+			_ = ring.Close()
+		}
+	}()
 
 	// Try to setup the WAL manager.
-	wal, err := newWalManager(options.WALDirectory, options.MaxWALSegmentSize)
+	wal, err := newWalManager(options.WALDirectory, options.MaxWALSegmentSize, options.FileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure that no one else has the database open. Both the WAL and the data directory are
+	// locked since they can be configured to be different places.
+	for _, directory := range getDatabaseDirectories(options) {
+		if err = newDirectory(directory, getDirectoryMode(options.FileMode)); err != nil {
+			return nil, err
+		}
+
+		lock, err := acquireDirectoryLock(directory, options)
+		if err != nil {
+			return nil, err
+		}
+
+		locks = append(locks, lock)
+	}
+
+	// If a key was provided for the WAL then every transaction will be encrypted.
+	if wal.cipher, err = newRecordCipher(options.WALEncryptionKey); err != nil {
+		return nil, err
+	}
+	wal.compressionThreshold = options.WALCompressionThreshold
+
+	if options.VerifyOnOpen {
+		if err = wal.Verify(runtime.GOMAXPROCS(0)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Transactions that were prepared before the database was closed stay prepared until they
+	// are committed or rolled back, and idempotency tokens are only stored in the WAL.
+	recovery, err := wal.recover()
 	if err != nil {
 		return nil, err
 	}
 
+	manifest, err := openManifest(options.DataDirectory, options.FileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sealed WAL segments and finished files are synced before anything refers to them, unless
+	// the caller has decided that their data does not need to survive a crash.
+	wal.syncer = newFileSyncer(options)
+	wal.watchLag = newWatchLag(options.MaxWatchLagSegments)
+	manifest.syncer = newFileSyncer(options)
+	manifest.heap = newHeapDirectories(options)
+
+	// Segment Ids are leased from the manifest so that they are never reused, even once every
+	// segment has been removed from the WAL directory.
+	wal.useSegmentIdLease(manifest.LastSegmentId(), manifest.LeaseSegmentIds)
+
+	// A segment missing from the middle of the WAL has lost transactions, and a copy of a segment
+	// somewhere else is usually left behind by moving the WAL directory. Neither stops the
+	// database from being opened, but they are reported so they can be looked at.
+	report, err := validateWalSegments(
+		path.Clean(options.WALDirectory), getDatabaseDirectories(options),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if !report.Empty() && options.Logger != nil {
+		options.Logger.Printf("wal segments in %s are inconsistent: %s",
+			options.WALDirectory, report)
+	}
+
+	deleter, err := newFileDeleter(
+		getDatabaseDirectories(options),
+		options.DeleteFilesPerSecond,
+		options.DeleteBytesPerSecond,
+		options.FileMode,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replaced manifests are the files that the database makes obsolete on its own, they go
+	// through the deleter like any other obsolete file would.
+	manifest.remove = deleter.Delete
+
+	values, err := newValueManager(getValueDirectories(options), options.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	values.coalesceReads = options.coalesceReads
+
+	// If io_uring was requested then all of the files will be wrapped to use it.
+	if options.IOUring {
+		if ring, err = newIOURing(uringEntries); err != nil {
+			return nil, err
+		}
+
+		wal.ring, values.ring = ring, ring
+	}
+
 	db := &DB{
+		options:      options,
 		wal:          wal,
-		values:       nil,
-		writeChannel: make(chan interface{}, options.PendingWritesBuffer),
+		values:       values,
+		timestamps:   newTimestampAllocator(options.Clock),
+		memory:       newMemoryAccountant(options.MaxTotalMemory),
+		memtable:     newMemtable(),
+		background:   newBackgroundWork(),
+		admission:    newWriteAdmission(options.MaxInFlightWrites),
+		deleter:      deleter,
+		manifest:     manifest,
+		ring:         ring,
+		locks:        locks,
+		writeChannel: make(chan *commitRequest, options.PendingWritesBuffer),
+		syncChannel:  make(chan *commitRequest, options.PendingWritesBuffer),
+		applyChannel: make(chan *commitRequest, options.PendingWritesBuffer),
+		pipelineDone: make(chan struct{}),
 
 		// TODO (elliotcourant) make this channel some sort of cancelFuture object.
 		stopWriteChannel: make(chan chan error, 1), // Make this a single byte for now.
+		stopped:          make(chan struct{}),
+	}
+
+	db.negativeLookups = newNegativeCache(options.NegativeLookupCacheSize)
+	db.readAmp = newReadAmpTracker(options.MaxReadAmplification)
+	db.rows = newRowCache(options.RowCacheSize, db.memory)
+	db.heapProperties = newHeapProperties()
+	db.prepared = newPreparedTransactions(recovery.prepared)
+	db.timestamps.Observe(recovery.lastPrepareId)
+	// Every transaction that was committed before the database was closed is applied to the
+	// memtable again, nothing is flushed to heap files yet so the WAL holds all of the data.
+	db.expirations = newExpirationIndex()
+	for _, txn := range recovery.committed {
+		db.memory.Add(memoryMemtables, db.memtable.Apply(txn.Timestamp, txn.Entries))
+		db.expirations.Add(txn.Timestamp, txn.Entries)
+		db.timestamps.Observe(txn.Timestamp)
+		db.committed = txn.Timestamp
 	}
+	db.conflicts = newConflictTracker()
+	db.quotas = newQuotaTracker(options.Quotas, db.memtable)
+	db.accesses = newAccessSampler(options.AccessSampleRate, options.HeatMapPrefixLength)
+	db.tokens = newIdempotencyTokens(
+		options.Clock, options.IdempotencyTokenRetention, recovery.tokens,
+	)
 
-	// Start the background writer to accept transaction commits.
-	go db.backgroundWriter()
+	if options.Registry != nil {
+		if err = options.Registry.register(db); err != nil {
+			return nil, err
+		}
+	}
+
+	// Start each stage of the commit pipeline.
+	goBackground("backgroundWriter", db.backgroundWriter)
+	goBackground("backgroundSyncer", db.backgroundSyncer)
+	goBackground("backgroundApplier", db.backgroundApplier)
+
+	if options.SnapshotLeakThreshold > 0 {
+		goBackground("snapshotLeakDetector", db.snapshotLeakDetector)
+	}
+
+	goBackground("transactionReaper", db.transactionReaper)
+	goBackground("obsoleteFileDeleter", db.obsoleteFileDeleter)
+
+	if options.ExpirationInterval > 0 {
+		goBackground("keyExpirer", db.keyExpirer)
+	}
 
 	return db, nil
 }
 
+// getDatabaseDirectories returns each of the unique directories that the database will store
+// files in.
+func getDatabaseDirectories(options Options) []string {
+	directories := []string{path.Clean(options.WALDirectory)}
+	seen := map[string]struct{}{directories[0]: {}}
+	for _, directory := range append(newHeapDirectories(options), options.ValueDirectories...) {
+		directory = path.Clean(directory)
+		if _, ok := seen[directory]; ok {
+			continue
+		}
+		seen[directory] = struct{}{}
+
+		directories = append(directories, directory)
+	}
+
+	return directories
+}
+
 // DefaultOptions just provides a basic configuration which can be passed to open a database.
 func DefaultOptions() Options {
 	return Options{
-		MaxWALSegmentSize:   1024 /* 1kb */ * 8,  /* 8kb */
-		MaxValueChunkSize:   1024 /* 1kb */ * 32, /* 32kb */
-		DataDirectory:       "db/data",
-		WALDirectory:        "db/wal",
-		PendingWritesBuffer: 8,
+		MaxWALSegmentSize:    1024 /* 1kb */ * 8,  /* 8kb */
+		MaxValueChunkSize:    1024 /* 1kb */ * 32, /* 32kb */
+		DataDirectory:        "db/data",
+		WALDirectory:         "db/wal",
+		PendingWritesBuffer:  8,
+		MaxKeySize:           1024 /* 1kb */ * 16,   /* 16kb */
+		MaxValueSize:         1024 /* 1kb */ * 1024, /* 1mb */
+		MaxBatchCount:        maxTransactionEntries,
+		MaxBatchSize:         1024 /* 1kb */ * 1024 /* 1mb */ * 64, /* 64mb */
+		Clock:                systemClock{},
+		FileMode:             defaultFileMode,
+		Logger:               log.New(os.Stderr, "lsmtree: ", log.LstdFlags),
+		WatchBufferSize:      64,
+		NumVersionsToKeep:    1,
+		HeatMapPrefixLength:  4,
+		MaxReadAmplification: 8,
+	}
+}
+
+// validate will check the options provided to make sure that they can be used to open a database.
+// If the options are not valid then an error wrapping ErrInvalidOptions will be returned.
+func (o Options) validate() error {
+	switch {
+	case o.MaxWALSegmentSize == 0:
+		return fmt.Errorf("%w: MaxWALSegmentSize must be greater than 0", ErrInvalidOptions)
+	case o.MaxWALSegmentSize > maxWalSegmentSizeLimit:
+		return fmt.Errorf("%w: MaxWALSegmentSize cannot be larger than %d bytes",
+			ErrInvalidOptions, maxWalSegmentSizeLimit)
+	case o.WALDirectory == "":
+		return fmt.Errorf("%w: WALDirectory must be specified", ErrInvalidOptions)
+	case o.DataDirectory == "":
+		return fmt.Errorf("%w: DataDirectory must be specified", ErrInvalidOptions)
+	case o.MaxKeySize == 0:
+		return fmt.Errorf("%w: MaxKeySize must be greater than 0", ErrInvalidOptions)
+	case o.MaxKeySize > maxKeySizeLimit:
+		return fmt.Errorf("%w: MaxKeySize cannot be larger than %d bytes",
+			ErrInvalidOptions, maxKeySizeLimit)
+	case o.MaxValueSize > maxValueSizeLimit:
+		return fmt.Errorf("%w: MaxValueSize cannot be larger than %d bytes",
+			ErrInvalidOptions, maxValueSizeLimit)
+	case o.PendingWritesBuffer < 0:
+		return fmt.Errorf("%w: PendingWritesBuffer cannot be negative", ErrInvalidOptions)
+	case o.MaxBatchCount < 0 || o.MaxBatchCount > maxTransactionEntries:
+		return fmt.Errorf("%w: MaxBatchCount must be between 0 and %d",
+			ErrInvalidOptions, maxTransactionEntries)
+	case o.MaxBatchSize < 0:
+		return fmt.Errorf("%w: MaxBatchSize cannot be negative", ErrInvalidOptions)
+	case o.MaxInFlightWrites < 0:
+		return fmt.Errorf("%w: MaxInFlightWrites cannot be negative", ErrInvalidOptions)
+	case o.NegativeLookupCacheSize < 0:
+		return fmt.Errorf("%w: NegativeLookupCacheSize cannot be negative", ErrInvalidOptions)
+	case o.MaxWatchLagSegments < 0:
+		return fmt.Errorf("%w: MaxWatchLagSegments cannot be negative", ErrInvalidOptions)
+	case o.IdempotencyTokenRetention < 0:
+		return fmt.Errorf("%w: IdempotencyTokenRetention cannot be negative", ErrInvalidOptions)
+	case o.ExpirationInterval < 0:
+		return fmt.Errorf("%w: ExpirationInterval cannot be negative", ErrInvalidOptions)
+	case o.AccessSampleRate < 0:
+		return fmt.Errorf("%w: AccessSampleRate cannot be negative", ErrInvalidOptions)
+	case o.AccessSampleRate > 0 && o.HeatMapPrefixLength < 1:
+		return fmt.Errorf("%w: HeatMapPrefixLength must be greater than 0", ErrInvalidOptions)
+	case o.NumVersionsToKeep < 1:
+		return fmt.Errorf("%w: NumVersionsToKeep must be at least 1", ErrInvalidOptions)
+	case o.RowCacheSize < 0:
+		return fmt.Errorf("%w: RowCacheSize cannot be negative", ErrInvalidOptions)
+	case o.MaxTotalMemory < 0:
+		return fmt.Errorf("%w: MaxTotalMemory cannot be negative", ErrInvalidOptions)
+	case o.SnapshotLeakThreshold < 0:
+		return fmt.Errorf("%w: SnapshotLeakThreshold cannot be negative", ErrInvalidOptions)
+	case o.SnapshotLeakThreshold > 0 && o.Logger == nil:
+		return fmt.Errorf("%w: Logger must be specified to detect snapshot leaks", ErrInvalidOptions)
+	case o.DeleteFilesPerSecond < 0:
+		return fmt.Errorf("%w: DeleteFilesPerSecond cannot be negative", ErrInvalidOptions)
+	case o.DeleteBytesPerSecond < 0:
+		return fmt.Errorf("%w: DeleteBytesPerSecond cannot be negative", ErrInvalidOptions)
+	case o.MaxReadAmplification < 0:
+		return fmt.Errorf("%w: MaxReadAmplification cannot be negative", ErrInvalidOptions)
+	case o.LockTimeout < 0:
+		return fmt.Errorf("%w: LockTimeout cannot be negative", ErrInvalidOptions)
+	case o.LockLease < 0:
+		return fmt.Errorf("%w: LockLease cannot be negative", ErrInvalidOptions)
+	case o.LockLease > 0 && o.LockLease < minLockLease:
+		return fmt.Errorf("%w: LockLease must be at least %s", ErrInvalidOptions, minLockLease)
+	case o.WatchBufferSize < 0:
+		return fmt.Errorf("%w: WatchBufferSize cannot be negative", ErrInvalidOptions)
+	case o.Clock == nil:
+		return fmt.Errorf("%w: Clock must be specified", ErrInvalidOptions)
+	case o.FileMode&^os.ModePerm != 0:
+		return fmt.Errorf("%w: FileMode can only contain permission bits", ErrInvalidOptions)
+	case o.FileMode&0600 != 0600:
+		return fmt.Errorf("%w: FileMode must allow the owner to read and write", ErrInvalidOptions)
+	}
+
+	for _, directory := range o.HeapDirectories {
+		if directory == "" {
+			return fmt.Errorf("%w: HeapDirectories cannot contain an empty directory",
+				ErrInvalidOptions)
+		}
+	}
+
+	for _, quota := range o.Quotas {
+		if quota.MaxBytes < 0 || quota.MaxKeys < 0 {
+			return fmt.Errorf("%w: the limits of the quota for %q cannot be negative",
+				ErrInvalidOptions, quota.Prefix)
+		}
+	}
+
+	for _, directory := range o.ValueDirectories {
+		if directory == "" {
+			return fmt.Errorf("%w: ValueDirectories cannot contain an empty directory",
+				ErrInvalidOptions)
+		}
+	}
+
+	switch len(o.WALEncryptionKey) {
+	case 0, 16, 24, 32:
+	default:
+		return fmt.Errorf("%w: WALEncryptionKey must be 16, 24 or 32 bytes", ErrInvalidOptions)
+	}
+
+	if o.WALCompressionThreshold < 0 {
+		return fmt.Errorf("%w: WALCompressionThreshold cannot be negative", ErrInvalidOptions)
+	}
+
+	return nil
+}
+
+// CloseOptions control how much work Close does before the database is closed.
+type CloseOptions struct {
+	// WaitForBackgroundWork will make Close wait for any flushes or compactions that are already
+	// running to finish. If this is false then they are abandoned, and any partial output they
+	// leave behind is removed the next time the database is opened. This makes closing faster at
+	// the cost of redoing the work after the database is opened again.
+	WaitForBackgroundWork bool
+
+	// Timeout is how long Close will wait for pending writes to drain and, if
+	// WaitForBackgroundWork is set, for background work to finish. If the timeout is reached then
+	// ErrCloseTimeout is returned. If this is 0 then Close will wait as long as it needs to.
+	Timeout time.Duration
+}
+
+// DefaultCloseOptions returns the options used by Close.
+func DefaultCloseOptions() CloseOptions {
+	return CloseOptions{
+		WaitForBackgroundWork: true,
+		Timeout:               0,
 	}
 }
 
 // Close will close any open files and stop any background writes. Any writes that have not been
 // returned successfully will not have been written to the database.
 func (db *DB) Close() error {
+	return db.CloseWithOptions(DefaultCloseOptions())
+}
+
+// CloseWithOptions will close the database the same way as Close, but the options can be used to
+// choose between a faster shutdown and a faster startup afterwards.
+//
+// If ErrCloseTimeout is returned then the database is closed, but something might still be
+// writing to its files. The locks on the directories are kept in this case so that another
+// process cannot open the database until this process exits.
+func (db *DB) CloseWithOptions(options CloseOptions) error {
+	// If the database has already been closed then the background writer is no longer running and
+	// we would block forever waiting for it.
+	if !atomic.CompareAndSwapInt32(&db.closed, 0, 1) {
+		return ErrClosed
+	}
+
+	// Even if something fails while closing, the database is no longer usable and should not be
+	// counted against the registry's limits.
+	if db.options.Registry != nil {
+		defer db.options.Registry.unregister(db)
+	}
+
+	// The same deadline is shared by every step below.
+	var deadline <-chan time.Time
+	if options.Timeout > 0 {
+		timer := time.NewTimer(options.Timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	// Stop any background tasks that do not need to be waited for.
+	close(db.stopped)
+	db.background.stop()
+	db.admission.stop()
+
 	// Create a channel that we can use to wait for the response from the background writer.
-	writeChannelFuture := make(chan error, 0)
+	writeChannelFuture := make(chan error, 1)
 
 	// Stop the background writer by sending the channel to it.
 	db.stopWriteChannel <- writeChannelFuture
 
 	// Wait to get a response from the background writer.
-	if err := <-writeChannelFuture; err != nil {
-		return err
+	select {
+	case err := <-writeChannelFuture:
+		if err != nil {
+			return err
+		}
+	case <-deadline:
+		return ErrCloseTimeout
 	}
 
-	// TODO (elliotcourant) Add timeout logic here if the background writer takes too long to exit.
+	if options.WaitForBackgroundWork {
+		select {
+		case <-db.background.idle():
+		case <-deadline:
+			return ErrCloseTimeout
+		}
+	}
 
-	return nil
+	// Nothing can be writing anymore, so the ring and the files can be released. Everything is
+	// closed even if something fails, and the first error is returned. The manifest does not keep
+	// a file open, each change writes and closes a new manifest file.
+	var err error
+	keep := func(closeErr error) {
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	if db.ring != nil {
+		keep(db.ring.Close())
+	}
+	keep(db.wal.Close())
+	keep(db.values.Close())
+
+	// Once everything else has been closed we can let someone else open the database.
+	for _, lock := range db.locks {
+		keep(lock.Release())
+	}
+
+	return err
 }
 
-func (db *DB) backgroundWriter() {
-	for {
-		select {
-		case txn := <-db.writeChannel:
-			fmt.Println(txn)
+// readTimestamp returns the timestamp that new transactions and snapshots should read at.
+func (db *DB) readTimestamp() uint64 {
+	return atomic.LoadUint64(&db.committed)
+}
 
-		case stopResult := <-db.stopWriteChannel:
-			// If we receive anything on the stopWriteChannel then just exit this method.
-			stopResult <- nil
-			return
-		}
+// WaitForTimestamp waits until every transaction committed at or before the timestamp is visible
+// to new transactions. The timestamp would usually come from Txn.CommitTimestamp, possibly on
+// another database that this one is a replica of. If timeout is 0 then this waits until the
+// timestamp is visible or the database is closed, otherwise ErrTimestampNotReached is returned
+// once the timeout has passed.
+func (db *DB) WaitForTimestamp(timestamp uint64, timeout time.Duration) error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	ready := db.timestampWaiters.Wait(timestamp, db.readTimestamp)
+	defer db.timestampWaiters.Cancel(ready)
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
 	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-deadline:
+		return ErrTimestampNotReached
+	case <-db.stopped:
+		return ErrClosed
+	}
+}
+
+// SyncBarrier will return once every transaction that has been written to the WAL before it was
+// called is durable on the disk. Concurrent calls will share a single sync.
+func (db *DB) SyncBarrier() error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	return db.wal.SyncBarrier()
 }
@@ -1,8 +1,15 @@
 package lsmtree
 
 import (
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestOpen(t *testing.T) {
@@ -21,4 +28,350 @@ func TestOpen(t *testing.T) {
 		err = db.Close()
 		assert.NoError(t, err)
 	})
+	t.Run("close twice", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		err = db.Close()
+		assert.NoError(t, err)
+
+		err = db.Close()
+		assert.Equal(t, ErrClosed, err)
+	})
+	t.Run("already open", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir + "/wal"
+		options.DataDirectory = dir + "/data"
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		other, err := Open(options)
+		assert.Equal(t, ErrDatabaseLocked, err)
+		assert.Nil(t, other)
+
+		err = db.Close()
+		assert.NoError(t, err)
+
+		// Once the first database has been closed it can be opened again.
+		other, err = Open(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, other)
+		assert.NoError(t, other.Close())
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.MaxKeySize = maxKeySizeLimit + 1
+
+		db, err := Open(options)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+		assert.Nil(t, db)
+	})
+	t.Run("invalid file mode", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		// Type bits like these used to be passed as the permissions for new files.
+		options.FileMode = os.ModeAppend | os.ModeExclusive
+		db, err := Open(options)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+		assert.Nil(t, db)
+
+		// The owner always needs to be able to read and write the files.
+		options.FileMode = 0444
+		db, err = Open(options)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+		assert.Nil(t, db)
+	})
+	t.Run("file mode", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("windows does not support unix permissions")
+		}
+
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		// 0600 is used here because the umask will not remove any of the bits.
+		options := DefaultOptions()
+		options.WALDirectory = path.Join(dir, "wal")
+		options.DataDirectory = path.Join(dir, "data")
+		options.FileMode = 0600
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+		defer db.Close()
+
+		for _, directory := range []string{options.WALDirectory, options.DataDirectory} {
+			info, err := os.Stat(directory)
+			assert.NoError(t, err)
+			assert.True(t, info.IsDir())
+			assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+			info, err = os.Stat(path.Join(directory, lockFileName))
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		}
+	})
+	t.Run("verify on open", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.VerifyOnOpen = true
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+		assert.NoError(t, txn.Commit())
+		assert.NoError(t, db.Close())
+
+		// Corrupt the only segment, the database should no longer open.
+		segment, err := openWalSegment(dir, 1, int32(options.MaxWALSegmentSize), options.FileMode)
+		assert.NoError(t, err)
+		_, dataOffset := segment.Space.Current()
+		_, err = segment.File.WriteAt([]byte{0xff, 0xff}, dataOffset+24)
+		assert.NoError(t, err)
+
+		db, err = Open(options)
+		assert.True(t, errors.Is(err, ErrCorrupted))
+		assert.Nil(t, db)
+	})
+
+	t.Run("replays the wal", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+
+		var committed uint64
+		for _, value := range []string{"first", "second", ""} {
+			txn, err := db.NewTransaction(TxnOptions{})
+			assert.NoError(t, err)
+			assert.NoError(t, txn.Set(Key("kept"), []byte(value)))
+			if value == "" {
+				assert.NoError(t, txn.Delete(Key("deleted")))
+			} else {
+				assert.NoError(t, txn.Set(Key("deleted"), []byte(value)))
+			}
+			assert.NoError(t, txn.Commit())
+			committed = txn.CommitTimestamp()
+		}
+		assert.NoError(t, db.Close())
+
+		db, err = Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		// Every version is back, and new commits are newer than all of them.
+		assert.Equal(t, committed, db.readTimestamp())
+		versions, err := db.GetVersions(Key("deleted"), 0)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 1) {
+			assert.True(t, versions[0].IsDeleted())
+		}
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		item, err := txn.Get(Key("kept"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{}, item.Value)
+		assert.NoError(t, txn.Set(Key("new"), []byte("value")))
+		assert.NoError(t, txn.Commit())
+		assert.True(t, txn.CommitTimestamp() > committed)
+	})
+
+	t.Run("io_uring", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.IOUring = true
+
+		db, err := Open(options)
+		if err == ErrIOUringNotSupported {
+			t.Skip("io_uring is not supported")
+		}
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		err = db.Close()
+		assert.NoError(t, err)
+	})
+}
+
+func TestCloseWithOptions(t *testing.T) {
+	t.Run("waits for background work", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		assert.True(t, db.background.begin())
+
+		closed := make(chan error)
+		go func() {
+			closed <- db.Close()
+		}()
+
+		select {
+		case <-closed:
+			t.Fatal("close returned while background work was running")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		db.background.end()
+		assert.NoError(t, <-closed)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		assert.True(t, db.background.begin())
+		defer db.background.end()
+
+		err := db.CloseWithOptions(CloseOptions{
+			WaitForBackgroundWork: true,
+			Timeout:               50 * time.Millisecond,
+		})
+		assert.Equal(t, ErrCloseTimeout, err)
+		assert.Equal(t, ErrClosed, db.Close())
+	})
+
+	t.Run("abandon background work", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+
+		assert.True(t, db.background.begin())
+		defer db.background.end()
+
+		assert.NoError(t, db.CloseWithOptions(CloseOptions{
+			WaitForBackgroundWork: false,
+			Timeout:               time.Second,
+		}))
+
+		// The locks should have been released even though work was still running.
+		db, err = Open(options)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("closes files", func(t *testing.T) {
+		if _, err := os.Stat("/proc/self/fd"); err != nil {
+			t.Skip("open files cannot be counted on this platform")
+		}
+
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		// openFiles returns the number of files this process has open in the directory.
+		openFiles := func() int {
+			fds, err := ioutil.ReadDir("/proc/self/fd")
+			assert.NoError(t, err)
+
+			count := 0
+			for _, fd := range fds {
+				target, _ := os.Readlink(path.Join("/proc/self/fd", fd.Name()))
+				if strings.HasPrefix(target, dir) {
+					count++
+				}
+			}
+			return count
+		}
+
+		for i := 0; i < 20; i++ {
+			db, err := Open(options)
+			assert.NoError(t, err)
+
+			txn, err := db.NewTransaction(TxnOptions{})
+			assert.NoError(t, err)
+			assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+			assert.NoError(t, txn.Commit())
+			_, err = db.values.getFile(db.values.nextFileId())
+			assert.NoError(t, err)
+			assert.NotZero(t, openFiles())
+
+			assert.NoError(t, db.Close())
+		}
+		assert.Zero(t, openFiles())
+	})
+}
+
+func TestWaitForTimestamp(t *testing.T) {
+	db, cleanup := newTestDB(t, DefaultOptions())
+	defer cleanup()
+
+	// A timestamp that is already visible should return right away.
+	assert.NoError(t, db.WaitForTimestamp(db.readTimestamp(), time.Millisecond))
+
+	// Wait for the next timestamp that will be committed, the wait should finish once it is.
+	waiting := make(chan error, 1)
+	target := db.readTimestamp() + 1
+	go func() {
+		waiting <- db.WaitForTimestamp(target, 0)
+	}()
+
+	txn, err := db.NewTransaction(TxnOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Set(Key("a"), []byte("1")))
+	assert.NoError(t, txn.Commit())
+
+	select {
+	case err := <-waiting:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for timestamp")
+	}
+
+	// Closing the database should stop anything that is still waiting.
+	go func() {
+		waiting <- db.WaitForTimestamp(db.readTimestamp()+1000000000, 0)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, db.Close())
+	assert.Equal(t, ErrClosed, <-waiting)
 }
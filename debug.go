@@ -0,0 +1,68 @@
+package lsmtree
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// pprofLabelKey is the pprof label that every background goroutine started by the database is
+	// tagged with. The value of the label is the name of the task being performed.
+	pprofLabelKey = "lsmtree"
+)
+
+// goBackground will start the function provided in a new goroutine that has been labeled with the
+// name of the task. This makes it easy to tell which goroutines belong to the database when looking
+// at a goroutine or CPU profile.
+func goBackground(name string, fn func()) {
+	go pprof.Do(context.Background(), pprof.Labels(pprofLabelKey, name), func(context.Context) {
+		fn()
+	})
+}
+
+// DebugString returns a human readable dump of the internal state of the database. This is meant
+// to help with troubleshooting and the format of the string should not be relied on.
+func (db *DB) DebugString() string {
+	buf := &strings.Builder{}
+
+	fmt.Fprintf(buf, "closed: %t\n", atomic.LoadInt32(&db.closed) == 1)
+	fmt.Fprintf(buf, "pending writes: %d/%d\n", len(db.writeChannel), cap(db.writeChannel))
+	buf.WriteString(db.wal.DebugString())
+
+	return buf.String()
+}
+
+// DebugHandler returns an http.Handler that will respond with the DebugString of the database.
+// The handler is not registered anywhere, it is up to the caller to decide where it is served.
+func (db *DB) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(db.DebugString()))
+	})
+}
+
+// DebugString returns a human readable dump of the state of the WAL.
+func (w *walManager) DebugString() string {
+	buf := &strings.Builder{}
+
+	fmt.Fprintf(buf, "wal directory: %s\n", w.Directory)
+	fmt.Fprintf(buf, "wal transactions appended: %d\n", atomic.LoadUint64(&w.appended))
+	fmt.Fprintf(buf, "wal transactions synced: %d\n", atomic.LoadUint64(&w.synced))
+
+	w.appendLock.Lock()
+	segment := w.currentSegment
+	w.appendLock.Unlock()
+
+	if segment == nil {
+		buf.WriteString("wal current segment: none\n")
+	} else {
+		fmt.Fprintf(buf, "wal current segment: %d (%d bytes free)\n",
+			segment.SegmentId, segment.Space.Space())
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,47 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDB_DebugString(t *testing.T) {
+	t.Run("simple", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		debug := db.DebugString()
+		assert.Contains(t, debug, "closed: false")
+		assert.Contains(t, debug, "wal current segment: none")
+	})
+}
+
+func TestDB_DebugHandler(t *testing.T) {
+	t.Run("simple", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		recorder := httptest.NewRecorder()
+		db.DebugHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, db.DebugString(), recorder.Body.String())
+	})
+}
@@ -0,0 +1,123 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrTruncated is returned when data is being decoded but the buffer ends before everything
+	// that was expected could be read.
+	ErrTruncated = errors.New("unexpected end of data")
+
+	// ErrTrailingData is returned when data has been decoded but there are still bytes left in the
+	// buffer that were not expected.
+	ErrTrailingData = errors.New("unexpected trailing data")
+)
+
+// bytesDecoder is a bounds checked reader for data that was encoded with the buffers library. The
+// reader provided by the buffers library will panic if it is given a truncated buffer, this is not
+// acceptable for data that is being read from the disk where it could be corrupted. Once the
+// decoder encounters an error every subsequent read will return a zero value, and the first error
+// can be retrieved with Err. This way a caller can decode an entire structure and check the error
+// once at the end.
+type bytesDecoder struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+// newBytesDecoder creates a decoder that will read from the start of the buffer provided.
+func newBytesDecoder(src []byte) *bytesDecoder {
+	return &bytesDecoder{
+		data:   src,
+		offset: 0,
+		err:    nil,
+	}
+}
+
+// next will return the next n bytes of the buffer and advance the offset. If there are not enough
+// bytes remaining then nil is returned and the decoder will be put into an error state.
+func (d *bytesDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(d.data)-d.offset < n {
+		d.err = ErrTruncated
+		return nil
+	}
+
+	result := d.data[d.offset : d.offset+n]
+	d.offset += n
+	return result
+}
+
+// NextByte returns the next single byte of the buffer.
+func (d *bytesDecoder) NextByte() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+// NextUint16 returns the next 2 bytes of the buffer as a big endian integer.
+func (d *bytesDecoder) NextUint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+// NextUint32 returns the next 4 bytes of the buffer as a big endian integer.
+func (d *bytesDecoder) NextUint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+// NextUint64 returns the next 8 bytes of the buffer as a big endian integer.
+func (d *bytesDecoder) NextUint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+// NextBytes returns a byte array that is prefixed with a 32-bit length. A length of -1 indicates a
+// nil array. Any other negative length is treated as truncated data.
+func (d *bytesDecoder) NextBytes() []byte {
+	length := int32(d.NextUint32())
+	if d.err != nil || length == -1 {
+		return nil
+	}
+
+	if length == 0 {
+		// next would return an empty slice here as well, but be explicit that an empty array is
+		// not nil.
+		return d.next(0)
+	}
+
+	return d.next(int(length))
+}
+
+// Err returns the first error encountered while decoding, or nil if everything was read
+// successfully.
+func (d *bytesDecoder) Err() error {
+	return d.err
+}
+
+// Finish returns the first error encountered while decoding. If there were no errors but there is
+// data left in the buffer then ErrTrailingData is returned.
+func (d *bytesDecoder) Finish() error {
+	if d.err == nil && d.offset != len(d.data) {
+		d.err = ErrTrailingData
+	}
+
+	return d.err
+}
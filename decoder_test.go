@@ -0,0 +1,56 @@
+package lsmtree
+
+import (
+	"github.com/elliotcourant/buffers"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBytesDecoder(t *testing.T) {
+	t.Run("matches buffers encoding", func(t *testing.T) {
+		buf := buffers.NewBytesBuffer()
+		buf.AppendByte(1)
+		buf.AppendUint16(2)
+		buf.AppendUint32(3)
+		buf.AppendUint64(4)
+		buf.Append([]byte("five")...)
+		buf.Append([]byte{}...)
+		buf.Append(nil...)
+
+		decoder := newBytesDecoder(buf.Bytes())
+		assert.Equal(t, byte(1), decoder.NextByte())
+		assert.Equal(t, uint16(2), decoder.NextUint16())
+		assert.Equal(t, uint32(3), decoder.NextUint32())
+		assert.Equal(t, uint64(4), decoder.NextUint64())
+		assert.Equal(t, []byte("five"), decoder.NextBytes())
+
+		empty := decoder.NextBytes()
+		assert.NotNil(t, empty)
+		assert.Empty(t, empty)
+
+		assert.Nil(t, decoder.NextBytes())
+		assert.NoError(t, decoder.Finish())
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		decoder := newBytesDecoder([]byte{0, 0, 0, 8, 1, 2})
+		assert.Nil(t, decoder.NextBytes())
+		assert.Equal(t, ErrTruncated, decoder.Err())
+
+		// Once the decoder has failed every read should return a zero value.
+		assert.Equal(t, uint64(0), decoder.NextUint64())
+		assert.Equal(t, ErrTruncated, decoder.Finish())
+	})
+
+	t.Run("negative length", func(t *testing.T) {
+		decoder := newBytesDecoder([]byte{0xff, 0xff, 0xff, 0xf0})
+		assert.Nil(t, decoder.NextBytes())
+		assert.Equal(t, ErrTruncated, decoder.Err())
+	})
+
+	t.Run("trailing data", func(t *testing.T) {
+		decoder := newBytesDecoder([]byte{1, 2})
+		assert.Equal(t, byte(1), decoder.NextByte())
+		assert.Equal(t, ErrTrailingData, decoder.Finish())
+	})
+}
@@ -0,0 +1,212 @@
+package lsmtree
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// trashDirectoryName is the name of the directory that obsolete files are moved into before
+	// they are deleted. Each database directory has its own trash directory so that files are
+	// never moved across filesystems.
+	trashDirectoryName = "trash"
+)
+
+type (
+	// fileDeleter removes files that are no longer needed by the database. Deleting thousands of
+	// files at once (like after a large compaction) can stall the filesystem for everything else,
+	// so files are moved into a trash directory right away and then deleted in the background at
+	// a limited rate. Anything left in the trash when the database is closed is deleted after the
+	// database is opened again.
+	fileDeleter struct {
+		// filesPerSecond is the largest number of files that will be deleted each second. If this
+		// is 0 then the number of files is not limited.
+		filesPerSecond int
+
+		// bytesPerSecond is the largest number of bytes that will be deleted each second. If this
+		// is 0 then the number of bytes is not limited.
+		bytesPerSecond int64
+
+		// mode is used to create trash directories.
+		mode os.FileMode
+
+		// lock must be held to read or modify pending.
+		lock sync.Mutex
+
+		// pending are the files in the trash that have not been deleted yet, in the order they
+		// were moved to the trash.
+		pending []obsoleteFile
+
+		// wake is signaled whenever a file is added to pending.
+		wake chan struct{}
+	}
+
+	// obsoleteFile is a file in a trash directory waiting to be deleted.
+	obsoleteFile struct {
+		path string
+		size int64
+	}
+)
+
+// newFileDeleter creates a deleter that will delete files at the rates provided. Any files that
+// were left in the trash directories of the database directories by a previous instance of the
+// database are queued to be deleted.
+func newFileDeleter(
+	directories []string, filesPerSecond int, bytesPerSecond int64, mode os.FileMode,
+) (*fileDeleter, error) {
+	deleter := &fileDeleter{
+		filesPerSecond: filesPerSecond,
+		bytesPerSecond: bytesPerSecond,
+		mode:           mode,
+		wake:           make(chan struct{}, 1),
+	}
+
+	for _, directory := range directories {
+		trash := path.Join(directory, trashDirectoryName)
+		infos, err := ioutil.ReadDir(trash)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, info := range infos {
+			if info.IsDir() {
+				continue
+			}
+
+			deleter.pending = append(deleter.pending, obsoleteFile{
+				path: path.Join(trash, info.Name()),
+				size: info.Size(),
+			})
+		}
+	}
+
+	return deleter, nil
+}
+
+// Delete moves the file into the trash directory next to it so that it will be deleted in the
+// background. Once this returns the file no longer exists at its original path.
+func (d *fileDeleter) Delete(filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+
+	trash := path.Join(path.Dir(filePath), trashDirectoryName)
+	if err = newDirectory(trash, getDirectoryMode(d.mode)); err != nil {
+		return err
+	}
+
+	trashPath := path.Join(trash, path.Base(filePath))
+	if err = os.Rename(filePath, trashPath); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	d.pending = append(d.pending, obsoleteFile{
+		path: trashPath,
+		size: info.Size(),
+	})
+	d.lock.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Pending returns the number of files that are waiting to be deleted.
+func (d *fileDeleter) Pending() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return len(d.pending)
+}
+
+// next removes the oldest file from pending. If nothing is pending then false is returned.
+func (d *fileDeleter) next() (obsoleteFile, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(d.pending) == 0 {
+		return obsoleteFile{}, false
+	}
+
+	file := d.pending[0]
+	d.pending = d.pending[1:]
+
+	return file, true
+}
+
+// delay returns how long to wait after deleting a file of the size provided so that neither of
+// the rates are exceeded.
+func (d *fileDeleter) delay(size int64) time.Duration {
+	var delay time.Duration
+	if d.filesPerSecond > 0 {
+		delay = time.Second / time.Duration(d.filesPerSecond)
+	}
+
+	if d.bytesPerSecond > 0 {
+		// This is done in floating point since size * time.Second overflows a Duration for files
+		// larger than about 9GB. A delay that does not fit in a Duration is clamped to the
+		// largest one, it would never be reached anyway.
+		bytesDelay := time.Duration(math.MaxInt64)
+		seconds := float64(size) / float64(d.bytesPerSecond)
+		if nanoseconds := seconds * float64(time.Second); nanoseconds < math.MaxInt64 {
+			bytesDelay = time.Duration(nanoseconds)
+		}
+
+		if bytesDelay > delay {
+			delay = bytesDelay
+		}
+	}
+
+	return delay
+}
+
+// run deletes pending files one at a time until stopped is closed. Each deletion is treated as
+// background work so that it will not happen while background work is paused.
+func (d *fileDeleter) run(stopped <-chan struct{}, work *backgroundWork) {
+	for {
+		file, ok := d.next()
+		if !ok {
+			select {
+			case <-d.wake:
+				continue
+			case <-stopped:
+				return
+			}
+		}
+
+		if !work.begin() {
+			return
+		}
+
+		// If the file is already gone then there is nothing left to do. Any other failure will
+		// leave the file in the trash to be tried again the next time the database is opened.
+		_ = os.Remove(file.path)
+		work.end()
+
+		if delay := d.delay(file.size); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-stopped:
+				timer.Stop()
+				return
+			}
+		}
+	}
+}
+
+// obsoleteFileDeleter deletes the files that have been moved to the trash in the background.
+func (db *DB) obsoleteFileDeleter() {
+	db.deleter.run(db.stopped, db.background)
+}
@@ -0,0 +1,116 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFileDeleter(t *testing.T) {
+	t.Run("delay", func(t *testing.T) {
+		deleter, err := newFileDeleter(nil, 0, 0, defaultFileMode)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), deleter.delay(1024))
+
+		deleter.filesPerSecond = 10
+		assert.Equal(t, 100*time.Millisecond, deleter.delay(1024))
+
+		// The slower of the two rates should be used.
+		deleter.bytesPerSecond = 1024
+		assert.Equal(t, 100*time.Millisecond, deleter.delay(10))
+		assert.Equal(t, 2*time.Second, deleter.delay(2048))
+
+		// Files larger than about 9GB used to overflow the delay and wrap around.
+		deleter.bytesPerSecond = 1024 * 1024
+		assert.Equal(t, 16*1024*time.Second, deleter.delay(16*1024*1024*1024))
+
+		// A delay that does not fit in a Duration is clamped.
+		deleter.bytesPerSecond = 1
+		assert.Equal(t, time.Duration(math.MaxInt64), deleter.delay(math.MaxInt64))
+	})
+
+	t.Run("delete in background", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		deleter, err := newFileDeleter([]string{dir}, 0, 0, defaultFileMode)
+		assert.NoError(t, err)
+
+		filePath := path.Join(dir, getHeapFileName(1))
+		assert.NoError(t, ioutil.WriteFile(filePath, make([]byte, 128), 0644))
+
+		work := newBackgroundWork()
+		assert.NoError(t, work.pause())
+
+		stopped := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			deleter.run(stopped, work)
+		}()
+
+		// The file should be moved into the trash right away, but not deleted while background
+		// work is paused.
+		assert.NoError(t, deleter.Delete(filePath))
+		assert.False(t, getPathExists(filePath))
+
+		trashPath := path.Join(dir, trashDirectoryName, getHeapFileName(1))
+		time.Sleep(50 * time.Millisecond)
+		assert.True(t, getPathExists(trashPath))
+
+		usage, err := getDiskUsage([]string{dir})
+		assert.NoError(t, err)
+		assert.Equal(t, DiskUsage{Obsolete: 128}, usage)
+
+		assert.NoError(t, work.resume())
+		for i := 0; i < 100 && getPathExists(trashPath); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.False(t, getPathExists(trashPath))
+		assert.Equal(t, 0, deleter.Pending())
+
+		close(stopped)
+		<-done
+	})
+
+	t.Run("trash left behind", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		trash := path.Join(dir, trashDirectoryName)
+		assert.NoError(t, os.Mkdir(trash, 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(trash, getValueFileName(1)), nil, 0644))
+		assert.NoError(t, ioutil.WriteFile(path.Join(trash, getValueFileName(2)), nil, 0644))
+
+		deleter, err := newFileDeleter([]string{dir}, 0, 0, defaultFileMode)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, deleter.Pending())
+	})
+
+	t.Run("replaced manifests", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+		assert.NoError(t, db.PauseBackgroundWork())
+
+		name := path.Join(db.options.DataDirectory, getHeapFileName(1))
+		assert.NoError(t, ioutil.WriteFile(name, make([]byte, 10), 0644))
+		assert.NoError(t, db.manifest.AddFile(fileTypeHeap, 1))
+		replaced := getManifestFileName(db.manifest.manifestId)
+		assert.NoError(t, db.manifest.RemoveFile(fileTypeHeap, 1))
+
+		// The manifest that was replaced is handed to the deleter instead of being removed.
+		assert.False(t, getPathExists(path.Join(db.options.DataDirectory, replaced)))
+		trashPath := path.Join(db.options.DataDirectory, trashDirectoryName, replaced)
+		assert.True(t, getPathExists(trashPath))
+
+		assert.NoError(t, db.ResumeBackgroundWork())
+		for i := 0; i < 100 && getPathExists(trashPath); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.False(t, getPathExists(trashPath))
+	})
+}
@@ -0,0 +1,346 @@
+package lsmtree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"sync/atomic"
+)
+
+var (
+	// ErrBadDump is returned by Load when the data being loaded is not a dump, or when the dump
+	// has been truncated or modified.
+	ErrBadDump = errors.New("bad dump")
+
+	// ErrUnknownDumpVersion is returned by Load when the dump was written in a newer format than
+	// this version of the database can read.
+	ErrUnknownDumpVersion = errors.New("unknown dump version")
+)
+
+const (
+	// dumpMagic is written at the start of every dump so that other data is not loaded by accident.
+	dumpMagic = "lsmtdump"
+
+	// dumpVersion is the version of the dump format that is written.
+	dumpVersion = 1
+
+	// dumpRecordEnd marks the end of the records in a dump, it is followed by the trailer.
+	dumpRecordEnd byte = 0
+
+	// dumpRecordItem is a record that contains a single key.
+	dumpRecordItem byte = 1
+
+	// dumpRecordAppliedIndex is a record that contains the applied index of the database when
+	// the dump was written. It is only written by FSM snapshots, and Load ignores it.
+	dumpRecordAppliedIndex byte = 2
+)
+
+type (
+	// dumpWriter writes a dump while keeping a running checksum of everything written.
+	dumpWriter struct {
+		w       *bufio.Writer
+		hash    hash.Hash32
+		scratch [8]byte
+		err     error
+	}
+
+	// dumpReader reads a dump while keeping a running checksum of everything read.
+	dumpReader struct {
+		r    *bufio.Reader
+		hash hash.Hash32
+		err  error
+	}
+)
+
+// Dump writes the newest version of every key in the database to the writer. Deleted keys are not
+// included. The dump is a consistent snapshot of the database at the time Dump was called, writes
+// that happen while the dump is being written are not included.
+//
+// The dump does not depend on how the database stores anything, so it can be loaded into a
+// database written with an incompatible version of this library or read by something else
+// entirely. The format is big endian and is laid out as:
+//
+//	8 Bytes: The magic string "lsmtdump"
+//	2 Bytes: Version (currently 1)
+//	Only in FSM snapshots:
+//	    1 Byte: Record type (2)
+//	    8 Bytes: The applied index of the database
+//	Repeated for each key:
+//	    1 Byte: Record type (1)
+//	    4 Bytes: Key length, followed by the key
+//	    4 Bytes: Value length, followed by the value
+//	    8 Bytes: The timestamp the key was committed at
+//	    1 Byte: The user metadata stored with the value
+//	1 Byte: Record type (0) marking the end of the keys
+//	8 Bytes: The number of keys in the dump
+//	4 Bytes: A 32-bit FNV-1 checksum of everything before it
+func (db *DB) Dump(w io.Writer) error {
+	snapshot, err := db.NewSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	return db.dump(w, snapshot, nil, nil, nil)
+}
+
+// dump writes every key visible to the snapshot that is greater than or equal to start and less
+// than end to the writer, if end is nil then there is no upper bound. If appliedIndex is not nil
+// then it is written to the dump as well.
+func (db *DB) dump(w io.Writer, snapshot *Snapshot, appliedIndex *uint64, start, end Key) error {
+	writer := &dumpWriter{
+		w:    bufio.NewWriter(w),
+		hash: fnv.New32(),
+	}
+	writer.Write([]byte(dumpMagic))
+	writer.WriteUint16(dumpVersion)
+	if appliedIndex != nil {
+		writer.WriteUint8(dumpRecordAppliedIndex)
+		writer.WriteUint64(*appliedIndex)
+	}
+
+	var count uint64
+	var lastKey Key
+	iterator := db.memtable.Iterator()
+	defer iterator.Close()
+	iterator.SetBounds(start, end)
+	for iterator.SeekToFirst(); iterator.Valid() && writer.err == nil; iterator.Next() {
+		key := TimestampedKey(iterator.Key())
+
+		// Versions of a key are sorted newest first, so the first version that is visible to the
+		// snapshot is the one that should be dumped and the rest can be skipped.
+		if key.Timestamp() > snapshot.Timestamp() ||
+			(lastKey != nil && bytes.Equal(key.Key(), lastKey)) {
+			continue
+		}
+		lastKey = append(lastKey[:0], key.Key()...)
+
+		entry := iterator.Entry()
+		if entry.Type != walTransactionChangeTypeSet {
+			continue
+		}
+
+		writer.WriteUint8(dumpRecordItem)
+		writer.WriteBytes(key.Key())
+		writer.WriteBytes(entry.Value)
+		writer.WriteUint64(key.Timestamp())
+		writer.WriteUint8(entry.UserMeta)
+		count++
+	}
+
+	writer.WriteUint8(dumpRecordEnd)
+	writer.WriteUint64(count)
+
+	return writer.Finish()
+}
+
+// Load reads a dump written by Dump and sets every key in it. Keys are committed in batches, so
+// if Load fails part way through then the keys before the failure will have been loaded. The keys
+// are committed at new timestamps, the timestamps in the dump are not preserved.
+func (db *DB) Load(r io.Reader) error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	_, err := db.load(r)
+
+	return err
+}
+
+// load sets every key in the dump and returns the applied index that was stored in the dump, or 0
+// if there was not one.
+func (db *DB) load(r io.Reader) (uint64, error) {
+	reader := &dumpReader{
+		r:    bufio.NewReader(r),
+		hash: fnv.New32(),
+	}
+	if magic := reader.Read(len(dumpMagic)); reader.err == nil && string(magic) != dumpMagic {
+		return 0, ErrBadDump
+	}
+	if version := reader.ReadUint16(); reader.err == nil && version != dumpVersion {
+		return 0, fmt.Errorf("%w: %d", ErrUnknownDumpVersion, version)
+	}
+
+	var count, appliedIndex uint64
+	loader := &batchLoader{db: db}
+	for reader.err == nil {
+		recordType := reader.ReadUint8()
+		if recordType == dumpRecordEnd || reader.err != nil {
+			break
+		} else if recordType == dumpRecordAppliedIndex {
+			appliedIndex = reader.ReadUint64()
+			continue
+		} else if recordType != dumpRecordItem {
+			return 0, fmt.Errorf("%w: unknown record type %d", ErrBadDump, recordType)
+		}
+
+		change := walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   reader.ReadBytes(),
+			Value: reader.ReadBytes(),
+		}
+		_ = reader.ReadUint64() // The timestamp is not preserved.
+		change.UserMeta = reader.ReadUint8()
+		if reader.err != nil {
+			break
+		}
+
+		// The loader will commit a batch once it is full. The last batch is only committed below
+		// once the rest of the dump has been verified.
+		if err := loader.Add(change); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	// Make sure that the entire dump is intact before the last batch is committed.
+	if expected := reader.ReadUint64(); reader.err == nil && expected != count {
+		return 0, fmt.Errorf("%w: expected %d keys but found %d", ErrBadDump, expected, count)
+	}
+	if err := reader.Finish(); err != nil {
+		return 0, err
+	}
+
+	return appliedIndex, loader.Flush()
+}
+
+// Write writes the bytes without a length prefix.
+func (w *dumpWriter) Write(data []byte) {
+	if w.err != nil {
+		return
+	}
+
+	_, _ = w.hash.Write(data)
+	_, w.err = w.w.Write(data)
+}
+
+// WriteUint8 writes a single byte.
+func (w *dumpWriter) WriteUint8(b byte) {
+	w.scratch[0] = b
+	w.Write(w.scratch[:1])
+}
+
+// WriteUint16 writes a big endian 16-bit integer.
+func (w *dumpWriter) WriteUint16(n uint16) {
+	binary.BigEndian.PutUint16(w.scratch[:2], n)
+	w.Write(w.scratch[:2])
+}
+
+// WriteUint64 writes a big endian 64-bit integer.
+func (w *dumpWriter) WriteUint64(n uint64) {
+	binary.BigEndian.PutUint64(w.scratch[:8], n)
+	w.Write(w.scratch[:8])
+}
+
+// WriteBytes writes the bytes prefixed with their length as a 32-bit integer.
+func (w *dumpWriter) WriteBytes(data []byte) {
+	binary.BigEndian.PutUint32(w.scratch[:4], uint32(len(data)))
+	w.Write(w.scratch[:4])
+	w.Write(data)
+}
+
+// Finish writes the checksum of everything written so far and flushes the writer.
+func (w *dumpWriter) Finish() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	binary.BigEndian.PutUint32(w.scratch[:4], w.hash.Sum32())
+	if _, err := w.w.Write(w.scratch[:4]); err != nil {
+		return err
+	}
+
+	return w.w.Flush()
+}
+
+// Read reads the number of bytes provided. If the dump ends before then ErrBadDump is returned.
+func (r *dumpReader) Read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r.r, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+		r.err = fmt.Errorf("%w: %v", ErrBadDump, ErrTruncated)
+		return nil
+	} else if err != nil {
+		r.err = err
+		return nil
+	}
+	_, _ = r.hash.Write(data)
+
+	return data
+}
+
+// ReadUint8 reads a single byte.
+func (r *dumpReader) ReadUint8() byte {
+	if data := r.Read(1); data != nil {
+		return data[0]
+	}
+
+	return 0
+}
+
+// ReadUint16 reads a big endian 16-bit integer.
+func (r *dumpReader) ReadUint16() uint16 {
+	if data := r.Read(2); data != nil {
+		return binary.BigEndian.Uint16(data)
+	}
+
+	return 0
+}
+
+// ReadUint64 reads a big endian 64-bit integer.
+func (r *dumpReader) ReadUint64() uint64 {
+	if data := r.Read(8); data != nil {
+		return binary.BigEndian.Uint64(data)
+	}
+
+	return 0
+}
+
+// ReadBytes reads bytes that were prefixed with their length. Lengths larger than any key or
+// value can be are treated as corruption rather than trying to allocate them.
+func (r *dumpReader) ReadBytes() []byte {
+	data := r.Read(4)
+	if data == nil {
+		return nil
+	}
+
+	length := binary.BigEndian.Uint32(data)
+	if length > maxValueSizeLimit {
+		r.err = fmt.Errorf("%w: length %d is too large", ErrBadDump, length)
+		return nil
+	}
+
+	return r.Read(int(length))
+}
+
+// Finish reads the checksum at the end of the dump and makes sure it matches everything that has
+// been read. Nothing is allowed after the checksum.
+func (r *dumpReader) Finish() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	expected := r.hash.Sum32()
+	data := r.Read(4)
+	if r.err != nil {
+		return r.err
+	}
+
+	if binary.BigEndian.Uint32(data) != expected {
+		return fmt.Errorf("%w: checksum mismatch", ErrBadDump)
+	}
+
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return fmt.Errorf("%w: %v", ErrBadDump, ErrTrailingData)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package lsmtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	// newDump creates a database with a few keys and returns a dump of it.
+	newDump := func(t *testing.T) []byte {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, txn.SetWithMeta(Key(fmt.Sprintf("key%03d", i)), []byte("old"), 1))
+		}
+		assert.NoError(t, txn.Commit())
+
+		txn, err = db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("key000"), []byte("new")))
+		assert.NoError(t, txn.Set(Key("key001"), []byte{}))
+		assert.NoError(t, txn.Delete(Key("key002")))
+		assert.NoError(t, txn.Commit())
+
+		buf := &bytes.Buffer{}
+		assert.NoError(t, db.Dump(buf))
+
+		return buf.Bytes()
+	}
+
+	t.Run("dump and load", func(t *testing.T) {
+		dump := newDump(t)
+
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+		assert.NoError(t, db.Load(bytes.NewReader(dump)))
+
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		item, err := txn.Get(Key("key000"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("new"), item.Value)
+		assert.Equal(t, byte(0), item.UserMeta)
+
+		item, err = txn.Get(Key("key001"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{}, item.Value)
+
+		_, err = txn.Get(Key("key002"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		item, err = txn.Get(Key("key099"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("old"), item.Value)
+		assert.Equal(t, byte(1), item.UserMeta)
+
+		// Only the newest version of the 99 keys that were not deleted should have been loaded.
+		assert.Equal(t, 99, db.memtable.Len())
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		buf := &bytes.Buffer{}
+		assert.NoError(t, db.Dump(buf))
+		assert.Len(t, buf.Bytes(), len(dumpMagic)+2+1+8+4)
+		assert.NoError(t, db.Load(buf))
+		assert.Equal(t, 0, db.memtable.Len())
+	})
+
+	t.Run("bad dumps", func(t *testing.T) {
+		dump := newDump(t)
+
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		assert.Equal(t, ErrBadDump, db.Load(bytes.NewReader([]byte("not a dump at all"))))
+
+		newer := append([]byte{}, dump...)
+		newer[len(dumpMagic)+1] = 2
+		assert.True(t, errors.Is(db.Load(bytes.NewReader(newer)), ErrUnknownDumpVersion))
+
+		truncated := dump[:len(dump)-10]
+		assert.True(t, errors.Is(db.Load(bytes.NewReader(truncated)), ErrBadDump))
+
+		// Change part of the last value, this should only be caught by the checksum. The last
+		// batch should not be committed.
+		modified := append([]byte{}, dump...)
+		modified[len(modified)-4-8-1-1-8-1] ^= 0xff
+		assert.True(t, errors.Is(db.Load(bytes.NewReader(modified)), ErrBadDump))
+		assert.Equal(t, 0, db.memtable.Len())
+
+		trailing := append(append([]byte{}, dump...), 0)
+		assert.True(t, errors.Is(db.Load(bytes.NewReader(trailing)), ErrBadDump))
+		assert.Equal(t, 0, db.memtable.Len())
+	})
+}
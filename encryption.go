@@ -0,0 +1,86 @@
+package lsmtree
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrDecryptionFailed is returned when an encrypted record cannot be decrypted. This happens
+	// if the wrong key is being used or if the record has been corrupted.
+	ErrDecryptionFailed = errors.New("could not decrypt record")
+
+	// ErrEncryptedTransactionUpdate is returned when an attempt is made to change a transaction
+	// in place within an encrypted WAL segment. Encrypted records cannot be modified without being
+	// re-encrypted.
+	ErrEncryptedTransactionUpdate = errors.New("cannot update an encrypted wal transaction in place")
+)
+
+const (
+	// recordNonceSize is the number of bytes used for the random nonce that is prefixed to every
+	// encrypted record.
+	recordNonceSize = 12
+
+	// recordTagSize is the number of bytes that the authentication tag adds to every encrypted
+	// record.
+	recordTagSize = 16
+
+	// recordEncryptionOverhead is the total number of bytes that encrypting a record will add to
+	// its size.
+	recordEncryptionOverhead = recordNonceSize + recordTagSize
+)
+
+// newRecordCipher will create an AES-GCM cipher from the key provided. The key must be 16, 24 or
+// 32 bytes to select AES-128, AES-192 or AES-256. If the key is empty then nil is returned and
+// records will not be encrypted.
+func newRecordCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCMWithNonceSize(block, recordNonceSize)
+}
+
+// sealRecord will encrypt the record provided. The id of the record is used as additional data so
+// that an encrypted record cannot be moved to a different id without being detected. The result
+// is the random nonce followed by the encrypted record.
+func sealRecord(aead cipher.AEAD, id uint64, record []byte) ([]byte, error) {
+	nonce := make([]byte, recordNonceSize, recordNonceSize+len(record)+recordTagSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, record, recordAdditionalData(id)), nil
+}
+
+// openRecord will decrypt a record that was encrypted with sealRecord. If the record cannot be
+// decrypted then ErrDecryptionFailed is returned.
+func openRecord(aead cipher.AEAD, id uint64, sealed []byte) ([]byte, error) {
+	if len(sealed) < recordEncryptionOverhead {
+		return nil, ErrDecryptionFailed
+	}
+
+	record, err := aead.Open(nil, sealed[:recordNonceSize], sealed[recordNonceSize:],
+		recordAdditionalData(id))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return record, nil
+}
+
+// recordAdditionalData returns the authenticated (but not encrypted) data for a record.
+func recordAdditionalData(id uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, id)
+	return data
+}
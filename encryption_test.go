@@ -0,0 +1,59 @@
+package lsmtree
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRecordEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	record := []byte("a record that should be encrypted")
+
+	t.Run("round trip", func(t *testing.T) {
+		aead, err := newRecordCipher(key)
+		assert.NoError(t, err)
+
+		sealed, err := sealRecord(aead, 1, record)
+		assert.NoError(t, err)
+		assert.Len(t, sealed, len(record)+recordEncryptionOverhead)
+		assert.False(t, bytes.Contains(sealed, record))
+
+		opened, err := openRecord(aead, 1, sealed)
+		assert.NoError(t, err)
+		assert.Equal(t, record, opened)
+	})
+
+	t.Run("wrong id", func(t *testing.T) {
+		aead, err := newRecordCipher(key)
+		assert.NoError(t, err)
+
+		sealed, err := sealRecord(aead, 1, record)
+		assert.NoError(t, err)
+
+		opened, err := openRecord(aead, 2, sealed)
+		assert.Equal(t, ErrDecryptionFailed, err)
+		assert.Nil(t, opened)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		aead, err := newRecordCipher(key)
+		assert.NoError(t, err)
+
+		sealed, err := sealRecord(aead, 1, record)
+		assert.NoError(t, err)
+
+		otherAead, err := newRecordCipher(bytes.Repeat([]byte{2}, 32))
+		assert.NoError(t, err)
+
+		opened, err := openRecord(otherAead, 1, sealed)
+		assert.Equal(t, ErrDecryptionFailed, err)
+		assert.Nil(t, opened)
+	})
+
+	t.Run("no key", func(t *testing.T) {
+		aead, err := newRecordCipher(nil)
+		assert.NoError(t, err)
+		assert.Nil(t, aead)
+	})
+}
@@ -0,0 +1,119 @@
+package lsmtree
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+var (
+	// Make sure that the DB implements the Engine interface.
+	_ Engine = &DB{}
+)
+
+// Engine is the smallest set of operations that a layer built on top of the database needs: a
+// storage engine for a SQL database or a message queue only writes batches, reads keys and ranges
+// of keys, and occasionally takes a snapshot or compacts. Writing that layer against an Engine
+// instead of a *DB means it can be tested against a mock that implements the same interface.
+//
+// Batches, snapshots and iterators can all be created without a DB, so that a mock can return
+// them too: the zero value of a WriteBatch is an empty batch, a zero Snapshot can be released, and
+// Itr is an interface.
+
+type (
+	// Engine is implemented by the DB. See the DB methods of the same names.
+	Engine interface {
+		// NewWriteBatch creates an empty batch of changes that can be applied with ApplyBatch.
+		NewWriteBatch() *WriteBatch
+
+		// ApplyBatch atomically applies the batch and records index as the applied index.
+		ApplyBatch(index uint64, batch *WriteBatch) error
+
+		// Get returns the newest version of the key, or ErrKeyNotFound if it does not exist.
+		Get(key Key, options ReadOptions) (Item, error)
+
+		// NewIterator creates an iterator over the keys, it must be closed once it is no longer
+		// needed.
+		NewIterator(options IteratorOptions) (Itr, error)
+
+		// NewSnapshot creates a snapshot of the current state, it must be released once it is no
+		// longer needed.
+		NewSnapshot() (*Snapshot, error)
+
+		// Compact runs the compactions that are needed until none are left.
+		Compact(ctx context.Context) error
+	}
+)
+
+// Get returns the newest version of the key that is visible to a new read only transaction, or to
+// ReadOptions.Snapshot if one is provided. If the key does not exist or has been deleted then
+// ErrKeyNotFound is returned.
+func (db *DB) Get(key Key, options ReadOptions) (Item, error) {
+	txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+	if err != nil {
+		return Item{}, err
+	}
+	defer txn.Discard()
+
+	return txn.GetWithOptions(key, options)
+}
+
+// NewIterator creates an iterator over the keys that are visible to a new read only transaction,
+// or to ReadOptions.Snapshot if one is provided. The transaction is discarded when the iterator is
+// closed, so the iterator must always be closed.
+func (db *DB) NewIterator(options IteratorOptions) (Itr, error) {
+	txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := txn.NewIterator(options)
+	if err != nil {
+		txn.Discard()
+		return nil, err
+	}
+	iterator.ownsTxn = true
+
+	return iterator, nil
+}
+
+// Compact runs every compaction that PickCompaction picks until no level needs to be compacted, or
+// the context is done. Compactions wait for PauseBackgroundWork the same way as any other
+// background work, and for Options.Registry to allow them to start.
+//
+// Heap files cannot be written yet, so only compactions that are a TrivialMove can be run. Compact
+// stops at the first compaction that would have to rewrite files and returns nil.
+func (db *DB) Compact(ctx context.Context) error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		pick, ok := db.PickCompaction()
+		if !ok || !pick.TrivialMove {
+			return nil
+		}
+
+		if err := db.runCompaction(pick); err != nil {
+			return err
+		}
+	}
+}
+
+// runCompaction runs a single compaction once background work and the registry allow it.
+func (db *DB) runCompaction(pick CompactionPick) error {
+	if !db.background.begin() {
+		return ErrClosed
+	}
+	defer db.background.end()
+
+	if registry := db.options.Registry; registry != nil {
+		registry.acquireCompaction()
+		defer registry.releaseCompaction()
+	}
+
+	return db.moveFiles(pick)
+}
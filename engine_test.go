@@ -0,0 +1,210 @@
+package lsmtree
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path"
+	"sort"
+	"testing"
+)
+
+// mockEngine is the kind of engine a layer built on top of the database would be tested against,
+// it only keeps the newest value of each key.
+type mockEngine struct {
+	values map[string][]byte
+}
+
+func (m *mockEngine) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (m *mockEngine) ApplyBatch(index uint64, batch *WriteBatch) error {
+	for _, item := range batch.Items() {
+		if item.IsDeleted() {
+			delete(m.values, string(item.Key))
+		} else {
+			m.values[string(item.Key)] = item.Value
+		}
+	}
+
+	return nil
+}
+
+func (m *mockEngine) Get(key Key, options ReadOptions) (Item, error) {
+	value, ok := m.values[string(key)]
+	if !ok {
+		return Item{}, ErrKeyNotFound
+	}
+
+	return Item{Key: key, Value: value}, nil
+}
+
+func (m *mockEngine) NewIterator(options IteratorOptions) (Itr, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *mockEngine) NewSnapshot() (*Snapshot, error) {
+	return &Snapshot{}, nil
+}
+
+func (m *mockEngine) Compact(ctx context.Context) error {
+	return nil
+}
+
+func TestEngine(t *testing.T) {
+	// setAndDelete writes a through c and then deletes b, it only uses the Engine.
+	setAndDelete := func(t *testing.T, engine Engine) {
+		batch := engine.NewWriteBatch()
+		for _, key := range []string{"a", "b", "c"} {
+			assert.NoError(t, batch.Set(Key(key), []byte("value "+key)))
+		}
+		assert.NoError(t, engine.ApplyBatch(1, batch))
+
+		batch = engine.NewWriteBatch()
+		assert.NoError(t, batch.Delete(Key("b")))
+		assert.NoError(t, engine.ApplyBatch(2, batch))
+
+		item, err := engine.Get(Key("a"), ReadOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "value a", string(item.Value))
+
+		_, err = engine.Get(Key("b"), ReadOptions{})
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		snapshot, err := engine.NewSnapshot()
+		assert.NoError(t, err)
+		snapshot.Release()
+
+		assert.NoError(t, engine.Compact(context.Background()))
+	}
+
+	t.Run("db", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		setAndDelete(t, db)
+
+		itr, err := db.NewIterator(IteratorOptions{})
+		assert.NoError(t, err)
+		keys := make([]string, 0)
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			keys = append(keys, string(itr.Item().Key))
+		}
+		itr.Close()
+		assert.Equal(t, []string{"a", "c"}, keys)
+
+		// Closing the iterator discards the transaction that was created for it.
+		assert.Nil(t, itr.(*Iterator).txn)
+	})
+
+	t.Run("mock", func(t *testing.T) {
+		engine := &mockEngine{values: map[string][]byte{}}
+		setAndDelete(t, engine)
+
+		keys := make([]string, 0, len(engine.values))
+		for key := range engine.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		assert.Equal(t, []string{"a", "c"}, keys)
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		batch := db.NewWriteBatch()
+		assert.NoError(t, batch.Set(Key("key"), []byte("old")))
+		assert.NoError(t, db.ApplyBatch(1, batch))
+
+		snapshot, err := db.NewSnapshot()
+		assert.NoError(t, err)
+		defer snapshot.Release()
+
+		batch = db.NewWriteBatch()
+		assert.NoError(t, batch.Set(Key("key"), []byte("new")))
+		assert.NoError(t, db.ApplyBatch(2, batch))
+
+		item, err := db.Get(Key("key"), ReadOptions{Snapshot: snapshot})
+		assert.NoError(t, err)
+		assert.Equal(t, "old", string(item.Value))
+
+		item, err = db.Get(Key("key"), ReadOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "new", string(item.Value))
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+		assert.NoError(t, db.Close())
+
+		_, err := db.Get(Key("key"), ReadOptions{})
+		assert.Equal(t, ErrClosed, err)
+		_, err = db.NewIterator(IteratorOptions{})
+		assert.Equal(t, ErrClosed, err)
+		assert.Equal(t, ErrClosed, db.Compact(context.Background()))
+	})
+}
+
+func TestDB_Compact(t *testing.T) {
+	db, cleanup := newTestDB(t, DefaultOptions())
+	defer cleanup()
+
+	addHeapFile := func(t *testing.T, id uint64, smallest, largest string) {
+		name := path.Join(db.options.DataDirectory, getHeapFileName(id))
+		assert.NoError(t, ioutil.WriteFile(name, make([]byte, 10), 0644))
+		assert.NoError(t, db.manifest.AddFile(fileTypeHeap, id))
+		db.heapProperties.Set(id, tableProperties{
+			Smallest: Key(smallest),
+			Largest:  Key(largest),
+		})
+	}
+
+	addHeapFile(t, 1, "a", "c")
+	addHeapFile(t, 2, "d", "f")
+	addHeapFile(t, 3, "g", "i")
+	addHeapFile(t, 4, "j", "l")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, db.Compact(ctx))
+
+	// Files that do not overlap are moved down a level.
+	assert.NoError(t, db.Compact(context.Background()))
+	_, ok := db.PickCompaction()
+	assert.False(t, ok)
+	scores := db.CompactionScores()
+	assert.Zero(t, scores[0].Files)
+	assert.Equal(t, 4, scores[1].Files)
+
+	// Files that overlap would have to be merged, which Compact cannot do yet.
+	addHeapFile(t, 5, "m", "o")
+	addHeapFile(t, 6, "n", "p")
+	addHeapFile(t, 7, "q", "r")
+	addHeapFile(t, 8, "s", "t")
+	assert.NoError(t, db.Compact(context.Background()))
+	pick, ok := db.PickCompaction()
+	assert.True(t, ok)
+	assert.False(t, pick.TrivialMove)
+}
+
+func TestWriteBatch_Zero(t *testing.T) {
+	var batch WriteBatch
+	assert.NoError(t, batch.Set(Key("a"), []byte("1")))
+	assert.NoError(t, batch.Delete(Key("b")))
+	assert.NoError(t, batch.Set(Key("a"), []byte("2")))
+	assert.Equal(t, 2, batch.Len())
+
+	items := batch.Items()
+	assert.Equal(t, "a", string(items[0].Key))
+	assert.Equal(t, "2", string(items[0].Value))
+	assert.Equal(t, "b", string(items[1].Key))
+	assert.True(t, items[1].IsDeleted())
+
+	// The default limits still apply.
+	err := batch.Set(make(Key, DefaultOptions().MaxKeySize+1), nil)
+	assert.Error(t, err)
+}
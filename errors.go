@@ -0,0 +1,128 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrKeyNotFound is returned when a key is requested that does not exist in the database, or
+	// when the key has been deleted.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrTxnConflict is returned when a transaction is committed but a value that it read has been
+	// changed by another transaction since it was read, or when it writes a key that is reserved by
+	// a prepared transaction. The transaction should be retried.
+	ErrTxnConflict = errors.New("transaction conflict")
+
+	// ErrTxnTooBig is returned when a transaction has grown larger than the database allows for a
+	// single commit. The transaction should be committed and the remaining changes should be made
+	// in a new transaction.
+	ErrTxnTooBig = errors.New("transaction too big")
+
+	// ErrClosed is returned when an operation is attempted against a database that has already
+	// been closed.
+	ErrClosed = errors.New("database is closed")
+
+	// ErrCloseTimeout is returned by CloseWithOptions when the database could not be closed cleanly
+	// before the timeout in the CloseOptions was reached.
+	ErrCloseTimeout = errors.New("timed out closing database")
+
+	// ErrTimestampNotReached is returned when waiting for a timestamp to become visible takes
+	// longer than the timeout provided.
+	ErrTimestampNotReached = errors.New("timed out waiting for timestamp")
+
+	// ErrReadOnly is returned when a change is made to, or Prepare is called on, a transaction
+	// that was created with TxnOptions.ReadOnly.
+	ErrReadOnly = errors.New("transaction is read only")
+
+	// ErrEmptyKey is returned when a change is made to a key that has a length of 0.
+	ErrEmptyKey = errors.New("key cannot be empty")
+
+	// ErrKeyTooLarge is returned when a change is made to a key that is larger than the MaxKeySize
+	// specified in the Options. It is returned by the call that makes the change, like Txn.Set or
+	// Txn.Delete, not by Commit.
+	ErrKeyTooLarge = errors.New("key too large")
+
+	// ErrValueTooLarge is returned when a value is set that is larger than the MaxValueSize
+	// specified in the Options. Like ErrKeyTooLarge it is returned by the call that sets it.
+	ErrValueTooLarge = errors.New("value too large")
+
+	// ErrInvalidOptions is returned by Open when the provided Options cannot be used.
+	ErrInvalidOptions = errors.New("invalid options")
+
+	// ErrKeyExists is returned by SetIfAbsent when the key already exists.
+	ErrKeyExists = errors.New("key already exists")
+
+	// ErrValueMismatch is the root of every MismatchError. Any MismatchError will match this error
+	// when checked using errors.Is.
+	ErrValueMismatch = errors.New("value does not match")
+
+	// ErrCorrupted is the root of all corruption errors. Any CorruptionError will match this error
+	// when checked using errors.Is.
+	ErrCorrupted = errors.New("data corrupted")
+)
+
+// CorruptionError is returned when data read from the disk is not what was expected. It includes
+// the name of the file and the offset within that file where the corruption was found. The
+// underlying cause (like ErrBadValueChecksum) can be retrieved with errors.Is or errors.As.
+type CorruptionError struct {
+	// File is the name of the file that the corruption was found in.
+	File string
+
+	// Offset is the position within the file where the corrupt data starts.
+	Offset int64
+
+	// Err is the specific failure that caused the data to be considered corrupt.
+	Err error
+}
+
+// newCorruptionError is a small helper to build a CorruptionError for the file and offset
+// specified.
+func newCorruptionError(file string, offset int64, err error) error {
+	return &CorruptionError{
+		File:   file,
+		Offset: offset,
+		Err:    err,
+	}
+}
+
+// Error returns a human readable description of the corruption including where it was found.
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s: %s at offset %d: %v", ErrCorrupted, e.File, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying cause of the corruption.
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// Is allows any CorruptionError to be matched against ErrCorrupted.
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
+// MismatchError is returned by CompareAndSwap when the current value of the key is not the value
+// that was expected. It includes the current value so that the caller can decide what to do next
+// without reading the key again.
+type MismatchError struct {
+	// Key is the key that was being swapped.
+	Key Key
+
+	// Current is the value the key had when it was compared, it is nil if the key did not exist.
+	Current []byte
+}
+
+// Error returns a human readable description of the mismatch.
+func (e *MismatchError) Error() string {
+	if e.Current == nil {
+		return fmt.Sprintf("%s: key %q does not exist", ErrValueMismatch, e.Key)
+	}
+
+	return fmt.Sprintf("%s: key %q has a different value", ErrValueMismatch, e.Key)
+}
+
+// Is allows any MismatchError to be matched against ErrValueMismatch.
+func (e *MismatchError) Is(target error) bool {
+	return target == ErrValueMismatch
+}
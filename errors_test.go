@@ -0,0 +1,24 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCorruptionError(t *testing.T) {
+	t.Run("is", func(t *testing.T) {
+		err := newCorruptionError("file", 12, ErrBadValueChecksum)
+		assert.True(t, errors.Is(err, ErrCorrupted))
+		assert.True(t, errors.Is(err, ErrBadValueChecksum))
+		assert.False(t, errors.Is(err, ErrIncompleteValue))
+	})
+
+	t.Run("as", func(t *testing.T) {
+		err := newCorruptionError("file", 12, ErrBadValueChecksum)
+		corruption := &CorruptionError{}
+		assert.True(t, errors.As(err, &corruption))
+		assert.Equal(t, "file", corruption.File)
+		assert.Equal(t, int64(12), corruption.Offset)
+	})
+}
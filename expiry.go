@@ -0,0 +1,216 @@
+package lsmtree
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// expirationBatchSize is the most expired keys that are deleted by a single commit.
+	expirationBatchSize = 1024
+)
+
+// A value set with a TTL is hidden from reads as soon as it expires, but it still takes up space
+// until something deletes it. Rather than waiting for the key to be read or compacted, every value
+// with a TTL is added to an expirationIndex ordered by when it expires. A background expirer takes
+// the values that have expired from the front of the index and commits a delete for each of them,
+// as long as the expired version is still the newest version of its key. The delete is what will
+// let a flush or compaction drop the value. Neither exists yet, so for now the delete only adds a
+// tombstone and the expirer is off by default, see Options.ExpirationInterval.
+
+type (
+	// expirationIndex is every version of a key that was set with a TTL and has not been deleted
+	// by the expirer yet, ordered by when it expires.
+	expirationIndex struct {
+		lock sync.Mutex
+		heap expirationHeap
+	}
+
+	// expiringKey is a single version of a key that expires.
+	expiringKey struct {
+		// expiresAt is the unix time in seconds when the version expires.
+		expiresAt uint64
+		key       Key
+		timestamp uint64
+	}
+
+	// expirationHeap orders expiringKeys by when they expire, soonest first.
+	expirationHeap []expiringKey
+)
+
+var (
+	_ heap.Interface = &expirationHeap{}
+)
+
+// getExpiresAt returns the unix time in seconds when a value set now with the ttl expires.
+func getExpiresAt(now time.Time, ttl time.Duration) uint64 {
+	return uint64(now.Add(ttl).Unix())
+}
+
+func newExpirationIndex() *expirationIndex {
+	return &expirationIndex{}
+}
+
+// Add adds every change that sets a value with a TTL to the index, the changes were committed at
+// the timestamp provided.
+func (x *expirationIndex) Add(timestamp uint64, changes []walTransactionChange) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	for _, change := range changes {
+		if change.Type != walTransactionChangeTypeSet || change.ExpiresAt == 0 {
+			continue
+		}
+
+		heap.Push(&x.heap, expiringKey{
+			expiresAt: change.ExpiresAt,
+			key:       change.Key,
+			timestamp: timestamp,
+		})
+	}
+}
+
+// Due removes and returns up to limit versions that have expired at the unix time in seconds
+// provided, soonest first.
+func (x *expirationIndex) Due(now uint64, limit int) []expiringKey {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	var due []expiringKey
+	for len(due) < limit && len(x.heap) > 0 && x.heap[0].expiresAt <= now {
+		due = append(due, heap.Pop(&x.heap).(expiringKey))
+	}
+
+	return due
+}
+
+// Readd puts versions returned by Due back into the index so that they are tried again.
+func (x *expirationIndex) Readd(keys []expiringKey) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	for _, key := range keys {
+		heap.Push(&x.heap, key)
+	}
+}
+
+// Len returns the number of versions in the index.
+func (x *expirationIndex) Len() int {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	return len(x.heap)
+}
+
+func (h expirationHeap) Len() int {
+	return len(h)
+}
+
+func (h expirationHeap) Less(i, j int) bool {
+	return h[i].expiresAt < h[j].expiresAt
+}
+
+func (h expirationHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *expirationHeap) Push(x interface{}) {
+	*h = append(*h, x.(expiringKey))
+}
+
+func (h *expirationHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return item
+}
+
+// keyExpirer periodically deletes the keys that have expired. It runs until the database is
+// closed.
+func (db *DB) keyExpirer() {
+	ticker := time.NewTicker(db.options.ExpirationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.expireKeys(); err != nil && db.options.Logger != nil {
+				db.options.Logger.Printf("failed to delete expired keys: %v", err)
+			}
+		case <-db.stopped:
+			return
+		}
+	}
+}
+
+// expireKeys deletes every key whose newest version has expired, in batches of
+// expirationBatchSize.
+func (db *DB) expireKeys() error {
+	if !db.background.begin() {
+		return nil
+	}
+	defer db.background.end()
+
+	for {
+		due := db.expirations.Due(uint64(db.options.Clock.Now().Unix()), expirationBatchSize)
+		if len(due) == 0 {
+			return nil
+		}
+
+		readTimestamp := db.readTimestamp()
+		var expired, retry []expiringKey
+		for _, entry := range due {
+			item, found := db.memtable.Get(entry.key, readTimestamp)
+			switch {
+			case !found || item.Version < entry.timestamp:
+				// The version was committed but is not visible yet.
+				retry = append(retry, entry)
+			case item.Version == entry.timestamp:
+				expired = append(expired, entry)
+			}
+
+			// Otherwise the key has been written again since, so this version no longer matters.
+		}
+
+		if len(expired) > 0 {
+			changes := make([]walTransactionChange, len(expired))
+			reads := make([]Key, len(expired))
+			for i, entry := range expired {
+				changes[i] = walTransactionChange{
+					Type: walTransactionChangeTypeDelete,
+					Key:  entry.key,
+				}
+				reads[i] = entry.key
+			}
+
+			// If any of the keys is written while they are being deleted then the commit
+			// conflicts, the versions are tried again and the ones that were overwritten are
+			// skipped.
+			_, err := db.commitRequest(&commitRequest{
+				changes:       changes,
+				reads:         reads,
+				readTimestamp: readTimestamp,
+				done:          make(chan error, 1),
+			}, WritePriorityLow)
+			switch err {
+			case nil:
+				atomic.AddUint64(&db.expiredKeys, uint64(len(expired)))
+			case ErrTxnConflict:
+				retry = append(retry, expired...)
+			default:
+				db.expirations.Readd(append(retry, expired...))
+				return err
+			}
+		}
+
+		// Versions that have to be retried would be returned again straight away, so they wait
+		// for the next run.
+		if len(retry) > 0 {
+			db.expirations.Readd(retry)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestExpirationIndex(t *testing.T) {
+	index := newExpirationIndex()
+	index.Add(1, []walTransactionChange{
+		{Type: walTransactionChangeTypeSet, Key: Key("a"), ExpiresAt: 30},
+		{Type: walTransactionChangeTypeSet, Key: Key("never")},
+		{Type: walTransactionChangeTypeDelete, Key: Key("deleted")},
+	})
+	index.Add(2, []walTransactionChange{
+		{Type: walTransactionChangeTypeSet, Key: Key("b"), ExpiresAt: 10},
+		{Type: walTransactionChangeTypeSet, Key: Key("c"), ExpiresAt: 20},
+	})
+	assert.Equal(t, 3, index.Len())
+
+	assert.Empty(t, index.Due(9, 10))
+
+	due := index.Due(30, 2)
+	if assert.Len(t, due, 2) {
+		assert.Equal(t, Key("b"), due[0].key)
+		assert.Equal(t, uint64(2), due[0].timestamp)
+		assert.Equal(t, Key("c"), due[1].key)
+	}
+
+	index.Readd(due[:1])
+	due = index.Due(30, 10)
+	if assert.Len(t, due, 2) {
+		assert.Equal(t, Key("b"), due[0].key)
+		assert.Equal(t, Key("a"), due[1].key)
+	}
+	assert.Zero(t, index.Len())
+}
+
+func TestTxn_SetWithTTL(t *testing.T) {
+	newDB := func(t *testing.T) (*DB, *ManualClock, func()) {
+		clock := NewManualClock(time.Unix(1000, 0))
+		options := DefaultOptions()
+		options.Clock = clock
+		// The test runs the expirer itself.
+		options.ExpirationInterval = 0
+		db, cleanup := newTestDB(t, options)
+
+		return db, clock, cleanup
+	}
+
+	set := func(t *testing.T, db *DB, key string, ttl time.Duration) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		if ttl == 0 {
+			assert.NoError(t, txn.Set(Key(key), []byte("value")))
+		} else {
+			assert.NoError(t, txn.SetWithTTL(Key(key), []byte("value"), ttl))
+		}
+		assert.NoError(t, txn.Commit())
+	}
+
+	visible := func(t *testing.T, db *DB) []string {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		iterator, err := txn.NewIterator(IteratorOptions{})
+		assert.NoError(t, err)
+		defer iterator.Close()
+
+		keys := []string{}
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			keys = append(keys, string(iterator.Item().Key))
+
+			_, err := txn.Get(iterator.Item().Key)
+			assert.NoError(t, err)
+		}
+
+		return keys
+	}
+
+	t.Run("hidden once expired", func(t *testing.T) {
+		db, clock, cleanup := newDB(t)
+		defer cleanup()
+
+		set(t, db, "short", time.Minute)
+		set(t, db, "long", time.Hour)
+		set(t, db, "forever", 0)
+		assert.Equal(t, []string{"forever", "long", "short"}, visible(t, db))
+
+		clock.Advance(time.Minute)
+		assert.Equal(t, []string{"forever", "long"}, visible(t, db))
+
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		_, err = txn.Get(Key("short"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		txn.Discard()
+
+		// The value is still stored until the expirer runs.
+		versions, err := db.GetVersions(Key("short"), 0)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 1) {
+			assert.True(t, versions[0].IsExpired(clock.Now()))
+			assert.False(t, versions[0].IsDeleted())
+		}
+
+		assert.NoError(t, db.expireKeys())
+		versions, err = db.GetVersions(Key("short"), 0)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 1) {
+			assert.True(t, versions[0].IsDeleted())
+		}
+		assert.Equal(t, uint64(1), db.Metrics().ExpiredKeys)
+		assert.Equal(t, 1, db.expirations.Len())
+	})
+
+	t.Run("overwritten keys are not deleted", func(t *testing.T) {
+		db, clock, cleanup := newDB(t)
+		defer cleanup()
+
+		set(t, db, "a", time.Minute)
+		set(t, db, "a", 0)
+		set(t, db, "b", time.Minute)
+		set(t, db, "b", time.Hour)
+
+		clock.Advance(time.Minute)
+		assert.NoError(t, db.expireKeys())
+		assert.Equal(t, []string{"a", "b"}, visible(t, db))
+		assert.Zero(t, db.Metrics().ExpiredKeys)
+
+		clock.Advance(time.Hour)
+		assert.NoError(t, db.expireKeys())
+		assert.Equal(t, []string{"a"}, visible(t, db))
+		assert.Equal(t, uint64(1), db.Metrics().ExpiredKeys)
+	})
+
+	t.Run("pending changes", func(t *testing.T) {
+		db, clock, cleanup := newDB(t)
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		assert.NoError(t, txn.SetWithTTL(Key("a"), []byte("value"), time.Second))
+		_, err = txn.Get(Key("a"))
+		assert.NoError(t, err)
+
+		clock.Advance(time.Second)
+		_, err = txn.Get(Key("a"))
+		assert.Equal(t, ErrKeyNotFound, err)
+	})
+
+	t.Run("write batch survives restart", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		clock := NewManualClock(time.Unix(1000, 0))
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.Clock = clock
+		options.ExpirationInterval = 0
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		batch := db.NewWriteBatch()
+		assert.NoError(t, batch.SetWithTTL(Key("a"), []byte("value"), time.Minute))
+		assert.NoError(t, db.ApplyBatch(1, batch))
+		assert.NoError(t, db.Close())
+
+		db, err = Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		// The index is rebuilt from the WAL.
+		assert.Equal(t, 1, db.expirations.Len())
+		clock.Advance(time.Minute)
+		assert.NoError(t, db.expireKeys())
+		assert.Equal(t, uint64(1), db.Metrics().ExpiredKeys)
+	})
+}
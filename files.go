@@ -3,8 +3,17 @@ package lsmtree
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
+)
+
+var (
+	// ErrInvalidFileName is returned when a file name is parsed that was not generated by the
+	// database, or that has been modified.
+	ErrInvalidFileName = errors.New("invalid file name")
 )
 
 var (
@@ -32,6 +41,36 @@ type (
 	CanSync interface {
 		Sync() error
 	}
+
+	// fileSyncer makes a finished file durable before anything refers to it. Finished files are
+	// WAL segments once they are sealed and any file that is added to the manifest. The file's
+	// data is synced first and then its directory, so that both the contents of the file and its
+	// name will survive a crash.
+	fileSyncer interface {
+		SyncFile(name string, file CanSync) error
+		SyncDirectory(directory string) error
+	}
+
+	// diskSyncer is the default fileSyncer and syncs everything to the disk.
+	diskSyncer struct{}
+
+	// skipSyncer is the fileSyncer used when Options.SkipSyncOnSeal is enabled, it does nothing.
+	skipSyncer struct{}
+)
+
+var (
+	_ fileSyncer = diskSyncer{}
+	_ fileSyncer = skipSyncer{}
+)
+
+const (
+	// defaultFileMode is the permissions that files are created with if no FileMode is specified
+	// in the Options.
+	defaultFileMode os.FileMode = 0644
+
+	// fileNameLength is the length of every file name generated by getFileName. The name is the
+	// hexadecimal encoding of a 1 byte fileType and an 8 byte Id.
+	fileNameLength = 18
 )
 
 const (
@@ -57,6 +96,35 @@ const (
 	fileTypeValue
 )
 
+// newFileSyncer returns the fileSyncer that should be used for the options provided.
+func newFileSyncer(options Options) fileSyncer {
+	if options.SkipSyncOnSeal {
+		return skipSyncer{}
+	}
+
+	return diskSyncer{}
+}
+
+// SyncFile flushes the contents of the file to the disk.
+func (diskSyncer) SyncFile(name string, file CanSync) error {
+	return file.Sync()
+}
+
+// SyncDirectory flushes the names of the files in the directory to the disk.
+func (diskSyncer) SyncDirectory(directory string) error {
+	return syncDirectory(directory)
+}
+
+// SyncFile does nothing.
+func (skipSyncer) SyncFile(name string, file CanSync) error {
+	return nil
+}
+
+// SyncDirectory does nothing.
+func (skipSyncer) SyncDirectory(directory string) error {
+	return nil
+}
+
 // getPathExists will return true or false indicating whether or not the path specified (file or
 // folder) is valid.
 func getPathExists(path string) bool {
@@ -71,8 +139,8 @@ func getPathExists(path string) bool {
 // newDirectory will create a new directory at the path specified, including any missing directories
 // in the provided path. The directory will be owned by the current user. If the directory already
 // exists then nothing will change.
-func newDirectory(path string) error {
-	if err := createDirectory(path); err == nil {
+func newDirectory(path string, mode os.FileMode) error {
+	if err := createDirectory(path, mode); err == nil {
 		return takeOwnership(path)
 	} else {
 		return err
@@ -80,9 +148,19 @@ func newDirectory(path string) error {
 }
 
 // createDirectory will create a directory at the path specified. If the path contains multiple
-// directories that do not exist, all of them will be created.
-func createDirectory(path string) error {
-	return os.MkdirAll(path, os.ModeDir)
+// directories that do not exist, all of them will be created. The mode is the permission bits that
+// the directories will be created with (before the umask is applied).
+func createDirectory(path string, mode os.FileMode) error {
+	return os.MkdirAll(path, mode)
+}
+
+// getDirectoryMode returns the permissions that directories should be created with for the file
+// permissions provided. Directories need the execute bit to be traversed, so anyone who can read
+// the files in the directory will be able to list and traverse it.
+// For example 0644 becomes 0755, and 0600 becomes 0700.
+func getDirectoryMode(fileMode os.FileMode) os.FileMode {
+	mode := fileMode & os.ModePerm
+	return mode | (mode&0444)>>2
 }
 
 // takeOwnership will change the owner of the path specified to be such that the DB has ownership.
@@ -90,34 +168,110 @@ func takeOwnership(path string) error {
 	return os.Chown(path, os.Getuid(), os.Getgid())
 }
 
-// getValueFileName returns a string representation of the value file name. The name is a
-// hexadecimal encoded byte array, with the first byte being the value file type prefix and the
-// following 8 bytes being the fileId.
-func getValueFileName(fileId uint64) string {
+// getFileName returns a string representation of a file name for the type and Id provided. The
+// name is a hexadecimal encoded byte array, with the first byte being the file type prefix and the
+// following 8 bytes being the Id. Because the Id is encoded big endian with a fixed width, sorting
+// the file names of a single type will also sort them by their Id.
+func getFileName(kind fileType, id uint64) string {
 	n := make([]byte, 9)
 
-	// The first byte of the filename is the fileTypeValue const.
-	n[0] = byte(fileTypeValue)
+	// The first byte of the filename is the type of the file.
+	n[0] = byte(kind)
 
-	// The following 8 bytes is the fileId itself.
-	binary.BigEndian.PutUint64(n[1:], fileId)
+	// The following 8 bytes is the Id itself.
+	binary.BigEndian.PutUint64(n[1:], id)
 
 	// The plaintext filename is the hexadecimal encoding of the 9 bytes.
 	return hex.EncodeToString(n)
 }
 
+// parseFileName is the inverse of getFileName, it will return the type and Id of the file name
+// provided. If the name was not generated by getFileName then ErrInvalidFileName is returned. Only
+// the canonical (lowercase) encoding is accepted, this way two different names can never refer to
+// the same file.
+func parseFileName(name string) (fileType, uint64, error) {
+	if len(name) != fileNameLength {
+		return 0, 0, ErrInvalidFileName
+	}
+
+	n, err := hex.DecodeString(name)
+	if err != nil {
+		return 0, 0, ErrInvalidFileName
+	}
+
+	kind, id := fileType(n[0]), binary.BigEndian.Uint64(n[1:])
+
+	// Ids start at 1, an Id of 0 is used throughout the database to indicate that something has
+	// not been written to a file yet.
+	if kind > fileTypeValue || id == 0 || getFileName(kind, id) != name {
+		return 0, 0, ErrInvalidFileName
+	}
+
+	return kind, id, nil
+}
+
+// listFiles will return the Ids of all of the files of the type specified in the directory. The
+// Ids are returned in ascending order. Any files in the directory that were not created by the
+// database (like the LOCK file) or that are of a different type are ignored.
+func listFiles(directory string, kind fileType) ([]uint64, error) {
+	infos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		fileKind, id, err := parseFileName(info.Name())
+		if err != nil || fileKind != kind {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids, nil
+}
+
+// getLastFileId returns the largest Id of the files of the type specified in the directory. If
+// there are no files of that type then 0 is returned. New files should always be created with an
+// Id greater than this, that way an existing file is never reused.
+func getLastFileId(directory string, kind fileType) (uint64, error) {
+	ids, err := listFiles(directory, kind)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	return ids[len(ids)-1], nil
+}
+
+// getManifestFileName returns a string representation of the manifest file name. See getFileName.
+func getManifestFileName(manifestId uint64) string {
+	return getFileName(fileTypeManifest, manifestId)
+}
+
+// getHeapFileName returns a string representation of the heap file name. See getFileName.
+func getHeapFileName(heapId uint64) string {
+	return getFileName(fileTypeHeap, heapId)
+}
+
+// getValueFileName returns a string representation of the value file name. The name is a
+// hexadecimal encoded byte array, with the first byte being the value file type prefix and the
+// following 8 bytes being the fileId.
+func getValueFileName(fileId uint64) string {
+	return getFileName(fileTypeValue, fileId)
+}
+
 // getWalSegmentFileName returns a string representation of the WAL segment file name. The name is a
 // hexadecimal encoded byte array, with the first byte being the wal file type prefix and the
 // following 8 bytes being the segmentId.
 func getWalSegmentFileName(segmentId uint64) string {
-	n := make([]byte, 9)
-
-	// The first byte of the filename is the fileTypeWal const.
-	n[0] = byte(fileTypeWal)
-
-	// The following 8 bytes is the segmentId itself.
-	binary.BigEndian.PutUint64(n[1:], segmentId)
-
-	// The plaintext filename is the hexadecimal encoding of the 9 bytes.
-	return hex.EncodeToString(n)
+	return getFileName(fileTypeWal, segmentId)
 }
@@ -2,7 +2,10 @@ package lsmtree
 
 import (
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"math"
+	"os"
+	"path"
 	"testing"
 )
 
@@ -38,6 +41,84 @@ func TestGetWalSegmentFileName(t *testing.T) {
 	}
 }
 
+func TestParseFileName(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		kinds := []fileType{fileTypeManifest, fileTypeWal, fileTypeHeap, fileTypeValue}
+		ids := []uint64{1, 2, 132, 532532, math.MaxUint64}
+		for _, kind := range kinds {
+			for _, id := range ids {
+				parsedKind, parsedId, err := parseFileName(getFileName(kind, id))
+				assert.NoError(t, err)
+				assert.Equal(t, kind, parsedKind)
+				assert.Equal(t, id, parsedId)
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		names := []string{
+			"",
+			lockFileName,
+			"01000000000000000",               // Too short.
+			"0100000000000000011",             // Too long.
+			"01000000000000000z",              // Not hexadecimal.
+			"01000000000000000A",              // Not the canonical encoding.
+			"010000000000000000",              // An Id of 0.
+			getFileName(fileTypeValue+1, 1),   // Unknown file type.
+			getWalSegmentFileName(1) + ".tmp", // Extra suffix.
+		}
+		for _, name := range names {
+			_, _, err := parseFileName(name)
+			assert.Equal(t, ErrInvalidFileName, err, name)
+		}
+	})
+}
+
+func TestListFiles(t *testing.T) {
+	t.Run("sorted by id", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		names := []string{
+			getWalSegmentFileName(300),
+			getWalSegmentFileName(2),
+			getValueFileName(1),
+			getWalSegmentFileName(1),
+			getHeapFileName(5),
+			lockFileName,
+			"random.txt",
+		}
+		for _, name := range names {
+			assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), nil, defaultFileMode))
+		}
+
+		// Directories should be ignored even if they look like one of our files.
+		assert.NoError(t, createDirectory(path.Join(dir, getWalSegmentFileName(4)), 0755))
+
+		ids, err := listFiles(dir, fileTypeWal)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{1, 2, 300}, ids)
+
+		ids, err = listFiles(dir, fileTypeValue)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{1}, ids)
+
+		lastId, err := getLastFileId(dir, fileTypeWal)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(300), lastId)
+
+		lastId, err = getLastFileId(dir, fileTypeManifest)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), lastId)
+	})
+
+	t.Run("directory doesnt exist", func(t *testing.T) {
+		ids, err := listFiles("tmp", fileTypeWal)
+		assert.Error(t, err)
+		assert.Nil(t, ids)
+	})
+}
+
 func TestGetPathExists(t *testing.T) {
 	t.Run("does not exist", func(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
@@ -66,7 +147,7 @@ func TestCreateDirectory(t *testing.T) {
 		exists := getPathExists(path)
 		assert.False(t, exists)
 
-		err := createDirectory(path)
+		err := createDirectory(path, 0755)
 		assert.NoError(t, err)
 
 		exists = getPathExists(path)
@@ -95,10 +176,47 @@ func TestNewDirectory(t *testing.T) {
 		exists := getPathExists(path)
 		assert.False(t, exists)
 
-		err := newDirectory(path)
+		err := newDirectory(path, 0755)
 		assert.NoError(t, err)
 
 		exists = getPathExists(path)
 		assert.True(t, exists)
 	})
 }
+
+func TestGetDirectoryMode(t *testing.T) {
+	modes := map[os.FileMode]os.FileMode{
+		0644: 0755,
+		0600: 0700,
+		0640: 0750,
+		0666: 0777,
+		0700: 0700,
+	}
+	for fileMode, expected := range modes {
+		assert.Equal(t, expected, getDirectoryMode(fileMode), "file mode %o", fileMode)
+	}
+}
+
+// recordingSyncer is a fileSyncer that records every sync instead of performing it, so tests can
+// check what was synced and in which order.
+type recordingSyncer struct {
+	syncs []string
+}
+
+func (s *recordingSyncer) SyncFile(name string, file CanSync) error {
+	s.syncs = append(s.syncs, "file:"+name)
+	return nil
+}
+
+func (s *recordingSyncer) SyncDirectory(directory string) error {
+	s.syncs = append(s.syncs, "directory:"+directory)
+	return nil
+}
+
+func TestNewFileSyncer(t *testing.T) {
+	options := DefaultOptions()
+	assert.Equal(t, diskSyncer{}, newFileSyncer(options))
+
+	options.SkipSyncOnSeal = true
+	assert.Equal(t, skipSyncer{}, newFileSyncer(options))
+}
@@ -0,0 +1,123 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+)
+
+// When a memtable is flushed, every transaction it covers has to record the heap file and value
+// file that its changes were written to. Originally this was done by rewriting the HeapId and
+// ValueFileId of each transaction in the WAL in place. That makes the WAL mutable: bytes that
+// were already synced are changed again later, so a checksum over a transaction could never cover
+// them, and a crash in the middle of the rewrite leaves some transactions updated and others not.
+//
+// Instead a flush appends a single flush marker to the WAL, a transaction of its own with one
+// walTransactionChangeTypeFlush change. The key of the change is the heap file id and the value
+// file id, and the value is the id of every transaction that was flushed to them. Transactions are
+// never changed once they have been appended, and the marker is made durable by the same
+// SyncBarrier as any other append. When the WAL is recovered the markers are applied to the
+// transactions they refer to, so callers see the same HeapId and ValueFileId either way.
+//
+// Versions of the database from before flush markers were added cannot read a WAL that has them,
+// walManager.inPlaceFlushUpdates keeps rewriting the transactions in place instead.
+
+type (
+	// walFlushTarget is the heap file and value file that a transaction was flushed to.
+	walFlushTarget struct {
+		HeapId      uint64
+		ValueFileId uint64
+	}
+)
+
+// RecordFlush records that the transactions specified were flushed to the heap and value file
+// provided. Normally a flush marker is appended to the WAL as a transaction with the markerId
+// provided, which like a prepare id must come from the same allocator as timestamps so that it
+// never collides with the TransactionId of a commit. The marker is not durable until the next
+// SyncBarrier.
+//
+// If the WAL is rewritten in place instead then every segment is searched for the transactions,
+// and the segments they were found in are synced, except for the current segment.
+func (w *walManager) RecordFlush(
+	markerId uint64, transactionIds []uint64, heapId, valueFileId uint64,
+) error {
+	if len(transactionIds) == 0 {
+		return nil
+	}
+
+	if !w.inPlaceFlushUpdates {
+		return w.Append(walTransaction{
+			TransactionId: markerId,
+			Entries: []walTransactionChange{
+				newFlushChange(transactionIds, walFlushTarget{
+					HeapId:      heapId,
+					ValueFileId: valueFileId,
+				}),
+			},
+		})
+	}
+
+	segmentIds, err := listFiles(w.Directory, fileTypeWal)
+	if err != nil {
+		return err
+	}
+
+	// Flushed transactions are usually the oldest ones that are still in the WAL, so searching
+	// from the first segment finds them soonest.
+	remaining := len(transactionIds)
+	for _, segmentId := range segmentIds {
+		found, err := w.UpdateTransactions(segmentId, transactionIds, heapId, valueFileId)
+		if err != nil {
+			return err
+		}
+
+		if remaining -= found; remaining <= 0 {
+			break
+		}
+	}
+
+	return nil
+}
+
+// newFlushChange returns the change that records that the transactions were flushed to the
+// target.
+func newFlushChange(transactionIds []uint64, target walFlushTarget) walTransactionChange {
+	key := make(Key, 16)
+	binary.BigEndian.PutUint64(key[0:8], target.HeapId)
+	binary.BigEndian.PutUint64(key[8:16], target.ValueFileId)
+
+	value := make([]byte, 8*len(transactionIds))
+	for i, id := range transactionIds {
+		binary.BigEndian.PutUint64(value[i*8:], id)
+	}
+
+	return walTransactionChange{
+		Type:  walTransactionChangeTypeFlush,
+		Key:   key,
+		Value: value,
+	}
+}
+
+// decodeFlushMarker returns the transactions that were flushed and where they were flushed to if
+// the transaction is a flush marker.
+func decodeFlushMarker(txn walTransaction) ([]uint64, walFlushTarget, bool) {
+	if len(txn.Entries) != 1 {
+		return nil, walFlushTarget{}, false
+	}
+
+	change := txn.Entries[0]
+	if change.Type != walTransactionChangeTypeFlush || len(change.Key) != 16 ||
+		len(change.Value)%8 != 0 {
+		return nil, walFlushTarget{}, false
+	}
+
+	target := walFlushTarget{
+		HeapId:      binary.BigEndian.Uint64(change.Key[0:8]),
+		ValueFileId: binary.BigEndian.Uint64(change.Key[8:16]),
+	}
+
+	ids := make([]uint64, len(change.Value)/8)
+	for i := range ids {
+		ids[i] = binary.BigEndian.Uint64(change.Value[i*8:])
+	}
+
+	return ids, target, true
+}
@@ -0,0 +1,120 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWalManager_RecordFlush(t *testing.T) {
+	// appendCommits appends committed transactions 1 through count, two fit in each segment.
+	appendCommits := func(t *testing.T, manager *walManager, count int) {
+		for i := 1; i <= count; i++ {
+			assert.NoError(t, manager.Append(walTransaction{
+				TransactionId: uint64(i),
+				Timestamp:     uint64(i),
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte(fmt.Sprintf("key%d", i)),
+						Value: []byte("value"),
+					},
+				},
+			}))
+		}
+	}
+
+	// flushedTo returns the heap id of every recovered transaction by its id.
+	flushedTo := func(t *testing.T, manager *walManager) map[uint64]uint64 {
+		recovery, err := manager.recover()
+		assert.NoError(t, err)
+		assert.Empty(t, recovery.prepared)
+
+		heapIds := map[uint64]uint64{}
+		for _, txn := range recovery.committed {
+			heapIds[txn.TransactionId] = txn.HeapId
+			if txn.HeapId != 0 {
+				assert.Equal(t, txn.HeapId+1, txn.ValueFileId)
+			}
+		}
+
+		return heapIds
+	}
+
+	t.Run("flush markers", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+		appendCommits(t, manager, 4)
+
+		assert.NoError(t, manager.RecordFlush(100, []uint64{1, 2, 3}, 7, 8))
+		assert.NoError(t, manager.RecordFlush(101, nil, 9, 10))
+		assert.Equal(t, uint64(5), manager.appended)
+		assert.NoError(t, manager.SyncBarrier())
+
+		// The transactions themselves are never rewritten.
+		transactions, err := manager.readSegment(1)
+		assert.NoError(t, err)
+		for _, txn := range transactions {
+			assert.Zero(t, txn.HeapId)
+		}
+
+		assert.Equal(t, map[uint64]uint64{1: 7, 2: 7, 3: 7, 4: 0}, flushedTo(t, manager))
+	})
+
+	t.Run("in place", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+		manager.inPlaceFlushUpdates = true
+		appendCommits(t, manager, 4)
+
+		assert.NoError(t, manager.RecordFlush(100, []uint64{1, 2, 3}, 7, 8))
+		assert.Equal(t, uint64(4), manager.appended)
+		assert.NoError(t, manager.SyncBarrier())
+
+		transactions, err := manager.readSegment(1)
+		assert.NoError(t, err)
+		for _, txn := range transactions {
+			assert.Equal(t, uint64(7), txn.HeapId)
+		}
+
+		assert.Equal(t, map[uint64]uint64{1: 7, 2: 7, 3: 7, 4: 0}, flushedTo(t, manager))
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.DataDirectory, options.WALDirectory = dir, dir
+		db, err := Open(options)
+		assert.NoError(t, err)
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+		assert.NoError(t, txn.Commit())
+
+		// A marker is neither applied to the memtable nor mistaken for a prepared transaction.
+		assert.NoError(t, db.wal.RecordFlush(db.timestamps.Next(), []uint64{1}, 3, 4))
+		assert.NoError(t, db.SyncBarrier())
+		assert.NoError(t, db.Close())
+
+		db, err = Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+		assert.Empty(t, db.PreparedTransactions())
+
+		txn, err = db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+		item, err := txn.Get(Key("key"))
+		assert.NoError(t, err)
+		assert.Equal(t, "value", string(item.Value))
+	})
+}
@@ -96,6 +96,6 @@ func (f *freeSpace) Space() int64 {
 // bytes in a file.
 func (f *freeSpace) Encode() []byte {
 	b := make([]byte, 8)
-	binary.BigEndian.PutUint64(b, (uint64)(*f))
+	binary.BigEndian.PutUint64(b, atomic.LoadUint64((*uint64)(f)))
 	return b
 }
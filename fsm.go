@@ -0,0 +1,304 @@
+package lsmtree
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// detachedBatchOptions are the options that a zero WriteBatch is checked against.
+	detachedBatchOptions = DefaultOptions()
+)
+
+type (
+	// WriteBatch is a set of changes that are applied together by ApplyBatch. Unlike a Txn a
+	// batch does not read anything, so it can be built before it is known what it will be applied
+	// on top of. If the same key is changed more than once in a batch then the last change wins.
+	//
+	// The zero value is an empty batch that is not tied to a database, it is checked against the
+	// limits in DefaultOptions instead. This is so that a mock Engine can create batches too.
+	//
+	// Every change in a batch is committed by a single WAL transaction and published to readers
+	// at a single timestamp. A reader sees all of the batch or none of it, and so does recovery
+	// after a crash, no matter how far the changes had been applied to the memtable.
+	WriteBatch struct {
+		db *DB
+
+		changes []walTransactionChange
+
+		// pending maps each key to its index in changes.
+		pending map[string]int
+
+		// size is the total size of the changes, see Options.MaxBatchSize.
+		size int64
+	}
+
+	// FSMSnapshot is a point in time copy of the database along with the index of the last log
+	// entry applied to it. It is used by consensus layers to compact their log, the snapshot can
+	// be persisted in the background while new entries continue to be applied. Release must be
+	// called once the snapshot is no longer needed.
+	FSMSnapshot struct {
+		db           *DB
+		snapshot     *Snapshot
+		appliedIndex uint64
+	}
+)
+
+// NewWriteBatch creates an empty batch of changes for the database.
+func (db *DB) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		db:      db,
+		pending: map[string]int{},
+	}
+}
+
+// Set will set the key to the value provided when the batch is applied.
+func (b *WriteBatch) Set(key Key, value []byte) error {
+	return b.SetWithMeta(key, value, 0)
+}
+
+// SetWithTTL will set the key to the value provided when the batch is applied, the key expires
+// once the ttl has passed. See Txn.SetWithTTL.
+func (b *WriteBatch) SetWithTTL(key Key, value []byte, ttl time.Duration) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	return b.add(walTransactionChange{
+		Type:      walTransactionChangeTypeSet,
+		Key:       key,
+		Value:     value,
+		ExpiresAt: getExpiresAt(b.options().Clock.Now(), ttl),
+	})
+}
+
+// SetWithMeta will set the key to the value provided, along with a single byte of user metadata,
+// when the batch is applied.
+func (b *WriteBatch) SetWithMeta(key Key, value []byte, userMeta byte) error {
+	if value == nil {
+		// A key that is being set must always have a non-nil value.
+		value = []byte{}
+	}
+
+	return b.add(walTransactionChange{
+		Type:     walTransactionChangeTypeSet,
+		Key:      key,
+		Value:    value,
+		UserMeta: userMeta,
+	})
+}
+
+// Delete will remove the key when the batch is applied.
+func (b *WriteBatch) Delete(key Key) error {
+	return b.add(walTransactionChange{
+		Type: walTransactionChangeTypeDelete,
+		Key:  key,
+	})
+}
+
+// Len returns the number of keys that the batch will change.
+func (b *WriteBatch) Len() int {
+	return len(b.changes)
+}
+
+// add stages the change in the batch. The key and value are copied so that the caller can reuse
+// their buffers.
+func (b *WriteBatch) add(change walTransactionChange) error {
+	options := b.options()
+	if err := change.Validate(options.MaxKeySize, options.MaxValueSize); err != nil {
+		return err
+	}
+
+	change.Key = append(Key{}, change.Key...)
+	if change.Value != nil {
+		change.Value = append([]byte{}, change.Value...)
+	}
+
+	index, ok := b.pending[string(change.Key)]
+	size, err := options.checkBatchLimits(b.changes, b.size, index, ok, change)
+	if err != nil {
+		return err
+	}
+	b.size = size
+
+	if ok {
+		b.changes[index] = change
+		return nil
+	}
+
+	if b.pending == nil {
+		b.pending = map[string]int{}
+	}
+	b.pending[string(change.Key)] = len(b.changes)
+	b.changes = append(b.changes, change)
+
+	return nil
+}
+
+// Items returns the changes in the batch in the order that their keys were first changed. The
+// Value of a deleted key is nil. The items share their memory with the batch, so they must not be
+// modified.
+func (b *WriteBatch) Items() []Item {
+	items := make([]Item, len(b.changes))
+	for i, change := range b.changes {
+		items[i] = Item{
+			Key:       change.Key,
+			Value:     change.Value,
+			UserMeta:  change.UserMeta,
+			ExpiresAt: change.ExpiresAt,
+		}
+	}
+
+	return items
+}
+
+// options returns the options of the database the batch was created for, or the default options if
+// it is a zero WriteBatch.
+func (b *WriteBatch) options() *Options {
+	if b.db == nil {
+		return &detachedBatchOptions
+	}
+
+	return &b.db.options
+}
+
+// AppliedIndex returns the index of the last log entry applied with ApplyBatch or restored by
+// InstallSnapshot. It is 0 if nothing has been applied.
+func (db *DB) AppliedIndex() uint64 {
+	return db.manifest.AppliedIndex()
+}
+
+// ApplyBatch atomically applies the batch and records index as the applied index of the database.
+// This is meant to be called from the Apply method of a consensus layer's state machine, where
+// index is the index of the log entry the batch came from. The batch may be nil or empty if the
+// entry does not change anything, the applied index is still recorded.
+//
+// Entries with an index at or below the applied index have already been applied and are ignored,
+// this way the log can be replayed from any point after a restart. The applied index is durable
+// once ApplyBatch returns, but it is recorded after the batch is committed; if the database
+// crashes in between then the entry will be applied again, which is harmless since applying the
+// same batch twice in log order has the same result as applying it once.
+//
+// When the database is used as a state machine every change should go through ApplyBatch,
+// otherwise snapshots will contain changes that are not reflected by the applied index.
+func (db *DB) ApplyBatch(index uint64, batch *WriteBatch) error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	db.fsmLock.Lock()
+	defer db.fsmLock.Unlock()
+
+	if index <= db.manifest.AppliedIndex() {
+		return nil
+	}
+
+	// The applied index can only be recorded once the manifest has been upgraded, make sure of
+	// that before the batch is committed so that it is not applied without its index.
+	if err := db.manifest.requireVersion(2); err != nil {
+		return err
+	}
+
+	if batch != nil && len(batch.changes) > 0 {
+		if _, err := db.commit(batch.changes, WritePriorityNormal); err != nil {
+			return err
+		}
+	}
+
+	return db.manifest.SetAppliedIndex(index)
+}
+
+// NewFSMSnapshot captures the current state of the database along with its applied index. This is
+// cheap and does not block ApplyBatch for longer than it takes to take a snapshot, the data is not
+// read until Persist is called.
+func (db *DB) NewFSMSnapshot() (*FSMSnapshot, error) {
+	db.fsmLock.Lock()
+	defer db.fsmLock.Unlock()
+
+	snapshot, err := db.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &FSMSnapshot{
+		db:           db,
+		snapshot:     snapshot,
+		appliedIndex: db.manifest.AppliedIndex(),
+	}, nil
+}
+
+// AppliedIndex returns the index of the last log entry included in the snapshot.
+func (s *FSMSnapshot) AppliedIndex() uint64 {
+	return s.appliedIndex
+}
+
+// Persist writes the snapshot to the writer. The snapshot is written in the same format as Dump
+// with the applied index included, so it can also be loaded with Load.
+func (s *FSMSnapshot) Persist(w io.Writer) error {
+	return s.db.dump(w, s.snapshot, &s.appliedIndex, nil, nil)
+}
+
+// Release allows the versions of keys held by the snapshot to be removed. Calling Release more
+// than once does nothing.
+func (s *FSMSnapshot) Release() {
+	s.snapshot.Release()
+}
+
+// InstallSnapshot replaces the entire contents of the database with a snapshot written by
+// FSMSnapshot.Persist, and sets the applied index to the one stored in the snapshot.
+//
+// The applied index is reset to 0 before anything is changed and only set once the snapshot has
+// been completely installed. If InstallSnapshot fails part way through then the database will be
+// left with some mix of its old contents and the snapshot, the applied index of 0 signals that the
+// snapshot needs to be installed again before the database can be used.
+func (db *DB) InstallSnapshot(r io.Reader) error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	db.fsmLock.Lock()
+	defer db.fsmLock.Unlock()
+
+	if err := db.manifest.SetAppliedIndex(0); err != nil {
+		return err
+	}
+
+	if err := db.deleteEverything(); err != nil {
+		return err
+	}
+
+	appliedIndex, err := db.load(r)
+	if err != nil {
+		return err
+	}
+
+	return db.manifest.SetAppliedIndex(appliedIndex)
+}
+
+// deleteEverything deletes every key in the database.
+func (db *DB) deleteEverything() error {
+	txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+
+	iterator, err := txn.NewIterator(IteratorOptions{})
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	loader := &batchLoader{db: db}
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if err = loader.Add(walTransactionChange{
+			Type: walTransactionChangeTypeDelete,
+			Key:  iterator.Item().Key,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return loader.Flush()
+}
@@ -0,0 +1,192 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestApplyBatch(t *testing.T) {
+	// get returns the value of the key or "" if it does not exist.
+	get := func(t *testing.T, db *DB, key string) string {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		item, err := txn.Get(Key(key))
+		if err == ErrKeyNotFound {
+			return ""
+		}
+		assert.NoError(t, err)
+		return string(item.Value)
+	}
+
+	t.Run("applied index", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.DataDirectory, options.WALDirectory = dir, dir
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.Zero(t, db.AppliedIndex())
+
+		batch := db.NewWriteBatch()
+		assert.NoError(t, batch.Set(Key("a"), []byte("1")))
+		assert.NoError(t, batch.Set(Key("b"), []byte("1")))
+		assert.NoError(t, batch.Delete(Key("b")))
+		assert.Equal(t, 2, batch.Len())
+		assert.NoError(t, db.ApplyBatch(1, batch))
+		assert.Equal(t, uint64(1), db.AppliedIndex())
+		assert.Equal(t, "1", get(t, db, "a"))
+		assert.Equal(t, "", get(t, db, "b"))
+
+		// Entries that have already been applied should be ignored.
+		batch = db.NewWriteBatch()
+		assert.NoError(t, batch.Set(Key("a"), []byte("2")))
+		assert.NoError(t, db.ApplyBatch(1, batch))
+		assert.Equal(t, "1", get(t, db, "a"))
+
+		// Entries without any changes still move the applied index.
+		assert.NoError(t, db.ApplyBatch(5, nil))
+		assert.Equal(t, uint64(5), db.AppliedIndex())
+
+		// The applied index should survive the database being reopened.
+		assert.NoError(t, db.Close())
+		db, err = Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+		assert.Equal(t, uint64(5), db.AppliedIndex())
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		source, cleanupSource := newTestDB(t, DefaultOptions())
+		defer cleanupSource()
+		target, cleanupTarget := newTestDB(t, DefaultOptions())
+		defer cleanupTarget()
+
+		batch := source.NewWriteBatch()
+		assert.NoError(t, batch.Set(Key("a"), []byte("1")))
+		assert.NoError(t, batch.Set(Key("b"), []byte("1")))
+		assert.NoError(t, source.ApplyBatch(3, batch))
+
+		snapshot, err := source.NewFSMSnapshot()
+		assert.NoError(t, err)
+		defer snapshot.Release()
+		assert.Equal(t, uint64(3), snapshot.AppliedIndex())
+
+		// Entries applied after the snapshot was taken should not be included in it.
+		batch = source.NewWriteBatch()
+		assert.NoError(t, batch.Set(Key("c"), []byte("1")))
+		assert.NoError(t, source.ApplyBatch(4, batch))
+
+		var buf bytes.Buffer
+		assert.NoError(t, snapshot.Persist(&buf))
+
+		// Anything in the target that is not in the snapshot should be removed.
+		batch = target.NewWriteBatch()
+		assert.NoError(t, batch.Set(Key("a"), []byte("old")))
+		assert.NoError(t, batch.Set(Key("z"), []byte("old")))
+		assert.NoError(t, target.ApplyBatch(10, batch))
+
+		assert.NoError(t, target.InstallSnapshot(bytes.NewReader(buf.Bytes())))
+		assert.Equal(t, uint64(3), target.AppliedIndex())
+		assert.Equal(t, "1", get(t, target, "a"))
+		assert.Equal(t, "1", get(t, target, "b"))
+		assert.Equal(t, "", get(t, target, "c"))
+		assert.Equal(t, "", get(t, target, "z"))
+
+		// A snapshot is still a valid dump.
+		loaded, cleanupLoaded := newTestDB(t, DefaultOptions())
+		defer cleanupLoaded()
+		assert.NoError(t, loaded.Load(bytes.NewReader(buf.Bytes())))
+		assert.Equal(t, "1", get(t, loaded, "b"))
+		assert.Zero(t, loaded.AppliedIndex())
+	})
+
+	t.Run("visible atomically", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for index := uint64(1); index <= 200; index++ {
+				batch := db.NewWriteBatch()
+				for _, key := range keys {
+					assert.NoError(t, batch.Set(Key(key), []byte(fmt.Sprint(index))))
+				}
+				assert.NoError(t, db.ApplyBatch(index, batch))
+			}
+		}()
+
+		// A reader must see every change in a batch or none of them, never some of the keys
+		// from one batch and some from another.
+		for {
+			select {
+			case <-done:
+				assert.Equal(t, "200", get(t, db, "h"))
+				return
+			default:
+			}
+
+			txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+			assert.NoError(t, err)
+			values := map[string]bool{}
+			for _, key := range keys {
+				item, err := txn.Get(Key(key))
+				if err == ErrKeyNotFound {
+					values[""] = true
+					continue
+				}
+				assert.NoError(t, err)
+				values[string(item.Value)] = true
+			}
+			txn.Discard()
+			assert.Len(t, values, 1)
+		}
+	})
+
+	t.Run("recovered atomically", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.DataDirectory, options.WALDirectory = dir, dir
+		db, err := Open(options)
+		assert.NoError(t, err)
+
+		batch := db.NewWriteBatch()
+		assert.NoError(t, batch.Set(Key("a"), []byte("1")))
+		assert.NoError(t, batch.Set(Key("b"), []byte("1")))
+		assert.NoError(t, batch.Delete(Key("c")))
+
+		// Simulate a crash after the batch was written to the WAL but before any of it was
+		// applied to the memtable.
+		assert.NoError(t, db.wal.Append(walTransaction{
+			TransactionId: 1,
+			Timestamp:     db.readTimestamp() + 1,
+			Entries:       batch.changes,
+		}))
+		assert.NoError(t, db.SyncBarrier())
+		assert.Equal(t, "", get(t, db, "a"))
+		assert.NoError(t, db.Close())
+
+		db, err = Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+		assert.Equal(t, "1", get(t, db, "a"))
+		assert.Equal(t, "1", get(t, db, "b"))
+	})
+
+	t.Run("bad snapshot", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		assert.NoError(t, db.ApplyBatch(7, nil))
+		assert.Error(t, db.InstallSnapshot(bytes.NewReader([]byte("not a snapshot"))))
+		assert.Zero(t, db.AppliedIndex())
+	})
+}
@@ -0,0 +1,325 @@
+package lsmtree
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// The golden files in testdata/golden were written by each version of the on-disk formats, one
+// directory per format and version. They are never regenerated: if a change to the code means
+// that one of them can no longer be read then the change breaks every database that was written
+// with that version. When a format version is bumped, run the tests with -golden.write to add the
+// files for the new version; files for versions that already exist are left untouched.
+//
+//	testdata/golden/wal/v1       A WAL segment.
+//	testdata/golden/manifest/vN  A manifest along with the heap file it records.
+//	testdata/golden/dump/vN.dump A dump, as written by DB.Dump.
+//	testdata/golden/valuelog/vN  A value file holding the golden items.
+var writeGolden = flag.Bool(
+	"golden.write", false, "write golden files for any format versions that do not have them",
+)
+
+const (
+	// goldenDirectory is where the golden files are stored, relative to the package.
+	goldenDirectory = "testdata/golden"
+
+	// goldenWalVersion is the version of the WAL segment format. The WAL does not store a version
+	// of its own yet, so this must be bumped by hand if the layout of a segment changes.
+	goldenWalVersion = 1
+
+	// goldenAppliedIndex is the applied index stored in the golden manifests that support it.
+	goldenAppliedIndex = 42
+
+	// goldenLastSegmentId is the last leased WAL segment Id stored in the golden manifests that
+	// support it.
+	goldenLastSegmentId = 9
+)
+
+var (
+	// goldenTransactions are the transactions stored in the golden WAL segments. They cover
+	// changes with and without user metadata, empty values and deletes.
+	goldenTransactions = []walTransaction{
+		{
+			TransactionId: 1,
+			Timestamp:     10,
+			Entries: []walTransactionChange{
+				{Type: walTransactionChangeTypeSet, Key: Key("a"), Value: []byte("one")},
+				{Type: walTransactionChangeTypeSet, Key: Key("b"), Value: []byte{}},
+			},
+		},
+		{
+			TransactionId: 2,
+			Timestamp:     20,
+			HeapId:        3,
+			ValueFileId:   4,
+			Entries: []walTransactionChange{
+				{
+					Type:     walTransactionChangeTypeSet,
+					Key:      Key("c"),
+					Value:    []byte("three"),
+					UserMeta: 7,
+				},
+				{Type: walTransactionChangeTypeDelete, Key: Key("a")},
+			},
+		},
+	}
+
+	// goldenItems are the keys and values stored in the golden dumps.
+	goldenItems = []Item{
+		{Key: Key("a"), Value: []byte("one")},
+		{Key: Key("b"), Value: []byte{}},
+		{Key: Key("c"), Value: []byte("three"), UserMeta: 7},
+	}
+)
+
+func TestGolden_Write(t *testing.T) {
+	if !*writeGolden {
+		t.Skip("golden files are only written with -golden.write")
+	}
+
+	write := func(t *testing.T, target string, fn func(directory string) error) {
+		if _, err := os.Stat(target); err == nil {
+			return
+		}
+
+		assert.NoError(t, os.MkdirAll(target, 0755))
+		if !assert.NoError(t, fn(target)) {
+			_ = os.RemoveAll(target)
+		}
+	}
+
+	write(t, goldenPath("wal", goldenWalVersion), func(directory string) error {
+		segment, err := openWalSegment(directory, 1, 1024, defaultFileMode)
+		if err != nil {
+			return err
+		}
+
+		for _, txn := range goldenTransactions {
+			if err = segment.Append(txn); err != nil {
+				return err
+			}
+		}
+
+		return segment.Sync()
+	})
+
+	write(t, goldenPath("manifest", manifestVersion), func(directory string) error {
+		m, err := openManifest(directory, defaultFileMode)
+		if err != nil {
+			return err
+		}
+
+		heapPath := path.Join(directory, getHeapFileName(1))
+		if err = ioutil.WriteFile(heapPath, []byte("golden heap file"), 0644); err != nil {
+			return err
+		}
+
+		if err = m.AddFile(fileTypeHeap, 1); err != nil {
+			return err
+		}
+
+		if err = m.SetAppliedIndex(goldenAppliedIndex); err != nil {
+			return err
+		}
+
+		return m.LeaseSegmentIds(goldenLastSegmentId)
+	})
+
+	write(t, goldenPath("valuelog", valueLogVersion), func(directory string) error {
+		file, err := openValueFile(directory, 1, defaultFileMode)
+		if err != nil {
+			return err
+		}
+		defer file.File.(*os.File).Close()
+
+		for _, item := range goldenItems {
+			if _, err = file.AppendEntry(item.Key, item.Value, item.UserMeta); err != nil {
+				return err
+			}
+		}
+
+		return file.Sync()
+	})
+
+	dumpPath := goldenPath("dump", dumpVersion) + ".dump"
+	if _, err := os.Stat(dumpPath); os.IsNotExist(err) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		for _, item := range goldenItems {
+			assert.NoError(t, txn.SetWithMeta(item.Key, item.Value, item.UserMeta))
+		}
+		assert.NoError(t, txn.Commit())
+
+		var buf bytes.Buffer
+		assert.NoError(t, db.Dump(&buf))
+		assert.NoError(t, os.MkdirAll(path.Dir(dumpPath), 0755))
+		assert.NoError(t, ioutil.WriteFile(dumpPath, buf.Bytes(), 0644))
+	}
+}
+
+func TestGolden_CurrentVersions(t *testing.T) {
+	// Every format version that can be written must have golden files, otherwise nothing would
+	// stop the next change to the format from breaking it.
+	for _, current := range []string{
+		goldenPath("wal", goldenWalVersion),
+		goldenPath("manifest", manifestVersion),
+		goldenPath("dump", dumpVersion) + ".dump",
+		goldenPath("valuelog", valueLogVersion),
+	} {
+		_, err := os.Stat(current)
+		assert.NoError(t, err, "run the tests with -golden.write to add the golden files")
+	}
+}
+
+func TestGolden_Wal(t *testing.T) {
+	for _, version := range goldenVersions(t, "wal") {
+		t.Run(path.Base(version), func(t *testing.T) {
+			dir, cleanup := copyGoldenDirectory(t, version)
+			defer cleanup()
+
+			segment, err := openWalSegment(dir, 1, 1024, defaultFileMode)
+			assert.NoError(t, err)
+			defer segment.File.(*os.File).Close()
+
+			transactions, err := segment.GetTransactions()
+			assert.NoError(t, err)
+			assert.Equal(t, goldenTransactions, transactions)
+		})
+	}
+}
+
+func TestGolden_Manifest(t *testing.T) {
+	for _, version := range goldenVersions(t, "manifest") {
+		t.Run(path.Base(version), func(t *testing.T) {
+			dir, cleanup := copyGoldenDirectory(t, version)
+			defer cleanup()
+
+			m, err := openManifest(dir, defaultFileMode)
+			assert.NoError(t, err)
+			assert.NoError(t, m.Verify())
+
+			files := m.Files()
+			assert.Len(t, files, 1)
+			assert.Equal(t, manifestFileKey{Kind: fileTypeHeap, Id: 1}, files[0].key())
+			assert.Zero(t, files[0].Level)
+
+			// The applied index was added in version 2.
+			if path.Base(version) == "v1" {
+				assert.Equal(t, uint64(0), m.AppliedIndex())
+			} else {
+				assert.Equal(t, uint64(goldenAppliedIndex), m.AppliedIndex())
+			}
+
+			// The leased segment Ids were added in version 4.
+			if m.Version() < 4 {
+				assert.Zero(t, m.LastSegmentId())
+			} else {
+				assert.Equal(t, uint64(goldenLastSegmentId), m.LastSegmentId())
+			}
+
+			assert.Equal(t, "v"+fmt.Sprint(m.Version()), path.Base(version))
+			assert.NoError(t, m.Upgrade())
+
+			upgraded, err := openManifest(dir, defaultFileMode)
+			assert.NoError(t, err)
+			assert.Equal(t, manifestVersion, upgraded.Version())
+			assert.Equal(t, files, upgraded.Files())
+			assert.Equal(t, m.AppliedIndex(), upgraded.AppliedIndex())
+			assert.Equal(t, m.LastSegmentId(), upgraded.LastSegmentId())
+		})
+	}
+}
+
+func TestGolden_Dump(t *testing.T) {
+	dumps, err := filepath.Glob(path.Join(goldenDirectory, "dump", "v*.dump"))
+	assert.NoError(t, err)
+
+	for _, dump := range dumps {
+		t.Run(path.Base(dump), func(t *testing.T) {
+			data, err := ioutil.ReadFile(dump)
+			assert.NoError(t, err)
+
+			db, cleanup := newTestDB(t, DefaultOptions())
+			defer cleanup()
+			assert.NoError(t, db.Load(bytes.NewReader(data)))
+
+			txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+			assert.NoError(t, err)
+			defer txn.Discard()
+
+			for _, expected := range goldenItems {
+				item, err := txn.Get(expected.Key)
+				assert.NoError(t, err)
+				assert.Equal(t, expected.Value, item.Value)
+				assert.Equal(t, expected.UserMeta, item.UserMeta)
+			}
+		})
+	}
+}
+
+func TestGolden_ValueLog(t *testing.T) {
+	for _, version := range goldenVersions(t, "valuelog") {
+		t.Run(path.Base(version), func(t *testing.T) {
+			dir, cleanup := copyGoldenDirectory(t, version)
+			defer cleanup()
+
+			file, err := openValueFile(dir, 1, defaultFileMode)
+			assert.NoError(t, err)
+			defer file.File.(*os.File).Close()
+
+			items := make([]Item, 0, len(goldenItems))
+			end, err := file.Scan(func(entry valueLogEntry) error {
+				value, err := file.ReadPointer(entry.Pointer, true)
+				items = append(items, Item{
+					Key:      entry.Key,
+					Value:    value,
+					UserMeta: entry.UserMeta,
+				})
+				return err
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, file.Offset, end)
+			assert.Equal(t, goldenItems, items)
+		})
+	}
+}
+
+// goldenPath returns the path of the golden files for a single version of a format.
+func goldenPath(format string, version int) string {
+	return path.Join(goldenDirectory, format, fmt.Sprintf("v%d", version))
+}
+
+// goldenVersions returns the directory of every version of a format that has golden files.
+func goldenVersions(t *testing.T, format string) []string {
+	versions, err := filepath.Glob(path.Join(goldenDirectory, format, "v*"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, versions)
+
+	return versions
+}
+
+// copyGoldenDirectory copies the golden files to a temporary directory, opening the files can
+// write to them and the golden files must never change.
+func copyGoldenDirectory(t *testing.T, source string) (string, func()) {
+	dir, cleanup := NewTempDirectory(t)
+
+	entries, err := ioutil.ReadDir(source)
+	assert.NoError(t, err)
+	for _, entry := range entries {
+		data, err := ioutil.ReadFile(path.Join(source, entry.Name()))
+		assert.NoError(t, err)
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, entry.Name()), data, 0644))
+	}
+
+	return dir, cleanup
+}
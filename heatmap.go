@@ -0,0 +1,200 @@
+package lsmtree
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// maxHeatMapBuckets is the most prefixes that the heat map tracks separately. Once there are
+	// this many, accesses to any other prefix are counted in a single bucket with a nil prefix so
+	// that a workload with a huge number of prefixes cannot use an unbounded amount of memory.
+	maxHeatMapBuckets = 4096
+)
+
+// Counting every access to every key would cost more than the accesses themselves, so when
+// Options.AccessSampleRate is set only a random sample of the reads and writes are counted. The
+// gap between samples is drawn from an exponential distribution rather than taking exactly every
+// Nth access, this makes the samples a Poisson process so a workload that happens to access keys
+// in a regular pattern cannot line up with the sampling and hide a prefix. Each sample stands in
+// for AccessSampleRate accesses, so the counts in the heat map are estimates that get more
+// accurate the more traffic a prefix gets, which is exactly the prefixes that matter.
+
+type (
+	// HeatMapBucket is the estimated number of accesses to the keys that start with a prefix.
+	HeatMapBucket struct {
+		// Prefix is the first Options.HeatMapPrefixLength bytes of the keys in the bucket. It is
+		// nil for the bucket that counts every prefix after the first maxHeatMapBuckets.
+		Prefix []byte
+
+		// Reads is the estimated number of times a key in the bucket was read with Txn.Get.
+		Reads uint64
+
+		// Writes is the estimated number of times a key in the bucket was set or deleted.
+		Writes uint64
+	}
+
+	// accessSampler chooses which key accesses to sample and counts the samples by prefix.
+	accessSampler struct {
+		rate         int
+		prefixLength int
+
+		// countdown is the number of accesses until the next sample, it is only modified
+		// atomically so that accesses that are not sampled never take the lock.
+		countdown int64
+
+		lock    sync.Mutex
+		random  *rand.Rand
+		buckets map[string]*heatMapCounts
+		other   heatMapCounts
+	}
+
+	// heatMapCounts are the number of samples taken for a single bucket.
+	heatMapCounts struct {
+		reads  uint64
+		writes uint64
+	}
+)
+
+// newAccessSampler returns a sampler that samples one in every rate accesses on average, or nil if
+// rate is 0.
+func newAccessSampler(rate, prefixLength int) *accessSampler {
+	if rate == 0 {
+		return nil
+	}
+
+	s := &accessSampler{
+		rate:         rate,
+		prefixLength: prefixLength,
+		random:       rand.New(rand.NewSource(1)),
+		buckets:      map[string]*heatMapCounts{},
+	}
+	s.countdown = s.gap()
+
+	return s
+}
+
+// Read records that the key was read.
+func (s *accessSampler) Read(key Key) {
+	if s == nil {
+		return
+	}
+
+	if counts := s.sample(key); counts != nil {
+		counts.reads++
+		s.lock.Unlock()
+	}
+}
+
+// Write records that each of the keys that are set or deleted by the changes was written.
+func (s *accessSampler) Write(changes []walTransactionChange) {
+	if s == nil {
+		return
+	}
+
+	for _, change := range changes {
+		switch change.Type {
+		case walTransactionChangeTypeSet, walTransactionChangeTypeDelete:
+		default:
+			// Other changes only record things in the WAL, they do not write a key.
+			continue
+		}
+
+		if counts := s.sample(change.Key); counts != nil {
+			counts.writes++
+			s.lock.Unlock()
+		}
+	}
+}
+
+// sample returns nil if the access should not be sampled. Otherwise it returns the counts of the
+// key's bucket with the lock held, the caller must increment them and release the lock.
+func (s *accessSampler) sample(key Key) *heatMapCounts {
+	if atomic.AddInt64(&s.countdown, -1) > 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+
+	// If several accesses reached the end of the countdown at once, only the first one that gets
+	// the lock is sampled.
+	if atomic.LoadInt64(&s.countdown) > 0 {
+		s.lock.Unlock()
+		return nil
+	}
+	atomic.StoreInt64(&s.countdown, s.gap())
+
+	prefix := key
+	if len(prefix) > s.prefixLength {
+		prefix = prefix[:s.prefixLength]
+	}
+
+	counts, ok := s.buckets[string(prefix)]
+	if !ok {
+		if len(s.buckets) >= maxHeatMapBuckets {
+			return &s.other
+		}
+
+		counts = &heatMapCounts{}
+		s.buckets[string(prefix)] = counts
+	}
+
+	return counts
+}
+
+// gap returns the number of accesses until the next sample, on average this is the rate. The lock
+// must be held, or the sampler must not be in use yet.
+func (s *accessSampler) gap() int64 {
+	return 1 + int64(s.random.ExpFloat64()*float64(s.rate-1))
+}
+
+// HeatMap returns the estimated number of accesses to each bucket, busiest first.
+func (s *accessSampler) HeatMap() []HeatMapBucket {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rate := uint64(s.rate)
+	buckets := make([]HeatMapBucket, 0, len(s.buckets)+1)
+	for prefix, counts := range s.buckets {
+		buckets = append(buckets, HeatMapBucket{
+			Prefix: []byte(prefix),
+			Reads:  counts.reads * rate,
+			Writes: counts.writes * rate,
+		})
+	}
+
+	if s.other.reads > 0 || s.other.writes > 0 {
+		buckets = append(buckets, HeatMapBucket{
+			Reads:  s.other.reads * rate,
+			Writes: s.other.writes * rate,
+		})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		a, b := buckets[i].Reads+buckets[i].Writes, buckets[j].Reads+buckets[j].Writes
+		if a != b {
+			return a > b
+		}
+
+		return bytes.Compare(buckets[i].Prefix, buckets[j].Prefix) < 0
+	})
+
+	return buckets
+}
+
+// HeatMap returns the estimated number of reads and writes to the keys under each prefix since
+// the database was opened, busiest first. Prefixes are the first Options.HeatMapPrefixLength bytes
+// of each key. This shows which tenants or tables are driving compaction and cache churn.
+//
+// Reads made with Txn.Get and every key that is set or deleted by a commit are sampled, scans are
+// not. If Options.AccessSampleRate is 0 then nothing is sampled and nil is returned.
+func (db *DB) HeatMap() []HeatMapBucket {
+	return db.accesses.HeatMap()
+}
@@ -0,0 +1,107 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDB_HeatMap(t *testing.T) {
+	t.Run("every access", func(t *testing.T) {
+		options := DefaultOptions()
+		options.AccessSampleRate = 1
+		options.HeatMapPrefixLength = 2
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("t1:a"), []byte("value")))
+		assert.NoError(t, txn.Set(Key("t1:b"), []byte("value")))
+		assert.NoError(t, txn.Delete(Key("t2:a")))
+		assert.NoError(t, txn.Commit())
+		assert.NoError(t, db.WaitForTimestamp(txn.CommitTimestamp(), time.Second))
+
+		txn, err = db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			_, err = txn.Get(Key("t2:a"))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		_, err = txn.Get(Key("t"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		txn.Discard()
+
+		assert.Equal(t, []HeatMapBucket{
+			{Prefix: []byte("t2"), Reads: 3, Writes: 1},
+			{Prefix: []byte("t1"), Writes: 2},
+			{Prefix: []byte("t"), Reads: 1},
+		}, db.HeatMap())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+		assert.NoError(t, txn.Commit())
+
+		assert.Nil(t, db.HeatMap())
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.AccessSampleRate = -1
+		_, err := Open(options)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+
+		options.AccessSampleRate = 10
+		options.HeatMapPrefixLength = 0
+		_, err = Open(options)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+	})
+}
+
+func TestAccessSampler(t *testing.T) {
+	t.Run("estimates", func(t *testing.T) {
+		sampler := newAccessSampler(100, 1)
+		for i := 0; i < 100000; i++ {
+			// Three quarters of the reads are to the hot prefix.
+			prefix := "h"
+			if i%4 == 0 {
+				prefix = "c"
+			}
+			sampler.Read(Key(fmt.Sprintf("%s%d", prefix, i)))
+		}
+
+		buckets := sampler.HeatMap()
+		if assert.Len(t, buckets, 2) {
+			assert.Equal(t, []byte("h"), buckets[0].Prefix)
+			assert.InDelta(t, 75000, buckets[0].Reads, 7500)
+			assert.InDelta(t, 25000, buckets[1].Reads, 5000)
+		}
+	})
+
+	t.Run("bucket limit", func(t *testing.T) {
+		sampler := newAccessSampler(1, 8)
+		for i := 0; i < maxHeatMapBuckets+10; i++ {
+			sampler.Write([]walTransactionChange{
+				{Type: walTransactionChangeTypeSet, Key: Key(fmt.Sprintf("%08d", i))},
+			})
+		}
+
+		buckets := sampler.HeatMap()
+		assert.Len(t, buckets, maxHeatMapBuckets+1)
+		assert.Nil(t, buckets[0].Prefix)
+		assert.Equal(t, uint64(10), buckets[0].Writes)
+	})
+}
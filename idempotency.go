@@ -0,0 +1,257 @@
+package lsmtree
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrEmptyToken is returned by ApplyIfNotSeen when the idempotency token is empty.
+	ErrEmptyToken = errors.New("idempotency token cannot be empty")
+)
+
+// Producers that deliver messages at least once, like a consumer reading from Kafka that restarts
+// from its last committed offset, will hand the same message to the database more than once.
+// ApplyIfNotSeen lets them tag every batch with a token that identifies the message, and the
+// database only applies the first batch with each token.
+//
+// The token is written to the WAL in the same record as the changes of the batch, as a
+// walTransactionChangeTypeToken change that is never applied to the memtable. So the batch and the
+// token are either both durable or both lost, and a replayed message can never be applied twice
+// or be dropped without having been applied. When the database is opened every token in the WAL
+// that has not expired is seen again.
+
+type (
+	// idempotencyTokens are the tokens that have been applied by ApplyIfNotSeen and have not
+	// expired yet.
+	idempotencyTokens struct {
+		lock sync.Mutex
+
+		clock Clock
+
+		// retention is how long a token is kept after it was seen, if this is 0 then tokens
+		// are kept forever.
+		retention time.Duration
+
+		// seen maps each token to the element in order that holds it.
+		seen map[string]*list.Element
+
+		// order holds every seenToken in the order that they were seen, oldest first, so that
+		// expired tokens can be removed from the front.
+		order *list.List
+
+		// inFlight has a channel for every token that is being applied right now, the channel
+		// is closed once the apply has finished. Only one batch with a token is applied at a
+		// time so that two deliveries of the same message at once cannot both be applied.
+		inFlight map[string]chan struct{}
+	}
+
+	// seenToken is a token and the time that it was seen.
+	seenToken struct {
+		token string
+		seen  time.Time
+	}
+)
+
+// ApplyIfNotSeen atomically applies the batch unless a batch with the same token has already been
+// applied, and returns true if the batch was applied. The batch may be nil or empty, the token is
+// still recorded.
+//
+// The token is recorded in the same commit as the batch, so once a batch has been applied no batch
+// with the same token is applied again, even if the database is restarted, until the token is
+// older than Options.IdempotencyTokenRetention. If the same token is applied concurrently then
+// one of the calls applies its batch and the others wait for it: if it fails then the next one
+// tries to apply its own batch.
+func (db *DB) ApplyIfNotSeen(token []byte, batch *WriteBatch) (bool, error) {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return false, ErrClosed
+	}
+
+	switch {
+	case len(token) == 0:
+		return false, ErrEmptyToken
+	case uint64(len(token)) > uint64(db.options.MaxKeySize):
+		return false, fmt.Errorf("%w: token is %d bytes, max is %d",
+			ErrKeyTooLarge, len(token), db.options.MaxKeySize)
+	}
+
+	done, ok := db.tokens.Acquire(string(token))
+	if !ok {
+		return false, nil
+	}
+	defer done()
+
+	var changes []walTransactionChange
+	if batch != nil {
+		changes = batch.changes
+	}
+
+	seen := db.options.Clock.Now()
+	if _, err := db.commitRequest(&commitRequest{
+		changes: changes,
+		markers: []walTransactionChange{newTokenChange(token, seen)},
+		done:    make(chan error, 1),
+	}, WritePriorityNormal); err != nil {
+		return false, err
+	}
+
+	db.tokens.Add(string(token), seen)
+
+	return true, nil
+}
+
+// newTokenChange returns the change that records that the token was seen at the time provided.
+func newTokenChange(token []byte, seen time.Time) walTransactionChange {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(seen.UnixNano()))
+
+	return walTransactionChange{
+		Type:  walTransactionChangeTypeToken,
+		Key:   append(Key{}, token...),
+		Value: value,
+	}
+}
+
+// decodeTokenChange returns the token and the time it was seen if the change records a token.
+func decodeTokenChange(change walTransactionChange) (string, time.Time, bool) {
+	if change.Type != walTransactionChangeTypeToken || len(change.Value) != 8 {
+		return "", time.Time{}, false
+	}
+
+	seen := time.Unix(0, int64(binary.BigEndian.Uint64(change.Value)))
+
+	return string(change.Key), seen, true
+}
+
+// newIdempotencyTokens creates the table of tokens, starting with the tokens that were recovered
+// from the WAL that have not expired yet.
+func newIdempotencyTokens(
+	clock Clock,
+	retention time.Duration,
+	recovered map[string]time.Time,
+) *idempotencyTokens {
+	t := &idempotencyTokens{
+		clock:     clock,
+		retention: retention,
+		seen:      map[string]*list.Element{},
+		order:     list.New(),
+		inFlight:  map[string]chan struct{}{},
+	}
+
+	// Recovered tokens are not in any particular order, insert keeps them sorted.
+	for token, seen := range recovered {
+		t.insert(token, seen)
+	}
+	t.expire()
+
+	return t
+}
+
+// Acquire waits until no other batch with the token is being applied. If the token has already
+// been seen then false is returned, otherwise done must be called once the batch has been applied
+// or has failed.
+func (t *idempotencyTokens) Acquire(token string) (done func(), ok bool) {
+	t.lock.Lock()
+	for {
+		t.expire()
+		if _, seen := t.seen[token]; seen {
+			t.lock.Unlock()
+			return nil, false
+		}
+
+		wait, applying := t.inFlight[token]
+		if !applying {
+			break
+		}
+
+		t.lock.Unlock()
+		<-wait
+		t.lock.Lock()
+	}
+
+	finished := make(chan struct{})
+	t.inFlight[token] = finished
+	t.lock.Unlock()
+
+	return func() {
+		t.lock.Lock()
+		delete(t.inFlight, token)
+		t.lock.Unlock()
+		close(finished)
+	}, true
+}
+
+// Add records that the token was seen at the time provided.
+func (t *idempotencyTokens) Add(token string, seen time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.insert(token, seen)
+	t.expire()
+}
+
+// Seen returns true if the token has been seen and has not expired.
+func (t *idempotencyTokens) Seen(token string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.expire()
+	_, ok := t.seen[token]
+
+	return ok
+}
+
+// Len returns the number of tokens that have not expired.
+func (t *idempotencyTokens) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.expire()
+
+	return len(t.seen)
+}
+
+// insert adds the token to the table, keeping order sorted by the time tokens were seen. The lock
+// must be held.
+func (t *idempotencyTokens) insert(token string, seen time.Time) {
+	if element, ok := t.seen[token]; ok {
+		t.order.Remove(element)
+	}
+
+	entry := seenToken{
+		token: token,
+		seen:  seen,
+	}
+
+	// Tokens are almost always seen in order, so the search starts from the back.
+	for element := t.order.Back(); element != nil; element = element.Prev() {
+		if !element.Value.(seenToken).seen.After(seen) {
+			t.seen[token] = t.order.InsertAfter(entry, element)
+			return
+		}
+	}
+	t.seen[token] = t.order.PushFront(entry)
+}
+
+// expire removes every token that is older than the retention. The lock must be held.
+func (t *idempotencyTokens) expire() {
+	if t.retention == 0 {
+		return
+	}
+
+	cutoff := t.clock.Now().Add(-t.retention)
+	for element := t.order.Front(); element != nil; element = t.order.Front() {
+		entry := element.Value.(seenToken)
+		if entry.seen.After(cutoff) {
+			return
+		}
+
+		t.order.Remove(element)
+		delete(t.seen, entry.token)
+	}
+}
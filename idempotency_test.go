@@ -0,0 +1,174 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDB_ApplyIfNotSeen(t *testing.T) {
+	get := func(t *testing.T, db *DB, key string) ([]byte, error) {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		item, err := txn.Get(Key(key))
+		return item.Value, err
+	}
+
+	batch := func(t *testing.T, db *DB, key, value string) *WriteBatch {
+		batch := db.NewWriteBatch()
+		assert.NoError(t, batch.Set(Key(key), []byte(value)))
+
+		return batch
+	}
+
+	t.Run("replay is ignored", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		applied, err := db.ApplyIfNotSeen([]byte("offset:1"), batch(t, db, "a", "first"))
+		assert.NoError(t, err)
+		assert.True(t, applied)
+
+		applied, err = db.ApplyIfNotSeen([]byte("offset:1"), batch(t, db, "a", "second"))
+		assert.NoError(t, err)
+		assert.False(t, applied)
+
+		value, err := get(t, db, "a")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("first"), value)
+
+		// A token with nothing to apply is still recorded.
+		applied, err = db.ApplyIfNotSeen([]byte("offset:2"), nil)
+		assert.NoError(t, err)
+		assert.True(t, applied)
+		applied, err = db.ApplyIfNotSeen([]byte("offset:2"), batch(t, db, "b", "value"))
+		assert.NoError(t, err)
+		assert.False(t, applied)
+		_, err = get(t, db, "b")
+		assert.Equal(t, ErrKeyNotFound, err)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		options := DefaultOptions()
+		options.MaxKeySize = 4
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		_, err := db.ApplyIfNotSeen(nil, nil)
+		assert.Equal(t, ErrEmptyToken, err)
+
+		_, err = db.ApplyIfNotSeen([]byte("too long"), nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("concurrent deliveries", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		var applied int32
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := db.ApplyIfNotSeen([]byte("token"), batch(t, db, "a", "value"))
+				assert.NoError(t, err)
+				if ok {
+					atomic.AddInt32(&applied, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int32(1), applied)
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		clock := NewManualClock(time.Unix(1000, 0))
+		options := DefaultOptions()
+		options.Clock = clock
+		options.IdempotencyTokenRetention = time.Minute
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		applied, err := db.ApplyIfNotSeen([]byte("old"), nil)
+		assert.NoError(t, err)
+		assert.True(t, applied)
+
+		clock.Advance(30 * time.Second)
+		applied, err = db.ApplyIfNotSeen([]byte("new"), nil)
+		assert.NoError(t, err)
+		assert.True(t, applied)
+		assert.Equal(t, 2, db.tokens.Len())
+
+		// Only the old token has expired, so it can be applied again.
+		clock.Advance(45 * time.Second)
+		assert.False(t, db.tokens.Seen("old"))
+		assert.True(t, db.tokens.Seen("new"))
+		applied, err = db.ApplyIfNotSeen([]byte("old"), nil)
+		assert.NoError(t, err)
+		assert.True(t, applied)
+		applied, err = db.ApplyIfNotSeen([]byte("new"), nil)
+		assert.NoError(t, err)
+		assert.False(t, applied)
+	})
+
+	t.Run("survives restart", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		clock := NewManualClock(time.Unix(1000, 0))
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.Clock = clock
+		options.IdempotencyTokenRetention = time.Minute
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		applied, err := db.ApplyIfNotSeen([]byte("old"), batch(t, db, "a", "value"))
+		assert.NoError(t, err)
+		assert.True(t, applied)
+		clock.Advance(45 * time.Second)
+		applied, err = db.ApplyIfNotSeen([]byte("new"), nil)
+		assert.NoError(t, err)
+		assert.True(t, applied)
+		assert.NoError(t, db.Close())
+
+		// The old token expires while the database is closed.
+		clock.Advance(30 * time.Second)
+		db, err = Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		assert.False(t, db.tokens.Seen("old"))
+		applied, err = db.ApplyIfNotSeen([]byte("new"), nil)
+		assert.NoError(t, err)
+		assert.False(t, applied)
+	})
+}
+
+func TestIdempotencyTokens(t *testing.T) {
+	t.Run("recovered out of order", func(t *testing.T) {
+		clock := NewManualClock(time.Unix(1000, 0))
+		tokens := newIdempotencyTokens(clock, time.Minute, map[string]time.Time{
+			"c": time.Unix(990, 0),
+			"a": time.Unix(945, 0),
+			"b": time.Unix(960, 0),
+			"x": time.Unix(900, 0),
+		})
+
+		// x had already expired when it was recovered.
+		assert.Equal(t, 3, tokens.Len())
+		clock.Advance(5 * time.Second)
+		assert.False(t, tokens.Seen("a"))
+		assert.True(t, tokens.Seen("b"))
+		clock.Advance(30 * time.Second)
+		assert.False(t, tokens.Seen("b"))
+		assert.True(t, tokens.Seen("c"))
+	})
+}
@@ -0,0 +1,158 @@
+package lsmtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+var (
+	// ErrUnsortedBulkLoad is returned by BulkLoad when the source returns a key that is not
+	// greater than the key before it.
+	ErrUnsortedBulkLoad = errors.New("bulk load keys are not in ascending order")
+)
+
+const (
+	// loadBatchSize is the number of bytes of keys and values that Load and Import will commit in
+	// a single transaction.
+	loadBatchSize = 1024 * 1024 /* 1mb */
+)
+
+type (
+	// ImportSource is something that keys can be read from to be imported into the database, like
+	// the data directory of another storage engine. Keys can be returned in any order, but each
+	// key should only be returned once.
+	ImportSource interface {
+		// Next returns the next key and its value. Once there are no more keys io.EOF is returned.
+		Next() (key Key, value []byte, err error)
+
+		// Close releases any resources held by the source.
+		Close() error
+	}
+
+	// batchLoader groups changes into transactions of roughly loadBatchSize bytes and commits
+	// them. This is used to load large amounts of data without building one giant transaction.
+	batchLoader struct {
+		db    *DB
+		batch []walTransactionChange
+		size  int
+	}
+)
+
+// Import reads every key from the source and sets it in the database. Keys are committed in
+// batches, so if the import fails part way through then some of the keys will already have been
+// set. The source is not closed.
+func (db *DB) Import(source ImportSource) error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	loader := &batchLoader{db: db}
+	for {
+		key, value, err := source.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if value == nil {
+			// A key that is being set must always have a non-nil value.
+			value = []byte{}
+		}
+
+		if err = loader.Add(walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   key,
+			Value: value,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return loader.Flush()
+}
+
+// Add adds the change to the current batch, if the batch is full then it will be committed.
+func (l *batchLoader) Add(change walTransactionChange) error {
+	if err := change.Validate(l.db.options.MaxKeySize, l.db.options.MaxValueSize); err != nil {
+		return err
+	}
+
+	l.batch = append(l.batch, change)
+	l.size += len(change.Key) + len(change.Value)
+
+	if l.size >= loadBatchSize || len(l.batch) == maxTransactionEntries {
+		return l.Flush()
+	}
+
+	return nil
+}
+
+// Flush commits whatever is in the current batch.
+func (l *batchLoader) Flush() error {
+	if len(l.batch) == 0 {
+		return nil
+	}
+
+	batch := l.batch
+	l.batch, l.size = make([]walTransactionChange, 0, len(batch)), 0
+
+	// Loading is bulk work, it should not get in the way of anything else writing.
+	_, err := l.db.commit(batch, WritePriorityLow)
+
+	return err
+}
+
+// BulkLoad reads every key from the source and sets it in the database, like Import, but the
+// source must return its keys in strictly ascending order. If a key is not greater than the key
+// before it then ErrUnsortedBulkLoad is returned, and every key before it has been set. The
+// source is not closed.
+//
+// Sorted input is what allows tables to be built straight from the source without going through
+// the memtable. This tree has no table writer that reads can see yet, so the keys are still
+// committed through the WAL in batches the same way Import commits them, and they are as durable
+// as any other commit.
+func (db *DB) BulkLoad(source ImportSource) error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	loader := &batchLoader{db: db}
+	var last Key
+	for {
+		key, value, err := source.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if last != nil && bytes.Compare(key, last) <= 0 {
+			// Everything before the key has been read successfully, so it is still loaded.
+			if err = loader.Flush(); err != nil {
+				return err
+			}
+
+			return fmt.Errorf("%w: %q after %q", ErrUnsortedBulkLoad, key, last)
+		}
+		last = append(last[:0], key...)
+
+		if value == nil {
+			// A key that is being set must always have a non-nil value.
+			value = []byte{}
+		}
+
+		if err = loader.Add(walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   key,
+			Value: value,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return loader.Flush()
+}
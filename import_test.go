@@ -0,0 +1,87 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+// sliceSource is an ImportSource that returns the keys it was given in order.
+type sliceSource struct {
+	keys []string
+}
+
+func (s *sliceSource) Next() (Key, []byte, error) {
+	if len(s.keys) == 0 {
+		return nil, nil, io.EOF
+	}
+
+	key := s.keys[0]
+	s.keys = s.keys[1:]
+
+	return Key(key), []byte("value-" + key), nil
+}
+
+func (s *sliceSource) Close() error {
+	return nil
+}
+
+func TestDB_BulkLoad(t *testing.T) {
+	get := func(t *testing.T, db *DB, key string) (Item, bool) {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		item, err := txn.Get(Key(key))
+		if err == ErrKeyNotFound {
+			return Item{}, false
+		}
+		assert.NoError(t, err)
+
+		return item, true
+	}
+
+	t.Run("sorted", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		source := &sliceSource{}
+		for i := 0; i < 5000; i++ {
+			source.keys = append(source.keys, fmt.Sprintf("key-%06d", i))
+		}
+		assert.NoError(t, db.BulkLoad(source))
+
+		for _, key := range []string{"key-000000", "key-002500", "key-004999"} {
+			item, ok := get(t, db, key)
+			if assert.True(t, ok, key) {
+				assert.Equal(t, []byte("value-"+key), item.Value)
+			}
+		}
+	})
+
+	t.Run("unsorted", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		err := db.BulkLoad(&sliceSource{keys: []string{"a", "c", "b", "d"}})
+		assert.True(t, errors.Is(err, ErrUnsortedBulkLoad))
+
+		// Everything before the out of order key is loaded, nothing after it is.
+		_, ok := get(t, db, "c")
+		assert.True(t, ok)
+		_, ok = get(t, db, "b")
+		assert.False(t, ok)
+		_, ok = get(t, db, "d")
+		assert.False(t, ok)
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		err := db.BulkLoad(&sliceSource{keys: []string{"a", "a"}})
+		assert.True(t, errors.Is(err, ErrUnsortedBulkLoad))
+	})
+}
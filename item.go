@@ -1,7 +1,39 @@
 package lsmtree
 
+import (
+	"time"
+)
+
+// Item represents a single version of a key in the database.
 type Item struct {
-	Key     Key
-	Value   []byte
+	Key Key
+
+	// Value is the value stored for the key. A key that has been set to an empty value will have
+	// an empty, non-nil value. Value will only be nil if the key has been deleted.
+	Value []byte
+
+	// UserMeta is the metadata byte that was stored alongside the value when it was set.
+	UserMeta byte
+
 	Version uint64
+
+	// ExpiresAt is the unix time in seconds when the value expires, or 0 if it never expires.
+	ExpiresAt uint64
+}
+
+// IsDeleted returns true if this version of the key is a delete.
+func (i Item) IsDeleted() bool {
+	return i.Value == nil
+}
+
+// IsExpired returns true if the value has expired at the time provided. An expired value is
+// treated the same as a deleted one.
+func (i Item) IsExpired(now time.Time) bool {
+	return isExpired(i.ExpiresAt, now)
+}
+
+// isExpired returns true if a value that expires at the unix time in seconds has expired at the
+// time provided.
+func isExpired(expiresAt uint64, now time.Time) bool {
+	return expiresAt != 0 && expiresAt <= uint64(now.Unix())
 }
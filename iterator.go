@@ -1,7 +1,426 @@
 package lsmtree
 
+import (
+	"bytes"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Itr iterates over keys in ascending order. It is implemented by Iterator, and is what an Engine
+// returns so that a mock engine can return its own iterator.
 type Itr interface {
+	// Rewind moves the iterator to the first key.
+	Rewind()
+
+	// Seek moves the iterator to the first key that is greater than or equal to the key provided.
 	Seek(prefix []byte)
+
+	// Next moves the iterator to the next key.
 	Next()
+
+	// Valid returns true if the iterator is positioned on a key.
+	Valid() bool
+
+	// Item returns the key that the iterator is positioned on.
 	Item() Item
+
+	// SetBounds changes the lower and upper bound of the iterator, see Iterator.SetBounds.
+	SetBounds(lower, upper Key)
+
+	// Reset reuses the iterator with new options, see Iterator.Reset.
+	Reset(options IteratorOptions) error
+
+	// Close releases the iterator.
+	Close()
+}
+
+var (
+	_ Itr = &Iterator{}
+
+	// iteratorPool keeps closed iterators around to be reused. The merging iterator and the
+	// memtable iterator are part of the Iterator, so a scan that gets its iterator from the pool
+	// does not allocate them, or the slices they use, again.
+	iteratorPool = sync.Pool{
+		New: func() interface{} {
+			return &Iterator{}
+		},
+	}
+)
+
+type (
+	// IteratorOptions change which keys are returned by an Iterator.
+	IteratorOptions struct {
+		// Prefix limits the iterator to keys that start with the prefix. If this is empty then
+		// every key is returned.
+		Prefix Key
+
+		// ReadOptions change how the keys are read. The iterator does not add anything to the
+		// caches, so ReadOptions.DisableCacheFill makes no difference to it.
+		ReadOptions ReadOptions
+
+		// LargeScan marks the iterator as a scan over a large part of the database, like an
+		// analytics job or an export. Iterators only read the memtable, which has no cache or
+		// readahead to protect, so this currently does nothing. Once heap files are read it is
+		// meant to keep a large scan from evicting the blocks that point reads use.
+		// Default is false.
+		LargeScan bool
+
+		// LowerBound limits the iterator to keys that are greater than or equal to it, and
+		// UpperBound to keys that are less than it. Either of them can be nil for no bound. They
+		// are combined with Prefix, a key has to be within both to be returned.
+		LowerBound Key
+		UpperBound Key
+
+		// Predicate is called with each key that would be returned, before its value is copied
+		// out of the database. Keys that it returns false for are skipped, so a query layer can
+		// filter rows without paying for the ones that do not match. The value and the key are
+		// only valid until the predicate returns and must not be modified. Deleted and expired
+		// keys are skipped before the predicate is called.
+		// Default is nil, every key is returned.
+		Predicate ScanPredicate
+	}
+
+	// ScanPredicate decides whether a key is returned by an Iterator, see
+	// IteratorOptions.Predicate.
+	ScanPredicate func(key Key, value []byte, userMeta byte) bool
+
+	// Iterator returns the newest version of each key that is visible to a transaction in
+	// ascending order. Keys that have been deleted are skipped. Changes that the transaction had
+	// made when the iterator was created are included, changes made after that are not.
+	Iterator struct {
+		// timestamp is the timestamp that the iterator reads at, see ReadOptions.Snapshot.
+		timestamp uint64
+
+		// now is when the iterator was created, values that have expired by then are skipped.
+		now time.Time
+
+		// merged iterates over every version of every key within the bounds, from every source of
+		// keys. Heap files are not read yet, so memtable is its only child.
+		merged   mergingIterator
+		memtable memtableIterator
+
+		// prefix is IteratorOptions.Prefix, it is combined with the bounds passed to SetBounds.
+		prefix Key
+
+		// changes are all of the changes the transaction had made when the iterator was created,
+		// sorted by key. pending are the ones within the bounds, and pendingIndex is the next
+		// pending change that has not been returned.
+		changes      []walTransactionChange
+		pending      []walTransactionChange
+		pendingIndex int
+
+		// candidate is the next key from merged that is visible to the transaction, or
+		// nil if there are no more. skipKey is a key that has already been returned, any other
+		// versions of it are skipped.
+		candidate      Key
+		candidateEntry memtableEntry
+		candidateTs    uint64
+		skipKey        Key
+
+		// predicate is IteratorOptions.Predicate.
+		predicate ScanPredicate
+
+		item  Item
+		valid bool
+
+		// txn is the transaction that the iterator reads from. If ownsTxn is true then the
+		// iterator was created by DB.NewIterator, which creates a transaction just for the
+		// iterator, and the transaction is discarded when the iterator is closed or reset.
+		txn     *Txn
+		ownsTxn bool
+	}
+)
+
+// NewIterator creates an iterator over the keys that are visible to the transaction. The iterator
+// is not positioned on anything until Rewind or Seek is called, and it must be closed once it is no
+// longer needed.
+func (t *Txn) NewIterator(options IteratorOptions) (*Iterator, error) {
+	iterator := iteratorPool.Get().(*Iterator)
+	if err := iterator.init(t, options); err != nil {
+		iteratorPool.Put(iterator)
+		return nil, err
+	}
+
+	return iterator, nil
+}
+
+// Reset reuses the iterator for a new scan with the options provided, instead of closing it and
+// creating a new one. An iterator created by Txn.NewIterator keeps reading from the same
+// transaction, including any changes it has made since. An iterator created by DB.NewIterator
+// discards its transaction and reads from a new one, so it sees everything that was committed
+// before Reset was called. The iterator is not positioned on anything until Rewind or Seek is
+// called. If an error is returned the iterator still has its old options and must still be closed.
+func (i *Iterator) Reset(options IteratorOptions) error {
+	if !i.ownsTxn {
+		return i.init(i.txn, options)
+	}
+
+	txn, err := i.txn.db.NewTransaction(TxnOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+
+	if err := i.init(txn, options); err != nil {
+		txn.Discard()
+		return err
+	}
+
+	i.txn.Discard()
+	i.txn = txn
+
+	return nil
+}
+
+// init sets the iterator up to read from the transaction with the options provided. The slices
+// from the last time the iterator was used are reused.
+func (i *Iterator) init(t *Txn, options IteratorOptions) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	timestamp, err := t.readTimestampFor(options.ReadOptions)
+	if err != nil {
+		return err
+	}
+
+	if !i.ownsTxn {
+		i.txn = t
+	}
+	i.timestamp = timestamp
+	i.now = t.db.options.Clock.Now()
+	i.prefix = options.Prefix
+	i.predicate = options.Predicate
+	i.item, i.valid = Item{}, false
+
+	i.memtable = memtableIterator{
+		memtable: t.db.memtable,
+	}
+	i.merged.Reset(&i.memtable)
+
+	i.changes = append(i.changes[:0], t.changes...)
+	sort.Slice(i.changes, func(a, b int) bool {
+		return bytes.Compare(i.changes[a].Key, i.changes[b].Key) < 0
+	})
+	i.setBounds(getIteratorBounds(options))
+
+	return nil
+}
+
+// SetBounds replaces IteratorOptions.LowerBound and IteratorOptions.UpperBound, the new bounds are
+// still combined with the prefix the iterator was created with. The bounds are pushed down into
+// every source of keys so that nothing outside of them is read. This way a single iterator can be
+// reused to scan many ranges, it is not positioned on anything until Rewind or Seek is called
+// again.
+func (i *Iterator) SetBounds(lower, upper Key) {
+	i.setBounds(getIteratorBounds(IteratorOptions{
+		Prefix:     i.prefix,
+		LowerBound: lower,
+		UpperBound: upper,
+	}))
+	i.valid = false
+}
+
+// setBounds pushes the bounds down into merged and picks the changes of the transaction that are
+// within them.
+func (i *Iterator) setBounds(lower, upper []byte) {
+	i.merged.SetBounds(lower, upper)
+
+	start := sort.Search(len(i.changes), func(n int) bool {
+		return bytes.Compare(i.changes[n].Key, lower) >= 0
+	})
+	end := len(i.changes)
+	if upper != nil {
+		end = sort.Search(len(i.changes), func(n int) bool {
+			return bytes.Compare(i.changes[n].Key, upper) >= 0
+		})
+	}
+	if end < start {
+		end = start
+	}
+
+	i.pending = i.changes[start:end]
+	i.pendingIndex = 0
+}
+
+// Rewind moves the iterator to the first key.
+func (i *Iterator) Rewind() {
+	i.merged.SeekToFirst()
+	i.pendingIndex = 0
+	i.reset()
+}
+
+// Seek moves the iterator to the first key that is greater than or equal to the key provided.
+func (i *Iterator) Seek(key []byte) {
+	// The newest possible version of the key sorts before every other version of it.
+	i.merged.Seek(newTimestampedKey(key, math.MaxUint64))
+	i.pendingIndex = sort.Search(len(i.pending), func(n int) bool {
+		return bytes.Compare(i.pending[n].Key, key) >= 0
+	})
+	i.reset()
+}
+
+// Next moves the iterator to the next key.
+func (i *Iterator) Next() {
+	if i.valid {
+		i.advance()
+	}
+}
+
+// Valid returns true if the iterator is positioned on a key.
+func (i *Iterator) Valid() bool {
+	return i.valid
+}
+
+// Item returns the key that the iterator is positioned on. The item can be kept after the iterator
+// has been moved.
+func (i *Iterator) Item() Item {
+	return i.item
+}
+
+// Close releases the iterator and returns it to the pool, it cannot be used after it has been
+// closed. Items that it returned can still be used.
+func (i *Iterator) Close() {
+	if i.txn == nil {
+		return
+	}
+
+	i.merged.Close()
+	if i.ownsTxn {
+		i.txn.Discard()
+	}
+
+	// Make sure the pool is not keeping the transaction or any of its changes alive.
+	for n := range i.changes {
+		i.changes[n] = walTransactionChange{}
+	}
+	*i = Iterator{
+		merged:  i.merged,
+		changes: i.changes[:0],
+	}
+	iteratorPool.Put(i)
+}
+
+// reset clears any state from the previous position and moves to the first key from the current
+// position of merged and the pending changes.
+func (i *Iterator) reset() {
+	i.skipKey = nil
+	i.fillCandidate()
+	i.advance()
+}
+
+// advance moves to the next key that has not been deleted.
+func (i *Iterator) advance() {
+	for {
+		var pending *walTransactionChange
+		if i.pendingIndex < len(i.pending) {
+			pending = &i.pending[i.pendingIndex]
+		}
+
+		if pending == nil && i.candidate == nil {
+			i.valid = false
+			return
+		}
+
+		// The transaction's own change to a key always replaces what is in the database.
+		var c int
+		switch {
+		case pending == nil:
+			c = 1
+		case i.candidate == nil:
+			c = -1
+		default:
+			c = bytes.Compare(pending.Key, i.candidate)
+		}
+
+		var entry memtableEntry
+		var key TimestampedKey
+		if c <= 0 {
+			entry = memtableEntry{
+				Type:      pending.Type,
+				Value:     pending.Value,
+				UserMeta:  pending.UserMeta,
+				ExpiresAt: pending.ExpiresAt,
+			}
+			key = newTimestampedKey(pending.Key, i.timestamp)
+			i.pendingIndex++
+		}
+
+		if c >= 0 {
+			if c > 0 {
+				entry, key = i.candidateEntry, newTimestampedKey(i.candidate, i.candidateTs)
+			}
+
+			// Every other version of the key needs to be skipped.
+			i.skipKey = append(i.skipKey[:0], i.candidate...)
+			i.merged.Next()
+			i.fillCandidate()
+		}
+
+		if entry.Type != walTransactionChangeTypeSet || isExpired(entry.ExpiresAt, i.now) {
+			continue
+		}
+
+		// The predicate sees the value where it is stored, it is only copied if the key matches.
+		if i.predicate == nil || i.predicate(key.Key(), entry.Value, entry.UserMeta) {
+			i.item = entry.Item(key)
+			i.valid = true
+			return
+		}
+	}
+}
+
+// fillCandidate moves merged to the next version that is visible to the transaction and is not a
+// version of the key that was just returned.
+func (i *Iterator) fillCandidate() {
+	for ; i.merged.Valid(); i.merged.Next() {
+		key := TimestampedKey(i.merged.Key())
+		if key.Timestamp() > i.timestamp ||
+			(i.skipKey != nil && bytes.Equal(key.Key(), i.skipKey)) {
+			continue
+		}
+
+		i.candidate = append(i.candidate[:0], key.Key()...)
+		i.candidateEntry = i.merged.Entry()
+		i.candidateTs = key.Timestamp()
+		return
+	}
+
+	i.candidate = nil
+}
+
+// getPrefixBounds returns the lower and upper bound of the keys that start with the prefix. The
+// upper bound is nil if there is no key that is greater than every key with the prefix.
+func getPrefixBounds(prefix []byte) (lower, upper []byte) {
+	if len(prefix) == 0 {
+		return nil, nil
+	}
+
+	lower = prefix
+	for n := len(prefix) - 1; n >= 0; n-- {
+		if prefix[n] != 0xff {
+			upper = append(append([]byte{}, prefix[:n]...), prefix[n]+1)
+			break
+		}
+	}
+
+	return lower, upper
+}
+
+// getIteratorBounds returns the lower and upper bound of the keys that are within both the prefix
+// and the bounds of the options. Either bound is nil if there is no bound.
+func getIteratorBounds(options IteratorOptions) (lower, upper []byte) {
+	lower, upper = getPrefixBounds(options.Prefix)
+	if options.LowerBound != nil && bytes.Compare(options.LowerBound, lower) > 0 {
+		lower = options.LowerBound
+	}
+	if options.UpperBound != nil && (upper == nil || bytes.Compare(options.UpperBound, upper) < 0) {
+		upper = options.UpperBound
+	}
+
+	return lower, upper
 }
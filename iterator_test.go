@@ -0,0 +1,294 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	// collect returns every key from the current position of the iterator with its value.
+	collect := func(iterator *Iterator) []string {
+		var keys []string
+		for ; iterator.Valid(); iterator.Next() {
+			keys = append(keys, string(iterator.Item().Key)+"="+string(iterator.Item().Value))
+		}
+		return keys
+	}
+
+	db, cleanup := newTestDB(t, DefaultOptions())
+	defer cleanup()
+
+	set := func(pairs ...string) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		for i := 0; i < len(pairs); i += 2 {
+			if pairs[i+1] == "" {
+				assert.NoError(t, txn.Delete(Key(pairs[i])))
+				continue
+			}
+			assert.NoError(t, txn.Set(Key(pairs[i]), []byte(pairs[i+1])))
+		}
+		assert.NoError(t, txn.Commit())
+	}
+
+	set("a", "1", "b", "1", "c", "1", "d", "1")
+	set("b", "2", "c", "")
+
+	t.Run("newest versions", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		iterator, err := txn.NewIterator(IteratorOptions{})
+		assert.NoError(t, err)
+		defer iterator.Close()
+
+		assert.False(t, iterator.Valid())
+		iterator.Rewind()
+		assert.Equal(t, []string{"a=1", "b=2", "d=1"}, collect(iterator))
+
+		iterator.Seek([]byte("bb"))
+		assert.Equal(t, []string{"d=1"}, collect(iterator))
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		// Changes committed after the transaction started should not be visible.
+		set("a", "", "e", "1")
+
+		iterator, err := txn.NewIterator(IteratorOptions{})
+		assert.NoError(t, err)
+		defer iterator.Close()
+
+		iterator.Rewind()
+		assert.Equal(t, []string{"a=1", "b=2", "d=1"}, collect(iterator))
+	})
+
+	t.Run("pending changes", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		assert.NoError(t, txn.Set(Key("c"), []byte("3")))
+		assert.NoError(t, txn.Delete(Key("d")))
+		assert.NoError(t, txn.Set(Key("0"), []byte("3")))
+		assert.NoError(t, txn.Set(Key("b"), []byte("3")))
+		assert.NoError(t, txn.Set(Key("z"), []byte("3")))
+
+		iterator, err := txn.NewIterator(IteratorOptions{})
+		assert.NoError(t, err)
+		defer iterator.Close()
+
+		iterator.Rewind()
+		assert.Equal(t, []string{"0=3", "b=3", "c=3", "e=1", "z=3"}, collect(iterator))
+
+		iterator.Seek([]byte("c"))
+		assert.Equal(t, []string{"c=3", "e=1", "z=3"}, collect(iterator))
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		set("user:1", "a", "user:2", "b", "user;", "c", "users", "d")
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		defer txn.Discard()
+		assert.NoError(t, txn.Set(Key("user:0"), []byte("e")))
+		assert.NoError(t, txn.Set(Key("zzz"), []byte("f")))
+
+		iterator, err := txn.NewIterator(IteratorOptions{Prefix: Key("user:")})
+		assert.NoError(t, err)
+		defer iterator.Close()
+
+		iterator.Rewind()
+		assert.Equal(t, []string{"user:0=e", "user:1=a", "user:2=b"}, collect(iterator))
+
+		// Seeking before the prefix should start at the prefix.
+		iterator.Seek([]byte("a"))
+		assert.Equal(t, []string{"user:0=e", "user:1=a", "user:2=b"}, collect(iterator))
+	})
+
+	t.Run("bounds", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		defer txn.Discard()
+		assert.NoError(t, txn.Set(Key("c"), []byte("3")))
+		assert.NoError(t, txn.Set(Key("zzz"), []byte("3")))
+
+		iterator, err := txn.NewIterator(IteratorOptions{
+			LowerBound: Key("b"),
+			UpperBound: Key("user:2"),
+		})
+		assert.NoError(t, err)
+		defer iterator.Close()
+
+		iterator.Rewind()
+		assert.Equal(t, []string{"b=2", "c=3", "d=1", "e=1", "user:1=a"}, collect(iterator))
+
+		iterator.Seek([]byte("a"))
+		assert.Equal(t, []string{"b=2", "c=3", "d=1", "e=1", "user:1=a"}, collect(iterator))
+
+		// The bounds are combined with the prefix.
+		iterator, err = txn.NewIterator(IteratorOptions{
+			Prefix:     Key("user"),
+			LowerBound: Key("user:2"),
+		})
+		assert.NoError(t, err)
+		defer iterator.Close()
+
+		iterator.Rewind()
+		assert.Equal(t, []string{"user:2=b", "user;=c", "users=d"}, collect(iterator))
+	})
+
+	t.Run("set bounds", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		defer txn.Discard()
+		assert.NoError(t, txn.Set(Key("c"), []byte("3")))
+		assert.NoError(t, txn.Set(Key("user:0"), []byte("e")))
+
+		iterator, err := txn.NewIterator(IteratorOptions{Prefix: Key("user")})
+		assert.NoError(t, err)
+		defer iterator.Close()
+
+		iterator.Rewind()
+		assert.Equal(t, []string{"user:0=e", "user:1=a", "user:2=b", "user;=c", "users=d"},
+			collect(iterator))
+
+		// The iterator is not positioned until it is rewound, and the new bounds are still
+		// combined with the prefix.
+		iterator.SetBounds(Key("a"), Key("user:2"))
+		assert.False(t, iterator.Valid())
+		iterator.Rewind()
+		assert.Equal(t, []string{"user:0=e", "user:1=a"}, collect(iterator))
+
+		iterator.SetBounds(Key("user:2"), nil)
+		iterator.Seek([]byte("a"))
+		assert.Equal(t, []string{"user:2=b", "user;=c", "users=d"}, collect(iterator))
+
+		// Bounds that do not overlap return nothing.
+		iterator.SetBounds(Key("user:2"), Key("user:1"))
+		iterator.Rewind()
+		assert.Empty(t, collect(iterator))
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		iterator, err := txn.NewIterator(IteratorOptions{Prefix: Key("user:")})
+		assert.NoError(t, err)
+		defer iterator.Close()
+
+		iterator.Rewind()
+		assert.Equal(t, []string{"user:1=a", "user:2=b"}, collect(iterator))
+
+		// The iterator keeps reading from the transaction, including changes made since it was
+		// created, with the new options.
+		assert.NoError(t, txn.Set(Key("user;"), []byte("x")))
+		assert.NoError(t, iterator.Reset(IteratorOptions{LowerBound: Key("user:2")}))
+		assert.False(t, iterator.Valid())
+		iterator.Rewind()
+		assert.Equal(t, []string{"user:2=b", "user;=x", "users=d"}, collect(iterator))
+	})
+
+	t.Run("reset db iterator", func(t *testing.T) {
+		itr, err := db.NewIterator(IteratorOptions{Prefix: Key("reset")})
+		assert.NoError(t, err)
+		defer itr.Close()
+
+		itr.Rewind()
+		assert.False(t, itr.Valid())
+
+		// A new transaction is used, so keys committed since the iterator was created are seen.
+		set("reset", "1")
+		assert.NoError(t, itr.Reset(IteratorOptions{Prefix: Key("reset")}))
+		itr.Rewind()
+		assert.True(t, itr.Valid())
+		assert.Equal(t, "1", string(itr.Item().Value))
+	})
+
+	t.Run("predicate", func(t *testing.T) {
+		set("user:3", "x")
+		set("user:3", "")
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		defer txn.Discard()
+		assert.NoError(t, txn.Set(Key("user:4"), []byte("d")))
+
+		var called []string
+		iterator, err := txn.NewIterator(IteratorOptions{
+			Prefix: Key("user"),
+			Predicate: func(key Key, value []byte, userMeta byte) bool {
+				called = append(called, string(key))
+				return string(value) != "b" && string(value) != "d"
+			},
+		})
+		assert.NoError(t, err)
+		defer iterator.Close()
+
+		iterator.Rewind()
+		assert.Equal(t, []string{"user:1=a", "user;=c"}, collect(iterator))
+
+		// Deleted keys are skipped before the predicate is called.
+		assert.Equal(t, []string{"user:1", "user:2", "user:4", "user;", "users"}, called)
+	})
+
+	t.Run("discarded", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		txn.Discard()
+
+		_, err = txn.NewIterator(IteratorOptions{})
+		assert.Equal(t, ErrTxnDiscarded, err)
+	})
+}
+
+func TestGetPrefixBounds(t *testing.T) {
+	lower, upper := getPrefixBounds(nil)
+	assert.Nil(t, lower)
+	assert.Nil(t, upper)
+
+	lower, upper = getPrefixBounds([]byte("abc"))
+	assert.Equal(t, []byte("abc"), lower)
+	assert.Equal(t, []byte("abd"), upper)
+
+	lower, upper = getPrefixBounds([]byte{0x01, 0xff})
+	assert.Equal(t, []byte{0x01, 0xff}, lower)
+	assert.Equal(t, []byte{0x02}, upper)
+
+	_, upper = getPrefixBounds([]byte{0xff, 0xff})
+	assert.Nil(t, upper)
+}
+
+func TestGetIteratorBounds(t *testing.T) {
+	lower, upper := getIteratorBounds(IteratorOptions{})
+	assert.Nil(t, lower)
+	assert.Nil(t, upper)
+
+	lower, upper = getIteratorBounds(IteratorOptions{
+		Prefix:     Key("abc"),
+		LowerBound: Key("abc1"),
+		UpperBound: Key("b"),
+	})
+	assert.Equal(t, []byte("abc1"), lower)
+	assert.Equal(t, []byte("abd"), upper)
+
+	lower, upper = getIteratorBounds(IteratorOptions{
+		Prefix:     Key("abc"),
+		LowerBound: Key("a"),
+		UpperBound: Key("abc5"),
+	})
+	assert.Equal(t, []byte("abc"), lower)
+	assert.Equal(t, []byte("abc5"), upper)
+
+	_, upper = getIteratorBounds(IteratorOptions{
+		Prefix:     []byte{0xff},
+		UpperBound: Key("z"),
+	})
+	assert.Equal(t, []byte("z"), upper)
+}
@@ -1,5 +1,11 @@
 package lsmtree
 
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
 type (
 	// TimestampedKey represents a byte array that will always have an 8 byte suffix to indicate the
 	// transactionId for the item. This is used to implement MVCC.
@@ -9,3 +15,33 @@ type (
 	// transactionId for the item.
 	Key []byte
 )
+
+// newTimestampedKey appends the timestamp to the key. The timestamp is stored inverted so that
+// newer versions of a key are sorted before older versions.
+func newTimestampedKey(key Key, timestamp uint64) TimestampedKey {
+	timestamped := make(TimestampedKey, len(key)+8)
+	copy(timestamped, key)
+	binary.BigEndian.PutUint64(timestamped[len(key):], math.MaxUint64-timestamp)
+	return timestamped
+}
+
+// Key returns the key without the timestamp suffix.
+func (k TimestampedKey) Key() Key {
+	return Key(k[:len(k)-8])
+}
+
+// Timestamp returns the timestamp that the version of the key was written at.
+func (k TimestampedKey) Timestamp() uint64 {
+	return math.MaxUint64 - binary.BigEndian.Uint64(k[len(k)-8:])
+}
+
+// compareTimestampedKeys orders keys ascending, and versions of the same key from newest to
+// oldest. The keys cannot simply be compared as bytes since a key that is a prefix of another key
+// would be compared against the other key's timestamp.
+func compareTimestampedKeys(a, b TimestampedKey) int {
+	if c := bytes.Compare(a.Key(), b.Key()); c != 0 {
+		return c
+	}
+
+	return bytes.Compare(a[len(a)-8:], b[len(b)-8:])
+}
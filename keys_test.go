@@ -0,0 +1,36 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestTimestampedKey(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		for _, timestamp := range []uint64{0, 1, 1234, math.MaxUint64} {
+			key := newTimestampedKey(Key("key"), timestamp)
+			assert.Equal(t, Key("key"), key.Key())
+			assert.Equal(t, timestamp, key.Timestamp())
+		}
+	})
+
+	t.Run("ordering", func(t *testing.T) {
+		ordered := []TimestampedKey{
+			newTimestampedKey(Key("a"), 10),
+			newTimestampedKey(Key("a"), 5),
+			newTimestampedKey(Key("a\x00"), math.MaxUint64),
+			newTimestampedKey(Key("ab"), 20),
+			newTimestampedKey(Key("ab"), 1),
+			newTimestampedKey(Key("b"), 100),
+		}
+
+		for i := range ordered {
+			assert.Equal(t, 0, compareTimestampedKeys(ordered[i], ordered[i]))
+			for j := i + 1; j < len(ordered); j++ {
+				assert.Equal(t, -1, compareTimestampedKeys(ordered[i], ordered[j]), "%d < %d", i, j)
+				assert.Equal(t, 1, compareTimestampedKeys(ordered[j], ordered[i]), "%d > %d", j, i)
+			}
+		}
+	})
+}
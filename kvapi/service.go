@@ -0,0 +1,328 @@
+// Package kvapi implements the requests a key value node built on a single database answers: Get,
+// Put, Delete, BatchWrite, a streaming Scan, and the Backup and Metrics admin requests.
+//
+// This package does not include a network transport. Server is plain Go so that the database does
+// not depend on any RPC framework, a deployment serves it over whichever transport it uses by
+// decoding requests into these types and passing each ScanResponse to its stream. The RESP server
+// in cmd/lsmserver is the transport that is included with the database.
+package kvapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/elliotcourant/lsmtree"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrBackupsDisabled is returned by Backup when the server was created without a backup
+	// directory.
+	ErrBackupsDisabled = errors.New("backups are disabled")
+
+	// ErrInvalidArgument is returned when a request is missing a required field or has a field
+	// that is not valid.
+	ErrInvalidArgument = errors.New("invalid argument")
+)
+
+const (
+	// OperationPut sets the value of a key in a BatchWrite.
+	OperationPut OperationType = 0
+
+	// OperationDelete removes a key in a BatchWrite.
+	OperationDelete OperationType = 1
+)
+
+type (
+	// OperationType is the kind of change an Operation makes.
+	OperationType int32
+
+	GetRequest struct {
+		Key []byte
+	}
+
+	GetResponse struct {
+		Value     []byte
+		Found     bool
+		Timestamp uint64
+	}
+
+	PutRequest struct {
+		Key   []byte
+		Value []byte
+	}
+
+	PutResponse struct{}
+
+	DeleteRequest struct {
+		Key []byte
+	}
+
+	DeleteResponse struct{}
+
+	// Operation is a single change within a BatchWrite.
+	Operation struct {
+		Type  OperationType
+		Key   []byte
+		Value []byte
+	}
+
+	BatchWriteRequest struct {
+		Operations []Operation
+	}
+
+	BatchWriteResponse struct{}
+
+	ScanRequest struct {
+		// Prefix limits the scan to keys that start with it.
+		Prefix []byte
+
+		// Start is the first key to return, keys before it are skipped.
+		Start []byte
+
+		// Limit is the largest number of keys to return, 0 returns every key.
+		Limit uint64
+
+		// KeysOnly leaves the values out of the responses.
+		KeysOnly bool
+	}
+
+	ScanResponse struct {
+		Key       []byte
+		Value     []byte
+		Timestamp uint64
+	}
+
+	// ScanStream is where a Scan sends its responses, it is implemented by the transport.
+	ScanStream interface {
+		Send(response *ScanResponse) error
+		Context() context.Context
+	}
+
+	BackupRequest struct {
+		// Name is the name of the file to create in the backup directory, it cannot contain a
+		// path separator.
+		Name string
+	}
+
+	BackupResponse struct {
+		Size uint64
+	}
+
+	MetricsRequest struct{}
+
+	MetricsResponse struct {
+		WALTransactionsAppended uint64
+		WALTransactionsSynced   uint64
+		PendingWrites           uint64
+	}
+
+	// Server implements the KV service on top of a single database.
+	Server struct {
+		db *lsmtree.DB
+
+		// backupDirectory is where Backup writes dumps. Backups are disabled if this is empty.
+		backupDirectory string
+	}
+)
+
+// NewServer creates a server for the database. Backups are written to the backup directory, if it
+// is empty then Backup returns ErrBackupsDisabled.
+func NewServer(db *lsmtree.DB, backupDirectory string) *Server {
+	return &Server{
+		db:              db,
+		backupDirectory: backupDirectory,
+	}
+}
+
+// Get returns the newest version of a key.
+func (s *Server) Get(ctx context.Context, request *GetRequest) (*GetResponse, error) {
+	if len(request.Key) == 0 {
+		return nil, fmt.Errorf("%w: key is required", ErrInvalidArgument)
+	}
+
+	txn, err := s.db.NewTransaction(lsmtree.TxnOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Discard()
+
+	item, err := txn.Get(request.Key)
+	if err == lsmtree.ErrKeyNotFound {
+		return &GetResponse{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &GetResponse{
+		Value:     item.Value,
+		Found:     true,
+		Timestamp: item.Version,
+	}, nil
+}
+
+// Put sets the value of a key.
+func (s *Server) Put(ctx context.Context, request *PutRequest) (*PutResponse, error) {
+	err := s.write(ctx, []Operation{{Type: OperationPut, Key: request.Key, Value: request.Value}})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PutResponse{}, nil
+}
+
+// Delete removes a key.
+func (s *Server) Delete(ctx context.Context, request *DeleteRequest) (*DeleteResponse, error) {
+	if err := s.write(ctx, []Operation{{Type: OperationDelete, Key: request.Key}}); err != nil {
+		return nil, err
+	}
+
+	return &DeleteResponse{}, nil
+}
+
+// BatchWrite applies every operation in a single transaction, either all of them are applied or
+// none of them are.
+func (s *Server) BatchWrite(
+	ctx context.Context, request *BatchWriteRequest,
+) (*BatchWriteResponse, error) {
+	if err := s.write(ctx, request.Operations); err != nil {
+		return nil, err
+	}
+
+	return &BatchWriteResponse{}, nil
+}
+
+// write applies the operations in a single transaction.
+func (s *Server) write(ctx context.Context, operations []Operation) error {
+	txn, err := s.db.NewTransaction(lsmtree.TxnOptions{})
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+
+	for i, operation := range operations {
+		if len(operation.Key) == 0 {
+			return fmt.Errorf("%w: operation %d is missing a key", ErrInvalidArgument, i)
+		}
+
+		switch operation.Type {
+		case OperationPut:
+			err = txn.Set(operation.Key, operation.Value)
+		case OperationDelete:
+			err = txn.Delete(operation.Key)
+		default:
+			err = fmt.Errorf("%w: operation %d has unknown type %d",
+				ErrInvalidArgument, i, operation.Type)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The client may have given up while we were building the transaction, there is no reason to
+	// commit it if nobody is waiting for the result.
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// Scan sends keys in ascending order from a consistent snapshot of the database. The scan stops
+// early if the client cancels the stream.
+func (s *Server) Scan(request *ScanRequest, stream ScanStream) error {
+	txn, err := s.db.NewTransaction(lsmtree.TxnOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+
+	iterator, err := txn.NewIterator(lsmtree.IteratorOptions{Prefix: request.Prefix})
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	ctx := stream.Context()
+	sent := uint64(0)
+	for iterator.Seek(request.Start); iterator.Valid(); iterator.Next() {
+		if request.Limit > 0 && sent >= request.Limit {
+			break
+		}
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		item := iterator.Item()
+		response := &ScanResponse{
+			Key:       item.Key,
+			Timestamp: item.Version,
+		}
+		if !request.KeysOnly {
+			response.Value = item.Value
+		}
+
+		if err = stream.Send(response); err != nil {
+			return err
+		}
+		sent++
+	}
+
+	return nil
+}
+
+// Backup writes a dump of the database to a file in the backup directory. The dump is written to
+// a temporary file first and only renamed once it is complete, so a backup that fails part way
+// through never leaves behind something that looks like a complete backup.
+func (s *Server) Backup(ctx context.Context, request *BackupRequest) (*BackupResponse, error) {
+	if s.backupDirectory == "" {
+		return nil, ErrBackupsDisabled
+	}
+
+	name := request.Name
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("%w: backup name %q is not valid", ErrInvalidArgument, name)
+	}
+
+	file, err := ioutil.TempFile(s.backupDirectory, "."+name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	temporaryPath := file.Name()
+	if err = s.db.Dump(file); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Stat(temporaryPath)
+	}
+	if err == nil {
+		err = os.Rename(temporaryPath, filepath.Join(s.backupDirectory, name))
+	}
+	if err != nil {
+		_ = os.Remove(temporaryPath)
+		return nil, err
+	}
+
+	return &BackupResponse{Size: uint64(info.Size())}, nil
+}
+
+// Metrics returns the database's counters.
+func (s *Server) Metrics(ctx context.Context, request *MetricsRequest) (*MetricsResponse, error) {
+	metrics := s.db.Metrics()
+
+	return &MetricsResponse{
+		WALTransactionsAppended: metrics.WALTransactionsAppended,
+		WALTransactionsSynced:   metrics.WALTransactionsSynced,
+		PendingWrites:           uint64(metrics.PendingWrites),
+	}, nil
+}
@@ -0,0 +1,167 @@
+package kvapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/elliotcourant/lsmtree"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testScanStream struct {
+	ctx       context.Context
+	responses []*ScanResponse
+}
+
+func (s *testScanStream) Send(response *ScanResponse) error {
+	s.responses = append(s.responses, response)
+	return nil
+}
+
+func (s *testScanStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testScanStream) Keys() []string {
+	keys := make([]string, len(s.responses))
+	for i, response := range s.responses {
+		keys[i] = string(response.Key)
+	}
+	return keys
+}
+
+func newTestServer(t *testing.T) (*Server, *lsmtree.DB, string, func()) {
+	directory, err := ioutil.TempDir("", "kvapi")
+	assert.NoError(t, err)
+
+	backups := filepath.Join(directory, "backups")
+	assert.NoError(t, os.Mkdir(backups, 0700))
+
+	options := lsmtree.DefaultOptions()
+	options.DataDirectory = filepath.Join(directory, "data")
+	options.WALDirectory = filepath.Join(directory, "data")
+	db, err := lsmtree.Open(options)
+	assert.NoError(t, err)
+
+	return NewServer(db, backups), db, backups, func() {
+		assert.NoError(t, db.Close())
+		_ = os.RemoveAll(directory)
+	}
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	server, db, backups, cleanup := newTestServer(t)
+	defer cleanup()
+
+	t.Run("get put delete", func(t *testing.T) {
+		response, err := server.Get(ctx, &GetRequest{Key: []byte("a")})
+		assert.NoError(t, err)
+		assert.False(t, response.Found)
+
+		_, err = server.Put(ctx, &PutRequest{Key: []byte("a"), Value: []byte("1")})
+		assert.NoError(t, err)
+
+		response, err = server.Get(ctx, &GetRequest{Key: []byte("a")})
+		assert.NoError(t, err)
+		assert.True(t, response.Found)
+		assert.Equal(t, []byte("1"), response.Value)
+		assert.NotZero(t, response.Timestamp)
+
+		_, err = server.Delete(ctx, &DeleteRequest{Key: []byte("a")})
+		assert.NoError(t, err)
+
+		response, err = server.Get(ctx, &GetRequest{Key: []byte("a")})
+		assert.NoError(t, err)
+		assert.False(t, response.Found)
+
+		_, err = server.Get(ctx, &GetRequest{})
+		assert.True(t, errors.Is(err, ErrInvalidArgument))
+	})
+
+	t.Run("batch write", func(t *testing.T) {
+		_, err := server.BatchWrite(ctx, &BatchWriteRequest{Operations: []Operation{
+			{Type: OperationPut, Key: []byte("b"), Value: []byte("1")},
+			{Type: OperationPut, Key: []byte("c"), Value: []byte("1")},
+			{Type: OperationDelete, Key: []byte("b")},
+		}})
+		assert.NoError(t, err)
+
+		response, err := server.Get(ctx, &GetRequest{Key: []byte("c")})
+		assert.NoError(t, err)
+		assert.True(t, response.Found)
+
+		// A bad operation should stop the whole batch from being applied.
+		_, err = server.BatchWrite(ctx, &BatchWriteRequest{Operations: []Operation{
+			{Type: OperationPut, Key: []byte("d"), Value: []byte("1")},
+			{Type: 7, Key: []byte("e")},
+		}})
+		assert.True(t, errors.Is(err, ErrInvalidArgument))
+
+		response, err = server.Get(ctx, &GetRequest{Key: []byte("d")})
+		assert.NoError(t, err)
+		assert.False(t, response.Found)
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		_, err := server.BatchWrite(ctx, &BatchWriteRequest{Operations: []Operation{
+			{Type: OperationPut, Key: []byte("user:1"), Value: []byte("1")},
+			{Type: OperationPut, Key: []byte("user:2"), Value: []byte("2")},
+			{Type: OperationPut, Key: []byte("user:3"), Value: []byte("3")},
+		}})
+		assert.NoError(t, err)
+
+		stream := &testScanStream{ctx: ctx}
+		assert.NoError(t, server.Scan(&ScanRequest{Prefix: []byte("user:")}, stream))
+		assert.Equal(t, []string{"user:1", "user:2", "user:3"}, stream.Keys())
+		assert.Equal(t, []byte("1"), stream.responses[0].Value)
+
+		stream = &testScanStream{ctx: ctx}
+		request := &ScanRequest{
+			Prefix:   []byte("user:"),
+			Start:    []byte("user:2"),
+			Limit:    1,
+			KeysOnly: true,
+		}
+		assert.NoError(t, server.Scan(request, stream))
+		assert.Equal(t, []string{"user:2"}, stream.Keys())
+		assert.Nil(t, stream.responses[0].Value)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		stream = &testScanStream{ctx: cancelled}
+		assert.Equal(t, context.Canceled, server.Scan(&ScanRequest{}, stream))
+		assert.Empty(t, stream.responses)
+	})
+
+	t.Run("backup", func(t *testing.T) {
+		response, err := server.Backup(ctx, &BackupRequest{Name: "first.dump"})
+		assert.NoError(t, err)
+
+		data, err := ioutil.ReadFile(filepath.Join(backups, "first.dump"))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(len(data)), response.Size)
+
+		var expected bytes.Buffer
+		assert.NoError(t, db.Dump(&expected))
+		assert.Equal(t, expected.Bytes(), data)
+
+		for _, name := range []string{"", "..", "../escape", "a/b"} {
+			_, err = server.Backup(ctx, &BackupRequest{Name: name})
+			assert.True(t, errors.Is(err, ErrInvalidArgument), name)
+		}
+
+		_, err = NewServer(db, "").Backup(ctx, &BackupRequest{Name: "disabled"})
+		assert.Equal(t, ErrBackupsDisabled, err)
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		metrics, err := server.Metrics(ctx, &MetricsRequest{})
+		assert.NoError(t, err)
+		assert.NotZero(t, metrics.WALTransactionsAppended)
+	})
+}
@@ -0,0 +1,288 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// leaseFileName is the name of the file in each database directory that records who holds
+	// the lease on it, when Options.LockLease is set.
+	leaseFileName = "LEASE"
+
+	// minLockLease is the shortest lease that Options.LockLease can be set to. Shorter leases
+	// would have to be renewed so often that a short pause could lose them.
+	minLockLease = time.Second
+)
+
+// OS file locks are released by the OS when the process that holds them exits, but on shared
+// filesystems like NFS they are either not supported or are not released when the client that
+// held them disappears. A lease works without any help from the filesystem: the lease file records
+// the process that holds the directory and when its lease expires, and the holder renews it well
+// before then. A directory whose lease has expired, or whose holder is a process on this host that
+// no longer exists, can be taken over by the next process that opens it.
+//
+// The lease file is only ever replaced as a whole. A new lease is written to a temporary file and
+// then hard linked to the lease file, which fails if the lease file already exists, so two
+// processes can never both create it. Renewals are written to a temporary file and renamed over
+// the lease file. A stale lease is taken over by renaming it out of the way first, and since only
+// one process can rename it, the others find that the file they renamed is not the stale lease
+// they read and put it back.
+
+type (
+	// directoryLease is the lease that a process holds on a database directory.
+	directoryLease struct {
+		directory string
+		mode      os.FileMode
+		clock     Clock
+		duration  time.Duration
+		logger    Logger
+
+		// lock must be held to read or change the record.
+		lock sync.Mutex
+
+		// record is the last lease that was written, the directory is still held if the lease
+		// file contains exactly this.
+		record []byte
+
+		// stop is closed to stop renewing the lease, and done is closed once renewal has stopped.
+		stop chan struct{}
+		done chan struct{}
+	}
+
+	// leaseHolder is the process that a lease file says holds the directory.
+	leaseHolder struct {
+		pid       int
+		host      string
+		expiresAt time.Time
+	}
+)
+
+// leaseDirectory will acquire a lease on the directory provided that lasts for the duration and is
+// renewed until it is released. If the directory is already leased by someone else then
+// ErrDatabaseLocked is returned immediately rather than waiting.
+func leaseDirectory(
+	directory string, mode os.FileMode, clock Clock, duration time.Duration, logger Logger,
+) (*directoryLease, error) {
+	l := &directoryLease{
+		directory: directory,
+		mode:      mode,
+		clock:     clock,
+		duration:  duration,
+		logger:    logger,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	// If a stale lease is taken over then the lease file is created on the second attempt.
+	for attempt := 0; attempt < 2; attempt++ {
+		record := l.newRecord()
+		err := l.writeFile(record, func(temporary, leasePath string) error {
+			return os.Link(temporary, leasePath)
+		})
+		if err == nil {
+			l.record = record
+			goBackground("leaseRenewer", l.renew)
+			return l, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if err = l.takeOver(); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, ErrDatabaseLocked
+}
+
+// takeOver removes the lease file if its lease is stale. If the lease is still held then
+// ErrDatabaseLocked is returned.
+func (l *directoryLease) takeOver() error {
+	leasePath := path.Join(l.directory, leaseFileName)
+	data, err := ioutil.ReadFile(leasePath)
+	if os.IsNotExist(err) {
+		// The lease was released in the meantime.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// The lease file is only ever replaced as a whole, so one that cannot be parsed was not
+	// written by a lease and is treated as stale.
+	holder, err := parseLeaseRecord(data)
+	if err == nil && !holder.Stale(l.clock.Now()) {
+		return ErrDatabaseLocked
+	}
+
+	stalePath := fmt.Sprintf("%s.stale.%d", leasePath, os.Getpid())
+	if err = os.Rename(leasePath, stalePath); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer os.Remove(stalePath)
+
+	// Someone else replaced the stale lease with their own before it was renamed, give it back.
+	if renamed, err := ioutil.ReadFile(stalePath); err != nil || !bytes.Equal(renamed, data) {
+		_ = os.Link(stalePath, leasePath)
+		return ErrDatabaseLocked
+	}
+
+	return nil
+}
+
+// renew extends the lease a third of the way through it until the lease is released or lost.
+func (l *directoryLease) renew() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.duration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := l.Renew(); err != nil {
+			if l.logger != nil {
+				l.logger.Printf("failed to renew the lease on %s: %v", l.directory, err)
+			}
+
+			if err == ErrDatabaseLocked {
+				return
+			}
+		}
+	}
+}
+
+// Renew extends the lease so that it expires one duration from now. If the lease file no longer
+// holds this lease, because it expired and was taken over by someone else, then ErrDatabaseLocked
+// is returned and the lease file is left alone.
+func (l *directoryLease) Renew() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.held() {
+		return ErrDatabaseLocked
+	}
+
+	record := l.newRecord()
+	if err := l.writeFile(record, os.Rename); err != nil {
+		return err
+	}
+	l.record = record
+
+	return nil
+}
+
+// Release stops renewing the lease and removes the lease file if it still holds this lease.
+func (l *directoryLease) Release() error {
+	close(l.stop)
+	<-l.done
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.held() {
+		return nil
+	}
+
+	err := os.Remove(path.Join(l.directory, leaseFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// held returns true if the lease file still holds the last lease that was written. The lock must
+// be held.
+func (l *directoryLease) held() bool {
+	data, err := ioutil.ReadFile(path.Join(l.directory, leaseFileName))
+
+	return err == nil && bytes.Equal(data, l.record)
+}
+
+// newRecord returns the contents of a lease file for a lease held by this process that expires
+// one duration from now.
+func (l *directoryLease) newRecord() []byte {
+	return []byte(fmt.Sprintf("%d %s %d\n",
+		os.Getpid(), getLeaseHost(), l.clock.Now().Add(l.duration).UnixNano()))
+}
+
+// writeFile writes the record to a temporary file and then passes the temporary file and the path
+// of the lease file to place, which should move the record into the lease file. The temporary file
+// is removed afterwards.
+func (l *directoryLease) writeFile(
+	record []byte, place func(temporary, leasePath string) error,
+) error {
+	leasePath := path.Join(l.directory, leaseFileName)
+	temporary := fmt.Sprintf("%s.%d.%d", leasePath, os.Getpid(), time.Now().UnixNano())
+	file, err := os.OpenFile(temporary, os.O_CREATE|os.O_EXCL|os.O_WRONLY, l.mode&os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary)
+
+	if _, err = file.Write(record); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return place(temporary, leasePath)
+}
+
+// parseLeaseRecord reads the holder of a lease from the contents of a lease file.
+func parseLeaseRecord(data []byte) (leaseHolder, error) {
+	var holder leaseHolder
+	var expiresAt int64
+	_, err := fmt.Sscanf(string(data), "%d %s %d\n", &holder.pid, &holder.host, &expiresAt)
+	if err != nil {
+		return leaseHolder{}, fmt.Errorf("bad lease file: %w", err)
+	}
+	holder.expiresAt = time.Unix(0, expiresAt)
+
+	return holder, nil
+}
+
+// Stale returns true if the lease can be taken over: either it has expired, or the process that
+// holds it was running on this host and has exited.
+func (h leaseHolder) Stale(now time.Time) bool {
+	if now.After(h.expiresAt) {
+		return true
+	}
+
+	if h.host != getLeaseHost() || h.pid == os.Getpid() {
+		return false
+	}
+
+	return !processExists(h.pid)
+}
+
+// getLeaseHost returns the name of this host as it is recorded in a lease file. If the name is not
+// known then a lease held by another process on this host can only be taken over once it expires.
+func getLeaseHost() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "unknown"
+	}
+
+	return host
+}
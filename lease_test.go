@@ -0,0 +1,135 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLeaseDirectory(t *testing.T) {
+	writeLease := func(t *testing.T, dir string, pid int, host string, expiresAt time.Time) {
+		record := fmt.Sprintf("%d %s %d\n", pid, host, expiresAt.UnixNano())
+		err := ioutil.WriteFile(path.Join(dir, leaseFileName), []byte(record), 0644)
+		assert.NoError(t, err)
+	}
+
+	t.Run("exclusive", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		clock := NewManualClock(time.Unix(1000, 0))
+		lease, err := leaseDirectory(dir, defaultFileMode, clock, time.Hour, nil)
+		assert.NoError(t, err)
+
+		other, err := leaseDirectory(dir, defaultFileMode, clock, time.Hour, nil)
+		assert.Equal(t, ErrDatabaseLocked, err)
+		assert.Nil(t, other)
+
+		assert.NoError(t, lease.Release())
+		assert.False(t, getPathExists(path.Join(dir, leaseFileName)))
+
+		other, err = leaseDirectory(dir, defaultFileMode, clock, time.Hour, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, other.Release())
+
+		// Nothing but the lease file is left behind.
+		infos, err := ioutil.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Empty(t, infos)
+	})
+
+	t.Run("renew", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		clock := NewManualClock(time.Unix(1000, 0))
+		lease, err := leaseDirectory(dir, defaultFileMode, clock, time.Hour, nil)
+		assert.NoError(t, err)
+		defer lease.Release()
+
+		clock.Advance(time.Minute * 50)
+		assert.NoError(t, lease.Renew())
+
+		data, err := ioutil.ReadFile(path.Join(dir, leaseFileName))
+		assert.NoError(t, err)
+		holder, err := parseLeaseRecord(data)
+		assert.NoError(t, err)
+		assert.Equal(t, os.Getpid(), holder.pid)
+		assert.Equal(t, clock.Now().Add(time.Hour), holder.expiresAt)
+
+		// The renewed lease has not expired even though the first one would have.
+		clock.Advance(time.Minute * 30)
+		_, err = leaseDirectory(dir, defaultFileMode, clock, time.Hour, nil)
+		assert.Equal(t, ErrDatabaseLocked, err)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		clock := NewManualClock(time.Unix(1000, 0))
+		lease, err := leaseDirectory(dir, defaultFileMode, clock, time.Hour, nil)
+		assert.NoError(t, err)
+
+		clock.Advance(time.Hour + time.Second)
+		other, err := leaseDirectory(dir, defaultFileMode, clock, time.Hour, nil)
+		assert.NoError(t, err)
+
+		// The first holder has lost the lease, it must not renew or remove the new one.
+		assert.Equal(t, ErrDatabaseLocked, lease.Renew())
+		assert.NoError(t, lease.Release())
+		assert.True(t, getPathExists(path.Join(dir, leaseFileName)))
+		assert.NoError(t, other.Renew())
+		assert.NoError(t, other.Release())
+	})
+
+	t.Run("holder exited", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		// A process that has exited and been waited for no longer exists.
+		command := exec.Command(os.Args[0], "-test.run=^$")
+		assert.NoError(t, command.Run())
+
+		clock := NewManualClock(time.Unix(1000, 0))
+		writeLease(t, dir, command.Process.Pid, getLeaseHost(), clock.Now().Add(time.Hour))
+		lease, err := leaseDirectory(dir, defaultFileMode, clock, time.Hour, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, lease.Release())
+	})
+
+	t.Run("holder on another host", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		// Whether a process on another host is running cannot be checked, so the lease has to
+		// expire first.
+		clock := NewManualClock(time.Unix(1000, 0))
+		writeLease(t, dir, 1, getLeaseHost()+"-other", clock.Now().Add(time.Hour))
+		_, err := leaseDirectory(dir, defaultFileMode, clock, time.Hour, nil)
+		assert.Equal(t, ErrDatabaseLocked, err)
+
+		clock.Advance(time.Hour * 2)
+		lease, err := leaseDirectory(dir, defaultFileMode, clock, time.Hour, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, lease.Release())
+	})
+
+	t.Run("bad lease file", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		err := ioutil.WriteFile(path.Join(dir, leaseFileName), []byte("garbage"), 0644)
+		assert.NoError(t, err)
+
+		clock := NewManualClock(time.Unix(1000, 0))
+		lease, err := leaseDirectory(dir, defaultFileMode, clock, time.Hour, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, lease.Release())
+	})
+}
@@ -0,0 +1,690 @@
+package lsmtree
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrUnsupportedLevelDB is returned when a LevelDB directory contains a file that was written
+	// in a format that cannot be read, like a table written with a newer Pebble or RocksDB format.
+	ErrUnsupportedLevelDB = errors.New("unsupported leveldb format")
+
+	// ErrBadLevelDB is returned when a file in a LevelDB directory is corrupt.
+	ErrBadLevelDB = errors.New("bad leveldb file")
+)
+
+const (
+	// levelDBTableMagic is stored in the last 8 bytes of every LevelDB table.
+	levelDBTableMagic = 0xdb4775248b80fb57
+
+	// levelDBFooterSize is the size of the footer at the end of every LevelDB table.
+	levelDBFooterSize = 48
+
+	// levelDBBlockTrailerSize is the size of the compression type and checksum after each block.
+	levelDBBlockTrailerSize = 5
+
+	// These are the compression types that a LevelDB block can be stored with.
+	levelDBNoCompression     = 0
+	levelDBSnappyCompression = 1
+
+	// These are the kinds of entries stored in the trailer of each internal key.
+	levelDBKindDeletion = 0
+	levelDBKindValue    = 1
+
+	// levelDBLogBlockSize is the size of the blocks that the LevelDB log is divided into.
+	levelDBLogBlockSize = 32 * 1024
+
+	// levelDBLogHeaderSize is the size of the header before each fragment of a log record.
+	levelDBLogHeaderSize = 7
+
+	// These are the types of the fragments that log records are split into.
+	levelDBLogFull   = 1
+	levelDBLogFirst  = 2
+	levelDBLogMiddle = 3
+	levelDBLogLast   = 4
+
+	// levelDBChecksumMaskDelta is used to unmask the CRCs stored by LevelDB.
+	levelDBChecksumMaskDelta = 0xa282ead8
+)
+
+var (
+	levelDBCRCTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type (
+	// levelDBEntry is a single version of a key read from a LevelDB table or log.
+	levelDBEntry struct {
+		key      []byte
+		value    []byte
+		sequence uint64
+		kind     byte
+	}
+
+	// levelDBIterator returns the entries of a single table or log in order.
+	levelDBIterator interface {
+		next() (levelDBEntry, bool, error)
+	}
+
+	// levelDBSliceIterator returns entries that have already been read into memory.
+	levelDBSliceIterator struct {
+		entries []levelDBEntry
+	}
+
+	// levelDBTableIterator reads the data blocks of a table one at a time.
+	levelDBTableIterator struct {
+		file    *os.File
+		name    string
+		handles []levelDBBlockHandle
+		block   []levelDBEntry
+	}
+
+	// levelDBBlockHandle is the location of a block within a table.
+	levelDBBlockHandle struct {
+		offset uint64
+		size   uint64
+	}
+
+	// levelDBHeapItem is the current entry of one of the files being merged.
+	levelDBHeapItem struct {
+		entry    levelDBEntry
+		iterator levelDBIterator
+	}
+
+	// levelDBHeap orders the current entry of every file by key and then by newest sequence.
+	levelDBHeap []levelDBHeapItem
+
+	// LevelDBSource reads the keys out of a LevelDB data directory so they can be imported with
+	// DB.Import. Pebble stores that were written with the LevelDB table format can also be read.
+	LevelDBSource struct {
+		files   []*os.File
+		heap    levelDBHeap
+		lastKey []byte
+		started bool
+	}
+)
+
+var (
+	_ ImportSource = &LevelDBSource{}
+)
+
+// OpenLevelDBSource reads the LevelDB directory provided. The LevelDB database must not be open
+// while it is being read. Every table and log file in the directory is read, and only the newest
+// version of each key is returned. Keys that have been deleted are not returned.
+//
+// Files that LevelDB no longer needs but did not delete (like after a crash) are read as well.
+// For the most accurate result the database should be opened and closed cleanly by LevelDB before
+// it is imported.
+func OpenLevelDBSource(directory string) (*LevelDBSource, error) {
+	infos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &LevelDBSource{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		filePath := path.Join(directory, info.Name())
+
+		var iterator levelDBIterator
+		switch {
+		case strings.HasSuffix(info.Name(), ".ldb"), strings.HasSuffix(info.Name(), ".sst"):
+			file, err := os.Open(filePath)
+			if err != nil {
+				_ = source.Close()
+				return nil, err
+			}
+			source.files = append(source.files, file)
+
+			if iterator, err = newLevelDBTableIterator(file, info.Name(), info.Size()); err != nil {
+				_ = source.Close()
+				return nil, err
+			}
+		case strings.HasSuffix(info.Name(), ".log"):
+			data, err := ioutil.ReadFile(filePath)
+			if err != nil {
+				_ = source.Close()
+				return nil, err
+			}
+
+			entries, err := readLevelDBLog(data)
+			if err != nil {
+				_ = source.Close()
+				return nil, fmt.Errorf("%s: %w", info.Name(), err)
+			}
+			iterator = &levelDBSliceIterator{entries: entries}
+		default:
+			continue
+		}
+
+		entry, ok, err := iterator.next()
+		if err != nil {
+			_ = source.Close()
+			return nil, err
+		} else if ok {
+			source.heap = append(source.heap, levelDBHeapItem{entry: entry, iterator: iterator})
+		}
+	}
+	heap.Init(&source.heap)
+
+	return source, nil
+}
+
+// Next returns the next key in the LevelDB database.
+func (s *LevelDBSource) Next() (Key, []byte, error) {
+	for len(s.heap) > 0 {
+		item := &s.heap[0]
+		entry := item.entry
+
+		next, ok, err := item.iterator.next()
+		if err != nil {
+			return nil, nil, err
+		} else if ok {
+			item.entry = next
+			heap.Fix(&s.heap, 0)
+		} else {
+			heap.Pop(&s.heap)
+		}
+
+		// The newest version of each key comes first, so any other versions can be skipped.
+		if s.started && bytes.Equal(entry.key, s.lastKey) {
+			continue
+		}
+		s.lastKey, s.started = entry.key, true
+
+		if entry.kind == levelDBKindValue {
+			return entry.key, entry.value, nil
+		}
+	}
+
+	return nil, nil, io.EOF
+}
+
+// Close closes all of the files in the directory.
+func (s *LevelDBSource) Close() error {
+	var err error
+	for _, file := range s.files {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	s.files = nil
+
+	return err
+}
+
+func (h levelDBHeap) Len() int      { return len(h) }
+func (h levelDBHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h levelDBHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].entry.key, h[j].entry.key); c != 0 {
+		return c < 0
+	}
+
+	return h[i].entry.sequence > h[j].entry.sequence
+}
+func (h *levelDBHeap) Push(x interface{}) { *h = append(*h, x.(levelDBHeapItem)) }
+func (h *levelDBHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// next returns the next entry that was read into memory.
+func (i *levelDBSliceIterator) next() (levelDBEntry, bool, error) {
+	if len(i.entries) == 0 {
+		return levelDBEntry{}, false, nil
+	}
+
+	entry := i.entries[0]
+	i.entries = i.entries[1:]
+
+	return entry, true, nil
+}
+
+// newLevelDBTableIterator reads the footer and index block of the table so that its data blocks
+// can be read in order.
+func newLevelDBTableIterator(file *os.File, name string, size int64) (*levelDBTableIterator, error) {
+	if size < levelDBFooterSize {
+		return nil, fmt.Errorf("%s: %w: %v", name, ErrBadLevelDB, ErrTruncated)
+	}
+
+	footer := make([]byte, levelDBFooterSize)
+	if _, err := file.ReadAt(footer, size-levelDBFooterSize); err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint64(footer[levelDBFooterSize-8:]) != levelDBTableMagic {
+		return nil, fmt.Errorf("%s: %w: unknown table magic", name, ErrUnsupportedLevelDB)
+	}
+
+	// The footer starts with the handle of the metaindex block, which we do not need, followed by
+	// the handle of the index block.
+	_, n := decodeLevelDBBlockHandle(footer)
+	index, m := decodeLevelDBBlockHandle(footer[n:])
+	if n <= 0 || m <= 0 {
+		return nil, fmt.Errorf("%s: %w: bad footer", name, ErrBadLevelDB)
+	}
+
+	iterator := &levelDBTableIterator{
+		file: file,
+		name: name,
+	}
+
+	indexBlock, err := iterator.readBlock(index)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each entry in the index block is a key that separates two data blocks and the handle of the
+	// data block before it.
+	err = iterateLevelDBBlock(indexBlock, func(_, value []byte) error {
+		handle, n := decodeLevelDBBlockHandle(value)
+		if n <= 0 {
+			return ErrBadLevelDB
+		}
+		iterator.handles = append(iterator.handles, handle)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return iterator, nil
+}
+
+// next returns the next entry in the table. Data blocks are read one at a time as they are needed.
+func (i *levelDBTableIterator) next() (levelDBEntry, bool, error) {
+	for len(i.block) == 0 {
+		if len(i.handles) == 0 {
+			return levelDBEntry{}, false, nil
+		}
+
+		data, err := i.readBlock(i.handles[0])
+		if err != nil {
+			return levelDBEntry{}, false, err
+		}
+		i.handles = i.handles[1:]
+
+		err = iterateLevelDBBlock(data, func(key, value []byte) error {
+			entry, err := decodeLevelDBInternalKey(key)
+			if err != nil {
+				return err
+			}
+			entry.value = value
+			i.block = append(i.block, entry)
+			return nil
+		})
+		if err != nil {
+			return levelDBEntry{}, false, fmt.Errorf("%s: %w", i.name, err)
+		}
+	}
+
+	entry := i.block[0]
+	i.block = i.block[1:]
+
+	return entry, true, nil
+}
+
+// readBlock reads the block that the handle points to, verifies its checksum and decompresses it.
+func (i *levelDBTableIterator) readBlock(handle levelDBBlockHandle) ([]byte, error) {
+	data := make([]byte, handle.size+levelDBBlockTrailerSize)
+	if _, err := i.file.ReadAt(data, int64(handle.offset)); err == io.EOF {
+		return nil, fmt.Errorf("%s: %w: %v", i.name, ErrBadLevelDB, ErrTruncated)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// The checksum covers the block and the compression type.
+	checksum := binary.LittleEndian.Uint32(data[handle.size+1:])
+	if crc32.Checksum(data[:handle.size+1], levelDBCRCTable) != unmaskLevelDBChecksum(checksum) {
+		return nil, fmt.Errorf("%s: %w: bad block checksum", i.name, ErrBadLevelDB)
+	}
+
+	switch compression := data[handle.size]; compression {
+	case levelDBNoCompression:
+		return data[:handle.size], nil
+	case levelDBSnappyCompression:
+		block, err := decodeSnappy(data[:handle.size])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", i.name, err)
+		}
+		return block, nil
+	default:
+		return nil, fmt.Errorf("%s: %w: compression type %d", i.name, ErrUnsupportedLevelDB, compression)
+	}
+}
+
+// iterateLevelDBBlock calls the function provided with every key and value in the block. Keys are
+// prefix compressed against the key before them.
+func iterateLevelDBBlock(block []byte, fn func(key, value []byte) error) error {
+	if len(block) < 4 {
+		return ErrBadLevelDB
+	}
+
+	// The block ends with an array of restart points and the number of restart points, we only
+	// need to know where the entries end.
+	restarts := uint64(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	if restarts*4+4 > uint64(len(block)) {
+		return ErrBadLevelDB
+	}
+	data := block[:uint64(len(block))-restarts*4-4]
+
+	var key []byte
+	for len(data) > 0 {
+		shared, n1 := binary.Uvarint(data)
+		if n1 <= 0 {
+			return ErrBadLevelDB
+		}
+		unshared, n2 := binary.Uvarint(data[n1:])
+		if n2 <= 0 {
+			return ErrBadLevelDB
+		}
+		valueLength, n3 := binary.Uvarint(data[n1+n2:])
+		if n3 <= 0 {
+			return ErrBadLevelDB
+		}
+		data = data[n1+n2+n3:]
+
+		if shared > uint64(len(key)) || unshared+valueLength > uint64(len(data)) {
+			return ErrBadLevelDB
+		}
+
+		// The key is copied so that it is not changed by the next entry.
+		key = append(append(make([]byte, 0, shared+unshared), key[:shared]...), data[:unshared]...)
+		value := data[unshared : unshared+valueLength]
+		data = data[unshared+valueLength:]
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeLevelDBBlockHandle reads a block handle from the start of the source. The number of bytes
+// read is returned, this is 0 or negative if the handle could not be read.
+func decodeLevelDBBlockHandle(src []byte) (levelDBBlockHandle, int) {
+	offset, n := binary.Uvarint(src)
+	if n <= 0 {
+		return levelDBBlockHandle{}, n
+	}
+
+	size, m := binary.Uvarint(src[n:])
+	if m <= 0 {
+		return levelDBBlockHandle{}, m
+	}
+
+	return levelDBBlockHandle{offset: offset, size: size}, n + m
+}
+
+// decodeLevelDBInternalKey splits an internal key into the user key and the 8 byte trailer that
+// holds the sequence number and the kind of entry.
+func decodeLevelDBInternalKey(key []byte) (levelDBEntry, error) {
+	if len(key) < 8 {
+		return levelDBEntry{}, ErrBadLevelDB
+	}
+
+	trailer := binary.LittleEndian.Uint64(key[len(key)-8:])
+	entry := levelDBEntry{
+		key:      key[:len(key)-8],
+		sequence: trailer >> 8,
+		kind:     byte(trailer),
+	}
+
+	if entry.kind != levelDBKindValue && entry.kind != levelDBKindDeletion {
+		return levelDBEntry{}, fmt.Errorf("%w: entry kind %d", ErrUnsupportedLevelDB, entry.kind)
+	}
+
+	return entry, nil
+}
+
+// readLevelDBLog reads every write batch in a LevelDB log and returns the entries sorted by key and
+// then by newest sequence. A record that was only partially written at the end of the log (like
+// after a crash) is ignored, just like LevelDB does.
+func readLevelDBLog(data []byte) ([]levelDBEntry, error) {
+	var entries []levelDBEntry
+	var record []byte
+	inRecord := false
+	for blockStart := 0; blockStart < len(data); blockStart += levelDBLogBlockSize {
+		block := data[blockStart:]
+		if len(block) > levelDBLogBlockSize {
+			block = block[:levelDBLogBlockSize]
+		}
+
+		for len(block) >= levelDBLogHeaderSize {
+			checksum := binary.LittleEndian.Uint32(block[0:4])
+			length := int(binary.LittleEndian.Uint16(block[4:6]))
+			kind := block[6]
+
+			// The rest of a block can be padded with zeros.
+			if kind == 0 && length == 0 {
+				break
+			}
+
+			if levelDBLogHeaderSize+length > len(block) {
+				// The last record was not completely written.
+				return sortLevelDBEntries(entries), nil
+			}
+
+			fragment := block[levelDBLogHeaderSize : levelDBLogHeaderSize+length]
+			if crc32.Checksum(block[6:levelDBLogHeaderSize+length], levelDBCRCTable) !=
+				unmaskLevelDBChecksum(checksum) {
+				return nil, fmt.Errorf("%w: bad log record checksum", ErrBadLevelDB)
+			}
+			block = block[levelDBLogHeaderSize+length:]
+
+			switch kind {
+			case levelDBLogFull:
+				record, inRecord = fragment, false
+			case levelDBLogFirst:
+				record, inRecord = append([]byte{}, fragment...), true
+				continue
+			case levelDBLogMiddle, levelDBLogLast:
+				if !inRecord {
+					return nil, fmt.Errorf("%w: log fragment without a start", ErrBadLevelDB)
+				}
+				record = append(record, fragment...)
+				if kind == levelDBLogMiddle {
+					continue
+				}
+				inRecord = false
+			default:
+				return nil, fmt.Errorf("%w: log record type %d", ErrUnsupportedLevelDB, kind)
+			}
+
+			batch, err := decodeLevelDBWriteBatch(record)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, batch...)
+		}
+	}
+
+	return sortLevelDBEntries(entries), nil
+}
+
+// decodeLevelDBWriteBatch reads the entries from a single write batch in the log. Each entry in the
+// batch is given the next sequence number after the sequence of the batch.
+func decodeLevelDBWriteBatch(record []byte) ([]levelDBEntry, error) {
+	if len(record) < 12 {
+		return nil, fmt.Errorf("%w: %v", ErrBadLevelDB, ErrTruncated)
+	}
+
+	sequence := binary.LittleEndian.Uint64(record[0:8])
+	count := binary.LittleEndian.Uint32(record[8:12])
+	data := record[12:]
+
+	readBytes := func() ([]byte, bool) {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return nil, false
+		}
+		value := data[n : uint64(n)+length]
+		data = data[uint64(n)+length:]
+		return value, true
+	}
+
+	entries := make([]levelDBEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%w: %v", ErrBadLevelDB, ErrTruncated)
+		}
+
+		entry := levelDBEntry{
+			sequence: sequence + uint64(i),
+			kind:     data[0],
+		}
+		data = data[1:]
+
+		var ok bool
+		switch entry.kind {
+		case levelDBKindValue:
+			if entry.key, ok = readBytes(); ok {
+				entry.value, ok = readBytes()
+			}
+		case levelDBKindDeletion:
+			entry.key, ok = readBytes()
+		default:
+			return nil, fmt.Errorf("%w: entry kind %d", ErrUnsupportedLevelDB, entry.kind)
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("%w: %v", ErrBadLevelDB, ErrTruncated)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// sortLevelDBEntries sorts the entries by key and then by newest sequence.
+func sortLevelDBEntries(entries []levelDBEntry) []levelDBEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if c := bytes.Compare(entries[i].key, entries[j].key); c != 0 {
+			return c < 0
+		}
+
+		return entries[i].sequence > entries[j].sequence
+	})
+
+	return entries
+}
+
+// unmaskLevelDBChecksum reverses the masking LevelDB applies to every CRC it stores.
+func unmaskLevelDBChecksum(checksum uint32) uint32 {
+	rotated := checksum - levelDBChecksumMaskDelta
+	return rotated>>17 | rotated<<15
+}
+
+// decodeSnappy decompresses a block that was compressed with the snappy block format.
+func decodeSnappy(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > maxValueSizeLimit {
+		return nil, fmt.Errorf("%w: bad snappy length", ErrBadLevelDB)
+	}
+	src = src[n:]
+
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		if uint64(len(dst)) > length {
+			return nil, fmt.Errorf("%w: snappy length mismatch", ErrBadLevelDB)
+		}
+
+		tag := src[0]
+		switch tag & 0x03 {
+		case 0x00: // A literal.
+			literalLength := uint64(tag >> 2)
+			src = src[1:]
+			if literalLength >= 60 {
+				// The length is stored in the next 1 to 4 bytes.
+				extra := int(literalLength - 59)
+				if len(src) < extra {
+					return nil, fmt.Errorf("%w: %v", ErrBadLevelDB, ErrTruncated)
+				}
+				literalLength = 0
+				for i := extra - 1; i >= 0; i-- {
+					literalLength = literalLength<<8 | uint64(src[i])
+				}
+				src = src[extra:]
+			}
+			literalLength++
+
+			if literalLength > uint64(len(src)) {
+				return nil, fmt.Errorf("%w: %v", ErrBadLevelDB, ErrTruncated)
+			}
+			dst = append(dst, src[:literalLength]...)
+			src = src[literalLength:]
+			continue
+
+		case 0x01: // A copy with a 1 byte offset.
+			if len(src) < 2 {
+				return nil, fmt.Errorf("%w: %v", ErrBadLevelDB, ErrTruncated)
+			}
+			copyLength := 4 + int(tag>>2)&0x07
+			offset := int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+			if dst, n = snappyCopy(dst, offset, copyLength); n < 0 {
+				return nil, fmt.Errorf("%w: bad snappy copy", ErrBadLevelDB)
+			}
+
+		case 0x02: // A copy with a 2 byte offset.
+			if len(src) < 3 {
+				return nil, fmt.Errorf("%w: %v", ErrBadLevelDB, ErrTruncated)
+			}
+			copyLength := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+			if dst, n = snappyCopy(dst, offset, copyLength); n < 0 {
+				return nil, fmt.Errorf("%w: bad snappy copy", ErrBadLevelDB)
+			}
+
+		case 0x03: // A copy with a 4 byte offset.
+			if len(src) < 5 {
+				return nil, fmt.Errorf("%w: %v", ErrBadLevelDB, ErrTruncated)
+			}
+			copyLength := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint32(src[1:5]))
+			src = src[5:]
+			if dst, n = snappyCopy(dst, offset, copyLength); n < 0 {
+				return nil, fmt.Errorf("%w: bad snappy copy", ErrBadLevelDB)
+			}
+		}
+	}
+
+	if uint64(len(dst)) != length {
+		return nil, fmt.Errorf("%w: snappy length mismatch", ErrBadLevelDB)
+	}
+
+	return dst, nil
+}
+
+// snappyCopy appends length bytes starting offset bytes back from the end of dst. The copy can
+// overlap with the bytes being appended. If the offset is not valid then -1 is returned.
+func snappyCopy(dst []byte, offset, length int) ([]byte, int) {
+	if offset <= 0 || offset > len(dst) {
+		return dst, -1
+	}
+
+	start := len(dst) - offset
+	for i := 0; i < length; i++ {
+		dst = append(dst, dst[start+i])
+	}
+
+	return dst, length
+}
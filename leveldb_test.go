@@ -0,0 +1,344 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func appendTestUvarint(dst []byte, n uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(dst, buf[:binary.PutUvarint(buf, n)]...)
+}
+
+func appendTestUint16(dst []byte, n uint16) []byte {
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, n)
+	return append(dst, buf...)
+}
+
+func appendTestUint32(dst []byte, n uint32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, n)
+	return append(dst, buf...)
+}
+
+func appendTestUint64(dst []byte, n uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, n)
+	return append(dst, buf...)
+}
+
+// maskLevelDBChecksum masks a CRC the same way that LevelDB does before it is stored.
+func maskLevelDBChecksum(checksum uint32) uint32 {
+	return (checksum>>15 | checksum<<17) + levelDBChecksumMaskDelta
+}
+
+// newLevelDBInternalKey appends the sequence and kind trailer to the key.
+func newLevelDBInternalKey(key string, sequence uint64, kind byte) []byte {
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(trailer, sequence<<8|uint64(kind))
+	return append([]byte(key), trailer...)
+}
+
+// newLevelDBBlock builds a block with a single restart point, every key after the first is prefix
+// compressed against the key before it.
+func newLevelDBBlock(keys, values [][]byte) []byte {
+	var block, last []byte
+	for i, key := range keys {
+		shared := 0
+		for shared < len(last) && shared < len(key) && last[shared] == key[shared] {
+			shared++
+		}
+		block = appendTestUvarint(block, uint64(shared))
+		block = appendTestUvarint(block, uint64(len(key)-shared))
+		block = appendTestUvarint(block, uint64(len(values[i])))
+		block = append(block, key[shared:]...)
+		block = append(block, values[i]...)
+		last = key
+	}
+
+	block = appendTestUint32(block, 0)
+	return appendTestUint32(block, 1)
+}
+
+// appendLevelDBBlock appends the block and its trailer to the table and returns its handle.
+func appendLevelDBBlock(table, block []byte, compression byte) ([]byte, []byte) {
+	handle := appendTestUvarint(nil, uint64(len(table)))
+	handle = appendTestUvarint(handle, uint64(len(block)))
+
+	table = append(table, block...)
+	table = append(table, compression)
+	checksum := crc32.Checksum(table[len(table)-len(block)-1:], levelDBCRCTable)
+	table = appendTestUint32(table, maskLevelDBChecksum(checksum))
+
+	return table, handle
+}
+
+// newLevelDBTable builds a table with one data block for each group of entries provided.
+func newLevelDBTable(blocks ...[]levelDBEntry) []byte {
+	var table, index []byte
+	var indexKeys, indexValues [][]byte
+	for _, entries := range blocks {
+		var keys, values [][]byte
+		for _, entry := range entries {
+			keys = append(keys, newLevelDBInternalKey(string(entry.key), entry.sequence, entry.kind))
+			values = append(values, entry.value)
+		}
+
+		var handle []byte
+		table, handle = appendLevelDBBlock(table, newLevelDBBlock(keys, values), levelDBNoCompression)
+		indexKeys = append(indexKeys, keys[len(keys)-1])
+		indexValues = append(indexValues, handle)
+	}
+
+	table, metaIndex := appendLevelDBBlock(table, newLevelDBBlock(nil, nil), levelDBNoCompression)
+	table, index = appendLevelDBBlock(table, newLevelDBBlock(indexKeys, indexValues), levelDBNoCompression)
+
+	footer := append(append([]byte{}, metaIndex...), index...)
+	footer = append(footer, make([]byte, 40-len(footer))...)
+	footer = appendTestUint64(footer, levelDBTableMagic)
+
+	return append(table, footer...)
+}
+
+// newLevelDBLog builds a log with a single record for each write batch. The records are split into
+// fragments so that no fragment is larger than the fragment size provided.
+func newLevelDBLog(maxFragmentSize int, batches ...[]byte) []byte {
+	var log []byte
+	for _, batch := range batches {
+		for first := true; first || len(batch) > 0; first = false {
+			fragmentSize := maxFragmentSize
+			// Pad the rest of the block if there is no room for another header.
+			left := levelDBLogBlockSize - len(log)%levelDBLogBlockSize
+			if left < levelDBLogHeaderSize {
+				log = append(log, make([]byte, left)...)
+				left = levelDBLogBlockSize
+			}
+
+			// Fragments can never cross a block boundary.
+			fragment := batch
+			if limit := left - levelDBLogHeaderSize; limit < fragmentSize {
+				fragmentSize = limit
+			}
+			if len(fragment) > fragmentSize {
+				fragment = fragment[:fragmentSize]
+			}
+			batch = batch[len(fragment):]
+
+			kind := byte(levelDBLogFull)
+			switch {
+			case first && len(batch) > 0:
+				kind = levelDBLogFirst
+			case !first && len(batch) > 0:
+				kind = levelDBLogMiddle
+			case !first:
+				kind = levelDBLogLast
+			}
+
+			checksum := crc32.Checksum(append([]byte{kind}, fragment...), levelDBCRCTable)
+			log = appendTestUint32(log, maskLevelDBChecksum(checksum))
+			log = appendTestUint16(log, uint16(len(fragment)))
+			log = append(log, kind)
+			log = append(log, fragment...)
+		}
+	}
+
+	return log
+}
+
+// newLevelDBWriteBatch builds a write batch. A nil value is a deletion.
+func newLevelDBWriteBatch(sequence uint64, keys []string, values [][]byte) []byte {
+	batch := appendTestUint64(nil, sequence)
+	batch = appendTestUint32(batch, uint32(len(keys)))
+	for i, key := range keys {
+		if values[i] == nil {
+			batch = append(batch, levelDBKindDeletion)
+			batch = appendTestUvarint(batch, uint64(len(key)))
+			batch = append(batch, key...)
+			continue
+		}
+
+		batch = append(batch, levelDBKindValue)
+		batch = appendTestUvarint(batch, uint64(len(key)))
+		batch = append(batch, key...)
+		batch = appendTestUvarint(batch, uint64(len(values[i])))
+		batch = append(batch, values[i]...)
+	}
+
+	return batch
+}
+
+func TestLevelDBSource(t *testing.T) {
+	t.Run("tables and logs", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		older := newLevelDBTable(
+			[]levelDBEntry{
+				{key: []byte("apple"), sequence: 1, kind: levelDBKindValue, value: []byte("red")},
+				{key: []byte("apricot"), sequence: 2, kind: levelDBKindValue, value: []byte("orange")},
+			},
+			[]levelDBEntry{
+				{key: []byte("banana"), sequence: 3, kind: levelDBKindValue, value: []byte("yellow")},
+				{key: []byte("cherry"), sequence: 4, kind: levelDBKindValue, value: []byte("red")},
+			},
+		)
+		newer := newLevelDBTable([]levelDBEntry{
+			{key: []byte("apple"), sequence: 10, kind: levelDBKindValue, value: []byte("green")},
+			{key: []byte("banana"), sequence: 11, kind: levelDBKindDeletion},
+		})
+
+		// The log is split into many small fragments to cover records that span blocks.
+		log := newLevelDBLog(5000,
+			newLevelDBWriteBatch(20, []string{"cherry", "date"}, [][]byte{nil, []byte("brown")}),
+			newLevelDBWriteBatch(22, []string{"elderberry"}, [][]byte{make([]byte, 40000)}),
+		)
+
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "000005.ldb"), older, 0644))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "000007.sst"), newer, 0644))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "000008.log"), log, 0644))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "CURRENT"), []byte("MANIFEST-000006\n"), 0644))
+
+		source, err := OpenLevelDBSource(dir)
+		assert.NoError(t, err)
+		defer source.Close()
+
+		var keys []string
+		values := map[string][]byte{}
+		for {
+			key, value, err := source.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+			keys = append(keys, string(key))
+			values[string(key)] = value
+		}
+
+		assert.Equal(t, []string{"apple", "apricot", "date", "elderberry"}, keys)
+		assert.Equal(t, []byte("green"), values["apple"])
+		assert.Equal(t, []byte("brown"), values["date"])
+		assert.Len(t, values["elderberry"], 40000)
+
+		db, cleanupDB := newTestDB(t, DefaultOptions())
+		defer cleanupDB()
+
+		source, err = OpenLevelDBSource(dir)
+		assert.NoError(t, err)
+		defer source.Close()
+		assert.NoError(t, db.Import(source))
+
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		item, err := txn.Get(Key("apple"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("green"), item.Value)
+
+		_, err = txn.Get(Key("banana"))
+		assert.Equal(t, ErrKeyNotFound, err)
+	})
+
+	t.Run("partial log record", func(t *testing.T) {
+		log := newLevelDBLog(100,
+			newLevelDBWriteBatch(1, []string{"a"}, [][]byte{[]byte("1")}),
+			newLevelDBWriteBatch(2, []string{"b"}, [][]byte{make([]byte, 1000)}),
+		)
+
+		entries, err := readLevelDBLog(log[:len(log)-10])
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+
+	t.Run("corrupt table", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		table := newLevelDBTable([]levelDBEntry{
+			{key: []byte("apple"), sequence: 1, kind: levelDBKindValue, value: []byte("red")},
+		})
+		table[2] ^= 0xff
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "000005.ldb"), table, 0644))
+
+		// The first block of each table is read when the source is opened.
+		_, err := OpenLevelDBSource(dir)
+		assert.True(t, errors.Is(err, ErrBadLevelDB))
+	})
+
+	t.Run("unsupported table", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "000005.sst"), make([]byte, 64), 0644))
+
+		_, err := OpenLevelDBSource(dir)
+		assert.True(t, errors.Is(err, ErrUnsupportedLevelDB))
+	})
+}
+
+func TestDecodeSnappy(t *testing.T) {
+	long := make([]byte, 100)
+	for i := range long {
+		long[i] = byte(i)
+	}
+
+	testCases := []struct {
+		name     string
+		input    []byte
+		expected []byte
+	}{
+		{
+			name:     "literal",
+			input:    []byte{0x03, 0x08, 'a', 'b', 'c'},
+			expected: []byte("abc"),
+		},
+		{
+			name:     "long literal",
+			input:    append([]byte{100, 0xf0, 99}, long...),
+			expected: long,
+		},
+		{
+			name:     "overlapping copy",
+			input:    []byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x03},
+			expected: []byte("abcabcabcabc"),
+		},
+		{
+			name:     "two byte offset",
+			input:    []byte{0x06, 0x08, 'a', 'b', 'c', 0x0a, 0x03, 0x00},
+			expected: []byte("abcabc"),
+		},
+		{
+			name:     "four byte offset",
+			input:    []byte{0x06, 0x08, 'a', 'b', 'c', 0x0b, 0x03, 0x00, 0x00, 0x00},
+			expected: []byte("abcabc"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			output, err := decodeSnappy(testCase.input)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expected, output)
+		})
+	}
+
+	for i, input := range [][]byte{
+		{0x04, 0x08, 'a', 'b', 'c'},
+		{0x03, 0x08, 'a', 'b'},
+		{0x06, 0x08, 'a', 'b', 'c', 0x0a, 0x09, 0x00},
+		{0x03, 0x0a, 0x01, 0x00},
+	} {
+		t.Run(fmt.Sprintf("invalid %d", i), func(t *testing.T) {
+			_, err := decodeSnappy(input)
+			assert.True(t, errors.Is(err, ErrBadLevelDB))
+		})
+	}
+}
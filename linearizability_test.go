@@ -0,0 +1,519 @@
+package lsmtree
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The linearizability tests record every operation that concurrent clients make against the
+// transaction layer as a history, the way Jepsen does: each operation is invoked, and then either
+// completes with its output (ok), definitely did not happen (fail), or may or may not have
+// happened (info). An operation whose commit fails with ErrTxnConflict is a fail, while one that
+// was still running, or whose commit returned after the disk was imaged for a crash, is an info.
+//
+// The history is then checked against a model of a map of registers: it is linearizable if every
+// ok operation can be placed at a single point between its invoke and its completion, and any
+// number of info operations can be placed at a point after their invoke, such that replaying them
+// in that order against the model produces every output that was observed. Since each operation
+// only touches one key, the history is checked one key at a time.
+//
+// The search is the one used by porcupine, a depth first search over which operations have been
+// placed so far, memoized on that set and the state of the model. Histories are recorded in
+// porcupine's Operation layout, run the tests with -history.dir to write them out as JSON so they
+// can be checked or visualized with porcupine itself.
+var historyDirectory = flag.String(
+	"history.dir", "", "write the history of each linearizability test to this directory as JSON",
+)
+
+const (
+	// historyGet reads a key in a read only transaction.
+	historyGet = "get"
+
+	// historyPut writes a value to a key without reading it.
+	historyPut = "put"
+
+	// historyIncrement reads a key and writes it back plus one in the same transaction, a missing
+	// key is read as 0. Its output is the value that was read.
+	historyIncrement = "increment"
+)
+
+type (
+	// historyInput is what a client asked an operation to do.
+	historyInput struct {
+		Kind  string
+		Key   string
+		Value int
+	}
+
+	// historyOutput is what an operation observed.
+	historyOutput struct {
+		Value int
+		Found bool
+	}
+
+	// historyOperation is a single completed operation, in the same layout as porcupine's
+	// Operation. Call and Return are nanoseconds since the history started, an info operation
+	// never returns so its Return is math.MaxInt64.
+	historyOperation struct {
+		ClientId int
+		Input    historyInput
+		Call     int64
+		Output   historyOutput
+		Return   int64
+	}
+
+	// historyRecorder collects the operations of every client.
+	historyRecorder struct {
+		start time.Time
+
+		lock       sync.Mutex
+		operations []historyOperation
+	}
+
+	// historyCall is an operation that has been invoked but has not completed yet.
+	historyCall struct {
+		recorder *historyRecorder
+		clientId int
+		input    historyInput
+		call     int64
+	}
+
+	// linearizabilityCheck searches for a linearization of the operations on a single key.
+	linearizabilityCheck struct {
+		operations []historyOperation
+
+		// required is the number of operations that must be placed, every other operation is an
+		// info that can be left out.
+		required int
+
+		// visited are the sets of placed operations and states that have already been searched
+		// without finding a linearization.
+		visited map[string]struct{}
+	}
+)
+
+func newHistoryRecorder() *historyRecorder {
+	return &historyRecorder{
+		start: time.Now(),
+	}
+}
+
+func (h *historyRecorder) now() int64 {
+	return time.Since(h.start).Nanoseconds()
+}
+
+// Invoke records that the client has started an operation.
+func (h *historyRecorder) Invoke(clientId int, input historyInput) *historyCall {
+	return &historyCall{
+		recorder: h,
+		clientId: clientId,
+		input:    input,
+		call:     h.now(),
+	}
+}
+
+// Operations returns every operation that was recorded, other than the ones that failed.
+func (h *historyRecorder) Operations() []historyOperation {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return append([]historyOperation{}, h.operations...)
+}
+
+// Ok records that the operation happened and observed the output.
+func (c *historyCall) Ok(output historyOutput) {
+	c.complete(output, c.recorder.now())
+}
+
+// Fail records that the operation did not happen. It is left out of the history since it could
+// not have had any effect.
+func (c *historyCall) Fail() {}
+
+// Info records that the operation may or may not have happened. Reads are left out of the history
+// since they have no effect, but writes are kept since they might have.
+func (c *historyCall) Info(output historyOutput) {
+	if c.input.Kind == historyGet {
+		return
+	}
+
+	c.complete(output, math.MaxInt64)
+}
+
+func (c *historyCall) complete(output historyOutput, returned int64) {
+	c.recorder.lock.Lock()
+	defer c.recorder.lock.Unlock()
+
+	c.recorder.operations = append(c.recorder.operations, historyOperation{
+		ClientId: c.clientId,
+		Input:    c.input,
+		Call:     c.call,
+		Output:   output,
+		Return:   returned,
+	})
+}
+
+// Info returns true if the operation may or may not have happened.
+func (o historyOperation) Info() bool {
+	return o.Return == math.MaxInt64
+}
+
+// step applies the operation to the state of its register and returns the new state, -1 is a
+// register that does not exist. If the operation could not have observed its output from the
+// state then ok is false.
+func (o historyOperation) step(state int) (_ int, ok bool) {
+	switch o.Input.Kind {
+	case historyGet:
+		if state < 0 {
+			return state, !o.Output.Found
+		}
+
+		return state, o.Output.Found && o.Output.Value == state
+	case historyPut:
+		return o.Input.Value, true
+	case historyIncrement:
+		if state < 0 {
+			return 1, !o.Output.Found
+		}
+
+		return state + 1, o.Output.Found && o.Output.Value == state
+	default:
+		panic(fmt.Sprintf("unknown operation %q", o.Input.Kind))
+	}
+}
+
+// checkLinearizable returns the keys whose operations cannot be linearized.
+func checkLinearizable(operations []historyOperation) []string {
+	partitions := map[string][]historyOperation{}
+	for _, operation := range operations {
+		partitions[operation.Input.Key] = append(partitions[operation.Input.Key], operation)
+	}
+
+	failed := make([]string, 0)
+	for key, partition := range partitions {
+		check := &linearizabilityCheck{
+			operations: partition,
+			visited:    map[string]struct{}{},
+		}
+		for _, operation := range partition {
+			if !operation.Info() {
+				check.required++
+			}
+		}
+
+		if !check.search(make([]bool, len(partition)), 0, -1) {
+			failed = append(failed, key)
+		}
+	}
+	sort.Strings(failed)
+
+	return failed
+}
+
+// search tries to place every remaining operation after the ones that are placed, starting from the
+// state provided.
+func (c *linearizabilityCheck) search(placed []bool, count, state int) bool {
+	if count == c.required {
+		return true
+	}
+
+	visit := fmt.Sprint(placed, state)
+	if _, ok := c.visited[visit]; ok {
+		return false
+	}
+	c.visited[visit] = struct{}{}
+
+	// The next operation must have been invoked before every remaining operation completed,
+	// otherwise the one that completed first would have to be placed before it.
+	next := int64(math.MaxInt64)
+	for i, operation := range c.operations {
+		if !placed[i] && operation.Return < next {
+			next = operation.Return
+		}
+	}
+
+	for i, operation := range c.operations {
+		if placed[i] || operation.Call > next {
+			continue
+		}
+
+		after, ok := operation.step(state)
+		if !ok {
+			continue
+		}
+
+		placed[i] = true
+		required := count
+		if !operation.Info() {
+			required++
+		}
+		found := c.search(placed, required, after)
+		placed[i] = false
+
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeHistory writes the operations to the history directory if one was provided.
+func writeHistory(t *testing.T, operations []historyOperation) {
+	if *historyDirectory == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(operations, "", "  ")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()) + ".json"
+	assert.NoError(t, ioutil.WriteFile(path.Join(*historyDirectory, name), data, 0644))
+}
+
+// runHistoryClient makes random operations against the database until it has made count of them
+// or the disk has been imaged for a crash. If fs is nil then the database never crashes.
+func runHistoryClient(
+	db *DB, fs *crashFS, recorder *historyRecorder, random *rand.Rand, clientId, count int,
+) {
+	crashed := func() bool {
+		return fs != nil && fs.Crashed()
+	}
+
+	for i := 0; i < count && !crashed(); i++ {
+		input := historyInput{
+			Key: fmt.Sprintf("key%d", random.Intn(3)),
+		}
+		switch n := random.Intn(10); {
+		case n < 4:
+			input.Kind = historyGet
+		case n < 7:
+			input.Kind = historyPut
+			input.Value = clientId*1000000 + i
+		default:
+			input.Kind = historyIncrement
+		}
+
+		call := recorder.Invoke(clientId, input)
+		output, err := runHistoryOperation(db, input)
+		switch {
+		case crashed():
+			// Anything that completed after the disk was imaged is lost along with the database.
+			call.Info(output)
+		case err == nil:
+			call.Ok(output)
+		case err == ErrTxnConflict:
+			call.Fail()
+		default:
+			call.Info(output)
+		}
+	}
+}
+
+// runHistoryOperation makes a single operation in a transaction of its own.
+func runHistoryOperation(db *DB, input historyInput) (output historyOutput, err error) {
+	txn, err := db.NewTransaction(TxnOptions{ReadOnly: input.Kind == historyGet})
+	if err != nil {
+		return output, err
+	}
+	defer txn.Discard()
+
+	if input.Kind != historyPut {
+		item, err := txn.Get(Key(input.Key))
+		if err == nil {
+			output.Found = true
+			if output.Value, err = strconv.Atoi(string(item.Value)); err != nil {
+				return output, err
+			}
+		} else if err != ErrKeyNotFound {
+			return output, err
+		}
+	}
+
+	switch input.Kind {
+	case historyGet:
+		return output, nil
+	case historyPut:
+		err = txn.Set(Key(input.Key), []byte(strconv.Itoa(input.Value)))
+	case historyIncrement:
+		err = txn.Set(Key(input.Key), []byte(strconv.Itoa(output.Value+1)))
+	}
+	if err != nil {
+		return output, err
+	}
+
+	return output, txn.Commit()
+}
+
+// runHistoryClients runs the clients against the database at the same time.
+func runHistoryClients(
+	db *DB, fs *crashFS, recorder *historyRecorder, random *rand.Rand, clients, count int,
+) {
+	var group sync.WaitGroup
+	for clientId := 0; clientId < clients; clientId++ {
+		group.Add(1)
+		go func(clientId int, random *rand.Rand) {
+			defer group.Done()
+			runHistoryClient(db, fs, recorder, random, clientId, count)
+		}(clientId, rand.New(rand.NewSource(random.Int63())))
+	}
+	group.Wait()
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	put := func(client int, key string, value int, call, returned int64) historyOperation {
+		return historyOperation{
+			ClientId: client,
+			Input:    historyInput{Kind: historyPut, Key: key, Value: value},
+			Call:     call,
+			Return:   returned,
+		}
+	}
+
+	get := func(client int, key string, value int, call, returned int64) historyOperation {
+		return historyOperation{
+			ClientId: client,
+			Input:    historyInput{Kind: historyGet, Key: key},
+			Call:     call,
+			Output:   historyOutput{Value: value, Found: true},
+			Return:   returned,
+		}
+	}
+
+	t.Run("concurrent operations", func(t *testing.T) {
+		// The get overlaps both puts, so it can see either of them.
+		assert.Empty(t, checkLinearizable([]historyOperation{
+			put(0, "a", 1, 0, 10),
+			put(1, "a", 2, 5, 15),
+			get(2, "a", 1, 1, 20),
+			get(2, "a", 2, 21, 22),
+		}))
+	})
+
+	t.Run("stale read", func(t *testing.T) {
+		assert.Equal(t, []string{"a"}, checkLinearizable([]historyOperation{
+			put(0, "a", 1, 0, 10),
+			put(0, "a", 2, 11, 20),
+			get(1, "a", 1, 21, 30),
+			{
+				ClientId: 1,
+				Input:    historyInput{Kind: historyGet, Key: "b"},
+				Call:     21,
+				Return:   30,
+			},
+		}))
+	})
+
+	t.Run("lost update", func(t *testing.T) {
+		increment := func(client int, read int, call, returned int64) historyOperation {
+			return historyOperation{
+				ClientId: client,
+				Input:    historyInput{Kind: historyIncrement, Key: "a"},
+				Call:     call,
+				Output:   historyOutput{Value: read, Found: true},
+				Return:   returned,
+			}
+		}
+
+		// Two concurrent increments that both read 1 can only both succeed if one of them was
+		// lost.
+		assert.Equal(t, []string{"a"}, checkLinearizable([]historyOperation{
+			put(0, "a", 1, 0, 10),
+			increment(1, 1, 11, 20),
+			increment(2, 1, 12, 21),
+		}))
+	})
+
+	t.Run("info operations are optional", func(t *testing.T) {
+		assert.Empty(t, checkLinearizable([]historyOperation{
+			put(0, "a", 1, 0, 10),
+			put(1, "a", 2, 11, math.MaxInt64),
+			get(2, "a", 1, 20, 30),
+			get(2, "a", 2, 31, 40),
+			get(2, "a", 2, 41, 50),
+		}))
+		assert.Equal(t, []string{"a"}, checkLinearizable([]historyOperation{
+			put(0, "a", 1, 0, 10),
+			put(1, "a", 2, 11, math.MaxInt64),
+			get(2, "a", 2, 31, 40),
+			get(2, "a", 1, 41, 50),
+		}))
+	})
+}
+
+func TestTxn_Linearizable(t *testing.T) {
+	seeds := 10
+	if testing.Short() {
+		seeds = 2
+	}
+
+	t.Run("concurrent clients", func(t *testing.T) {
+		for seed := int64(1); seed <= int64(seeds); seed++ {
+			db, cleanup := newTestDB(t, DefaultOptions())
+			recorder := newHistoryRecorder()
+			runHistoryClients(db, nil, recorder, rand.New(rand.NewSource(seed)), 4, 100)
+			cleanup()
+
+			operations := recorder.Operations()
+			writeHistory(t, operations)
+			assert.Empty(t, checkLinearizable(operations), "seed %d", seed)
+		}
+	})
+
+	t.Run("crashes", func(t *testing.T) {
+		for seed := int64(1); seed <= int64(seeds); seed++ {
+			random := rand.New(rand.NewSource(seed))
+			source, cleanupSource := NewTempDirectory(t)
+			image, cleanupImage := NewTempDirectory(t)
+
+			options := DefaultOptions()
+			options.DataDirectory, options.WALDirectory = source, source
+			db, err := Open(options)
+			if !assert.NoError(t, err) {
+				cleanupSource()
+				cleanupImage()
+				return
+			}
+
+			// Every write is at least two writes to the WAL, the crash lands somewhere in the
+			// first few hundred of them.
+			fs := newCrashFS(rand.New(rand.NewSource(random.Int63())), source, image,
+				random.Intn(600)+1)
+			db.wal.appendLock.Lock()
+			db.wal.wrapSegment = fs.Wrap
+			db.wal.appendLock.Unlock()
+
+			recorder := newHistoryRecorder()
+			runHistoryClients(db, fs, recorder, random, 4, 100)
+			assert.NoError(t, fs.Crash())
+			_ = db.Close()
+
+			// The clients carry on against whatever the database recovered.
+			options.DataDirectory, options.WALDirectory = image, image
+			db, err = Open(options)
+			if assert.NoError(t, err, "seed %d", seed) {
+				runHistoryClients(db, nil, recorder, random, 4, 50)
+				assert.NoError(t, db.Close())
+			}
+			cleanupSource()
+			cleanupImage()
+
+			operations := recorder.Operations()
+			writeHistory(t, operations)
+			assert.Empty(t, checkLinearizable(operations), "seed %d", seed)
+		}
+	})
+}
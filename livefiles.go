@@ -0,0 +1,82 @@
+package lsmtree
+
+import (
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// LiveFile describes a single heap file that the database is using. It has enough information
+	// to decide which files hold a range of keys, like when splitting a shard, and to copy and
+	// validate the files, like a backup would.
+	LiveFile struct {
+		// Id is the heapId of the file, and Path is where it is stored.
+		Id   uint64
+		Path string
+
+		// Level is the level of the tree that the file is in.
+		Level int
+
+		// Smallest and Largest are the first and last keys in the file. They are nil if the file
+		// does not record them, in which case the file could hold any key.
+		Smallest Key
+		Largest  Key
+
+		// Size is the number of bytes in the file and Checksum is the checksum of all of them, as
+		// they were recorded in the manifest.
+		Size     int64
+		Checksum uint32
+
+		// Entries is the number of keys in the file, including tombstones. PointDeletions and
+		// RangeDeletions are how many of them are tombstones for a single key or a range of keys.
+		Entries        uint64
+		PointDeletions uint64
+		RangeDeletions uint64
+
+		// CreatedAt is when the file was written. Heap files are never modified once they are
+		// finished, so this is the modification time of the file.
+		CreatedAt time.Time
+	}
+)
+
+// LiveFiles returns every heap file that the database is using, sorted by Id. The files will not
+// change, but they can be removed from the database by a compaction at any time after they are
+// returned, so anything that copies them should expect them to disappear.
+func (db *DB) LiveFiles() ([]LiveFile, error) {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return nil, ErrClosed
+	}
+
+	files := make([]LiveFile, 0)
+	for _, file := range db.manifest.Files() {
+		if file.Kind != fileTypeHeap {
+			continue
+		}
+
+		directory := db.manifest.fileDirectory(file.Kind, file.Id)
+		filePath := path.Join(directory, getHeapFileName(file.Id))
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		properties := db.heapProperties.Get(file.Id)
+		files = append(files, LiveFile{
+			Id:             file.Id,
+			Path:           filePath,
+			Level:          file.Level,
+			Smallest:       properties.Smallest,
+			Largest:        properties.Largest,
+			Size:           file.Size,
+			Checksum:       file.Checksum,
+			Entries:        properties.Entries,
+			PointDeletions: properties.PointDeletions,
+			RangeDeletions: properties.RangeDeletions,
+			CreatedAt:      info.ModTime(),
+		})
+	}
+
+	return files, nil
+}
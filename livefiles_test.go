@@ -0,0 +1,73 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestDB_LiveFiles(t *testing.T) {
+	t.Run("heap files", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		files, err := db.LiveFiles()
+		assert.NoError(t, err)
+		assert.Empty(t, files)
+
+		// Heap files cannot be written yet, so finished files are added to the manifest by hand.
+		for id := uint64(1); id <= 2; id++ {
+			filePath := path.Join(db.options.DataDirectory, getHeapFileName(id))
+			assert.NoError(t, ioutil.WriteFile(filePath, []byte("heap file"), 0644))
+			assert.NoError(t, db.manifest.AddFile(fileTypeHeap, id))
+		}
+		assert.NoError(t, db.manifest.MoveFiles([]uint64{2}, 3))
+		db.heapProperties.Set(2, tableProperties{
+			Entries:        10,
+			PointDeletions: 2,
+			RangeDeletions: 1,
+			Smallest:       Key("a"),
+			Largest:        Key("m"),
+		})
+
+		// Value files are not heap files.
+		valuePath := path.Join(db.options.DataDirectory, getValueFileName(1))
+		assert.NoError(t, ioutil.WriteFile(valuePath, []byte("value file"), 0644))
+		assert.NoError(t, db.manifest.AddFile(fileTypeValue, 1))
+
+		files, err = db.LiveFiles()
+		assert.NoError(t, err)
+		assert.Len(t, files, 2)
+
+		assert.Equal(t, uint64(1), files[0].Id)
+		assert.Equal(t, 0, files[0].Level)
+		assert.Nil(t, files[0].Smallest)
+		assert.Nil(t, files[0].Largest)
+
+		second := files[1]
+		assert.Equal(t, uint64(2), second.Id)
+		assert.Equal(t, path.Join(db.options.DataDirectory, getHeapFileName(2)), second.Path)
+		assert.Equal(t, 3, second.Level)
+		assert.Equal(t, Key("a"), second.Smallest)
+		assert.Equal(t, Key("m"), second.Largest)
+		assert.Equal(t, int64(len("heap file")), second.Size)
+		assert.Equal(t, uint64(10), second.Entries)
+		assert.Equal(t, uint64(2), second.PointDeletions)
+		assert.Equal(t, uint64(1), second.RangeDeletions)
+		assert.False(t, second.CreatedAt.IsZero())
+
+		checksum, _, err := getFileChecksum(second.Path)
+		assert.NoError(t, err)
+		assert.Equal(t, checksum, second.Checksum)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		assert.NoError(t, db.Close())
+		_, err := db.LiveFiles()
+		assert.Equal(t, ErrClosed, err)
+	})
+}
@@ -0,0 +1,101 @@
+package lsmtree
+
+import (
+	"errors"
+	"os"
+	"path"
+	"time"
+)
+
+var (
+	// ErrDatabaseLocked is returned by Open when another process (or another DB in this process)
+	// already has the database open.
+	ErrDatabaseLocked = errors.New("database is locked by another process")
+)
+
+const (
+	// lockFileName is the name of the file in each database directory that is locked while the
+	// database is open.
+	lockFileName = "LOCK"
+
+	// lockRetryInterval is how long Open waits before trying to lock a directory again, while
+	// Options.LockTimeout has not passed.
+	lockRetryInterval = 10 * time.Millisecond
+)
+
+// directoryLock is an exclusive lock on a database directory. The lock is held by keeping a lock
+// file open with an OS level lock on it, this means the lock is released by the OS if the process
+// exits without releasing it. When Options.LockLease is set the directory is leased instead and
+// file is nil.
+type directoryLock struct {
+	file  *os.File
+	lease *directoryLease
+}
+
+// acquireDirectoryLock locks the directory the way the options ask for. If the directory is locked
+// by someone else then this keeps trying until Options.LockTimeout has passed before returning
+// ErrDatabaseLocked, so that a database can be opened while the process that had it open before
+// is still shutting down.
+func acquireDirectoryLock(directory string, options Options) (*directoryLock, error) {
+	deadline := time.Now().Add(options.LockTimeout)
+	for {
+		lock, err := lockDirectoryWithOptions(directory, options)
+		if err != ErrDatabaseLocked || !time.Now().Before(deadline) {
+			return lock, err
+		}
+
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// lockDirectoryWithOptions makes a single attempt to lock the directory, with a lease if
+// Options.LockLease is set or with an OS level lock otherwise.
+func lockDirectoryWithOptions(directory string, options Options) (*directoryLock, error) {
+	if options.LockLease == 0 {
+		return lockDirectory(directory, options.FileMode)
+	}
+
+	lease, err := leaseDirectory(
+		directory, options.FileMode, options.Clock, options.LockLease, options.Logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &directoryLock{
+		lease: lease,
+	}, nil
+}
+
+// lockDirectory will acquire an exclusive lock on the directory provided. If the directory is
+// already locked then ErrDatabaseLocked is returned immediately rather than waiting. If the lock
+// file does not exist it will be created with the permissions provided.
+func lockDirectory(directory string, mode os.FileMode) (*directoryLock, error) {
+	file, err := os.OpenFile(path.Join(directory, lockFileName), os.O_CREATE|os.O_RDWR, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(file); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &directoryLock{
+		file: file,
+	}, nil
+}
+
+// Release will unlock the directory. The lock file is left in place, but a lease file is removed.
+func (l *directoryLock) Release() error {
+	if l.lease != nil {
+		return l.lease.Release()
+	}
+
+	if err := unlockFile(l.file); err != nil {
+		_ = l.file.Close()
+		return err
+	}
+
+	return l.file.Close()
+}
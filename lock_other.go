@@ -0,0 +1,29 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly,!windows
+
+package lsmtree
+
+import (
+	"os"
+)
+
+// lockFile does nothing on platforms where we do not know how to lock files.
+func lockFile(file *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing on platforms where we do not know how to lock files.
+func unlockFile(file *os.File) error {
+	return nil
+}
+
+// processExists always returns true on platforms where we do not know how to find processes, a
+// lease held by another process can only be taken over once it expires.
+func processExists(pid int) bool {
+	return true
+}
+
+// syncDirectory does nothing on platforms where we do not know how to sync directories.
+func syncDirectory(directory string) error {
+	return nil
+}
@@ -0,0 +1,90 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLockDirectory(t *testing.T) {
+	t.Run("exclusive", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		lock, err := lockDirectory(dir, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, lock)
+
+		other, err := lockDirectory(dir, defaultFileMode)
+		assert.Equal(t, ErrDatabaseLocked, err)
+		assert.Nil(t, other)
+
+		assert.NoError(t, lock.Release())
+
+		// Once the lock has been released it should be possible to lock the directory again.
+		other, err = lockDirectory(dir, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, other)
+		assert.NoError(t, other.Release())
+	})
+
+	t.Run("directory doesnt exist", func(t *testing.T) {
+		lock, err := lockDirectory("tmp", defaultFileMode)
+		assert.Error(t, err)
+		assert.Nil(t, lock)
+	})
+}
+
+func TestAcquireDirectoryLock(t *testing.T) {
+	t.Run("retry until released", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		lock, err := lockDirectory(dir, defaultFileMode)
+		assert.NoError(t, err)
+
+		options := DefaultOptions()
+		_, err = acquireDirectoryLock(dir, options)
+		assert.Equal(t, ErrDatabaseLocked, err)
+
+		released := make(chan error, 1)
+		go func() {
+			time.Sleep(lockRetryInterval * 5)
+			released <- lock.Release()
+		}()
+
+		options.LockTimeout = time.Minute
+		other, err := acquireDirectoryLock(dir, options)
+		assert.NoError(t, err)
+		assert.NoError(t, <-released)
+		assert.NoError(t, other.Release())
+	})
+
+	t.Run("lease", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.LockLease = time.Minute
+		lock, err := acquireDirectoryLock(dir, options)
+		assert.NoError(t, err)
+		assert.Nil(t, lock.file)
+		assert.True(t, getPathExists(path.Join(dir, leaseFileName)))
+
+		_, err = acquireDirectoryLock(dir, options)
+		assert.Equal(t, ErrDatabaseLocked, err)
+
+		assert.NoError(t, lock.Release())
+		assert.False(t, getPathExists(path.Join(dir, leaseFileName)))
+	})
+}
+
+func TestSyncDirectory(t *testing.T) {
+	t.Run("simple", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		assert.NoError(t, syncDirectory(dir))
+	})
+}
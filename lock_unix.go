@@ -0,0 +1,48 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package lsmtree
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on the file without blocking.
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrDatabaseLocked
+	}
+
+	return err
+}
+
+// unlockFile releases the flock on the file.
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// processExists returns true if a process with the pid is running. A process that exists but
+// belongs to another user cannot be signalled, but it still exists.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+
+	return err == nil || err == syscall.EPERM
+}
+
+// syncDirectory will flush the directory entry changes (like newly created files) to the disk. A
+// newly created file is not guaranteed to exist after a crash until its directory has been synced.
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+
+	if err := dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+
+	return dir.Close()
+}
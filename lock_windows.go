@@ -0,0 +1,64 @@
+//go:build windows
+// +build windows
+
+package lsmtree
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// These flags are used with LockFileEx.
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+
+	// errorLockViolation is returned when the file is already locked by another handle.
+	errorLockViolation syscall.Errno = 33
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// lockFile takes an exclusive lock on the first byte of the file without blocking.
+func lockFile(file *os.File) error {
+	overlapped := &syscall.Overlapped{}
+	r, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0,
+		1, 0, uintptr(unsafe.Pointer(overlapped)))
+	if r == 0 {
+		if err == errorLockViolation {
+			return ErrDatabaseLocked
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// unlockFile releases the lock taken by lockFile.
+func unlockFile(file *os.File) error {
+	overlapped := &syscall.Overlapped{}
+	r, _, err := procUnlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(overlapped)))
+	if r == 0 {
+		return err
+	}
+
+	return nil
+}
+
+// processExists always returns true on windows, a lease held by another process can only be
+// taken over once it expires.
+func processExists(pid int) bool {
+	return true
+}
+
+// syncDirectory does nothing on windows. Directories cannot be opened for syncing, NTFS makes
+// directory entries durable as part of syncing the file itself.
+func syncDirectory(directory string) error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package lsmtree
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// LookupStats count where each point lookup made with Txn.Get was answered. Together they
+	// show how far down the read path lookups have to go, and how often they find nothing at all.
+	LookupStats struct {
+		// Pending is the number of lookups answered by a change the transaction made itself.
+		Pending uint64
+
+		// RowCache is the number of lookups answered by the row cache. See Options.RowCacheSize.
+		RowCache uint64
+
+		// Memtable is the number of lookups that found the key in the memtable.
+		Memtable uint64
+
+		// NegativeCache is the number of lookups for missing keys that were answered by the
+		// negative lookup cache without searching anything else. See
+		// Options.NegativeLookupCacheSize.
+		NegativeCache uint64
+
+		// NotFound is the number of lookups that searched everything and did not find the key.
+		NotFound uint64
+	}
+
+	// lookupCounters are the live counters behind LookupStats, they are only modified atomically.
+	lookupCounters struct {
+		pending       uint64
+		rowCache      uint64
+		memtable      uint64
+		negativeCache uint64
+		notFound      uint64
+	}
+
+	// negativeCache remembers keys that were recently looked up and not found, so that repeated
+	// lookups of hot missing keys do not have to search the whole read path. Keys are evicted in
+	// least recently used order once the cache is full.
+	//
+	// Each entry records the snapshot timestamp the key was found to be missing at. An entry can
+	// only answer lookups at that timestamp or newer, and every write removes the keys it changes
+	// before it becomes visible. To avoid caching a result that a concurrent write has already
+	// made stale, an entry is only added if no write newer than its timestamp has been applied.
+	negativeCache struct {
+		lock     sync.Mutex
+		capacity int
+		entries  map[string]*list.Element
+		order    *list.List
+
+		// highWater is the newest timestamp of any write that has removed keys from the cache.
+		highWater uint64
+	}
+
+	// negativeCacheEntry is a single missing key in the negativeCache.
+	negativeCacheEntry struct {
+		key       string
+		timestamp uint64
+	}
+)
+
+// Stats returns a snapshot of the counters.
+func (c *lookupCounters) Stats() LookupStats {
+	return LookupStats{
+		Pending:       atomic.LoadUint64(&c.pending),
+		RowCache:      atomic.LoadUint64(&c.rowCache),
+		Memtable:      atomic.LoadUint64(&c.memtable),
+		NegativeCache: atomic.LoadUint64(&c.negativeCache),
+		NotFound:      atomic.LoadUint64(&c.notFound),
+	}
+}
+
+// Add returns the sum of the two sets of stats.
+func (s LookupStats) Add(other LookupStats) LookupStats {
+	return LookupStats{
+		Pending:       s.Pending + other.Pending,
+		RowCache:      s.RowCache + other.RowCache,
+		Memtable:      s.Memtable + other.Memtable,
+		NegativeCache: s.NegativeCache + other.NegativeCache,
+		NotFound:      s.NotFound + other.NotFound,
+	}
+}
+
+// newNegativeCache creates a cache that holds up to capacity keys. If capacity is 0 then nothing
+// is cached.
+func newNegativeCache(capacity int) *negativeCache {
+	return &negativeCache{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// Contains returns true if the key is known to be missing for a lookup at the timestamp provided.
+func (c *negativeCache) Contains(key Key, timestamp uint64) bool {
+	if c.capacity == 0 {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[string(key)]
+	if !ok || element.Value.(*negativeCacheEntry).timestamp > timestamp {
+		return false
+	}
+	c.order.MoveToFront(element)
+
+	return true
+}
+
+// Add records that the key was missing at the timestamp provided.
+func (c *negativeCache) Add(key Key, timestamp uint64) {
+	if c.capacity == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// A write newer than the lookup has been applied, it may have set this key after the lookup
+	// missed it.
+	if timestamp < c.highWater {
+		return
+	}
+
+	if element, ok := c.entries[string(key)]; ok {
+		element.Value.(*negativeCacheEntry).timestamp = timestamp
+		c.order.MoveToFront(element)
+		return
+	}
+
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*negativeCacheEntry).key)
+	}
+
+	c.entries[string(key)] = c.order.PushFront(&negativeCacheEntry{
+		key:       string(key),
+		timestamp: timestamp,
+	})
+}
+
+// Invalidate removes every key changed by a write at the timestamp provided. This must be called
+// after the write has been applied to the memtable and before it is visible to new transactions.
+func (c *negativeCache) Invalidate(timestamp uint64, changes []walTransactionChange) {
+	if c.capacity == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if timestamp > c.highWater {
+		c.highWater = timestamp
+	}
+
+	for _, change := range changes {
+		if element, ok := c.entries[string(change.Key)]; ok {
+			c.order.Remove(element)
+			delete(c.entries, string(change.Key))
+		}
+	}
+}
+
+// Len returns the number of keys in the cache.
+func (c *negativeCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
@@ -0,0 +1,90 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNegativeCache(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		c := newNegativeCache(0)
+		c.Add(Key("a"), 1)
+		assert.False(t, c.Contains(Key("a"), 1))
+	})
+
+	t.Run("timestamps", func(t *testing.T) {
+		c := newNegativeCache(10)
+		c.Add(Key("a"), 5)
+
+		// The key is only known to be missing at or after the lookup that missed it.
+		assert.False(t, c.Contains(Key("a"), 4))
+		assert.True(t, c.Contains(Key("a"), 5))
+		assert.True(t, c.Contains(Key("a"), 9))
+
+		// Writing the key removes it.
+		c.Invalidate(6, []walTransactionChange{{Key: Key("a")}})
+		assert.False(t, c.Contains(Key("a"), 9))
+
+		// A lookup older than a write that has already been applied could have missed the write.
+		c.Add(Key("b"), 5)
+		assert.False(t, c.Contains(Key("b"), 9))
+		c.Add(Key("b"), 6)
+		assert.True(t, c.Contains(Key("b"), 9))
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		c := newNegativeCache(2)
+		c.Add(Key("a"), 1)
+		c.Add(Key("b"), 1)
+		assert.True(t, c.Contains(Key("a"), 1))
+
+		// b is now the least recently used.
+		c.Add(Key("c"), 1)
+		assert.Equal(t, 2, c.Len())
+		assert.True(t, c.Contains(Key("a"), 1))
+		assert.False(t, c.Contains(Key("b"), 1))
+		assert.True(t, c.Contains(Key("c"), 1))
+	})
+}
+
+func TestTxn_GetLookupStats(t *testing.T) {
+	options := DefaultOptions()
+	options.NegativeLookupCacheSize = 16
+	db, cleanup := newTestDB(t, options)
+	defer cleanup()
+
+	get := func(key string) error {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		_, err = txn.Get(Key(key))
+		return err
+	}
+
+	txn, err := db.NewTransaction(TxnOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Set(Key("a"), []byte("value")))
+	_, err = txn.Get(Key("a"))
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Commit())
+
+	assert.NoError(t, get("a"))
+	assert.Equal(t, ErrKeyNotFound, get("missing"))
+	assert.Equal(t, ErrKeyNotFound, get("missing"))
+	assert.Equal(t, ErrKeyNotFound, get("missing"))
+
+	assert.Equal(t, LookupStats{
+		Pending:       1,
+		Memtable:      1,
+		NegativeCache: 2,
+		NotFound:      1,
+	}, db.Metrics().Lookups)
+
+	// Once the missing key is written it must be found again.
+	txn, err = db.NewTransaction(TxnOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Set(Key("missing"), []byte("value")))
+	assert.NoError(t, txn.Commit())
+	assert.NoError(t, get("missing"))
+}
@@ -0,0 +1,588 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/elliotcourant/buffers"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrBadManifestChecksum is returned when the manifest file is read but its contents do not
+	// match the checksum stored at the end of the file.
+	ErrBadManifestChecksum = errors.New("bad manifest checksum")
+
+	// ErrUnknownManifestVersion is returned when the manifest was written by a newer version of
+	// the database than the one reading it.
+	ErrUnknownManifestVersion = errors.New("unknown manifest version")
+
+	// ErrBadFileChecksum is returned by VerifyFileChecksums when the checksum of a file does not
+	// match the checksum that was recorded in the manifest when the file was finished.
+	ErrBadFileChecksum = errors.New("bad file checksum")
+
+	// ErrFileSizeMismatch is returned by VerifyFileChecksums when the size of a file does not
+	// match the size that was recorded in the manifest when the file was finished.
+	ErrFileSizeMismatch = errors.New("file size does not match manifest")
+
+	// ErrFormatUpgradeRequired is returned when a change needs a newer version of an on-disk
+	// format than the database is using. DB.OnDiskFormatUpgrade upgrades the formats.
+	ErrFormatUpgradeRequired = errors.New("on-disk format upgrade required")
+)
+
+const (
+	// manifestVersion is the version of the manifest format that is written. Version 2 added the
+	// applied index, manifests written with version 1 are still read and have an applied index of
+	// 0. Version 3 added the level of each file, files in older manifests are in level 0. Version 4
+	// added the WAL segment ids that have been leased, see LeaseSegmentIds.
+	manifestVersion = 4
+
+	// manifestFileEntrySize is the number of bytes each encoded manifestFile uses before version
+	// 3, which added one byte for the level.
+	manifestFileEntrySize = 1 + 8 + 8 + 4
+)
+
+type (
+	// manifest records every finished file that the database depends on. Each file is recorded
+	// with its size and a checksum of its entire contents, this way a backup or a copy of the
+	// database can be validated without understanding the structure of each file.
+	//
+	// The manifest is small, so every change rewrites the whole thing to a new manifest file. The
+	// new file is synced before the old one is removed, so a crash will always leave at least one
+	// complete manifest behind. The manifest with the largest Id is the current one.
+	manifest struct {
+		directory string
+		mode      os.FileMode
+
+		// syncer makes each file durable before it is added to the manifest.
+		syncer fileSyncer
+
+		// remove deletes a manifest file once a newer one has replaced it. The database hands
+		// these to its fileDeleter so that they are deleted at the same limited rate as every
+		// other obsolete file.
+		remove func(filePath string) error
+
+		// heap are the directories that heap files are striped across, if this is empty then heap
+		// files are in the same directory as the manifest.
+		heap heapDirectories
+
+		// lock must be held to read or modify the files or the manifestId.
+		lock sync.Mutex
+
+		// manifestId is the Id of the current manifest file. It is 0 if no manifest has been
+		// written yet.
+		manifestId uint64
+
+		// version is the version of the format that the manifest is written with. Manifests are
+		// rewritten with the version they were read with until they are upgraded by Upgrade, so
+		// that an older version of the database can still read them.
+		version int
+
+		// files are all of the files recorded in the manifest.
+		files map[manifestFileKey]manifestFile
+
+		// appliedIndex is the index of the last entry from an external log that has been applied
+		// to the database, see ApplyBatch.
+		appliedIndex uint64
+
+		// lastSegmentId is the largest WAL segment Id that has been leased, see LeaseSegmentIds.
+		lastSegmentId uint64
+	}
+
+	// manifestFileKey identifies a single file in the manifest.
+	manifestFileKey struct {
+		Kind fileType
+		Id   uint64
+	}
+
+	// manifestFile is the information recorded about a single file.
+	manifestFile struct {
+		Kind     fileType
+		Id       uint64
+		Size     int64
+		Checksum uint32
+
+		// Level is the level of the tree that a heap file is in. Files are always added in level
+		// 0, they only move deeper when they are compacted or moved with MoveFiles.
+		Level int
+	}
+)
+
+// openManifest will read the current manifest in the directory provided. If there is no manifest
+// then an empty one is returned, it will not be written until a file is added.
+func openManifest(directory string, mode os.FileMode) (*manifest, error) {
+	m := &manifest{
+		directory: directory,
+		mode:      mode,
+		syncer:    diskSyncer{},
+		remove:    os.Remove,
+		files:     map[manifestFileKey]manifestFile{},
+		version:   manifestVersion,
+	}
+
+	manifestId, err := getLastFileId(directory, fileTypeManifest)
+	if err != nil || manifestId == 0 {
+		return m, err
+	}
+
+	name := getManifestFileName(manifestId)
+	data, err := ioutil.ReadFile(path.Join(directory, name))
+	if err != nil {
+		return nil, err
+	}
+
+	files, appliedIndex, lastSegmentId, err := decodeManifest(data)
+	if err != nil {
+		return nil, newCorruptionError(name, 0, err)
+	}
+
+	for _, file := range files {
+		m.files[file.key()] = file
+	}
+	m.manifestId = manifestId
+	m.appliedIndex = appliedIndex
+	m.lastSegmentId = lastSegmentId
+	m.version = int(binary.BigEndian.Uint16(data))
+
+	return m, nil
+}
+
+// AddFile will checksum the file provided and record it in the manifest. This should only be
+// called once the file has been completely written, since any change to the file after this point
+// will be treated as corruption. The file and the directory are synced before the manifest refers
+// to the file, unless Options.SkipSyncOnSeal is enabled.
+func (m *manifest) AddFile(kind fileType, id uint64) error {
+	directory, name := m.fileDirectory(kind, id), getFileName(kind, id)
+	if err := m.syncFile(directory, name); err != nil {
+		return err
+	}
+
+	checksum, size, err := getFileChecksum(path.Join(directory, name))
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	file := manifestFile{
+		Kind:     kind,
+		Id:       id,
+		Size:     size,
+		Checksum: checksum,
+	}
+	m.files[file.key()] = file
+
+	return m.write()
+}
+
+// fileDirectory returns the directory that the file is stored in.
+func (m *manifest) fileDirectory(kind fileType, id uint64) string {
+	if kind == fileTypeHeap && len(m.heap) > 0 {
+		return m.heap.Find(id)
+	}
+
+	return m.directory
+}
+
+// syncFile makes the contents and the name of a finished file durable.
+func (m *manifest) syncFile(directory, name string) error {
+	file, err := os.Open(path.Join(directory, name))
+	if err != nil {
+		return err
+	}
+
+	if err = m.syncer.SyncFile(name, file); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return m.syncer.SyncDirectory(directory)
+}
+
+// RemoveFile will remove the file from the manifest. The file itself is not deleted.
+func (m *manifest) RemoveFile(kind fileType, id uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := manifestFileKey{Kind: kind, Id: id}
+	if _, ok := m.files[key]; !ok {
+		return nil
+	}
+	delete(m.files, key)
+
+	return m.write()
+}
+
+// MoveFiles moves the heap files to the level provided without rewriting them, this only changes
+// the manifest. Every file is moved by a single write of the manifest, so after a crash either all
+// of them have moved or none of them have.
+func (m *manifest) MoveFiles(ids []uint64, level int) error {
+	if err := m.requireVersion(3); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	previous := make([]manifestFile, 0, len(ids))
+	for _, id := range ids {
+		file, ok := m.files[manifestFileKey{Kind: fileTypeHeap, Id: id}]
+		if !ok {
+			return fmt.Errorf("cannot move %s, it is not in the manifest", getHeapFileName(id))
+		}
+		previous = append(previous, file)
+	}
+
+	for _, file := range previous {
+		moved := file
+		moved.Level = level
+		m.files[file.key()] = moved
+	}
+
+	if err := m.write(); err != nil {
+		for _, file := range previous {
+			m.files[file.key()] = file
+		}
+		return err
+	}
+
+	return nil
+}
+
+// AppliedIndex returns the index of the last entry from an external log that has been applied.
+func (m *manifest) AppliedIndex() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.appliedIndex
+}
+
+// SetAppliedIndex records the index of the last entry from an external log that has been applied.
+// The index is durable once this returns.
+func (m *manifest) SetAppliedIndex(index uint64) error {
+	if err := m.requireVersion(2); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	previous := m.appliedIndex
+	m.appliedIndex = index
+	if err := m.write(); err != nil {
+		m.appliedIndex = previous
+		return err
+	}
+
+	return nil
+}
+
+// LastSegmentId returns the largest WAL segment Id that has been leased. Every segment that has
+// been created has an Id less than or equal to this, unless it was created with a manifest from
+// before version 4.
+func (m *manifest) LastSegmentId() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.lastSegmentId
+}
+
+// LeaseSegmentIds records that WAL segments may be created with any Id up to and including the
+// one provided, and is durable once this returns. Manifests from before version 4 cannot record
+// it, nothing is written and segment Ids only come from the segments in the WAL directory like
+// they did before.
+func (m *manifest) LeaseSegmentIds(lastSegmentId uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.version < 4 || lastSegmentId <= m.lastSegmentId {
+		return nil
+	}
+
+	previous := m.lastSegmentId
+	m.lastSegmentId = lastSegmentId
+	if err := m.write(); err != nil {
+		m.lastSegmentId = previous
+		return err
+	}
+
+	return nil
+}
+
+// Version returns the version of the format that the manifest is written with.
+func (m *manifest) Version() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.version
+}
+
+// requireVersion returns ErrFormatUpgradeRequired if the manifest is written with a version older
+// than the one provided, the change that needs it cannot be recorded in the older version.
+func (m *manifest) requireVersion(version int) error {
+	if current := m.Version(); current < version {
+		return fmt.Errorf("%w: manifest is version %d, version %d is needed",
+			ErrFormatUpgradeRequired, current, version)
+	}
+
+	return nil
+}
+
+// Upgrade rewrites the manifest with the current version of the format. The new manifest replaces
+// the old one the same way as any other change, so after a crash the manifest is either entirely
+// upgraded or not upgraded at all. Nothing is written if the manifest is already up to date.
+func (m *manifest) Upgrade() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.version == manifestVersion {
+		return nil
+	}
+
+	previous := m.version
+	m.version = manifestVersion
+	if err := m.write(); err != nil {
+		m.version = previous
+		return err
+	}
+
+	return nil
+}
+
+// Files returns every file in the manifest sorted by kind and then by Id.
+func (m *manifest) Files() []manifestFile {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	files := make([]manifestFile, 0, len(m.files))
+	for _, file := range m.files {
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Kind != files[j].Kind {
+			return files[i].Kind < files[j].Kind
+		}
+
+		return files[i].Id < files[j].Id
+	})
+
+	return files
+}
+
+// Verify will checksum every file in the manifest and make sure that it matches what was recorded
+// when the file was added. A CorruptionError is returned for the first file that does not match.
+func (m *manifest) Verify() error {
+	for _, file := range m.Files() {
+		name := getFileName(file.Kind, file.Id)
+		checksum, size, err := getFileChecksum(path.Join(m.fileDirectory(file.Kind, file.Id), name))
+		switch {
+		case err != nil:
+			return err
+		case size != file.Size:
+			return newCorruptionError(name, size, ErrFileSizeMismatch)
+		case checksum != file.Checksum:
+			return newCorruptionError(name, 0, ErrBadFileChecksum)
+		}
+	}
+
+	return nil
+}
+
+// write will write the files to a new manifest file and then remove the old manifest. The lock
+// must be held.
+func (m *manifest) write() error {
+	files := make([]manifestFile, 0, len(m.files))
+	for _, file := range m.files {
+		files = append(files, file)
+	}
+
+	manifestId := m.manifestId + 1
+	filePath := path.Join(m.directory, getManifestFileName(manifestId))
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, m.mode&os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	data := encodeManifest(files, m.appliedIndex, m.lastSegmentId, m.version)
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	// The new manifest needs to be durable before the old one is removed, otherwise a crash could
+	// leave us without any manifest at all.
+	if err = syncDirectory(m.directory); err != nil {
+		return err
+	}
+
+	if m.manifestId > 0 {
+		err = m.remove(path.Join(m.directory, getManifestFileName(m.manifestId)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	m.manifestId = manifestId
+
+	return nil
+}
+
+// key returns the key the file is stored under in the manifest.
+func (f manifestFile) key() manifestFileKey {
+	return manifestFileKey{
+		Kind: f.Kind,
+		Id:   f.Id,
+	}
+}
+
+// encodeManifest returns the binary representation of the manifest in the version provided. Older
+// versions drop what they cannot store, see requireVersion.
+// 1. 2 Bytes: Version
+// 2. 8 Bytes: Applied Index (since version 2)
+// 3. 8 Bytes: Last Segment ID (since version 4)
+// 4. 4 Bytes: Number Of Files
+// 5. Repeated: 1 Byte File Type, 8 Bytes File ID, 8 Bytes Size, 4 Bytes Checksum, 1 Byte Level
+// (since version 3)
+// 6. 4 Bytes: Checksum of everything before it
+func encodeManifest(
+	files []manifestFile, appliedIndex, lastSegmentId uint64, version int,
+) []byte {
+	buf := buffers.NewBytesBuffer()
+	buf.AppendUint16(uint16(version))
+	if version >= 2 {
+		buf.AppendUint64(appliedIndex)
+	}
+	if version >= 4 {
+		buf.AppendUint64(lastSegmentId)
+	}
+	buf.AppendUint32(uint32(len(files)))
+	for _, file := range files {
+		buf.AppendByte(byte(file.Kind))
+		buf.AppendUint64(file.Id)
+		buf.AppendUint64(uint64(file.Size))
+		buf.AppendUint32(file.Checksum)
+		if version >= 3 {
+			buf.AppendByte(byte(file.Level))
+		}
+	}
+
+	h := fnv.New32()
+	_, _ = h.Write(buf.Bytes())
+	buf.AppendUint32(h.Sum32())
+
+	return buf.Bytes()
+}
+
+// decodeManifest reads the files, the applied index and the last segment Id from the binary
+// representation of a manifest.
+func decodeManifest(src []byte) (
+	files []manifestFile, appliedIndex, lastSegmentId uint64, err error,
+) {
+	if len(src) < 4 {
+		return nil, 0, 0, ErrTruncated
+	}
+
+	data, checksum := src[:len(src)-4], binary.BigEndian.Uint32(src[len(src)-4:])
+	h := fnv.New32()
+	_, _ = h.Write(data)
+	if h.Sum32() != checksum {
+		return nil, 0, 0, ErrBadManifestChecksum
+	}
+
+	buf := newBytesDecoder(data)
+	entrySize := manifestFileEntrySize
+	switch version := buf.NextUint16(); {
+	case buf.Err() != nil:
+	case version == 1:
+	case version == 2:
+		appliedIndex = buf.NextUint64()
+	case version == 3:
+		appliedIndex = buf.NextUint64()
+		entrySize++
+	case version == 4:
+		appliedIndex = buf.NextUint64()
+		lastSegmentId = buf.NextUint64()
+		entrySize++
+	default:
+		return nil, 0, 0, fmt.Errorf("%w: %d", ErrUnknownManifestVersion, version)
+	}
+
+	count := int(buf.NextUint32())
+	if err = buf.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	if count*entrySize > len(data) {
+		return nil, 0, 0, ErrTruncated
+	}
+
+	files = make([]manifestFile, count)
+	for i := range files {
+		files[i] = manifestFile{
+			Kind:     fileType(buf.NextByte()),
+			Id:       buf.NextUint64(),
+			Size:     int64(buf.NextUint64()),
+			Checksum: buf.NextUint32(),
+		}
+
+		if entrySize > manifestFileEntrySize {
+			files[i].Level = int(buf.NextByte())
+		}
+	}
+
+	if err = buf.Finish(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	return files, appliedIndex, lastSegmentId, nil
+}
+
+// getFileChecksum returns the checksum of the entire contents of the file as well as its size.
+func getFileChecksum(filePath string) (uint32, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	h := fnv.New32()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return h.Sum32(), size, nil
+}
+
+// VerifyFileChecksums will read every finished file that the database depends on and make sure
+// that its checksum matches the one recorded in the manifest when the file was written. This does
+// not need to understand the contents of any of the files, so it can be used to validate backups
+// or copies of the database. A CorruptionError is returned for the first file that does not match.
+func (db *DB) VerifyFileChecksums() error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	return db.manifest.Verify()
+}
@@ -0,0 +1,218 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		m, err := openManifest(dir, defaultFileMode)
+		assert.NoError(t, err)
+		assert.Empty(t, m.Files())
+		assert.NoError(t, m.Verify())
+
+		// Nothing should be written until a file is added.
+		ids, err := listFiles(dir, fileTypeManifest)
+		assert.NoError(t, err)
+		assert.Empty(t, ids)
+	})
+
+	t.Run("add and reopen", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		m, err := openManifest(dir, defaultFileMode)
+		assert.NoError(t, err)
+
+		for id := uint64(1); id <= 3; id++ {
+			data := make([]byte, id*10)
+			assert.NoError(t, ioutil.WriteFile(path.Join(dir, getHeapFileName(id)), data, 0644))
+			assert.NoError(t, m.AddFile(fileTypeHeap, id))
+		}
+		assert.NoError(t, m.RemoveFile(fileTypeHeap, 2))
+		assert.NoError(t, m.RemoveFile(fileTypeHeap, 10))
+
+		// Only the latest manifest should be left behind.
+		ids, err := listFiles(dir, fileTypeManifest)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{4}, ids)
+
+		reopened, err := openManifest(dir, defaultFileMode)
+		assert.NoError(t, err)
+		assert.Equal(t, m.Files(), reopened.Files())
+		assert.Len(t, reopened.Files(), 2)
+		assert.Equal(t, int64(30), reopened.Files()[1].Size)
+		assert.NoError(t, reopened.Verify())
+	})
+
+	t.Run("move files", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		m, err := openManifest(dir, defaultFileMode)
+		assert.NoError(t, err)
+
+		for id := uint64(1); id <= 3; id++ {
+			assert.NoError(t, ioutil.WriteFile(path.Join(dir, getHeapFileName(id)), []byte("a"), 0644))
+			assert.NoError(t, m.AddFile(fileTypeHeap, id))
+		}
+		assert.NoError(t, m.MoveFiles([]uint64{1, 3}, 2))
+
+		// A file that is not in the manifest stops any of the files from moving.
+		assert.Error(t, m.MoveFiles([]uint64{2, 4}, 1))
+
+		reopened, err := openManifest(dir, defaultFileMode)
+		assert.NoError(t, err)
+		levels := map[uint64]int{}
+		for _, file := range reopened.Files() {
+			levels[file.Id] = file.Level
+		}
+		assert.Equal(t, map[uint64]int{1: 2, 2: 0, 3: 2}, levels)
+		assert.NoError(t, reopened.Verify())
+	})
+
+	t.Run("syncs added files", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		m, err := openManifest(dir, defaultFileMode)
+		assert.NoError(t, err)
+		syncer := &recordingSyncer{}
+		m.syncer = syncer
+
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, getHeapFileName(1)), []byte("a"), 0644))
+		assert.NoError(t, m.AddFile(fileTypeHeap, 1))
+		assert.Equal(t, []string{
+			"file:" + getHeapFileName(1),
+			"directory:" + dir,
+		}, syncer.syncs)
+	})
+
+	t.Run("file changed", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		m, err := openManifest(dir, defaultFileMode)
+		assert.NoError(t, err)
+
+		filePath := path.Join(dir, getValueFileName(1))
+		assert.NoError(t, ioutil.WriteFile(filePath, []byte("some values"), 0644))
+		assert.NoError(t, m.AddFile(fileTypeValue, 1))
+
+		// Flip a byte without changing the size.
+		assert.NoError(t, ioutil.WriteFile(filePath, []byte("some valuez"), 0644))
+		err = m.Verify()
+		assert.True(t, errors.Is(err, ErrBadFileChecksum))
+		assert.True(t, errors.Is(err, ErrCorrupted))
+
+		assert.NoError(t, ioutil.WriteFile(filePath, []byte("some"), 0644))
+		assert.True(t, errors.Is(m.Verify(), ErrFileSizeMismatch))
+
+		assert.NoError(t, os.Remove(filePath))
+		assert.True(t, os.IsNotExist(m.Verify()))
+	})
+
+	t.Run("corrupt manifest", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		data := encodeManifest(
+			[]manifestFile{{Kind: fileTypeHeap, Id: 1, Size: 10, Checksum: 5}}, 0, 0, manifestVersion,
+		)
+		data[3] ^= 0xff
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, getManifestFileName(1)), data, 0644))
+
+		m, err := openManifest(dir, defaultFileMode)
+		assert.Nil(t, m)
+		assert.True(t, errors.Is(err, ErrBadManifestChecksum))
+		assert.True(t, errors.Is(err, ErrCorrupted))
+	})
+}
+
+func TestDecodeManifest(t *testing.T) {
+	files := []manifestFile{
+		{Kind: fileTypeHeap, Id: 1, Size: 10, Checksum: 5, Level: 1},
+		{Kind: fileTypeValue, Id: 2, Size: 20, Checksum: 6},
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		decoded, appliedIndex, lastSegmentId, err := decodeManifest(
+			encodeManifest(files, 42, 9, manifestVersion),
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, files, decoded)
+		assert.Equal(t, uint64(42), appliedIndex)
+		assert.Equal(t, uint64(9), lastSegmentId)
+	})
+
+	t.Run("encode older versions", func(t *testing.T) {
+		// Older versions drop the segment ids, levels and the applied index that they cannot
+		// store.
+		decoded, appliedIndex, lastSegmentId, err := decodeManifest(encodeManifest(files, 42, 9, 3))
+		assert.NoError(t, err)
+		assert.Equal(t, files, decoded)
+		assert.Zero(t, lastSegmentId)
+
+		decoded, appliedIndex, _, err = decodeManifest(encodeManifest(files, 42, 9, 2))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, decoded[0].Level)
+		assert.Equal(t, uint64(42), appliedIndex)
+
+		decoded, appliedIndex, _, err = decodeManifest(encodeManifest(files, 42, 9, 1))
+		assert.NoError(t, err)
+		assert.Len(t, decoded, 2)
+		assert.Zero(t, appliedIndex)
+	})
+
+	t.Run("version 1", func(t *testing.T) {
+		// Version 1 manifests do not have an applied index.
+		data := []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x00}
+		h := fnv.New32()
+		h.Write(data)
+
+		decoded, appliedIndex, _, err := decodeManifest(h.Sum(data))
+		assert.NoError(t, err)
+		assert.Empty(t, decoded)
+		assert.Zero(t, appliedIndex)
+	})
+
+	t.Run("version 2", func(t *testing.T) {
+		// Version 2 manifests do not have the level of each file, so every file is in level 0.
+		data := []byte{0x00, 0x02}
+		data = append(data, make([]byte, 8)...)
+		data = append(data, 0x00, 0x00, 0x00, 0x01)
+		data = append(data, byte(fileTypeHeap))
+		data = append(data, 0, 0, 0, 0, 0, 0, 0, 1)
+		data = append(data, 0, 0, 0, 0, 0, 0, 0, 10)
+		data = append(data, 0, 0, 0, 5)
+		h := fnv.New32()
+		h.Write(data)
+
+		decoded, _, _, err := decodeManifest(h.Sum(data))
+		assert.NoError(t, err)
+		assert.Equal(t, []manifestFile{{Kind: fileTypeHeap, Id: 1, Size: 10, Checksum: 5}}, decoded)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		_, _, _, err := decodeManifest([]byte{0x01})
+		assert.Equal(t, ErrTruncated, err)
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		data := []byte{0x00, manifestVersion + 1, 0x00, 0x00, 0x00, 0x00}
+		h := fnv.New32()
+		h.Write(data)
+
+		_, _, _, err := decodeManifest(h.Sum(data))
+		assert.True(t, errors.Is(err, ErrUnknownManifestVersion))
+	})
+}
@@ -0,0 +1,148 @@
+package lsmtree
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// MemoryUsage is the approximate number of bytes of memory being used by each part of the
+	// database.
+	MemoryUsage struct {
+		// Memtables is the memory used by memtables that have not been flushed to the disk yet.
+		Memtables int64
+
+		// BlockCache is the memory used by cached blocks from heap files. Heap files are not read
+		// yet, so this is always 0.
+		BlockCache int64
+
+		// TableCache is the memory used by open heap files, not including their blocks. Heap files
+		// are not read yet, so this is always 0.
+		TableCache int64
+
+		// IndexAndFilters is the memory used by the index and filter blocks of open heap files.
+		// Heap files are not read yet, so this is always 0.
+		IndexAndFilters int64
+
+		// RowCache is the memory used by whole key-value entries cached by Options.RowCacheSize.
+		RowCache int64
+	}
+
+	// memoryCategory is one of the parts of the database that memory usage is tracked for.
+	memoryCategory int
+
+	// memoryReclaimer is called when the database is using more memory than it is allowed to. It
+	// should try to free at least the number of bytes provided, and the memory that is freed must
+	// be given back with memoryAccountant.Add.
+	memoryReclaimer func(bytes int64)
+
+	// memoryAccountant keeps track of how much memory each part of the database is using. If the
+	// total grows beyond the max then the reclaimers are called to free memory. Caches are always
+	// shrunk before memtables would be flushed since flushing is much more expensive. Nothing can
+	// flush a memtable yet, so no reclaimer is registered for memoryMemtables.
+	memoryAccountant struct {
+		// max is the largest the total memory usage can be before memory is reclaimed. If this is
+		// 0 then memory is never reclaimed.
+		max int64
+
+		// usage is the number of bytes used by each category. It is only modified atomically.
+		usage [memoryCategoryCount]int64
+
+		// reclaiming is set to 1 atomically while reclaimers are being called. Only one thread
+		// will reclaim memory at a time, any other threads that go over the max while memory is
+		// being reclaimed will not wait for it.
+		reclaiming int32
+
+		// reclaimersLock must be held to read or modify the reclaimers.
+		reclaimersLock sync.Mutex
+
+		// reclaimers are called in order of their category when memory needs to be reclaimed.
+		reclaimers [memoryCategoryCount][]memoryReclaimer
+	}
+)
+
+const (
+	// The categories are ordered by the order that they should be reclaimed in.
+	memoryRowCache memoryCategory = iota
+	memoryBlockCache
+	memoryTableCache
+	memoryIndexAndFilters
+	memoryMemtables
+
+	// memoryCategoryCount is the number of categories and is not a category itself.
+	memoryCategoryCount
+)
+
+// Total returns the total memory used by every part of the database.
+func (m MemoryUsage) Total() int64 {
+	return m.Memtables + m.BlockCache + m.TableCache + m.IndexAndFilters + m.RowCache
+}
+
+// MemoryUsage returns the approximate amount of memory being used by the database.
+func (db *DB) MemoryUsage() MemoryUsage {
+	return db.memory.Usage()
+}
+
+// newMemoryAccountant creates a new memoryAccountant that will reclaim memory whenever more than
+// the max is being used. If max is 0 then memory will only be tracked.
+func newMemoryAccountant(max int64) *memoryAccountant {
+	return &memoryAccountant{
+		max: max,
+	}
+}
+
+// AddReclaimer registers a function that can free memory in the category specified.
+func (m *memoryAccountant) AddReclaimer(category memoryCategory, reclaimer memoryReclaimer) {
+	m.reclaimersLock.Lock()
+	defer m.reclaimersLock.Unlock()
+
+	m.reclaimers[category] = append(m.reclaimers[category], reclaimer)
+}
+
+// Add will change the memory used by the category by the number of bytes provided, the number
+// should be negative when memory is freed. If the total memory usage is now larger than the max
+// then memory will be reclaimed before Add returns.
+func (m *memoryAccountant) Add(category memoryCategory, bytes int64) {
+	atomic.AddInt64(&m.usage[category], bytes)
+
+	if bytes > 0 && m.max > 0 && m.Usage().Total() > m.max {
+		m.reclaim()
+	}
+}
+
+// Usage returns a snapshot of the memory used by each category.
+func (m *memoryAccountant) Usage() MemoryUsage {
+	return MemoryUsage{
+		Memtables:       atomic.LoadInt64(&m.usage[memoryMemtables]),
+		BlockCache:      atomic.LoadInt64(&m.usage[memoryBlockCache]),
+		TableCache:      atomic.LoadInt64(&m.usage[memoryTableCache]),
+		IndexAndFilters: atomic.LoadInt64(&m.usage[memoryIndexAndFilters]),
+		RowCache:        atomic.LoadInt64(&m.usage[memoryRowCache]),
+	}
+}
+
+// reclaim will call the reclaimers in order until the total memory usage is no longer above the
+// max, or until there are no reclaimers left.
+func (m *memoryAccountant) reclaim() {
+	// Reclaimers call Add when they free memory, and other threads might go over the max while we
+	// are reclaiming. There is no reason for either of them to reclaim memory as well.
+	if !atomic.CompareAndSwapInt32(&m.reclaiming, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&m.reclaiming, 0)
+
+	m.reclaimersLock.Lock()
+	reclaimers := m.reclaimers
+	m.reclaimersLock.Unlock()
+
+	for _, category := range reclaimers {
+		for _, reclaimer := range category {
+			over := m.Usage().Total() - m.max
+			if over <= 0 {
+				return
+			}
+
+			reclaimer(over)
+		}
+	}
+}
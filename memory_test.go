@@ -0,0 +1,81 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMemoryAccountant(t *testing.T) {
+	t.Run("usage", func(t *testing.T) {
+		memory := newMemoryAccountant(0)
+		memory.Add(memoryMemtables, 100)
+		memory.Add(memoryBlockCache, 50)
+		memory.Add(memoryTableCache, 25)
+		memory.Add(memoryIndexAndFilters, 10)
+		memory.Add(memoryBlockCache, -20)
+
+		assert.Equal(t, MemoryUsage{
+			Memtables:       100,
+			BlockCache:      30,
+			TableCache:      25,
+			IndexAndFilters: 10,
+		}, memory.Usage())
+		assert.Equal(t, int64(165), memory.Usage().Total())
+	})
+
+	t.Run("reclaim caches first", func(t *testing.T) {
+		memory := newMemoryAccountant(100)
+
+		var calls []string
+		memory.AddReclaimer(memoryMemtables, func(bytes int64) {
+			calls = append(calls, "memtables")
+			memory.Add(memoryMemtables, -bytes)
+		})
+		memory.AddReclaimer(memoryBlockCache, func(bytes int64) {
+			calls = append(calls, "block cache")
+
+			// The block cache can only give back part of what is needed.
+			memory.Add(memoryBlockCache, -10)
+		})
+
+		memory.Add(memoryMemtables, 80)
+		memory.Add(memoryBlockCache, 10)
+		assert.Empty(t, calls)
+
+		memory.Add(memoryMemtables, 30)
+		assert.Equal(t, []string{"block cache", "memtables"}, calls)
+		assert.Equal(t, int64(100), memory.Usage().Total())
+	})
+
+	t.Run("reclaim stops when under max", func(t *testing.T) {
+		memory := newMemoryAccountant(100)
+
+		var memtableCalls int
+		memory.AddReclaimer(memoryMemtables, func(bytes int64) {
+			memtableCalls++
+		})
+		memory.AddReclaimer(memoryBlockCache, func(bytes int64) {
+			memory.Add(memoryBlockCache, -bytes)
+		})
+
+		memory.Add(memoryBlockCache, 150)
+		assert.Equal(t, 0, memtableCalls)
+		assert.Equal(t, int64(100), memory.Usage().Total())
+	})
+}
+
+func TestDB_MemoryUsage(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	options := DefaultOptions()
+	options.WALDirectory = dir
+	options.DataDirectory = dir
+	options.MaxTotalMemory = 1024 * 1024
+
+	db, err := Open(options)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, MemoryUsage{}, db.MemoryUsage())
+}
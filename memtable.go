@@ -0,0 +1,221 @@
+package lsmtree
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// memtable holds the changes that have been committed but have not been flushed to a heap file
+	// yet. Every version of a key is kept, keyed by the key and the timestamp it was committed at.
+	//
+	// Reads never take a lock, so a large commit being applied never holds up Get or an iterator.
+	// Only writers are serialized, since the skiplist allows one writer alongside any number of
+	// readers.
+	memtable struct {
+		// size is the approximate number of bytes used by the keys and values in the memtable, it
+		// is only modified atomically. It is the first field so that it is 64-bit aligned on
+		// 32-bit platforms.
+		size int64
+
+		writeLock sync.Mutex
+		list      *skiplist
+	}
+
+	// memtableEntry is the value of a single version of a key in the memtable.
+	memtableEntry struct {
+		// Type is whether the key was set or deleted in this version.
+		Type walTransactionChangeType
+
+		// Value is the value that the key was set to, this is nil if the key was deleted.
+		Value []byte
+
+		// UserMeta is the metadata byte that was stored with the value.
+		UserMeta byte
+
+		// ExpiresAt is the unix time in seconds when the value expires, or 0 if it never does.
+		ExpiresAt uint64
+	}
+
+	// memtableIterator iterates over every version of every key in a memtable. It implements
+	// internalIterator, the keys it returns are TimestampedKeys.
+	memtableIterator struct {
+		memtable *memtable
+		node     *skiplistNode
+		lower    TimestampedKey
+		upper    Key
+	}
+)
+
+var (
+	_ internalIterator = &memtableIterator{}
+)
+
+const (
+	// memtableNodeOverhead is roughly how many bytes each entry in the memtable uses on top of its
+	// key and value.
+	memtableNodeOverhead = 64
+)
+
+// newMemtable creates an empty memtable.
+func newMemtable() *memtable {
+	return &memtable{
+		list: newSkiplist(),
+	}
+}
+
+// Apply adds every change to the memtable at the timestamp provided. It returns the number of
+// bytes that the memtable grew by.
+func (m *memtable) Apply(timestamp uint64, changes []walTransactionChange) int64 {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	var size int64
+	for _, change := range changes {
+		m.list.Put(newTimestampedKey(change.Key, timestamp), memtableEntry{
+			Type:      change.Type,
+			Value:     change.Value,
+			UserMeta:  change.UserMeta,
+			ExpiresAt: change.ExpiresAt,
+		})
+		size += int64(len(change.Key) + 8 + len(change.Value) + memtableNodeOverhead)
+	}
+	atomic.AddInt64(&m.size, size)
+
+	return size
+}
+
+// Get returns the newest version of the key that was committed at or before the timestamp
+// provided. If there is no such version then found will be false. The version returned may be a
+// delete.
+func (m *memtable) Get(key Key, timestamp uint64) (item Item, found bool) {
+	node := m.list.Seek(newTimestampedKey(key, timestamp))
+	if node == nil || !bytes.Equal(node.key.Key(), key) {
+		return Item{}, false
+	}
+
+	return node.Entry().Item(node.key), true
+}
+
+// Versions returns up to limit versions of the key that were committed at or before the timestamp
+// provided, newest first. Deletes are included.
+func (m *memtable) Versions(key Key, timestamp uint64, limit int) []Item {
+	var items []Item
+	node := m.list.Seek(newTimestampedKey(key, timestamp))
+	for ; node != nil && len(items) < limit; node = node.Next(0) {
+		if !bytes.Equal(node.key.Key(), key) {
+			break
+		}
+
+		items = append(items, node.Entry().Item(node.key))
+	}
+
+	return items
+}
+
+// Size returns the approximate number of bytes used by the memtable.
+func (m *memtable) Size() int64 {
+	return atomic.LoadInt64(&m.size)
+}
+
+// Len returns the number of versions stored in the memtable.
+func (m *memtable) Len() int {
+	return m.list.Len()
+}
+
+// Iterator returns an iterator over every version of every key in the memtable.
+func (m *memtable) Iterator() *memtableIterator {
+	return &memtableIterator{
+		memtable: m,
+	}
+}
+
+// Item returns the entry as an Item for the key provided.
+func (e memtableEntry) Item(key TimestampedKey) Item {
+	item := Item{
+		Key:       append(Key{}, key.Key()...),
+		UserMeta:  e.UserMeta,
+		Version:   key.Timestamp(),
+		ExpiresAt: e.ExpiresAt,
+	}
+	if e.Type == walTransactionChangeTypeSet {
+		// A key that has been set always has a non-nil value, even if it is empty.
+		item.Value = append([]byte{}, e.Value...)
+	}
+
+	return item
+}
+
+// SetBounds changes the bounds of the iterator. The bounds are keys without timestamps.
+func (i *memtableIterator) SetBounds(lower, upper []byte) {
+	i.lower, i.upper = nil, upper
+	if lower != nil {
+		// The newest possible version of the lower bound sorts before every other version of it.
+		i.lower = newTimestampedKey(lower, ^uint64(0))
+	}
+	i.node = nil
+}
+
+// SeekToFirst moves the iterator to the first version within the bounds.
+func (i *memtableIterator) SeekToFirst() {
+	if i.lower != nil {
+		i.node = i.memtable.list.Seek(i.lower)
+	} else {
+		i.node = i.memtable.list.First()
+	}
+	i.checkUpper()
+}
+
+// Seek moves the iterator to the first version that is greater than or equal to the timestamped
+// key provided.
+func (i *memtableIterator) Seek(key []byte) {
+	target := TimestampedKey(key)
+	if i.lower != nil && compareTimestampedKeys(target, i.lower) < 0 {
+		target = i.lower
+	}
+	i.node = i.memtable.list.Seek(target)
+	i.checkUpper()
+}
+
+// Next moves the iterator to the next version.
+func (i *memtableIterator) Next() {
+	if i.node == nil {
+		return
+	}
+
+	i.node = i.node.Next(0)
+	i.checkUpper()
+}
+
+// Valid returns true if the iterator is positioned on a version.
+func (i *memtableIterator) Valid() bool {
+	return i.node != nil
+}
+
+// Key returns the current timestamped key.
+func (i *memtableIterator) Key() []byte {
+	return i.node.key
+}
+
+// Entry returns the entry of the current version.
+func (i *memtableIterator) Entry() memtableEntry {
+	return i.node.Entry()
+}
+
+// Err always returns nil since reading a memtable cannot fail.
+func (i *memtableIterator) Err() error {
+	return nil
+}
+
+// Close releases the iterator.
+func (i *memtableIterator) Close() {
+	i.node = nil
+}
+
+// checkUpper invalidates the iterator if it has moved past the upper bound.
+func (i *memtableIterator) checkUpper() {
+	if i.node != nil && i.upper != nil && bytes.Compare(i.node.key.Key(), i.upper) >= 0 {
+		i.node = nil
+	}
+}
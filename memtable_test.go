@@ -0,0 +1,191 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	list := newSkiplist()
+	assert.Nil(t, list.First())
+
+	random := rand.New(rand.NewSource(1))
+	keys := map[string]TimestampedKey{}
+	for i := 0; i < 1000; i++ {
+		key := newTimestampedKey(Key(fmt.Sprintf("key%d", random.Intn(200))), uint64(random.Intn(5)))
+		keys[string(key)] = key
+		list.Put(key, memtableEntry{})
+	}
+	assert.Equal(t, len(keys), list.Len())
+
+	expected := make([]TimestampedKey, 0, len(keys))
+	for _, key := range keys {
+		expected = append(expected, key)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return compareTimestampedKeys(expected[i], expected[j]) < 0
+	})
+
+	var actual []TimestampedKey
+	for node := list.First(); node != nil; node = node.Next(0) {
+		actual = append(actual, node.key)
+	}
+	assert.Equal(t, expected, actual)
+}
+
+func TestSkiplist_ConcurrentSeek(t *testing.T) {
+	// Newer versions of a key sort before older ones, so every version put while the readers are
+	// seeking lands right before the version they are looking for. Seek must never return one.
+	list := newSkiplist()
+	list.Put(newTimestampedKey(Key("key"), 1), memtableEntry{})
+	list.Put(newTimestampedKey(Key("other"), 1), memtableEntry{})
+
+	const versions = 50000
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			target := newTimestampedKey(Key("key"), 1)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				node := list.Seek(target)
+				if !assert.NotNil(t, node) ||
+					!assert.Equal(t, target, node.key, "seek returned a newer version") {
+					return
+				}
+			}
+		}()
+	}
+
+	for i := uint64(2); i <= versions; i++ {
+		list.Put(newTimestampedKey(Key("key"), i), memtableEntry{})
+	}
+	close(done)
+	wg.Wait()
+	assert.Equal(t, versions+1, list.Len())
+}
+
+func TestMemtable(t *testing.T) {
+	set := func(key, value string) walTransactionChange {
+		return walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   Key(key),
+			Value: []byte(value),
+		}
+	}
+
+	t.Run("versions", func(t *testing.T) {
+		memtable := newMemtable()
+		memtable.Apply(10, []walTransactionChange{set("a", "1"), set("b", "1")})
+		memtable.Apply(20, []walTransactionChange{set("a", "2")})
+		memtable.Apply(30, []walTransactionChange{
+			{
+				Type: walTransactionChangeTypeDelete,
+				Key:  Key("a"),
+			},
+		})
+		assert.Equal(t, 4, memtable.Len())
+		assert.NotZero(t, memtable.Size())
+
+		_, found := memtable.Get(Key("a"), 5)
+		assert.False(t, found)
+
+		item, found := memtable.Get(Key("a"), 10)
+		assert.True(t, found)
+		assert.Equal(t, Item{Key: Key("a"), Value: []byte("1"), Version: 10}, item)
+
+		item, found = memtable.Get(Key("a"), 25)
+		assert.True(t, found)
+		assert.Equal(t, []byte("2"), item.Value)
+
+		// The delete is returned as an item with a nil value.
+		item, found = memtable.Get(Key("a"), 30)
+		assert.True(t, found)
+		assert.Nil(t, item.Value)
+		assert.Equal(t, uint64(30), item.Version)
+
+		_, found = memtable.Get(Key("c"), 30)
+		assert.False(t, found)
+	})
+
+	t.Run("iterator", func(t *testing.T) {
+		memtable := newMemtable()
+		memtable.Apply(1, []walTransactionChange{set("a", "1"), set("b", "1"), set("c", "1")})
+		memtable.Apply(2, []walTransactionChange{set("b", "2")})
+
+		collect := func(itr *memtableIterator) []string {
+			var items []string
+			for ; itr.Valid(); itr.Next() {
+				key := TimestampedKey(itr.Key())
+				items = append(items, fmt.Sprintf("%s@%d=%s", key.Key(), key.Timestamp(), itr.Entry().Value))
+			}
+			return items
+		}
+
+		itr := memtable.Iterator()
+		itr.SeekToFirst()
+		assert.Equal(t, []string{"a@1=1", "b@2=2", "b@1=1", "c@1=1"}, collect(itr))
+
+		itr.SetBounds([]byte("b"), []byte("c"))
+		itr.SeekToFirst()
+		assert.Equal(t, []string{"b@2=2", "b@1=1"}, collect(itr))
+
+		itr.Seek(newTimestampedKey(Key("b"), 1))
+		assert.Equal(t, []string{"b@1=1"}, collect(itr))
+		assert.NoError(t, itr.Err())
+		itr.Close()
+	})
+
+	t.Run("concurrent reads", func(t *testing.T) {
+		// Readers do not take a lock, so they must always see a consistent memtable while a
+		// writer is applying changes to it. This is mostly useful with the race detector.
+		memtable := newMemtable()
+
+		const commits = 500
+		var wg sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < commits; i++ {
+					item, found := memtable.Get(Key(fmt.Sprintf("key%d", i%50)), ^uint64(0))
+					if found {
+						assert.Equal(t, []byte("value"), item.Value)
+					}
+
+					// Every version in the memtable is in order, no matter how far the writer
+					// has got.
+					var last TimestampedKey
+					itr := memtable.Iterator()
+					for itr.SeekToFirst(); itr.Valid(); itr.Next() {
+						if last != nil {
+							assert.True(t, compareTimestampedKeys(last, itr.Key()) < 0)
+						}
+						last = append(last[:0], itr.Key()...)
+					}
+					itr.Close()
+				}
+			}()
+		}
+
+		for i := 1; i <= commits; i++ {
+			memtable.Apply(uint64(i), []walTransactionChange{
+				set(fmt.Sprintf("key%d", i%50), "value"),
+			})
+		}
+		wg.Wait()
+
+		assert.Equal(t, commits, memtable.Len())
+	})
+}
@@ -0,0 +1,225 @@
+package lsmtree
+
+import (
+	"container/heap"
+)
+
+type (
+	// internalIterator is implemented by every source of keys in the database (memtables, and
+	// heap files once they can be read) so that they can be combined by a mergingIterator. The
+	// keys are TimestampedKeys, every version of every key is returned in the order of
+	// compareTimestampedKeys.
+	//
+	// Bounds are pushed down into every internalIterator rather than being checked after the fact.
+	// This way an iterator can avoid reading any data (like a block of a heap file) that is
+	// entirely outside of the bounds.
+	internalIterator interface {
+		// SeekToFirst moves the iterator to the first key that is greater than or equal to the
+		// lower bound.
+		SeekToFirst()
+
+		// Seek moves the iterator to the first version that is greater than or equal to the
+		// timestamped key provided. If the key is less than the lower bound then the iterator will
+		// be moved to the lower bound instead.
+		Seek(key []byte)
+
+		// Next moves the iterator to the next key.
+		Next()
+
+		// Valid returns true if the iterator is positioned on a key that is within the bounds.
+		Valid() bool
+
+		// Key returns the current timestamped key. It is only valid until the iterator is moved.
+		Key() []byte
+
+		// Entry returns the current version of the key.
+		Entry() memtableEntry
+
+		// Err returns any error that was encountered while iterating.
+		Err() error
+
+		// SetBounds changes the bounds of the iterator. The bounds are keys without timestamps, the
+		// lower bound is inclusive and the upper bound is exclusive, either of them can be nil to
+		// indicate there is no bound. The iterator must be positioned again with Seek or
+		// SeekToFirst after the bounds change.
+		SetBounds(lower, upper []byte)
+
+		// Close releases the iterator. Iterators are pooled, so the iterator and anything it
+		// returned cannot be used after it has been closed.
+		Close()
+	}
+
+	// mergingIterator combines multiple internalIterators into a single stream of keys in
+	// ascending order. If more than one child has the same key then the child that was provided
+	// first is returned first, so children should be provided newest to oldest.
+	mergingIterator struct {
+		children []internalIterator
+		heap     mergingIteratorHeap
+		lower    []byte
+		upper    []byte
+		err      error
+	}
+
+	// mergingIteratorHeap is a min heap of the indexes of the children that are still valid,
+	// ordered by their current key.
+	mergingIteratorHeap struct {
+		children []internalIterator
+		indexes  []int
+	}
+)
+
+var (
+	// Make sure that the mergingIterator can itself be merged.
+	_ internalIterator = &mergingIterator{}
+)
+
+// newMergingIterator creates a new mergingIterator for the children provided. The children should
+// be ordered newest to oldest.
+func newMergingIterator(children ...internalIterator) *mergingIterator {
+	itr := &mergingIterator{}
+	itr.Reset(children...)
+	return itr
+}
+
+// Reset will replace the children of the iterator and clear its bounds, this allows the iterator
+// to be reused for a new scan without allocating. The old children are not closed.
+func (m *mergingIterator) Reset(children ...internalIterator) {
+	*m = mergingIterator{
+		children: append(m.children[:0], children...),
+		heap: mergingIteratorHeap{
+			indexes: m.heap.indexes[:0],
+		},
+	}
+	m.heap.children = m.children
+}
+
+// Close closes every child. The iterator can be reused with Reset, which is how an Iterator that
+// is taken from iteratorPool reuses its slices.
+func (m *mergingIterator) Close() {
+	for i, child := range m.children {
+		child.Close()
+
+		// Make sure a pooled Iterator is not keeping the children alive.
+		m.children[i] = nil
+	}
+
+	m.Reset()
+}
+
+// SetBounds changes the bounds of the iterator and every one of its children. See
+// internalIterator.SetBounds.
+func (m *mergingIterator) SetBounds(lower, upper []byte) {
+	m.lower, m.upper = lower, upper
+	for _, child := range m.children {
+		child.SetBounds(lower, upper)
+	}
+
+	m.heap.indexes = m.heap.indexes[:0]
+}
+
+// SeekToFirst moves every child to its first key within the bounds.
+func (m *mergingIterator) SeekToFirst() {
+	for _, child := range m.children {
+		child.SeekToFirst()
+	}
+
+	m.init()
+}
+
+// Seek moves every child to the first version that is greater than or equal to the timestamped
+// key provided.
+func (m *mergingIterator) Seek(key []byte) {
+	for _, child := range m.children {
+		child.Seek(key)
+	}
+
+	m.init()
+}
+
+// Next moves the child with the current key forward.
+func (m *mergingIterator) Next() {
+	if len(m.heap.indexes) == 0 {
+		return
+	}
+
+	child := m.children[m.heap.indexes[0]]
+	child.Next()
+	if child.Valid() {
+		heap.Fix(&m.heap, 0)
+		return
+	}
+
+	if err := child.Err(); err != nil {
+		m.err = err
+		m.heap.indexes = m.heap.indexes[:0]
+		return
+	}
+
+	heap.Pop(&m.heap)
+}
+
+// Valid returns true if any of the children are still positioned on a key.
+func (m *mergingIterator) Valid() bool {
+	return m.err == nil && len(m.heap.indexes) > 0
+}
+
+// Key returns the smallest key of all of the children.
+func (m *mergingIterator) Key() []byte {
+	return m.children[m.heap.indexes[0]].Key()
+}
+
+// Entry returns the version of the smallest key of all of the children.
+func (m *mergingIterator) Entry() memtableEntry {
+	return m.children[m.heap.indexes[0]].Entry()
+}
+
+// Err returns the first error encountered by any of the children.
+func (m *mergingIterator) Err() error {
+	return m.err
+}
+
+// init rebuilds the heap after the children have been repositioned.
+func (m *mergingIterator) init() {
+	m.err = nil
+	m.heap.indexes = m.heap.indexes[:0]
+	for i, child := range m.children {
+		if child.Valid() {
+			m.heap.indexes = append(m.heap.indexes, i)
+		} else if err := child.Err(); err != nil {
+			m.err = err
+			m.heap.indexes = m.heap.indexes[:0]
+			return
+		}
+	}
+
+	heap.Init(&m.heap)
+}
+
+func (h *mergingIteratorHeap) Len() int {
+	return len(h.indexes)
+}
+
+func (h *mergingIteratorHeap) Less(i, j int) bool {
+	a, b := h.indexes[i], h.indexes[j]
+	c := compareTimestampedKeys(h.children[a].Key(), h.children[b].Key())
+	if c != 0 {
+		return c < 0
+	}
+
+	// Newer children are provided first, so they win when the versions are the same.
+	return a < b
+}
+
+func (h *mergingIteratorHeap) Swap(i, j int) {
+	h.indexes[i], h.indexes[j] = h.indexes[j], h.indexes[i]
+}
+
+func (h *mergingIteratorHeap) Push(x interface{}) {
+	h.indexes = append(h.indexes, x.(int))
+}
+
+func (h *mergingIteratorHeap) Pop() interface{} {
+	last := h.indexes[len(h.indexes)-1]
+	h.indexes = h.indexes[:len(h.indexes)-1]
+	return last
+}
@@ -0,0 +1,180 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+// newTestMemtableIterator returns an iterator over a memtable with the keys provided, each key is
+// committed at the timestamp and also used as the value with the prefix specified.
+func newTestMemtableIterator(
+	timestamp uint64, valuePrefix string, keys ...string,
+) internalIterator {
+	changes := make([]walTransactionChange, len(keys))
+	for i, key := range keys {
+		changes[i] = walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   Key(key),
+			Value: []byte(valuePrefix + key),
+		}
+	}
+
+	memtable := newMemtable()
+	memtable.Apply(timestamp, changes)
+
+	return memtable.Iterator()
+}
+
+// collectKeys returns all of the keys and values of the iterator from its current position.
+func collectKeys(itr internalIterator) []string {
+	var items []string
+	for ; itr.Valid(); itr.Next() {
+		key := TimestampedKey(itr.Key())
+		items = append(items, fmt.Sprintf("%s=%s", key.Key(), itr.Entry().Value))
+	}
+	return items
+}
+
+// erroringIterator is an internalIterator that only ever fails.
+type erroringIterator struct {
+	err error
+}
+
+func (e *erroringIterator) SeekToFirst()          {}
+func (e *erroringIterator) Seek([]byte)           {}
+func (e *erroringIterator) Next()                 {}
+func (e *erroringIterator) Valid() bool           { return false }
+func (e *erroringIterator) Key() []byte           { return nil }
+func (e *erroringIterator) Entry() memtableEntry  { return memtableEntry{} }
+func (e *erroringIterator) Err() error            { return e.err }
+func (e *erroringIterator) SetBounds(_, _ []byte) {}
+func (e *erroringIterator) Close()                {}
+
+func TestMergingIterator(t *testing.T) {
+	newIterator := func() *mergingIterator {
+		return newMergingIterator(
+			newTestMemtableIterator(3, "new", "b", "d", "f"),
+			newTestMemtableIterator(2, "old", "a", "b", "c", "g"),
+			newTestMemtableIterator(1, "oldest"),
+		)
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		itr := newIterator()
+		itr.SeekToFirst()
+		assert.Equal(t, []string{
+			"a=olda",
+			"b=newb",
+			"b=oldb",
+			"c=oldc",
+			"d=newd",
+			"f=newf",
+			"g=oldg",
+		}, collectKeys(itr))
+		assert.NoError(t, itr.Err())
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		itr := newIterator()
+		itr.Seek(newTimestampedKey(Key("c"), math.MaxUint64))
+		assert.Equal(t, []string{
+			"c=oldc",
+			"d=newd",
+			"f=newf",
+			"g=oldg",
+		}, collectKeys(itr))
+
+		itr.Seek(newTimestampedKey(Key("z"), math.MaxUint64))
+		assert.False(t, itr.Valid())
+	})
+
+	t.Run("bounds", func(t *testing.T) {
+		itr := newIterator()
+		itr.SetBounds([]byte("b"), []byte("f"))
+		assert.False(t, itr.Valid())
+
+		itr.SeekToFirst()
+		assert.Equal(t, []string{
+			"b=newb",
+			"b=oldb",
+			"c=oldc",
+			"d=newd",
+		}, collectKeys(itr))
+
+		// Seeking before the lower bound should start at the lower bound.
+		itr.Seek(newTimestampedKey(Key("a"), math.MaxUint64))
+		assert.Equal(t, "b", string(TimestampedKey(itr.Key()).Key()))
+
+		// The bounds can be changed and the iterator reused.
+		itr.SetBounds([]byte("d"), nil)
+		itr.SeekToFirst()
+		assert.Equal(t, []string{
+			"d=newd",
+			"f=newf",
+			"g=oldg",
+		}, collectKeys(itr))
+	})
+
+	t.Run("bounds are pushed down", func(t *testing.T) {
+		child := newTestMemtableIterator(1, "", "a", "b", "c", "d")
+		itr := newMergingIterator(child)
+		itr.SetBounds(nil, []byte("c"))
+		itr.SeekToFirst()
+		assert.Equal(t, []string{"a=a", "b=b"}, collectKeys(itr))
+
+		// The child itself should have stopped at the upper bound.
+		assert.False(t, child.Valid())
+	})
+
+	t.Run("error", func(t *testing.T) {
+		itr := newMergingIterator(
+			newTestMemtableIterator(1, "", "a"),
+			&erroringIterator{err: errors.New("failed")},
+		)
+		itr.SeekToFirst()
+		assert.False(t, itr.Valid())
+		assert.EqualError(t, itr.Err(), "failed")
+	})
+}
+
+func TestMergingIterator_Reset(t *testing.T) {
+	itr := newMergingIterator(newTestMemtableIterator(1, "", "a", "b"))
+	itr.SetBounds([]byte("b"), nil)
+	itr.SeekToFirst()
+	assert.Equal(t, []string{"b=b"}, collectKeys(itr))
+
+	// Resetting the iterator should clear the bounds as well as replace the children.
+	itr.Reset(newTestMemtableIterator(1, "", "c", "d"))
+	assert.False(t, itr.Valid())
+	itr.SeekToFirst()
+	assert.Equal(t, []string{"c=c", "d=d"}, collectKeys(itr))
+
+	itr.Close()
+	assert.Empty(t, itr.children)
+}
+
+func BenchmarkMergingIterator(b *testing.B) {
+	children := make([][]string, 4)
+	for i := range children {
+		for j := 0; j < 100; j++ {
+			children[i] = append(children[i], fmt.Sprintf("key%05d", j*len(children)+i))
+		}
+	}
+
+	iterators := make([]internalIterator, len(children))
+	for i := range children {
+		iterators[i] = newTestMemtableIterator(uint64(i+1), "", children[i]...)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		itr := newMergingIterator(iterators...)
+		for itr.SeekToFirst(); itr.Valid(); itr.Next() {
+		}
+		itr.Close()
+	}
+}
@@ -0,0 +1,187 @@
+package lsmtree
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a point in time snapshot of counters from a single database, or the total of many
+// databases when retrieved from a Registry.
+type Metrics struct {
+	// CollectedAt is the time that the metrics were collected at according to Options.Clock. The
+	// total of many databases was collected at the latest time of any of them.
+	CollectedAt time.Time
+
+	// Databases is the number of databases that the metrics were collected from.
+	Databases int
+
+	// WALTransactionsAppended is the number of transactions that have been written to the WAL.
+	WALTransactionsAppended uint64
+
+	// WALTransactionsSynced is the number of transactions that are known to be durable in the WAL.
+	WALTransactionsSynced uint64
+
+	// PendingWrites is the number of writes that are waiting to be picked up by the background
+	// writer.
+	PendingWrites int
+
+	// Lookups is where each point lookup was answered.
+	Lookups LookupStats
+
+	// ReadAmp is how many heap files point lookups have had to search, see
+	// Options.MaxReadAmplification.
+	ReadAmp ReadAmpStats
+
+	// RowCache is how the row cache is being used, see Options.RowCacheSize.
+	RowCache RowCacheStats
+
+	// WriteAdmission is how many writes of each priority had to wait because too many commits
+	// were in progress.
+	WriteAdmission WriteAdmissionStats
+
+	// ExpiredKeys is the number of keys that have been deleted because their TTL passed.
+	ExpiredKeys uint64
+
+	// WAL is how full the WAL segments are and how many of their transactions have been flushed.
+	// Collecting it reads every transaction in the WAL, see DB.WALStats. If the WAL could not be
+	// read then it is left empty.
+	WAL WALStats
+}
+
+// Metrics returns a snapshot of the counters for the database.
+func (db *DB) Metrics() Metrics {
+	var wal WALStats
+	if segments, err := db.wal.Stats(); err == nil {
+		wal = walStatsTotal(segments)
+	}
+
+	return Metrics{
+		CollectedAt:             db.options.Clock.Now(),
+		Databases:               1,
+		WALTransactionsAppended: atomic.LoadUint64(&db.wal.appended),
+		WALTransactionsSynced:   atomic.LoadUint64(&db.wal.synced),
+		PendingWrites:           len(db.writeChannel),
+		Lookups:                 db.lookups.Stats(),
+		ReadAmp:                 db.readAmp.Stats(),
+		RowCache:                db.rows.Stats(),
+		WriteAdmission:          db.admission.Stats(),
+		ExpiredKeys:             atomic.LoadUint64(&db.expiredKeys),
+		WAL:                     wal,
+	}
+}
+
+// Add returns the sum of the two sets of metrics.
+func (m Metrics) Add(other Metrics) Metrics {
+	collectedAt := m.CollectedAt
+	if other.CollectedAt.After(collectedAt) {
+		collectedAt = other.CollectedAt
+	}
+
+	return Metrics{
+		CollectedAt:             collectedAt,
+		Databases:               m.Databases + other.Databases,
+		WALTransactionsAppended: m.WALTransactionsAppended + other.WALTransactionsAppended,
+		WALTransactionsSynced:   m.WALTransactionsSynced + other.WALTransactionsSynced,
+		PendingWrites:           m.PendingWrites + other.PendingWrites,
+		Lookups:                 m.Lookups.Add(other.Lookups),
+		ReadAmp:                 m.ReadAmp.Add(other.ReadAmp),
+		RowCache:                m.RowCache.Add(other.RowCache),
+		WriteAdmission:          m.WriteAdmission.Add(other.WriteAdmission),
+		ExpiredKeys:             m.ExpiredKeys + other.ExpiredKeys,
+		WAL:                     m.WAL.Add(other.WAL),
+	}
+}
+
+// MetricsDelta is what happened between two snapshots of Metrics, as rates over the interval
+// between them. Counters are cumulative from when each database was opened, so on their own they
+// only say what has happened since then; logging a MetricsDelta periodically says what the
+// database has been doing recently instead.
+type MetricsDelta struct {
+	// Interval is the time between the two snapshots. If it is not positive then every rate is 0.
+	Interval time.Duration
+
+	// WALTransactionsAppended and WALTransactionsSynced are the number of transactions per second
+	// that were written to the WAL and that became durable.
+	WALTransactionsAppended float64
+	WALTransactionsSynced   float64
+
+	// Lookups is the number of point lookups per second, however they were answered.
+	Lookups float64
+
+	// RowCacheHitRate is the fraction of the lookups that checked the row cache in the interval
+	// that it answered. It is 0 if no lookups checked it.
+	RowCacheHitRate float64
+
+	// ReadAmp is the average number of heap files that each lookup in the interval had to search.
+	ReadAmp float64
+
+	// WritesThrottled is the number of writes per second of any priority that had to wait because
+	// too many commits were in progress.
+	WritesThrottled float64
+
+	// ExpiredKeys is the number of keys per second that were deleted because their TTL passed.
+	ExpiredKeys float64
+}
+
+// Delta returns the rates of the counters between the previous snapshot provided and this one.
+// Both snapshots should come from the same database or registry. If a counter went backwards,
+// because a database was closed between the two snapshots for example, then it is treated as if
+// nothing happened.
+func (m Metrics) Delta(previous Metrics) MetricsDelta {
+	delta := MetricsDelta{
+		Interval: m.CollectedAt.Sub(previous.CollectedAt),
+	}
+
+	lookups := func(metrics Metrics) uint64 {
+		l := metrics.Lookups
+		return l.Pending + l.RowCache + l.Memtable + l.NegativeCache + l.NotFound
+	}
+	throttled := func(metrics Metrics) uint64 {
+		return metrics.WriteAdmission.ThrottledNormal + metrics.WriteAdmission.ThrottledLow
+	}
+
+	// The ratios are of how much each counter grew in the interval, not of the counters
+	// themselves, so that they describe the interval rather than the lifetime of the database.
+	hits := counterDelta(m.RowCache.Hits, previous.RowCache.Hits)
+	misses := counterDelta(m.RowCache.Misses, previous.RowCache.Misses)
+	delta.RowCacheHitRate = ratio(hits, hits+misses)
+	delta.ReadAmp = ratio(
+		counterDelta(m.ReadAmp.FilesProbed, previous.ReadAmp.FilesProbed),
+		counterDelta(m.ReadAmp.Lookups, previous.ReadAmp.Lookups),
+	)
+
+	if delta.Interval <= 0 {
+		return delta
+	}
+
+	rate := func(current, previous uint64) float64 {
+		return float64(counterDelta(current, previous)) / delta.Interval.Seconds()
+	}
+	delta.WALTransactionsAppended = rate(
+		m.WALTransactionsAppended, previous.WALTransactionsAppended,
+	)
+	delta.WALTransactionsSynced = rate(m.WALTransactionsSynced, previous.WALTransactionsSynced)
+	delta.Lookups = rate(lookups(m), lookups(previous))
+	delta.WritesThrottled = rate(throttled(m), throttled(previous))
+	delta.ExpiredKeys = rate(m.ExpiredKeys, previous.ExpiredKeys)
+
+	return delta
+}
+
+// counterDelta returns how much a counter grew between two snapshots, or 0 if it went backwards.
+func counterDelta(current, previous uint64) uint64 {
+	if current < previous {
+		return 0
+	}
+
+	return current - previous
+}
+
+// ratio returns the numerator divided by the denominator, or 0 if the denominator is 0.
+func ratio(numerator, denominator uint64) float64 {
+	if denominator == 0 {
+		return 0
+	}
+
+	return float64(numerator) / float64(denominator)
+}
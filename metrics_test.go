@@ -0,0 +1,88 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Delta(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	t.Run("rates", func(t *testing.T) {
+		previous := Metrics{
+			CollectedAt:             start,
+			WALTransactionsAppended: 100,
+			WALTransactionsSynced:   90,
+			Lookups:                 LookupStats{Memtable: 10},
+			RowCache:                RowCacheStats{Hits: 50, Misses: 50},
+			ReadAmp:                 ReadAmpStats{Lookups: 10, FilesProbed: 10},
+			WriteAdmission:          WriteAdmissionStats{ThrottledLow: 1},
+			ExpiredKeys:             5,
+		}
+		current := Metrics{
+			CollectedAt:             start.Add(10 * time.Second),
+			WALTransactionsAppended: 600,
+			WALTransactionsSynced:   590,
+			Lookups:                 LookupStats{Memtable: 30, RowCache: 30, NotFound: 20},
+			RowCache:                RowCacheStats{Hits: 80, Misses: 60},
+			ReadAmp:                 ReadAmpStats{Lookups: 30, FilesProbed: 70},
+			WriteAdmission:          WriteAdmissionStats{ThrottledNormal: 10, ThrottledLow: 11},
+			ExpiredKeys:             25,
+		}
+
+		// Ratios only cover the interval, the lifetime hit rate of the row cache is much lower.
+		assert.Equal(t, MetricsDelta{
+			Interval:                10 * time.Second,
+			WALTransactionsAppended: 50,
+			WALTransactionsSynced:   50,
+			Lookups:                 7,
+			RowCacheHitRate:         0.75,
+			ReadAmp:                 3,
+			WritesThrottled:         2,
+			ExpiredKeys:             2,
+		}, current.Delta(previous))
+	})
+
+	t.Run("no interval", func(t *testing.T) {
+		metrics := Metrics{
+			CollectedAt:             start,
+			WALTransactionsAppended: 10,
+			RowCache:                RowCacheStats{Hits: 1, Misses: 1},
+		}
+
+		delta := metrics.Delta(Metrics{CollectedAt: start})
+		assert.Zero(t, delta.Interval)
+		assert.Zero(t, delta.WALTransactionsAppended)
+		assert.Equal(t, 0.5, delta.RowCacheHitRate)
+	})
+
+	t.Run("counter went backwards", func(t *testing.T) {
+		previous := Metrics{CollectedAt: start, WALTransactionsAppended: 100}
+		current := Metrics{CollectedAt: start.Add(time.Second), WALTransactionsAppended: 40}
+		assert.Zero(t, current.Delta(previous).WALTransactionsAppended)
+	})
+
+	t.Run("database", func(t *testing.T) {
+		clock := NewManualClock(start)
+		options := DefaultOptions()
+		options.Clock = clock
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		previous := db.Metrics()
+		assert.Equal(t, start, previous.CollectedAt)
+
+		for i := 0; i < 4; i++ {
+			txn, err := db.NewTransaction(TxnOptions{})
+			assert.NoError(t, err)
+			assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+			assert.NoError(t, txn.Commit())
+		}
+		clock.Advance(2 * time.Second)
+
+		delta := db.Metrics().Delta(previous)
+		assert.Equal(t, 2*time.Second, delta.Interval)
+		assert.Equal(t, float64(2), delta.WALTransactionsAppended)
+	})
+}
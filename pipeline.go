@@ -0,0 +1,375 @@
+package lsmtree
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// The commit pipeline is split into stages that each run in their own goroutine, connected by
+// channels. This way the WAL write of one transaction can overlap with the sync of the transactions
+// before it, and the memtable apply of the transactions before that.
+//
+//   commit -> writeChannel -> backgroundWriter  (allocate a timestamp, append to the WAL)
+//          -> syncChannel  -> backgroundSyncer  (sync every transaction that is waiting at once)
+//          -> applyChannel -> backgroundApplier (apply to the memtable, publish the timestamp)
+//
+// Each stage handles transactions in the order it received them, so transactions are always
+// applied and published in timestamp order.
+//
+// If Options.UnorderedWrites is enabled then the last stage is skipped. Once a transaction has
+// been synced each committer applies its own changes to the memtable concurrently, and publishes
+// its timestamp if it is newer than the last published timestamp. This means a transaction can be
+// visible before an older transaction that committed at the same time.
+
+type (
+	// commitRequest is a single transaction moving through the commit pipeline.
+	commitRequest struct {
+		changes   []walTransactionChange
+		timestamp uint64
+
+		// markers are written to the WAL after the changes but are never applied to the
+		// memtable, like the record that resolves a prepared transaction.
+		markers []walTransactionChange
+
+		// reads are the keys that the transaction read at readTimestamp. If any of them has
+		// been written since then the commit fails with ErrTxnConflict, see conflictTracker.
+		reads         []Key
+		readTimestamp uint64
+
+		// disableWAL requests are given a timestamp and applied but are not written to the WAL,
+		// see TxnOptions.DisableWAL.
+		disableWAL bool
+
+		// ignoreQuotas requests are not checked against Options.Quotas, but still count towards
+		// them.
+		ignoreQuotas bool
+
+		// prepare requests are prepared transactions, they are checked for conflicts and written
+		// to the WAL but are never applied. Their timestamp is the prepare id, see Txn.Prepare.
+		prepare bool
+
+		// resolves is the prepare id of the prepared transaction that the request commits, the
+		// keys reserved by that transaction do not conflict with the request.
+		resolves uint64
+
+		// barrier requests carry no changes and are not written to the WAL. They only pass
+		// through each stage so that the caller knows every request before them has too, see
+		// DB.waitForCommits.
+		barrier bool
+
+		// done receives the result of the commit. It is buffered so that the pipeline never
+		// waits on the caller.
+		done chan error
+	}
+
+	// timestampWaiters are callers waiting for a timestamp to be published, see
+	// DB.WaitForTimestamp.
+	timestampWaiters struct {
+		lock    sync.Mutex
+		waiters []timestampWaiter
+
+		// count is the number of waiters, it is read atomically so that commits do not need to
+		// take the lock when nothing is waiting.
+		count int32
+	}
+
+	// timestampWaiter is a single caller waiting for a timestamp, ready is closed once the
+	// timestamp has been published.
+	timestampWaiter struct {
+		timestamp uint64
+		ready     chan struct{}
+	}
+)
+
+// commit will send the changes through the commit pipeline and wait for them to be durable and
+// visible to new transactions. The timestamp the changes were committed at is returned. The
+// priority decides how long the commit waits to enter the pipeline when it is busy.
+func (db *DB) commit(changes []walTransactionChange, priority WritePriority) (uint64, error) {
+	return db.commitRequest(&commitRequest{
+		changes: changes,
+		done:    make(chan error, 1),
+	}, priority)
+}
+
+// commitRequest sends the request through the commit pipeline, see commit.
+func (db *DB) commitRequest(request *commitRequest, priority WritePriority) (uint64, error) {
+	if err := db.admission.Admit(priority); err != nil {
+		return 0, err
+	}
+	defer db.admission.Release()
+
+	select {
+	case db.writeChannel <- request:
+	case <-db.stopped:
+		return 0, ErrClosed
+	}
+
+	select {
+	case err := <-request.done:
+		if err == nil && db.options.UnorderedWrites && !request.prepare {
+			db.apply(request)
+		}
+
+		return request.timestamp, err
+	case <-db.pipelineDone:
+		// The pipeline might have finished the request right before it exited.
+		select {
+		case err := <-request.done:
+			return request.timestamp, err
+		default:
+			return 0, ErrClosed
+		}
+	}
+}
+
+// waitForCommits waits for every transaction that was committed before it was called to be durable
+// and visible, so that anything that copies the database files afterwards sees all of them. If the
+// context is done first then its error is returned, the transactions still finish committing in
+// the background. With Options.UnorderedWrites a transaction can be durable but still applying to
+// the memtable when waitForCommits returns.
+func (db *DB) waitForCommits(ctx context.Context) error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	// The pipeline handles requests in order, so once the barrier comes out of the end of it
+	// everything that went in before it has been synced and applied.
+	barrier := &commitRequest{
+		barrier: true,
+		done:    make(chan error, 1),
+	}
+
+	select {
+	case db.writeChannel <- barrier:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-db.stopped:
+		return ErrClosed
+	}
+
+	select {
+	case err := <-barrier.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-db.pipelineDone:
+		return ErrClosed
+	}
+}
+
+// backgroundWriter is the first stage of the commit pipeline. It allocates the timestamp for each
+// transaction and appends it to the WAL.
+func (db *DB) backgroundWriter() {
+	for {
+		select {
+		case request := <-db.writeChannel:
+			if request.barrier {
+				db.syncChannel <- request
+				continue
+			}
+
+			// The timestamp of a conflicting commit is the write it conflicted with, so that
+			// a retry can wait for that write to be visible.
+			conflict := db.conflicts.Conflicts(request.reads, request.readTimestamp)
+			if conflict != 0 {
+				request.timestamp = conflict
+				request.done <- ErrTxnConflict
+				continue
+			}
+
+			// Keys reserved by a prepared transaction cannot be written until it is resolved,
+			// there is no write to wait for so the timestamp is 0.
+			if db.prepared.Conflicts(request.changes, request.resolves) {
+				request.timestamp = 0
+				request.done <- ErrTxnConflict
+				continue
+			}
+
+			if request.prepare {
+				if err := db.appendPrepared(request); err != nil {
+					request.done <- err
+					continue
+				}
+
+				db.syncChannel <- request
+				continue
+			}
+
+			plan, err := db.quotas.Check(request.changes)
+			if err != nil && !request.ignoreQuotas {
+				request.done <- err
+				continue
+			}
+
+			request.timestamp = db.timestamps.Next()
+
+			entries := request.changes
+			if len(request.markers) > 0 {
+				entries = append(entries[:len(entries):len(entries)], request.markers...)
+			}
+
+			if !request.disableWAL {
+				if err := db.wal.Append(walTransaction{
+					TransactionId: request.timestamp,
+					Timestamp:     request.timestamp,
+					Entries:       entries,
+				}); err != nil {
+					request.done <- err
+					continue
+				}
+			}
+
+			db.conflicts.Record(request.timestamp, request.changes)
+			db.quotas.Commit(request.timestamp, plan)
+			db.conflicts.Prune(db.conflictCutoff)
+
+			db.syncChannel <- request
+
+		case stopResult := <-db.stopWriteChannel:
+			// Let the rest of the pipeline finish whatever it has already received before
+			// responding.
+			close(db.syncChannel)
+			<-db.pipelineDone
+			stopResult <- nil
+			return
+		}
+	}
+}
+
+// backgroundSyncer is the second stage of the commit pipeline. It waits for transactions to be
+// appended to the WAL and then syncs all of them with a single sync.
+func (db *DB) backgroundSyncer() {
+	defer close(db.applyChannel)
+
+	batch := make([]*commitRequest, 0, cap(db.syncChannel)+1)
+	for request := range db.syncChannel {
+		// Grab everything else that is already waiting so that it can share the sync.
+		batch = append(batch[:0], request)
+	drain:
+		for {
+			select {
+			case request, ok := <-db.syncChannel:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, request)
+			default:
+				break drain
+			}
+		}
+
+		if err := db.wal.SyncBarrier(); err != nil {
+			for _, request := range batch {
+				request.done <- err
+			}
+			continue
+		}
+
+		for _, request := range batch {
+			if db.options.UnorderedWrites {
+				// The committer will apply its own changes.
+				request.done <- nil
+				continue
+			}
+
+			db.applyChannel <- request
+		}
+	}
+}
+
+// backgroundApplier is the last stage of the commit pipeline. It applies each transaction to the
+// memtable and then publishes its timestamp so that new transactions will see it.
+func (db *DB) backgroundApplier() {
+	defer close(db.pipelineDone)
+
+	for request := range db.applyChannel {
+		if !request.barrier && !request.prepare {
+			db.apply(request)
+		}
+		request.done <- nil
+	}
+}
+
+// apply adds the changes of the transaction to the memtable and then publishes its timestamp. The
+// published timestamp never moves backwards. Once the changes are visible they are sent to any
+// watches.
+func (db *DB) apply(request *commitRequest) {
+	db.memory.Add(memoryMemtables, db.memtable.Apply(request.timestamp, request.changes))
+	db.quotas.Applied(request.timestamp, request.changes)
+	db.expirations.Add(request.timestamp, request.changes)
+	db.accesses.Write(request.changes)
+
+	// Missing keys and cached rows that were just written must be forgotten before the write is
+	// visible.
+	db.negativeLookups.Invalidate(request.timestamp, request.changes)
+	db.rows.Invalidate(request.timestamp, request.changes)
+
+	for {
+		committed := atomic.LoadUint64(&db.committed)
+		if committed >= request.timestamp ||
+			atomic.CompareAndSwapUint64(&db.committed, committed, request.timestamp) {
+			break
+		}
+	}
+
+	db.timestampWaiters.Notify(atomic.LoadUint64(&db.committed))
+	db.watches.Notify(request.timestamp, request.changes, db.stopped)
+}
+
+// Wait returns a channel that is closed once the published timestamp reaches the timestamp
+// provided. published is the timestamp that is currently published, if it has already reached the
+// timestamp then the channel is closed right away.
+func (w *timestampWaiters) Wait(timestamp uint64, published func() uint64) <-chan struct{} {
+	ready := make(chan struct{})
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// Check again once the lock is held, otherwise the timestamp could be published between the
+	// check and the waiter being added and it would never be woken up.
+	if published() >= timestamp {
+		close(ready)
+		return ready
+	}
+
+	w.waiters = append(w.waiters, timestampWaiter{timestamp: timestamp, ready: ready})
+	atomic.StoreInt32(&w.count, int32(len(w.waiters)))
+
+	return ready
+}
+
+// Cancel removes a waiter that is no longer waiting.
+func (w *timestampWaiters) Cancel(ready <-chan struct{}) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for i, waiter := range w.waiters {
+		if waiter.ready == ready {
+			w.waiters = append(w.waiters[:i], w.waiters[i+1:]...)
+			break
+		}
+	}
+	atomic.StoreInt32(&w.count, int32(len(w.waiters)))
+}
+
+// Notify wakes up every waiter whose timestamp has been published.
+func (w *timestampWaiters) Notify(published uint64) {
+	if atomic.LoadInt32(&w.count) == 0 {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	remaining := w.waiters[:0]
+	for _, waiter := range w.waiters {
+		if waiter.timestamp <= published {
+			close(waiter.ready)
+			continue
+		}
+		remaining = append(remaining, waiter)
+	}
+	w.waiters = remaining
+	atomic.StoreInt32(&w.count, int32(len(w.waiters)))
+}
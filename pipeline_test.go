@@ -0,0 +1,152 @@
+package lsmtree
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestCommitPipeline(t *testing.T) {
+	for _, unordered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("concurrent commits unordered %t", unordered), func(t *testing.T) {
+			options := DefaultOptions()
+			options.UnorderedWrites = unordered
+			testConcurrentCommits(t, options)
+		})
+	}
+
+	t.Run("visible once committed", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		// Each commit should be visible to a transaction started right after it returns.
+		for i := 0; i < 100; i++ {
+			key := Key(fmt.Sprintf("key%d", i))
+
+			txn, _ := db.NewTransaction(TxnOptions{})
+			assert.NoError(t, txn.Set(key, []byte("value")))
+			assert.NoError(t, txn.Commit())
+
+			reader, _ := db.NewTransaction(TxnOptions{ReadOnly: true})
+			_, err := reader.Get(key)
+			assert.NoError(t, err)
+			reader.Discard()
+		}
+	})
+
+	t.Run("close while committing", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					txn, err := db.NewTransaction(TxnOptions{})
+					if err != nil {
+						assert.Equal(t, ErrClosed, err)
+						return
+					}
+
+					_ = txn.Set(Key(fmt.Sprintf("key-%d-%d", w, i)), []byte("value"))
+					if err := txn.Commit(); err != nil {
+						assert.Equal(t, ErrClosed, err)
+						return
+					}
+				}
+			}(w)
+		}
+
+		assert.NoError(t, db.Close())
+
+		// Every writer should see the database close rather than hanging.
+		wg.Wait()
+	})
+}
+
+func testConcurrentCommits(t *testing.T, options Options) {
+	db, cleanup := newTestDB(t, options)
+	defer cleanup()
+
+	const writers, commits = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < commits; i++ {
+				txn, err := db.NewTransaction(TxnOptions{})
+				assert.NoError(t, err)
+				assert.NoError(t, txn.Set(Key(fmt.Sprintf("key-%d-%d", w, i)), []byte("value")))
+				assert.NoError(t, txn.Commit())
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, uint64(writers*commits), db.Metrics().WALTransactionsSynced)
+	assert.Equal(t, writers*commits, db.memtable.Len())
+	assert.Equal(t, db.timestamps.Current(), db.readTimestamp())
+
+	txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+	assert.NoError(t, err)
+	defer txn.Discard()
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < commits; i++ {
+			_, err := txn.Get(Key(fmt.Sprintf("key-%d-%d", w, i)))
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestDB_waitForCommits(t *testing.T) {
+	t.Run("waits for commits", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		assert.NoError(t, db.waitForCommits(context.Background()))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.NoError(t, db.SetIfAbsent(Key(fmt.Sprintf("key%d", i)), []byte("value")))
+			}(i)
+		}
+		wg.Wait()
+
+		assert.NoError(t, db.waitForCommits(context.Background()))
+		assert.Equal(t, 10, db.memtable.Len())
+		assert.Equal(t, db.Metrics().WALTransactionsAppended, db.Metrics().WALTransactionsSynced)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// The barrier might be accepted before the cancellation is noticed, either way the
+		// database keeps working afterwards.
+		if err := db.waitForCommits(ctx); err != nil {
+			assert.Equal(t, context.Canceled, err)
+		}
+
+		assert.NoError(t, db.SetIfAbsent(Key("key"), []byte("value")))
+		assert.NoError(t, db.waitForCommits(context.Background()))
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		cleanup()
+
+		assert.Equal(t, ErrClosed, db.waitForCommits(context.Background()))
+	})
+}
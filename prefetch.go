@@ -0,0 +1,87 @@
+package lsmtree
+
+type (
+	// valuePrefetcher reads values from the value files ahead of when they are needed. This is
+	// meant to be used by iterators, while the consumer is processing the current value the next
+	// few values are already being read in the background. Values are always returned in the same
+	// order as the pointers that were provided. Iterators only read the memtable for now, so
+	// nothing starts a prefetcher until keys can point into value files.
+	valuePrefetcher struct {
+		// pending is a queue of results for values that have been requested. The capacity of this
+		// channel is the number of values that can be read ahead of the consumer.
+		pending chan chan prefetchResult
+
+		// done is closed when the prefetcher is closed, this stops any more values from being
+		// requested.
+		done chan struct{}
+	}
+
+	// prefetchResult is the outcome of reading a single value.
+	prefetchResult struct {
+		Value []byte
+		Err   error
+	}
+)
+
+// newValuePrefetcher will start reading the values for the pointers provided in the background. At
+// most depth values will be read ahead of the consumer. If depth is less than 1 then values are
+// still read in the background but only one at a time.
+func newValuePrefetcher(
+	values *valueManager, pointers []valuePointer, depth int, verify bool,
+) *valuePrefetcher {
+	if depth < 1 {
+		depth = 1
+	}
+
+	p := &valuePrefetcher{
+		pending: make(chan chan prefetchResult, depth),
+		done:    make(chan struct{}),
+	}
+
+	goBackground("valuePrefetcher", func() {
+		defer close(p.pending)
+
+		for _, pointer := range pointers {
+			result := make(chan prefetchResult, 1)
+
+			// This will block once we are depth values ahead of the consumer.
+			select {
+			case p.pending <- result:
+			case <-p.done:
+				return
+			}
+
+			go func(pointer valuePointer) {
+				value, err := values.ReadPointer(pointer, verify)
+				result <- prefetchResult{
+					Value: value,
+					Err:   err,
+				}
+			}(pointer)
+		}
+	})
+
+	return p
+}
+
+// Next will return the next value in the order of the pointers provided. If there are no more
+// values then ok will be false.
+func (p *valuePrefetcher) Next() (value []byte, ok bool, err error) {
+	result, ok := <-p.pending
+	if !ok {
+		return nil, false, nil
+	}
+
+	r := <-result
+	return r.Value, true, r.Err
+}
+
+// Close will stop any more values from being read. Values that are already being read will finish
+// in the background but will be discarded.
+func (p *valuePrefetcher) Close() {
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+}
@@ -0,0 +1,73 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValuePrefetcher(t *testing.T) {
+	writeValues := func(t *testing.T, values *valueManager, count int) []valuePointer {
+		file, err := values.getFile(1)
+		assert.NoError(t, err)
+
+		pointers := make([]valuePointer, count)
+		for i := 0; i < count; i++ {
+			pointers[i], err = file.Append([]byte(fmt.Sprintf("value%d", i)))
+			assert.NoError(t, err)
+		}
+
+		return pointers
+	}
+
+	t.Run("in order", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		values, err := newValueManager([]string{dir}, defaultFileMode)
+		assert.NoError(t, err)
+
+		pointers := writeValues(t, values, 100)
+
+		prefetcher := newValuePrefetcher(values, pointers, 8, true)
+		defer prefetcher.Close()
+
+		for i := 0; i < len(pointers); i++ {
+			value, ok, err := prefetcher.Next()
+			assert.True(t, ok)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("value%d", i)), value)
+		}
+
+		value, ok, err := prefetcher.Next()
+		assert.False(t, ok)
+		assert.NoError(t, err)
+		assert.Nil(t, value)
+	})
+
+	t.Run("close early", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		values, err := newValueManager([]string{dir}, defaultFileMode)
+		assert.NoError(t, err)
+
+		pointers := writeValues(t, values, 100)
+
+		prefetcher := newValuePrefetcher(values, pointers, 2, true)
+		value, ok, err := prefetcher.Next()
+		assert.True(t, ok)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value0"), value)
+
+		prefetcher.Close()
+
+		// Anything that was already queued can still be drained, but the prefetcher must stop
+		// well before reaching the end of the pointers.
+		remaining := 0
+		for _, ok, _ := prefetcher.Next(); ok; _, ok, _ = prefetcher.Next() {
+			remaining++
+		}
+		assert.True(t, remaining < len(pointers)-1)
+	})
+}
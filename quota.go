@@ -0,0 +1,272 @@
+package lsmtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrQuotaExceeded is returned when a commit would make the keys under the prefix of a Quota
+	// larger than the quota allows. Nothing in the commit is applied.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// Quotas are checked in backgroundWriter, which sees every commit in the order they are given
+// timestamps. To know how much a commit changes the size of a prefix the writer needs the size of
+// each key before the commit. That is the newest version in the memtable, unless a commit that
+// has been accepted but not applied yet has written the key since. So the tracker remembers the
+// size it accepted for each key until that commit has been applied to the memtable.
+
+type (
+	// Quota limits the logical size of the keys that start with a prefix. The logical size is
+	// the length of every live key and its value, old versions and deleted keys are not counted.
+	// This is meant for services that store the data of many tenants in one database, each
+	// tenant under its own prefix.
+	Quota struct {
+		// Prefix is the start of every key that the quota applies to. A key counts towards every
+		// quota whose prefix it starts with.
+		Prefix Key
+
+		// MaxBytes is the largest total length of the keys and their values. If this is 0 then
+		// the size is not limited.
+		MaxBytes int64
+
+		// MaxKeys is the largest number of keys. If this is 0 then the number of keys is not
+		// limited.
+		MaxKeys int64
+	}
+
+	// QuotaUsage is how much of a Quota is being used.
+	QuotaUsage struct {
+		Quota Quota
+
+		// Bytes is the total length of the live keys under the prefix and their values.
+		Bytes int64
+
+		// Keys is the number of live keys under the prefix.
+		Keys int64
+	}
+
+	// quotaTracker keeps the usage of every quota up to date and rejects the commits that would
+	// exceed them. Check and Commit are only called by backgroundWriter.
+	quotaTracker struct {
+		lock  sync.Mutex
+		usage []QuotaUsage
+
+		// memtable is where the size of a key is found when it has no pending write.
+		memtable *memtable
+
+		// pending is the size of each key written by a commit that has not been applied to the
+		// memtable yet, by key.
+		pending map[string]pendingQuotaKey
+	}
+
+	// pendingQuotaKey is the size that a commit with the timestamp wrote a key with, the size is
+	// 0 if the commit deleted the key.
+	pendingQuotaKey struct {
+		timestamp uint64
+		size      int64
+	}
+
+	// quotaPlan is the change that a commit will make to the usage of each quota once it has
+	// been written.
+	quotaPlan struct {
+		usage []QuotaUsage
+		sizes map[string]int64
+	}
+)
+
+// newQuotaTracker returns a tracker for the quotas, or nil if there are none. The usage of each
+// quota is counted from the newest version of every key in the memtable.
+func newQuotaTracker(quotas []Quota, memtable *memtable) *quotaTracker {
+	if len(quotas) == 0 {
+		return nil
+	}
+
+	t := &quotaTracker{
+		usage:    make([]QuotaUsage, len(quotas)),
+		memtable: memtable,
+		pending:  map[string]pendingQuotaKey{},
+	}
+	for i, quota := range quotas {
+		t.usage[i].Quota = Quota{
+			Prefix:   append(Key{}, quota.Prefix...),
+			MaxBytes: quota.MaxBytes,
+			MaxKeys:  quota.MaxKeys,
+		}
+	}
+
+	// Versions are ordered newest first for each key, so only the first version of each key is
+	// counted.
+	var last Key
+	itr := memtable.Iterator()
+	defer itr.Close()
+	for itr.SeekToFirst(); itr.Valid(); itr.Next() {
+		key := TimestampedKey(itr.Key()).Key()
+		if last != nil && bytes.Equal(last, key) {
+			continue
+		}
+		last = append(last[:0], key...)
+
+		if entry := itr.Entry(); entry.Type == walTransactionChangeTypeSet {
+			t.add(key, int64(len(key)+len(entry.Value)), 1)
+		}
+	}
+
+	return t
+}
+
+// Check returns how the changes would change the usage of each quota. If a quota would be
+// exceeded then an error wrapping ErrQuotaExceeded is returned as well, the plan is still returned
+// so that a commit that cannot be rejected is counted. Changes that shrink the usage of a quota
+// are always allowed, even if it is still over the limit afterwards.
+func (t *quotaTracker) Check(changes []walTransactionChange) (*quotaPlan, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	plan := &quotaPlan{
+		usage: make([]QuotaUsage, len(t.usage)),
+		sizes: map[string]int64{},
+	}
+	for _, change := range changes {
+		var size int64
+		switch change.Type {
+		case walTransactionChangeTypeSet:
+			size = int64(len(change.Key) + len(change.Value))
+		case walTransactionChangeTypeDelete:
+		default:
+			continue
+		}
+
+		// A key that is changed more than once by the same commit only counts its last change.
+		old, ok := plan.sizes[string(change.Key)]
+		if !ok {
+			old = t.size(change.Key)
+		}
+		plan.sizes[string(change.Key)] = size
+
+		var keys int64
+		switch {
+		case old == 0 && size > 0:
+			keys = 1
+		case old > 0 && size == 0:
+			keys = -1
+		}
+
+		for i := range t.usage {
+			if bytes.HasPrefix(change.Key, t.usage[i].Quota.Prefix) {
+				plan.usage[i].Bytes += size - old
+				plan.usage[i].Keys += keys
+			}
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i, usage := range t.usage {
+		quota, delta := usage.Quota, plan.usage[i]
+		if delta.Bytes > 0 && quota.MaxBytes > 0 && usage.Bytes+delta.Bytes > quota.MaxBytes {
+			return plan, fmt.Errorf("%w: %q would use %d bytes of %d",
+				ErrQuotaExceeded, quota.Prefix, usage.Bytes+delta.Bytes, quota.MaxBytes)
+		}
+
+		if delta.Keys > 0 && quota.MaxKeys > 0 && usage.Keys+delta.Keys > quota.MaxKeys {
+			return plan, fmt.Errorf("%w: %q would have %d keys of %d",
+				ErrQuotaExceeded, quota.Prefix, usage.Keys+delta.Keys, quota.MaxKeys)
+		}
+	}
+
+	return plan, nil
+}
+
+// Commit adds the changes that were checked by Check to the usage of each quota once they have
+// been written at the timestamp.
+func (t *quotaTracker) Commit(timestamp uint64, plan *quotaPlan) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i, delta := range plan.usage {
+		t.usage[i].Bytes += delta.Bytes
+		t.usage[i].Keys += delta.Keys
+	}
+
+	for key, size := range plan.sizes {
+		t.pending[key] = pendingQuotaKey{
+			timestamp: timestamp,
+			size:      size,
+		}
+	}
+}
+
+// Applied forgets the pending sizes of the keys written by the commit at the timestamp, they can
+// be found in the memtable now. It must be called after the changes have been applied.
+func (t *quotaTracker) Applied(timestamp uint64, changes []walTransactionChange) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, change := range changes {
+		// A newer commit may have written the key again before this one was applied.
+		if pending, ok := t.pending[string(change.Key)]; ok && pending.timestamp == timestamp {
+			delete(t.pending, string(change.Key))
+		}
+	}
+}
+
+// Usage returns the usage of every quota, in the order they were configured.
+func (t *quotaTracker) Usage() []QuotaUsage {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	usage := make([]QuotaUsage, len(t.usage))
+	copy(usage, t.usage)
+
+	return usage
+}
+
+// size returns the size of the newest version of the key, or 0 if it does not exist.
+func (t *quotaTracker) size(key Key) int64 {
+	t.lock.Lock()
+	pending, ok := t.pending[string(key)]
+	t.lock.Unlock()
+	if ok {
+		return pending.size
+	}
+
+	item, found := t.memtable.Get(key, ^uint64(0))
+	if !found || item.IsDeleted() {
+		return 0
+	}
+
+	return int64(len(key) + len(item.Value))
+}
+
+// add adds the key to the usage of every quota that it is under.
+func (t *quotaTracker) add(key Key, size, keys int64) {
+	for i := range t.usage {
+		if bytes.HasPrefix(key, t.usage[i].Quota.Prefix) {
+			t.usage[i].Bytes += size
+			t.usage[i].Keys += keys
+		}
+	}
+}
+
+// QuotaUsage returns how much of each quota in Options.Quotas is being used, in the same order.
+func (db *DB) QuotaUsage() []QuotaUsage {
+	return db.quotas.Usage()
+}
@@ -0,0 +1,150 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDB_Quotas(t *testing.T) {
+	commit := func(db *DB, changes ...walTransactionChange) error {
+		txn, err := db.NewTransaction(TxnOptions{})
+		if err != nil {
+			return err
+		}
+
+		for _, change := range changes {
+			if change.Type == walTransactionChangeTypeDelete {
+				err = txn.Delete(change.Key)
+			} else {
+				err = txn.Set(change.Key, change.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return txn.Commit()
+	}
+	set := func(key, value string) walTransactionChange {
+		return walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   Key(key),
+			Value: []byte(value),
+		}
+	}
+	del := func(key string) walTransactionChange {
+		return walTransactionChange{
+			Type: walTransactionChangeTypeDelete,
+			Key:  Key(key),
+		}
+	}
+
+	t.Run("bytes", func(t *testing.T) {
+		options := DefaultOptions()
+		options.Quotas = []Quota{{Prefix: Key("t1/"), MaxBytes: 20}}
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		// Each of these keys uses 10 bytes.
+		assert.NoError(t, commit(db, set("t1/a", "123456"), set("t1/b", "123456")))
+		err := commit(db, set("t1/c", "1"))
+		assert.True(t, errors.Is(err, ErrQuotaExceeded))
+
+		// Other prefixes are not limited.
+		assert.NoError(t, commit(db, set("t2/c", "123456789")))
+
+		// Overwriting a key only counts the difference, and deleting frees the space.
+		assert.NoError(t, commit(db, set("t1/a", "654321")))
+		assert.True(t, errors.Is(commit(db, set("t1/a", "1234567")), ErrQuotaExceeded))
+		assert.NoError(t, commit(db, del("t1/b"), set("t1/c", "1")))
+		assert.Equal(t, []QuotaUsage{
+			{Quota: options.Quotas[0], Bytes: 15, Keys: 2},
+		}, db.QuotaUsage())
+	})
+
+	t.Run("keys", func(t *testing.T) {
+		options := DefaultOptions()
+		options.Quotas = []Quota{{Prefix: Key("t1/"), MaxKeys: 2}, {MaxKeys: 3}}
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		// A key that is set twice in the same commit only counts once.
+		assert.NoError(t, commit(db, set("t1/a", "1"), set("t1/a", "2")))
+		assert.NoError(t, commit(db, set("t1/b", "1")))
+		assert.True(t, errors.Is(commit(db, set("t1/c", "1")), ErrQuotaExceeded))
+
+		// The empty prefix covers every key.
+		assert.NoError(t, commit(db, set("t2/a", "1")))
+		assert.True(t, errors.Is(commit(db, set("t2/b", "1")), ErrQuotaExceeded))
+
+		// Deleting a key that does not exist changes nothing.
+		assert.NoError(t, commit(db, del("t1/missing")))
+
+		usage := db.QuotaUsage()
+		if assert.Len(t, usage, 2) {
+			assert.Equal(t, int64(2), usage[0].Keys)
+			assert.Equal(t, int64(3), usage[1].Keys)
+		}
+	})
+
+	t.Run("prepared", func(t *testing.T) {
+		options := DefaultOptions()
+		options.Quotas = []Quota{{MaxKeys: 1}}
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("prepared"), []byte("value")))
+		id, err := txn.Prepare()
+		assert.NoError(t, err)
+
+		assert.NoError(t, commit(db, set("a", "1")))
+
+		// The prepared transaction was promised to commit, so it goes over the quota.
+		_, err = db.CommitPrepared(id)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), db.QuotaUsage()[0].Keys)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.Nil(t, db.QuotaUsage())
+		assert.NoError(t, commit(db, set("t1/a", "1"), set("t1/b", "1"), set("t2/a", "1")))
+		assert.NoError(t, commit(db, del("t1/b"), set("t1/a", "22")))
+		assert.NoError(t, db.Close())
+
+		// Usage is counted from the data when the database is opened.
+		options.Quotas = []Quota{{Prefix: Key("t1/"), MaxKeys: 1}}
+		db, err = Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		assert.Equal(t, []QuotaUsage{
+			{Quota: options.Quotas[0], Bytes: 6, Keys: 1},
+		}, db.QuotaUsage())
+		assert.True(t, errors.Is(commit(db, set("t1/b", "1")), ErrQuotaExceeded))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.Quotas = []Quota{{MaxBytes: -1}}
+
+		_, err := Open(options)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+	})
+}
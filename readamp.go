@@ -0,0 +1,150 @@
+package lsmtree
+
+import (
+	"bytes"
+	"math"
+	"sync/atomic"
+)
+
+const (
+	// readAmpWindow is the number of point lookups that the average read amplification is taken
+	// over. The average is replaced once every window, so it follows the current workload instead
+	// of every lookup since the database was opened.
+	readAmpWindow = 1024
+)
+
+// Read amplification is the number of heap files that a point lookup has to search. Level 0 files
+// can overlap each other, so a lookup has to search every one of them that could hold the key,
+// while each deeper level only has one file that could. Normally level 0 is only compacted once
+// it has level0CompactionTrigger files, but a workload whose reads keep landing on the overlapping
+// files pays for every one of them until then. When the average lookup over the last window
+// searches more than Options.MaxReadAmplification files, level 0 is given a compaction score of
+// the average over the limit, which makes it a candidate for compaction ahead of other levels.
+
+type (
+	// ReadAmpStats describe how many heap files point lookups have had to search.
+	ReadAmpStats struct {
+		// Lookups is the number of point lookups that searched the database, not including the
+		// ones answered by the changes of their own transaction.
+		Lookups uint64
+
+		// FilesProbed is the total number of heap files that the lookups had to search.
+		FilesProbed uint64
+
+		// Average is the average number of heap files searched by each lookup in the last
+		// complete window of readAmpWindow lookups.
+		Average float64
+
+		// Boosted is true if Average is over Options.MaxReadAmplification, so level 0 is being
+		// compacted sooner than it would be otherwise.
+		Boosted bool
+	}
+
+	// readAmpTracker counts the heap files searched by each point lookup. The counters are only
+	// modified atomically so that lookups never wait on each other.
+	readAmpTracker struct {
+		// threshold is Options.MaxReadAmplification, if it is 0 then nothing is boosted.
+		threshold float64
+
+		lookups     uint64
+		filesProbed uint64
+
+		// windowLookups and windowProbed are the counts for the current window. average holds the
+		// bits of the float64 average of the last complete window.
+		windowLookups uint64
+		windowProbed  uint64
+		average       uint64
+	}
+)
+
+func newReadAmpTracker(threshold float64) *readAmpTracker {
+	return &readAmpTracker{
+		threshold: threshold,
+	}
+}
+
+// Record counts a single lookup that searched the number of heap files provided.
+func (r *readAmpTracker) Record(files int) {
+	atomic.AddUint64(&r.lookups, 1)
+	atomic.AddUint64(&r.filesProbed, uint64(files))
+	probed := atomic.AddUint64(&r.windowProbed, uint64(files))
+
+	// Only the lookup that completes the window replaces the average. Lookups that land between
+	// the two resets below are counted in the next window instead.
+	if atomic.AddUint64(&r.windowLookups, 1) == readAmpWindow {
+		probed = atomic.SwapUint64(&r.windowProbed, 0)
+		atomic.StoreUint64(&r.windowLookups, 0)
+		atomic.StoreUint64(&r.average, math.Float64bits(float64(probed)/readAmpWindow))
+	}
+}
+
+// Average returns the average number of heap files searched by a lookup in the last window.
+func (r *readAmpTracker) Average() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&r.average))
+}
+
+// Boost returns the compaction score that level 0 should have at least because of the read
+// amplification, or 0 if lookups are within the limit.
+func (r *readAmpTracker) Boost() float64 {
+	if r.threshold == 0 {
+		return 0
+	}
+
+	if average := r.Average(); average > r.threshold {
+		return average / r.threshold
+	}
+
+	return 0
+}
+
+// Stats returns a snapshot of the counters.
+func (r *readAmpTracker) Stats() ReadAmpStats {
+	return ReadAmpStats{
+		Lookups:     atomic.LoadUint64(&r.lookups),
+		FilesProbed: atomic.LoadUint64(&r.filesProbed),
+		Average:     r.Average(),
+		Boosted:     r.Boost() > 0,
+	}
+}
+
+// Add returns the sum of the two sets of stats. The averages are weighted by the number of lookups
+// of each, and the sum is boosted if either of them is.
+func (s ReadAmpStats) Add(other ReadAmpStats) ReadAmpStats {
+	sum := ReadAmpStats{
+		Lookups:     s.Lookups + other.Lookups,
+		FilesProbed: s.FilesProbed + other.FilesProbed,
+		Boosted:     s.Boosted || other.Boosted,
+	}
+	if sum.Lookups > 0 {
+		sum.Average = (s.Average*float64(s.Lookups) + other.Average*float64(other.Lookups)) /
+			float64(sum.Lookups)
+	}
+
+	return sum
+}
+
+// filesToProbe returns the number of heap files that a lookup of the key has to search once it
+// has missed the memtable: every file in level 0 that could hold the key, and at most one file in
+// each deeper level. A file whose key range is not known could hold any key.
+func (db *DB) filesToProbe(key Key) int {
+	var files int
+	var levels [numLevels]bool
+	for _, file := range db.manifest.Files() {
+		if file.Kind != fileTypeHeap || (file.Level > 0 && levels[file.Level]) {
+			continue
+		}
+
+		properties := db.heapProperties.Get(file.Id)
+		if properties.Smallest != nil && bytes.Compare(key, properties.Smallest) < 0 {
+			continue
+		}
+		if properties.Largest != nil && bytes.Compare(key, properties.Largest) > 0 {
+			continue
+		}
+
+		levels[file.Level] = true
+		files++
+	}
+
+	return files
+}
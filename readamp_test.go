@@ -0,0 +1,105 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestReadAmpTracker(t *testing.T) {
+	t.Run("average of the last window", func(t *testing.T) {
+		tracker := newReadAmpTracker(8)
+		for i := 0; i < readAmpWindow-1; i++ {
+			tracker.Record(10)
+		}
+
+		// The average is not replaced until the window is complete.
+		assert.Equal(t, float64(0), tracker.Average())
+		assert.Equal(t, float64(0), tracker.Boost())
+
+		tracker.Record(10)
+		assert.Equal(t, float64(10), tracker.Average())
+		assert.Equal(t, 10.0/8, tracker.Boost())
+
+		for i := 0; i < readAmpWindow; i++ {
+			tracker.Record(i % 2)
+		}
+		assert.Equal(t, 0.5, tracker.Average())
+		assert.Equal(t, float64(0), tracker.Boost())
+
+		stats := tracker.Stats()
+		assert.Equal(t, uint64(readAmpWindow*2), stats.Lookups)
+		assert.Equal(t, uint64(readAmpWindow*10+readAmpWindow/2), stats.FilesProbed)
+		assert.False(t, stats.Boosted)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		tracker := newReadAmpTracker(0)
+		for i := 0; i < readAmpWindow; i++ {
+			tracker.Record(100)
+		}
+		assert.Equal(t, float64(100), tracker.Average())
+		assert.Equal(t, float64(0), tracker.Boost())
+	})
+
+	t.Run("add", func(t *testing.T) {
+		sum := ReadAmpStats{Lookups: 1, FilesProbed: 2, Average: 2}.Add(ReadAmpStats{
+			Lookups:     3,
+			FilesProbed: 30,
+			Average:     10,
+			Boosted:     true,
+		})
+		assert.Equal(t, ReadAmpStats{
+			Lookups:     4,
+			FilesProbed: 32,
+			Average:     8,
+			Boosted:     true,
+		}, sum)
+	})
+}
+
+func TestDB_ReadAmplification(t *testing.T) {
+	options := DefaultOptions()
+	options.MaxReadAmplification = 2
+	db, cleanup := newTestDB(t, options)
+	defer cleanup()
+
+	// Heap files cannot be written yet, so finished files are added to the manifest by hand. Three
+	// level 0 files cover the key being read, which is below the trigger.
+	bounds := [][2]string{{"a", "m"}, {"c", "z"}, {"k", "l"}}
+	for i, bound := range bounds {
+		id := uint64(i + 1)
+		filePath := path.Join(db.options.DataDirectory, getHeapFileName(id))
+		assert.NoError(t, ioutil.WriteFile(filePath, []byte(fmt.Sprint(id)), 0644))
+		assert.NoError(t, db.manifest.AddFile(fileTypeHeap, id))
+		db.heapProperties.Set(id, tableProperties{
+			Smallest: Key(bound[0]),
+			Largest:  Key(bound[1]),
+		})
+	}
+	assert.Equal(t, 3, db.filesToProbe(Key("k")))
+	assert.Equal(t, 1, db.filesToProbe(Key("b")))
+
+	_, ok := db.PickCompaction()
+	assert.False(t, ok)
+
+	txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+	assert.NoError(t, err)
+	defer txn.Discard()
+	for i := 0; i < readAmpWindow; i++ {
+		_, err = txn.GetWithOptions(Key("k"), ReadOptions{DisableCacheFill: true})
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+
+	stats := db.Metrics().ReadAmp
+	assert.Equal(t, uint64(readAmpWindow), stats.Lookups)
+	assert.Equal(t, float64(3), stats.Average)
+	assert.True(t, stats.Boosted)
+
+	pick, ok := db.PickCompaction()
+	assert.True(t, ok)
+	assert.Equal(t, 0, pick.Level)
+	assert.Equal(t, 1.5, pick.Score)
+}
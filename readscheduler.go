@@ -0,0 +1,178 @@
+package lsmtree
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// coalesceMaxGap is the largest number of bytes that can be between two reads for them to
+	// still be merged into a single read. Reading a few extra bytes is cheaper than a second read
+	// on storage with a high latency per operation.
+	coalesceMaxGap = 1024 * 4 /* 4kb */
+
+	// coalesceMaxReadSize is the largest a single merged read can be. Reads that are larger than
+	// this on their own are still performed, they just won't have anything merged into them.
+	coalesceMaxReadSize = 1024 * 256 /* 256kb */
+)
+
+var (
+	// Make sure that the coalescingFile can be used anywhere a file is used.
+	_ ReaderWriterAt = &coalescingFile{}
+	_ CanSync        = &coalescingFile{}
+)
+
+type (
+	// coalescingFile wraps a file and merges concurrent reads of nearby ranges into fewer, larger
+	// reads. When a read comes in and no other read is being performed, the caller becomes the
+	// leader and performs the read. Any reads that come in while the leader is busy are queued,
+	// and once the leader is done it will sort the queue by offset, merge reads that are close to
+	// each other, and perform them on behalf of the waiting callers. Writes are passed directly to
+	// the underlying file.
+	coalescingFile struct {
+		file ReaderWriterAt
+
+		lock    sync.Mutex
+		active  bool
+		pending []*readRequest
+
+		// reads is the number of ReadAt calls made against the file.
+		reads uint64
+
+		// physicalReads is the number of reads actually performed against the underlying file.
+		physicalReads uint64
+	}
+
+	// readRequest is a single ReadAt call waiting to be performed.
+	readRequest struct {
+		buf  []byte
+		off  int64
+		n    int
+		err  error
+		done chan struct{}
+	}
+)
+
+// newCoalescingFile will wrap the file provided.
+func newCoalescingFile(file ReaderWriterAt) *coalescingFile {
+	return &coalescingFile{
+		file: file,
+	}
+}
+
+// ReadAt implements io.ReaderAt. The read might be merged with other concurrent reads.
+func (f *coalescingFile) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddUint64(&f.reads, 1)
+
+	request := &readRequest{
+		buf:  p,
+		off:  off,
+		done: make(chan struct{}),
+	}
+
+	f.lock.Lock()
+	f.pending = append(f.pending, request)
+
+	// If someone else is already reading then they will perform our read for us.
+	if f.active {
+		f.lock.Unlock()
+		<-request.done
+		return request.n, request.err
+	}
+
+	// Otherwise we become the leader and keep reading until there is nothing left in the queue.
+	f.active = true
+	for len(f.pending) > 0 {
+		batch := f.pending
+		f.pending = nil
+		f.lock.Unlock()
+
+		f.dispatch(batch)
+
+		f.lock.Lock()
+	}
+	f.active = false
+	f.lock.Unlock()
+
+	return request.n, request.err
+}
+
+// WriteAt implements io.WriterAt and simply writes to the underlying file.
+func (f *coalescingFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.file.WriteAt(p, off)
+}
+
+// Sync will sync the underlying file if it can be synced.
+func (f *coalescingFile) Sync() error {
+	if canSync, ok := f.file.(CanSync); ok {
+		return canSync.Sync()
+	}
+
+	return nil
+}
+
+// dispatch will perform all of the reads provided, merging any that are close enough together.
+func (f *coalescingFile) dispatch(batch []*readRequest) {
+	sort.Slice(batch, func(i, j int) bool {
+		return batch[i].off < batch[j].off
+	})
+
+	for start := 0; start < len(batch); {
+		runStart, runEnd := batch[start].off, batch[start].off+int64(len(batch[start].buf))
+
+		// Keep adding reads to this run while they are close enough to the end of it.
+		end := start + 1
+		for ; end < len(batch); end++ {
+			next := batch[end]
+			nextEnd := next.off + int64(len(next.buf))
+			if next.off > runEnd+coalesceMaxGap || nextEnd-runStart > coalesceMaxReadSize {
+				break
+			}
+
+			if nextEnd > runEnd {
+				runEnd = nextEnd
+			}
+		}
+
+		f.read(batch[start:end], runStart, runEnd)
+		start = end
+	}
+}
+
+// read performs a single read covering every request in the run and copies the result into each
+// of the requests.
+func (f *coalescingFile) read(run []*readRequest, runStart, runEnd int64) {
+	atomic.AddUint64(&f.physicalReads, 1)
+
+	// If there is only one request then we can read directly into its buffer.
+	if len(run) == 1 {
+		run[0].n, run[0].err = f.file.ReadAt(run[0].buf, run[0].off)
+		close(run[0].done)
+		return
+	}
+
+	buf := make([]byte, runEnd-runStart)
+	n, err := f.file.ReadAt(buf, runStart)
+	buf = buf[:n]
+
+	for _, request := range run {
+		relative := request.off - runStart
+		if relative < int64(len(buf)) {
+			request.n = copy(request.buf, buf[relative:])
+		}
+
+		// ReadAt must always return an error if it did not fill the entire buffer. If the merged
+		// read did not fail then the only reason it could be short is reaching the end of the
+		// file.
+		if request.n < len(request.buf) {
+			request.err = err
+			if request.err == nil {
+				request.err = io.EOF
+			}
+		}
+
+		close(request.done)
+	}
+}
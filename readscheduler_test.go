@@ -0,0 +1,98 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowFile is an in memory file that takes a while to perform each read, this gives concurrent
+// reads time to queue up behind each other.
+type slowFile struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (f *slowFile) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(f.delay)
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *slowFile) WriteAt(p []byte, off int64) (int, error) {
+	return copy(f.data[off:], p), nil
+}
+
+func TestCoalescingFile_ReadAt(t *testing.T) {
+	t.Run("concurrent", func(t *testing.T) {
+		data := make([]byte, 1024*64)
+		for i := range data {
+			data[i] = byte(i)
+		}
+
+		file := newCoalescingFile(&slowFile{
+			data:  data,
+			delay: time.Millisecond * 5,
+		})
+
+		numberOfReads := 64
+		wg := sync.WaitGroup{}
+		wg.Add(numberOfReads)
+		for i := 0; i < numberOfReads; i++ {
+			go func(i int) {
+				defer wg.Done()
+				off := int64(i * 1024)
+				buf := make([]byte, 512)
+				n, err := file.ReadAt(buf, off)
+				assert.NoError(t, err)
+				assert.Equal(t, len(buf), n)
+				assert.Equal(t, data[off:off+int64(len(buf))], buf)
+			}(i)
+		}
+		wg.Wait()
+
+		assert.Equal(t, uint64(numberOfReads), file.reads)
+		assert.True(t, file.physicalReads < file.reads,
+			"expected fewer than %d physical reads, got %d", file.reads, file.physicalReads)
+	})
+
+	t.Run("end of file", func(t *testing.T) {
+		file := newCoalescingFile(&slowFile{
+			data: []byte("0123456789"),
+		})
+
+		buf := make([]byte, 4)
+		n, err := file.ReadAt(buf, 8)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, []byte("89"), buf[:n])
+	})
+
+	t.Run("merged end of file", func(t *testing.T) {
+		file := newCoalescingFile(&slowFile{
+			data: []byte("0123456789"),
+		})
+
+		first := &readRequest{buf: make([]byte, 4), off: 0, done: make(chan struct{})}
+		second := &readRequest{buf: make([]byte, 4), off: 8, done: make(chan struct{})}
+		file.dispatch([]*readRequest{second, first})
+
+		assert.Equal(t, uint64(1), file.physicalReads)
+		assert.Equal(t, 4, first.n)
+		assert.NoError(t, first.err)
+		assert.Equal(t, []byte("0123"), first.buf)
+		assert.Equal(t, 2, second.n)
+		assert.Equal(t, io.EOF, second.err)
+		assert.Equal(t, []byte("89"), second.buf[:second.n])
+	})
+}
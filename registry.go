@@ -0,0 +1,163 @@
+package lsmtree
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrTooManyDatabases is returned by Open when the Registry in the Options already has the
+	// maximum number of databases open.
+	ErrTooManyDatabases = errors.New("too many open databases")
+)
+
+type (
+	// RegistryOptions are the limits that are enforced across every database in a Registry.
+	RegistryOptions struct {
+		// MaxOpenDatabases is the largest number of databases that can be open with the registry
+		// at the same time. If this is 0 then there is no limit.
+		MaxOpenDatabases int
+
+		// MaxMemtableMemory is the total number of bytes that the memtables of every database in
+		// the registry can use at the same time. If this is 0 then there is no limit.
+		MaxMemtableMemory int64
+
+		// MaxCompactions is the total number of compactions that can be running at the same time
+		// across every database in the registry. If this is 0 then there is no limit.
+		MaxCompactions int
+	}
+
+	// Registry is used by processes that host many databases (like one database per shard). The
+	// same registry can be provided in the Options of each database, and it can then be used to
+	// enumerate all of the open databases and collect their metrics in one place. The limits in
+	// the RegistryOptions are shared by every database in the registry.
+	Registry struct {
+		options RegistryOptions
+
+		// lock must be held to read or modify the databases or memory.
+		lock sync.Mutex
+
+		// databases are all of the open databases, in the order they were opened.
+		databases []*DB
+
+		// memory is the number of bytes that have been reserved for memtables.
+		memory int64
+
+		// compactions has a slot for every compaction that is allowed to run at the same time. If
+		// this is nil then compactions are not limited.
+		compactions chan struct{}
+	}
+)
+
+// NewRegistry will create a new registry with the limits provided. The registry can then be
+// shared by multiple databases by setting Options.Registry.
+func NewRegistry(options RegistryOptions) *Registry {
+	registry := &Registry{
+		options: options,
+	}
+
+	if options.MaxCompactions > 0 {
+		registry.compactions = make(chan struct{}, options.MaxCompactions)
+	}
+
+	return registry
+}
+
+// Databases returns all of the databases that are currently open with the registry, in the order
+// they were opened.
+func (r *Registry) Databases() []*DB {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	databases := make([]*DB, len(r.databases))
+	copy(databases, r.databases)
+
+	return databases
+}
+
+// Metrics returns the total of the metrics of every database that is open with the registry.
+func (r *Registry) Metrics() Metrics {
+	var metrics Metrics
+	for _, db := range r.Databases() {
+		metrics = metrics.Add(db.Metrics())
+	}
+
+	return metrics
+}
+
+// MemtableMemory returns the number of bytes that are currently reserved for memtables across
+// every database in the registry.
+func (r *Registry) MemtableMemory() int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.memory
+}
+
+// register will add the database to the registry. If the registry already has the maximum number
+// of databases open then ErrTooManyDatabases is returned.
+func (r *Registry) register(db *DB) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.options.MaxOpenDatabases > 0 && len(r.databases) >= r.options.MaxOpenDatabases {
+		return ErrTooManyDatabases
+	}
+
+	r.databases = append(r.databases, db)
+
+	return nil
+}
+
+// unregister will remove the database from the registry, allowing another database to be opened
+// in its place.
+func (r *Registry) unregister(db *DB) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i, item := range r.databases {
+		if item == db {
+			r.databases = append(r.databases[:i], r.databases[i+1:]...)
+			return
+		}
+	}
+}
+
+// reserveMemory will try to reserve the number of bytes specified for a memtable. If reserving the
+// memory would exceed MaxMemtableMemory then false is returned and nothing is reserved. Any memory
+// that is reserved must be given back with releaseMemory.
+func (r *Registry) reserveMemory(size int64) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.options.MaxMemtableMemory > 0 && r.memory+size > r.options.MaxMemtableMemory {
+		return false
+	}
+
+	r.memory += size
+
+	return true
+}
+
+// releaseMemory will give back memory that was reserved with reserveMemory.
+func (r *Registry) releaseMemory(size int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.memory -= size
+}
+
+// acquireCompaction will block until a compaction is allowed to start. Once the compaction has
+// finished releaseCompaction must be called.
+func (r *Registry) acquireCompaction() {
+	if r.compactions != nil {
+		r.compactions <- struct{}{}
+	}
+}
+
+// releaseCompaction will allow another compaction to start.
+func (r *Registry) releaseCompaction() {
+	if r.compactions != nil {
+		<-r.compactions
+	}
+}
@@ -0,0 +1,141 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Run("databases", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		registry := NewRegistry(RegistryOptions{
+			MaxOpenDatabases: 2,
+		})
+
+		open := func(name string) (*DB, error) {
+			options := DefaultOptions()
+			options.WALDirectory = path.Join(dir, name, "wal")
+			options.DataDirectory = path.Join(dir, name, "data")
+			options.Registry = registry
+			return Open(options)
+		}
+
+		first, err := open("first")
+		assert.NoError(t, err)
+		second, err := open("second")
+		assert.NoError(t, err)
+
+		assert.Equal(t, []*DB{first, second}, registry.Databases())
+		assert.Equal(t, 2, registry.Metrics().Databases)
+
+		// The registry is full so no more databases can be opened.
+		third, err := open("third")
+		assert.Equal(t, ErrTooManyDatabases, err)
+		assert.Nil(t, third)
+
+		// But the third database should not be left locked.
+		assert.NoError(t, first.Close())
+		assert.Equal(t, []*DB{second}, registry.Databases())
+
+		third, err = open("third")
+		assert.NoError(t, err)
+		assert.Equal(t, []*DB{second, third}, registry.Databases())
+
+		assert.NoError(t, second.Close())
+		assert.NoError(t, third.Close())
+		assert.Empty(t, registry.Databases())
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		registry := NewRegistry(RegistryOptions{})
+		for i := 0; i < 3; i++ {
+			options := DefaultOptions()
+			options.WALDirectory = path.Join(dir, fmt.Sprint(i), "wal")
+			options.DataDirectory = path.Join(dir, fmt.Sprint(i), "data")
+			options.Registry = registry
+
+			db, err := Open(options)
+			assert.NoError(t, err)
+			defer db.Close()
+
+			err = db.wal.Append(walTransaction{
+				TransactionId: 1,
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte("key"),
+						Value: []byte("value"),
+					},
+				},
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, db.SyncBarrier())
+		}
+
+		metrics := registry.Metrics()
+		assert.Equal(t, 3, metrics.Databases)
+		assert.Equal(t, uint64(3), metrics.WALTransactionsAppended)
+		assert.Equal(t, uint64(3), metrics.WALTransactionsSynced)
+		assert.Equal(t, 3, metrics.WAL.Segments)
+		assert.Equal(t, uint64(3), metrics.WAL.Unflushed)
+		assert.False(t, metrics.CollectedAt.IsZero())
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		registry := NewRegistry(RegistryOptions{
+			MaxMemtableMemory: 100,
+		})
+
+		assert.True(t, registry.reserveMemory(60))
+		assert.False(t, registry.reserveMemory(60))
+		assert.Equal(t, int64(60), registry.MemtableMemory())
+
+		registry.releaseMemory(60)
+		assert.True(t, registry.reserveMemory(100))
+		assert.Equal(t, int64(100), registry.MemtableMemory())
+	})
+
+	t.Run("compactions", func(t *testing.T) {
+		registry := NewRegistry(RegistryOptions{
+			MaxCompactions: 1,
+		})
+
+		registry.acquireCompaction()
+
+		var started int32
+		done := make(chan struct{})
+		go func() {
+			registry.acquireCompaction()
+			atomic.StoreInt32(&started, 1)
+			registry.releaseCompaction()
+			close(done)
+		}()
+
+		// The second compaction cannot start until the first one has finished.
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&started))
+
+		registry.releaseCompaction()
+		<-done
+		assert.Equal(t, int32(1), atomic.LoadInt32(&started))
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		registry := NewRegistry(RegistryOptions{})
+
+		// Without a limit these should never block or fail.
+		for i := 0; i < 10; i++ {
+			registry.acquireCompaction()
+			assert.True(t, registry.reserveMemory(1<<30))
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+type (
+	// ReplayOptions control how a trace is replayed by Replay.
+	ReplayOptions struct {
+		// Speed scales the time between operations. 1 replays the trace at the rate it was
+		// recorded, 2 replays it twice as fast. If this is 0 then operations are replayed as fast
+		// as possible, which measures the throughput of the database instead of its latency under
+		// the recorded load.
+		Speed float64
+	}
+
+	// ReplayStats are the results of replaying a trace.
+	ReplayStats struct {
+		// Gets, Sets and Deletes are the number of operations of each type that were replayed.
+		Gets    int
+		Sets    int
+		Deletes int
+
+		// Commits is the number of transactions that were committed.
+		Commits int
+
+		// Conflicts is the number of transactions that failed to commit with ErrTxnConflict.
+		// Transactions are replayed one at a time, so this only happens if something else is
+		// writing to the database.
+		Conflicts int
+
+		// Elapsed is how long the replay took.
+		Elapsed time.Duration
+	}
+)
+
+// Replay performs every operation in the trace against the database. Since a trace does not
+// contain any keys or values, each key is rebuilt from its hash and size and each value is filled
+// with zeros; the keys are not the original keys but every recorded operation on the same key
+// uses the same replayed key, so the pattern of reads and writes is the same.
+//
+// Operations are replayed one at a time in the order they were recorded. Writes are grouped into
+// the transactions they were committed in, while each read is replayed in its own read-only
+// transaction.
+func Replay(db *DB, reader *TraceReader, options ReplayOptions) (ReplayStats, error) {
+	var stats ReplayStats
+	var changes []walTransactionChange
+	var values []byte
+	var first time.Time
+	start := db.options.Clock.Now()
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return stats, err
+		}
+
+		if options.Speed > 0 {
+			if first.IsZero() {
+				first = record.Time
+			}
+
+			// Wait until the same amount of time has passed since the start of the replay as had
+			// passed since the start of the trace, scaled by the speed.
+			offset := time.Duration(float64(record.Time.Sub(first)) / options.Speed)
+			if wait := offset - db.options.Clock.Now().Sub(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		switch record.Op {
+		case TraceOpGet:
+			if err = replayGet(db, replayKey(record)); err != nil {
+				return stats, err
+			}
+			stats.Gets++
+		case TraceOpSet:
+			if len(values) < record.ValueSize {
+				values = make([]byte, record.ValueSize)
+			}
+			changes = append(changes, walTransactionChange{
+				Type:  walTransactionChangeTypeSet,
+				Key:   replayKey(record),
+				Value: values[:record.ValueSize],
+			})
+			stats.Sets++
+		case TraceOpDelete:
+			changes = append(changes, walTransactionChange{
+				Type: walTransactionChangeTypeDelete,
+				Key:  replayKey(record),
+			})
+			stats.Deletes++
+		case TraceOpCommit:
+			switch err = replayCommit(db, changes); err {
+			case nil:
+				stats.Commits++
+			case ErrTxnConflict:
+				stats.Conflicts++
+			default:
+				return stats, err
+			}
+			changes = changes[:0]
+		}
+	}
+
+	// Changes that are not followed by a commit can only come from a trace that was cut off part
+	// way through a transaction, they are not replayed.
+	stats.Elapsed = db.options.Clock.Now().Sub(start)
+
+	return stats, nil
+}
+
+// replayGet reads the key in its own read-only transaction.
+func replayGet(db *DB, key Key) error {
+	txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+
+	if _, err = txn.Get(key); err != nil && err != ErrKeyNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// replayCommit commits the changes of a single recorded transaction.
+func replayCommit(db *DB, changes []walTransactionChange) error {
+	txn, err := db.NewTransaction(TxnOptions{})
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+
+	for _, change := range changes {
+		if change.Type == walTransactionChangeTypeDelete {
+			err = txn.Delete(change.Key)
+		} else {
+			err = txn.Set(change.Key, change.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replay change to key of %d bytes: %w", len(change.Key), err)
+		}
+	}
+
+	return txn.Commit()
+}
+
+// replayKey rebuilds a key of the recorded size from its hash by repeating the hash.
+func replayKey(record TraceRecord) Key {
+	hash := make([]byte, 8)
+	binary.BigEndian.PutUint64(hash, record.KeyHash)
+
+	key := make(Key, record.KeySize)
+	for i := range key {
+		key[i] = hash[i%len(hash)]
+	}
+
+	return key
+}
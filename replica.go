@@ -0,0 +1,315 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrBadReplicaEntry is returned when a value stored by a Replica cannot be decoded. This
+	// usually means that the database was written to directly instead of through the Replica.
+	ErrBadReplicaEntry = errors.New("bad replica entry")
+)
+
+const (
+	// replicaEntryHeaderSize is the size of the header that a Replica stores in front of every
+	// value: 1 byte of flags, an 8 byte timestamp and an 8 byte origin.
+	replicaEntryHeaderSize = 1 + 8 + 8
+
+	// replicaEntryDeleted is set in the flags of an entry that is a tombstone.
+	replicaEntryDeleted byte = 1 << 0
+)
+
+var (
+	// Make sure the default resolver implements the ConflictResolver interface.
+	_ ConflictResolver = LastWriterWins{}
+)
+
+type (
+	// ReplicaEntry is the newest version of a key known to a Replica, along with where and when
+	// that version was written.
+	ReplicaEntry struct {
+		Key Key
+
+		// Value is the value of the key, it is nil if the key has been deleted.
+		Value []byte
+
+		// Deleted is true if this entry is a tombstone. Tombstones are kept forever so that a
+		// delete is not undone by syncing with a replica that has not seen it yet.
+		Deleted bool
+
+		// Timestamp is when the entry was written. Timestamps come from a hybrid clock: they
+		// follow the wall clock of the replica that wrote the entry, but are always greater than
+		// any timestamp the replica has seen from another replica. This way a write is always
+		// considered newer than anything that the writer could have observed.
+		Timestamp uint64
+
+		// Origin is the Id of the replica that wrote the entry.
+		Origin uint64
+	}
+
+	// ConflictResolver decides which version of a key should be kept when a replica receives a
+	// version of a key from another replica during Sync. Resolve must be deterministic and must
+	// not depend on which replica is local, otherwise replicas will not converge.
+	ConflictResolver interface {
+		Resolve(local, remote ReplicaEntry) ReplicaEntry
+	}
+
+	// LastWriterWins is the default ConflictResolver. The entry with the greater timestamp is
+	// kept, if both entries have the same timestamp then the entry from the greater origin wins.
+	LastWriterWins struct{}
+
+	// Replica stores keys in a database so that they can be synced with other replicas that are
+	// written to independently, such as an application that must keep working while it is
+	// offline. Every value is stored along with the timestamp and origin of the write, and when
+	// two replicas are synced a ConflictResolver picks which version of each key both replicas
+	// keep.
+	//
+	// A database used by a Replica should only be written to through the Replica.
+	Replica struct {
+		db       *DB
+		origin   uint64
+		resolver ConflictResolver
+
+		// lock serializes every write so that Merge can read the local entry and replace it
+		// without another write happening in between.
+		lock sync.Mutex
+
+		// timestamps allocates the timestamps of local writes and observes the timestamps of
+		// remote writes.
+		timestamps *timestampAllocator
+	}
+)
+
+// Resolve returns the entry that was written last.
+func (LastWriterWins) Resolve(local, remote ReplicaEntry) ReplicaEntry {
+	if remote.Timestamp > local.Timestamp ||
+		(remote.Timestamp == local.Timestamp && remote.Origin > local.Origin) {
+		return remote
+	}
+
+	return local
+}
+
+// NewReplica creates a replica that stores its keys in the database provided. The origin must be
+// unique among every replica that will ever be synced together. If resolver is nil then
+// LastWriterWins is used.
+func NewReplica(db *DB, origin uint64, resolver ConflictResolver) (*Replica, error) {
+	if resolver == nil {
+		resolver = LastWriterWins{}
+	}
+
+	replica := &Replica{
+		db:         db,
+		origin:     origin,
+		resolver:   resolver,
+		timestamps: newTimestampAllocator(db.options.Clock),
+	}
+
+	// Local writes need to be newer than anything already stored, even if the clock is behind.
+	err := replica.Scan(func(entry ReplicaEntry) error {
+		replica.timestamps.Observe(entry.Timestamp)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return replica, nil
+}
+
+// Origin returns the Id of the replica.
+func (r *Replica) Origin() uint64 {
+	return r.origin
+}
+
+// Get returns the value of the key. ErrKeyNotFound is returned if the key does not exist or has
+// been deleted.
+func (r *Replica) Get(key Key) ([]byte, error) {
+	entry, err := r.Entry(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Deleted {
+		return nil, ErrKeyNotFound
+	}
+
+	return entry.Value, nil
+}
+
+// Entry returns the newest entry for the key, including tombstones. ErrKeyNotFound is returned if
+// the replica has never seen the key.
+func (r *Replica) Entry(key Key) (ReplicaEntry, error) {
+	txn, err := r.db.NewTransaction(TxnOptions{ReadOnly: true})
+	if err != nil {
+		return ReplicaEntry{}, err
+	}
+	defer txn.Discard()
+
+	return r.get(txn, key)
+}
+
+// Set sets the key to the value.
+func (r *Replica) Set(key Key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	return r.write(key, value, false)
+}
+
+// Delete deletes the key. A tombstone is stored so that the delete can be synced to other replicas.
+func (r *Replica) Delete(key Key) error {
+	return r.write(key, nil, true)
+}
+
+// write stores a new local entry for the key.
+func (r *Replica) write(key Key, value []byte, deleted bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.put(ReplicaEntry{
+		Key:       key,
+		Value:     value,
+		Deleted:   deleted,
+		Timestamp: r.timestamps.Next(),
+		Origin:    r.origin,
+	})
+}
+
+// Merge resolves the remote entry against the local entry for the same key and stores the result.
+// It returns true if the local entry was changed.
+func (r *Replica) Merge(remote ReplicaEntry) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Anything written locally from now on must be newer than what we have seen.
+	r.timestamps.Observe(remote.Timestamp)
+
+	local, err := r.Entry(remote.Key)
+	if err == ErrKeyNotFound {
+		return true, r.put(remote)
+	} else if err != nil {
+		return false, err
+	}
+
+	resolved := r.resolver.Resolve(local, remote)
+	if resolved.Timestamp == local.Timestamp && resolved.Origin == local.Origin {
+		return false, nil
+	}
+
+	return true, r.put(resolved)
+}
+
+// Scan calls fn with every entry in the replica in ascending order of their keys, including
+// tombstones. If fn returns an error then the scan is stopped and the error is returned.
+func (r *Replica) Scan(fn func(entry ReplicaEntry) error) error {
+	txn, err := r.db.NewTransaction(TxnOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+
+	iterator, err := txn.NewIterator(IteratorOptions{})
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		item := iterator.Item()
+		entry, err := decodeReplicaEntry(item.Key, item.Value)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sync performs anti-entropy between two replicas: every entry from each replica is merged into
+// the other one. Once Sync returns both replicas will have the same entry for every key, unless
+// they were written to while the sync was running.
+func Sync(a, b *Replica) error {
+	if err := a.Scan(func(entry ReplicaEntry) error {
+		_, err := b.Merge(entry)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return b.Scan(func(entry ReplicaEntry) error {
+		_, err := a.Merge(entry)
+		return err
+	})
+}
+
+// get reads and decodes the entry for the key.
+func (r *Replica) get(txn *Txn, key Key) (ReplicaEntry, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return ReplicaEntry{}, err
+	}
+
+	return decodeReplicaEntry(item.Key, item.Value)
+}
+
+// put stores the entry, replacing any entry for the same key.
+func (r *Replica) put(entry ReplicaEntry) error {
+	txn, err := r.db.NewTransaction(TxnOptions{})
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+
+	if err = txn.Set(entry.Key, encodeReplicaEntry(entry)); err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// encodeReplicaEntry returns the value that is stored in the database for the entry.
+// 1. 1 Byte: Flags
+// 2. 8 Bytes: Timestamp
+// 3. 8 Bytes: Origin
+// 4. Remaining: The value, empty for tombstones
+func encodeReplicaEntry(entry ReplicaEntry) []byte {
+	data := make([]byte, replicaEntryHeaderSize, replicaEntryHeaderSize+len(entry.Value))
+	if entry.Deleted {
+		data[0] |= replicaEntryDeleted
+	}
+	binary.BigEndian.PutUint64(data[1:], entry.Timestamp)
+	binary.BigEndian.PutUint64(data[9:], entry.Origin)
+
+	if !entry.Deleted {
+		data = append(data, entry.Value...)
+	}
+
+	return data
+}
+
+// decodeReplicaEntry reads an entry from the value stored in the database.
+func decodeReplicaEntry(key Key, data []byte) (ReplicaEntry, error) {
+	if len(data) < replicaEntryHeaderSize || data[0]&^replicaEntryDeleted != 0 {
+		return ReplicaEntry{}, ErrBadReplicaEntry
+	}
+
+	entry := ReplicaEntry{
+		Key:       key,
+		Deleted:   data[0]&replicaEntryDeleted != 0,
+		Timestamp: binary.BigEndian.Uint64(data[1:]),
+		Origin:    binary.BigEndian.Uint64(data[9:]),
+	}
+	if !entry.Deleted {
+		entry.Value = data[replicaEntryHeaderSize:]
+	}
+
+	return entry, nil
+}
@@ -0,0 +1,162 @@
+package lsmtree
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// concatResolver keeps both values when two replicas conflict, it is used to make sure that a
+// custom resolver is used.
+type concatResolver struct{}
+
+func (concatResolver) Resolve(local, remote ReplicaEntry) ReplicaEntry {
+	if local.Deleted || remote.Deleted {
+		return LastWriterWins{}.Resolve(local, remote)
+	}
+
+	// Order the values so that both replicas end up with the same result.
+	first, second := local, remote
+	if bytes.Compare(first.Value, second.Value) > 0 {
+		first, second = second, first
+	}
+
+	// If one value already contains the other then they have been merged before.
+	resolved := LastWriterWins{}.Resolve(local, remote)
+	if bytes.HasPrefix(first.Value, second.Value) || bytes.HasPrefix(second.Value, first.Value) {
+		return resolved
+	}
+	resolved.Value = append(append(append([]byte{}, first.Value...), '+'), second.Value...)
+	resolved.Timestamp++
+	return resolved
+}
+
+func TestReplica(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 1000))
+
+	newReplica := func(t *testing.T, origin uint64, resolver ConflictResolver) (*Replica, func()) {
+		options := DefaultOptions()
+		options.Clock = clock
+		db, cleanup := newTestDB(t, options)
+
+		replica, err := NewReplica(db, origin, resolver)
+		assert.NoError(t, err)
+
+		return replica, cleanup
+	}
+
+	get := func(t *testing.T, replica *Replica, key string) string {
+		value, err := replica.Get(Key(key))
+		if err == ErrKeyNotFound {
+			return ""
+		}
+		assert.NoError(t, err)
+		return string(value)
+	}
+
+	t.Run("last writer wins", func(t *testing.T) {
+		a, cleanupA := newReplica(t, 1, nil)
+		defer cleanupA()
+		b, cleanupB := newReplica(t, 2, nil)
+		defer cleanupB()
+
+		assert.NoError(t, a.Set(Key("only-a"), []byte("a")))
+		assert.NoError(t, a.Set(Key("both"), []byte("a")))
+		clock.Advance(10)
+		assert.NoError(t, b.Set(Key("both"), []byte("b")))
+		assert.NoError(t, b.Set(Key("only-b"), []byte("b")))
+
+		assert.NoError(t, Sync(a, b))
+		for _, replica := range []*Replica{a, b} {
+			assert.Equal(t, "a", get(t, replica, "only-a"))
+			assert.Equal(t, "b", get(t, replica, "only-b"))
+			assert.Equal(t, "b", get(t, replica, "both"))
+		}
+	})
+
+	t.Run("ties use origin", func(t *testing.T) {
+		a, cleanupA := newReplica(t, 1, nil)
+		defer cleanupA()
+		b, cleanupB := newReplica(t, 2, nil)
+		defer cleanupB()
+
+		clock.Advance(10)
+		assert.NoError(t, a.Set(Key("key"), []byte("a")))
+		assert.NoError(t, b.Set(Key("key"), []byte("b")))
+
+		assert.NoError(t, Sync(a, b))
+		assert.Equal(t, "b", get(t, a, "key"))
+		assert.Equal(t, "b", get(t, b, "key"))
+	})
+
+	t.Run("deletes are synced", func(t *testing.T) {
+		a, cleanupA := newReplica(t, 1, nil)
+		defer cleanupA()
+		b, cleanupB := newReplica(t, 2, nil)
+		defer cleanupB()
+
+		assert.NoError(t, a.Set(Key("key"), []byte("a")))
+		assert.NoError(t, Sync(a, b))
+		assert.Equal(t, "a", get(t, b, "key"))
+
+		clock.Advance(10)
+		assert.NoError(t, b.Delete(Key("key")))
+		assert.NoError(t, Sync(a, b))
+		assert.Equal(t, "", get(t, a, "key"))
+
+		entry, err := a.Entry(Key("key"))
+		assert.NoError(t, err)
+		assert.True(t, entry.Deleted)
+		assert.Equal(t, uint64(2), entry.Origin)
+	})
+
+	t.Run("writes after sync are newer", func(t *testing.T) {
+		a, cleanupA := newReplica(t, 1, nil)
+		defer cleanupA()
+		b, cleanupB := newReplica(t, 2, nil)
+		defer cleanupB()
+
+		// b has a clock that is far ahead, once a has seen its write anything a writes must win
+		// even though a's clock is behind.
+		_, err := b.Merge(ReplicaEntry{
+			Key:       Key("key"),
+			Value:     []byte("b"),
+			Timestamp: uint64(clock.Now().UnixNano()) + 1000000,
+			Origin:    2,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, Sync(a, b))
+		assert.NoError(t, a.Set(Key("key"), []byte("a")))
+		assert.NoError(t, Sync(a, b))
+		assert.Equal(t, "a", get(t, b, "key"))
+	})
+
+	t.Run("custom resolver", func(t *testing.T) {
+		a, cleanupA := newReplica(t, 1, concatResolver{})
+		defer cleanupA()
+		b, cleanupB := newReplica(t, 2, concatResolver{})
+		defer cleanupB()
+
+		assert.NoError(t, a.Set(Key("key"), []byte("x")))
+		assert.NoError(t, b.Set(Key("key"), []byte("y")))
+		assert.NoError(t, Sync(a, b))
+		assert.Equal(t, "x+y", get(t, a, "key"))
+		assert.Equal(t, "x+y", get(t, b, "key"))
+	})
+}
+
+func TestDecodeReplicaEntry(t *testing.T) {
+	entry := ReplicaEntry{Key: Key("a"), Value: []byte("value"), Timestamp: 5, Origin: 7}
+	decoded, err := decodeReplicaEntry(entry.Key, encodeReplicaEntry(entry))
+	assert.NoError(t, err)
+	assert.Equal(t, entry, decoded)
+
+	tombstone := ReplicaEntry{Key: Key("a"), Deleted: true, Timestamp: 5, Origin: 7}
+	decoded, err = decodeReplicaEntry(tombstone.Key, encodeReplicaEntry(tombstone))
+	assert.NoError(t, err)
+	assert.Equal(t, tombstone, decoded)
+
+	_, err = decodeReplicaEntry(Key("a"), []byte("short"))
+	assert.Equal(t, ErrBadReplicaEntry, err)
+}
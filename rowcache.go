@@ -0,0 +1,232 @@
+package lsmtree
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// rowCacheEntryOverhead is roughly how many bytes each entry in the row cache uses on top of
+	// its key and value.
+	rowCacheEntryOverhead = 96
+)
+
+type (
+	// RowCacheStats describe how the row cache is being used. See Options.RowCacheSize.
+	RowCacheStats struct {
+		// Hits and Misses are the number of lookups that were and were not answered by the cache.
+		Hits   uint64
+		Misses uint64
+
+		// Evictions is the number of entries removed to make room for new ones or to free memory.
+		// Entries removed because their key was written are not counted.
+		Evictions uint64
+
+		// Entries is the number of keys in the cache and Size is the approximate number of bytes
+		// they use.
+		Entries int
+		Size    int64
+	}
+
+	// rowCache holds the newest version of recently read keys, so that lookups of hot keys do not
+	// have to search the read path at all. Keys are evicted in least recently used order once the
+	// cache is full.
+	//
+	// Entries are kept consistent the same way as the negativeCache: each entry records the
+	// snapshot timestamp it was read at and only answers lookups at that timestamp or newer, every
+	// write removes the keys it changes before it becomes visible, and an entry is only added if no
+	// write newer than its timestamp has been applied.
+	rowCache struct {
+		// hits, misses and evictions are only modified atomically. They come first so that they
+		// are 64-bit aligned on 32-bit platforms.
+		hits      uint64
+		misses    uint64
+		evictions uint64
+
+		lock     sync.Mutex
+		capacity int64
+		size     int64
+		entries  map[string]*list.Element
+		order    *list.List
+
+		// highWater is the newest timestamp of any write that has removed keys from the cache.
+		highWater uint64
+
+		// memory is told about every change in the size of the cache.
+		memory *memoryAccountant
+	}
+
+	// rowCacheEntry is a single key in the rowCache.
+	rowCacheEntry struct {
+		item      Item
+		timestamp uint64
+		size      int64
+	}
+)
+
+// newRowCache creates a row cache that uses up to capacity bytes. If capacity is 0 then nothing
+// is cached. The cache registers itself with the memory accountant so that it is shrunk before
+// anything else when the database is using too much memory.
+func newRowCache(capacity int64, memory *memoryAccountant) *rowCache {
+	cache := &rowCache{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+		memory:   memory,
+	}
+
+	if capacity > 0 {
+		memory.AddReclaimer(memoryRowCache, cache.Reclaim)
+	}
+
+	return cache
+}
+
+// Get returns the newest version of the key for a lookup at the timestamp provided, if it is in
+// the cache.
+func (c *rowCache) Get(key Key, timestamp uint64) (Item, bool) {
+	if c.capacity == 0 {
+		return Item{}, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[string(key)]
+	if !ok || element.Value.(*rowCacheEntry).timestamp > timestamp {
+		atomic.AddUint64(&c.misses, 1)
+		return Item{}, false
+	}
+	c.order.MoveToFront(element)
+	atomic.AddUint64(&c.hits, 1)
+
+	// Items from the memtable are always copies that the caller can modify, so the cached item is
+	// copied the same way.
+	item := element.Value.(*rowCacheEntry).item
+	item.Key = append(Key{}, item.Key...)
+	item.Value = append([]byte{}, item.Value...)
+
+	return item, true
+}
+
+// Add records that the item was the newest version of its key at the timestamp provided.
+func (c *rowCache) Add(item Item, timestamp uint64) {
+	if c.capacity == 0 {
+		return
+	}
+
+	entry := &rowCacheEntry{
+		item:      item,
+		timestamp: timestamp,
+		size:      int64(len(item.Key)+len(item.Value)) + rowCacheEntryOverhead,
+	}
+
+	// Entries that would take up most of the cache would just push everything else out.
+	if entry.size > c.capacity/2 {
+		return
+	}
+
+	c.lock.Lock()
+	delta := c.add(entry)
+	c.lock.Unlock()
+
+	// The accountant may call Reclaim, so it must be told after the lock has been released.
+	c.memory.Add(memoryRowCache, delta)
+}
+
+// add inserts the entry and evicts whatever is needed to make room for it. The lock must be held.
+// The change in the size of the cache is returned.
+func (c *rowCache) add(entry *rowCacheEntry) int64 {
+	// A write newer than the lookup has been applied, it may have changed this key after the
+	// lookup read it.
+	if entry.timestamp < c.highWater {
+		return 0
+	}
+
+	before := c.size
+	if element, ok := c.entries[string(entry.item.Key)]; ok {
+		c.remove(element)
+	}
+
+	for c.size+entry.size > c.capacity && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+
+	c.entries[string(entry.item.Key)] = c.order.PushFront(entry)
+	c.size += entry.size
+
+	return c.size - before
+}
+
+// Invalidate removes every key changed by a write at the timestamp provided. This must be called
+// after the write has been applied to the memtable and before it is visible to new transactions.
+func (c *rowCache) Invalidate(timestamp uint64, changes []walTransactionChange) {
+	if c.capacity == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	if timestamp > c.highWater {
+		c.highWater = timestamp
+	}
+
+	before := c.size
+	for _, change := range changes {
+		if element, ok := c.entries[string(change.Key)]; ok {
+			c.remove(element)
+		}
+	}
+	delta := c.size - before
+	c.lock.Unlock()
+
+	c.memory.Add(memoryRowCache, delta)
+}
+
+// Reclaim evicts the least recently used entries until at least the number of bytes provided
+// have been freed or the cache is empty.
+func (c *rowCache) Reclaim(bytes int64) {
+	c.lock.Lock()
+	before := c.size
+	for before-c.size < bytes && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+	delta := c.size - before
+	c.lock.Unlock()
+
+	c.memory.Add(memoryRowCache, delta)
+}
+
+// Stats returns a snapshot of how the cache is being used.
+func (c *rowCache) Stats() RowCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return RowCacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Entries:   c.order.Len(),
+		Size:      c.size,
+	}
+}
+
+// Add returns the sum of the two sets of stats.
+func (s RowCacheStats) Add(other RowCacheStats) RowCacheStats {
+	return RowCacheStats{
+		Hits:      s.Hits + other.Hits,
+		Misses:    s.Misses + other.Misses,
+		Evictions: s.Evictions + other.Evictions,
+		Entries:   s.Entries + other.Entries,
+		Size:      s.Size + other.Size,
+	}
+}
+
+// remove removes a single entry from the cache. The lock must be held.
+func (c *rowCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*rowCacheEntry)
+	delete(c.entries, string(entry.item.Key))
+	c.size -= entry.size
+}
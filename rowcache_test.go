@@ -0,0 +1,161 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRowCache(t *testing.T) {
+	item := func(key, value string) Item {
+		return Item{
+			Key:     Key(key),
+			Value:   []byte(value),
+			Version: 1,
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		c := newRowCache(0, newMemoryAccountant(0))
+		c.Add(item("a", "value"), 1)
+		_, ok := c.Get(Key("a"), 1)
+		assert.False(t, ok)
+		assert.Equal(t, RowCacheStats{}, c.Stats())
+	})
+
+	t.Run("timestamps", func(t *testing.T) {
+		c := newRowCache(4096, newMemoryAccountant(0))
+		c.Add(item("a", "value"), 5)
+
+		// The item is only known to be the newest version at or after the lookup that read it.
+		_, ok := c.Get(Key("a"), 4)
+		assert.False(t, ok)
+		cached, ok := c.Get(Key("a"), 9)
+		assert.True(t, ok)
+		assert.Equal(t, item("a", "value"), cached)
+
+		// Writing the key removes it.
+		c.Invalidate(6, []walTransactionChange{{Key: Key("a")}})
+		_, ok = c.Get(Key("a"), 9)
+		assert.False(t, ok)
+
+		// A lookup older than a write that has already been applied could have missed the write.
+		c.Add(item("b", "value"), 5)
+		_, ok = c.Get(Key("b"), 9)
+		assert.False(t, ok)
+		c.Add(item("b", "value"), 6)
+		_, ok = c.Get(Key("b"), 9)
+		assert.True(t, ok)
+	})
+
+	t.Run("copies", func(t *testing.T) {
+		c := newRowCache(4096, newMemoryAccountant(0))
+		c.Add(item("a", "value"), 1)
+
+		cached, ok := c.Get(Key("a"), 1)
+		assert.True(t, ok)
+		cached.Value[0] = 'X'
+
+		cached, ok = c.Get(Key("a"), 1)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("value"), cached.Value)
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		// Room for exactly two small entries.
+		c := newRowCache(2*(rowCacheEntryOverhead+2), newMemoryAccountant(0))
+		c.Add(item("a", "1"), 1)
+		c.Add(item("b", "1"), 1)
+		_, ok := c.Get(Key("a"), 1)
+		assert.True(t, ok)
+
+		// b is now the least recently used.
+		c.Add(item("c", "1"), 1)
+		_, ok = c.Get(Key("b"), 1)
+		assert.False(t, ok)
+		_, ok = c.Get(Key("a"), 1)
+		assert.True(t, ok)
+
+		stats := c.Stats()
+		assert.Equal(t, 2, stats.Entries)
+		assert.Equal(t, uint64(1), stats.Evictions)
+		assert.Equal(t, int64(2*(rowCacheEntryOverhead+2)), stats.Size)
+
+		// Entries that would take up most of the cache are not cached at all.
+		c.Add(item("d", string(make([]byte, rowCacheEntryOverhead))), 1)
+		_, ok = c.Get(Key("d"), 1)
+		assert.False(t, ok)
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		memory := newMemoryAccountant(0)
+		c := newRowCache(4096, memory)
+		c.Add(item("a", "value"), 1)
+		c.Add(item("b", "value"), 1)
+		assert.Equal(t, c.Stats().Size, memory.Usage().RowCache)
+
+		c.Invalidate(2, []walTransactionChange{{Key: Key("a")}})
+		assert.Equal(t, c.Stats().Size, memory.Usage().RowCache)
+
+		// The row cache is the first thing to be shrunk when there is too much memory in use.
+		memory.max = 1
+		memory.Add(memoryMemtables, 1)
+		assert.Equal(t, 0, c.Stats().Entries)
+		assert.Equal(t, int64(0), memory.Usage().RowCache)
+	})
+}
+
+func TestTxn_GetRowCache(t *testing.T) {
+	options := DefaultOptions()
+	options.RowCacheSize = 1024
+	db, cleanup := newTestDB(t, options)
+	defer cleanup()
+
+	get := func(key string) (Item, error) {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		return txn.Get(Key(key))
+	}
+
+	set := func(key, value string) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key(key), []byte(value)))
+		assert.NoError(t, txn.Commit())
+	}
+
+	set("a", "first")
+	for i := 0; i < 3; i++ {
+		item, err := get("a")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("first"), item.Value)
+	}
+
+	assert.Equal(t, uint64(1), db.Metrics().Lookups.Memtable)
+	assert.Equal(t, uint64(2), db.Metrics().Lookups.RowCache)
+	assert.Equal(t, uint64(2), db.Metrics().RowCache.Hits)
+	assert.Equal(t, 1, db.Metrics().RowCache.Entries)
+
+	// Once the key is written the new value must be read.
+	set("a", "second")
+	item, err := get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), item.Value)
+	assert.Equal(t, uint64(2), db.Metrics().Lookups.Memtable)
+
+	// Deleting the key must not leave the old value behind.
+	txn, err := db.NewTransaction(TxnOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Delete(Key("a")))
+	assert.NoError(t, txn.Commit())
+	_, err = get("a")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	options = db.options
+	options.RowCacheSize = -1
+	err = options.validate()
+	assert.True(t, errors.Is(err, ErrInvalidOptions))
+	assert.Contains(t, err.Error(), "RowCacheSize")
+}
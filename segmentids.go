@@ -0,0 +1,156 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrSegmentIdsExhausted is returned when a new WAL segment is needed but every segment Id
+	// has already been used. Ids are never reused, so the WAL cannot grow any further.
+	ErrSegmentIdsExhausted = errors.New("wal segment ids exhausted")
+)
+
+const (
+	// walSegmentIdLeaseSize is how many WAL segment Ids are leased from the manifest at once, so
+	// that the manifest is only rewritten once every this many segments instead of for each one.
+	walSegmentIdLeaseSize = 64
+)
+
+// WAL segment Ids have to keep increasing: recovery replays segments in the order of their Ids,
+// and anything that remembers a segment by its Id, like a watch, would be confused by a new
+// segment with an old Id. New segments are created with an Id after the newest segment in the WAL
+// directory, which is enough as long as there is a segment there. Once old segments are removed
+// the directory can be empty though, so the manifest also records the Ids that have been handed
+// out. Ids are leased from the manifest in blocks of walSegmentIdLeaseSize, this way a segment Id
+// is always recorded in the manifest before a segment is created with it.
+//
+// The manifest is only needed when the directory is empty. Otherwise the newest segment is used,
+// since segments are only removed oldest first, and starting after the end of the lease instead
+// would leave a gap between the segments every time the database is reopened. Gaps are what the
+// validation in validateWalSegments looks for: a segment missing between the oldest and the newest
+// segment means the transactions in it have been lost.
+
+type (
+	// walSegmentReport is what validateWalSegments found wrong with the WAL segment files.
+	walSegmentReport struct {
+		// Missing are the Ids between the oldest and the newest segment in the WAL directory
+		// that do not have a segment file.
+		Missing []walSegmentIdRange
+
+		// Duplicates are the paths of segment files that are not in the WAL directory but have
+		// the same Id as a segment that is.
+		Duplicates []string
+	}
+
+	// walSegmentIdRange is an inclusive range of WAL segment Ids.
+	walSegmentIdRange struct {
+		First uint64
+		Last  uint64
+	}
+)
+
+// useSegmentIdLease makes the manager lease segment Ids with the function provided, starting with
+// the Ids up to lastLeased which have already been leased. If there are no segments in the
+// directory then new segments are created after lastLeased. This must be called before anything
+// is appended.
+func (w *walManager) useSegmentIdLease(lastLeased uint64, lease func(lastSegmentId uint64) error) {
+	w.leasedSegmentId, w.leaseSegmentIds = lastLeased, lease
+	if w.lastSegmentId == 0 {
+		w.lastSegmentId = lastLeased
+	}
+}
+
+// nextSegmentId returns the Id for a new segment, leasing more Ids if there are none left. This
+// must be called while the appendLock is held.
+func (w *walManager) nextSegmentId() (uint64, error) {
+	if w.lastSegmentId == math.MaxUint64 {
+		return 0, ErrSegmentIdsExhausted
+	}
+
+	segmentId := w.lastSegmentId + 1
+	if w.leaseSegmentIds == nil || segmentId <= w.leasedSegmentId {
+		return segmentId, nil
+	}
+
+	lastLeased := segmentId + walSegmentIdLeaseSize - 1
+	if lastLeased < segmentId {
+		lastLeased = math.MaxUint64
+	}
+
+	if err := w.leaseSegmentIds(lastLeased); err != nil {
+		return 0, err
+	}
+	w.leasedSegmentId = lastLeased
+
+	return segmentId, nil
+}
+
+// validateWalSegments looks for segments missing from the WAL directory, and for segment files in
+// any of the other directories that have the same Id as one that is in the WAL directory.
+func validateWalSegments(walDirectory string, others []string) (walSegmentReport, error) {
+	var report walSegmentReport
+
+	segmentIds, err := listFiles(walDirectory, fileTypeWal)
+	if err != nil {
+		return report, err
+	}
+
+	existing := make(map[uint64]struct{}, len(segmentIds))
+	for i, segmentId := range segmentIds {
+		existing[segmentId] = struct{}{}
+		if i > 0 && segmentId > segmentIds[i-1]+1 {
+			report.Missing = append(report.Missing, walSegmentIdRange{
+				First: segmentIds[i-1] + 1,
+				Last:  segmentId - 1,
+			})
+		}
+	}
+
+	for _, directory := range others {
+		if directory == walDirectory {
+			continue
+		}
+
+		ids, err := listFiles(directory, fileTypeWal)
+		if err != nil {
+			return report, err
+		}
+
+		for _, segmentId := range ids {
+			if _, ok := existing[segmentId]; ok {
+				report.Duplicates = append(report.Duplicates,
+					path.Join(directory, getWalSegmentFileName(segmentId)))
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// Empty returns true if nothing was found wrong with the segments.
+func (r walSegmentReport) Empty() bool {
+	return len(r.Missing) == 0 && len(r.Duplicates) == 0
+}
+
+// String returns a description of everything that was found wrong with the segments.
+func (r walSegmentReport) String() string {
+	problems := make([]string, 0, len(r.Missing)+len(r.Duplicates))
+	for _, missing := range r.Missing {
+		if missing.First == missing.Last {
+			problems = append(problems, fmt.Sprintf("segment %d is missing", missing.First))
+		} else {
+			problems = append(problems,
+				fmt.Sprintf("segments %d through %d are missing", missing.First, missing.Last))
+		}
+	}
+
+	for _, duplicate := range r.Duplicates {
+		problems = append(problems, fmt.Sprintf("%s duplicates a segment in the WAL", duplicate))
+	}
+
+	return strings.Join(problems, ", ")
+}
@@ -0,0 +1,183 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestWalManager_NextSegmentId(t *testing.T) {
+	t.Run("lease", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+
+		var leases []uint64
+		manager.useSegmentIdLease(0, func(lastSegmentId uint64) error {
+			leases = append(leases, lastSegmentId)
+			return nil
+		})
+
+		// Ids are only leased once the previous lease has been used up.
+		for i := uint64(1); i <= walSegmentIdLeaseSize+1; i++ {
+			segmentId, err := manager.nextSegmentId()
+			assert.NoError(t, err)
+			assert.Equal(t, i, segmentId)
+			manager.lastSegmentId = segmentId
+		}
+		assert.Equal(t, []uint64{walSegmentIdLeaseSize, 2 * walSegmentIdLeaseSize}, leases)
+	})
+
+	t.Run("empty directory", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+		manager.useSegmentIdLease(10, func(uint64) error { return nil })
+
+		segmentId, err := manager.nextSegmentId()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(11), segmentId)
+	})
+
+	t.Run("existing segments", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		_, err := openWalSegment(dir, 3, 160, defaultFileMode)
+		assert.NoError(t, err)
+
+		// The newest segment is used instead of the end of the lease, so reopening the database
+		// does not leave a gap between the segments.
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+		manager.useSegmentIdLease(10, func(uint64) error { return nil })
+
+		segmentId, err := manager.nextSegmentId()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(4), segmentId)
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+
+		var leased uint64
+		manager.useSegmentIdLease(math.MaxUint64-2, func(lastSegmentId uint64) error {
+			leased = lastSegmentId
+			return nil
+		})
+
+		segmentId, err := manager.nextSegmentId()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(math.MaxUint64-1), segmentId)
+		assert.Equal(t, uint64(math.MaxUint64), leased)
+
+		manager.lastSegmentId = math.MaxUint64
+		_, err = manager.nextSegmentId()
+		assert.Equal(t, ErrSegmentIdsExhausted, err)
+	})
+
+	t.Run("segments removed", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.DataDirectory, options.WALDirectory = dir, dir
+		commit := func(t *testing.T) uint64 {
+			db, err := Open(options)
+			assert.NoError(t, err)
+			defer db.Close()
+
+			txn, err := db.NewTransaction(TxnOptions{})
+			assert.NoError(t, err)
+			assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+			assert.NoError(t, txn.Commit())
+
+			return db.wal.lastSegmentId
+		}
+
+		first := commit(t)
+		segmentIds, err := listFiles(dir, fileTypeWal)
+		assert.NoError(t, err)
+		for _, segmentId := range segmentIds {
+			assert.NoError(t, os.Remove(path.Join(dir, getWalSegmentFileName(segmentId))))
+		}
+
+		// Without any segments left the Ids come from the manifest, so none of them are reused.
+		assert.True(t, commit(t) > first)
+	})
+}
+
+func TestValidateWalSegments(t *testing.T) {
+	create := func(t *testing.T, directory string, segmentIds ...uint64) {
+		for _, segmentId := range segmentIds {
+			segment, err := openWalSegment(directory, segmentId, 160, defaultFileMode)
+			assert.NoError(t, err)
+			assert.NoError(t, segment.File.(*os.File).Close())
+		}
+	}
+
+	t.Run("consistent", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+		create(t, dir, 4, 5, 6)
+
+		report, err := validateWalSegments(dir, []string{dir})
+		assert.NoError(t, err)
+		assert.True(t, report.Empty())
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+		create(t, dir, 1, 3, 7)
+
+		report, err := validateWalSegments(dir, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []walSegmentIdRange{{First: 2, Last: 2}, {First: 4, Last: 6}}, report.Missing)
+		assert.Equal(t, "segment 2 is missing, segments 4 through 6 are missing", report.String())
+	})
+
+	t.Run("duplicates", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+		other, cleanupOther := NewTempDirectory(t)
+		defer cleanupOther()
+		create(t, dir, 1, 2)
+		create(t, other, 2, 3)
+
+		report, err := validateWalSegments(dir, []string{dir, other})
+		assert.NoError(t, err)
+		assert.Empty(t, report.Missing)
+		assert.Equal(t, []string{path.Join(other, getWalSegmentFileName(2))}, report.Duplicates)
+	})
+
+	t.Run("reported on open", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+		create(t, dir, 1, 3)
+
+		logger := &testLogger{}
+		options := DefaultOptions()
+		options.DataDirectory, options.WALDirectory = dir, dir
+		options.Logger = logger
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		messages := logger.Messages()
+		assert.Len(t, messages, 1)
+		assert.True(t, strings.Contains(messages[0], "segment 2 is missing"), messages)
+	})
+}
@@ -0,0 +1,128 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrZeroBandwidth is returned by GetSequence when the bandwidth is 0.
+	ErrZeroBandwidth = errors.New("sequence bandwidth must be greater than 0")
+)
+
+type (
+	// Sequence hands out ids that are unique and strictly increasing, even across restarts of the
+	// database. Ids are leased from the database in blocks of bandwidth ids so that only one
+	// write is needed per block instead of one per id. A Sequence is safe for concurrent use.
+	//
+	// Ids that were leased but not handed out are lost if the database is closed without calling
+	// Release first, so there may be gaps between ids but an id is never handed out twice.
+	Sequence struct {
+		lock sync.Mutex
+
+		db        *DB
+		key       Key
+		bandwidth uint64
+
+		// next is the next id that will be handed out, and leased is the first id that has not
+		// been leased yet. Once next reaches leased a new block has to be leased.
+		next   uint64
+		leased uint64
+	}
+)
+
+// GetSequence returns a Sequence that is stored under the key name. The key should not be
+// written to by anything else, and only one Sequence should be used for each name at a time. The
+// first id a new sequence hands out is 0.
+//
+// Bandwidth is how many ids are leased at once, a larger bandwidth means fewer writes but more
+// ids that can be lost if the database is not closed cleanly. A block is leased before
+// GetSequence returns.
+func (db *DB) GetSequence(name Key, bandwidth uint64) (*Sequence, error) {
+	if bandwidth == 0 {
+		return nil, ErrZeroBandwidth
+	}
+
+	sequence := &Sequence{
+		db:        db,
+		key:       append(Key{}, name...),
+		bandwidth: bandwidth,
+	}
+
+	sequence.lock.Lock()
+	defer sequence.lock.Unlock()
+
+	if err := sequence.lease(); err != nil {
+		return nil, err
+	}
+
+	return sequence, nil
+}
+
+// Next returns the next id in the sequence.
+func (s *Sequence) Next() (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.next >= s.leased {
+		if err := s.lease(); err != nil {
+			return 0, err
+		}
+	}
+
+	id := s.next
+	s.next++
+
+	return id, nil
+}
+
+// Release gives back the ids that were leased but not handed out yet, so that the next Sequence
+// for the same name starts right after the last id this one handed out. The Sequence must not be
+// used after it has been released.
+func (s *Sequence) Release() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// If the stored lease is not ours anymore then another sequence has leased ids after ours,
+	// giving ours back would hand those ids out twice.
+	err := s.db.CompareAndSwap(s.key, encodeSequence(s.leased), encodeSequence(s.next))
+	if errors.Is(err, ErrValueMismatch) {
+		return nil
+	}
+
+	return err
+}
+
+// lease reserves the next block of ids. The lock must be held.
+func (s *Sequence) lease() error {
+	// The block is only ours once the update has committed, fn may be called more than once.
+	var start uint64
+	err := s.db.Update(s.key, func(old []byte) ([]byte, error) {
+		start = 0
+		if old != nil {
+			if len(old) != 8 {
+				return nil, fmt.Errorf("sequence %q has an invalid value", s.key)
+			}
+			start = binary.BigEndian.Uint64(old)
+		}
+
+		return encodeSequence(start + s.bandwidth), nil
+	})
+	if err != nil {
+		return err
+	}
+	s.next, s.leased = start, start+s.bandwidth
+
+	return nil
+}
+
+// encodeSequence returns the value that a sequence stores to record that every id before next
+// has been leased.
+func encodeSequence(next uint64) []byte {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, next)
+
+	return value
+}
@@ -0,0 +1,100 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestDB_GetSequence(t *testing.T) {
+	next := func(t *testing.T, sequence *Sequence, count int) []uint64 {
+		ids := make([]uint64, 0, count)
+		for i := 0; i < count; i++ {
+			id, err := sequence.Next()
+			assert.NoError(t, err)
+			ids = append(ids, id)
+		}
+
+		return ids
+	}
+
+	t.Run("leases blocks", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		sequence, err := db.GetSequence(Key("ids"), 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{0, 1, 2, 3, 4}, next(t, sequence, 5))
+
+		// A second sequence for the same name without a release starts after the last lease.
+		other, err := db.GetSequence(Key("ids"), 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{6, 7}, next(t, other, 2))
+
+		// The first sequence cannot give back its ids anymore, someone leased after it.
+		assert.NoError(t, sequence.Release())
+		assert.NoError(t, other.Release())
+
+		sequence, err = db.GetSequence(Key("ids"), 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{8}, next(t, sequence, 1))
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		sequence, err := db.GetSequence(Key("ids"), 4)
+		assert.NoError(t, err)
+
+		var lock sync.Mutex
+		seen := map[uint64]struct{}{}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, id := range next(t, sequence, 25) {
+					lock.Lock()
+					seen[id] = struct{}{}
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Len(t, seen, 100)
+	})
+
+	t.Run("survives restart", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		sequence, err := db.GetSequence(Key("ids"), 100)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{0, 1}, next(t, sequence, 2))
+		assert.NoError(t, db.Close())
+
+		// The rest of the lease was never released, so those ids are skipped.
+		db, err = Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+		sequence, err = db.GetSequence(Key("ids"), 100)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{100}, next(t, sequence, 1))
+	})
+
+	t.Run("zero bandwidth", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		_, err := db.GetSequence(Key("ids"), 0)
+		assert.Equal(t, ErrZeroBandwidth, err)
+	})
+}
@@ -0,0 +1,179 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrShardCountMismatch is returned by OpenSharded when the directories already contain a
+	// different number of shards than was requested. Keys are routed based on the number of
+	// shards, so changing it would make existing keys unreachable.
+	ErrShardCountMismatch = errors.New("shard count does not match existing shards")
+)
+
+const (
+	// shardDirectoryPrefix is the prefix of the directory that each shard is stored in, the
+	// directory name is suffixed with the index of the shard.
+	shardDirectoryPrefix = "shard-"
+)
+
+// ShardedDB partitions keys across multiple databases, each stored in its own directory. This
+// spreads compaction and lock contention across the shards. Keys are routed to a shard with a
+// consistent hash, so a key will always be stored in the same shard as long as the number of
+// shards does not change.
+type ShardedDB struct {
+	shards []*DB
+}
+
+// OpenSharded will open or create the number of shards specified. Each shard is opened with the
+// options provided, except that the WALDirectory, DataDirectory, HeapDirectories and
+// ValueDirectories of each shard will be a subdirectory of the directories in the options. If the
+// directories already contain shards then the number of shards must match.
+func OpenSharded(options Options, shards int) (_ *ShardedDB, err error) {
+	if shards <= 0 {
+		return nil, fmt.Errorf("%w: shards must be greater than 0", ErrInvalidOptions)
+	}
+
+	for _, directory := range getDatabaseDirectories(options) {
+		existing, err := countShardDirectories(directory)
+		if err != nil {
+			return nil, err
+		}
+
+		if existing != 0 && existing != shards {
+			return nil, ErrShardCountMismatch
+		}
+	}
+
+	db := &ShardedDB{
+		shards: make([]*DB, 0, shards),
+	}
+
+	// If one of the shards cannot be opened then the ones that were opened need to be closed.
+	defer func() {
+		if err != nil {
+			_ = db.Close()
+		}
+	}()
+
+	for i := 0; i < shards; i++ {
+		shardOptions := options
+		shardOptions.WALDirectory = path.Join(options.WALDirectory, getShardDirectoryName(i))
+		shardOptions.DataDirectory = path.Join(options.DataDirectory, getShardDirectoryName(i))
+		shardOptions.HeapDirectories = make([]string, len(options.HeapDirectories))
+		for j, directory := range options.HeapDirectories {
+			shardOptions.HeapDirectories[j] = path.Join(directory, getShardDirectoryName(i))
+		}
+		shardOptions.ValueDirectories = make([]string, len(options.ValueDirectories))
+		for j, directory := range options.ValueDirectories {
+			shardOptions.ValueDirectories[j] = path.Join(directory, getShardDirectoryName(i))
+		}
+
+		shard, err := Open(shardOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		db.shards = append(db.shards, shard)
+	}
+
+	return db, nil
+}
+
+// Shards returns the number of shards that keys are partitioned across.
+func (s *ShardedDB) Shards() int {
+	return len(s.shards)
+}
+
+// Shard returns the database for the shard index provided.
+func (s *ShardedDB) Shard(index int) *DB {
+	return s.shards[index]
+}
+
+// ShardFor returns the index of the shard that the key is stored in.
+func (s *ShardedDB) ShardFor(key Key) int {
+	hash := fnv.New64a()
+	_, _ = hash.Write(key)
+
+	return jumpHash(hash.Sum64(), len(s.shards))
+}
+
+// Metrics returns the total of the metrics from every shard.
+func (s *ShardedDB) Metrics() Metrics {
+	var metrics Metrics
+	for _, shard := range s.shards {
+		metrics = metrics.Add(shard.Metrics())
+	}
+
+	return metrics
+}
+
+// SyncBarrier will call SyncBarrier on every shard. See DB.SyncBarrier.
+func (s *ShardedDB) SyncBarrier() error {
+	for _, shard := range s.shards {
+		if err := shard.SyncBarrier(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close will close every shard. Every shard will be closed even if one of them fails, the first
+// error encountered is returned.
+func (s *ShardedDB) Close() error {
+	var firstErr error
+	for _, shard := range s.shards {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// getShardDirectoryName returns the name of the subdirectory that the shard will be stored in.
+func getShardDirectoryName(index int) string {
+	return fmt.Sprintf("%s%04d", shardDirectoryPrefix, index)
+}
+
+// countShardDirectories returns the number of shard directories that exist in the directory. If
+// the directory does not exist then 0 is returned.
+func countShardDirectories(directory string) (int, error) {
+	if !getPathExists(directory) {
+		return 0, nil
+	}
+
+	infos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), shardDirectoryPrefix) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// jumpHash is the jump consistent hash from "A Fast, Minimal Memory, Consistent Hash Algorithm" by
+// Lamping and Veach. It maps the key to one of the buckets such that when the number of buckets is
+// changed only the minimum number of keys are moved to a different bucket.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
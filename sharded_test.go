@@ -0,0 +1,136 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"path"
+	"testing"
+)
+
+func TestOpenSharded(t *testing.T) {
+	t.Run("simple", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = path.Join(dir, "wal")
+		options.DataDirectory = path.Join(dir, "data")
+
+		db, err := OpenSharded(options, 4)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, db.Shards())
+		assert.Equal(t, 4, db.Metrics().Databases)
+		assert.NoError(t, db.SyncBarrier())
+
+		for i := 0; i < db.Shards(); i++ {
+			assert.True(t, getPathExists(path.Join(options.WALDirectory, getShardDirectoryName(i))))
+			assert.True(t, getPathExists(path.Join(options.DataDirectory, getShardDirectoryName(i))))
+		}
+
+		assert.NoError(t, db.Close())
+
+		// The same number of shards can be opened again.
+		db, err = OpenSharded(options, 4)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("shard count mismatch", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := OpenSharded(options, 4)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+
+		db, err = OpenSharded(options, 5)
+		assert.Equal(t, ErrShardCountMismatch, err)
+		assert.Nil(t, db)
+	})
+
+	t.Run("invalid shard count", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := OpenSharded(options, 0)
+		assert.Error(t, err)
+		assert.Nil(t, db)
+	})
+
+	t.Run("shard fails to open", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := OpenSharded(options, 4)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+
+		// Lock one of the shards so that opening the sharded database will fail part way through.
+		shard, err := Open(func() Options {
+			shardOptions := options
+			shardOptions.WALDirectory = path.Join(dir, getShardDirectoryName(2))
+			shardOptions.DataDirectory = shardOptions.WALDirectory
+			return shardOptions
+		}())
+		assert.NoError(t, err)
+
+		db, err = OpenSharded(options, 4)
+		assert.Equal(t, ErrDatabaseLocked, err)
+		assert.Nil(t, db)
+		assert.NoError(t, shard.Close())
+
+		// The shards that were opened before the failure should have been closed.
+		db, err = OpenSharded(options, 4)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+	})
+}
+
+func TestShardedDB_ShardFor(t *testing.T) {
+	db := &ShardedDB{
+		shards: make([]*DB, 8),
+	}
+
+	counts := make([]int, db.Shards())
+	for i := 0; i < 10000; i++ {
+		key := Key(fmt.Sprintf("key%d", i))
+
+		shard := db.ShardFor(key)
+		assert.True(t, shard >= 0 && shard < db.Shards())
+		assert.Equal(t, shard, db.ShardFor(key), "routing must be deterministic")
+		counts[shard]++
+	}
+
+	// The keys should be spread reasonably evenly across the shards.
+	for _, count := range counts {
+		assert.InDelta(t, 10000/8, count, 250)
+	}
+}
+
+func TestJumpHash(t *testing.T) {
+	t.Run("single bucket", func(t *testing.T) {
+		for key := uint64(0); key < 100; key++ {
+			assert.Equal(t, 0, jumpHash(key, 1))
+		}
+	})
+
+	t.Run("minimal movement", func(t *testing.T) {
+		// When a bucket is added, keys should only ever move to the new bucket.
+		for key := uint64(0); key < 1000; key++ {
+			before, after := jumpHash(key, 10), jumpHash(key, 11)
+			assert.True(t, before == after || after == 10)
+		}
+	})
+}
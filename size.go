@@ -0,0 +1,127 @@
+package lsmtree
+
+import (
+	"io/ioutil"
+	"path"
+	"sync/atomic"
+)
+
+type (
+	// DiskUsage is the number of bytes used on the disk by each kind of file in the database.
+	// Files that were not created by the database are not counted.
+	DiskUsage struct {
+		// WAL is the size of every WAL segment, including segments that are only partially used.
+		WAL int64
+
+		// Manifest is the size of the manifest files.
+		Manifest int64
+
+		// Heap is the size of the heap files that hold the sorted keys.
+		Heap int64
+
+		// Values is the size of the value files.
+		Values int64
+
+		// Obsolete is the size of the files that are no longer needed but have not been deleted
+		// yet. (see Options.DeleteBytesPerSecond)
+		Obsolete int64
+	}
+)
+
+// Total returns the total number of bytes used on the disk.
+func (d DiskUsage) Total() int64 {
+	return d.WAL + d.Manifest + d.Heap + d.Values + d.Obsolete
+}
+
+// Size returns the number of bytes that the database is using on the disk. The sizes are read
+// from the directories every time this is called, so it should not be called in a hot path.
+func (db *DB) Size() (DiskUsage, error) {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return DiskUsage{}, ErrClosed
+	}
+
+	return getDiskUsage(getDatabaseDirectories(db.options))
+}
+
+// DirectoryUsage returns the number of bytes that the database is using in each of its
+// directories, by directory. This shows how evenly files are spread when heap or value files are
+// striped across several directories, see Options.HeapDirectories and Options.ValueDirectories.
+func (db *DB) DirectoryUsage() (map[string]DiskUsage, error) {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return nil, ErrClosed
+	}
+
+	usage := map[string]DiskUsage{}
+	for _, directory := range getDatabaseDirectories(db.options) {
+		directoryUsage, err := getDiskUsage([]string{directory})
+		if err != nil {
+			return nil, err
+		}
+
+		usage[directory] = directoryUsage
+	}
+
+	return usage, nil
+}
+
+// getDiskUsage adds up the size of every database file in the directories provided. Each directory
+// should only be provided once or its files will be counted twice.
+func getDiskUsage(directories []string) (DiskUsage, error) {
+	usage := DiskUsage{}
+	for _, directory := range directories {
+		infos, err := ioutil.ReadDir(directory)
+		if err != nil {
+			return DiskUsage{}, err
+		}
+
+		for _, info := range infos {
+			if info.IsDir() {
+				if info.Name() == trashDirectoryName {
+					obsolete, err := getDirectorySize(path.Join(directory, info.Name()))
+					if err != nil {
+						return DiskUsage{}, err
+					}
+
+					usage.Obsolete += obsolete
+				}
+
+				continue
+			}
+
+			kind, _, err := parseFileName(info.Name())
+			if err != nil {
+				continue
+			}
+
+			switch kind {
+			case fileTypeWal:
+				usage.WAL += info.Size()
+			case fileTypeManifest:
+				usage.Manifest += info.Size()
+			case fileTypeHeap:
+				usage.Heap += info.Size()
+			case fileTypeValue:
+				usage.Values += info.Size()
+			}
+		}
+	}
+
+	return usage, nil
+}
+
+// getDirectorySize returns the total size of the files directly within the directory.
+func getDirectorySize(directory string) (int64, error) {
+	infos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, info := range infos {
+		if !info.IsDir() {
+			size += info.Size()
+		}
+	}
+
+	return size, nil
+}
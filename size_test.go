@@ -0,0 +1,65 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	t.Run("each kind of file", func(t *testing.T) {
+		walDirectory, cleanupWal := NewTempDirectory(t)
+		defer cleanupWal()
+		dataDirectory, cleanupData := NewTempDirectory(t)
+		defer cleanupData()
+
+		files := map[string]int{
+			path.Join(walDirectory, getWalSegmentFileName(1)):   100,
+			path.Join(walDirectory, getWalSegmentFileName(2)):   50,
+			path.Join(dataDirectory, getManifestFileName(1)):    10,
+			path.Join(dataDirectory, getHeapFileName(1)):        20,
+			path.Join(dataDirectory, getValueFileName(1)):       30,
+			path.Join(dataDirectory, getValueFileName(2)):       5,
+			path.Join(dataDirectory, "not a database file"):     1000,
+			path.Join(dataDirectory, getHeapFileName(2)+".tmp"): 1000,
+		}
+		for name, size := range files {
+			assert.NoError(t, ioutil.WriteFile(name, make([]byte, size), 0644))
+		}
+		assert.NoError(t, os.Mkdir(path.Join(dataDirectory, getValueFileName(3)), 0755))
+
+		usage, err := getDiskUsage([]string{walDirectory, dataDirectory})
+		assert.NoError(t, err)
+		assert.Equal(t, DiskUsage{
+			WAL:      150,
+			Manifest: 10,
+			Heap:     20,
+			Values:   35,
+		}, usage)
+		assert.Equal(t, int64(215), usage.Total())
+	})
+
+	t.Run("database", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+		assert.NoError(t, txn.Commit())
+
+		usage, err := db.Size()
+		assert.NoError(t, err)
+		assert.True(t, usage.WAL > 0)
+
+		// The manifest is written when the first segment Ids are leased.
+		assert.True(t, usage.Manifest > 0)
+		assert.Equal(t, usage.WAL+usage.Manifest, usage.Total())
+
+		assert.NoError(t, db.Close())
+		_, err = db.Size()
+		assert.Equal(t, ErrClosed, err)
+	})
+}
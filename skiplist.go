@@ -0,0 +1,159 @@
+package lsmtree
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// skiplistMaxHeight is the largest number of levels that a node in the skiplist can have.
+	// With a branching factor of 4 this is enough for billions of entries.
+	skiplistMaxHeight = 16
+
+	// skiplistBranching is the inverse of the probability that a node will have another level.
+	skiplistBranching = 4
+)
+
+// Only one goroutine may call Put at a time, but any number of goroutines can read the skiplist
+// while it is being written to without taking a lock. A new node is filled in completely before it
+// is linked in, and every link is published with an atomic store, so a reader either sees the node
+// with everything it needs or does not see it at all. Links are linked in from the bottom level up,
+// a reader that finds a node on a higher level will always find it on the levels below. Nodes are
+// never removed, the whole skiplist is dropped at once and the garbage collector frees it once the
+// last reader is done with it.
+
+type (
+	// skiplist is an ordered set of timestamped keys and their values. It is safe for one writer
+	// and many readers to use concurrently, the memtable makes sure there is only one writer.
+	skiplist struct {
+		head *skiplistNode
+
+		// height and length are only modified atomically.
+		height int32
+		length int64
+
+		random *rand.Rand
+	}
+
+	// skiplistNode is a single entry in the skiplist.
+	skiplistNode struct {
+		key TimestampedKey
+
+		// entry is a *memtableEntry, it is replaced as a whole if the key is put again.
+		entry unsafe.Pointer
+
+		// next are the *skiplistNode that follow this one on each level.
+		next []unsafe.Pointer
+	}
+)
+
+// newSkiplist creates an empty skiplist.
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head: &skiplistNode{
+			next: make([]unsafe.Pointer, skiplistMaxHeight),
+		},
+		height: 1,
+		random: rand.New(rand.NewSource(1)),
+	}
+}
+
+// Put will insert the key into the skiplist, or replace its entry if the key already exists. Put
+// must not be called by more than one goroutine at a time.
+func (s *skiplist) Put(key TimestampedKey, entry memtableEntry) {
+	var previous [skiplistMaxHeight]*skiplistNode
+	node := s.findGreaterOrEqual(key, &previous)
+	if node != nil && compareTimestampedKeys(node.key, key) == 0 {
+		atomic.StorePointer(&node.entry, unsafe.Pointer(&entry))
+		return
+	}
+
+	height := s.randomHeight()
+	if current := int(atomic.LoadInt32(&s.height)); height > current {
+		for i := current; i < height; i++ {
+			previous[i] = s.head
+		}
+
+		// A reader that sees the new height before the node is linked in just finds nothing on
+		// the new levels of the head and moves down.
+		atomic.StoreInt32(&s.height, int32(height))
+	}
+
+	node = &skiplistNode{
+		key:   key,
+		entry: unsafe.Pointer(&entry),
+		next:  make([]unsafe.Pointer, height),
+	}
+	for i := 0; i < height; i++ {
+		node.setNext(i, previous[i].Next(i))
+		previous[i].setNext(i, node)
+	}
+
+	atomic.AddInt64(&s.length, 1)
+}
+
+// Seek returns the first node with a key greater than or equal to the key provided, or nil if
+// there is no such node.
+func (s *skiplist) Seek(key TimestampedKey) *skiplistNode {
+	return s.findGreaterOrEqual(key, nil)
+}
+
+// First returns the first node in the skiplist, or nil if it is empty.
+func (s *skiplist) First() *skiplistNode {
+	return s.head.Next(0)
+}
+
+// Len returns the number of keys in the skiplist.
+func (s *skiplist) Len() int {
+	return int(atomic.LoadInt64(&s.length))
+}
+
+// findGreaterOrEqual returns the first node with a key greater than or equal to the key provided.
+// If previous is not nil then it will be filled with the last node before the key at each level.
+func (s *skiplist) findGreaterOrEqual(
+	key TimestampedKey, previous *[skiplistMaxHeight]*skiplistNode,
+) *skiplistNode {
+	// The node that stopped the scan on the bottom level is returned, rather than loading the link
+	// again. A node put in between would be linked after the node the scan stopped at, but it could
+	// sort before the key, like a newer version of the same key.
+	var next *skiplistNode
+	node := s.head
+	for level := int(atomic.LoadInt32(&s.height)) - 1; level >= 0; level-- {
+		for next = node.Next(level); next != nil && compareTimestampedKeys(next.key, key) < 0; {
+			node, next = next, next.Next(level)
+		}
+
+		if previous != nil {
+			previous[level] = node
+		}
+	}
+
+	return next
+}
+
+// randomHeight picks the number of levels for a new node.
+func (s *skiplist) randomHeight() int {
+	height := 1
+	for height < skiplistMaxHeight && s.random.Intn(skiplistBranching) == 0 {
+		height++
+	}
+
+	return height
+}
+
+// Next returns the node after this one on the level provided, or nil if it is the last node on
+// that level.
+func (n *skiplistNode) Next(level int) *skiplistNode {
+	return (*skiplistNode)(atomic.LoadPointer(&n.next[level]))
+}
+
+// Entry returns the newest entry that was put for the node's key.
+func (n *skiplistNode) Entry() memtableEntry {
+	return *(*memtableEntry)(atomic.LoadPointer(&n.entry))
+}
+
+// setNext links the node provided after this one on the level provided.
+func (n *skiplistNode) setNext(level int, next *skiplistNode) {
+	atomic.StorePointer(&n.next[level], unsafe.Pointer(next))
+}
@@ -0,0 +1,217 @@
+package lsmtree
+
+import (
+	"container/list"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Logger is used by the database to report problems that do not cause an operation to fail,
+	// but that should still be looked at. *log.Logger implements this interface.
+	Logger interface {
+		Printf(format string, v ...interface{})
+	}
+
+	// Snapshot is a consistent view of the database at a single point in time. Versions of keys
+	// that are visible to a snapshot will not be removed by compaction until the snapshot has been
+	// released, so snapshots should always be released as soon as they are no longer needed.
+	Snapshot struct {
+		list    *snapshotList
+		element *list.Element
+
+		timestamp uint64
+		createdAt time.Time
+
+		// caller is where the snapshot was created, it is included in the log message if the
+		// snapshot is held for too long.
+		caller string
+
+		// reported is set once the snapshot has been logged as leaked so that it is only logged
+		// once.
+		reported bool
+
+		// released is set to 1 atomically once the snapshot has been released.
+		released int32
+	}
+
+	// snapshotList keeps track of every snapshot that has not been released. Compaction consults
+	// the list to find the oldest snapshot, any version of a key that is visible to that snapshot
+	// or any newer snapshot must be kept.
+	snapshotList struct {
+		lock sync.Mutex
+
+		// snapshots are ordered by their timestamp, oldest first. Snapshots are always created
+		// with a timestamp that is greater than or equal to the snapshots before them, so new
+		// snapshots are simply added to the back.
+		snapshots list.List
+	}
+)
+
+// NewSnapshot creates a snapshot of the current state of the database. Release must be called once
+// the snapshot is no longer needed.
+func (db *DB) NewSnapshot() (*Snapshot, error) {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return nil, ErrClosed
+	}
+
+	return db.snapshots.NewCurrent(db.readTimestamp, db.options.Clock.Now(), getCaller(1)), nil
+}
+
+// Timestamp returns the timestamp of the snapshot. Any version of a key written at or before this
+// timestamp is visible to the snapshot.
+func (s *Snapshot) Timestamp() uint64 {
+	return s.timestamp
+}
+
+// Release will allow the versions of keys that are only visible to this snapshot to be removed.
+// Calling Release more than once does nothing, and neither does releasing a zero Snapshot that was
+// not created by a database.
+func (s *Snapshot) Release() {
+	if !atomic.CompareAndSwapInt32(&s.released, 0, 1) || s.list == nil {
+		return
+	}
+
+	s.list.remove(s)
+}
+
+// New adds a new snapshot to the list. The timestamp must be greater than or equal to the
+// timestamp of every snapshot already in the list.
+func (l *snapshotList) New(timestamp uint64, createdAt time.Time, caller string) *Snapshot {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	snapshot := &Snapshot{
+		list:      l,
+		timestamp: timestamp,
+		createdAt: createdAt,
+		caller:    caller,
+	}
+	snapshot.element = l.snapshots.PushBack(snapshot)
+
+	return snapshot
+}
+
+// NewCurrent adds a new snapshot to the list like New, but the timestamp is read with current
+// while the lock is held. This way a snapshot can never be missed by Oldest while it is being
+// created, which matters to anything that compares Oldest to the current timestamp.
+func (l *snapshotList) NewCurrent(
+	current func() uint64, createdAt time.Time, caller string,
+) *Snapshot {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	snapshot := &Snapshot{
+		list:      l,
+		timestamp: current(),
+		createdAt: createdAt,
+		caller:    caller,
+	}
+	snapshot.element = l.snapshots.PushBack(snapshot)
+
+	return snapshot
+}
+
+// Oldest returns the timestamp of the oldest snapshot that has not been released. If there are no
+// snapshots then ok will be false.
+func (l *snapshotList) Oldest() (timestamp uint64, ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	front := l.snapshots.Front()
+	if front == nil {
+		return 0, false
+	}
+
+	return front.Value.(*Snapshot).timestamp, true
+}
+
+// Len returns the number of snapshots that have not been released.
+func (l *snapshotList) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.snapshots.Len()
+}
+
+// Leaked returns every snapshot that was created before the cutoff and has not been released and
+// has not already been returned by Leaked.
+func (l *snapshotList) Leaked(cutoff time.Time) []*Snapshot {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var leaked []*Snapshot
+	for element := l.snapshots.Front(); element != nil; element = element.Next() {
+		snapshot := element.Value.(*Snapshot)
+		if snapshot.reported || !snapshot.createdAt.Before(cutoff) {
+			continue
+		}
+
+		snapshot.reported = true
+		leaked = append(leaked, snapshot)
+	}
+
+	return leaked
+}
+
+// remove takes the snapshot out of the list.
+func (l *snapshotList) remove(snapshot *Snapshot) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.snapshots.Remove(snapshot.element)
+}
+
+// snapshotLeakDetector will periodically log any snapshots that have been held for longer than
+// Options.SnapshotLeakThreshold. It runs until the database is closed.
+func (db *DB) snapshotLeakDetector() {
+	threshold := db.options.SnapshotLeakThreshold
+	ticker := time.NewTicker(getSnapshotLeakCheckInterval(threshold))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db.reportLeakedSnapshots()
+		case <-db.stopped:
+			return
+		}
+	}
+}
+
+// reportLeakedSnapshots logs every snapshot that has been held for longer than the threshold and
+// has not been logged already.
+func (db *DB) reportLeakedSnapshots() {
+	now := db.options.Clock.Now()
+	for _, snapshot := range db.snapshots.Leaked(now.Add(-db.options.SnapshotLeakThreshold)) {
+		db.options.Logger.Printf(
+			"snapshot at timestamp %d has not been released after %s, it was created at %s",
+			snapshot.timestamp, now.Sub(snapshot.createdAt), snapshot.caller,
+		)
+	}
+}
+
+// getCaller returns the file and line of the function that called the function calling getCaller.
+// The skip is the number of additional frames to skip.
+func getCaller(skip int) string {
+	if _, file, line, ok := runtime.Caller(skip + 1); ok {
+		return fmt.Sprintf("%s:%d", file, line)
+	}
+
+	return "unknown"
+}
+
+// getSnapshotLeakCheckInterval returns how often snapshots should be checked for leaks. Checking
+// at half of the threshold means a leak is reported at most 1.5x the threshold after it was
+// created.
+func getSnapshotLeakCheckInterval(threshold time.Duration) time.Duration {
+	interval := threshold / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	return interval
+}
@@ -0,0 +1,138 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLogger collects every message that is logged so that tests can check them.
+type testLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) Messages() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string{}, l.messages...)
+}
+
+func TestSnapshotList(t *testing.T) {
+	t.Run("oldest", func(t *testing.T) {
+		snapshots := &snapshotList{}
+		_, ok := snapshots.Oldest()
+		assert.False(t, ok)
+
+		first := snapshots.New(10, time.Time{}, "")
+		second := snapshots.New(20, time.Time{}, "")
+		third := snapshots.New(20, time.Time{}, "")
+		assert.Equal(t, 3, snapshots.Len())
+
+		oldest, ok := snapshots.Oldest()
+		assert.True(t, ok)
+		assert.Equal(t, uint64(10), oldest)
+
+		// Releasing a newer snapshot does not change the oldest.
+		second.Release()
+		oldest, _ = snapshots.Oldest()
+		assert.Equal(t, uint64(10), oldest)
+
+		first.Release()
+		oldest, _ = snapshots.Oldest()
+		assert.Equal(t, uint64(20), oldest)
+
+		// Releasing twice should not do anything.
+		first.Release()
+		assert.Equal(t, 1, snapshots.Len())
+
+		third.Release()
+		_, ok = snapshots.Oldest()
+		assert.False(t, ok)
+	})
+
+	t.Run("leaked", func(t *testing.T) {
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		snapshots := &snapshotList{}
+		old := snapshots.New(1, start, "")
+		snapshots.New(2, start.Add(time.Hour), "")
+
+		assert.Empty(t, snapshots.Leaked(start))
+		assert.Equal(t, []*Snapshot{old}, snapshots.Leaked(start.Add(time.Minute)))
+
+		// Each snapshot should only be reported once.
+		assert.Empty(t, snapshots.Leaked(start.Add(time.Minute)))
+	})
+}
+
+func TestDB_NewSnapshot(t *testing.T) {
+	t.Run("leak detection", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		clock := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		logger := &testLogger{}
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.Clock = clock
+		options.Logger = logger
+		options.SnapshotLeakThreshold = time.Minute
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+		assert.NoError(t, txn.Commit())
+
+		snapshot, err := db.NewSnapshot()
+		assert.NoError(t, err)
+		assert.NotZero(t, snapshot.Timestamp())
+		assert.Equal(t, db.timestamps.Current(), snapshot.Timestamp())
+
+		db.reportLeakedSnapshots()
+		assert.Empty(t, logger.Messages())
+
+		clock.Advance(2 * time.Minute)
+		db.reportLeakedSnapshots()
+		messages := logger.Messages()
+		if assert.Len(t, messages, 1) {
+			assert.Contains(t, messages[0], "snapshot_test.go")
+			assert.Contains(t, messages[0], "2m0s")
+		}
+
+		snapshot.Release()
+		clock.Advance(2 * time.Minute)
+		db.reportLeakedSnapshots()
+		assert.Len(t, logger.Messages(), 1)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+
+		snapshot, err := db.NewSnapshot()
+		assert.Equal(t, ErrClosed, err)
+		assert.Nil(t, snapshot)
+	})
+}
@@ -0,0 +1,183 @@
+package lsmtree
+
+import (
+	"hash/fnv"
+	"os"
+	"path"
+	"sort"
+)
+
+type (
+	// heapDirectories are the directories that heap files are striped across so that reads and
+	// compactions can use the bandwidth of several devices at once. The first directory is always
+	// Options.DataDirectory, followed by Options.HeapDirectories.
+	heapDirectories []string
+)
+
+// newHeapDirectories returns the directories heap files will be striped across for the options
+// provided. A directory that is listed more than once is only used once.
+func newHeapDirectories(options Options) heapDirectories {
+	directories := heapDirectories{path.Clean(options.DataDirectory)}
+	seen := map[string]struct{}{directories[0]: {}}
+	for _, directory := range options.HeapDirectories {
+		directory = path.Clean(directory)
+		if _, ok := seen[directory]; ok {
+			continue
+		}
+		seen[directory] = struct{}{}
+
+		directories = append(directories, directory)
+	}
+
+	return directories
+}
+
+// Directory returns the directory that a new heap file with the Id provided should be written
+// to. Heap Ids are allocated in ascending order, so consecutive files are written round-robin to
+// consecutive directories.
+func (d heapDirectories) Directory(heapId uint64) string {
+	return d[heapId%uint64(len(d))]
+}
+
+// Find returns the directory that the heap file with the Id provided is in. The directories can be
+// changed between opens of the database, which moves where Directory would put a file, so if the
+// file is not where it would be written now then every other directory is checked. If the file is
+// not in any of them then the directory it would be written to is returned.
+func (d heapDirectories) Find(heapId uint64) string {
+	name := getHeapFileName(heapId)
+	expected := d.Directory(heapId)
+	if _, err := os.Stat(path.Join(expected, name)); err == nil {
+		return expected
+	}
+
+	for _, directory := range d {
+		if directory == expected {
+			continue
+		}
+
+		if _, err := os.Stat(path.Join(directory, name)); err == nil {
+			return directory
+		}
+	}
+
+	return expected
+}
+
+// valueRingReplicas is the number of points each value directory has on the hash ring. More points
+// spread files more evenly between the directories.
+const valueRingReplicas = 64
+
+type (
+	// valueDirectories are the directories that value files are spread across. Each file is placed
+	// by consistent hashing of its Id: every directory has valueRingReplicas points on a ring of
+	// hashes, and a file goes to the directory of the first point at or after the hash of its Id.
+	// When a directory is added only the files that hash to its new points move to it, so most
+	// files stay where they would have been written before.
+	valueDirectories struct {
+		directories []string
+		ring        []valueRingPoint
+	}
+
+	// valueRingPoint is a single point on the hash ring of the valueDirectories.
+	valueRingPoint struct {
+		hash      uint64
+		directory int
+	}
+)
+
+// newValueDirectories returns value directories for the directories provided, the first directory
+// is always Options.DataDirectory. A directory that is listed more than once is only used once.
+func newValueDirectories(directories []string) *valueDirectories {
+	d := &valueDirectories{}
+	seen := map[string]struct{}{}
+	for _, directory := range directories {
+		directory = path.Clean(directory)
+		if _, ok := seen[directory]; ok {
+			continue
+		}
+		seen[directory] = struct{}{}
+
+		for replica := 0; replica < valueRingReplicas; replica++ {
+			d.ring = append(d.ring, valueRingPoint{
+				hash:      hashValueRingPoint(directory, replica),
+				directory: len(d.directories),
+			})
+		}
+		d.directories = append(d.directories, directory)
+	}
+
+	sort.Slice(d.ring, func(i, j int) bool {
+		return d.ring[i].hash < d.ring[j].hash
+	})
+
+	return d
+}
+
+// getValueDirectories returns every directory that value files can be stored in for the options
+// provided.
+func getValueDirectories(options Options) []string {
+	return append([]string{options.DataDirectory}, options.ValueDirectories...)
+}
+
+// Directory returns the directory that the value file with the Id provided should be written to.
+func (d *valueDirectories) Directory(fileId uint64) string {
+	if len(d.directories) == 1 {
+		return d.directories[0]
+	}
+
+	sum := mixValueRingHash(fileId)
+
+	// The ring wraps around, a hash after the last point belongs to the first point.
+	index := sort.Search(len(d.ring), func(i int) bool {
+		return d.ring[i].hash >= sum
+	})
+	if index == len(d.ring) {
+		index = 0
+	}
+
+	return d.directories[d.ring[index].directory]
+}
+
+// Find returns the directory that the value file with the Id provided is in. Like
+// heapDirectories.Find, if the file is not where it would be written now then every other
+// directory is checked, and if it is not in any of them then the directory it would be written to
+// is returned.
+func (d *valueDirectories) Find(fileId uint64) string {
+	name := getValueFileName(fileId)
+	expected := d.Directory(fileId)
+	if _, err := os.Stat(path.Join(expected, name)); err == nil {
+		return expected
+	}
+
+	for _, directory := range d.directories {
+		if directory == expected {
+			continue
+		}
+
+		if _, err := os.Stat(path.Join(directory, name)); err == nil {
+			return directory
+		}
+	}
+
+	return expected
+}
+
+// hashValueRingPoint returns the hash of a single point of a directory on the ring.
+func hashValueRingPoint(directory string, replica int) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(directory))
+
+	return mixValueRingHash(hash.Sum64() + uint64(replica))
+}
+
+// mixValueRingHash spreads the bits of x across the whole hash. Ids and replicas are consecutive
+// numbers, without mixing them their hashes would all land on a narrow part of the ring.
+func mixValueRingHash(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
@@ -0,0 +1,205 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHeapDirectories(t *testing.T) {
+	t.Run("round robin", func(t *testing.T) {
+		options := DefaultOptions()
+		options.DataDirectory = "data"
+		options.HeapDirectories = []string{"disk1", "disk2/", "data", "disk1"}
+
+		directories := newHeapDirectories(options)
+		assert.Equal(t, heapDirectories{"data", "disk1", "disk2"}, directories)
+		assert.Equal(t, "disk1", directories.Directory(1))
+		assert.Equal(t, "disk2", directories.Directory(2))
+		assert.Equal(t, "data", directories.Directory(3))
+	})
+
+	t.Run("find", func(t *testing.T) {
+		first, cleanupFirst := NewTempDirectory(t)
+		defer cleanupFirst()
+		second, cleanupSecond := NewTempDirectory(t)
+		defer cleanupSecond()
+
+		directories := heapDirectories{first, second}
+
+		// A file that does not exist yet goes where it would be written.
+		assert.Equal(t, second, directories.Find(1))
+
+		// A file that was written before the directories changed is still found.
+		assert.NoError(t, ioutil.WriteFile(path.Join(first, getHeapFileName(1)), []byte("heap"), 0644))
+		assert.Equal(t, first, directories.Find(1))
+	})
+
+	t.Run("manifest", func(t *testing.T) {
+		data, cleanupData := NewTempDirectory(t)
+		defer cleanupData()
+		disk, cleanupDisk := NewTempDirectory(t)
+		defer cleanupDisk()
+
+		m, err := openManifest(data, defaultFileMode)
+		assert.NoError(t, err)
+		m.heap = heapDirectories{data, disk}
+
+		name := path.Join(disk, getHeapFileName(1))
+		assert.NoError(t, ioutil.WriteFile(name, []byte("heap"), 0644))
+		assert.NoError(t, m.AddFile(fileTypeHeap, 1))
+		assert.NoError(t, m.Verify())
+
+		assert.NoError(t, ioutil.WriteFile(name, []byte("corrupt"), 0644))
+		assert.True(t, errors.Is(m.Verify(), ErrCorrupted))
+	})
+
+	t.Run("database", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = path.Join(dir, "wal")
+		options.DataDirectory = path.Join(dir, "data")
+		options.HeapDirectories = []string{path.Join(dir, "disk1")}
+		assert.Equal(t, []string{
+			options.WALDirectory, options.DataDirectory, options.HeapDirectories[0],
+		}, getDatabaseDirectories(options))
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		// Every directory is created and locked.
+		_, err = os.Stat(options.HeapDirectories[0])
+		assert.NoError(t, err)
+		_, err = Open(options)
+		assert.Error(t, err)
+
+		name := path.Join(options.HeapDirectories[0], getHeapFileName(1))
+		assert.NoError(t, ioutil.WriteFile(name, []byte("heap"), 0644))
+		assert.NoError(t, db.manifest.AddFile(fileTypeHeap, 1))
+		assert.NoError(t, db.VerifyFileChecksums())
+
+		usage, err := db.Size()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), usage.Heap)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.HeapDirectories = []string{""}
+
+		_, err := Open(options)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+	})
+}
+
+func TestValueDirectories(t *testing.T) {
+	// place returns the directory that each of the first n file Ids is placed in.
+	place := func(directories *valueDirectories, n int) []string {
+		placed := make([]string, n)
+		for i := range placed {
+			placed[i] = directories.Directory(uint64(i + 1))
+		}
+
+		return placed
+	}
+
+	t.Run("single directory", func(t *testing.T) {
+		directories := newValueDirectories([]string{"data", "data/"})
+		assert.Equal(t, []string{"data", "data", "data"}, place(directories, 3))
+	})
+
+	t.Run("spread", func(t *testing.T) {
+		directories := newValueDirectories([]string{"data", "disk1", "disk2"})
+
+		counts := map[string]int{}
+		for _, directory := range place(directories, 9000) {
+			counts[directory]++
+		}
+		assert.Len(t, counts, 3)
+		for directory, count := range counts {
+			assert.InDelta(t, 3000, count, 1000, directory)
+		}
+	})
+
+	t.Run("adding a directory", func(t *testing.T) {
+		before := place(newValueDirectories([]string{"data", "disk1", "disk2"}), 9000)
+		after := place(newValueDirectories([]string{"data", "disk1", "disk2", "disk3"}), 9000)
+
+		// Files only ever move to the new directory, and only about a quarter of them do.
+		moved := 0
+		for i := range before {
+			if before[i] != after[i] {
+				assert.Equal(t, "disk3", after[i])
+				moved++
+			}
+		}
+		assert.InDelta(t, 2250, moved, 1000)
+	})
+
+	t.Run("manager", func(t *testing.T) {
+		first, cleanupFirst := NewTempDirectory(t)
+		defer cleanupFirst()
+		second, cleanupSecond := NewTempDirectory(t)
+		defer cleanupSecond()
+
+		// The last Id is taken from every directory.
+		_, err := openValueFile(second, 7, defaultFileMode)
+		assert.NoError(t, err)
+
+		manager, err := newValueManager([]string{first, second}, defaultFileMode)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(8), manager.nextFileId())
+
+		// A file that is not where it would be placed now is still opened where it is.
+		assert.Equal(t, second, manager.directories.Find(7))
+		file, err := manager.getFile(7)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(7), file.FileId)
+
+		for id := uint64(8); id < 16; id++ {
+			_, err = manager.getFile(id)
+			assert.NoError(t, err)
+			_, err = os.Stat(path.Join(manager.directories.Directory(id), getValueFileName(id)))
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("database", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = path.Join(dir, "wal")
+		options.DataDirectory = path.Join(dir, "data")
+		options.ValueDirectories = []string{path.Join(dir, "disk1"), path.Join(dir, "disk2")}
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		name := path.Join(options.ValueDirectories[1], getValueFileName(1))
+		assert.NoError(t, ioutil.WriteFile(name, []byte("value"), 0644))
+
+		usage, err := db.DirectoryUsage()
+		assert.NoError(t, err)
+		assert.Len(t, usage, 4)
+		assert.Equal(t, int64(5), usage[options.ValueDirectories[1]].Values)
+		assert.Zero(t, usage[options.ValueDirectories[0]].Values)
+		assert.Contains(t, usage, options.WALDirectory)
+
+		options.ValueDirectories = []string{""}
+		_, err = Open(options)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+	})
+}
@@ -0,0 +1,163 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrBadTableFormat is returned when the properties block of a heap file cannot be read, or it
+	// was written in a format that this version of the database does not know how to read.
+	ErrBadTableFormat = errors.New("bad table format")
+)
+
+const (
+	// tablePropertiesVersion is the version of the properties block that is written. Version 2
+	// added the smallest and largest keys, blocks written with version 1 are still read and have
+	// nil keys.
+	tablePropertiesVersion = 2
+)
+
+type (
+	// tableProperties are counts that are collected while a heap file is written and stored in
+	// the file, so that compactions can be planned without reading the whole file.
+	tableProperties struct {
+		// Entries is the number of keys in the file, including tombstones.
+		Entries uint64
+
+		// PointDeletions is the number of tombstones for single keys in the file.
+		PointDeletions uint64
+
+		// RangeDeletions is the number of range tombstones in the file.
+		RangeDeletions uint64
+
+		// RangeDeletedSize is the approximate number of bytes of older data that the range
+		// tombstones in the file cover. None of that data can be read anymore, but the space is
+		// only freed once the tombstones have been compacted down over it.
+		RangeDeletedSize int64
+
+		// Smallest and Largest are the first and last keys in the file. They are nil if the file
+		// was written before they were recorded, a file without them is treated as if it could
+		// overlap any other file.
+		Smallest Key
+		Largest  Key
+	}
+
+	// heapProperties holds the tableProperties of every heap file that the database is using, by
+	// heapId.
+	heapProperties struct {
+		lock  sync.RWMutex
+		files map[uint64]tableProperties
+	}
+)
+
+// Encode returns the properties block for a heap file. The block is laid out as:
+//
+//	1 Byte: Version
+//	Uvarint: Entries
+//	Uvarint: Point deletions
+//	Uvarint: Range deletions
+//	Uvarint: Range deleted size
+//	Uvarint: Smallest key length (only in version 2)
+//	Smallest key
+//	Uvarint: Largest key length (only in version 2)
+//	Largest key
+func (p tableProperties) Encode() []byte {
+	buf := []byte{tablePropertiesVersion}
+	buf = appendUvarint(buf, p.Entries)
+	buf = appendUvarint(buf, p.PointDeletions)
+	buf = appendUvarint(buf, p.RangeDeletions)
+	buf = appendUvarint(buf, uint64(p.RangeDeletedSize))
+	buf = appendUvarint(buf, uint64(len(p.Smallest)))
+	buf = append(buf, p.Smallest...)
+	buf = appendUvarint(buf, uint64(len(p.Largest)))
+
+	return append(buf, p.Largest...)
+}
+
+// decodeTableProperties reads a properties block that was written by Encode.
+func decodeTableProperties(data []byte) (tableProperties, error) {
+	if len(data) == 0 {
+		return tableProperties{}, fmt.Errorf("%w: empty properties block", ErrBadTableFormat)
+	}
+
+	version := data[0]
+	if version < 1 || version > tablePropertiesVersion {
+		return tableProperties{}, fmt.Errorf("%w: unknown properties version %d",
+			ErrBadTableFormat, version)
+	}
+	data = data[1:]
+
+	var values [4]uint64
+	for i := range values {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return tableProperties{}, fmt.Errorf("%w: truncated properties block",
+				ErrBadTableFormat)
+		}
+		values[i] = value
+		data = data[n:]
+	}
+
+	properties := tableProperties{
+		Entries:          values[0],
+		PointDeletions:   values[1],
+		RangeDeletions:   values[2],
+		RangeDeletedSize: int64(values[3]),
+	}
+
+	if version >= 2 {
+		// Keys cannot be empty, so a length of 0 means that the key was not recorded.
+		for _, key := range []*Key{&properties.Smallest, &properties.Largest} {
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return tableProperties{}, fmt.Errorf("%w: truncated properties block",
+					ErrBadTableFormat)
+			}
+
+			if length > 0 {
+				*key = append(Key{}, data[n:n+int(length)]...)
+			}
+			data = data[n+int(length):]
+		}
+	}
+
+	if len(data) != 0 {
+		return tableProperties{}, fmt.Errorf("%w: bad properties trailer", ErrBadTableFormat)
+	}
+
+	return properties, nil
+}
+
+func newHeapProperties() *heapProperties {
+	return &heapProperties{
+		files: map[uint64]tableProperties{},
+	}
+}
+
+// Set records the properties of a heap file once it has been written or opened.
+func (h *heapProperties) Set(id uint64, properties tableProperties) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.files[id] = properties
+}
+
+// Get returns the properties of the heap file. Files that have no recorded properties return the
+// zero value, which is treated as a file without any tombstones.
+func (h *heapProperties) Get(id uint64) tableProperties {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.files[id]
+}
+
+// Remove forgets the properties of a heap file once it is no longer used.
+func (h *heapProperties) Remove(id uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.files, id)
+}
@@ -0,0 +1,72 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTableProperties(t *testing.T) {
+	t.Run("encode and decode", func(t *testing.T) {
+		for _, properties := range []tableProperties{
+			{},
+			{
+				Entries:          1000,
+				PointDeletions:   12,
+				RangeDeletions:   3,
+				RangeDeletedSize: 1 << 40,
+			},
+			{
+				Entries:  2,
+				Smallest: Key("a"),
+				Largest:  Key("zz"),
+			},
+		} {
+			decoded, err := decodeTableProperties(properties.Encode())
+			assert.NoError(t, err)
+			assert.Equal(t, properties, decoded)
+		}
+	})
+
+	t.Run("version 1", func(t *testing.T) {
+		// Version 1 blocks do not have the smallest and largest keys.
+		decoded, err := decodeTableProperties([]byte{1, 10, 2, 1, 0x80, 0x01})
+		assert.NoError(t, err)
+		assert.Equal(t, tableProperties{
+			Entries:          10,
+			PointDeletions:   2,
+			RangeDeletions:   1,
+			RangeDeletedSize: 128,
+		}, decoded)
+	})
+
+	t.Run("bad blocks", func(t *testing.T) {
+		encoded := tableProperties{Entries: 1, Smallest: Key("a"), Largest: Key("b")}.Encode()
+
+		unknownVersion := append([]byte{}, encoded...)
+		unknownVersion[0] = tablePropertiesVersion + 1
+
+		for name, data := range map[string][]byte{
+			"empty":           nil,
+			"truncated":       encoded[:len(encoded)-1],
+			"trailing data":   append(append([]byte{}, encoded...), 0),
+			"unknown version": unknownVersion,
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := decodeTableProperties(data)
+				assert.True(t, errors.Is(err, ErrBadTableFormat))
+			})
+		}
+	})
+
+	t.Run("heap properties", func(t *testing.T) {
+		h := newHeapProperties()
+		assert.Equal(t, tableProperties{}, h.Get(1))
+
+		h.Set(1, tableProperties{Entries: 5})
+		assert.Equal(t, tableProperties{Entries: 5}, h.Get(1))
+
+		h.Remove(1)
+		assert.Equal(t, tableProperties{}, h.Get(1))
+	})
+}
@@ -0,0 +1,288 @@
+package lsmtree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBadTrace is returned when a trace cannot be read, either because it was not written by a
+	// Tracer or because it was truncated part way through a record.
+	ErrBadTrace = errors.New("bad trace")
+
+	// ErrUnknownTraceVersion is returned when a trace was written by a newer version of the
+	// database than the one reading it.
+	ErrUnknownTraceVersion = errors.New("unknown trace version")
+)
+
+const (
+	// traceMagic is written at the start of every trace so that other data is not replayed by
+	// accident.
+	traceMagic = "lsmttrce"
+
+	// traceVersion is the version of the trace format that is written.
+	traceVersion = 1
+)
+
+// TraceOp is the type of operation recorded in a trace.
+type TraceOp byte
+
+const (
+	// TraceOpGet is a call to Txn.Get.
+	TraceOpGet TraceOp = iota + 1
+
+	// TraceOpSet is a key that was set by a committed transaction.
+	TraceOpSet
+
+	// TraceOpDelete is a key that was deleted by a committed transaction.
+	TraceOpDelete
+
+	// TraceOpCommit marks the end of a committed transaction. The TraceOpSet and TraceOpDelete
+	// records of a transaction are written together immediately before its TraceOpCommit.
+	TraceOpCommit
+)
+
+type (
+	// Tracer records the operations performed on a database to a compact file so that the
+	// workload can be replayed later, usually against different Options to see how they would
+	// perform. Keys and values are not recorded: each key is stored as a hash along with its
+	// size, and each value as just its size, so a trace can be taken from a production database
+	// without copying its data.
+	//
+	// Reads are recorded as they happen and writes are recorded once their transaction has been
+	// committed, transactions that are discarded or fail to commit are not recorded. Scans are
+	// not recorded.
+	Tracer struct {
+		lock   sync.Mutex
+		writer *bufio.Writer
+		buf    []byte
+
+		// last is the time of the previous record, each record stores the time since the previous
+		// one to keep the trace small.
+		last time.Time
+
+		// err is the first error encountered while writing the trace. Tracing never fails an
+		// operation on the database, once an error happens nothing else is written and the error
+		// is returned by Close.
+		err error
+
+		// closed is set by Close, nothing is recorded after that.
+		closed bool
+	}
+
+	// TraceRecord is a single operation read from a trace.
+	TraceRecord struct {
+		Op TraceOp
+
+		// KeyHash is the 64-bit FNV-1a hash of the key. It is 0 for TraceOpCommit.
+		KeyHash uint64
+
+		// KeySize is the length of the key in bytes.
+		KeySize int
+
+		// ValueSize is the length of the value in bytes, it is only set for TraceOpSet.
+		ValueSize int
+
+		// Time is when the operation happened.
+		Time time.Time
+	}
+
+	// TraceReader reads the records of a trace written by a Tracer.
+	TraceReader struct {
+		reader *bufio.Reader
+		last   time.Time
+	}
+)
+
+// NewTracer creates a tracer that writes to w. The tracer is enabled by setting it as
+// Options.Tracer, it must not be shared by more than one database. Close must be called once the
+// database has been closed to flush the end of the trace.
+func NewTracer(w io.Writer) *Tracer {
+	t := &Tracer{
+		writer: bufio.NewWriter(w),
+		last:   time.Unix(0, 0),
+	}
+
+	// The trace starts with the magic string "lsmttrce" and a 2 byte version.
+	header := make([]byte, len(traceMagic)+2)
+	copy(header, traceMagic)
+	binary.BigEndian.PutUint16(header[len(traceMagic):], traceVersion)
+	_, t.err = t.writer.Write(header)
+
+	return t
+}
+
+// Close flushes any records that have not been written yet and returns the first error that was
+// encountered while writing the trace. Nothing else is recorded once the tracer is closed.
+func (t *Tracer) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.closed && t.err == nil {
+		t.err = t.writer.Flush()
+	}
+	t.closed = true
+
+	return t.err
+}
+
+// traceGet records a read of the key.
+func (t *Tracer) traceGet(now time.Time, key Key) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.write(now, TraceOpGet, key, 0)
+}
+
+// traceCommit records the changes of a committed transaction followed by a TraceOpCommit.
+func (t *Tracer) traceCommit(now time.Time, changes []walTransactionChange) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, change := range changes {
+		if change.Type == walTransactionChangeTypeDelete {
+			t.write(now, TraceOpDelete, change.Key, 0)
+		} else {
+			t.write(now, TraceOpSet, change.Key, len(change.Value))
+		}
+	}
+	t.write(now, TraceOpCommit, nil, 0)
+}
+
+// write appends a single record to the trace, the lock must be held. Each record is laid out as:
+//
+//	1 Byte: Op
+//	Uvarint: Nanoseconds since the previous record (since the Unix epoch for the first record)
+//	Only for TraceOpGet, TraceOpSet and TraceOpDelete:
+//	    8 Bytes: Key hash
+//	    Uvarint: Key size
+//	Only for TraceOpSet:
+//	    Uvarint: Value size
+func (t *Tracer) write(now time.Time, op TraceOp, key Key, valueSize int) {
+	if t.err != nil || t.closed {
+		return
+	}
+	t.buf = t.buf[:0]
+
+	// The clock can go backwards, the replay just treats that as no time passing.
+	elapsed := now.Sub(t.last)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	t.last = t.last.Add(elapsed)
+
+	t.buf = append(t.buf, byte(op))
+	t.buf = appendUvarint(t.buf, uint64(elapsed))
+	if op != TraceOpCommit {
+		t.buf = append(t.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(t.buf[len(t.buf)-8:], hashTraceKey(key))
+		t.buf = appendUvarint(t.buf, uint64(len(key)))
+	}
+	if op == TraceOpSet {
+		t.buf = appendUvarint(t.buf, uint64(valueSize))
+	}
+
+	_, t.err = t.writer.Write(t.buf)
+}
+
+// NewTraceReader reads the header of a trace and returns a reader for its records.
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	reader := bufio.NewReader(r)
+
+	header := make([]byte, len(traceMagic)+2)
+	if _, err := io.ReadFull(reader, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrBadTrace
+	} else if err != nil {
+		return nil, err
+	}
+
+	if string(header[:len(traceMagic)]) != traceMagic {
+		return nil, ErrBadTrace
+	}
+
+	if version := binary.BigEndian.Uint16(header[len(traceMagic):]); version != traceVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownTraceVersion, version)
+	}
+
+	return &TraceReader{
+		reader: reader,
+		last:   time.Unix(0, 0),
+	}, nil
+}
+
+// Next returns the next record in the trace. io.EOF is returned once every record has been read.
+func (r *TraceReader) Next() (TraceRecord, error) {
+	op, err := r.reader.ReadByte()
+	if err != nil {
+		return TraceRecord{}, err
+	}
+
+	if op < byte(TraceOpGet) || op > byte(TraceOpCommit) {
+		return TraceRecord{}, ErrBadTrace
+	}
+
+	record := TraceRecord{
+		Op: TraceOp(op),
+	}
+
+	elapsed, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return TraceRecord{}, r.truncated(err)
+	}
+	r.last = r.last.Add(time.Duration(elapsed))
+	record.Time = r.last
+
+	if record.Op != TraceOpCommit {
+		hash := make([]byte, 8)
+		if _, err = io.ReadFull(r.reader, hash); err != nil {
+			return TraceRecord{}, r.truncated(err)
+		}
+		record.KeyHash = binary.BigEndian.Uint64(hash)
+
+		keySize, err := binary.ReadUvarint(r.reader)
+		if err != nil {
+			return TraceRecord{}, r.truncated(err)
+		}
+		record.KeySize = int(keySize)
+	}
+
+	if record.Op == TraceOpSet {
+		valueSize, err := binary.ReadUvarint(r.reader)
+		if err != nil {
+			return TraceRecord{}, r.truncated(err)
+		}
+		record.ValueSize = int(valueSize)
+	}
+
+	return record, nil
+}
+
+// truncated returns ErrBadTrace if the trace ended part way through a record.
+func (r *TraceReader) truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrBadTrace
+	}
+
+	return err
+}
+
+// hashTraceKey returns the hash that is recorded for the key.
+func hashTraceKey(key Key) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+
+	return h.Sum64()
+}
+
+// appendUvarint appends n to the buffer as a uvarint.
+func appendUvarint(buf []byte, n uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+
+	return append(buf, scratch[:binary.PutUvarint(scratch[:], n)]...)
+}
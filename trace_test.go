@@ -0,0 +1,156 @@
+package lsmtree
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTracer(t *testing.T) {
+	clock := NewManualClock(time.Unix(100, 0))
+
+	// trace runs the workload against a new database and returns the trace it recorded.
+	trace := func(t *testing.T, workload func(db *DB)) []byte {
+		var buf bytes.Buffer
+		tracer := NewTracer(&buf)
+
+		options := DefaultOptions()
+		options.Clock = clock
+		options.Tracer = tracer
+		db, cleanup := newTestDB(t, options)
+		workload(db)
+		cleanup()
+
+		assert.NoError(t, tracer.Close())
+		assert.NoError(t, tracer.Close())
+
+		return buf.Bytes()
+	}
+
+	t.Run("records", func(t *testing.T) {
+		data := trace(t, func(db *DB) {
+			txn, err := db.NewTransaction(TxnOptions{})
+			assert.NoError(t, err)
+			assert.NoError(t, txn.Set(Key("a"), []byte("value")))
+			assert.NoError(t, txn.Delete(Key("bb")))
+			clock.Advance(time.Millisecond)
+			assert.NoError(t, txn.Commit())
+
+			// Discarded transactions are not recorded, but their reads are.
+			txn, err = db.NewTransaction(TxnOptions{})
+			assert.NoError(t, err)
+			clock.Advance(time.Millisecond)
+			_, err = txn.Get(Key("a"))
+			assert.NoError(t, err)
+			assert.NoError(t, txn.Set(Key("c"), []byte("value")))
+			txn.Discard()
+		})
+
+		reader, err := NewTraceReader(bytes.NewReader(data))
+		assert.NoError(t, err)
+
+		var records []TraceRecord
+		for {
+			record, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+			records = append(records, record)
+		}
+
+		start := time.Unix(100, 0)
+		assert.Equal(t, []TraceRecord{
+			{
+				Op:        TraceOpSet,
+				KeyHash:   hashTraceKey(Key("a")),
+				KeySize:   1,
+				ValueSize: 5,
+				Time:      start.Add(time.Millisecond),
+			},
+			{
+				Op:      TraceOpDelete,
+				KeyHash: hashTraceKey(Key("bb")),
+				KeySize: 2,
+				Time:    start.Add(time.Millisecond),
+			},
+			{Op: TraceOpCommit, Time: start.Add(time.Millisecond)},
+			{
+				Op:      TraceOpGet,
+				KeyHash: hashTraceKey(Key("a")),
+				KeySize: 1,
+				Time:    start.Add(2 * time.Millisecond),
+			},
+		}, records)
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		data := trace(t, func(db *DB) {
+			for i := 0; i < 10; i++ {
+				txn, err := db.NewTransaction(TxnOptions{})
+				assert.NoError(t, err)
+				assert.NoError(t, txn.Set(Key{byte(i)}, make([]byte, i)))
+				assert.NoError(t, txn.Set(Key("same"), []byte("value")))
+				assert.NoError(t, txn.Commit())
+			}
+
+			txn, err := db.NewTransaction(TxnOptions{})
+			assert.NoError(t, err)
+			assert.NoError(t, txn.Delete(Key("same")))
+			assert.NoError(t, txn.Commit())
+
+			txn, err = db.NewTransaction(TxnOptions{ReadOnly: true})
+			assert.NoError(t, err)
+			_, err = txn.Get(Key("same"))
+			assert.Equal(t, ErrKeyNotFound, err)
+			txn.Discard()
+		})
+
+		reader, err := NewTraceReader(bytes.NewReader(data))
+		assert.NoError(t, err)
+
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		stats, err := Replay(db, reader, ReplayOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, stats.Gets)
+		assert.Equal(t, 20, stats.Sets)
+		assert.Equal(t, 1, stats.Deletes)
+		assert.Equal(t, 11, stats.Commits)
+		assert.Equal(t, 0, stats.Conflicts)
+
+		// Every write to the same original key is replayed to the same key, so the key that was
+		// deleted is gone and the rest are there.
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		_, err = txn.Get(replayKey(TraceRecord{KeyHash: hashTraceKey(Key("same")), KeySize: 4}))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		item, err := txn.Get(replayKey(TraceRecord{KeyHash: hashTraceKey(Key{9}), KeySize: 1}))
+		assert.NoError(t, err)
+		assert.Len(t, item.Value, 9)
+	})
+
+	t.Run("bad trace", func(t *testing.T) {
+		_, err := NewTraceReader(bytes.NewReader([]byte("lsmt")))
+		assert.Equal(t, ErrBadTrace, err)
+
+		_, err = NewTraceReader(bytes.NewReader([]byte("notatrace!")))
+		assert.Equal(t, ErrBadTrace, err)
+
+		_, err = NewTraceReader(bytes.NewReader([]byte("lsmttrce\x00\x09")))
+		assert.True(t, errors.Is(err, ErrUnknownTraceVersion))
+
+		// A record that is cut off part way through.
+		reader, err := NewTraceReader(bytes.NewReader([]byte("lsmttrce\x00\x01\x01\x00\x01")))
+		assert.NoError(t, err)
+		_, err = reader.Next()
+		assert.Equal(t, ErrBadTrace, err)
+	})
+}
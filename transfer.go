@@ -0,0 +1,155 @@
+package lsmtree
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+var (
+	// ErrInvalidRange is returned when a range of keys is given whose end is not greater than its
+	// start.
+	ErrInvalidRange = errors.New("invalid key range")
+)
+
+// Moving a range of keys from one database to another, like when a shard is split or two shards
+// are merged, is done in three steps that are built from the functions below:
+//
+//  1. ExportRange writes a dump of the range at a snapshot, which is loaded into the destination
+//     with Load while the source keeps serving writes. It returns the timestamp of the snapshot.
+//  2. RangeChanges returns the changes made to the range since that timestamp, along with the
+//     timestamp it is current up to. The changes are applied to the destination and RangeChanges
+//     is called again with the new timestamp until there are few enough changes left. Then writes
+//     to the range are stopped, the last changes are applied, and the range is handed over.
+//  3. ExciseRange removes the range from the source once nothing is reading it there anymore.
+//
+// Routing reads and writes to the database that owns a range is left to whatever is built on top.
+
+// ExportRange writes the newest version of every key that is greater than or equal to start and
+// less than end to the writer, if end is nil then there is no upper bound. The keys are written in
+// the same format as Dump so they can be loaded into another database with Load. The export is a
+// consistent snapshot of the range, the timestamp of that snapshot is returned so that the changes
+// made after it can be read with RangeChanges.
+func (db *DB) ExportRange(w io.Writer, start, end Key) (uint64, error) {
+	if err := checkKeyRange(start, end); err != nil {
+		return 0, err
+	}
+
+	snapshot, err := db.NewSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Release()
+
+	if err = db.dump(w, snapshot, nil, start, end); err != nil {
+		return 0, err
+	}
+
+	return snapshot.Timestamp(), nil
+}
+
+// RangeChanges returns the newest change to each key in the range that was committed after the
+// since timestamp, sorted by key. A change that deleted a key has a nil Value. Only the newest
+// change is returned for each key, so applying the changes in any order to a copy of the range as
+// of since brings it up to date. The timestamp that the changes are current up to is returned as
+// well, it should be passed as since the next time.
+
+func (db *DB) RangeChanges(start, end Key, since uint64) ([]Change, uint64, error) {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return nil, 0, ErrClosed
+	}
+
+	if err := checkKeyRange(start, end); err != nil {
+		return nil, 0, err
+	}
+
+	timestamp := db.readTimestamp()
+	changes := make([]Change, 0)
+	var lastKey Key
+	iterator := db.memtable.Iterator()
+	defer iterator.Close()
+	iterator.SetBounds(start, end)
+	for iterator.SeekToFirst(); iterator.Valid(); iterator.Next() {
+		key := TimestampedKey(iterator.Key())
+
+		// Versions of a key are sorted newest first, so only the first version that is visible is
+		// needed.
+		if key.Timestamp() > timestamp || (lastKey != nil && bytes.Equal(key.Key(), lastKey)) {
+			continue
+		}
+		lastKey = append(lastKey[:0], key.Key()...)
+
+		if key.Timestamp() <= since {
+			continue
+		}
+
+		entry := iterator.Entry()
+		change := Change{
+			Key:       append(Key{}, key.Key()...),
+			UserMeta:  entry.UserMeta,
+			Timestamp: key.Timestamp(),
+		}
+		if entry.Type == walTransactionChangeTypeSet {
+			change.Value = append([]byte{}, entry.Value...)
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, timestamp, nil
+}
+
+// ExciseRange deletes every key that is greater than or equal to start and less than end, if end
+// is nil then there is no upper bound. It is meant to be called once a range has been moved to
+// another database and writes to the range have stopped, a key that is written while the range is
+// being excised may be left behind.
+//
+// There are no range tombstones and no heap files to trim yet, so each key is deleted on its own.
+// The deletes are committed in batches, so if ExciseRange fails part way through then some of the
+// keys will already have been deleted and it can be called again.
+func (db *DB) ExciseRange(start, end Key) error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	if err := checkKeyRange(start, end); err != nil {
+		return err
+	}
+
+	timestamp := db.readTimestamp()
+	loader := &batchLoader{db: db}
+	var lastKey Key
+	iterator := db.memtable.Iterator()
+	defer iterator.Close()
+	iterator.SetBounds(start, end)
+	for iterator.SeekToFirst(); iterator.Valid(); iterator.Next() {
+		key := TimestampedKey(iterator.Key())
+		if key.Timestamp() > timestamp || (lastKey != nil && bytes.Equal(key.Key(), lastKey)) {
+			continue
+		}
+		lastKey = append(lastKey[:0], key.Key()...)
+
+		if iterator.Entry().Type != walTransactionChangeTypeSet {
+			continue
+		}
+
+		if err := loader.Add(walTransactionChange{
+			Type: walTransactionChangeTypeDelete,
+			Key:  append(Key{}, key.Key()...),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return loader.Flush()
+}
+
+// checkKeyRange returns ErrInvalidRange if the end of the range is not greater than the start.
+func checkKeyRange(start, end Key) error {
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+
+	return nil
+}
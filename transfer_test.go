@@ -0,0 +1,129 @@
+package lsmtree
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDB_TransferRange(t *testing.T) {
+	set := func(t *testing.T, db *DB, key, value string) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key(key), []byte(value)))
+		assert.NoError(t, txn.Commit())
+	}
+
+	remove := func(t *testing.T, db *DB, key string) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Delete(Key(key)))
+		assert.NoError(t, txn.Commit())
+	}
+
+	keys := func(t *testing.T, db *DB) map[string]string {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		iterator, err := txn.NewIterator(IteratorOptions{})
+		assert.NoError(t, err)
+		defer iterator.Close()
+
+		items := map[string]string{}
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			item := iterator.Item()
+			items[string(item.Key)] = string(item.Value)
+		}
+
+		return items
+	}
+
+	t.Run("move a range", func(t *testing.T) {
+		source, cleanupSource := newTestDB(t, DefaultOptions())
+		defer cleanupSource()
+		destination, cleanupDestination := newTestDB(t, DefaultOptions())
+		defer cleanupDestination()
+
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			set(t, source, key, "old "+key)
+		}
+
+		var dump bytes.Buffer
+		timestamp, err := source.ExportRange(&dump, Key("b"), Key("e"))
+		assert.NoError(t, err)
+
+		// Changes made after the export are only visible through RangeChanges.
+		set(t, source, "b", "new b")
+		set(t, source, "b", "newer b")
+		remove(t, source, "c")
+		set(t, source, "e", "new e")
+
+		assert.NoError(t, destination.Load(&dump))
+		assert.Equal(t, map[string]string{
+			"b": "old b",
+			"c": "old c",
+			"d": "old d",
+		}, keys(t, destination))
+
+		changes, next, err := source.RangeChanges(Key("b"), Key("e"), timestamp)
+		assert.NoError(t, err)
+		assert.Greater(t, next, timestamp)
+		assert.Len(t, changes, 2)
+		assert.Equal(t, Key("b"), changes[0].Key)
+		assert.Equal(t, "newer b", string(changes[0].Value))
+		assert.Equal(t, Key("c"), changes[1].Key)
+		assert.Nil(t, changes[1].Value)
+
+		txn, err := destination.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		for _, change := range changes {
+			if change.Value == nil {
+				assert.NoError(t, txn.Delete(change.Key))
+			} else {
+				assert.NoError(t, txn.Set(change.Key, change.Value))
+			}
+		}
+		assert.NoError(t, txn.Commit())
+		assert.Equal(t, map[string]string{
+			"b": "newer b",
+			"d": "old d",
+		}, keys(t, destination))
+
+		// Once the destination has caught up there are no more changes.
+		changes, _, err = source.RangeChanges(Key("b"), Key("e"), next)
+		assert.NoError(t, err)
+		assert.Empty(t, changes)
+
+		assert.NoError(t, source.ExciseRange(Key("b"), Key("e")))
+		assert.Equal(t, map[string]string{
+			"a": "old a",
+			"e": "new e",
+		}, keys(t, source))
+	})
+
+	t.Run("no upper bound", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		for _, key := range []string{"a", "b", "c"} {
+			set(t, db, key, key)
+		}
+
+		assert.NoError(t, db.ExciseRange(Key("b"), nil))
+		assert.Equal(t, map[string]string{"a": "a"}, keys(t, db))
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		var dump bytes.Buffer
+		_, err := db.ExportRange(&dump, Key("b"), Key("a"))
+		assert.True(t, errors.Is(err, ErrInvalidRange))
+		_, _, err = db.RangeChanges(Key("b"), Key("b"), 0)
+		assert.True(t, errors.Is(err, ErrInvalidRange))
+		assert.True(t, errors.Is(db.ExciseRange(Key("b"), Key("a")), ErrInvalidRange))
+	})
+}
@@ -0,0 +1,379 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrTxnPrepared is returned when a change is made to a transaction after it has been
+	// prepared, or when it is prepared a second time. A prepared transaction can only be
+	// committed or rolled back.
+	ErrTxnPrepared = errors.New("transaction has been prepared")
+
+	// ErrWALDisabled is returned when a transaction with TxnOptions.DisableWAL is prepared, a
+	// prepared transaction has to survive a restart so it must be written to the WAL.
+	ErrWALDisabled = errors.New("transaction does not write to the wal")
+
+	// ErrPreparedTxnNotFound is returned when a prepared transaction is committed or rolled back
+	// by an id that is not prepared, either because it was never prepared or because it has
+	// already been committed or rolled back.
+	ErrPreparedTxnNotFound = errors.New("prepared transaction not found")
+)
+
+// Two-phase commit lets the database take part in a transaction that spans more than one store.
+// A coordinator outside of the database first asks every participant to prepare, then commits
+// everywhere once every participant has prepared or rolls back everywhere otherwise.
+//
+// Preparing appends the changes of the transaction to the WAL with a timestamp of 0 and the
+// prepare id as its TransactionId, and syncs it. Nothing is applied to the memtable, so the
+// changes are not visible. Resolving the transaction appends a second record with a
+// walTransactionChangeTypeResolve change keyed by the prepare id: on commit that change is added
+// to the normal commit of the transaction's changes, on rollback it is the only change in a record
+// that also has a timestamp of 0. When the database is opened every prepared record without a
+// matching resolve is prepared again, so a coordinator can resolve it after a restart.
+//
+// A prepared transaction has promised that it can commit, so nothing may happen in between that
+// would have made it conflict. Preparing goes through backgroundWriter like a commit does, where
+// the keys the transaction read are checked for conflicts and then every key it read or wrote is
+// reserved. Until the transaction is resolved any commit that writes a reserved key fails with
+// ErrTxnConflict, otherwise the prepared transaction would overwrite a change it never saw or
+// commit based on a value that is no longer current. Only the keys a transaction writes are in the
+// WAL, so after a restart only those are reserved.
+
+type (
+	// preparedTransactions are the transactions that have been prepared and not resolved yet, by
+	// their prepare id.
+	preparedTransactions struct {
+		lock         sync.Mutex
+		transactions map[uint64]*preparedTransaction
+
+		// reserved maps each key that a prepared transaction read or wrote to its prepare id.
+		reserved map[string]uint64
+	}
+
+	// preparedTransaction is a single transaction in preparedTransactions.
+	preparedTransaction struct {
+		changes []walTransactionChange
+
+		// keys are the keys the transaction reserved.
+		keys []Key
+
+		// resolving is true while the transaction is being committed or rolled back. Its keys
+		// stay reserved until it has been resolved.
+		resolving bool
+	}
+)
+
+// Prepare makes the changes of the transaction durable without making them visible, and returns
+// the id that the transaction can be committed or rolled back with. The transaction is
+// guaranteed to commit if it is committed later, even if the database is restarted in between:
+// once a transaction has been prepared only Commit (or DB.CommitPrepared) and
+// DB.RollbackPrepared can end it.
+//
+// The keys the transaction read are checked for conflicts the same way as by Commit, and
+// ErrTxnConflict is returned if any of them has been written since the transaction started. Once
+// prepared, every key the transaction read or wrote is reserved: other commits that write one of
+// them fail with ErrTxnConflict until the transaction is committed or rolled back.
+//
+// Discarding a prepared transaction does not roll it back, it stays prepared until it is resolved
+// by its id. This way a deferred Discard can never undo a decision that the coordinator has not
+// made yet.
+func (t *Txn) Prepare() (uint64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := t.check(); err != nil {
+		return 0, err
+	}
+
+	if t.options.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	if t.prepared != 0 {
+		return 0, ErrTxnPrepared
+	}
+
+	if t.options.DisableWAL {
+		return 0, ErrWALDisabled
+	}
+
+	id, err := t.db.prepare(t.changes, t.reads, t.snapshot.timestamp, t.options.Priority)
+	if err == ErrTxnConflict {
+		t.conflictTimestamp = id
+	}
+	if err != nil {
+		return 0, err
+	}
+	t.prepared = id
+
+	return id, nil
+}
+
+// CommitPrepared commits a transaction that was prepared with Txn.Prepare, possibly before the
+// database was restarted, and returns the timestamp it was committed at. ErrPreparedTxnNotFound is
+// returned if the id is not prepared.
+func (db *DB) CommitPrepared(id uint64) (uint64, error) {
+	return db.commitPrepared(id, WritePriorityNormal)
+}
+
+// RollbackPrepared throws away a transaction that was prepared with Txn.Prepare, possibly before
+// the database was restarted. ErrPreparedTxnNotFound is returned if the id is not prepared.
+func (db *DB) RollbackPrepared(id uint64) error {
+	if _, ok := db.prepared.Take(id); !ok {
+		return ErrPreparedTxnNotFound
+	}
+
+	err := db.wal.Append(walTransaction{
+		TransactionId: id,
+		Entries:       []walTransactionChange{newResolveChange(id)},
+	})
+	if err == nil {
+		err = db.wal.SyncBarrier()
+	}
+
+	// If the rollback could not be made durable then the transaction is still prepared.
+	if err != nil {
+		db.prepared.Restore(id)
+		return err
+	}
+	db.prepared.Release(id)
+
+	return nil
+}
+
+// PreparedTransactions returns the ids of every transaction that has been prepared and not
+// committed or rolled back yet, in ascending order. After a restart these are the transactions
+// whose outcome has to be asked of the coordinator.
+func (db *DB) PreparedTransactions() []uint64 {
+	return db.prepared.Ids()
+}
+
+// prepare sends the changes through the commit pipeline as a prepared transaction and waits for
+// them to be durable, see appendPrepared. The prepare id is returned, or the timestamp of the write
+// that the transaction conflicted with if it fails with ErrTxnConflict.
+func (db *DB) prepare(
+	changes []walTransactionChange, reads []Key, readTimestamp uint64, priority WritePriority,
+) (uint64, error) {
+	request := &commitRequest{
+		changes:       changes,
+		reads:         reads,
+		readTimestamp: readTimestamp,
+		prepare:       true,
+		done:          make(chan error, 1),
+	}
+	id, err := db.commitRequest(request, priority)
+	if err != nil && err != ErrTxnConflict {
+		// The record may have been appended and its keys reserved before the sync failed.
+		db.prepared.Release(id)
+	}
+
+	return id, err
+}
+
+// appendPrepared appends a prepared transaction to the WAL and reserves its keys, it is called by
+// backgroundWriter once the transaction has been checked for conflicts. Nothing is applied to the
+// memtable.
+func (db *DB) appendPrepared(request *commitRequest) error {
+	// Prepare ids come from the same allocator as timestamps so that they never collide with the
+	// TransactionId of a commit.
+	request.timestamp = db.timestamps.Next()
+	if err := db.wal.Append(walTransaction{
+		TransactionId: request.timestamp,
+		Entries:       request.changes,
+	}); err != nil {
+		return err
+	}
+
+	db.prepared.Add(request.timestamp, request.changes, request.reads)
+
+	return nil
+}
+
+// commitPrepared commits the changes of the prepared transaction along with the record that
+// resolves it.
+func (db *DB) commitPrepared(id uint64, priority WritePriority) (uint64, error) {
+	changes, ok := db.prepared.Take(id)
+	if !ok {
+		return 0, ErrPreparedTxnNotFound
+	}
+
+	// A prepared transaction is resolved by the same record that commits it. Its reads were
+	// checked when it was prepared, and its keys have been reserved since then.
+	timestamp, err := db.commitRequest(&commitRequest{
+		changes:      changes,
+		markers:      []walTransactionChange{newResolveChange(id)},
+		resolves:     id,
+		ignoreQuotas: true,
+		done:         make(chan error, 1),
+	}, priority)
+	if err != nil {
+		// The commit record was not written, so the transaction is still prepared.
+		db.prepared.Restore(id)
+		return 0, err
+	}
+	db.prepared.Release(id)
+
+	return timestamp, nil
+}
+
+// newResolveChange returns the change that marks the prepared transaction as resolved.
+func newResolveChange(id uint64) walTransactionChange {
+	key := make(Key, 8)
+	binary.BigEndian.PutUint64(key, id)
+
+	return walTransactionChange{
+		Type: walTransactionChangeTypeResolve,
+		Key:  key,
+	}
+}
+
+// resolvedPrepareId returns the prepare id that the transaction resolves, if it resolves one. The
+// resolve change is always the last change in the transaction.
+func resolvedPrepareId(txn walTransaction) (uint64, bool) {
+	if len(txn.Entries) == 0 {
+		return 0, false
+	}
+
+	last := txn.Entries[len(txn.Entries)-1]
+	if last.Type != walTransactionChangeTypeResolve || len(last.Key) != 8 {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint64(last.Key), true
+}
+
+// readSegment returns every transaction in a single segment and then closes it.
+func (w *walManager) readSegment(segmentId uint64) ([]walTransaction, error) {
+	segment, err := openWalSegment(w.Directory, segmentId, int32(w.MaxWALSegmentSize), w.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	segment.Cipher = w.cipher
+
+	if closer, ok := segment.File.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	return segment.GetTransactions()
+}
+
+// newPreparedTransactions creates the prepared transactions from the ones that were recovered
+// from the WAL, only the keys they wrote are reserved.
+func newPreparedTransactions(transactions map[uint64][]walTransactionChange) *preparedTransactions {
+	p := &preparedTransactions{
+		transactions: map[uint64]*preparedTransaction{},
+		reserved:     map[string]uint64{},
+	}
+	for id, changes := range transactions {
+		p.Add(id, changes, nil)
+	}
+
+	return p
+}
+
+// Add records that the transaction is prepared and reserves the keys it changed and read.
+func (p *preparedTransactions) Add(id uint64, changes []walTransactionChange, reads []Key) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	keys := make([]Key, 0, len(changes)+len(reads))
+	for _, change := range changes {
+		keys = append(keys, change.Key)
+	}
+	keys = append(keys, reads...)
+	for _, key := range keys {
+		p.reserved[string(key)] = id
+	}
+
+	p.transactions[id] = &preparedTransaction{
+		changes: changes,
+		keys:    keys,
+	}
+}
+
+// Conflicts returns true if any of the changes writes a key reserved by a prepared transaction
+// other than the one with the id provided.
+func (p *preparedTransactions) Conflicts(changes []walTransactionChange, except uint64) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.reserved) == 0 {
+		return false
+	}
+
+	for _, change := range changes {
+		if id, ok := p.reserved[string(change.Key)]; ok && id != except {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Take marks the prepared transaction as being resolved and returns its changes. Only one caller
+// can take a transaction, so it can never be resolved twice at the same time. The caller must
+// either Release the transaction once it has been resolved or Restore it if that failed.
+func (p *preparedTransactions) Take(id uint64) ([]walTransactionChange, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	txn, ok := p.transactions[id]
+	if !ok || txn.resolving {
+		return nil, false
+	}
+	txn.resolving = true
+
+	return txn.changes, true
+}
+
+// Restore makes a transaction that could not be resolved prepared again.
+func (p *preparedTransactions) Restore(id uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if txn, ok := p.transactions[id]; ok {
+		txn.resolving = false
+	}
+}
+
+// Release forgets the prepared transaction and the keys it reserved. Nothing happens if the
+// transaction is not prepared.
+func (p *preparedTransactions) Release(id uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	txn, ok := p.transactions[id]
+	if !ok {
+		return
+	}
+
+	for _, key := range txn.keys {
+		if p.reserved[string(key)] == id {
+			delete(p.reserved, string(key))
+		}
+	}
+	delete(p.transactions, id)
+}
+
+// Ids returns the ids of every prepared transaction that is not being resolved in ascending order.
+func (p *preparedTransactions) Ids() []uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ids := make([]uint64, 0, len(p.transactions))
+	for id, txn := range p.transactions {
+		if !txn.resolving {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
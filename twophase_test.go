@@ -0,0 +1,268 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTxn_Prepare(t *testing.T) {
+	get := func(t *testing.T, db *DB, key string) error {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		_, err = txn.Get(Key(key))
+		return err
+	}
+
+	prepare := func(t *testing.T, db *DB, key string) (*Txn, uint64) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key(key), []byte("value")))
+
+		id, err := txn.Prepare()
+		assert.NoError(t, err)
+		assert.NotZero(t, id)
+
+		return txn, id
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, id := prepare(t, db, "a")
+		assert.Equal(t, []uint64{id}, db.PreparedTransactions())
+
+		// Prepared changes are not visible, and the transaction cannot be changed anymore.
+		assert.Equal(t, ErrKeyNotFound, get(t, db, "a"))
+		assert.Equal(t, ErrTxnPrepared, txn.Set(Key("b"), []byte("value")))
+		_, err := txn.Prepare()
+		assert.Equal(t, ErrTxnPrepared, err)
+
+		assert.NoError(t, txn.Commit())
+		assert.NotZero(t, txn.CommitTimestamp())
+		assert.NoError(t, get(t, db, "a"))
+		assert.Empty(t, db.PreparedTransactions())
+
+		_, err = db.CommitPrepared(id)
+		assert.Equal(t, ErrPreparedTxnNotFound, err)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, id := prepare(t, db, "a")
+
+		// Discarding a prepared transaction leaves it prepared.
+		txn.Discard()
+		assert.Equal(t, []uint64{id}, db.PreparedTransactions())
+
+		assert.NoError(t, db.RollbackPrepared(id))
+		assert.Equal(t, ErrKeyNotFound, get(t, db, "a"))
+		assert.Empty(t, db.PreparedTransactions())
+		assert.Equal(t, ErrPreparedTxnNotFound, db.RollbackPrepared(id))
+	})
+
+	t.Run("conflicts", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		set := func(key, value string) error {
+			txn, err := db.NewTransaction(TxnOptions{})
+			assert.NoError(t, err)
+			assert.NoError(t, txn.Set(Key(key), []byte(value)))
+			return txn.Commit()
+		}
+		assert.NoError(t, set("balance", "100"))
+
+		// readAndPrepare reads the balance and prepares a change to it.
+		readAndPrepare := func() (*Txn, error) {
+			txn, err := db.NewTransaction(TxnOptions{})
+			assert.NoError(t, err)
+			_, err = txn.Get(Key("balance"))
+			assert.NoError(t, err)
+			assert.NoError(t, txn.Set(Key("balance"), []byte("90")))
+			assert.NoError(t, txn.Set(Key("history"), []byte("-10")))
+
+			_, err = txn.Prepare()
+			return txn, err
+		}
+
+		// A write after the read but before the prepare is a conflict for the prepare.
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		_, err = txn.Get(Key("balance"))
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("balance"), []byte("90")))
+		assert.NoError(t, set("balance", "50"))
+		_, err = txn.Prepare()
+		assert.Equal(t, ErrTxnConflict, err)
+		assert.NotZero(t, txn.conflictTimestamp)
+		assert.Empty(t, db.PreparedTransactions())
+
+		// A writer that commits between the prepare and the commit conflicts instead of being
+		// overwritten, for keys the prepared transaction wrote or only read.
+		txn, err = readAndPrepare()
+		assert.NoError(t, err)
+		assert.Equal(t, ErrTxnConflict, set("balance", "0"))
+		assert.Equal(t, ErrTxnConflict, set("history", "0"))
+
+		// So does another prepare.
+		_, err = readAndPrepare()
+		assert.Equal(t, ErrTxnConflict, err)
+
+		// Keys that the prepared transaction did not touch can still be written.
+		assert.NoError(t, set("other", "1"))
+
+		assert.NoError(t, txn.Commit())
+		value, err := db.Get(Key("balance"), ReadOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "90", string(value.Value))
+
+		// Once the transaction is resolved its keys can be written again.
+		assert.NoError(t, set("balance", "80"))
+
+		txn, err = readAndPrepare()
+		assert.NoError(t, err)
+		id := txn.prepared
+		txn.Discard()
+		assert.Equal(t, ErrTxnConflict, set("balance", "0"))
+		assert.NoError(t, db.RollbackPrepared(id))
+		assert.NoError(t, set("balance", "0"))
+	})
+
+	t.Run("concurrent writer", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		// increment reads the counter and sets it to one more.
+		increment := func(txn *Txn) {
+			item, err := txn.Get(Key("counter"))
+			assert.NoError(t, err)
+			assert.NoError(t, txn.Set(Key("counter"), []byte{item.Value[0] + 1}))
+		}
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("counter"), []byte{0}))
+		assert.NoError(t, txn.Commit())
+
+		prepared, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		increment(prepared)
+		_, err = prepared.Prepare()
+		assert.NoError(t, err)
+
+		// Another writer increments the counter from its own goroutine between the prepare and
+		// the commit. It has to retry until the prepared transaction is resolved.
+		attempts := make(chan error)
+		go func() {
+			defer close(attempts)
+			for {
+				txn, err := db.NewTransaction(TxnOptions{})
+				assert.NoError(t, err)
+				increment(txn)
+
+				err = txn.Commit()
+				attempts <- err
+				if err != ErrTxnConflict {
+					return
+				}
+			}
+		}()
+
+		assert.Equal(t, ErrTxnConflict, <-attempts)
+		assert.NoError(t, prepared.Commit())
+		for err = range attempts {
+		}
+		assert.NoError(t, err)
+
+		// Neither increment was lost.
+		item, err := db.Get(Key("counter"), ReadOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, byte(2), item.Value[0])
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		_, err = txn.Prepare()
+		assert.Equal(t, ErrReadOnly, err)
+	})
+
+	t.Run("survives restart", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+
+		// One transaction of each outcome, plus two that are still prepared when the database
+		// is closed.
+		committed, committedId := prepare(t, db, "committed")
+		assert.NoError(t, committed.Commit())
+		_, rolledBackId := prepare(t, db, "rolled back")
+		assert.NoError(t, db.RollbackPrepared(rolledBackId))
+		_, commitLaterId := prepare(t, db, "commit later")
+		_, rollbackLaterId := prepare(t, db, "rollback later")
+		assert.NoError(t, db.Close())
+
+		db, err = Open(options)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{commitLaterId, rollbackLaterId}, db.PreparedTransactions())
+
+		timestamp, err := db.CommitPrepared(commitLaterId)
+		assert.NoError(t, err)
+		assert.True(t, timestamp > rollbackLaterId)
+		assert.NoError(t, get(t, db, "commit later"))
+		assert.NoError(t, db.RollbackPrepared(rollbackLaterId))
+
+		_, err = db.CommitPrepared(committedId)
+		assert.Equal(t, ErrPreparedTxnNotFound, err)
+		assert.NoError(t, db.Close())
+
+		// Resolving after the restart is durable as well.
+		db, err = Open(options)
+		assert.NoError(t, err)
+		assert.Empty(t, db.PreparedTransactions())
+		assert.NoError(t, db.Close())
+	})
+
+	t.Run("rolled back ids are not reused", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		clock := NewManualClock(time.Unix(1000, 0))
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.Clock = clock
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+		_, rolledBackId := prepare(t, db, "rolled back")
+		assert.NoError(t, db.RollbackPrepared(rolledBackId))
+		assert.NoError(t, db.Close())
+
+		// Even with the clock moved backwards the next id is newer than the rolled back one.
+		clock.Set(time.Unix(999, 0))
+		db, err = Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		_, id := prepare(t, db, "again")
+		assert.True(t, id > rolledBackId)
+	})
+}
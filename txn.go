@@ -0,0 +1,641 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrTxnDiscarded is returned when an operation is attempted on a transaction that has already
+	// been committed or discarded.
+	ErrTxnDiscarded = errors.New("transaction has already been committed or discarded")
+
+	// ErrTxnTimeout is returned when an operation is attempted on a transaction that was aborted
+	// because it ran for longer than its TxnOptions.Timeout.
+	ErrTxnTimeout = errors.New("transaction timed out")
+
+	// ErrSnapshotReleased is returned when a read is made at a ReadOptions.Snapshot that has
+	// already been released. The versions it could see may have been removed already.
+	ErrSnapshotReleased = errors.New("snapshot has already been released")
+)
+
+const (
+	// txnReapInterval is how often the transaction reaper checks for transactions that have run
+	// for longer than their timeout.
+	txnReapInterval = 100 * time.Millisecond
+)
+
+type (
+	// TxnOptions are the options for a single transaction.
+	TxnOptions struct {
+		// ReadOnly transactions cannot make any changes, any attempt to will return ErrReadOnly.
+		ReadOnly bool
+
+		// Timeout is how long the transaction can run before it is automatically aborted. Once it
+		// has been aborted every operation on the transaction will return ErrTxnTimeout. A
+		// transaction holds a snapshot for as long as it is open, so a transaction that is leaked
+		// would otherwise keep old versions of keys from ever being removed. If this is 0 then the
+		// transaction will never time out.
+		Timeout time.Duration
+
+		// MinReadTimestamp makes NewTransaction wait until every transaction committed at or
+		// before this timestamp is visible, so the transaction is guaranteed to see them. This is
+		// used for read-your-writes consistency: pass the Txn.CommitTimestamp of an earlier write,
+		// possibly to a different replica of the database. If this is 0 then NewTransaction does
+		// not wait.
+		MinReadTimestamp uint64
+
+		// MinReadTimeout is how long NewTransaction will wait for MinReadTimestamp before
+		// returning ErrTimestampNotReached. If this is 0 then it will wait until the timestamp is
+		// visible or the database is closed.
+		MinReadTimeout time.Duration
+
+		// Priority decides which writes are held back first when too many commits are in
+		// progress, see Options.MaxInFlightWrites. It has no effect on reads.
+		// Default is WritePriorityNormal.
+		Priority WritePriority
+
+		// DisableWAL commits the transaction without writing it to the WAL. This is only meant for
+		// data that can be rebuilt from somewhere else, like a derived index. The changes are
+		// still conflict checked, visible to other transactions and sent to watches like any
+		// other commit, but they are not durable: they are lost if the database crashes, and
+		// since nothing but the WAL is replayed when the database is opened, they are lost when
+		// it is closed as well. A transaction written to the WAL after one that was not can
+		// survive a crash without it, so other writes should never depend on these changes
+		// being there. A transaction with DisableWAL cannot be prepared.
+		// Default is false.
+		DisableWAL bool
+	}
+
+	// ReadOptions change how a single read is made, see Txn.GetWithOptions, Txn.MultiGet and
+	// IteratorOptions. The zero value reads the same way as Txn.Get.
+	ReadOptions struct {
+		// DisableCacheFill stops the read from adding what it finds to the row cache or the
+		// negative lookup cache. Anything that is already cached is still used. This is meant for
+		// one off reads of a lot of keys, like a backfill, that would otherwise push the hot keys
+		// of the working set out of the caches.
+		// Default is false.
+		DisableCacheFill bool
+
+		// Snapshot is read at instead of the snapshot of the transaction, the snapshot must not
+		// have been released. Changes made by the transaction itself are still visible. The keys
+		// that are read are still checked for conflicts at the transaction's read timestamp, so
+		// a read at an older snapshot will not notice keys that were changed after the snapshot
+		// but before the transaction started.
+		// Default is nil, the snapshot of the transaction is read.
+		Snapshot *Snapshot
+	}
+
+	// Txn is a set of reads and changes to the database. The reads see a consistent snapshot of
+	// the database as of when the transaction was started, plus any changes made by the
+	// transaction itself. The changes are applied atomically when the transaction is committed.
+	// A transaction is not safe for concurrent use.
+	Txn struct {
+		db       *DB
+		options  TxnOptions
+		snapshot *Snapshot
+
+		// deadline is when the transaction will time out, it is zero if there is no timeout.
+		deadline time.Time
+
+		// changes are the pending changes of the transaction in the order they were made, and
+		// pending is the index of the change for each key.
+		changes []walTransactionChange
+		pending map[string]int
+
+		// size is the total size of the changes, see Options.MaxBatchSize.
+		size int64
+
+		// reads are the keys the transaction has read with Get, and read holds the same keys so
+		// that each is only added once. They are checked for conflicts on commit.
+		reads []Key
+		read  map[string]struct{}
+
+		// lock is held for every operation on the transaction. The transaction itself is not
+		// safe for concurrent use, but the reaper can abort it at any time.
+		lock sync.Mutex
+
+		// done is txnOpen until the transaction has been committed or discarded (txnDone) or it
+		// has timed out (txnTimedOut). The lock must be held to change it.
+		done int32
+
+		// commitTimestamp is the timestamp the transaction was committed at, it is 0 until the
+		// transaction has been committed.
+		commitTimestamp uint64
+
+		// prepared is the id the transaction was prepared with, it is 0 until Prepare succeeds.
+		prepared uint64
+
+		// conflictTimestamp is the timestamp of the write that the commit conflicted with, if it
+		// failed with ErrTxnConflict.
+		conflictTimestamp uint64
+	}
+
+	// transactionList keeps track of every open transaction that has a timeout.
+	transactionList struct {
+		lock         sync.Mutex
+		transactions map[*Txn]struct{}
+	}
+)
+
+const (
+	// txnOpen, txnDone and txnTimedOut are the states of a transaction.
+	txnOpen int32 = iota
+	txnDone
+	txnTimedOut
+)
+
+// NewTransaction starts a new transaction. The transaction must be committed or discarded once it
+// is no longer needed.
+func (db *DB) NewTransaction(options TxnOptions) (*Txn, error) {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return nil, ErrClosed
+	}
+
+	if options.MinReadTimestamp > 0 {
+		if err := db.WaitForTimestamp(options.MinReadTimestamp, options.MinReadTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	txn := &Txn{
+		db:       db,
+		options:  options,
+		snapshot: db.snapshots.NewCurrent(db.readTimestamp, db.options.Clock.Now(), getCaller(1)),
+		pending:  map[string]int{},
+		read:     map[string]struct{}{},
+	}
+
+	if options.Timeout > 0 {
+		txn.deadline = txn.snapshot.createdAt.Add(options.Timeout)
+		db.transactions.Add(txn)
+	}
+
+	return txn, nil
+}
+
+// Get returns the newest version of the key that is visible to the transaction. If the key does
+// not exist or has been deleted then ErrKeyNotFound is returned.
+func (t *Txn) Get(key Key) (Item, error) {
+	return t.GetWithOptions(key, ReadOptions{})
+}
+
+// GetWithOptions returns the newest version of the key like Get, but the read is made with the
+// options provided.
+func (t *Txn) GetWithOptions(key Key, options ReadOptions) (Item, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := t.check(); err != nil {
+		return Item{}, err
+	}
+
+	timestamp, err := t.readTimestampFor(options)
+	if err != nil {
+		return Item{}, err
+	}
+
+	return t.get(key, timestamp, options)
+}
+
+// MultiGet returns the newest version of each of the keys, in the same order as the keys. Every
+// key is read at the same timestamp. A key that does not exist or has been deleted has a zero
+// Item, so its Key is nil. If any key is empty then ErrEmptyKey is returned.
+func (t *Txn) MultiGet(keys []Key, options ReadOptions) ([]Item, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+
+	timestamp, err := t.readTimestampFor(options)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]Item, len(keys))
+	for i, key := range keys {
+		item, err := t.get(key, timestamp, options)
+		switch err {
+		case nil:
+			items[i] = item
+		case ErrKeyNotFound:
+		default:
+			return nil, err
+		}
+	}
+
+	return items, nil
+}
+
+// readTimestampFor returns the timestamp that a read with the options provided is made at.
+func (t *Txn) readTimestampFor(options ReadOptions) (uint64, error) {
+	if options.Snapshot == nil {
+		return t.snapshot.timestamp, nil
+	}
+
+	if atomic.LoadInt32(&options.Snapshot.released) == 1 {
+		return 0, ErrSnapshotReleased
+	}
+
+	return options.Snapshot.timestamp, nil
+}
+
+// get returns the newest version of the key that is visible at the timestamp. The lock must be
+// held.
+func (t *Txn) get(key Key, timestamp uint64, options ReadOptions) (Item, error) {
+	if len(key) == 0 {
+		return Item{}, ErrEmptyKey
+	}
+
+	if tracer := t.db.options.Tracer; tracer != nil {
+		tracer.traceGet(t.db.options.Clock.Now(), key)
+	}
+	t.db.accesses.Read(key)
+
+	// Read only transactions can never conflict, so there is no need to remember what they read.
+	if !t.options.ReadOnly {
+		if _, ok := t.read[string(key)]; !ok {
+			key := append(Key{}, key...)
+			t.read[string(key)] = struct{}{}
+			t.reads = append(t.reads, key)
+		}
+	}
+
+	// Expired values are not removed until they are deleted by the expirer, so they are hidden
+	// here instead.
+	now := t.db.options.Clock.Now()
+
+	// Changes made by the transaction itself are always visible to it.
+	if index, ok := t.pending[string(key)]; ok {
+		atomic.AddUint64(&t.db.lookups.pending, 1)
+		change := t.changes[index]
+		if change.Type == walTransactionChangeTypeDelete {
+			return Item{}, ErrKeyNotFound
+		}
+
+		item := memtableEntry{
+			Type:      change.Type,
+			Value:     change.Value,
+			UserMeta:  change.UserMeta,
+			ExpiresAt: change.ExpiresAt,
+		}.Item(newTimestampedKey(key, t.snapshot.timestamp))
+		if item.IsExpired(now) {
+			return Item{}, ErrKeyNotFound
+		}
+
+		return item, nil
+	}
+
+	if item, ok := t.db.rows.Get(key, timestamp); ok {
+		atomic.AddUint64(&t.db.lookups.rowCache, 1)
+		t.db.readAmp.Record(0)
+		if item.IsExpired(now) {
+			return Item{}, ErrKeyNotFound
+		}
+
+		return item, nil
+	}
+
+	if t.db.negativeLookups.Contains(key, timestamp) {
+		atomic.AddUint64(&t.db.lookups.negativeCache, 1)
+		t.db.readAmp.Record(0)
+		return Item{}, ErrKeyNotFound
+	}
+
+	item, found := t.db.memtable.Get(key, timestamp)
+	if !found || item.Value == nil {
+		atomic.AddUint64(&t.db.lookups.notFound, 1)
+		t.db.readAmp.Record(t.db.filesToProbe(key))
+		if !options.DisableCacheFill {
+			t.db.negativeLookups.Add(key, timestamp)
+		}
+		return Item{}, ErrKeyNotFound
+	}
+	atomic.AddUint64(&t.db.lookups.memtable, 1)
+	t.db.readAmp.Record(0)
+	if !options.DisableCacheFill {
+		t.db.rows.Add(item, timestamp)
+	}
+	if item.IsExpired(now) {
+		return Item{}, ErrKeyNotFound
+	}
+
+	return item, nil
+}
+
+// Set will set the key to the value provided when the transaction is committed. The key and value
+// are checked against Options.MaxKeySize and Options.MaxValueSize straight away, ErrKeyTooLarge or
+// ErrValueTooLarge is returned here rather than from Commit.
+func (t *Txn) Set(key Key, value []byte) error {
+	return t.SetWithMeta(key, value, 0)
+}
+
+// SetWithTTL will set the key to the value provided when the transaction is committed. Once the
+// ttl has passed the key is treated as if it had been deleted. If Options.ExpirationInterval is
+// set then it is also deleted in the background shortly after. The ttl is rounded to whole
+// seconds.
+func (t *Txn) SetWithTTL(key Key, value []byte, ttl time.Duration) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	return t.add(walTransactionChange{
+		Type:      walTransactionChangeTypeSet,
+		Key:       key,
+		Value:     value,
+		ExpiresAt: getExpiresAt(t.db.options.Clock.Now(), ttl),
+	})
+}
+
+// SetWithMeta will set the key to the value provided when the transaction is committed, the
+// userMeta byte is stored alongside the value and is returned in the Item.
+func (t *Txn) SetWithMeta(key Key, value []byte, userMeta byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	return t.add(walTransactionChange{
+		Type:     walTransactionChangeTypeSet,
+		Key:      key,
+		Value:    value,
+		UserMeta: userMeta,
+	})
+}
+
+// Delete will remove the key when the transaction is committed. Like Set, a key larger than
+// Options.MaxKeySize is rejected straight away with ErrKeyTooLarge.
+func (t *Txn) Delete(key Key) error {
+	return t.add(walTransactionChange{
+		Type: walTransactionChangeTypeDelete,
+		Key:  key,
+	})
+}
+
+// Commit will atomically apply every change made by the transaction. Once Commit returns the
+// changes are durable and visible to new transactions. The transaction cannot be used after it
+// has been committed, even if the commit fails.
+//
+// If the transaction made changes and a key it read with Get has been written by another
+// transaction since the transaction started then nothing is applied and ErrTxnConflict is
+// returned, the transaction should be retried from the start. Keys read with an Iterator are not
+// checked.
+func (t *Txn) Commit() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := t.check(); err != nil {
+		return err
+	}
+	defer t.finish()
+
+	if t.prepared != 0 {
+		timestamp, err := t.db.commitPrepared(t.prepared, t.options.Priority)
+		if err != nil {
+			return err
+		}
+		t.commitTimestamp = timestamp
+
+		if tracer := t.db.options.Tracer; tracer != nil {
+			tracer.traceCommit(t.db.options.Clock.Now(), t.changes)
+		}
+
+		return nil
+	}
+
+	if len(t.changes) == 0 {
+		// Nothing was written, but everything the transaction read is still a valid point to
+		// wait for.
+		t.commitTimestamp = t.snapshot.timestamp
+		return nil
+	}
+
+	timestamp, err := t.db.commitRequest(&commitRequest{
+		changes:       t.changes,
+		reads:         t.reads,
+		readTimestamp: t.snapshot.timestamp,
+		disableWAL:    t.options.DisableWAL,
+		done:          make(chan error, 1),
+	}, t.options.Priority)
+	if err == ErrTxnConflict {
+		t.conflictTimestamp = timestamp
+	}
+	if err != nil {
+		return err
+	}
+	t.commitTimestamp = timestamp
+
+	if tracer := t.db.options.Tracer; tracer != nil {
+		tracer.traceCommit(t.db.options.Clock.Now(), t.changes)
+	}
+
+	return nil
+}
+
+// ReadTimestamp returns the timestamp of the snapshot the transaction reads from.
+func (t *Txn) ReadTimestamp() uint64 {
+	return t.snapshot.timestamp
+}
+
+// CommitTimestamp returns the timestamp that the transaction was committed at, or 0 if it has not
+// been committed successfully. A transaction that did not make any changes returns its read
+// timestamp. The timestamp can be passed as TxnOptions.MinReadTimestamp to make sure that a later
+// transaction sees everything this one did.
+func (t *Txn) CommitTimestamp() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.commitTimestamp
+}
+
+// Discard will throw away every change made by the transaction. It is safe to call Discard after
+// the transaction has been committed, this way it can always be deferred.
+func (t *Txn) Discard() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if atomic.LoadInt32(&t.done) == txnOpen {
+		t.finish()
+	}
+}
+
+// add stages the change to be applied when the transaction is committed. If the key has already
+// been changed by the transaction then the new change replaces it.
+func (t *Txn) add(change walTransactionChange) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	if t.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if t.prepared != 0 {
+		return ErrTxnPrepared
+	}
+
+	if err := change.Validate(t.db.options.MaxKeySize, t.db.options.MaxValueSize); err != nil {
+		return err
+	}
+
+	// Copy the key and value so that the caller can reuse their buffers.
+	change.Key = append(Key{}, change.Key...)
+	if change.Value != nil {
+		change.Value = append([]byte{}, change.Value...)
+	}
+
+	index, ok := t.pending[string(change.Key)]
+	size, err := t.db.options.checkBatchLimits(t.changes, t.size, index, ok, change)
+	if err != nil {
+		return err
+	}
+	t.size = size
+
+	if ok {
+		t.changes[index] = change
+		return nil
+	}
+
+	t.pending[string(change.Key)] = len(t.changes)
+	t.changes = append(t.changes, change)
+
+	return nil
+}
+
+// checkBatchLimits returns the size of the changes once the change has been added to them, or
+// ErrTxnTooBig if that would take them over Options.MaxBatchCount or Options.MaxBatchSize. size
+// is the current size of the changes. If replaces is true then the change replaces the change at
+// the index instead of being added after the others.
+func (o *Options) checkBatchLimits(
+	changes []walTransactionChange, size int64, index int, replaces bool,
+	change walTransactionChange,
+) (int64, error) {
+	maxCount := o.MaxBatchCount
+	if maxCount == 0 {
+		maxCount = maxTransactionEntries
+	}
+
+	count := len(changes)
+	size += change.Size()
+	if replaces {
+		size -= changes[index].Size()
+	} else {
+		count++
+	}
+
+	switch {
+	case count > maxCount:
+		return 0, fmt.Errorf("%w: more than %d keys", ErrTxnTooBig, maxCount)
+	case o.MaxBatchSize > 0 && size > o.MaxBatchSize:
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrTxnTooBig, o.MaxBatchSize)
+	}
+
+	return size, nil
+}
+
+// check returns an error if the transaction can no longer be used.
+func (t *Txn) check() error {
+	switch atomic.LoadInt32(&t.done) {
+	case txnDone:
+		return ErrTxnDiscarded
+	case txnTimedOut:
+		return ErrTxnTimeout
+	}
+
+	if atomic.LoadInt32(&t.db.closed) == 1 {
+		return ErrClosed
+	}
+
+	return nil
+}
+
+// finish releases everything held by the transaction. The lock must be held.
+func (t *Txn) finish() {
+	t.end(txnDone)
+}
+
+// abort is called by the reaper when the transaction has run past its deadline. If the
+// transaction is in the middle of committing then the commit is allowed to finish.
+func (t *Txn) abort() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if atomic.LoadInt32(&t.done) == txnOpen {
+		t.end(txnTimedOut)
+	}
+}
+
+// end marks the transaction with the state provided and releases its snapshot.
+func (t *Txn) end(state int32) {
+	atomic.StoreInt32(&t.done, state)
+	t.snapshot.Release()
+	t.changes, t.pending = nil, nil
+
+	if !t.deadline.IsZero() {
+		t.db.transactions.Remove(t)
+	}
+}
+
+// Add starts tracking the transaction.
+func (l *transactionList) Add(txn *Txn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.transactions == nil {
+		l.transactions = map[*Txn]struct{}{}
+	}
+	l.transactions[txn] = struct{}{}
+}
+
+// Remove stops tracking the transaction.
+func (l *transactionList) Remove(txn *Txn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.transactions, txn)
+}
+
+// Expired returns every transaction that has a deadline before the time provided.
+func (l *transactionList) Expired(now time.Time) []*Txn {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var expired []*Txn
+	for txn := range l.transactions {
+		if !now.Before(txn.deadline) {
+			expired = append(expired, txn)
+		}
+	}
+
+	return expired
+}
+
+// transactionReaper will periodically abort any transactions that have run for longer than their
+// timeout. It runs until the database is closed.
+func (db *DB) transactionReaper() {
+	ticker := time.NewTicker(txnReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db.reapTransactions()
+		case <-db.stopped:
+			return
+		}
+	}
+}
+
+// reapTransactions aborts every transaction that has passed its deadline.
+func (db *DB) reapTransactions() {
+	for _, txn := range db.transactions.Expired(db.options.Clock.Now()) {
+		txn.abort()
+	}
+}
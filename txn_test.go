@@ -0,0 +1,479 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDB opens a database in a new temporary directory with the options provided. The
+// directories in the options are always replaced.
+func newTestDB(t *testing.T, options Options) (*DB, func()) {
+	dir, cleanup := NewTempDirectory(t)
+	options.WALDirectory = dir
+	options.DataDirectory = dir
+
+	db, err := Open(options)
+	if !assert.NoError(t, err) {
+		cleanup()
+		t.FailNow()
+	}
+
+	return db, func() {
+		_ = db.Close()
+		cleanup()
+	}
+}
+
+func TestTxn(t *testing.T) {
+	t.Run("set and get", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+		assert.NoError(t, txn.SetWithMeta(Key("meta"), nil, 7))
+
+		// The transaction should see its own changes before they are committed.
+		item, err := txn.Get(Key("key"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), item.Value)
+
+		// But other transactions should not.
+		other, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer other.Discard()
+
+		_, err = other.Get(Key("key"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		assert.NoError(t, txn.Commit())
+		assert.Equal(t, ErrTxnDiscarded, txn.Set(Key("key"), nil))
+
+		// A transaction that started before the commit still should not see the change.
+		_, err = other.Get(Key("key"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		reader, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer reader.Discard()
+
+		item, err = reader.Get(Key("key"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), item.Value)
+		assert.Equal(t, db.readTimestamp(), item.Version)
+
+		item, err = reader.Get(Key("meta"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{}, item.Value)
+		assert.Equal(t, byte(7), item.UserMeta)
+
+		assert.Equal(t, uint64(1), db.Metrics().WALTransactionsSynced)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, _ := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+		assert.NoError(t, txn.Commit())
+
+		txn, _ = db.NewTransaction(TxnOptions{})
+		assert.NoError(t, txn.Delete(Key("key")))
+		_, err := txn.Get(Key("key"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.NoError(t, txn.Commit())
+
+		txn, _ = db.NewTransaction(TxnOptions{ReadOnly: true})
+		defer txn.Discard()
+		_, err = txn.Get(Key("key"))
+		assert.Equal(t, ErrKeyNotFound, err)
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		options := DefaultOptions()
+		options.MaxKeySize = 4
+		options.MaxValueSize = 4
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		txn, _ := db.NewTransaction(TxnOptions{})
+		defer txn.Discard()
+
+		assert.Equal(t, ErrEmptyKey, txn.Set(Key(""), nil))
+		assert.True(t, errors.Is(txn.Set(Key("12345"), nil), ErrKeyTooLarge))
+		assert.True(t, errors.Is(txn.Set(Key("key"), []byte("12345")), ErrValueTooLarge))
+
+		readOnly, _ := db.NewTransaction(TxnOptions{ReadOnly: true})
+		defer readOnly.Discard()
+		assert.Equal(t, ErrReadOnly, readOnly.Set(Key("key"), nil))
+	})
+
+	t.Run("caller buffers are copied", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, _ := db.NewTransaction(TxnOptions{})
+		key, value := []byte("key"), []byte("value")
+		assert.NoError(t, txn.Set(key, value))
+		copy(key, "abc")
+		copy(value, "12345")
+		assert.NoError(t, txn.Commit())
+
+		txn, _ = db.NewTransaction(TxnOptions{ReadOnly: true})
+		defer txn.Discard()
+		item, err := txn.Get(Key("key"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), item.Value)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, _ := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, db.Close())
+
+		assert.Equal(t, ErrClosed, txn.Set(Key("key"), nil))
+		_, err := db.NewTransaction(TxnOptions{})
+		assert.Equal(t, ErrClosed, err)
+	})
+}
+
+func TestTxn_Timeout(t *testing.T) {
+	clock := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	options := DefaultOptions()
+	options.Clock = clock
+	db, cleanup := newTestDB(t, options)
+	defer cleanup()
+
+	txn, err := db.NewTransaction(TxnOptions{
+		Timeout: time.Minute,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+
+	forever, err := db.NewTransaction(TxnOptions{})
+	assert.NoError(t, err)
+	defer forever.Discard()
+
+	assert.Equal(t, 2, db.snapshots.Len())
+
+	db.reapTransactions()
+	assert.NoError(t, txn.Set(Key("other"), []byte("value")))
+
+	clock.Advance(time.Minute)
+	db.reapTransactions()
+
+	// Once the transaction has been aborted its snapshot should be released and it should not be
+	// usable anymore.
+	assert.Equal(t, 1, db.snapshots.Len())
+	assert.Equal(t, ErrTxnTimeout, txn.Set(Key("key"), nil))
+	assert.Equal(t, ErrTxnTimeout, txn.Commit())
+	_, err = txn.Get(Key("key"))
+	assert.Equal(t, ErrTxnTimeout, err)
+	txn.Discard()
+
+	// Transactions without a timeout are never aborted.
+	assert.NoError(t, forever.Set(Key("key"), nil))
+	assert.Empty(t, db.transactions.Expired(clock.Now().Add(time.Hour)))
+}
+
+func TestTxn_CommitTimestamp(t *testing.T) {
+	db, cleanup := newTestDB(t, DefaultOptions())
+	defer cleanup()
+
+	t.Run("write", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("a"), []byte("1")))
+		assert.Zero(t, txn.CommitTimestamp())
+		assert.NoError(t, txn.Commit())
+
+		timestamp := txn.CommitTimestamp()
+		assert.True(t, timestamp > txn.ReadTimestamp())
+
+		// A transaction that waits for the timestamp must see the write.
+		reader, err := db.NewTransaction(TxnOptions{ReadOnly: true, MinReadTimestamp: timestamp})
+		assert.NoError(t, err)
+		defer reader.Discard()
+		assert.True(t, reader.ReadTimestamp() >= timestamp)
+
+		item, err := reader.Get(Key("a"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("1"), item.Value)
+		assert.Equal(t, timestamp, item.Version)
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Commit())
+		assert.Equal(t, txn.ReadTimestamp(), txn.CommitTimestamp())
+	})
+
+	t.Run("timestamp not reached", func(t *testing.T) {
+		_, err := db.NewTransaction(TxnOptions{
+			MinReadTimestamp: db.readTimestamp() + 1000000000,
+			MinReadTimeout:   10 * time.Millisecond,
+		})
+		assert.Equal(t, ErrTimestampNotReached, err)
+		assert.Zero(t, atomic.LoadInt32(&db.timestampWaiters.count))
+	})
+}
+
+func TestTxn_DisableWAL(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	options := DefaultOptions()
+	options.WALDirectory = dir
+	options.DataDirectory = dir
+
+	db, err := Open(options)
+	assert.NoError(t, err)
+
+	commit := func(key string, txnOptions TxnOptions) {
+		txn, err := db.NewTransaction(txnOptions)
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key(key), []byte("value")))
+		assert.NoError(t, txn.Commit())
+	}
+
+	commit("durable", TxnOptions{})
+	appended := db.Metrics().WALTransactionsAppended
+	commit("derived", TxnOptions{DisableWAL: true})
+	assert.Equal(t, appended, db.Metrics().WALTransactionsAppended)
+
+	// The change is visible like any other commit.
+	txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+	assert.NoError(t, err)
+	_, err = txn.Get(Key("derived"))
+	assert.NoError(t, err)
+	txn.Discard()
+
+	txn, err = db.NewTransaction(TxnOptions{DisableWAL: true})
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Set(Key("prepared"), []byte("value")))
+	_, err = txn.Prepare()
+	assert.Equal(t, ErrWALDisabled, err)
+	txn.Discard()
+	assert.NoError(t, db.Close())
+
+	// Only the change that was written to the WAL survives a restart.
+	db, err = Open(options)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	txn, err = db.NewTransaction(TxnOptions{ReadOnly: true})
+	assert.NoError(t, err)
+	defer txn.Discard()
+	_, err = txn.Get(Key("durable"))
+	assert.NoError(t, err)
+	_, err = txn.Get(Key("derived"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestTxn_BatchLimits(t *testing.T) {
+	t.Run("count", func(t *testing.T) {
+		options := DefaultOptions()
+		options.MaxBatchCount = 2
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("a"), []byte("1")))
+		assert.NoError(t, txn.Set(Key("b"), []byte("2")))
+
+		// Changing a key that is already in the transaction does not count it again.
+		assert.NoError(t, txn.Set(Key("a"), []byte("3")))
+
+		err = txn.Delete(Key("c"))
+		assert.True(t, errors.Is(err, ErrTxnTooBig))
+
+		// The changes made before the limit was reached can still be committed, and the rest
+		// made in a new transaction.
+		assert.NoError(t, txn.Commit())
+		txn, err = db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("c"), []byte("4")))
+		assert.NoError(t, txn.Commit())
+
+		txn, err = db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+		for key, expected := range map[string]string{"a": "3", "b": "2", "c": "4"} {
+			item, err := txn.Get(Key(key))
+			assert.NoError(t, err)
+			assert.Equal(t, expected, string(item.Value))
+		}
+	})
+	t.Run("size", func(t *testing.T) {
+		options := DefaultOptions()
+		options.MaxBatchSize = 10
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		defer txn.Discard()
+		assert.NoError(t, txn.Set(Key("a"), []byte("1234")))
+		assert.NoError(t, txn.Set(Key("b"), []byte("1234")))
+
+		err = txn.Set(Key("c"), []byte("1"))
+		assert.True(t, errors.Is(err, ErrTxnTooBig))
+
+		// A change that is rejected is not made.
+		_, err = txn.Get(Key("c"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// Replacing a value only counts the difference in size.
+		assert.NoError(t, txn.Set(Key("a"), []byte("1")))
+		assert.NoError(t, txn.Set(Key("c"), []byte("1")))
+	})
+	t.Run("write batch", func(t *testing.T) {
+		options := DefaultOptions()
+		options.MaxBatchCount = 1
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		batch := db.NewWriteBatch()
+		assert.NoError(t, batch.Set(Key("a"), []byte("1")))
+		assert.True(t, errors.Is(batch.Set(Key("b"), []byte("2")), ErrTxnTooBig))
+	})
+	t.Run("invalid", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.MaxBatchCount = maxTransactionEntries + 1
+		db, err := Open(options)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+		assert.Nil(t, db)
+
+		options.MaxBatchCount = 0
+		options.MaxBatchSize = -1
+		db, err = Open(options)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+		assert.Nil(t, db)
+	})
+}
+
+func TestTxn_ReadOptions(t *testing.T) {
+	options := DefaultOptions()
+	options.RowCacheSize = 1024 * 1024
+	db, cleanup := newTestDB(t, options)
+	defer cleanup()
+
+	set := func(key, value string) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key(key), []byte(value)))
+		assert.NoError(t, txn.Commit())
+	}
+
+	set("a", "1")
+	set("b", "1")
+	snapshot, err := db.NewSnapshot()
+	assert.NoError(t, err)
+	set("a", "2")
+	set("c", "2")
+
+	t.Run("snapshot", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		defer txn.Discard()
+		assert.NoError(t, txn.Set(Key("d"), []byte("pending")))
+
+		item, err := txn.GetWithOptions(Key("a"), ReadOptions{Snapshot: snapshot})
+		assert.NoError(t, err)
+		assert.Equal(t, "1", string(item.Value))
+
+		_, err = txn.GetWithOptions(Key("c"), ReadOptions{Snapshot: snapshot})
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// The transaction's own changes are visible at any snapshot.
+		item, err = txn.GetWithOptions(Key("d"), ReadOptions{Snapshot: snapshot})
+		assert.NoError(t, err)
+		assert.Equal(t, "pending", string(item.Value))
+
+		// Without a snapshot the transaction reads at its own timestamp.
+		item, err = txn.Get(Key("a"))
+		assert.NoError(t, err)
+		assert.Equal(t, "2", string(item.Value))
+
+		itr, err := txn.NewIterator(IteratorOptions{
+			ReadOptions: ReadOptions{Snapshot: snapshot},
+		})
+		assert.NoError(t, err)
+		var keys []string
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			keys = append(keys, string(itr.Item().Key)+"="+string(itr.Item().Value))
+		}
+		itr.Close()
+		assert.Equal(t, []string{"a=1", "b=1", "d=pending"}, keys)
+	})
+
+	t.Run("multi get", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		items, err := txn.MultiGet([]Key{Key("a"), Key("missing"), Key("c")}, ReadOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, items, 3)
+		assert.Equal(t, "2", string(items[0].Value))
+		assert.Nil(t, items[1].Key)
+		assert.Equal(t, "2", string(items[2].Value))
+
+		items, err = txn.MultiGet([]Key{Key("a"), Key("c")}, ReadOptions{Snapshot: snapshot})
+		assert.NoError(t, err)
+		assert.Equal(t, "1", string(items[0].Value))
+		assert.Nil(t, items[1].Key)
+
+		_, err = txn.MultiGet([]Key{Key("a"), {}}, ReadOptions{})
+		assert.Equal(t, ErrEmptyKey, err)
+	})
+
+	t.Run("disable cache fill", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		before := db.rows.Stats().Entries
+		_, err = txn.GetWithOptions(Key("b"), ReadOptions{DisableCacheFill: true})
+		assert.NoError(t, err)
+		assert.Equal(t, before, db.rows.Stats().Entries)
+
+		_, err = txn.Get(Key("b"))
+		assert.NoError(t, err)
+		assert.Equal(t, before+1, db.rows.Stats().Entries)
+
+		// What is already cached is still used.
+		hits := db.rows.Stats().Hits
+		_, err = txn.GetWithOptions(Key("b"), ReadOptions{DisableCacheFill: true})
+		assert.NoError(t, err)
+		assert.Equal(t, hits+1, db.rows.Stats().Hits)
+	})
+
+	t.Run("released snapshot", func(t *testing.T) {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		snapshot.Release()
+		_, err = txn.GetWithOptions(Key("a"), ReadOptions{Snapshot: snapshot})
+		assert.Equal(t, ErrSnapshotReleased, err)
+		_, err = txn.NewIterator(IteratorOptions{ReadOptions: ReadOptions{Snapshot: snapshot}})
+		assert.Equal(t, ErrSnapshotReleased, err)
+	})
+}
@@ -0,0 +1,105 @@
+package lsmtree
+
+import (
+	"bytes"
+)
+
+const (
+	// maxUpdateAttempts is how many times Update runs its transaction before giving up with
+	// ErrTxnConflict.
+	maxUpdateAttempts = 100
+)
+
+// Update atomically replaces the value of the key with the value returned by fn, which is called
+// with the current value of the key. The current value is nil if the key does not exist, and if
+// fn returns a nil value then the key is deleted. If fn returns an error then nothing is changed
+// and the error is returned.
+//
+// Update runs a transaction that reads the key and writes the new value. If another transaction
+// writes the key in between then the commit fails with ErrTxnConflict and Update tries again
+// with the new value, so fn may be called more than once and should not have side effects. If the
+// key is still being changed after many attempts then ErrTxnConflict is returned.
+func (db *DB) Update(key Key, fn func(old []byte) ([]byte, error)) error {
+	var conflict uint64
+	for attempt := 0; ; attempt++ {
+		var err error
+		conflict, err = db.update(key, fn, conflict)
+		if err != ErrTxnConflict || attempt+1 >= maxUpdateAttempts {
+			return err
+		}
+	}
+}
+
+// update makes a single attempt at Update. The attempt reads at or after the timestamp of the
+// write that the last attempt conflicted with, otherwise it could read the same stale value again.
+// If the attempt conflicts then the timestamp of the write it conflicted with is returned.
+func (db *DB) update(
+	key Key, fn func(old []byte) ([]byte, error), conflict uint64,
+) (uint64, error) {
+	txn, err := db.NewTransaction(TxnOptions{
+		MinReadTimestamp: conflict,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Discard()
+
+	item, err := txn.Get(key)
+	if err != nil && err != ErrKeyNotFound {
+		return 0, err
+	}
+
+	value, err := fn(item.Value)
+	if err != nil {
+		return 0, err
+	}
+
+	if value == nil {
+		err = txn.Delete(key)
+	} else {
+		err = txn.Set(key, value)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err = txn.Commit(); err == ErrTxnConflict {
+		return txn.conflictTimestamp, err
+	}
+
+	return 0, err
+}
+
+// SetIfAbsent sets the key to the value only if the key does not exist, otherwise nothing is
+// changed and ErrKeyExists is returned. A key that has been deleted does not exist. This can be
+// used to register a name or take a lock that only one caller can get.
+func (db *DB) SetIfAbsent(key Key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	return db.Update(key, func(old []byte) ([]byte, error) {
+		if old != nil {
+			return nil, ErrKeyExists
+		}
+
+		return value, nil
+	})
+}
+
+// CompareAndSwap sets the key to the new value only if its current value is the expected value,
+// otherwise nothing is changed and a *MismatchError with the current value is returned. An
+// expected value of nil means the key must not exist, and a new value of nil deletes the key.
+func (db *DB) CompareAndSwap(key Key, expected, new []byte) error {
+	return db.Update(key, func(old []byte) ([]byte, error) {
+		// An empty value is not the same as a key that does not exist.
+		if (old == nil) != (expected == nil) || !bytes.Equal(old, expected) {
+			return nil, &MismatchError{
+				Key:     append(Key{}, key...),
+				Current: old,
+			}
+		}
+
+		return new, nil
+	})
+}
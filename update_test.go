@@ -0,0 +1,146 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDB_Update(t *testing.T) {
+	increment := func(old []byte) ([]byte, error) {
+		count := 0
+		if old != nil {
+			var err error
+			if count, err = strconv.Atoi(string(old)); err != nil {
+				return nil, err
+			}
+		}
+
+		return []byte(strconv.Itoa(count + 1)), nil
+	}
+
+	get := func(t *testing.T, db *DB, key string) (Item, error) {
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+
+		return txn.Get(Key(key))
+	}
+
+	t.Run("concurrent counter", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					assert.NoError(t, db.Update(Key("counter"), increment))
+				}
+			}()
+		}
+		wg.Wait()
+
+		item, err := get(t, db, "counter")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("80"), item.Value)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		failure := errors.New("failure")
+		err := db.Update(Key("a"), func(old []byte) ([]byte, error) {
+			return []byte("value"), failure
+		})
+		assert.Equal(t, failure, err)
+
+		_, err = get(t, db, "a")
+		assert.Equal(t, ErrKeyNotFound, err)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		assert.NoError(t, db.Update(Key("a"), increment))
+		assert.NoError(t, db.Update(Key("a"), func(old []byte) ([]byte, error) {
+			assert.Equal(t, []byte("1"), old)
+			return nil, nil
+		}))
+
+		_, err := get(t, db, "a")
+		assert.Equal(t, ErrKeyNotFound, err)
+	})
+}
+
+func TestDB_SetIfAbsent(t *testing.T) {
+	db, cleanup := newTestDB(t, DefaultOptions())
+	defer cleanup()
+
+	assert.NoError(t, db.SetIfAbsent(Key("lock"), []byte("first")))
+	assert.Equal(t, ErrKeyExists, db.SetIfAbsent(Key("lock"), []byte("second")))
+
+	// Only one of many concurrent callers gets the key.
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	winners := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := db.SetIfAbsent(Key("name"), []byte(strconv.Itoa(i)))
+			if err == ErrKeyExists {
+				return
+			}
+			assert.NoError(t, err)
+
+			lock.Lock()
+			defer lock.Unlock()
+			winners++
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, winners)
+
+	// A deleted key can be set again, and an empty value still counts as existing.
+	assert.NoError(t, db.CompareAndSwap(Key("lock"), []byte("first"), nil))
+	assert.NoError(t, db.SetIfAbsent(Key("lock"), nil))
+	assert.Equal(t, ErrKeyExists, db.SetIfAbsent(Key("lock"), []byte("again")))
+}
+
+func TestDB_CompareAndSwap(t *testing.T) {
+	db, cleanup := newTestDB(t, DefaultOptions())
+	defer cleanup()
+
+	// Swapping from nil creates the key.
+	assert.NoError(t, db.CompareAndSwap(Key("a"), nil, []byte("1")))
+	assert.NoError(t, db.CompareAndSwap(Key("a"), []byte("1"), []byte("2")))
+
+	err := db.CompareAndSwap(Key("a"), []byte("1"), []byte("3"))
+	assert.True(t, errors.Is(err, ErrValueMismatch))
+	var mismatch *MismatchError
+	if assert.True(t, errors.As(err, &mismatch)) {
+		assert.Equal(t, Key("a"), mismatch.Key)
+		assert.Equal(t, []byte("2"), mismatch.Current)
+	}
+
+	// The key exists, so it cannot be swapped as if it did not.
+	err = db.CompareAndSwap(Key("a"), nil, []byte("3"))
+	assert.True(t, errors.As(err, &mismatch))
+	assert.Equal(t, []byte("2"), mismatch.Current)
+
+	// An empty value is not the same as a missing key.
+	assert.NoError(t, db.CompareAndSwap(Key("b"), nil, []byte{}))
+	err = db.CompareAndSwap(Key("b"), nil, []byte("1"))
+	assert.True(t, errors.Is(err, ErrValueMismatch))
+	assert.NoError(t, db.CompareAndSwap(Key("b"), []byte{}, nil))
+	err = db.CompareAndSwap(Key("b"), []byte{}, []byte("1"))
+	assert.True(t, errors.As(err, &mismatch))
+	assert.Nil(t, mismatch.Current)
+}
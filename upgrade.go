@@ -0,0 +1,45 @@
+package lsmtree
+
+import (
+	"sync/atomic"
+)
+
+// A database keeps writing each on-disk format in the version it was created with, even after it
+// is opened by a newer version of the library, so that it can still be opened by the older one if
+// the newer version has to be rolled back. Changes that cannot be recorded in the older version
+// fail with ErrFormatUpgradeRequired instead of upgrading the format behind the caller's back.
+// Once the newer version is known to be good, OnDiskFormatUpgrade upgrades everything at once.
+
+type (
+	// FormatVersions are the versions of the on-disk formats that a database is written with.
+	FormatVersions struct {
+		// Manifest is the version of the manifest.
+		Manifest int
+	}
+)
+
+// FormatVersions returns the versions of the on-disk formats that the database is written with.
+func (db *DB) FormatVersions() FormatVersions {
+	return FormatVersions{
+		Manifest: db.manifest.Version(),
+	}
+}
+
+// OnDiskFormatUpgrade upgrades every on-disk format of the database to the newest version that
+// this version of the library writes. After the upgrade the database can no longer be opened by a
+// version of the library that does not know the new formats.
+//
+// Each format is upgraded by replacing it as a whole, the same way it is replaced by any other
+// change, so a crash leaves each format either upgraded or not. Formats that are already up to
+// date are skipped, so if the upgrade fails or is interrupted it can simply be called again.
+//
+// The WAL does not store a version of its own yet, and heap files only have one version of their
+// format block. Heap files whose properties were written by an older version are rewritten in the
+// newer version as they are compacted, they do not need to be upgraded here.
+func (db *DB) OnDiskFormatUpgrade() error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+
+	return db.manifest.Upgrade()
+}
@@ -0,0 +1,77 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDB_OnDiskFormatUpgrade(t *testing.T) {
+	openGolden := func(t *testing.T, version int) (*DB, func()) {
+		dir, cleanup := copyGoldenDirectory(t, goldenPath("manifest", version))
+
+		options := DefaultOptions()
+		options.DataDirectory = dir
+		options.WALDirectory = dir
+		db, err := Open(options)
+		if !assert.NoError(t, err) {
+			cleanup()
+			t.FailNow()
+		}
+
+		return db, func() {
+			_ = db.Close()
+			cleanup()
+		}
+	}
+
+	t.Run("new database", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		assert.Equal(t, FormatVersions{Manifest: manifestVersion}, db.FormatVersions())
+		assert.NoError(t, db.OnDiskFormatUpgrade())
+		assert.Equal(t, FormatVersions{Manifest: manifestVersion}, db.FormatVersions())
+	})
+
+	t.Run("old manifest", func(t *testing.T) {
+		db, cleanup := openGolden(t, 1)
+		defer cleanup()
+		assert.Equal(t, FormatVersions{Manifest: 1}, db.FormatVersions())
+
+		// A version 1 manifest cannot record the applied index, so nothing in the batch is
+		// committed until it has been upgraded.
+		batch := db.NewWriteBatch()
+		assert.NoError(t, batch.Set(Key("key"), []byte("value")))
+		err := db.ApplyBatch(1, batch)
+		assert.True(t, errors.Is(err, ErrFormatUpgradeRequired))
+		assert.Zero(t, db.AppliedIndex())
+
+		txn, err := db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		_, err = txn.Get(Key("key"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		txn.Discard()
+
+		// Nor can it record the level of a file.
+		err = db.manifest.MoveFiles([]uint64{1}, 1)
+		assert.True(t, errors.Is(err, ErrFormatUpgradeRequired))
+
+		assert.NoError(t, db.OnDiskFormatUpgrade())
+		assert.Equal(t, FormatVersions{Manifest: manifestVersion}, db.FormatVersions())
+		assert.NoError(t, db.ApplyBatch(1, batch))
+		assert.Equal(t, uint64(1), db.AppliedIndex())
+		assert.NoError(t, db.manifest.MoveFiles([]uint64{1}, 1))
+
+		// Upgrading again does nothing.
+		assert.NoError(t, db.OnDiskFormatUpgrade())
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		assert.NoError(t, db.Close())
+		assert.Equal(t, ErrClosed, db.OnDiskFormatUpgrade())
+	})
+}
@@ -0,0 +1,16 @@
+package lsmtree
+
+import (
+	"errors"
+)
+
+var (
+	// ErrIOUringNotSupported is returned by Open when Options.IOUring is enabled but io_uring
+	// cannot be used on the current platform or kernel.
+	ErrIOUringNotSupported = errors.New("io_uring is not supported")
+)
+
+const (
+	// uringEntries is the number of operations that can be in flight on the ring at once.
+	uringEntries = 64
+)
@@ -0,0 +1,448 @@
+//go:build linux
+// +build linux
+
+package lsmtree
+
+import (
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// These syscall numbers are the same on every architecture.
+	sysIOUringSetup = 425
+	sysIOUringEnter = 426
+
+	// These are the offsets used to mmap the different parts of the ring.
+	uringOffSqRing = 0
+	uringOffCqRing = 0x8000000
+	uringOffSqes   = 0x10000000
+
+	// uringEnterGetEvents tells io_uring_enter to wait for completions.
+	uringEnterGetEvents = 1
+
+	// These are the operations that we submit to the ring. IORING_OP_READ and IORING_OP_WRITE
+	// require linux 5.6 or newer.
+	uringOpNop   = 0
+	uringOpFsync = 3
+	uringOpRead  = 22
+	uringOpWrite = 23
+
+	// uringCloseUserData is used for the NOP that is submitted to stop the reaper.
+	uringCloseUserData = math.MaxUint64
+)
+
+var (
+	// Make sure that the uringFile can be used anywhere a file is used.
+	_ ReaderWriterAt = &uringFile{}
+	_ CanSync        = &uringFile{}
+)
+
+type (
+	// uringParams mirrors struct io_uring_params.
+	uringParams struct {
+		sqEntries    uint32
+		cqEntries    uint32
+		flags        uint32
+		sqThreadCpu  uint32
+		sqThreadIdle uint32
+		features     uint32
+		wqFd         uint32
+		resv         [3]uint32
+		sqOff        uringSqOffsets
+		cqOff        uringCqOffsets
+	}
+
+	// uringSqOffsets mirrors struct io_sqring_offsets.
+	uringSqOffsets struct {
+		head        uint32
+		tail        uint32
+		ringMask    uint32
+		ringEntries uint32
+		flags       uint32
+		dropped     uint32
+		array       uint32
+		resv1       uint32
+		resv2       uint64
+	}
+
+	// uringCqOffsets mirrors struct io_cqring_offsets.
+	uringCqOffsets struct {
+		head        uint32
+		tail        uint32
+		ringMask    uint32
+		ringEntries uint32
+		overflow    uint32
+		cqes        uint32
+		flags       uint32
+		resv1       uint32
+		resv2       uint64
+	}
+
+	// uringSqe mirrors struct io_uring_sqe. This is always 64 bytes.
+	uringSqe struct {
+		opcode   uint8
+		flags    uint8
+		ioprio   uint16
+		fd       int32
+		off      uint64
+		addr     uint64
+		len      uint32
+		opFlags  uint32
+		userData uint64
+		pad      [3]uint64
+	}
+
+	// uringCqe mirrors struct io_uring_cqe. This is always 16 bytes.
+	uringCqe struct {
+		userData uint64
+		res      int32
+		flags    uint32
+	}
+
+	// ioURing is a single io_uring instance that can be shared by many files. Operations are
+	// submitted by the callers and completions are collected by a background reaper. At most
+	// uringEntries operations can be in flight at once, any more will wait for a free slot.
+	ioURing struct {
+		fd int
+
+		sqRing []byte
+		cqRing []byte
+		sqeMap []byte
+
+		sqTail  *uint32
+		sqMask  uint32
+		sqArray []uint32
+		sqes    []uringSqe
+
+		cqHead *uint32
+		cqTail *uint32
+		cqMask uint32
+		cqes   []uringCqe
+
+		// submitLock must be held while adding an entry to the submission queue.
+		submitLock sync.Mutex
+
+		// slots hands out the index of an op that is not currently in flight. The index is used as
+		// the user data of the submission.
+		slots chan uint32
+
+		// ops are the operations that are in flight, indexed by their slot.
+		ops     []*uringOp
+		opsLock sync.Mutex
+
+		// closed is set while the submitLock is held once the ring is being closed.
+		closed bool
+
+		// reaperDone is closed once the reaper has exited.
+		reaperDone chan struct{}
+	}
+
+	// uringOp is a single operation that is waiting to be completed.
+	uringOp struct {
+		buf  []byte
+		res  int32
+		done chan struct{}
+	}
+
+	// uringFile performs all of its reads, writes and syncs through an ioURing.
+	uringFile struct {
+		ring *ioURing
+		file *os.File
+	}
+)
+
+// newIOURing will create a new io_uring instance with the number of entries provided. If the
+// kernel does not support io_uring then ErrIOUringNotSupported is returned.
+func newIOURing(entries uint32) (*ioURing, error) {
+	params := uringParams{}
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uintptr(entries),
+		uintptr(unsafe.Pointer(&params)), 0)
+	switch errno {
+	case 0:
+	case syscall.ENOSYS, syscall.EPERM:
+		return nil, ErrIOUringNotSupported
+	default:
+		return nil, errno
+	}
+
+	r := &ioURing{
+		fd:         int(fd),
+		slots:      make(chan uint32, params.sqEntries),
+		ops:        make([]*uringOp, params.sqEntries),
+		reaperDone: make(chan struct{}),
+	}
+
+	if err := r.mmap(&params); err != nil {
+		r.unmap()
+		_ = syscall.Close(r.fd)
+		return nil, err
+	}
+
+	for i := uint32(0); i < params.sqEntries; i++ {
+		r.slots <- i
+	}
+
+	goBackground("ioURingReaper", r.reap)
+
+	return r, nil
+}
+
+// mmap will map the submission and completion rings into memory.
+func (r *ioURing) mmap(params *uringParams) (err error) {
+	prot, flags := syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE
+
+	sqSize := int(params.sqOff.array + params.sqEntries*4)
+	if r.sqRing, err = syscall.Mmap(r.fd, uringOffSqRing, sqSize, prot, flags); err != nil {
+		return err
+	}
+
+	cqSize := int(params.cqOff.cqes) + int(params.cqEntries)*int(unsafe.Sizeof(uringCqe{}))
+	if r.cqRing, err = syscall.Mmap(r.fd, uringOffCqRing, cqSize, prot, flags); err != nil {
+		return err
+	}
+
+	sqeSize := int(params.sqEntries) * int(unsafe.Sizeof(uringSqe{}))
+	if r.sqeMap, err = syscall.Mmap(r.fd, uringOffSqes, sqeSize, prot, flags); err != nil {
+		return err
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.ringMask]))
+	r.sqArray = (*[1 << 20]uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.array]))[:params.sqEntries:params.sqEntries]
+	r.sqes = (*[1 << 20]uringSqe)(unsafe.Pointer(&r.sqeMap[0]))[:params.sqEntries:params.sqEntries]
+
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.ringMask]))
+	r.cqes = (*[1 << 20]uringCqe)(unsafe.Pointer(&r.cqRing[params.cqOff.cqes]))[:params.cqEntries:params.cqEntries]
+
+	return nil
+}
+
+// unmap will release any of the rings that have been mapped.
+func (r *ioURing) unmap() {
+	for _, mapped := range [][]byte{r.sqRing, r.cqRing, r.sqeMap} {
+		if mapped != nil {
+			_ = syscall.Munmap(mapped)
+		}
+	}
+}
+
+// Wrap returns a file that will perform all of its IO through the ring. Only *os.File can be
+// wrapped, any other file is returned unchanged.
+func (r *ioURing) Wrap(file ReaderWriterAt) ReaderWriterAt {
+	if osFile, ok := file.(*os.File); ok {
+		return &uringFile{
+			ring: r,
+			file: osFile,
+		}
+	}
+
+	return file
+}
+
+// Close will wait for all in flight operations to finish and then release the ring. Any
+// operations submitted after this will return ErrClosed.
+func (r *ioURing) Close() error {
+	r.submitLock.Lock()
+	closed := r.closed
+	r.submitLock.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	// Take every slot, this way we know that nothing is in flight and nothing else can start.
+	for i := 0; i < cap(r.slots); i++ {
+		<-r.slots
+	}
+
+	r.submitLock.Lock()
+	r.closed = true
+	err := r.submit(uringSqe{
+		opcode:   uringOpNop,
+		userData: uringCloseUserData,
+	})
+	r.submitLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	<-r.reaperDone
+	close(r.slots)
+	r.unmap()
+
+	return syscall.Close(r.fd)
+}
+
+// do will submit a single operation to the ring and wait for it to complete. The result is the
+// raw result from the kernel, negative results are returned as an error.
+func (r *ioURing) do(opcode uint8, file *os.File, buf []byte, offset int64) (int, error) {
+	slot, ok := <-r.slots
+	if !ok {
+		return 0, ErrClosed
+	}
+	defer func() {
+		r.slots <- slot
+	}()
+
+	op := &uringOp{
+		buf:  buf,
+		done: make(chan struct{}),
+	}
+
+	r.opsLock.Lock()
+	r.ops[slot] = op
+	r.opsLock.Unlock()
+
+	sqe := uringSqe{
+		opcode:   opcode,
+		fd:       int32(file.Fd()),
+		off:      uint64(offset),
+		len:      uint32(len(buf)),
+		userData: uint64(slot),
+	}
+	if len(buf) > 0 {
+		sqe.addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	}
+
+	r.submitLock.Lock()
+	if r.closed {
+		r.submitLock.Unlock()
+		return 0, ErrClosed
+	}
+	err := r.submit(sqe)
+	r.submitLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	<-op.done
+
+	// Make sure neither the buffer nor the file can be collected while the kernel is using them.
+	runtime.KeepAlive(buf)
+	runtime.KeepAlive(file)
+
+	if op.res < 0 {
+		return 0, syscall.Errno(-op.res)
+	}
+
+	return int(op.res), nil
+}
+
+// submit adds a single entry to the submission queue and tells the kernel about it. This must be
+// called while the submitLock is held.
+func (r *ioURing) submit(sqe uringSqe) error {
+	tail := atomic.LoadUint32(r.sqTail)
+	index := tail & r.sqMask
+	r.sqes[index] = sqe
+	r.sqArray[index] = index
+	atomic.StoreUint32(r.sqTail, tail+1)
+
+	for {
+		_, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(r.fd), 1, 0, 0, 0, 0)
+		switch errno {
+		case 0:
+			return nil
+		case syscall.EINTR:
+			continue
+		default:
+			return errno
+		}
+	}
+}
+
+// reap collects completions from the ring and hands the results back to the waiting operations.
+// It will exit once the NOP submitted by Close has completed.
+func (r *ioURing) reap() {
+	defer close(r.reaperDone)
+
+	for {
+		head, tail := atomic.LoadUint32(r.cqHead), atomic.LoadUint32(r.cqTail)
+		if head == tail {
+			// Nothing has completed yet, wait for at least one completion.
+			_, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(r.fd), 0, 1,
+				uringEnterGetEvents, 0, 0)
+			if errno != 0 && errno != syscall.EINTR {
+				// If we cannot wait for completions then there is nothing more the ring can do.
+				// Anything still in flight will never complete.
+				return
+			}
+
+			continue
+		}
+
+		stop := false
+		for ; head != tail; head++ {
+			cqe := r.cqes[head&r.cqMask]
+			if cqe.userData == uringCloseUserData {
+				stop = true
+				continue
+			}
+
+			r.opsLock.Lock()
+			op := r.ops[cqe.userData]
+			r.ops[cqe.userData] = nil
+			r.opsLock.Unlock()
+
+			op.res = cqe.res
+			close(op.done)
+		}
+		atomic.StoreUint32(r.cqHead, head)
+
+		if stop {
+			return
+		}
+	}
+}
+
+// ReadAt implements io.ReaderAt by reading through the ring.
+func (f *uringFile) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		n, err := f.ring.do(uringOpRead, f.file, p[read:], off+int64(read))
+		if err != nil {
+			return read, err
+		}
+
+		// A read of 0 bytes means we have reached the end of the file.
+		if n == 0 {
+			return read, io.EOF
+		}
+
+		read += n
+	}
+
+	return read, nil
+}
+
+// WriteAt implements io.WriterAt by writing through the ring.
+func (f *uringFile) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := f.ring.do(uringOpWrite, f.file, p[written:], off+int64(written))
+		if err != nil {
+			return written, err
+		}
+
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+
+		written += n
+	}
+
+	return written, nil
+}
+
+// Sync will flush the file to the disk through the ring.
+func (f *uringFile) Sync() error {
+	_, err := f.ring.do(uringOpFsync, f.file, nil, 0)
+	return err
+}
@@ -0,0 +1,126 @@
+//go:build linux
+// +build linux
+
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func newTestIOURing(t *testing.T) *ioURing {
+	ring, err := newIOURing(uringEntries)
+	if err == ErrIOUringNotSupported {
+		t.Skip("io_uring is not supported")
+	}
+	assert.NoError(t, err)
+	return ring
+}
+
+func TestIOURing(t *testing.T) {
+	t.Run("read write sync", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		ring := newTestIOURing(t)
+		defer ring.Close()
+
+		osFile, err := os.OpenFile(path.Join(dir, "test"), os.O_CREATE|os.O_RDWR, 0600)
+		assert.NoError(t, err)
+		defer osFile.Close()
+
+		file := ring.Wrap(osFile)
+		n, err := file.WriteAt([]byte("hello world"), 4)
+		assert.NoError(t, err)
+		assert.Equal(t, 11, n)
+		assert.NoError(t, file.(CanSync).Sync())
+
+		buf := make([]byte, 5)
+		n, err = file.ReadAt(buf, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, n)
+		assert.Equal(t, []byte("world"), buf)
+
+		// Reading past the end of the file should behave just like an os.File.
+		buf = make([]byte, 8)
+		n, err = file.ReadAt(buf, 10)
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, 5, n)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		ring := newTestIOURing(t)
+		defer ring.Close()
+
+		osFile, err := os.OpenFile(path.Join(dir, "test"), os.O_CREATE|os.O_RDWR, 0600)
+		assert.NoError(t, err)
+		defer osFile.Close()
+
+		file := ring.Wrap(osFile)
+
+		// Use more routines than there are entries in the ring so that some have to wait.
+		numberOfRoutines := uringEntries * 2
+		wg := sync.WaitGroup{}
+		wg.Add(numberOfRoutines)
+		for i := 0; i < numberOfRoutines; i++ {
+			go func(i int) {
+				defer wg.Done()
+				value := []byte(fmt.Sprintf("%08d", i))
+				_, err := file.WriteAt(value, int64(i*8))
+				assert.NoError(t, err)
+
+				buf := make([]byte, 8)
+				_, err = file.ReadAt(buf, int64(i*8))
+				assert.NoError(t, err)
+				assert.Equal(t, value, buf)
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		ring := newTestIOURing(t)
+		assert.NoError(t, ring.Close())
+		assert.Equal(t, ErrClosed, ring.Close())
+
+		osFile, err := os.OpenFile(path.Join(dir, "test"), os.O_CREATE|os.O_RDWR, 0600)
+		assert.NoError(t, err)
+		defer osFile.Close()
+
+		_, err = ring.Wrap(osFile).WriteAt([]byte("test"), 0)
+		assert.Equal(t, ErrClosed, err)
+	})
+
+	t.Run("value files", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		ring := newTestIOURing(t)
+		defer ring.Close()
+
+		values, err := newValueManager([]string{dir}, defaultFileMode)
+		assert.NoError(t, err)
+		values.ring = ring
+
+		file, err := values.getFile(1)
+		assert.NoError(t, err)
+
+		pointer, err := file.Append([]byte("value one"))
+		assert.NoError(t, err)
+
+		value, err := values.ReadPointer(pointer, true)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value one"), value)
+	})
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package lsmtree
+
+// ioURing is only available on linux, everywhere else it cannot be created.
+type ioURing struct{}
+
+// newIOURing always fails on platforms other than linux.
+func newIOURing(entries uint32) (*ioURing, error) {
+	return nil, ErrIOUringNotSupported
+}
+
+// Wrap returns the file provided unchanged.
+func (r *ioURing) Wrap(file ReaderWriterAt) ReaderWriterAt {
+	return file
+}
+
+// Close does nothing.
+func (r *ioURing) Close() error {
+	return nil
+}
@@ -3,7 +3,9 @@ package lsmtree
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/fnv"
+	"io"
 	"os"
 	"path"
 	"sync"
@@ -23,13 +25,79 @@ var (
 	// ErrCreatingChecksum is returned when a value is being written to the value file but the
 	// checksum could not be created.
 	ErrCreatingChecksum = errors.New("could not create checksum for value")
+
+	// errValuePointerMismatch is returned when a value is read using a valuePointer, but the value
+	// stored in the file is not the value that the pointer was created for. The value in the file
+	// is intact (its own checksum matches) but it is not the value that was expected. Keys do not
+	// store value pointers yet, so this and errBadValuePointer cannot be returned by any public
+	// method and stay unexported until they can.
+	errValuePointerMismatch = errors.New("value does not match pointer checksum")
+
+	// errBadValuePointer is returned when a valuePointer cannot be decoded.
+	errBadValuePointer = errors.New("bad value pointer")
+
+	// ErrBadValueLog is returned when a value file does not start with the value log header.
+	ErrBadValueLog = errors.New("bad value log")
+
+	// ErrUnknownValueLogVersion is returned when a value file was written in a newer format than
+	// this version of the database can read.
+	ErrUnknownValueLogVersion = errors.New("unknown value log version")
+)
+
+const (
+	// valuePointerSize is the number of bytes an encoded valuePointer uses.
+	valuePointerSize = 8 + 8 + 4 + 4
+
+	// valueLogMagic is written at the start of every value file so that other files are not read
+	// as one by accident.
+	valueLogMagic = "lsmtvlog"
+
+	// valueLogVersion is the version of the value file format that is written.
+	valueLogVersion = 1
+
+	// valueLogHeaderSize is the size of the header at the start of every value file, the magic
+	// followed by a 16-bit version.
+	valueLogHeaderSize = len(valueLogMagic) + 2
+
+	// valueEntryHeaderSize is the size of the header in front of every entry in a value file.
+	valueEntryHeaderSize = 4 + 4 + 1 + 4
 )
 
+// Value files are append only logs. Every file starts with a header that identifies it, and is
+// followed by one entry for every value that was written to it:
+//
+//	File header:  valueLogMagic | 2 byte version
+//	Entry:        4 byte key length | 4 byte value length | 1 byte user meta | 4 byte checksum
+//	              | key | value | 4 byte value checksum
+//
+// All of the integers are big endian and both checksums are FNV-1 32. The checksum in the entry
+// header covers the rest of the header and the key, the value checksum covers only the value. A
+// valuePointer points at the value itself rather than the start of its entry, so that a value can
+// be read and checked without reading the key in front of it.
+//
+// Normally values are found through the pointers stored with their keys, but if those are lost
+// the entries can be read back one after another from the start of the file with Scan, which
+// rebuilds the key and pointer of every value in the file. Values are written to offsets that are
+// allocated up front, so a crash while values were being written can leave a torn entry or a hole
+// of zeros that has no valid header. Scan stops at the first entry that is not intact, everything
+// before it can be trusted.
+//
+// Version 1 is the first version of the format. Files that were written in a newer version are
+// rejected with ErrUnknownValueLogVersion rather than being misread.
+
 type (
 	// valueManager wraps all of the value files and manages reads and writes of actual values.
 	valueManager struct {
-		// directory is the folder where all valueFiles will be stored.
-		directory string
+		// lastFileId is the largest fileId that has been allocated, including the value files that
+		// existed in the directory before the manager was created. It is only modified
+		// atomically, and is the first field so that it is 64-bit aligned on 32-bit platforms.
+		lastFileId uint64
+
+		// directories are the folders that valueFiles are spread across.
+		directories *valueDirectories
+
+		// fileMode is the permissions that new value files are created with.
+		fileMode os.FileMode
 
 		// writeLocks are acquired while a readLock is still held. The read lock is then released.
 		// This ensures that two threads cannot try to write to the files map at the same time.
@@ -41,6 +109,13 @@ type (
 
 		// files is just a map of all of the valueFiles in memory by their fileId.
 		files map[uint64]*valueFile
+
+		// coalesceReads will wrap every value file that is opened so that concurrent reads of
+		// nearby values are merged into fewer reads. (see Options.coalesceReads)
+		coalesceReads bool
+
+		// ring is used to perform all IO on the value files if it is not nil.
+		ring *ioURing
 	}
 
 	// valueFile represents an append only file that is used to store actual values for the
@@ -63,26 +138,174 @@ type (
 		// fast concurrent writes. Right now this is an os.File but this could be replaced if it
 		// ever needed to be.
 		File ReaderWriterAt
+
+		// closer is the file that was opened, File can be wrapped once the file has been opened
+		// so the file is kept here to be closed.
+		closer io.Closer
+	}
+
+	// valuePointer is what is stored with a key in place of the actual value. It indicates which
+	// value file the value is stored in and where within that file. It also keeps the checksum of
+	// the value when it was written, this way if the pointer ends up referencing a different value
+	// (that is not itself corrupt) it can still be detected when the value is read.
+	valuePointer struct {
+		// FileId is the value file the value is stored in.
+		FileId uint64
+
+		// Offset is where the value starts within the value file.
+		Offset uint64
+
+		// Size is the length of the value, not including the checksum suffix.
+		Size uint32
+
+		// Checksum is the 32-bit checksum of the value at the time that it was written.
+		Checksum uint32
+	}
+
+	// valueLogEntry is a single entry read back from a value file by Scan.
+	valueLogEntry struct {
+		// Key is the key that the value was written for.
+		Key Key
+
+		// UserMeta is the metadata byte that was written alongside the value.
+		UserMeta byte
+
+		// Pointer references the value of the entry.
+		Pointer valuePointer
 	}
 )
 
+// newValueManager will create the value manager for the directories provided, value files are
+// spread across all of them. If a directory does not exist then it will be created.
+func newValueManager(directories []string, fileMode os.FileMode) (*valueManager, error) {
+	// Find any value files that were left behind by a previous instance of the database so that
+	// new files will not reuse their Ids.
+	var lastFileId uint64
+	for _, directory := range directories {
+		if err := newDirectory(directory, getDirectoryMode(fileMode)); err != nil {
+			return nil, err
+		}
+
+		last, err := getLastFileId(directory, fileTypeValue)
+		if err != nil {
+			return nil, err
+		}
+
+		if last > lastFileId {
+			lastFileId = last
+		}
+	}
+
+	return &valueManager{
+		directories: newValueDirectories(directories),
+		fileMode:    fileMode,
+		files:       map[uint64]*valueFile{},
+		lastFileId:  lastFileId,
+	}, nil
+}
+
+// nextFileId will allocate a new fileId that is not used by any existing value file. Ids are
+// allocated in ascending order and are never reused.
+func (m *valueManager) nextFileId() uint64 {
+	return atomic.AddUint64(&m.lastFileId, 1)
+}
+
+// getFile will return the value file with the fileId specified. If the file is not already open
+// then it will be opened (or created if it does not exist).
+func (m *valueManager) getFile(fileId uint64) (*valueFile, error) {
+	m.readLock.RLock()
+	file, ok := m.files[fileId]
+	m.readLock.RUnlock()
+	if ok {
+		return file, nil
+	}
+
+	// Only one thread can open files at a time. Once we have the write lock we need to check the
+	// map again in case another thread opened the file while we were waiting.
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	m.readLock.RLock()
+	file, ok = m.files[fileId]
+	m.readLock.RUnlock()
+	if ok {
+		return file, nil
+	}
+
+	file, err := openValueFile(m.directories.Find(fileId), fileId, m.fileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.ring != nil {
+		file.File = m.ring.Wrap(file.File)
+	}
+
+	if m.coalesceReads {
+		file.File = newCoalescingFile(file.File)
+	}
+
+	m.readLock.Lock()
+	m.files[fileId] = file
+	m.readLock.Unlock()
+
+	return file, nil
+}
+
+// Close closes every value file that has been opened. Nothing can be read or written after this.
+func (m *valueManager) Close() error {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	m.readLock.Lock()
+	defer m.readLock.Unlock()
+
+	var err error
+	for fileId, file := range m.files {
+		if closeErr := file.closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(m.files, fileId)
+	}
+
+	return err
+}
+
+// ReadPointer will return the value that the pointer references from whichever value file it is
+// stored in. See valueFile.ReadPointer.
+func (m *valueManager) ReadPointer(pointer valuePointer, verify bool) ([]byte, error) {
+	file, err := m.getFile(pointer.FileId)
+	if err != nil {
+		return nil, err
+	}
+
+	return file.ReadPointer(pointer, verify)
+}
+
+// Scan reads every entry in the value file with the fileId specified. See valueFile.Scan.
+func (m *valueManager) Scan(fileId uint64, fn func(entry valueLogEntry) error) (uint64, error) {
+	file, err := m.getFile(fileId)
+	if err != nil {
+		return 0, err
+	}
+
+	return file.Scan(fn)
+}
+
 // openValueFile will open a value file with the Id specified. If the file does not exist it will
-// create the file. The file is opened with the append, create and read/write flags, and the append
-// and exclusive mode.
-func openValueFile(directory string, fileId uint64) (*valueFile, error) {
+// create the file with the permissions provided. The file is opened with the create and read/write
+// flags.
+func openValueFile(directory string, fileId uint64, mode os.FileMode) (*valueFile, error) {
 	// Get an actual file path for the directory and the fileId specified.
 	filePath := path.Join(directory, getValueFileName(fileId))
 
 	// We want to be able to read/write the file. If the file does not exist we want to create it.
+	// The file cannot be opened with O_APPEND because values are written to specific offsets, and
+	// exclusive access to the file is guaranteed by the lock on the directory.
 	flags := os.O_CREATE | os.O_RDWR
 
-	// We are only appending to the file, and we want to be the only process with the file open.
-	// This might change later as it might prove to be more efficient to have a single writer and
-	// multiple readers for a single file.
-	mode := os.ModeAppend | os.ModeExclusive
-
 	// Open/create the file with the flags and mode specified.
-	file, err := os.OpenFile(filePath, flags, mode)
+	file, err := os.OpenFile(filePath, flags, mode&os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
@@ -98,31 +321,110 @@ func openValueFile(directory string, fileId uint64) (*valueFile, error) {
 		FileId: fileId,
 		Offset: uint64(stat.Size()),
 		File:   file,
+		closer: file,
+	}
+
+	// A new file gets the header before any values are written to it, an existing one must
+	// already have a header that this version can read.
+	if f.Offset == 0 {
+		err = f.writeHeader()
+	} else {
+		err = f.readHeader()
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
 	}
 
 	return f, nil
 }
 
+// writeHeader writes the value log header to the start of a new value file.
+func (f *valueFile) writeHeader() error {
+	header := make([]byte, valueLogHeaderSize)
+	copy(header, valueLogMagic)
+	binary.BigEndian.PutUint16(header[len(valueLogMagic):], valueLogVersion)
+	if _, err := f.File.WriteAt(header, 0); err != nil {
+		return err
+	}
+	f.Offset = uint64(valueLogHeaderSize)
+
+	return nil
+}
+
+// readHeader checks the value log header at the start of an existing value file.
+func (f *valueFile) readHeader() error {
+	header := make([]byte, valueLogHeaderSize)
+	if n, err := f.File.ReadAt(header, 0); err != nil && err != io.EOF {
+		return err
+	} else if n < valueLogHeaderSize || string(header[:len(valueLogMagic)]) != valueLogMagic {
+		return f.corrupted(0, ErrBadValueLog)
+	}
+
+	if version := binary.BigEndian.Uint16(header[len(valueLogMagic):]); version != valueLogVersion {
+		return fmt.Errorf("%w: %s is version %d",
+			ErrUnknownValueLogVersion, getValueFileName(f.FileId), version)
+	}
+
+	return nil
+}
+
 // Read will return the byte array for a value at the address provided. Values are suffixed with a
 // 32-bit checksum when they are written. If the checksum does not match when the value is read then
 // an ErrBadValueChecksum will be returned here. This is to prevent unintentionally using a value
-// that is corrupt. If the entire value cannot be read then an ErrIncompleteValue is returned.
+// that is corrupt. If the entire value cannot be read then an ErrIncompleteValue is returned. Both
+// of these errors are wrapped in a CorruptionError and will match ErrCorrupted.
 // To recover the value for either of these failures, the WAL entry for this item should be found
 // and replayed.
 func (f *valueFile) Read(offset, size uint64) ([]byte, error) {
+	value, _, err := f.read(offset, size)
+	return value, err
+}
+
+// ReadPointer will return the value that the pointer references. The value will be validated
+// against the checksum stored in the file just like Read. If verify is true then the checksum in
+// the pointer will also be compared to the value read, if they do not match then a CorruptionError
+// wrapping errValuePointerMismatch is returned.
+func (f *valueFile) ReadPointer(pointer valuePointer, verify bool) ([]byte, error) {
+	if pointer.FileId != f.FileId {
+		return nil, errBadValuePointer
+	}
+
+	value, checksum, err := f.read(pointer.Offset, uint64(pointer.Size))
+	if err != nil {
+		return nil, err
+	}
+
+	if verify && checksum != pointer.Checksum {
+		return nil, f.corrupted(pointer.Offset, errValuePointerMismatch)
+	}
+
+	return value, nil
+}
+
+// read will return the value at the offset provided as well as the checksum that was stored with
+// it.
+func (f *valueFile) read(offset, size uint64) ([]byte, uint32, error) {
 	// We need an extra 4 bytes for the checksum
 	value := make([]byte, size+4)
 
 	// Read the value into the buffer at the specified offset.
 	// If there is a problem just return early.
-	if n, err := f.File.ReadAt(value, int64(offset)); err != nil {
-		return nil, err
+	if n, err := f.File.ReadAt(value, int64(offset)); err == io.EOF {
+		// If we reached the end of the file before the entire value could be read then the value
+		// is incomplete.
+		return nil, 0, f.corrupted(offset, ErrIncompleteValue)
+	} else if err != nil {
+		return nil, 0, err
 	} else if n != len(value) {
 		// If we didn't get an error but the number of bytes read does not match the number of bytes
 		// that we were looking for then we need to return an error.
-		return nil, ErrIncompleteValue
+		return nil, 0, f.corrupted(offset, ErrIncompleteValue)
 	}
 
+	// readChecksum is the hash of the value that was stored in the file.
+	readChecksum := binary.BigEndian.Uint32(value[size:])
+
 	// Validate the checksum.
 	{
 		h := fnv.New32()
@@ -130,36 +432,70 @@ func (f *valueFile) Read(offset, size uint64) ([]byte, error) {
 		// If we fail to write the checksum from the value or if the entire value could not be
 		// written to the hash then we want to fail here and assume the checksum is bad.
 		if n, err := h.Write(value[:size]); err != nil || uint64(n) != size {
-			return nil, ErrBadValueChecksum
+			return nil, 0, f.corrupted(offset, ErrBadValueChecksum)
 		}
 
 		// actualChecksum is the hash of the value we read from the file.
 		actualChecksum := h.Sum32()
 
-		// readChecksum is the hash of the value that was stored in the file.
-		readChecksum := binary.BigEndian.Uint32(value[size:])
-
 		// If the checksums to not match then that means the checksum in the file is wrong, or the
 		// value stored in the file is wrong. Either way the value is very likely corrupted and to
 		// make sure a bad value is not read we should return an error.
 		if actualChecksum != readChecksum {
-			return nil, ErrBadValueChecksum
+			return nil, 0, f.corrupted(offset, ErrBadValueChecksum)
 		}
 	}
 
-	return value[:size], nil
+	return value[:size], readChecksum, nil
+}
+
+// corrupted wraps the error provided in a CorruptionError for this value file at the offset
+// specified.
+func (f *valueFile) corrupted(offset uint64, err error) error {
+	return newCorruptionError(getValueFileName(f.FileId), int64(offset), err)
 }
 
 // Write will take a value and write it to the value file. It will suffix the value with a 32-bit
-// checksum that will be used to guarantee the value is not corrupt. The file is not synchronized
-// here and must be called manually.
+// checksum that will be used to guarantee the value is not corrupt. The entry is written without a
+// key, use AppendEntry for values that need to be found by Scan. The file is not synchronized here
+// and must be called manually.
 func (f *valueFile) Write(value []byte) (uint64, error) {
-	// We add 4 bytes to the total length of the value in order to properly add the checksum suffix.
-	size := uint64(len(value) + 4)
+	offset, _, err := f.write(nil, value, 0)
+	return offset, err
+}
+
+// Append will write the value to the value file just like Write, but will return a valuePointer
+// that can be used to read the value back with ReadPointer.
+func (f *valueFile) Append(value []byte) (valuePointer, error) {
+	return f.AppendEntry(nil, value, 0)
+}
 
-	// Increment the offset atomically for this new value, but then subtract this values total size
-	// so that we know the actual offset that we need to write it to and the offset we want to
-	// return at the end.
+// AppendEntry will write the value to the value file along with the key and metadata it belongs
+// to, so that Scan can rebuild the pointer to it if the key's own copy of the pointer is lost. It
+// returns a valuePointer that can be used to read the value back with ReadPointer.
+func (f *valueFile) AppendEntry(key Key, value []byte, userMeta byte) (valuePointer, error) {
+	offset, checksum, err := f.write(key, value, userMeta)
+	if err != nil {
+		return valuePointer{}, err
+	}
+
+	return valuePointer{
+		FileId:   f.FileId,
+		Offset:   offset,
+		Size:     uint32(len(value)),
+		Checksum: checksum,
+	}, nil
+}
+
+// write will write an entry for the value and its checksum to the file. It returns the offset the
+// value was written to as well as the checksum of the value.
+func (f *valueFile) write(key Key, value []byte, userMeta byte) (uint64, uint32, error) {
+	// The entry is the header and the key, followed by the value with its 4 byte checksum suffix.
+	valueStart := uint64(valueEntryHeaderSize + len(key))
+	size := valueStart + uint64(len(value)+4)
+
+	// Increment the offset atomically for this new entry, but then subtract this entry's total size
+	// so that we know the actual offset that we need to write it to.
 	// This should (in theory) allow for concurrent writes to the same file as the only thing that
 	// needs to be contested here is the offset value. I believe that the write function for files
 	// is thread-safe.
@@ -171,26 +507,138 @@ func (f *valueFile) Write(value []byte) (uint64, error) {
 	// if there is no error and n != the length that should have been written then return an error
 	// indicating that a Checksum could not be created.
 	if n, err := h.Write(value); err != nil {
-		return 0, err
+		return 0, 0, err
 	} else if n != len(value) {
-		return 0, ErrCreatingChecksum
+		return 0, 0, ErrCreatingChecksum
 	}
 
-	checksum := h.Sum(nil)
+	checksum := h.Sum32()
+
+	v := make([]byte, size)
+	binary.BigEndian.PutUint32(v[0:4], uint32(len(key)))
+	binary.BigEndian.PutUint32(v[4:8], uint32(len(value)))
+	v[8] = userMeta
+	binary.BigEndian.PutUint32(v[9:13], entryHeaderChecksum(v[:9], key))
+	copy(v[valueEntryHeaderSize:], key)
+	copy(v[valueStart:], value)
+	binary.BigEndian.PutUint32(v[size-4:], checksum)
 
-	v := append(value, checksum...)
-	// Write the value and checksum to the file at the calculated offset.
+	// Write the entry to the file at the calculated offset.
 	if n, err := f.File.WriteAt(v, int64(offset)); err != nil {
-		return 0, err
+		return 0, 0, err
 	} else if uint64(n) != size {
-		return 0, ErrIncompleteValue
+		return 0, 0, ErrIncompleteValue
 	}
 
-	// If everything has succeeded and the value has been written, then return the offset of the
+	// If everything has succeeded and the entry has been written, then return the offset of the
 	// stored value.
+	return offset + valueStart, checksum, nil
+}
+
+// Scan reads every entry in the value file from the start of the file and calls fn with each one.
+// If fn returns an error then the scan stops and that error is returned. Scan returns the offset
+// that it stopped at, which is the end of the file once every entry has been read.
+//
+// If an entry is not intact then the scan stops at the start of it and returns a CorruptionError,
+// every entry before it is intact. A torn entry at the end of the file, left by a crash while it
+// was being written, wraps ErrIncompleteValue, and the file can be truncated to the offset
+// returned to drop it.
+func (f *valueFile) Scan(fn func(entry valueLogEntry) error) (uint64, error) {
+	end := atomic.LoadUint64(&f.Offset)
+	offset := uint64(valueLogHeaderSize)
+	header := make([]byte, valueEntryHeaderSize)
+	for offset < end {
+		if offset+valueEntryHeaderSize > end {
+			return offset, f.corrupted(offset, ErrIncompleteValue)
+		}
+
+		if _, err := f.File.ReadAt(header, int64(offset)); err == io.EOF {
+			return offset, f.corrupted(offset, ErrIncompleteValue)
+		} else if err != nil {
+			return offset, err
+		}
+
+		keySize := uint64(binary.BigEndian.Uint32(header[0:4]))
+		valueSize := uint64(binary.BigEndian.Uint32(header[4:8]))
+		valueStart := offset + valueEntryHeaderSize + keySize
+		if valueStart+valueSize+4 > end {
+			return offset, f.corrupted(offset, ErrIncompleteValue)
+		}
+
+		key := make(Key, keySize)
+		if _, err := f.File.ReadAt(key, int64(offset+valueEntryHeaderSize)); err == io.EOF {
+			return offset, f.corrupted(offset, ErrIncompleteValue)
+		} else if err != nil {
+			return offset, err
+		}
+
+		// A hole of zeros or a torn header will not match its checksum, and its lengths cannot be
+		// trusted to find the next entry either.
+		if entryHeaderChecksum(header[:9], key) != binary.BigEndian.Uint32(header[9:13]) {
+			return offset, f.corrupted(offset, ErrBadValueChecksum)
+		}
+
+		_, checksum, err := f.read(valueStart, valueSize)
+		if err != nil {
+			return offset, err
+		}
+
+		if err = fn(valueLogEntry{
+			Key:      key,
+			UserMeta: header[8],
+			Pointer: valuePointer{
+				FileId:   f.FileId,
+				Offset:   valueStart,
+				Size:     uint32(valueSize),
+				Checksum: checksum,
+			},
+		}); err != nil {
+			return offset, err
+		}
+
+		offset = valueStart + valueSize + 4
+	}
+
 	return offset, nil
 }
 
+// entryHeaderChecksum returns the checksum of an entry header's lengths and metadata along with
+// the entry's key.
+func entryHeaderChecksum(header []byte, key Key) uint32 {
+	h := fnv.New32()
+	_, _ = h.Write(header)
+	_, _ = h.Write(key)
+	return h.Sum32()
+}
+
+// Encode returns the binary representation of the valuePointer.
+// 1. 8 Bytes: File ID
+// 2. 8 Bytes: Offset
+// 3. 4 Bytes: Size
+// 4. 4 Bytes: Checksum
+func (p valuePointer) Encode() []byte {
+	b := make([]byte, valuePointerSize)
+	binary.BigEndian.PutUint64(b[0:8], p.FileId)
+	binary.BigEndian.PutUint64(b[8:16], p.Offset)
+	binary.BigEndian.PutUint32(b[16:20], p.Size)
+	binary.BigEndian.PutUint32(b[20:24], p.Checksum)
+	return b
+}
+
+// Decode will read the binary representation of a valuePointer. If the source is not exactly the
+// size of an encoded valuePointer then errBadValuePointer is returned.
+func (p *valuePointer) Decode(src []byte) error {
+	if len(src) != valuePointerSize {
+		return errBadValuePointer
+	}
+
+	p.FileId = binary.BigEndian.Uint64(src[0:8])
+	p.Offset = binary.BigEndian.Uint64(src[8:16])
+	p.Size = binary.BigEndian.Uint32(src[16:20])
+	p.Checksum = binary.BigEndian.Uint32(src[20:24])
+	return nil
+}
+
 // Sync will flush the changes made to the value file to the disk if the file interface implements
 // the CanSync interface. If it does not then nothing happens and nil is returned.
 func (f *valueFile) Sync() error {
@@ -2,15 +2,20 @@ package lsmtree
 
 import (
 	"encoding/binary"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path"
+	"runtime"
 	"sync"
 	"testing"
 )
 
 func TestOpenValueFile(t *testing.T) {
 	t.Run("directory doesnt exist", func(t *testing.T) {
-		file, err := openValueFile("tmp", 1)
+		file, err := openValueFile("tmp", 1, defaultFileMode)
 		assert.Error(t, err)
 		assert.Nil(t, file)
 	})
@@ -19,10 +24,79 @@ func TestOpenValueFile(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openValueFile(dir, 1)
+		file, err := openValueFile(dir, 1, defaultFileMode)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 	})
+
+	t.Run("permissions", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("windows does not support unix permissions")
+		}
+
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, 0600)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		info, err := os.Stat(path.Join(dir, getValueFileName(1)))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode())
+	})
+
+	t.Run("not a value file", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		filePath := path.Join(dir, getValueFileName(1))
+		assert.NoError(t, ioutil.WriteFile(filePath, []byte("not a value file"), 0644))
+
+		file, err := openValueFile(dir, 1, defaultFileMode)
+		assert.Nil(t, file)
+		assert.True(t, errors.Is(err, ErrCorrupted))
+		assert.True(t, errors.Is(err, ErrBadValueLog))
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		header := append([]byte(valueLogMagic), 0, valueLogVersion+1)
+		filePath := path.Join(dir, getValueFileName(1))
+		assert.NoError(t, ioutil.WriteFile(filePath, header, 0644))
+
+		file, err := openValueFile(dir, 1, defaultFileMode)
+		assert.Nil(t, file)
+		assert.True(t, errors.Is(err, ErrUnknownValueLogVersion))
+	})
+}
+
+func TestValueManager_NextFileId(t *testing.T) {
+	t.Run("empty directory", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newValueManager([]string{dir}, defaultFileMode)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), manager.nextFileId())
+		assert.Equal(t, uint64(2), manager.nextFileId())
+	})
+
+	t.Run("existing files", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		for _, fileId := range []uint64{3, 1} {
+			_, err := openValueFile(dir, fileId, defaultFileMode)
+			assert.NoError(t, err)
+		}
+
+		manager, err := newValueManager([]string{dir}, defaultFileMode)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(4), manager.nextFileId())
+	})
 }
 
 func TestValueFile_Write(t *testing.T) {
@@ -30,7 +104,7 @@ func TestValueFile_Write(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openValueFile(dir, 1)
+		file, err := openValueFile(dir, 1, defaultFileMode)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 
@@ -38,13 +112,14 @@ func TestValueFile_Write(t *testing.T) {
 
 		offset1, err := file.Write(originalValue1)
 		assert.NoError(t, err)
-		assert.Equal(t, uint64(0), offset1)
+		// Values are written after the file header and their own entry header.
+		assert.Equal(t, uint64(valueLogHeaderSize+valueEntryHeaderSize), offset1)
 
 		offset2, err := file.Write(originalValue2)
 		assert.NoError(t, err)
 		// Make sure the offset of the second value is the length of the first value appended plus the
-		// size of the checksum for the first value.
-		assert.Equal(t, uint64(len(originalValue1)+4), offset2)
+		// size of the checksum for the first value and the entry header of the second.
+		assert.Equal(t, offset1+uint64(len(originalValue1)+4+valueEntryHeaderSize), offset2)
 	})
 
 	t.Run("asynchronous", func(t *testing.T) {
@@ -79,14 +154,15 @@ func TestValueFile_Write(t *testing.T) {
 			wg.Wait()
 
 			// Make sure the new offset matches the expected.
-			assert.Equal(t, uint64(numberOfValues*(8+4)), file.Offset)
+			assert.Equal(t, uint64(valueLogHeaderSize+numberOfValues*(valueEntryHeaderSize+8+4)),
+				file.Offset)
 		}
 
 		t.Run("os.File", func(t *testing.T) {
 			dir, cleanup := NewTempDirectory(t)
 			defer cleanup()
 
-			file, err := openValueFile(dir, 1)
+			file, err := openValueFile(dir, 1, defaultFileMode)
 			assert.NoError(t, err)
 			assert.NotNil(t, file)
 
@@ -100,7 +176,7 @@ func TestValueFile_Read(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openValueFile(dir, 1)
+		file, err := openValueFile(dir, 1, defaultFileMode)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 
@@ -108,13 +184,14 @@ func TestValueFile_Read(t *testing.T) {
 
 		offset1, err := file.Write(originalValue1)
 		assert.NoError(t, err)
-		assert.Equal(t, uint64(0), offset1)
+		// Values are written after the file header and their own entry header.
+		assert.Equal(t, uint64(valueLogHeaderSize+valueEntryHeaderSize), offset1)
 
 		offset2, err := file.Write(originalValue2)
 		assert.NoError(t, err)
 		// Make sure the offset of the second value is the length of the first value appended plus the
-		// size of the checksum for the first value.
-		assert.Equal(t, uint64(len(originalValue1)+4), offset2)
+		// size of the checksum for the first value and the entry header of the second.
+		assert.Equal(t, offset1+uint64(len(originalValue1)+4+valueEntryHeaderSize), offset2)
 
 		readValue1, err := file.Read(offset1, uint64(len(originalValue1)))
 		assert.NoError(t, err)
@@ -125,6 +202,45 @@ func TestValueFile_Read(t *testing.T) {
 		assert.Equal(t, originalValue2, readValue2)
 	})
 
+	t.Run("bad checksum", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		offset, err := file.Write([]byte("value one"))
+		assert.NoError(t, err)
+
+		// Overwrite the first byte of the value so the checksum no longer matches.
+		_, err = file.File.WriteAt([]byte("V"), int64(offset))
+		assert.NoError(t, err)
+
+		value, err := file.Read(offset, uint64(len("value one")))
+		assert.Nil(t, value)
+		assert.True(t, errors.Is(err, ErrCorrupted))
+		assert.True(t, errors.Is(err, ErrBadValueChecksum))
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		offset, err := file.Write([]byte("value one"))
+		assert.NoError(t, err)
+
+		// Try to read more than was actually written to the file.
+		value, err := file.Read(offset, 32)
+		assert.Nil(t, value)
+		assert.True(t, errors.Is(err, ErrCorrupted))
+		assert.True(t, errors.Is(err, ErrIncompleteValue))
+	})
+
 	t.Run("asynchronous", func(t *testing.T) {
 		doAsyncTest := func(t *testing.T, file *valueFile) {
 			numberOfValues := 1000
@@ -172,7 +288,8 @@ func TestValueFile_Read(t *testing.T) {
 			wg.Wait()
 
 			// Make sure the new offset matches the expected.
-			assert.Equal(t, uint64(numberOfValues*(8+4)), file.Offset)
+			assert.Equal(t, uint64(valueLogHeaderSize+numberOfValues*(valueEntryHeaderSize+8+4)),
+				file.Offset)
 
 			wg = sync.WaitGroup{}
 			wg.Add(numberOfRoutines)
@@ -196,7 +313,7 @@ func TestValueFile_Read(t *testing.T) {
 			dir, cleanup := NewTempDirectory(t)
 			defer cleanup()
 
-			file, err := openValueFile(dir, 1)
+			file, err := openValueFile(dir, 1, defaultFileMode)
 			assert.NoError(t, err)
 			assert.NotNil(t, file)
 
@@ -209,7 +326,7 @@ func BenchmarkValueFile_Write(b *testing.B) {
 	dir, cleanup := NewTempDirectory(b)
 	defer cleanup()
 
-	file, err := openValueFile(dir, 1)
+	file, err := openValueFile(dir, 1, defaultFileMode)
 	assert.NoError(b, err)
 	assert.NotNil(b, file)
 
@@ -226,7 +343,7 @@ func BenchmarkValueFile_Read(b *testing.B) {
 	dir, cleanup := NewTempDirectory(b)
 	defer cleanup()
 
-	file, err := openValueFile(dir, 1)
+	file, err := openValueFile(dir, 1, defaultFileMode)
 	assert.NoError(b, err)
 	assert.NotNil(b, file)
 
@@ -275,11 +392,190 @@ func BenchmarkValueFile_Read(b *testing.B) {
 	wg.Wait()
 
 	// Make sure the new offset matches the expected.
-	assert.Equal(b, uint64(numberOfValues*(8+4)), file.Offset)
+	assert.Equal(b, uint64(valueLogHeaderSize+numberOfValues*(valueEntryHeaderSize+8+4)),
+		file.Offset)
 
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = file.Read(0, 8)
+		_, _ = file.Read(uint64(valueLogHeaderSize+valueEntryHeaderSize), 8)
+	}
+}
+
+func TestValueFile_ReadPointer(t *testing.T) {
+	t.Run("simple", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		pointer, err := file.Append([]byte("value one"))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), pointer.FileId)
+		assert.Equal(t, uint32(len("value one")), pointer.Size)
+
+		value, err := file.ReadPointer(pointer, true)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value one"), value)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		pointer, err := file.Append([]byte("value one"))
+		assert.NoError(t, err)
+
+		// Write a different but entirely valid value over the original one. The checksum in the
+		// file will match but the checksum in the pointer will not.
+		other, err := openValueFile(dir, 1, defaultFileMode)
+		assert.NoError(t, err)
+		other.Offset = pointer.Offset - valueEntryHeaderSize
+		_, err = other.Write([]byte("value two"))
+		assert.NoError(t, err)
+
+		value, err := file.ReadPointer(pointer, true)
+		assert.Nil(t, value)
+		assert.True(t, errors.Is(err, ErrCorrupted))
+		assert.True(t, errors.Is(err, errValuePointerMismatch))
+
+		// If we don't verify the pointer then the value in the file is returned.
+		value, err = file.ReadPointer(pointer, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value two"), value)
+	})
+
+	t.Run("wrong file", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openValueFile(dir, 1, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		value, err := file.ReadPointer(valuePointer{FileId: 2}, true)
+		assert.Nil(t, value)
+		assert.Equal(t, errBadValuePointer, err)
+	})
+}
+
+func TestValueFile_Scan(t *testing.T) {
+	// write adds three entries to a new value file and returns it along with their pointers.
+	write := func(t *testing.T, dir string) (*valueFile, []valuePointer) {
+		file, err := openValueFile(dir, 1, defaultFileMode)
+		assert.NoError(t, err)
+
+		pointers := make([]valuePointer, 0, 3)
+		for i, key := range []string{"a", "b", "c"} {
+			pointer, err := file.AppendEntry(Key(key), []byte("value "+key), byte(i))
+			assert.NoError(t, err)
+			pointers = append(pointers, pointer)
+		}
+
+		return file, pointers
 	}
+
+	scan := func(file *valueFile) ([]valueLogEntry, uint64, error) {
+		entries := make([]valueLogEntry, 0)
+		end, err := file.Scan(func(entry valueLogEntry) error {
+			entries = append(entries, entry)
+			return nil
+		})
+		return entries, end, err
+	}
+
+	t.Run("rebuild pointers", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, pointers := write(t, dir)
+		assert.NoError(t, file.Sync())
+
+		// A file that is opened again can still be read from the start.
+		reopened, err := openValueFile(dir, 1, defaultFileMode)
+		assert.NoError(t, err)
+
+		entries, end, err := scan(reopened)
+		assert.NoError(t, err)
+		assert.Equal(t, reopened.Offset, end)
+		assert.Len(t, entries, 3)
+		for i, entry := range entries {
+			assert.Equal(t, pointers[i], entry.Pointer)
+			assert.Equal(t, byte(i), entry.UserMeta)
+
+			value, err := reopened.ReadPointer(entry.Pointer, true)
+			assert.NoError(t, err)
+			assert.Equal(t, "value "+string(entry.Key), string(value))
+		}
+	})
+
+	t.Run("torn tail", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, pointers := write(t, dir)
+
+		// Cut the last entry off in the middle of its value.
+		filePath := path.Join(dir, getValueFileName(1))
+		assert.NoError(t, os.Truncate(filePath, int64(pointers[2].Offset+2)))
+		reopened, err := openValueFile(dir, 1, defaultFileMode)
+		assert.NoError(t, err)
+
+		entries, end, err := scan(reopened)
+		assert.True(t, errors.Is(err, ErrCorrupted))
+		assert.True(t, errors.Is(err, ErrIncompleteValue))
+		assert.Len(t, entries, 2)
+		assert.Equal(t, pointers[1].Offset+uint64(pointers[1].Size)+4, end)
+
+		// Once the torn entry is truncated away the file is clean again.
+		assert.NoError(t, os.Truncate(filePath, int64(end)))
+		reopened, err = openValueFile(dir, 1, defaultFileMode)
+		assert.NoError(t, err)
+		entries, _, err = scan(reopened)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		assert.NoError(t, file.File.(*os.File).Close())
+	})
+
+	t.Run("hole", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, pointers := write(t, dir)
+
+		// An entry that was allocated but never written before a crash is left as zeros, the scan
+		// cannot find its way past it.
+		start := pointers[1].Offset - valueEntryHeaderSize - 1
+		_, err := file.File.WriteAt(make([]byte, pointers[2].Offset-start), int64(start))
+		assert.NoError(t, err)
+
+		entries, end, err := scan(file)
+		assert.True(t, errors.Is(err, ErrBadValueChecksum))
+		assert.Len(t, entries, 1)
+		assert.Equal(t, start, end)
+	})
+}
+
+func TestValuePointer_Encode(t *testing.T) {
+	pointer := valuePointer{
+		FileId:   1,
+		Offset:   1234,
+		Size:     56,
+		Checksum: 7890,
+	}
+
+	encoded := pointer.Encode()
+	assert.Len(t, encoded, valuePointerSize)
+
+	decoded := valuePointer{}
+	assert.NoError(t, decoded.Decode(encoded))
+	assert.Equal(t, pointer, decoded)
+
+	assert.Equal(t, errBadValuePointer, decoded.Decode(encoded[1:]))
 }
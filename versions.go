@@ -0,0 +1,29 @@
+package lsmtree
+
+import (
+	"sync/atomic"
+)
+
+// GetVersions returns the versions of the key that are visible to a new transaction, newest first.
+// Each version is returned as an Item with the timestamp it was committed at as its Version, a
+// version that deleted the key has IsDeleted set. This is meant for auditing and debugging how a
+// key has changed, normal reads should use a transaction.
+//
+// At most limit versions are returned, if limit is 0 then Options.NumVersionsToKeep versions are
+// returned. No more than Options.NumVersionsToKeep versions are ever returned, even though older
+// versions are never removed. If the key has never been written then no versions are returned.
+func (db *DB) GetVersions(key Key, limit int) ([]Item, error) {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return nil, ErrClosed
+	}
+
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	if limit <= 0 || limit > db.options.NumVersionsToKeep {
+		limit = db.options.NumVersionsToKeep
+	}
+
+	return db.memtable.Versions(key, db.readTimestamp(), limit), nil
+}
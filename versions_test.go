@@ -0,0 +1,89 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDB_GetVersions(t *testing.T) {
+	commit := func(t *testing.T, db *DB, key, value string) uint64 {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		if value == "" {
+			assert.NoError(t, txn.Delete(Key(key)))
+		} else {
+			assert.NoError(t, txn.Set(Key(key), []byte(value)))
+		}
+		assert.NoError(t, txn.Commit())
+
+		return txn.CommitTimestamp()
+	}
+
+	t.Run("history", func(t *testing.T) {
+		options := DefaultOptions()
+		options.NumVersionsToKeep = 10
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		first := commit(t, db, "a", "1")
+		commit(t, db, "b", "other")
+		deleted := commit(t, db, "a", "")
+		last := commit(t, db, "a", "2")
+
+		versions, err := db.GetVersions(Key("a"), 0)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 3) {
+			assert.Equal(t, []byte("2"), versions[0].Value)
+			assert.Equal(t, last, versions[0].Version)
+			assert.False(t, versions[0].IsDeleted())
+			assert.True(t, versions[1].IsDeleted())
+			assert.Equal(t, deleted, versions[1].Version)
+			assert.Equal(t, []byte("1"), versions[2].Value)
+			assert.Equal(t, first, versions[2].Version)
+		}
+
+		versions, err = db.GetVersions(Key("a"), 2)
+		assert.NoError(t, err)
+		assert.Len(t, versions, 2)
+
+		versions, err = db.GetVersions(Key("missing"), 0)
+		assert.NoError(t, err)
+		assert.Empty(t, versions)
+
+		_, err = db.GetVersions(nil, 0)
+		assert.Equal(t, ErrEmptyKey, err)
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		options := DefaultOptions()
+		options.NumVersionsToKeep = 2
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		for _, value := range []string{"1", "2", "3"} {
+			commit(t, db, "a", value)
+		}
+
+		// Asking for more versions than are kept only returns the ones that are kept.
+		versions, err := db.GetVersions(Key("a"), 10)
+		assert.NoError(t, err)
+		if assert.Len(t, versions, 2) {
+			assert.Equal(t, []byte("3"), versions[0].Value)
+			assert.Equal(t, []byte("2"), versions[1].Value)
+		}
+	})
+
+	t.Run("invalid retention", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.WALDirectory = dir
+		options.DataDirectory = dir
+		options.NumVersionsToKeep = 0
+
+		_, err := Open(options)
+		assert.True(t, errors.Is(err, ErrInvalidOptions))
+	})
+}
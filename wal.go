@@ -1,10 +1,34 @@
 package lsmtree
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/elliotcourant/buffers"
+	"io"
+	"math"
 	"os"
 	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrUnknownChangeType is returned when a change is read from the WAL but the type of the
+	// change is not one that is known.
+	ErrUnknownChangeType = errors.New("unknown wal change type")
+
+	// ErrBadTransactionHeader is returned when a transaction header in a WAL segment points to
+	// data that cannot exist.
+	ErrBadTransactionHeader = errors.New("bad wal transaction header")
+
+	// ErrWalSegmentTooLarge is returned when a WAL segment on the disk is larger than
+	// maxWalSegmentSizeLimit. Offsets beyond the limit cannot be stored in the freeSpace map or
+	// the transaction headers, so the segment was not written by the database.
+	ErrWalSegmentTooLarge = errors.New("wal segment is too large")
 )
 
 type (
@@ -21,10 +45,65 @@ type (
 		// last transaction committed to it. (see Options)
 		MaxWALSegmentSize uint64
 
+		// FileMode is the permissions that new segment files are created with. (see Options)
+		FileMode os.FileMode
+
 		// currentSegment is the WAL segment that is currently being used for all transactions. As
 		// transactions are committed there are appended here. Once this segment reaches a max size
 		// then a new segment will be created.
 		currentSegment *walSegment
+
+		// appendLock must be held while appending to the WAL or while changing the currentSegment.
+		appendLock sync.Mutex
+
+		// syncLock is held while a SyncBarrier is flushing the currentSegment to the disk. This
+		// allows concurrent barriers to share a single sync.
+		syncLock sync.Mutex
+
+		// appended is the number of transactions that have been appended to the WAL. This is only
+		// incremented while the appendLock is held but can be read atomically at any time.
+		appended uint64
+
+		// synced is the number of transactions that are known to be durable on the disk. This is
+		// always less than or equal to appended.
+		synced uint64
+
+		// cipher is used to encrypt every transaction written to the WAL. If this is nil then the
+		// WAL is not encrypted.
+		cipher cipher.AEAD
+
+		// ring is used to perform all IO on the WAL segments if it is not nil.
+		ring *ioURing
+
+		// wrapSegment is given the file of each new segment if it is not nil, and the segment uses
+		// the file it returns instead. Tests use this to inject faults underneath the WAL.
+		wrapSegment func(name string, file ReaderWriterAt) ReaderWriterAt
+
+		// syncer makes a segment durable when it is sealed, and makes a new segment's name
+		// durable when it is created.
+		syncer fileSyncer
+
+		// inPlaceFlushUpdates makes RecordFlush rewrite the flushed transactions instead of
+		// appending a flush marker. Nothing flushes transactions yet, so there is no option for
+		// it until there is a flush path that would call RecordFlush.
+		inPlaceFlushUpdates bool
+
+		// compressionThreshold is given to every new segment. (see Options)
+		compressionThreshold int
+
+		// watchLag tracks how many segments each watch is behind.
+		watchLag *watchLag
+
+		// lastSegmentId is the largest segmentId that has been used in the directory, including
+		// the segments that existed before the manager was created. New segments are always
+		// created with an Id after this one so that existing segments are never overwritten.
+		lastSegmentId uint64
+
+		// leaseSegmentIds records that segments may be created with Ids up to the one provided
+		// before any of them are used, and leasedSegmentId is the last Id that has been leased.
+		// If leaseSegmentIds is nil then Ids are not leased. (see useSegmentIdLease)
+		leaseSegmentIds func(lastSegmentId uint64) error
+		leasedSegmentId uint64
 	}
 
 	// walSegment represents a single chunk of the entire WAL. This chunk is limited by file size
@@ -42,6 +121,19 @@ type (
 
 		// File is just an accessor for the actual data on the disk for the WAL segment.
 		File ReaderWriterAt
+
+		// Cipher is used to encrypt and decrypt the transaction data in the segment. Transaction
+		// headers are never encrypted. If this is nil then the segment is not encrypted.
+		Cipher cipher.AEAD
+
+		// CompressionThreshold is the encoded size in bytes above which transactions appended to
+		// the segment are compressed. If this is 0 then nothing is compressed. Compressed
+		// transactions are always read regardless of this.
+		CompressionThreshold int
+
+		// closer is the file that was opened for the segment. File can be wrapped once the
+		// segment has been opened, so the file is kept here to be closed.
+		closer io.Closer
 	}
 
 	// walTransaction represents a single batch of changes that must be all committed to the state
@@ -82,8 +174,16 @@ type (
 		Key Key
 
 		// Value is the value we want to store in the database. This will be nil if we are deleting
-		// a key.
+		// a key, and will never be nil when the key is being set (even to an empty value).
 		Value []byte
+
+		// UserMeta is a single byte that the user can store alongside the value. The database does
+		// not interpret it in any way, it is simply stored and returned with the value.
+		UserMeta byte
+
+		// ExpiresAt is the unix time in seconds when a value that is being set expires, or 0 if it
+		// never expires. See Txn.SetWithTTL.
+		ExpiresAt uint64
 	}
 )
 
@@ -93,36 +193,464 @@ const (
 
 	// walTransactionChangeTypeDelete indicates that the value is being deleted.
 	walTransactionChangeTypeDelete
+
+	// walTransactionChangeTypeResolve marks the prepared transaction whose id is the key as
+	// committed or rolled back. It is never applied to the memtable. See Txn.Prepare.
+	walTransactionChangeTypeResolve
+
+	// walTransactionChangeTypeToken records that the idempotency token in the key was seen by the
+	// transaction, the value is the time it was seen. It is never applied to the memtable. See
+	// DB.ApplyIfNotSeen.
+	walTransactionChangeTypeToken
+
+	// walTransactionChangeTypeFlush records the heap and value file in the key that the
+	// transactions listed in the value were flushed to. It is never applied to the memtable. See
+	// walManager.RecordFlush.
+	walTransactionChangeTypeFlush
+)
+
+const (
+	// walTransactionChangeFlagUserMeta is set on the change type byte when the change is followed
+	// by a UserMeta byte. Changes without any UserMeta do not store the extra byte, this also means
+	// that changes written before UserMeta existed can still be read.
+	walTransactionChangeFlagUserMeta byte = 0x80
+
+	// walTransactionChangeFlagExpiresAt is set on the change type byte when the change is followed
+	// by an 8 byte ExpiresAt, after the UserMeta byte if there is one. Like UserMeta it is only
+	// stored when it is not 0.
+	walTransactionChangeFlagExpiresAt byte = 0x40
+)
+
+const (
+	// maxWalSegmentSizeLimit is the largest a single WAL segment can be. The freeSpace map and the
+	// transaction headers store offsets as 32-bit integers, so nothing in a segment can be addressed
+	// beyond this. Rather than a second version of the segment format with 64-bit offsets, every
+	// size that becomes one of those offsets is checked against this limit: a segment is sealed
+	// long before it gets this large, and a transaction larger than this is too big to hold in
+	// memory while it is committed anyway.
+	maxWalSegmentSizeLimit = math.MaxInt32
+
+	// walUpdateCoalesceGap is the largest gap between two transactions being updated by
+	// UpdateTransactions that will be read and written back along with them, so that both can be
+	// updated by a single write.
+	walUpdateCoalesceGap = 64 << 10
+
+	// maxKeySizeLimit is the largest that Options.MaxKeySize can be configured to.
+	maxKeySizeLimit = math.MaxUint16
+
+	// maxValueSizeLimit is the largest that Options.MaxValueSize can be configured to. Values are
+	// stored with a 32-bit length prefix, this leaves plenty of room for the rest of the
+	// transaction within a single segment.
+	maxValueSizeLimit = 1 << 30
+
+	// maxTransactionEntries is the largest number of changes that can be stored in a single
+	// transaction. The number of changes is encoded as a 16-bit integer.
+	maxTransactionEntries = math.MaxUint16
 )
 
 // newWalManager will create the WAL manager object.
-func newWalManager(directory string, maxWalSegmentSize uint64) (*walManager, error) {
+func newWalManager(
+	directory string, maxWalSegmentSize uint64, fileMode os.FileMode,
+) (*walManager, error) {
+	// The segment size is converted to the 32-bit offsets of the freeSpace map, so it would be
+	// silently truncated if it was not checked here as well as by Options.validate.
+	if maxWalSegmentSize == 0 || maxWalSegmentSize > maxWalSegmentSizeLimit {
+		return nil, fmt.Errorf("%w: MaxWALSegmentSize must be between 1 and %d bytes",
+			ErrInvalidOptions, maxWalSegmentSizeLimit)
+	}
+
 	// Create/verify that the directory exists. If it does not exist then this will create it. If
 	// the dir does exist then nothing will happen here.
-	if err := newDirectory(directory); err != nil {
+	if err := newDirectory(directory, getDirectoryMode(fileMode)); err != nil {
+		return nil, err
+	}
+
+	// Find any segments that were left behind by a previous instance of the database.
+	lastSegmentId, err := getLastFileId(directory, fileTypeWal)
+	if err != nil {
 		return nil, err
 	}
 
 	return &walManager{
 		Directory:         directory,
 		MaxWALSegmentSize: maxWalSegmentSize,
+		FileMode:          fileMode,
 		currentSegment:    nil,
+		lastSegmentId:     lastSegmentId,
+		syncer:            diskSyncer{},
+		watchLag:          newWatchLag(0),
 	}, nil
 }
 
-// openWalSegment will open or create a wal segment file if it does not exist.
-func openWalSegment(directory string, segmentId uint64, size int32) (*walSegment, error) {
+// Append will add the transaction to the current WAL segment. If there is not enough space left in
+// the current segment then it will be synced and a new segment will be created for this and any
+// subsequent transactions. The transaction is not durable until Sync or SyncBarrier has been
+// called.
+func (w *walManager) Append(txn walTransaction) error {
+	w.appendLock.Lock()
+	defer w.appendLock.Unlock()
+
+	// If this is the first append then there might not be a segment yet.
+	if w.currentSegment == nil {
+		if err := w.rotateSegment(txn); err != nil {
+			return err
+		}
+	}
+
+	err := w.currentSegment.Append(txn)
+	if err == ErrInsufficientSpace {
+		// If the current segment is full then we need to move onto a new one and try again. The
+		// new segment will always be large enough to fit the transaction.
+		if err = w.rotateSegment(txn); err != nil {
+			return err
+		}
+
+		err = w.currentSegment.Append(txn)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	w.watchLag.Appended(w.currentSegment.SegmentId, txn.Timestamp)
+	atomic.AddUint64(&w.appended, 1)
+
+	return nil
+}
+
+// SyncBarrier will return once every transaction that was appended before it was called has been
+// flushed to the disk. If multiple barriers are waiting at the same time then a single sync will
+// satisfy all of them. This allows callers to append many transactions and only pay for a single
+// sync, rather than syncing after each append.
+func (w *walManager) SyncBarrier() error {
+	// Anything that has been appended up to this point must be durable before we return.
+	target := atomic.LoadUint64(&w.appended)
+
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+
+	// If another barrier synced while we were waiting for the lock then it might have already
+	// covered everything we needed.
+	if atomic.LoadUint64(&w.synced) >= target {
+		return nil
+	}
+
+	// Grab the current segment and the number of transactions that will be durable once the
+	// segment has been synced. Any segments before this one were synced when they were sealed.
+	w.appendLock.Lock()
+	segment, covered := w.currentSegment, atomic.LoadUint64(&w.appended)
+	w.appendLock.Unlock()
+
+	if segment != nil {
+		if err := segment.Sync(); err != nil {
+			// The segment may have been sealed and closed since it was read. Sealing a segment
+			// syncs it, so there is nothing left to do if it is no longer current.
+			w.appendLock.Lock()
+			sealed := w.currentSegment != segment
+			w.appendLock.Unlock()
+			if !sealed {
+				return err
+			}
+		}
+	}
+
+	atomic.StoreUint64(&w.synced, covered)
+
+	return nil
+}
+
+// Close closes the current segment, every other segment has already been closed when it was
+// sealed. Nothing can be appended after this.
+func (w *walManager) Close() error {
+	w.appendLock.Lock()
+	defer w.appendLock.Unlock()
+
+	if w.currentSegment == nil {
+		return nil
+	}
+
+	segment := w.currentSegment
+	w.currentSegment = nil
+
+	return segment.Close()
+}
+
+// Verify will read every transaction in every segment in the directory to make sure that none of
+// them are corrupt. Segments are independent of each other, so up to parallelism segments are
+// read at the same time. If more than one segment is corrupt then the error for the oldest one is
+// returned.
+func (w *walManager) Verify(parallelism int) error {
+	segmentIds, err := listFiles(w.Directory, fileTypeWal)
+	if err != nil {
+		return err
+	}
+
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	errs := make([]error, len(segmentIds))
+	next := int64(-1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism && i < len(segmentIds); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				index := atomic.AddInt64(&next, 1)
+				if index >= int64(len(segmentIds)) {
+					return
+				}
+
+				errs[index] = w.verifySegment(segmentIds[index])
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walRecovery is what has to be rebuilt from the WAL when the database is opened, because it is
+// only ever stored in the WAL.
+type walRecovery struct {
+	// prepared are the transactions that were prepared and never resolved, by their prepare id.
+	prepared map[uint64][]walTransactionChange
+
+	// lastPrepareId is the largest prepare id in the WAL, including the ids of transactions that
+	// were committed or rolled back since. The timestamp allocator has to observe it so that a
+	// prepare id is never handed out again, even by a clock that has moved backwards.
+	lastPrepareId uint64
+
+	// tokens are the idempotency tokens that were committed, with the time they were seen.
+	tokens map[string]time.Time
+
+	// committed are the changes of every committed transaction in timestamp order, without the
+	// markers that are never applied to the memtable. The heap and value file that each one was
+	// flushed to are set whether they were recorded in place or by a flush marker.
+	committed []walTransaction
+}
+
+// recover reads every segment in the WAL and returns the state that is only kept in the WAL.
+func (w *walManager) recover() (*walRecovery, error) {
+	segmentIds, err := listFiles(w.Directory, fileTypeWal)
+	if err != nil {
+		return nil, err
+	}
+
+	recovery := &walRecovery{
+		prepared: map[uint64][]walTransactionChange{},
+		tokens:   map[string]time.Time{},
+	}
+
+	// A flush marker always comes after the transactions it refers to, but they can be in an
+	// earlier segment, so markers are only applied once every segment has been read.
+	flushed := map[uint64]walFlushTarget{}
+	for _, segmentId := range segmentIds {
+		transactions, err := w.readSegment(segmentId)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, txn := range transactions {
+			if ids, target, ok := decodeFlushMarker(txn); ok {
+				for _, id := range ids {
+					flushed[id] = target
+				}
+				continue
+			}
+
+			if id, ok := resolvedPrepareId(txn); ok {
+				delete(recovery.prepared, id)
+			} else if txn.Timestamp == 0 {
+				recovery.prepared[txn.TransactionId] = txn.Entries
+				if txn.TransactionId > recovery.lastPrepareId {
+					recovery.lastPrepareId = txn.TransactionId
+				}
+				continue
+			}
+
+			if txn.Timestamp == 0 {
+				continue
+			}
+
+			changes := make([]walTransactionChange, 0, len(txn.Entries))
+			for _, change := range txn.Entries {
+				switch change.Type {
+				case walTransactionChangeTypeSet, walTransactionChangeTypeDelete:
+					changes = append(changes, change)
+				}
+
+				if token, seen, ok := decodeTokenChange(change); ok {
+					recovery.tokens[token] = seen
+				}
+			}
+			recovery.committed = append(recovery.committed, walTransaction{
+				TransactionId: txn.TransactionId,
+				Timestamp:     txn.Timestamp,
+				HeapId:        txn.HeapId,
+				ValueFileId:   txn.ValueFileId,
+				Entries:       changes,
+			})
+		}
+	}
+
+	for i, txn := range recovery.committed {
+		if target, ok := flushed[txn.TransactionId]; ok {
+			recovery.committed[i].HeapId = target.HeapId
+			recovery.committed[i].ValueFileId = target.ValueFileId
+		}
+	}
+
+	return recovery, nil
+}
+
+// UpdateTransactions will record the heap and value file that the transactions specified were
+// flushed to in the segment with the segmentId provided, and returns how many of them were found in
+// it. See walSegment.UpdateTransactions. Changes to the current segment are made durable along with
+// the rest of it by the next SyncBarrier, a segment that has already been sealed is synced before
+// this returns.
+func (w *walManager) UpdateTransactions(
+	segmentId uint64, transactionIds []uint64, heapId, valueFileId uint64,
+) (int, error) {
+	// Appends to the current segment hold the appendLock while they write, so holding it makes
+	// sure that no transaction is only partly written while spans of the segment are rewritten.
+	w.appendLock.Lock()
+	if segment := w.currentSegment; segment != nil && segment.SegmentId == segmentId {
+		defer w.appendLock.Unlock()
+		return segment.UpdateTransactions(transactionIds, heapId, valueFileId)
+	}
+	w.appendLock.Unlock()
+
+	// Segments that are no longer current are never appended to again. They are opened just for
+	// the update, but opening a segment creates it if it does not exist.
+	filePath := path.Join(w.Directory, getWalSegmentFileName(segmentId))
+	if _, err := os.Stat(filePath); err != nil {
+		return 0, err
+	}
+
+	segment, err := openWalSegment(w.Directory, segmentId, int32(w.MaxWALSegmentSize), w.FileMode)
+	if err != nil {
+		return 0, err
+	}
+	segment.Cipher = w.cipher
+
+	if closer, ok := segment.File.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	found, err := segment.UpdateTransactions(transactionIds, heapId, valueFileId)
+	if err != nil || found == 0 {
+		return found, err
+	}
+
+	return found, segment.Sync()
+}
+
+// verifySegment will read all of the transactions in a single segment and then close it.
+func (w *walManager) verifySegment(segmentId uint64) error {
+	_, err := w.readSegment(segmentId)
+
+	return err
+}
+
+// rotateSegment will seal the current segment (if there is one) and create a new segment that
+// will be large enough to store the transaction provided. This must be called while the
+// appendLock is held.
+func (w *walManager) rotateSegment(txn walTransaction) error {
+	if w.currentSegment != nil {
+		// Make sure everything in the current segment is on the disk before we stop tracking it,
+		// this way a SyncBarrier only ever needs to sync the current segment.
+		if err := w.currentSegment.WriteSpace(); err != nil {
+			return err
+		}
+
+		if canSync, ok := w.currentSegment.File.(CanSync); ok {
+			name := getWalSegmentFileName(w.lastSegmentId)
+			if err := w.syncer.SyncFile(name, canSync); err != nil {
+				return err
+			}
+		}
+
+		// Sealed segments are never written to again, so the file is closed now rather than
+		// whenever it is garbage collected. The segment stops being current first, if it cannot be
+		// closed then the next append still creates a new segment.
+		sealed := w.currentSegment
+		w.currentSegment = nil
+		if err := sealed.Close(); err != nil {
+			return err
+		}
+	}
+
+	segmentId, err := w.nextSegmentId()
+	if err != nil {
+		return err
+	}
+
+	// Segments are usually the max size specified, but if the transaction is larger than that
+	// then the segment will be made large enough to fit it. The segment needs room for the
+	// freeSpace map and the transaction header as well as the transaction itself.
+	size := w.MaxWALSegmentSize
+	required := uint64(len(txn.Encode())) + 16 + 8
+	if w.cipher != nil {
+		required += recordEncryptionOverhead
+	}
+
+	if required > size {
+		size = required
+	}
+
+	if size > maxWalSegmentSizeLimit {
+		return ErrTxnTooBig
+	}
+
+	segment, err := openWalSegment(w.Directory, segmentId, int32(size), w.FileMode)
+	if err != nil {
+		return err
+	}
+	segment.Cipher = w.cipher
+	segment.CompressionThreshold = w.compressionThreshold
+
+	// The new segment file will not be guaranteed to exist after a crash until the directory it
+	// was created in has been synced.
+	if err = w.syncer.SyncDirectory(w.Directory); err != nil {
+		return err
+	}
+
+	if w.ring != nil {
+		segment.File = w.ring.Wrap(segment.File)
+	}
+
+	if w.wrapSegment != nil {
+		segment.File = w.wrapSegment(getWalSegmentFileName(segmentId), segment.File)
+	}
+
+	w.currentSegment = segment
+	w.lastSegmentId = segmentId
+
+	return nil
+}
+
+// openWalSegment will open or create a wal segment file if it does not exist. If the file is
+// created then it will be created with the permissions provided.
+func openWalSegment(
+	directory string, segmentId uint64, size int32, mode os.FileMode,
+) (*walSegment, error) {
 	filePath := path.Join(directory, getWalSegmentFileName(segmentId))
 
 	// We want to be able to read/write the file. If the file does not exist we want to create it.
+	// The file cannot be opened with O_APPEND because data is written to specific offsets, and
+	// exclusive access to the file is guaranteed by the lock on the directory.
 	flags := os.O_CREATE | os.O_RDWR
 
-	// We are only appending to the file, and we want to be the only process with the file open.
-	// This might change later as it might prove to be more efficient to have a single writer and
-	// multiple readers for a single file.
-	mode := os.ModeAppend | os.ModeExclusive
-
-	file, err := os.OpenFile(filePath, flags, mode)
+	file, err := os.OpenFile(filePath, flags, mode&os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
@@ -134,6 +662,13 @@ func openWalSegment(directory string, segmentId uint64, size int32) (*walSegment
 		return nil, err
 	}
 
+	// A segment larger than the limit has offsets that the freeSpace map cannot describe, reading
+	// it would silently wrap around to the wrong data.
+	if stat.Size() > maxWalSegmentSizeLimit {
+		file.Close()
+		return nil, newCorruptionError(filePath, 0, ErrWalSegmentTooLarge)
+	}
+
 	var space freeSpace
 
 	// If the current file size less than or equal to 8 then we know it's a new file and we need to
@@ -146,24 +681,49 @@ func openWalSegment(directory string, segmentId uint64, size int32) (*walSegment
 		if n, err := file.ReadAt(spaceBytes, 0); err != nil {
 			return nil, err
 		} else if n < 8 {
-			return nil, ErrCantReadFreeSpace
+			return nil, newCorruptionError(filePath, 0, ErrCantReadFreeSpace)
 		}
 
 		space = newFreeSpaceFromBytes(spaceBytes)
+
+		// The freeSpace map is only written when the segment is synced, so a segment that was
+		// written to but never synced before a crash has data but no map. None of its
+		// transactions were durable, so it is treated as empty. A map that was written always
+		// has at least the 8 bytes it takes up itself.
+		if space == 0 {
+			space = newFreeSpace(size)
+		}
 	}
 
 	return &walSegment{
 		SegmentId: segmentId,
 		Space:     space,
 		File:      file,
+		closer:    file,
 	}, nil
 }
 
+// Close closes the file of the segment, the segment cannot be used after this.
+func (s *walSegment) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+
+	return s.closer.Close()
+}
+
 // Append adds a transaction entry to the WAL segment. A transaction header is inserted at the top
 // of the file, and the transaction data is added to a buffer from the end of file. If the write is
 // successful then no error will be returned. If there is not enough space to write the transaction
 // to this WAL segment then ErrInsufficientSpace will be returned.
 func (w *walSegment) Append(txn walTransaction) (err error) {
+	// Make sure that the transaction can actually be encoded without anything being truncated. The
+	// configured limits in the Options are stricter than this and should be checked before the
+	// transaction gets here.
+	if err = txn.Validate(maxKeySizeLimit, maxValueSizeLimit); err != nil {
+		return err
+	}
+
 	// The header will always be 16 bytes and consists of a single 64 bit integer and two 32 bit
 	// integers.
 	header := make([]byte, 16)
@@ -171,6 +731,27 @@ func (w *walSegment) Append(txn walTransaction) (err error) {
 	// Encode the transactions changes to be written to the file.
 	data := txn.Encode()
 
+	// Large transactions are compressed if that makes them smaller, this is flagged in the header.
+	var flags uint32
+	if w.CompressionThreshold > 0 && len(data) > w.CompressionThreshold {
+		if compressed, ok := compressTransaction(data); ok {
+			data, flags = compressed, walHeaderFlagCompressed
+		}
+	}
+
+	// If the segment is encrypted then the data we write is the encrypted transaction.
+	if w.Cipher != nil {
+		if data, err = sealRecord(w.Cipher, txn.TransactionId, data); err != nil {
+			return err
+		}
+	}
+
+	// If the encoded transaction cannot be addressed by the 32-bit offsets in the header then it
+	// can never be written to a segment.
+	if len(data) > maxWalSegmentSizeLimit-len(header)-8 {
+		return ErrTxnTooBig
+	}
+
 	// Allocate space for the item to be written to the WAL.
 	ok, headerOffset, dataOffset := w.Space.Allocate(header, data)
 	if !ok {
@@ -181,7 +762,7 @@ func (w *walSegment) Append(txn walTransaction) (err error) {
 	// end offsets for the actual transaction changes within the file.
 	binary.BigEndian.PutUint64(header[0:8], txn.TransactionId)
 	binary.BigEndian.PutUint32(header[8:12], uint32(dataOffset))
-	binary.BigEndian.PutUint32(header[12:16], uint32(dataOffset+int64(len(data))))
+	binary.BigEndian.PutUint32(header[12:16], uint32(dataOffset+int64(len(data)))|flags)
 
 	// Write the header to the file.
 	if _, err = w.File.WriteAt(header, headerOffset); err != nil {
@@ -199,40 +780,107 @@ func (w *walSegment) Append(txn walTransaction) (err error) {
 
 // UpdateTransaction will update the heapId and valueFileId's of the specified transaction
 // within the WAL segment. If the transaction could not be found then ok will be false. If the write
-// failed then an error will be returned.
+// failed then an error will be returned. To update many transactions use UpdateTransactions, which
+// only reads the headers once and batches the writes.
 func (w *walSegment) UpdateTransaction(transactionId, heapId, valueFileId uint64) (
 	ok bool, err error,
 ) {
-	start := int64(0)
+	found, err := w.UpdateTransactions([]uint64{transactionId}, heapId, valueFileId)
+
+	// If the transaction was found we still want to return true when the write fails, to indicate
+	// that the transaction is in fact in this file but that something is stopping the change from
+	// being made.
+	return found > 0, err
+}
+
+// UpdateTransactions will update the heapId and valueFileId of every one of the transactions
+// specified that is in this WAL segment, and returns how many of them were found. Flushing a
+// memtable records the same heap and value file for every transaction it covers, which can be
+// thousands of transactions, so rather than a small random write for each one the headers are read
+// once and updates that are close together in the file are made with a single read and write of
+// the span between them. The changes are not synced.
+//
+// The span between two updates is read and written back as it is, so none of the transactions in
+// it can be written to at the same time. Transactions are never changed once they have been
+// appended, but the caller must make sure that every transaction in the segment up to the last one
+// being updated has been appended completely, see walManager.UpdateTransactions.
+func (w *walSegment) UpdateTransactions(transactionIds []uint64, heapId, valueFileId uint64) (
+	found int, err error,
+) {
+	wanted := make(map[uint64]struct{}, len(transactionIds))
+	for _, transactionId := range transactionIds {
+		wanted[transactionId] = struct{}{}
+	}
 
-	ok, start, _, err = w.getTransactionDataLocation(transactionId)
+	headers, err := w.readHeaders()
 	if err != nil {
-		return ok, err
+		return 0, err
+	}
+
+	// The heap and value file ids are a 16 byte pair that follows the 8 byte timestamp at the start
+	// of the transaction's data.
+	offsets := make([]int64, 0, len(transactionIds))
+	for i := 0; i < len(headers); i += 16 {
+		if _, ok := wanted[binary.BigEndian.Uint64(headers[i:i+8])]; ok {
+			offsets = append(offsets, int64(binary.BigEndian.Uint32(headers[i+8:i+8+4]))+8)
+		}
+	}
+
+	if len(offsets) == 0 {
+		return 0, nil
 	}
 
-	// If the start and the end are still 0 then the transaction specified is not in this segment.
-	if start == 0 || !ok {
-		return false, nil
+	// Encrypted transactions cannot be changed without decrypting and rewriting them entirely.
+	if w.Cipher != nil {
+		return len(offsets), ErrEncryptedTransactionUpdate
 	}
 
-	// The heap and value file ids are a 16 byte pair that follows the 8 byte timestamp within a
-	// transaction change. So we can simply give it the start offset plus 8 bytes to change this
-	// block properly.
 	heapValueUpdate := make([]byte, 16)
 	binary.BigEndian.PutUint64(heapValueUpdate[0:8], heapId)
 	binary.BigEndian.PutUint64(heapValueUpdate[8:16], valueFileId)
 
-	// We can then write the heapId and valueFileId update to the file starting 8 bytes after the
-	// start offset we got from the header.
-	if _, err := w.File.WriteAt(heapValueUpdate, start+8); err != nil {
-		// Something went wrong writing to the file, we still want to return true to indicate that
-		// the transaction is in fact in this file, but that something is stopping the change from
-		// being made.
-		return true, err
+	// Transaction data is written from the end of the segment towards the start, so the offsets
+	// need to be sorted before neighbouring updates can be found.
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for i := 0; i < len(offsets); {
+		end := i + 1
+		for end < len(offsets) && offsets[end]-(offsets[end-1]+16) <= walUpdateCoalesceGap {
+			end++
+		}
+
+		if end == i+1 {
+			if _, err = w.File.WriteAt(heapValueUpdate, offsets[i]); err != nil {
+				return len(offsets), err
+			}
+			i = end
+			continue
+		}
+
+		start := offsets[i]
+		span := make([]byte, offsets[end-1]+16-start)
+		if _, err = w.File.ReadAt(span, start); err == io.EOF {
+			return len(offsets), w.corrupted(start, ErrTruncated)
+		} else if err != nil {
+			return len(offsets), err
+		}
+
+		for _, offset := range offsets[i:end] {
+			copy(span[offset-start:], heapValueUpdate)
+		}
+
+		if _, err = w.File.WriteAt(span, start); err != nil {
+			return len(offsets), err
+		}
+		i = end
 	}
 
-	// Everything worked, we can return true because we found the transaction.
-	return true, nil
+	return len(offsets), nil
+}
+
+// WriteSpace writes the current freeSpace map to the start of the segment without syncing it.
+func (w *walSegment) WriteSpace() error {
+	_, err := w.File.WriteAt(w.Space.Encode(), 0)
+	return err
 }
 
 // Sync will flush the changes made to the wal file to the disk if the file interface implements
@@ -240,7 +888,7 @@ func (w *walSegment) UpdateTransaction(transactionId, heapId, valueFileId uint64
 func (w *walSegment) Sync() error {
 	// Before syncing the file make sure to write the current freeSpace map to the
 	// file as well.
-	if _, err := w.File.WriteAt(w.Space.Encode(), 0); err != nil {
+	if err := w.WriteSpace(); err != nil {
 		return err
 	}
 
@@ -251,38 +899,33 @@ func (w *walSegment) Sync() error {
 	return nil
 }
 
-func (w *walSegment) getTransactionDataLocation(txnId uint64) (ok bool, start, end int64, err error) {
+// readHeaders will return all of the transaction headers that have been written to the segment.
+// Headers start immediately after the freeSpace map and are always 16 bytes each.
+func (w *walSegment) readHeaders() ([]byte, error) {
 	headerStart := int64(8)
 	headerEnd, _ := w.Space.Current()
-	headers := make([]byte, headerEnd-headerStart)
-	if _, err := w.File.ReadAt(headers, headerStart); err != nil {
-		return false, 0, 0, err
-	}
-
-	for i := 0; i < len(headers); i += 16 {
-		transactionId := binary.BigEndian.Uint64(headers[i : i+8])
-		if txnId != transactionId {
-			continue
-		}
 
-		ok = true
-		start = int64(binary.BigEndian.Uint32(headers[i+8 : i+8+4]))
-		end = int64(binary.BigEndian.Uint32(headers[i+8+4 : i+8+4+4]))
+	// If the freeSpace map does not describe a valid set of headers then it has been corrupted.
+	if headerEnd < headerStart || (headerEnd-headerStart)%16 != 0 {
+		return nil, w.corrupted(0, ErrCantReadFreeSpace)
+	}
 
-		return
+	headers := make([]byte, headerEnd-headerStart)
+	if _, err := w.File.ReadAt(headers, headerStart); err == io.EOF {
+		return nil, w.corrupted(headerStart, ErrTruncated)
+	} else if err != nil {
+		return nil, err
 	}
 
-	return
+	return headers, nil
 }
 
 // GetTransactions will return an array of transactions and their changes in the order that they
 // were written to the WAL.
 func (w *walSegment) GetTransactions() ([]walTransaction, error) {
 	headerStart := int64(8)
-	headerEnd, _ := w.Space.Current()
-
-	headers := make([]byte, headerEnd-headerStart)
-	if _, err := w.File.ReadAt(headers, headerStart); err != nil {
+	headers, err := w.readHeaders()
+	if err != nil {
 		return nil, err
 	}
 
@@ -291,16 +934,39 @@ func (w *walSegment) GetTransactions() ([]walTransaction, error) {
 		transactionId := binary.BigEndian.Uint64(headers[i : i+8])
 		start := binary.BigEndian.Uint32(headers[i+8 : i+8+4])
 		end := binary.BigEndian.Uint32(headers[i+8+4 : i+8+4+4])
+		compressed := end&walHeaderFlagCompressed != 0
+		end &^= walHeaderFlagCompressed
 		transaction := &walTransaction{
 			TransactionId: transactionId,
 		}
 
+		// If the header points to data that cannot exist then the header is corrupt.
+		if end < start {
+			return nil, w.corrupted(headerStart+int64(i), ErrBadTransactionHeader)
+		}
+
 		changeBuffer := make([]byte, end-start)
-		if _, err := w.File.ReadAt(changeBuffer, int64(start)); err != nil {
+		if _, err := w.File.ReadAt(changeBuffer, int64(start)); err == io.EOF {
+			return nil, w.corrupted(int64(start), ErrTruncated)
+		} else if err != nil {
 			return nil, err
 		}
 
-		transaction.Decode(changeBuffer)
+		if w.Cipher != nil {
+			if changeBuffer, err = openRecord(w.Cipher, transactionId, changeBuffer); err != nil {
+				return nil, w.corrupted(int64(start), err)
+			}
+		}
+
+		if compressed {
+			if changeBuffer, err = decompressTransaction(changeBuffer); err != nil {
+				return nil, w.corrupted(int64(start), err)
+			}
+		}
+
+		if err := transaction.Decode(changeBuffer); err != nil {
+			return nil, w.corrupted(int64(start), err)
+		}
 
 		transactions = append(transactions, *transaction)
 	}
@@ -308,6 +974,29 @@ func (w *walSegment) GetTransactions() ([]walTransaction, error) {
 	return transactions, nil
 }
 
+// corrupted wraps the error provided in a CorruptionError for this segment at the offset
+// specified.
+func (w *walSegment) corrupted(offset int64, err error) error {
+	return newCorruptionError(getWalSegmentFileName(w.SegmentId), offset, err)
+}
+
+// Validate will make sure that every change in the transaction is within the key and value size
+// limits provided, and that the transaction does not have more changes than can be encoded.
+func (t *walTransaction) Validate(maxKeySize, maxValueSize uint32) error {
+	if len(t.Entries) > maxTransactionEntries {
+		return fmt.Errorf("%w: transaction has %d changes, max is %d",
+			ErrTxnTooBig, len(t.Entries), maxTransactionEntries)
+	}
+
+	for i := range t.Entries {
+		if err := t.Entries[i].Validate(maxKeySize, maxValueSize); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Encode returns the binary representation of the walTransaction.
 // 1. 8 Bytes: Timestamp
 // 2. 8 Bytes: Heap ID
@@ -327,48 +1016,149 @@ func (t *walTransaction) Encode() []byte {
 	return buf.Bytes()
 }
 
-func (t *walTransaction) Decode(src []byte) {
-	buf := buffers.NewBytesReader(src)
+// Decode will read the binary representation of a walTransaction from the buffer provided. If the
+// buffer is truncated or contains anything that is not a valid transaction then an error is
+// returned and the transaction should not be used.
+func (t *walTransaction) Decode(src []byte) error {
+	buf := newBytesDecoder(src)
 	t.Timestamp = buf.NextUint64()
 	t.HeapId = buf.NextUint64()
 	t.ValueFileId = buf.NextUint64()
 
 	numberOfEntries := int(buf.NextUint16())
+	if err := buf.Err(); err != nil {
+		return err
+	}
+
+	// Every change requires at least 4 bytes for its length prefix. If there are not enough bytes
+	// left for the number of changes then don't even try to allocate them.
+	if numberOfEntries*4 > len(src) {
+		return ErrTruncated
+	}
+
 	t.Entries = make([]walTransactionChange, numberOfEntries)
 
 	for i := 0; i < numberOfEntries; i++ {
+		changeBytes := buf.NextBytes()
+		if err := buf.Err(); err != nil {
+			return err
+		}
+
 		change := &walTransactionChange{}
-		change.Decode(buf.NextBytes())
+		if err := change.Decode(changeBytes); err != nil {
+			return err
+		}
+
 		t.Entries[i] = *change
 	}
+
+	return buf.Finish()
+}
+
+// Validate will make sure that the key and value of the change are within the size limits
+// provided.
+func (c *walTransactionChange) Validate(maxKeySize, maxValueSize uint32) error {
+	switch {
+	case len(c.Key) == 0:
+		return ErrEmptyKey
+	case uint64(len(c.Key)) > uint64(maxKeySize):
+		return fmt.Errorf("%w: key is %d bytes, max is %d", ErrKeyTooLarge, len(c.Key), maxKeySize)
+	case uint64(len(c.Value)) > uint64(maxValueSize):
+		return fmt.Errorf("%w: value is %d bytes, max is %d",
+			ErrValueTooLarge, len(c.Value), maxValueSize)
+	}
+
+	return nil
+}
+
+// Size returns the number of bytes that the change counts towards Options.MaxBatchSize.
+func (c *walTransactionChange) Size() int64 {
+	return int64(len(c.Key) + len(c.Value))
 }
 
 // Encode returns the binary representation of the walTransactionChange.
-// 1. 1 Byte: Change Type
-// 2. 4+ Bytes: Key
-// 3. 0-4+ Bytes: Value (If we are deleting then this is not included.
+// 1. 1 Byte: Change Type (The high bit is set if there is a UserMeta byte, the next bit is set if
+// there is an ExpiresAt)
+// 2. 0-1 Bytes: UserMeta (Only included if it is not 0)
+// 3. 0-8 Bytes: ExpiresAt (Only included if it is not 0)
+// 4. 4+ Bytes: Key
+// 5. 0-4+ Bytes: Value (If we are deleting then this is not included.
+// A key that is set to an empty value is NOT the same as a key being deleted. A set will always
+// store a value, if the value is nil then it is stored as an empty value.
 func (c *walTransactionChange) Encode() []byte {
 	buf := buffers.NewBytesBuffer()
-	buf.AppendByte(byte(c.Type))
+	changeType := byte(c.Type)
+	if c.UserMeta != 0 {
+		changeType |= walTransactionChangeFlagUserMeta
+	}
+	if c.ExpiresAt != 0 {
+		changeType |= walTransactionChangeFlagExpiresAt
+	}
+	buf.AppendByte(changeType)
+	if c.UserMeta != 0 {
+		buf.AppendByte(c.UserMeta)
+	}
+	if c.ExpiresAt != 0 {
+		buf.AppendUint64(c.ExpiresAt)
+	}
 	buf.Append(c.Key...)
 
 	switch c.Type {
-	// Right now only a set type will need the actual value. There might
-	// be others in the future that do or do not need the value stored.
-	case walTransactionChangeTypeSet:
-		buf.Append(c.Value...)
+	// Only sets, tokens and flush markers need the actual value.
+	case walTransactionChangeTypeSet, walTransactionChangeTypeToken, walTransactionChangeTypeFlush:
+		// The buffer will encode a nil value differently than an empty one. But for a set there
+		// should be no difference, so make sure we always store an empty value.
+		value := c.Value
+		if value == nil {
+			value = []byte{}
+		}
+		buf.Append(value...)
 	}
 
 	return buf.Bytes()
 }
 
-func (c *walTransactionChange) Decode(src []byte) {
-	buf := buffers.NewBytesReader(src)
-	c.Type = walTransactionChangeType(buf.NextByte())
+// Decode will read the binary representation of a walTransactionChange from the buffer provided.
+// If the buffer is truncated or the change type is not known then an error is returned.
+func (c *walTransactionChange) Decode(src []byte) error {
+	buf := newBytesDecoder(src)
+	changeType := buf.NextByte()
+	c.Type = walTransactionChangeType(
+		changeType &^ (walTransactionChangeFlagUserMeta | walTransactionChangeFlagExpiresAt),
+	)
+	if c.Type > walTransactionChangeTypeFlush {
+		return ErrUnknownChangeType
+	}
+
+	c.UserMeta = 0
+	if changeType&walTransactionChangeFlagUserMeta != 0 {
+		c.UserMeta = buf.NextByte()
+	}
+
+	c.ExpiresAt = 0
+	if changeType&walTransactionChangeFlagExpiresAt != 0 {
+		c.ExpiresAt = buf.NextUint64()
+	}
+
 	c.Key = buf.NextBytes()
 
 	switch c.Type {
-	case walTransactionChangeTypeSet:
+	case walTransactionChangeTypeSet, walTransactionChangeTypeToken, walTransactionChangeTypeFlush:
 		c.Value = buf.NextBytes()
+
+		// A set must always have a non-nil value so that it can never be confused with a delete.
+		if c.Value == nil {
+			c.Value = []byte{}
+		}
+	case walTransactionChangeTypeDelete, walTransactionChangeTypeResolve:
+		c.Value = nil
+	default:
+		if err := buf.Err(); err != nil {
+			return err
+		}
+
+		return ErrUnknownChangeType
 	}
+
+	return buf.Finish()
 }
@@ -0,0 +1,140 @@
+//go:build go1.18
+// +build go1.18
+
+package lsmtree
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func FuzzWalTransactionChange_RoundTrip(f *testing.F) {
+	f.Add([]byte("key1"), []byte("value1"), byte(0), false)
+	f.Add([]byte("key1"), []byte{}, byte(1), false)
+	f.Add([]byte("key1"), []byte(nil), byte(0), true)
+
+	f.Fuzz(func(t *testing.T, key, value []byte, userMeta byte, delete bool) {
+		change := walTransactionChange{
+			Type:     walTransactionChangeTypeSet,
+			Key:      key,
+			Value:    value,
+			UserMeta: userMeta,
+		}
+		if delete {
+			change.Type = walTransactionChangeTypeDelete
+		}
+
+		result := walTransactionChange{}
+		if err := result.Decode(change.Encode()); err != nil {
+			t.Fatalf("failed to decode change: %v", err)
+		}
+
+		if result.Type != change.Type {
+			t.Fatalf("type mismatch, expected %d got %d", change.Type, result.Type)
+		}
+
+		if !bytes.Equal(result.Key, change.Key) {
+			t.Fatalf("key mismatch, expected %v got %v", change.Key, result.Key)
+		}
+
+		if result.UserMeta != change.UserMeta {
+			t.Fatalf("user meta mismatch, expected %d got %d", change.UserMeta, result.UserMeta)
+		}
+
+		switch change.Type {
+		case walTransactionChangeTypeSet:
+			if result.Value == nil || !bytes.Equal(result.Value, change.Value) {
+				t.Fatalf("value mismatch, expected %v got %v", change.Value, result.Value)
+			}
+		case walTransactionChangeTypeDelete:
+			if result.Value != nil {
+				t.Fatalf("deleted value should be nil, got %v", result.Value)
+			}
+		}
+	})
+}
+
+func FuzzWalTransaction_RoundTrip(f *testing.F) {
+	f.Add(uint64(1), uint64(0), uint64(0), []byte("key1"), []byte("value1"), []byte("key2"))
+	f.Add(uint64(12345), uint64(2), uint64(3), []byte("key"), []byte{}, []byte("other"))
+
+	f.Fuzz(func(t *testing.T, timestamp, heapId, valueFileId uint64, setKey, value, deleteKey []byte) {
+		txn := walTransaction{
+			Timestamp:   timestamp,
+			HeapId:      heapId,
+			ValueFileId: valueFileId,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   setKey,
+					Value: value,
+				},
+				{
+					Type: walTransactionChangeTypeDelete,
+					Key:  deleteKey,
+				},
+			},
+		}
+
+		result := walTransaction{}
+		if err := result.Decode(txn.Encode()); err != nil {
+			t.Fatalf("failed to decode transaction: %v", err)
+		}
+
+		if result.Timestamp != txn.Timestamp ||
+			result.HeapId != txn.HeapId ||
+			result.ValueFileId != txn.ValueFileId {
+			t.Fatalf("header mismatch, expected %+v got %+v", txn, result)
+		}
+
+		if len(result.Entries) != len(txn.Entries) {
+			t.Fatalf("expected %d entries, got %d", len(txn.Entries), len(result.Entries))
+		}
+
+		for i, change := range txn.Entries {
+			if result.Entries[i].Type != change.Type ||
+				!bytes.Equal(result.Entries[i].Key, change.Key) ||
+				!bytes.Equal(result.Entries[i].Value, change.Value) {
+				t.Fatalf("entry %d mismatch, expected %+v got %+v", i, change, result.Entries[i])
+			}
+		}
+	})
+}
+
+// FuzzWalTransaction_Decode feeds arbitrary bytes to the decoder. The data read back from a WAL
+// segment could be anything if the file has been corrupted, decoding it should never panic.
+func FuzzWalTransaction_Decode(f *testing.F) {
+	seed := walTransaction{
+		Timestamp: 1,
+		Entries: []walTransactionChange{
+			{
+				Type:  walTransactionChangeTypeSet,
+				Key:   []byte("key1"),
+				Value: []byte("value1"),
+			},
+			{
+				Type: walTransactionChangeTypeDelete,
+				Key:  []byte("key2"),
+			},
+		},
+	}
+	f.Add(seed.Encode())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		txn := walTransaction{}
+		if err := txn.Decode(data); err != nil {
+			return
+		}
+
+		// If the data could be decoded then encoding it again must produce the same transaction.
+		result := walTransaction{}
+		if err := result.Decode(txn.Encode()); err != nil {
+			t.Fatalf("failed to decode re-encoded transaction: %v", err)
+		}
+
+		if !reflect.DeepEqual(txn, result) {
+			t.Fatalf("re-encoded transaction mismatch, expected %+v got %+v", txn, result)
+		}
+	})
+}
@@ -1,7 +1,15 @@
 package lsmtree
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sync"
 	"testing"
 )
 
@@ -10,15 +18,229 @@ func TestNewWalManager(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		manager, err := newWalManager(dir+"/wal", 1024*8)
+		manager, err := newWalManager(dir+"/wal", 1024*8, defaultFileMode)
 		assert.NoError(t, err)
 		assert.NotNil(t, manager)
 	})
+
+	t.Run("existing segments", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		// Segments from a previous instance should never be overwritten by new segments.
+		for _, segmentId := range []uint64{1, 2, 7} {
+			_, err := openWalSegment(dir, segmentId, 1024, defaultFileMode)
+			assert.NoError(t, err)
+		}
+
+		manager, err := newWalManager(dir, 1024*8, defaultFileMode)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(7), manager.lastSegmentId)
+
+		err = manager.Append(walTransaction{
+			TransactionId: 1,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key"),
+					Value: []byte("value"),
+				},
+			},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(8), manager.currentSegment.SegmentId)
+
+		ids, err := listFiles(dir, fileTypeWal)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{1, 2, 7, 8}, ids)
+	})
+
+	t.Run("segment size", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		// Sizes that cannot be stored in the freeSpace map are rejected instead of truncated.
+		for _, size := range []uint64{0, maxWalSegmentSizeLimit + 1, 1 << 32} {
+			manager, err := newWalManager(dir, size, defaultFileMode)
+			assert.True(t, errors.Is(err, ErrInvalidOptions), "size %d", size)
+			assert.Nil(t, manager)
+		}
+
+		manager, err := newWalManager(dir, maxWalSegmentSizeLimit, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+	})
+}
+
+func TestWalManager_Append(t *testing.T) {
+	t.Run("rotate segments", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+
+		for i := 0; i < 10; i++ {
+			err = manager.Append(walTransaction{
+				TransactionId: uint64(i + 1),
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte(fmt.Sprintf("key%d", i)),
+						Value: []byte("value"),
+					},
+				},
+			})
+			assert.NoError(t, err)
+		}
+
+		// Each transaction is 64 bytes with its header, so only 2 can fit in a single segment.
+		assert.Equal(t, uint64(5), manager.currentSegment.SegmentId)
+		assert.Equal(t, uint64(10), manager.appended)
+	})
+
+	t.Run("sync sealed segments", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+		syncer := &recordingSyncer{}
+		manager.syncer = syncer
+
+		for i := 0; i < 3; i++ {
+			err = manager.Append(walTransaction{
+				TransactionId: uint64(i + 1),
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte(fmt.Sprintf("key%d", i)),
+						Value: []byte("value"),
+					},
+				},
+			})
+			assert.NoError(t, err)
+		}
+
+		// The first segment is created, then sealed on the third transaction. The sealed segment
+		// must be synced before the directory that now contains the new segment.
+		assert.Equal(t, []string{
+			"directory:" + dir,
+			"file:" + getWalSegmentFileName(1),
+			"directory:" + dir,
+		}, syncer.syncs)
+	})
+
+	t.Run("close sealed segments", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+
+		files := map[uint64]*os.File{}
+		for i := 0; i < 6; i++ {
+			err = manager.Append(walTransaction{
+				TransactionId: uint64(i + 1),
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte(fmt.Sprintf("key%d", i)),
+						Value: []byte("value"),
+					},
+				},
+			})
+			assert.NoError(t, err)
+			files[manager.currentSegment.SegmentId] = manager.currentSegment.File.(*os.File)
+		}
+		assert.Len(t, files, 3)
+
+		// Only the current segment is still open.
+		for segmentId, file := range files {
+			_, err := file.Stat()
+			if segmentId == manager.currentSegment.SegmentId {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		}
+		assert.NoError(t, manager.SyncBarrier())
+	})
+
+	t.Run("larger than segment", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 64, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+
+		err = manager.Append(walTransaction{
+			TransactionId: 1,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key"),
+					Value: make([]byte, 256),
+				},
+			},
+		})
+		assert.NoError(t, err)
+
+		transactions, err := manager.currentSegment.GetTransactions()
+		assert.NoError(t, err)
+		assert.Len(t, transactions, 1)
+	})
+}
+
+func TestWalManager_SyncBarrier(t *testing.T) {
+	t.Run("concurrent", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 1024*8, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, manager)
+
+		numberOfRoutines := 8
+		wg := sync.WaitGroup{}
+		wg.Add(numberOfRoutines)
+		for i := 0; i < numberOfRoutines; i++ {
+			go func(i int) {
+				defer wg.Done()
+				err := manager.Append(walTransaction{
+					TransactionId: uint64(i + 1),
+					Entries: []walTransactionChange{
+						{
+							Type:  walTransactionChangeTypeSet,
+							Key:   []byte(fmt.Sprintf("key%d", i)),
+							Value: []byte("value"),
+						},
+					},
+				})
+				assert.NoError(t, err)
+				assert.NoError(t, manager.SyncBarrier())
+			}(i)
+		}
+		wg.Wait()
+
+		assert.Equal(t, uint64(numberOfRoutines), manager.synced)
+	})
+
+	t.Run("nothing appended", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 1024*8, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NoError(t, manager.SyncBarrier())
+	})
 }
 
 func TestOpenWalSegment(t *testing.T) {
 	t.Run("directory doesnt exist", func(t *testing.T) {
-		file, err := openWalSegment("tmp", 1, 1024)
+		file, err := openWalSegment("tmp", 1, 1024, defaultFileMode)
 		assert.Error(t, err)
 		assert.Nil(t, file)
 	})
@@ -27,10 +249,45 @@ func TestOpenWalSegment(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openWalSegment(dir, 1, 1024)
+		file, err := openWalSegment(dir, 1, 1024, defaultFileMode)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 	})
+
+	t.Run("permissions", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("windows does not support unix permissions")
+		}
+
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openWalSegment(dir, 1, 1024, 0600)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		// The mode should only contain the permissions, none of the type bits.
+		info, err := os.Stat(path.Join(dir, getWalSegmentFileName(1)))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode())
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		// The file is sparse so this does not actually use the space.
+		filePath := path.Join(dir, getWalSegmentFileName(1))
+		file, err := os.Create(filePath)
+		assert.NoError(t, err)
+		assert.NoError(t, file.Truncate(maxWalSegmentSizeLimit+1))
+		assert.NoError(t, file.Close())
+
+		segment, err := openWalSegment(dir, 1, 1024, defaultFileMode)
+		assert.True(t, errors.Is(err, ErrWalSegmentTooLarge))
+		assert.True(t, errors.Is(err, ErrCorrupted))
+		assert.Nil(t, segment)
+	})
 }
 
 func TestWalSegment_Append(t *testing.T) {
@@ -38,7 +295,7 @@ func TestWalSegment_Append(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openWalSegment(dir, 1, 1024)
+		file, err := openWalSegment(dir, 1, 1024, defaultFileMode)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 
@@ -70,7 +327,7 @@ func TestWalSegment_Sync(t *testing.T) {
 		dir, cleanup := NewTempDirectory(t)
 		defer cleanup()
 
-		file, err := openWalSegment(dir, 1, 1024)
+		file, err := openWalSegment(dir, 1, 1024, defaultFileMode)
 		assert.NoError(t, err)
 		assert.NotNil(t, file)
 
@@ -99,3 +356,543 @@ func TestWalSegment_Sync(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestWalTransaction_Validate(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		txn := walTransaction{
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: []byte("value1"),
+				},
+				{
+					Type: walTransactionChangeTypeDelete,
+					Key:  []byte("key2"),
+				},
+			},
+		}
+		assert.NoError(t, txn.Validate(4, 6))
+	})
+
+	t.Run("empty key", func(t *testing.T) {
+		txn := walTransaction{
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Value: []byte("value1"),
+				},
+			},
+		}
+		assert.Equal(t, ErrEmptyKey, txn.Validate(4, 6))
+	})
+
+	t.Run("key too large", func(t *testing.T) {
+		txn := walTransaction{
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: []byte("value1"),
+				},
+			},
+		}
+		assert.True(t, errors.Is(txn.Validate(3, 6), ErrKeyTooLarge))
+	})
+
+	t.Run("value too large", func(t *testing.T) {
+		txn := walTransaction{
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: []byte("value1"),
+				},
+			},
+		}
+		assert.True(t, errors.Is(txn.Validate(4, 5), ErrValueTooLarge))
+	})
+
+	t.Run("too many changes", func(t *testing.T) {
+		txn := walTransaction{
+			Entries: make([]walTransactionChange, maxTransactionEntries+1),
+		}
+		assert.True(t, errors.Is(txn.Validate(4, 6), ErrTxnTooBig))
+	})
+}
+
+func TestWalTransactionChange_Encode(t *testing.T) {
+	roundTrip := func(change walTransactionChange) walTransactionChange {
+		result := walTransactionChange{}
+		assert.NoError(t, result.Decode(change.Encode()))
+		return result
+	}
+
+	t.Run("set", func(t *testing.T) {
+		result := roundTrip(walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   []byte("key1"),
+			Value: []byte("value1"),
+		})
+		assert.Equal(t, walTransactionChangeTypeSet, result.Type)
+		assert.Equal(t, []byte("key1"), []byte(result.Key))
+		assert.Equal(t, []byte("value1"), result.Value)
+	})
+
+	t.Run("set with user meta", func(t *testing.T) {
+		result := roundTrip(walTransactionChange{
+			Type:     walTransactionChangeTypeSet,
+			Key:      []byte("key1"),
+			Value:    []byte("value1"),
+			UserMeta: 0x7f,
+		})
+		assert.Equal(t, walTransactionChangeTypeSet, result.Type)
+		assert.Equal(t, []byte("value1"), result.Value)
+		assert.Equal(t, byte(0x7f), result.UserMeta)
+	})
+
+	t.Run("without user meta", func(t *testing.T) {
+		// Changes without any UserMeta should be encoded exactly as they were before UserMeta
+		// existed.
+		change := walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   []byte("key1"),
+			Value: []byte("value1"),
+		}
+		encoded := change.Encode()
+		assert.Equal(t, byte(walTransactionChangeTypeSet), encoded[0])
+		assert.Len(t, encoded, 1+4+4+4+6)
+	})
+
+	t.Run("set with expiry", func(t *testing.T) {
+		result := roundTrip(walTransactionChange{
+			Type:      walTransactionChangeTypeSet,
+			Key:       []byte("key1"),
+			Value:     []byte("value1"),
+			UserMeta:  0x01,
+			ExpiresAt: 1600000000,
+		})
+		assert.Equal(t, []byte("value1"), result.Value)
+		assert.Equal(t, byte(0x01), result.UserMeta)
+		assert.Equal(t, uint64(1600000000), result.ExpiresAt)
+
+		result = roundTrip(walTransactionChange{
+			Type:      walTransactionChangeTypeSet,
+			Key:       []byte("key1"),
+			Value:     []byte("value1"),
+			ExpiresAt: 1600000000,
+		})
+		assert.Zero(t, result.UserMeta)
+		assert.Equal(t, uint64(1600000000), result.ExpiresAt)
+	})
+
+	t.Run("set empty value", func(t *testing.T) {
+		result := roundTrip(walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   []byte("key1"),
+			Value: []byte{},
+		})
+		assert.Equal(t, walTransactionChangeTypeSet, result.Type)
+		assert.NotNil(t, result.Value)
+		assert.Empty(t, result.Value)
+	})
+
+	t.Run("set nil value", func(t *testing.T) {
+		result := roundTrip(walTransactionChange{
+			Type:  walTransactionChangeTypeSet,
+			Key:   []byte("key1"),
+			Value: nil,
+		})
+		assert.Equal(t, walTransactionChangeTypeSet, result.Type)
+		assert.NotNil(t, result.Value)
+		assert.Empty(t, result.Value)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		result := roundTrip(walTransactionChange{
+			Type:  walTransactionChangeTypeDelete,
+			Key:   []byte("key1"),
+			Value: []byte("ignored"),
+		})
+		assert.Equal(t, walTransactionChangeTypeDelete, result.Type)
+		assert.Nil(t, result.Value)
+	})
+}
+
+func TestWalSegment_GetTransactions(t *testing.T) {
+	t.Run("empty and deleted values", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openWalSegment(dir, 1, 1024, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		err = file.Append(walTransaction{
+			TransactionId: 12345,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: []byte{},
+				},
+				{
+					Type: walTransactionChangeTypeDelete,
+					Key:  []byte("key2"),
+				},
+			},
+		})
+		assert.NoError(t, err)
+
+		transactions, err := file.GetTransactions()
+		assert.NoError(t, err)
+		assert.Len(t, transactions, 1)
+
+		txn := transactions[0]
+		assert.Equal(t, uint64(12345), txn.TransactionId)
+		assert.Len(t, txn.Entries, 2)
+		assert.Equal(t, walTransactionChangeTypeSet, txn.Entries[0].Type)
+		assert.NotNil(t, txn.Entries[0].Value)
+		assert.Empty(t, txn.Entries[0].Value)
+		assert.Equal(t, walTransactionChangeTypeDelete, txn.Entries[1].Type)
+		assert.Nil(t, txn.Entries[1].Value)
+	})
+}
+
+// countingWriter counts the writes made to the file it wraps.
+type countingWriter struct {
+	ReaderWriterAt
+	writes int
+}
+
+func (c *countingWriter) WriteAt(p []byte, offset int64) (int, error) {
+	c.writes++
+	return c.ReaderWriterAt.WriteAt(p, offset)
+}
+
+func TestWalSegment_UpdateTransactions(t *testing.T) {
+	appendTransaction := func(t *testing.T, segment *walSegment, transactionId uint64, size int) {
+		assert.NoError(t, segment.Append(walTransaction{
+			TransactionId: transactionId,
+			Timestamp:     transactionId,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte(fmt.Sprintf("key%d", transactionId)),
+					Value: bytes.Repeat([]byte{1}, size),
+				},
+			},
+		}))
+	}
+
+	t.Run("batched", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		segment, err := openWalSegment(dir, 1, 1<<20, defaultFileMode)
+		assert.NoError(t, err)
+		defer segment.File.(*os.File).Close()
+
+		// Transaction 51 is large enough that the transactions on either side of it are too far
+		// apart to be updated by the same write.
+		for i := uint64(1); i <= 100; i++ {
+			if i == 51 {
+				appendTransaction(t, segment, i, walUpdateCoalesceGap*2)
+			} else {
+				appendTransaction(t, segment, i, 8)
+			}
+		}
+
+		ids := make([]uint64, 0, 100)
+		for i := uint64(1); i <= 100; i++ {
+			if i != 51 {
+				ids = append(ids, i)
+			}
+		}
+
+		counter := &countingWriter{ReaderWriterAt: segment.File}
+		segment.File = counter
+		found, err := segment.UpdateTransactions(append(ids, 1000), 7, 8)
+		assert.NoError(t, err)
+		assert.Equal(t, 99, found)
+		assert.Equal(t, 2, counter.writes)
+
+		transactions, err := segment.GetTransactions()
+		assert.NoError(t, err)
+		assert.Len(t, transactions, 100)
+		for _, txn := range transactions {
+			if txn.TransactionId == 51 {
+				assert.Zero(t, txn.HeapId)
+				assert.Zero(t, txn.ValueFileId)
+			} else {
+				assert.Equal(t, uint64(7), txn.HeapId, "transaction %d", txn.TransactionId)
+				assert.Equal(t, uint64(8), txn.ValueFileId, "transaction %d", txn.TransactionId)
+			}
+
+			// The rest of the transaction is untouched.
+			assert.Equal(t, txn.TransactionId, txn.Timestamp)
+			assert.Len(t, txn.Entries, 1)
+		}
+	})
+
+	t.Run("single transaction", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		segment, err := openWalSegment(dir, 1, 1024, defaultFileMode)
+		assert.NoError(t, err)
+		defer segment.File.(*os.File).Close()
+
+		appendTransaction(t, segment, 1, 8)
+		appendTransaction(t, segment, 2, 8)
+
+		ok, err := segment.UpdateTransaction(2, 3, 4)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = segment.UpdateTransaction(5, 3, 4)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		transactions, err := segment.GetTransactions()
+		assert.NoError(t, err)
+		assert.Zero(t, transactions[0].HeapId)
+		assert.Equal(t, uint64(3), transactions[1].HeapId)
+		assert.Equal(t, uint64(4), transactions[1].ValueFileId)
+	})
+}
+
+func TestWalManager_UpdateTransactions(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	manager, err := newWalManager(dir, 160, defaultFileMode)
+	assert.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, manager.Append(walTransaction{
+			TransactionId: uint64(i + 1),
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte(fmt.Sprintf("key%d", i)),
+					Value: []byte("value"),
+				},
+			},
+		}))
+	}
+
+	// Two transactions fit in each segment, so the first segment has been sealed.
+	assert.Equal(t, uint64(2), manager.currentSegment.SegmentId)
+	found, err := manager.UpdateTransactions(1, []uint64{1, 2, 3}, 5, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, found)
+	found, err = manager.UpdateTransactions(2, []uint64{1, 2, 3}, 5, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, found)
+	assert.NoError(t, manager.SyncBarrier())
+
+	for segmentId, heapIds := range map[uint64][]uint64{1: {5, 5}, 2: {5, 0}} {
+		transactions, err := manager.readSegment(segmentId)
+		assert.NoError(t, err)
+		assert.Len(t, transactions, 2)
+		for i, txn := range transactions {
+			assert.Equal(t, heapIds[i], txn.HeapId, "transaction %d", txn.TransactionId)
+		}
+	}
+
+	// A segment that does not exist is not created.
+	_, err = manager.UpdateTransactions(10, []uint64{1}, 5, 6)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWalTransaction_Decode(t *testing.T) {
+	encoded := (&walTransaction{
+		Timestamp: 1,
+		Entries: []walTransactionChange{
+			{
+				Type:  walTransactionChangeTypeSet,
+				Key:   []byte("key1"),
+				Value: []byte("value1"),
+			},
+			{
+				Type: walTransactionChangeTypeDelete,
+				Key:  []byte("key2"),
+			},
+		},
+	}).Encode()
+
+	t.Run("valid", func(t *testing.T) {
+		txn := walTransaction{}
+		assert.NoError(t, txn.Decode(encoded))
+		assert.Len(t, txn.Entries, 2)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		// Every possible truncation of the transaction must return an error instead of panicking.
+		for i := 0; i < len(encoded); i++ {
+			txn := walTransaction{}
+			assert.Error(t, txn.Decode(encoded[:i]), "truncated to %d bytes", i)
+		}
+	})
+
+	t.Run("trailing data", func(t *testing.T) {
+		txn := walTransaction{}
+		assert.Equal(t, ErrTrailingData, txn.Decode(append(encoded, 0)))
+	})
+
+	t.Run("unknown change type", func(t *testing.T) {
+		change := walTransactionChange{}
+		assert.Equal(t, ErrUnknownChangeType, change.Decode([]byte{0x7f, 0, 0, 0, 0}))
+	})
+}
+
+func TestWalManager_Verify(t *testing.T) {
+	dir, cleanup := NewTempDirectory(t)
+	defer cleanup()
+
+	manager, err := newWalManager(dir, 160, defaultFileMode)
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		err = manager.Append(walTransaction{
+			TransactionId: uint64(i + 1),
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte(fmt.Sprintf("key%d", i)),
+					Value: []byte("value"),
+				},
+			},
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, manager.SyncBarrier())
+
+	t.Run("valid", func(t *testing.T) {
+		assert.NoError(t, manager.Verify(4))
+	})
+
+	t.Run("corrupt segments", func(t *testing.T) {
+		// Corrupt two of the segments, the error for the older one should be returned.
+		for _, segmentId := range []uint64{4, 2} {
+			segment, err := openWalSegment(dir, segmentId, 160, defaultFileMode)
+			assert.NoError(t, err)
+
+			_, dataOffset := segment.Space.Current()
+			_, err = segment.File.WriteAt([]byte{0xff, 0xff}, dataOffset+24)
+			assert.NoError(t, err)
+		}
+
+		err := manager.Verify(4)
+		assert.True(t, errors.Is(err, ErrCorrupted))
+
+		var corruption *CorruptionError
+		if assert.True(t, errors.As(err, &corruption)) {
+			assert.Equal(t, getWalSegmentFileName(2), corruption.File)
+		}
+	})
+}
+
+func TestWalSegment_GetTransactions_Corrupted(t *testing.T) {
+	t.Run("corrupt change data", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		file, err := openWalSegment(dir, 1, 1024, defaultFileMode)
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+
+		err = file.Append(walTransaction{
+			TransactionId: 12345,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: []byte("value1"),
+				},
+			},
+		})
+		assert.NoError(t, err)
+
+		// Overwrite the number of changes in the transaction so it no longer matches the data.
+		_, dataOffset := file.Space.Current()
+		_, err = file.File.WriteAt([]byte{0xff, 0xff}, dataOffset+24)
+		assert.NoError(t, err)
+
+		transactions, err := file.GetTransactions()
+		assert.Nil(t, transactions)
+		assert.True(t, errors.Is(err, ErrCorrupted))
+	})
+}
+
+func TestWalSegment_Encrypted(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		aead, err := newRecordCipher(bytes.Repeat([]byte{1}, 16))
+		assert.NoError(t, err)
+
+		file, err := openWalSegment(dir, 1, 1024, defaultFileMode)
+		assert.NoError(t, err)
+		file.Cipher = aead
+
+		err = file.Append(walTransaction{
+			TransactionId: 12345,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: []byte("secret value"),
+				},
+			},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, file.Sync())
+
+		// The value should not be stored in plaintext anywhere in the file.
+		raw, err := ioutil.ReadFile(path.Join(dir, getWalSegmentFileName(1)))
+		assert.NoError(t, err)
+		assert.False(t, bytes.Contains(raw, []byte("secret value")))
+
+		transactions, err := file.GetTransactions()
+		assert.NoError(t, err)
+		assert.Len(t, transactions, 1)
+		assert.Equal(t, []byte("secret value"), transactions[0].Entries[0].Value)
+
+		// Without the key the transaction cannot be read.
+		file.Cipher = nil
+		transactions, err = file.GetTransactions()
+		assert.Nil(t, transactions)
+		assert.True(t, errors.Is(err, ErrCorrupted))
+	})
+
+	t.Run("update in place", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		aead, err := newRecordCipher(bytes.Repeat([]byte{1}, 16))
+		assert.NoError(t, err)
+
+		file, err := openWalSegment(dir, 1, 1024, defaultFileMode)
+		assert.NoError(t, err)
+		file.Cipher = aead
+
+		err = file.Append(walTransaction{
+			TransactionId: 12345,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: []byte("value1"),
+				},
+			},
+		})
+		assert.NoError(t, err)
+
+		ok, err := file.UpdateTransaction(12345, 1, 1)
+		assert.True(t, ok)
+		assert.Equal(t, ErrEncryptedTransactionUpdate, err)
+	})
+}
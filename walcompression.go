@@ -0,0 +1,102 @@
+package lsmtree
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrBadCompressedTransaction is returned when a compressed transaction is read from the WAL
+	// but it cannot be decompressed back to the size that it was written with.
+	ErrBadCompressedTransaction = errors.New("bad compressed wal transaction")
+)
+
+const (
+	// walHeaderFlagCompressed is set on the end offset in the header of a transaction whose data
+	// is compressed. Offsets within a segment never exceed maxWalSegmentSizeLimit, so the top bit
+	// of the 32-bit offset is never needed for the offset itself.
+	walHeaderFlagCompressed uint32 = 1 << 31
+
+	// walCompressedPrefixSize is the number of bytes at the start of a compressed transaction that
+	// are not compressed: the timestamp, heap id and value file id.
+	walCompressedPrefixSize = 8 + 8 + 8
+
+	// maxDeflateRatio is the most that DEFLATE can shrink data by.
+	maxDeflateRatio = 1032
+)
+
+// Small transactions are not worth compressing: the CPU spent on them is the same for every
+// commit, while the space they would save is a few bytes. Only transactions whose encoded size is
+// larger than Options.WALCompressionThreshold are compressed, which is where large batch commits
+// end up, and a transaction is only written compressed if that actually made it smaller. Whether
+// a transaction is compressed is flagged in its header, so a segment can hold both.
+//
+// The timestamp, heap id and value file id at the start of the encoded transaction are left
+// uncompressed, so that walSegment.UpdateTransactions can still rewrite the heap and value file id
+// in place. They are followed by the size of the rest of the transaction before it was compressed
+// and then the rest of the transaction compressed with DEFLATE. If the WAL is encrypted then the
+// compressed transaction is what is encrypted, since encrypted data does not compress.
+//
+// Versions of the database from before compression was added cannot read a WAL with compressed
+// transactions in it.
+
+// compressTransaction returns the compressed form of the encoded transaction provided, ok is false
+// if compressing it did not make it any smaller.
+func compressTransaction(encoded []byte) (compressed []byte, ok bool) {
+	if len(encoded) <= walCompressedPrefixSize {
+		return nil, false
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(encoded)))
+	buf.Write(encoded[:walCompressedPrefixSize])
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(encoded)-walCompressedPrefixSize))
+	buf.Write(size)
+
+	// The writer only returns an error for an invalid level or if the buffer fails to write.
+	writer, _ := flate.NewWriter(buf, flate.DefaultCompression)
+	_, _ = writer.Write(encoded[walCompressedPrefixSize:])
+	_ = writer.Close()
+
+	if buf.Len() >= len(encoded) {
+		return nil, false
+	}
+
+	return buf.Bytes(), true
+}
+
+// decompressTransaction returns the encoded transaction that was compressed by
+// compressTransaction.
+func decompressTransaction(compressed []byte) ([]byte, error) {
+	if len(compressed) < walCompressedPrefixSize+4 {
+		return nil, ErrBadCompressedTransaction
+	}
+
+	// The size is checked against the most the data could decompress to before anything is
+	// allocated, so that a corrupt size cannot be used to allocate an enormous buffer.
+	size := binary.BigEndian.Uint32(compressed[walCompressedPrefixSize:])
+	if uint64(size) > uint64(len(compressed))*maxDeflateRatio {
+		return nil, ErrBadCompressedTransaction
+	}
+
+	encoded := make([]byte, walCompressedPrefixSize+int(size))
+	copy(encoded, compressed[:walCompressedPrefixSize])
+
+	reader := flate.NewReader(bytes.NewReader(compressed[walCompressedPrefixSize+4:]))
+	defer reader.Close()
+
+	if _, err := io.ReadFull(reader, encoded[walCompressedPrefixSize:]); err != nil {
+		return nil, ErrBadCompressedTransaction
+	}
+
+	// The transaction must end exactly where the compressed data does.
+	if n, err := reader.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		return nil, ErrBadCompressedTransaction
+	}
+
+	return encoded, nil
+}
@@ -0,0 +1,195 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"testing"
+)
+
+func TestWalSegment_Compressed(t *testing.T) {
+	// newTransaction returns a transaction with a value that compresses well.
+	newTransaction := func(id uint64, valueSize int) walTransaction {
+		return walTransaction{
+			TransactionId: id,
+			Timestamp:     id,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key"),
+					Value: bytes.Repeat([]byte("compressible "), valueSize/13),
+				},
+			},
+		}
+	}
+
+	// headerFlags returns whether each transaction in the segment is flagged as compressed.
+	headerFlags := func(t *testing.T, segment *walSegment) []bool {
+		headers, err := segment.readHeaders()
+		assert.NoError(t, err)
+
+		flags := make([]bool, 0, len(headers)/16)
+		for i := 0; i < len(headers); i += 16 {
+			end := binary.BigEndian.Uint32(headers[i+12 : i+16])
+			flags = append(flags, end&walHeaderFlagCompressed != 0)
+		}
+
+		return flags
+	}
+
+	t.Run("threshold", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		segment, err := openWalSegment(dir, 1, 1<<16, defaultFileMode)
+		assert.NoError(t, err)
+		segment.CompressionThreshold = 1024
+
+		// Only the transaction over the threshold is compressed.
+		small, large := newTransaction(1, 512), newTransaction(2, 8192)
+		assert.NoError(t, segment.Append(small))
+		assert.NoError(t, segment.Append(large))
+		assert.NoError(t, segment.Sync())
+		assert.Equal(t, []bool{false, true}, headerFlags(t, segment))
+
+		headerEnd, dataStart := segment.Space.Current()
+		used := int(headerEnd) + (1<<16 - int(dataStart))
+		assert.True(t, used < len(small.Encode())+len(large.Encode()))
+
+		// Compressed transactions are read back the same whatever the threshold is now.
+		segment.CompressionThreshold = 0
+		transactions, err := segment.GetTransactions()
+		assert.NoError(t, err)
+		assert.Equal(t, []walTransaction{small, large}, transactions)
+	})
+
+	t.Run("incompressible", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		segment, err := openWalSegment(dir, 1, 1<<16, defaultFileMode)
+		assert.NoError(t, err)
+		segment.CompressionThreshold = 16
+
+		// A transaction that does not get any smaller is written as it is.
+		txn := newTransaction(1, 0)
+		txn.Entries[0].Value = make([]byte, 2048)
+		rand.New(rand.NewSource(1)).Read(txn.Entries[0].Value)
+		_, ok := compressTransaction(txn.Encode())
+		assert.False(t, ok)
+
+		assert.NoError(t, segment.Append(txn))
+		assert.Equal(t, []bool{false}, headerFlags(t, segment))
+	})
+
+	t.Run("update in place", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		segment, err := openWalSegment(dir, 1, 1<<16, defaultFileMode)
+		assert.NoError(t, err)
+		segment.CompressionThreshold = 1
+
+		// The heap and value file ids are not compressed, so they can still be rewritten.
+		assert.NoError(t, segment.Append(newTransaction(1, 4096)))
+		found, err := segment.UpdateTransactions([]uint64{1}, 7, 8)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, found)
+
+		transactions, err := segment.GetTransactions()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(7), transactions[0].HeapId)
+		assert.Equal(t, uint64(8), transactions[0].ValueFileId)
+		assert.Equal(t, newTransaction(1, 4096).Entries, transactions[0].Entries)
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		aead, err := newRecordCipher(bytes.Repeat([]byte{1}, 16))
+		assert.NoError(t, err)
+
+		segment, err := openWalSegment(dir, 1, 1<<16, defaultFileMode)
+		assert.NoError(t, err)
+		segment.Cipher, segment.CompressionThreshold = aead, 1
+
+		txn := newTransaction(1, 4096)
+		assert.NoError(t, segment.Append(txn))
+		assert.Equal(t, []bool{true}, headerFlags(t, segment))
+
+		transactions, err := segment.GetTransactions()
+		assert.NoError(t, err)
+		assert.Equal(t, []walTransaction{txn}, transactions)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		segment, err := openWalSegment(dir, 1, 1<<16, defaultFileMode)
+		assert.NoError(t, err)
+		segment.CompressionThreshold = 1
+		assert.NoError(t, segment.Append(newTransaction(1, 4096)))
+		assert.NoError(t, segment.Sync())
+
+		// Claim that the transaction was larger than it was before it was compressed.
+		_, dataStart := segment.Space.Current()
+		size := make([]byte, 4)
+		_, err = segment.File.ReadAt(size, dataStart+walCompressedPrefixSize)
+		assert.NoError(t, err)
+		binary.BigEndian.PutUint32(size, binary.BigEndian.Uint32(size)+1)
+		_, err = segment.File.WriteAt(size, dataStart+walCompressedPrefixSize)
+		assert.NoError(t, err)
+
+		_, err = segment.GetTransactions()
+		assert.True(t, errors.Is(err, ErrBadCompressedTransaction))
+		assert.True(t, errors.Is(err, ErrCorrupted))
+	})
+
+	t.Run("database", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		options := DefaultOptions()
+		options.DataDirectory, options.WALDirectory = dir, dir
+		options.WALCompressionThreshold = 256
+
+		db, err := Open(options)
+		assert.NoError(t, err)
+
+		value := bytes.Repeat([]byte("compressible "), 200)
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("key"), value))
+		assert.NoError(t, txn.Commit())
+		assert.NoError(t, db.Close())
+
+		raw, err := ioutil.ReadFile(path.Join(dir, getWalSegmentFileName(1)))
+		assert.NoError(t, err)
+		assert.False(t, bytes.Contains(raw, value))
+
+		// Recovery reads the compressed transaction without needing the option.
+		options.WALCompressionThreshold = 0
+		db, err = Open(options)
+		assert.NoError(t, err)
+		defer db.Close()
+
+		txn, err = db.NewTransaction(TxnOptions{ReadOnly: true})
+		assert.NoError(t, err)
+		defer txn.Discard()
+		item, err := txn.Get(Key("key"))
+		assert.NoError(t, err)
+		assert.Equal(t, value, item.Value)
+	})
+
+	t.Run("invalid threshold", func(t *testing.T) {
+		options := DefaultOptions()
+		options.WALCompressionThreshold = -1
+		assert.True(t, errors.Is(options.validate(), ErrInvalidOptions))
+	})
+}
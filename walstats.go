@@ -0,0 +1,205 @@
+package lsmtree
+
+import (
+	"io"
+	"os"
+	"path"
+	"sync/atomic"
+)
+
+// Each WAL segment is preallocated to Options.MaxWALSegmentSize, with headers growing from the
+// start of the file and transaction data growing from the end, so a segment is sealed once the two
+// meet. A segment can only be removed once every transaction in it has been flushed to a heap file.
+// The stats here describe how full each segment is and how much of it is still waiting to be
+// flushed, so that operators can tell whether segments are sized sensibly for their transactions:
+// a lot of free space in sealed segments means transactions are regularly larger than the space
+// left, and a very large number of segments means they are too small.
+
+type (
+	// WALSegmentStats describe how a single WAL segment is being used.
+	WALSegmentStats struct {
+		// SegmentId is the id of the segment, segments with larger ids are more recent.
+		SegmentId uint64
+
+		// Size is the size of the segment file in bytes. This is Options.MaxWALSegmentSize unless
+		// a transaction was too large to fit in a segment of that size.
+		Size uint64
+
+		// BytesUsed is the number of bytes in the segment used by the freeSpace map, transaction
+		// headers and transaction data.
+		BytesUsed uint64
+
+		// BytesFree is the number of bytes between the transaction headers and the transaction
+		// data according to the freeSpace map. Sealed segments never use this space.
+		BytesFree uint64
+
+		// Transactions is the number of transactions in the segment, including flush markers.
+		Transactions uint64
+
+		// Flushed is the number of transactions in the segment whose changes have been written to
+		// a heap file, either in place or by a flush marker in any segment.
+		Flushed uint64
+
+		// Unflushed is the number of transactions in the segment that have not been flushed yet.
+		// This includes prepared transactions and the transactions that resolve them.
+		Unflushed uint64
+
+		// Markers is the number of flush markers in the segment, they are never flushed
+		// themselves.
+		Markers uint64
+	}
+
+	// WALStats is the total of the WALSegmentStats of every segment.
+	WALStats struct {
+		// Segments is the number of WAL segments.
+		Segments int
+
+		// BytesUsed is the total of WALSegmentStats.BytesUsed.
+		BytesUsed uint64
+
+		// BytesFree is the total of WALSegmentStats.BytesFree.
+		BytesFree uint64
+
+		// Transactions is the total of WALSegmentStats.Transactions.
+		Transactions uint64
+
+		// Flushed is the total of WALSegmentStats.Flushed.
+		Flushed uint64
+
+		// Unflushed is the total of WALSegmentStats.Unflushed.
+		Unflushed uint64
+
+		// Markers is the total of WALSegmentStats.Markers.
+		Markers uint64
+	}
+)
+
+// WALStats returns how each of the segments in the WAL is being used, oldest first. Every
+// transaction in the WAL is read to find out which of them have been flushed, so this is not meant
+// to be called often.
+func (db *DB) WALStats() ([]WALSegmentStats, error) {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return nil, ErrClosed
+	}
+
+	return db.wal.Stats()
+}
+
+// Stats returns how each of the segments in the directory is being used, oldest first.
+func (w *walManager) Stats() ([]WALSegmentStats, error) {
+	segmentIds, err := listFiles(w.Directory, fileTypeWal)
+	if err != nil {
+		return nil, err
+	}
+
+	// A flush marker can be in a later segment than the transactions it refers to, so the
+	// transactions are only counted once every segment has been read.
+	stats := make([]WALSegmentStats, len(segmentIds))
+	pending := make([][]uint64, len(segmentIds))
+	flushed := map[uint64]struct{}{}
+	for i, segmentId := range segmentIds {
+		transactions, err := w.segmentStats(segmentId, &stats[i])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, txn := range transactions {
+			stats[i].Transactions++
+			if ids, _, ok := decodeFlushMarker(txn); ok {
+				stats[i].Markers++
+				for _, id := range ids {
+					flushed[id] = struct{}{}
+				}
+			} else if txn.HeapId != 0 {
+				stats[i].Flushed++
+			} else {
+				pending[i] = append(pending[i], txn.TransactionId)
+			}
+		}
+	}
+
+	for i, ids := range pending {
+		for _, id := range ids {
+			if _, ok := flushed[id]; ok {
+				stats[i].Flushed++
+			} else {
+				stats[i].Unflushed++
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// segmentStats fills in the size of the segment specified and returns its transactions. The
+// current segment is read while the appendLock is held, because the freeSpace map of the segment
+// on the disk is only written when it is synced.
+func (w *walManager) segmentStats(
+	segmentId uint64, stats *WALSegmentStats,
+) ([]walTransaction, error) {
+	stat, err := os.Stat(path.Join(w.Directory, getWalSegmentFileName(segmentId)))
+	if err != nil {
+		return nil, err
+	}
+
+	w.appendLock.Lock()
+	segment := w.currentSegment
+	if segment != nil && segment.SegmentId == segmentId {
+		defer w.appendLock.Unlock()
+	} else {
+		w.appendLock.Unlock()
+
+		if segment, err = openWalSegment(
+			w.Directory, segmentId, int32(w.MaxWALSegmentSize), w.FileMode,
+		); err != nil {
+			return nil, err
+		}
+		segment.Cipher = w.cipher
+
+		if closer, ok := segment.File.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+
+	headerEnd, dataStart := segment.Space.Current()
+	stats.SegmentId = segmentId
+	stats.Size = uint64(stat.Size())
+	if free := dataStart - headerEnd; free > 0 {
+		stats.BytesFree = uint64(free)
+	}
+	if stats.Size > stats.BytesFree {
+		stats.BytesUsed = stats.Size - stats.BytesFree
+	}
+
+	return segment.GetTransactions()
+}
+
+// walStatsTotal returns the total of the stats of every segment.
+func walStatsTotal(segments []WALSegmentStats) WALStats {
+	total := WALStats{
+		Segments: len(segments),
+	}
+	for _, segment := range segments {
+		total.BytesUsed += segment.BytesUsed
+		total.BytesFree += segment.BytesFree
+		total.Transactions += segment.Transactions
+		total.Flushed += segment.Flushed
+		total.Unflushed += segment.Unflushed
+		total.Markers += segment.Markers
+	}
+
+	return total
+}
+
+// Add returns the sum of the two sets of stats.
+func (s WALStats) Add(other WALStats) WALStats {
+	return WALStats{
+		Segments:     s.Segments + other.Segments,
+		BytesUsed:    s.BytesUsed + other.BytesUsed,
+		BytesFree:    s.BytesFree + other.BytesFree,
+		Transactions: s.Transactions + other.Transactions,
+		Flushed:      s.Flushed + other.Flushed,
+		Unflushed:    s.Unflushed + other.Unflushed,
+		Markers:      s.Markers + other.Markers,
+	}
+}
@@ -0,0 +1,142 @@
+package lsmtree
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWalManager_Stats(t *testing.T) {
+	// appendCommits appends committed transactions 1 through count, two fit in each segment.
+	appendCommits := func(t *testing.T, manager *walManager, count int) {
+		for i := 1; i <= count; i++ {
+			assert.NoError(t, manager.Append(walTransaction{
+				TransactionId: uint64(i),
+				Timestamp:     uint64(i),
+				Entries: []walTransactionChange{
+					{
+						Type:  walTransactionChangeTypeSet,
+						Key:   []byte(fmt.Sprintf("key%d", i)),
+						Value: []byte("value"),
+					},
+				},
+			}))
+		}
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+
+		stats, err := manager.Stats()
+		assert.NoError(t, err)
+		assert.Empty(t, stats)
+		assert.Equal(t, WALStats{}, walStatsTotal(stats))
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+		appendCommits(t, manager, 3)
+
+		// The current segment has not been synced, so its freeSpace map is only in memory.
+		stats, err := manager.Stats()
+		assert.NoError(t, err)
+		assert.Len(t, stats, 2)
+		for i, segment := range stats {
+			assert.Equal(t, uint64(i+1), segment.SegmentId)
+			assert.Equal(t, uint64(160), segment.Size)
+			assert.Equal(t, segment.Size, segment.BytesUsed+segment.BytesFree)
+		}
+
+		txnSize := uint64(16 + len((&walTransaction{
+			Timestamp: 1,
+			Entries: []walTransactionChange{
+				{
+					Type:  walTransactionChangeTypeSet,
+					Key:   []byte("key1"),
+					Value: []byte("value"),
+				},
+			},
+		}).Encode()))
+		assert.Equal(t, 8+2*txnSize, stats[0].BytesUsed)
+		assert.Equal(t, 8+txnSize, stats[1].BytesUsed)
+		assert.Equal(t, uint64(2), stats[0].Transactions)
+		assert.Equal(t, uint64(1), stats[1].Transactions)
+	})
+
+	t.Run("flushed", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+		appendCommits(t, manager, 4)
+
+		// The marker for transactions in the first two segments is appended to the third.
+		assert.NoError(t, manager.RecordFlush(100, []uint64{1, 2, 3}, 7, 8))
+
+		stats, err := manager.Stats()
+		assert.NoError(t, err)
+		assert.Len(t, stats, 3)
+		assert.Equal(t, WALStats{
+			Segments:     3,
+			BytesUsed:    walStatsTotal(stats).BytesUsed,
+			BytesFree:    walStatsTotal(stats).BytesFree,
+			Transactions: 5,
+			Flushed:      3,
+			Unflushed:    1,
+			Markers:      1,
+		}, walStatsTotal(stats))
+		assert.Equal(t, uint64(2), stats[0].Flushed)
+		assert.Equal(t, uint64(1), stats[1].Flushed)
+		assert.Equal(t, uint64(1), stats[1].Unflushed)
+		assert.Equal(t, uint64(1), stats[2].Markers)
+	})
+
+	t.Run("in place", func(t *testing.T) {
+		dir, cleanup := NewTempDirectory(t)
+		defer cleanup()
+
+		manager, err := newWalManager(dir, 160, defaultFileMode)
+		assert.NoError(t, err)
+		manager.inPlaceFlushUpdates = true
+		appendCommits(t, manager, 4)
+		assert.NoError(t, manager.RecordFlush(100, []uint64{1, 4}, 7, 8))
+
+		stats, err := manager.Stats()
+		assert.NoError(t, err)
+		assert.Len(t, stats, 2)
+		for _, segment := range stats {
+			assert.Equal(t, uint64(1), segment.Flushed)
+			assert.Equal(t, uint64(1), segment.Unflushed)
+			assert.Zero(t, segment.Markers)
+		}
+	})
+
+	t.Run("db", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, txn.Set(Key("key"), []byte("value")))
+		assert.NoError(t, txn.Commit())
+
+		stats, err := db.WALStats()
+		assert.NoError(t, err)
+		assert.Equal(t, walStatsTotal(stats), db.Metrics().WAL)
+		assert.Equal(t, uint64(1), db.Metrics().WAL.Unflushed)
+		assert.Equal(t, 1, db.Metrics().WAL.Segments)
+
+		assert.NoError(t, db.Close())
+		_, err = db.WALStats()
+		assert.Equal(t, ErrClosed, err)
+	})
+}
@@ -0,0 +1,290 @@
+package lsmtree
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// minWatchRetryDelay is how long a watch waits before calling its function again after the
+	// function returned an error. The delay doubles each time up to maxWatchRetryDelay.
+	minWatchRetryDelay = 10 * time.Millisecond
+
+	// maxWatchRetryDelay is the longest a watch will wait between calls to a failing function.
+	maxWatchRetryDelay = time.Second
+)
+
+type (
+	// Change is a single key that was changed by a committed transaction.
+	Change struct {
+		Key Key
+
+		// Value is the new value of the key, it is nil if the key was deleted. The key and value
+		// are shared with the database and must not be modified.
+		Value []byte
+
+		// UserMeta is the metadata byte that was stored alongside the value.
+		UserMeta byte
+
+		// Timestamp is the commit timestamp of the transaction that made the change.
+		Timestamp uint64
+	}
+
+	// Watch delivers committed changes for keys that start with a prefix. See DB.Watch.
+	Watch struct {
+		db     *DB
+		prefix Key
+		fn     func(change Change) error
+
+		// queue holds the changes from each committed transaction that have not been delivered
+		// yet. When it is full commits wait for the watch to catch up.
+		queue chan []Change
+
+		// pending is the number of transactions in the queue or being delivered. It is only
+		// modified atomically.
+		pending int32
+
+		// subscriber tracks how many WAL segments the watch has not consumed yet.
+		subscriber *walSubscriber
+
+		// closed is closed by Close to stop the watch, done is closed once the watch has stopped.
+		closed    chan struct{}
+		closeOnce sync.Once
+		done      chan struct{}
+
+		// err is why the watch was disconnected, it is set before closed is closed.
+		errLock sync.Mutex
+		err     error
+	}
+
+	// watchList is every watch that has not been closed.
+	watchList struct {
+		lock    sync.RWMutex
+		watches []*Watch
+
+		// count is the number of watches, it is read atomically so that commits do not need to
+		// take the lock when there are no watches.
+		count int32
+	}
+)
+
+// Watch calls fn with every change committed to a key that starts with prefix, starting with the
+// next transaction that is committed. Changes are delivered one at a time from a single goroutine
+// in the order they became visible, which is commit order unless Options.UnorderedWrites is
+// enabled. An empty prefix watches every key.
+//
+// Delivery is at least once: if fn returns an error then it is called again with the same change
+// after a short delay until it succeeds or the watch is closed. Once fn succeeds the next change is
+// delivered.
+//
+// Up to Options.WatchBufferSize transactions are queued for the watch, once the queue is full
+// commits wait for the watch to catch up. Because of this fn should not wait on a commit to the
+// same database, it should hand the work off to another goroutine instead.
+//
+// Changes that are still queued when the watch or the database is closed are not delivered. Close
+// must be called once the watch is no longer needed.
+//
+// If Options.MaxWatchLagSegments is set then a watch that falls that many WAL segments behind is
+// disconnected: it stops, Done is closed and Err returns ErrWatchTooSlow.
+func (db *DB) Watch(prefix Key, fn func(change Change) error) (*Watch, error) {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return nil, ErrClosed
+	}
+
+	watch := &Watch{
+		db:     db,
+		prefix: append(Key{}, prefix...),
+		fn:     fn,
+		queue:  make(chan []Change, db.options.WatchBufferSize),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	committed := atomic.LoadUint64(&db.committed)
+	watch.subscriber = db.wal.watchLag.Subscribe(committed, watch.disconnect)
+	db.watches.Add(watch)
+
+	goBackground("watch", watch.run)
+
+	return watch, nil
+}
+
+// Close stops the watch and waits for fn to return if it is being called. Calling Close more than
+// once does nothing. Close must not be called from within fn.
+func (w *Watch) Close() {
+	w.closeOnce.Do(func() {
+		w.db.watches.Remove(w)
+		close(w.closed)
+	})
+	w.db.wal.watchLag.Unsubscribe(w.subscriber)
+
+	<-w.done
+}
+
+// Done returns a channel that is closed once the watch has stopped, either because it was closed,
+// it was disconnected or the database was closed.
+func (w *Watch) Done() <-chan struct{} {
+	return w.done
+}
+
+// Err returns ErrWatchTooSlow if the watch was disconnected because it fell too far behind, see
+// Options.MaxWatchLagSegments. Otherwise it returns nil.
+func (w *Watch) Err() error {
+	w.errLock.Lock()
+	defer w.errLock.Unlock()
+
+	return w.err
+}
+
+// disconnect stops the watch because of the error provided. Unlike Close this does not wait for
+// the watch to stop, since it is called while a commit is in progress.
+func (w *Watch) disconnect(err error) {
+	w.closeOnce.Do(func() {
+		if logger := w.db.options.Logger; logger != nil {
+			logger.Printf("watch on prefix %q disconnected: %v", w.prefix, err)
+		}
+
+		w.errLock.Lock()
+		w.err = err
+		w.errLock.Unlock()
+
+		w.db.watches.Remove(w)
+		close(w.closed)
+	})
+}
+
+// run delivers the changes in the queue until the watch or the database is closed.
+func (w *Watch) run() {
+	defer close(w.done)
+
+	for {
+		select {
+		case changes := <-w.queue:
+			for _, change := range changes {
+				// A watch that was disconnected stops as soon as the change it is delivering has
+				// been handled.
+				select {
+				case <-w.closed:
+					return
+				default:
+				}
+
+				if !w.deliver(change) {
+					return
+				}
+			}
+			w.subscriber.Consumed(changes[0].Timestamp)
+			atomic.AddInt32(&w.pending, -1)
+		case <-w.closed:
+			return
+		case <-w.db.stopped:
+			return
+		}
+	}
+}
+
+// deliver calls fn with the change until it succeeds. It returns false if the watch was closed
+// before the change could be delivered.
+func (w *Watch) deliver(change Change) bool {
+	delay := minWatchRetryDelay
+	for {
+		err := w.fn(change)
+		if err == nil {
+			return true
+		}
+
+		if logger := w.db.options.Logger; logger != nil {
+			logger.Printf("watch failed to handle change to %q, retrying in %s: %v",
+				change.Key, delay, err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-w.closed:
+			return false
+		case <-w.db.stopped:
+			return false
+		}
+
+		if delay *= 2; delay > maxWatchRetryDelay {
+			delay = maxWatchRetryDelay
+		}
+	}
+}
+
+// Add adds the watch to the list so that it will receive changes.
+func (l *watchList) Add(watch *Watch) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.watches = append(l.watches, watch)
+	atomic.StoreInt32(&l.count, int32(len(l.watches)))
+}
+
+// Remove removes the watch from the list.
+func (l *watchList) Remove(watch *Watch) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for i, existing := range l.watches {
+		if existing == watch {
+			l.watches = append(l.watches[:i], l.watches[i+1:]...)
+			break
+		}
+	}
+	atomic.StoreInt32(&l.count, int32(len(l.watches)))
+}
+
+// Notify queues the changes of a committed transaction for every watch with a matching prefix. If
+// a watch's queue is full then this waits until there is room, the watch is closed or stopped is
+// closed.
+func (l *watchList) Notify(
+	timestamp uint64, changes []walTransactionChange, stopped <-chan struct{},
+) {
+	if atomic.LoadInt32(&l.count) == 0 {
+		return
+	}
+
+	l.lock.RLock()
+	watches := append([]*Watch{}, l.watches...)
+	l.lock.RUnlock()
+
+	for _, watch := range watches {
+		var matched []Change
+		for _, change := range changes {
+			if !bytes.HasPrefix(change.Key, watch.prefix) {
+				continue
+			}
+
+			value := change.Value
+			if change.Type == walTransactionChangeTypeSet && value == nil {
+				value = []byte{}
+			}
+
+			matched = append(matched, Change{
+				Key:       change.Key,
+				Value:     value,
+				UserMeta:  change.UserMeta,
+				Timestamp: timestamp,
+			})
+		}
+
+		if len(matched) == 0 {
+			// The watch does not need anything from this transaction. If it has caught up with
+			// everything before it then it has consumed this transaction as well.
+			if atomic.LoadInt32(&watch.pending) == 0 {
+				watch.subscriber.Consumed(timestamp)
+			}
+			continue
+		}
+
+		atomic.AddInt32(&watch.pending, 1)
+		select {
+		case watch.queue <- matched:
+		case <-watch.closed:
+		case <-stopped:
+			return
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package lsmtree
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	commit := func(t *testing.T, db *DB, pairs ...string) {
+		txn, err := db.NewTransaction(TxnOptions{})
+		assert.NoError(t, err)
+		for i := 0; i < len(pairs); i += 2 {
+			if pairs[i+1] == "" {
+				assert.NoError(t, txn.Delete(Key(pairs[i])))
+				continue
+			}
+			assert.NoError(t, txn.Set(Key(pairs[i]), []byte(pairs[i+1])))
+		}
+		assert.NoError(t, txn.Commit())
+	}
+
+	t.Run("prefix", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		defer cleanup()
+
+		// Changes committed before the watch is created are not delivered.
+		commit(t, db, "user:0", "old")
+
+		received := make(chan Change, 16)
+		watch, err := db.Watch(Key("user:"), func(change Change) error {
+			received <- change
+			return nil
+		})
+		assert.NoError(t, err)
+		defer watch.Close()
+
+		commit(t, db, "user:1", "a", "other", "b")
+		commit(t, db, "user:1", "")
+		commit(t, db, "user:2", "c")
+
+		var changes []Change
+		for i := 0; i < 3; i++ {
+			select {
+			case change := <-received:
+				changes = append(changes, change)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for change")
+			}
+		}
+
+		assert.Equal(t, Key("user:1"), changes[0].Key)
+		assert.Equal(t, []byte("a"), changes[0].Value)
+		assert.Equal(t, Key("user:1"), changes[1].Key)
+		assert.Nil(t, changes[1].Value)
+		assert.Equal(t, Key("user:2"), changes[2].Key)
+		assert.True(t, changes[0].Timestamp < changes[1].Timestamp)
+		assert.True(t, changes[1].Timestamp < changes[2].Timestamp)
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		options := DefaultOptions()
+		options.Logger = nil
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		var lock sync.Mutex
+		attempts := map[string]int{}
+		received := make(chan string, 16)
+		watch, err := db.Watch(nil, func(change Change) error {
+			lock.Lock()
+			defer lock.Unlock()
+
+			attempts[string(change.Key)]++
+			if attempts[string(change.Key)] < 3 {
+				return errors.New("try again")
+			}
+			received <- string(change.Key)
+			return nil
+		})
+		assert.NoError(t, err)
+		defer watch.Close()
+
+		commit(t, db, "a", "1")
+		commit(t, db, "b", "1")
+
+		for _, expected := range []string{"a", "b"} {
+			select {
+			case key := <-received:
+				assert.Equal(t, expected, key)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for change")
+			}
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		assert.Equal(t, 3, attempts["a"])
+	})
+
+	t.Run("backpressure", func(t *testing.T) {
+		options := DefaultOptions()
+		options.WatchBufferSize = 0
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		release := make(chan struct{})
+		watch, err := db.Watch(nil, func(change Change) error {
+			<-release
+			return nil
+		})
+		assert.NoError(t, err)
+
+		// The first commit is picked up by the watch, which then blocks. The second commit has
+		// nowhere to go and has to wait.
+		commit(t, db, "a", "1")
+		committed := make(chan struct{})
+		go func() {
+			commit(t, db, "b", "1")
+			close(committed)
+		}()
+
+		select {
+		case <-committed:
+			t.Fatal("commit should wait for the watch")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		select {
+		case <-committed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for commit")
+		}
+
+		watch.Close()
+		watch.Close()
+	})
+
+	t.Run("disconnect slow watch", func(t *testing.T) {
+		options := DefaultOptions()
+		options.MaxWatchLagSegments = 2
+		options.Logger = nil
+		options.WatchBufferSize = 1024
+		db, cleanup := newTestDB(t, options)
+		defer cleanup()
+
+		release := make(chan struct{})
+		slow, err := db.Watch(nil, func(change Change) error {
+			<-release
+			return nil
+		})
+		assert.NoError(t, err)
+		defer slow.Close()
+
+		// A watch on keys that are never written keeps up without receiving anything.
+		idle, err := db.Watch(Key("idle:"), func(change Change) error { return nil })
+		assert.NoError(t, err)
+		defer idle.Close()
+
+		// Each value takes up a good part of a segment, so the WAL moves through several segments
+		// while the slow watch is stuck on the first change.
+		value := string(make([]byte, int(options.MaxWALSegmentSize)/3))
+		for i := 0; i < 20; i++ {
+			commit(t, db, "key", value)
+		}
+
+		assert.Equal(t, ErrWatchTooSlow, slow.Err())
+
+		// The watch stops once the change it is stuck on has been handled.
+		close(release)
+		select {
+		case <-slow.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the watch to stop")
+		}
+
+		assert.NoError(t, idle.Err())
+		select {
+		case <-idle.Done():
+			t.Fatal("idle watch should not be disconnected")
+		default:
+		}
+
+		// Only the current segment is counted now that nothing is lagging.
+		db.wal.watchLag.lock.Lock()
+		db.wal.watchLag.release()
+		assert.Len(t, db.wal.watchLag.segments, 1)
+		db.wal.watchLag.lock.Unlock()
+	})
+
+	t.Run("closed database", func(t *testing.T) {
+		db, cleanup := newTestDB(t, DefaultOptions())
+		cleanup()
+
+		_, err := db.Watch(nil, func(change Change) error { return nil })
+		assert.Equal(t, ErrClosed, err)
+	})
+}
@@ -0,0 +1,164 @@
+package lsmtree
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrWatchTooSlow is returned by Watch.Err when a watch was disconnected because it fell more
+	// than Options.MaxWatchLagSegments WAL segments behind the writes to the database.
+	ErrWatchTooSlow = errors.New("watch too slow, disconnected")
+)
+
+type (
+	// watchLag measures how far subscribers like watches are behind the WAL, in segments. Once a
+	// subscriber has not consumed more than maxLag segments it is disconnected.
+	//
+	// Memtables are never flushed, so the WAL is the only copy of the data on disk and its
+	// segments are never deleted. Segments are only counted here, they are not kept or released
+	// for the subscribers.
+	watchLag struct {
+		lock sync.Mutex
+
+		// maxLag is the largest number of segments a subscriber can have not consumed. If this is
+		// 0 then subscribers are never disconnected.
+		maxLag int
+
+		// segments are the segments that at least one subscriber has not consumed yet, oldest
+		// first. The last segment is always the current segment.
+		segments []segmentTimestamp
+
+		subscribers map[*walSubscriber]struct{}
+	}
+
+	// segmentTimestamp is a WAL segment and the newest timestamp that was appended to it.
+	segmentTimestamp struct {
+		id        uint64
+		timestamp uint64
+	}
+
+	// walSubscriber is something that reads the changes of every transaction as they are
+	// committed.
+	walSubscriber struct {
+		// consumed is the newest timestamp that the subscriber has finished with, every
+		// transaction at or before it has been consumed. It is only modified atomically.
+		consumed uint64
+
+		// disconnect is called once if the subscriber falls too far behind.
+		disconnect func(err error)
+	}
+)
+
+func newWatchLag(maxLag int) *watchLag {
+	return &watchLag{
+		maxLag:      maxLag,
+		subscribers: map[*walSubscriber]struct{}{},
+	}
+}
+
+// Subscribe adds a subscriber that has consumed everything up to and including the timestamp
+// provided. If the subscriber falls too far behind then it is removed and disconnect is called
+// with ErrWatchTooSlow, disconnect must not call back into the watchLag.
+func (r *watchLag) Subscribe(consumed uint64, disconnect func(err error)) *walSubscriber {
+	subscriber := &walSubscriber{
+		consumed:   consumed,
+		disconnect: disconnect,
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.subscribers[subscriber] = struct{}{}
+
+	return subscriber
+}
+
+// Unsubscribe removes the subscriber. Unsubscribing a subscriber that has been disconnected does
+// nothing.
+func (r *watchLag) Unsubscribe(subscriber *walSubscriber) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.subscribers, subscriber)
+	r.release()
+}
+
+// Consumed records that the subscriber has finished with every transaction at or before the
+// timestamp. Timestamps older than the one already recorded are ignored.
+func (s *walSubscriber) Consumed(timestamp uint64) {
+	for {
+		consumed := atomic.LoadUint64(&s.consumed)
+		if consumed >= timestamp || atomic.CompareAndSwapUint64(&s.consumed, consumed, timestamp) {
+			return
+		}
+	}
+}
+
+// Appended records that a transaction with the timestamp was appended to the segment. This must
+// be called while the WAL's appendLock is held so that segments are seen in order. When a new
+// segment is started the subscribers that are now too far behind are disconnected.
+func (r *watchLag) Appended(segmentId, timestamp uint64) {
+	r.lock.Lock()
+
+	if last := len(r.segments) - 1; last >= 0 && r.segments[last].id == segmentId {
+		if timestamp > r.segments[last].timestamp {
+			r.segments[last].timestamp = timestamp
+		}
+		r.lock.Unlock()
+		return
+	}
+
+	r.segments = append(r.segments, segmentTimestamp{
+		id:        segmentId,
+		timestamp: timestamp,
+	})
+	slow := r.slowSubscribers()
+	r.release()
+	r.lock.Unlock()
+
+	for _, subscriber := range slow {
+		subscriber.disconnect(ErrWatchTooSlow)
+	}
+}
+
+// slowSubscribers removes and returns every subscriber that has more than maxLag sealed segments
+// that it has not finished consuming. The current segment is not counted. The lock must be held.
+func (r *watchLag) slowSubscribers() []*walSubscriber {
+	sealed := len(r.segments) - 1
+	if r.maxLag == 0 || sealed <= r.maxLag {
+		return nil
+	}
+
+	// Any subscriber that has not consumed everything in this segment is too far behind, since it
+	// and every sealed segment after it have not been consumed.
+	limit := r.segments[sealed-r.maxLag-1]
+
+	var slow []*walSubscriber
+	for subscriber := range r.subscribers {
+		if atomic.LoadUint64(&subscriber.consumed) < limit.timestamp {
+			slow = append(slow, subscriber)
+			delete(r.subscribers, subscriber)
+		}
+	}
+
+	return slow
+}
+
+// release stops counting the oldest segments once every subscriber has consumed them. The current
+// segment is always counted. The lock must be held.
+func (r *watchLag) release() {
+	oldest := ^uint64(0)
+	for subscriber := range r.subscribers {
+		if consumed := atomic.LoadUint64(&subscriber.consumed); consumed < oldest {
+			oldest = consumed
+		}
+	}
+
+	released := 0
+	for released < len(r.segments)-1 && r.segments[released].timestamp <= oldest {
+		released++
+	}
+	r.segments = append(r.segments[:0], r.segments[released:]...)
+}
@@ -0,0 +1,89 @@
+package lsmtree
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWatchLag(t *testing.T) {
+	// counted returns the ids of the segments that are still being counted.
+	counted := func(r *watchLag) []uint64 {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		r.release()
+		ids := make([]uint64, len(r.segments))
+		for i, segment := range r.segments {
+			ids[i] = segment.id
+		}
+
+		return ids
+	}
+
+	t.Run("no subscribers", func(t *testing.T) {
+		r := newWatchLag(0)
+		r.Appended(1, 1)
+		r.Appended(1, 2)
+		r.Appended(2, 3)
+
+		// Only the current segment is counted.
+		assert.Equal(t, []uint64{2}, counted(r))
+	})
+
+	t.Run("subscribers", func(t *testing.T) {
+		r := newWatchLag(0)
+		a := r.Subscribe(0, func(err error) { t.Fatal("should not be disconnected") })
+		b := r.Subscribe(0, func(err error) { t.Fatal("should not be disconnected") })
+
+		r.Appended(1, 1)
+		r.Appended(1, 2)
+		r.Appended(2, 3)
+		r.Appended(3, 4)
+		assert.Equal(t, []uint64{1, 2, 3}, counted(r))
+
+		// Segment 1 is only released once both subscribers have consumed all of it.
+		a.Consumed(2)
+		assert.Equal(t, []uint64{1, 2, 3}, counted(r))
+		b.Consumed(1)
+		assert.Equal(t, []uint64{1, 2, 3}, counted(r))
+		b.Consumed(3)
+		assert.Equal(t, []uint64{2, 3}, counted(r))
+
+		// Consuming an older timestamp does not move a subscriber backwards.
+		a.Consumed(1)
+		assert.Equal(t, []uint64{2, 3}, counted(r))
+
+		// Unsubscribing releases everything the subscriber was behind on.
+		r.Unsubscribe(a)
+		assert.Equal(t, []uint64{3}, counted(r))
+	})
+
+	t.Run("slow subscribers are disconnected", func(t *testing.T) {
+		r := newWatchLag(2)
+
+		var disconnected []error
+		slow := r.Subscribe(0, func(err error) {
+			disconnected = append(disconnected, err)
+		})
+		fast := r.Subscribe(0, func(err error) { t.Fatal("should not be disconnected") })
+
+		for segment := uint64(1); segment <= 3; segment++ {
+			r.Appended(segment, segment)
+			fast.Consumed(segment)
+		}
+		assert.Empty(t, disconnected)
+		assert.Equal(t, []uint64{1, 2, 3}, counted(r))
+
+		// The slow subscriber now has not consumed three segments, one more than allowed.
+		r.Appended(4, 4)
+		fast.Consumed(4)
+		assert.Equal(t, []error{ErrWatchTooSlow}, disconnected)
+		assert.Equal(t, []uint64{4}, counted(r))
+
+		// Once disconnected the subscriber is not disconnected again, and unsubscribing it does
+		// nothing.
+		r.Appended(5, 5)
+		r.Unsubscribe(slow)
+		assert.Len(t, disconnected, 1)
+	})
+}